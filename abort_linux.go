@@ -0,0 +1,99 @@
+package fuse
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Find the ID under /sys/fs/fuse/connections of the fuse connection mounted
+// at dir, reading /proc/self/mountinfo rather than stat'ing dir so as not to
+// send the file system an op.
+func fuseConnectionID(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Lines look like:
+	//
+	//     36 35 0:45 / /mnt/foo rw,nosuid,nodev - fuse.foo foo rw,user_id=0
+	//
+	// The third field is the device number, and the fifth the mount point with
+	// special characters octal-escaped.
+	var id string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || unescapeMountInfo(fields[4]) != dir {
+			continue
+		}
+
+		parts := strings.SplitN(fields[2], ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		major, err1 := strconv.ParseUint(parts[0], 10, 32)
+		minor, err2 := strconv.ParseUint(parts[1], 10, 32)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		// The kernel names the directory after its internal dev_t encoding.
+		// Keep looking in case of mounts stacked on the same directory; the
+		// last one is on top.
+		id = strconv.FormatUint(major<<20|minor, 10)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if id == "" {
+		return "", fmt.Errorf("No mount found at %q", dir)
+	}
+
+	return id, nil
+}
+
+// Undo the octal escaping of spaces, tabs, newlines and backslashes in
+// /proc/self/mountinfo.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// Abort the fuse connection with the given ID, causing all pending and future
+// requests on it to fail with ENOTCONN.
+func abortConnection(id string) error {
+	return ioutil.WriteFile(
+		filepath.Join("/sys/fs/fuse/connections", id, "abort"),
+		[]byte("1"),
+		0)
+}
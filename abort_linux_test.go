@@ -0,0 +1,29 @@
+package fuse
+
+import (
+	"testing"
+)
+
+func Test_unescapeMountInfo(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want string
+	}{
+		{"/mnt/foo", "/mnt/foo"},
+		{`/mnt/foo\040bar`, "/mnt/foo bar"},
+		{`/mnt/a\011b\134c`, "/mnt/a\tb\\c"},
+		{`/mnt/trailing\`, `/mnt/trailing\`},
+	}
+
+	for _, tc := range testCases {
+		if got := unescapeMountInfo(tc.in); got != tc.want {
+			t.Errorf("unescapeMountInfo(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func Test_fuseConnectionID(t *testing.T) {
+	if _, err := fuseConnectionID("/no/such/mount/point"); err == nil {
+		t.Errorf("expected an error, got nil")
+	}
+}
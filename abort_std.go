@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package fuse
+
+import "syscall"
+
+// There is no equivalent of /sys/fs/fuse/connections elsewhere; callers fall
+// back to unmounting.
+func fuseConnectionID(dir string) (string, error) {
+	return "", syscall.ENOSYS
+}
+
+func abortConnection(id string) error {
+	return syscall.ENOSYS
+}
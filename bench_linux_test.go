@@ -0,0 +1,142 @@
+package fuse
+
+import (
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A server that answers every op as fillBenchReply does.
+type benchServer struct{}
+
+func (benchServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		fillBenchReply(op)
+		c.Reply(ctx, nil)
+	}
+}
+
+// Serve benchmark requests from a socket standing in for the kernel, which is
+// returned.
+func startBenchServer(tb testing.TB) *os.File {
+	c, kernel, _ := initWithKernelSocket(tb, MountConfig{}, 0, 0)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		benchServer{}.ServeOps(c)
+	}()
+
+	// Closing the kernel's end makes ReadOp return an error.
+	tb.Cleanup(func() {
+		kernel.Close()
+		<-done
+	})
+
+	return kernel
+}
+
+// Play the kernel's part: send msg with its unique ID set to the given one.
+func sendBenchRequest(kernel *os.File, msg []byte, unique uint64) error {
+	(*fusekernel.InHeader)(unsafe.Pointer(&msg[0])).Unique = unique
+	_, err := kernel.Write(msg)
+	return err
+}
+
+// Receive a reply, checking that it is a success.
+func recvBenchReply(tb testing.TB, kernel *os.File, buf []byte) {
+	n, err := kernel.Read(buf)
+	if err != nil {
+		tb.Fatalf("Read: %v", err)
+	}
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	if n < int(unsafe.Sizeof(*h)) || h.Error != 0 {
+		tb.Fatalf("Unexpected reply: %x", buf[:n])
+	}
+}
+
+// Round trips through ReadOp and Reply, one request at a time, which is the
+// latency the kernel sees for each op.
+func BenchmarkServeRoundTrip(b *testing.B) {
+	for _, req := range benchRequests() {
+		req := req
+		b.Run(req.name, func(b *testing.B) {
+			kernel := startBenchServer(b)
+			msg := append([]byte(nil), req.msg...)
+			buf := make([]byte, buffer.MaxReadSize+4096)
+
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := sendBenchRequest(kernel, msg, uint64(i)+2); err != nil {
+					b.Fatalf("Write: %v", err)
+				}
+
+				recvBenchReply(b, kernel, buf)
+			}
+		})
+	}
+}
+
+// Requests sent as fast as the server takes them, as when many processes use
+// the mount at once.
+func BenchmarkServePipelined(b *testing.B) {
+	for _, req := range benchRequests() {
+		req := req
+		b.Run(req.name, func(b *testing.B) {
+			kernel := startBenchServer(b)
+			msg := append([]byte(nil), req.msg...)
+			buf := make([]byte, buffer.MaxReadSize+4096)
+
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if err := sendBenchRequest(kernel, msg, uint64(i)+2); err != nil {
+						b.Errorf("Write: %v", err)
+						return
+					}
+				}
+			}()
+
+			for i := 0; i < b.N; i++ {
+				recvBenchReply(b, kernel, buf)
+			}
+		})
+	}
+}
+
+func TestServeAllocs(t *testing.T) {
+	for _, req := range benchRequests() {
+		kernel := startBenchServer(t)
+		msg := append([]byte(nil), req.msg...)
+		buf := make([]byte, buffer.MaxReadSize+4096)
+
+		var unique uint64 = 1
+		allocs := testing.AllocsPerRun(100, func() {
+			unique++
+			if err := sendBenchRequest(kernel, msg, unique); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+
+			recvBenchReply(t, kernel, buf)
+		})
+
+		if allocs > req.serveAllocs {
+			t.Errorf("%s: %v allocations, budget %v", req.name, allocs, req.serveAllocs)
+		}
+	}
+}
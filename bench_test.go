@@ -0,0 +1,147 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The protocol the hot path benchmarks are run against.
+var benchProtocol = fusekernel.Protocol{
+	Major: fusekernel.ProtoVersionMaxMajor,
+	Minor: fusekernel.ProtoVersionMaxMinor,
+}
+
+// The size of the reads and writes in the benchmark requests.
+const benchIOSize = 4096
+
+// A request typical of a busy mount, and the most allocations decoding it
+// and encoding its reply may take (see TestHotPathAllocs), as well as serving
+// it through ReadOp and Reply (see TestServeAllocs). Raising a budget should
+// be a deliberate decision, not a way of making the test pass.
+type benchRequest struct {
+	name        string
+	msg         []byte
+	allocs      float64
+	serveAllocs float64
+}
+
+func benchRequests() []benchRequest {
+	read := fusekernel.ReadIn{Fh: 7, Size: benchIOSize}
+	write := fusekernel.WriteIn{Fh: 7, Size: benchIOSize}
+
+	return []benchRequest{
+		{
+			name:        "GetInodeAttributes",
+			msg:         rawMessage(fusekernel.OpGetattr, make([]byte, unsafe.Sizeof(fusekernel.GetattrIn{}))),
+			allocs:      4,
+			serveAllocs: 9,
+		},
+		{
+			name:        "LookUpInode",
+			msg:         rawMessage(fusekernel.OpLookup, []byte("some_file_name\x00")),
+			allocs:      5,
+			serveAllocs: 10,
+		},
+		{
+			name:        "ReadFile",
+			msg:         rawMessage(fusekernel.OpRead, (*[unsafe.Sizeof(read)]byte)(unsafe.Pointer(&read))[:]),
+			allocs:      3,
+			serveAllocs: 8,
+		},
+		{
+			name: "WriteFile",
+			msg: rawMessage(
+				fusekernel.OpWrite,
+				(*[unsafe.Sizeof(write)]byte)(unsafe.Pointer(&write))[:],
+				make([]byte, benchIOSize)),
+			allocs:      4,
+			serveAllocs: 9,
+		},
+	}
+}
+
+// Fill in a successful response to one of the benchmark requests, as a file
+// system would.
+func fillBenchReply(op interface{}) {
+	switch o := op.(type) {
+	case *fuseops.GetInodeAttributesOp:
+		o.Attributes = fuseops.InodeAttributes{Size: benchIOSize, Nlink: 1, Mode: 0644}
+
+	case *fuseops.LookUpInodeOp:
+		o.Entry.Child = 3
+		o.Entry.Attributes = fuseops.InodeAttributes{Size: benchIOSize, Nlink: 1, Mode: 0644}
+
+	case *fuseops.ReadFileOp:
+		o.BytesRead = len(o.Dst)
+	}
+}
+
+// Decodes requests and encodes their replies the way the serve loop does, but
+// from and to memory rather than a device.
+type benchPipeline struct {
+	c      *Connection
+	r      bytes.Reader
+	inMsg  *buffer.InMessage
+	outMsg buffer.OutMessage
+}
+
+func newBenchPipeline() *benchPipeline {
+	return &benchPipeline{
+		c: &Connection{
+			cfg:      MountConfig{OpContext: context.Background()},
+			logger:   NewLevelLogger(log.New(&bytes.Buffer{}, "", 0), LogError),
+			protocol: benchProtocol,
+		},
+		inMsg: buffer.NewInMessage(buffer.MaxWriteSize),
+	}
+}
+
+func (p *benchPipeline) run(tb testing.TB, msg []byte) {
+	p.r.Reset(msg)
+	if err := p.inMsg.Init(&p.r); err != nil {
+		tb.Fatalf("Init: %v", err)
+	}
+
+	p.outMsg.Reset()
+	op, err := convertInMessage(&p.c.cfg, p.inMsg, &p.outMsg, p.c.protocol)
+	if err != nil {
+		tb.Fatalf("convertInMessage: %v", err)
+	}
+
+	fillBenchReply(op)
+	p.c.applyDefaultTimeouts(op)
+	p.c.kernelResponse(&p.outMsg, p.inMsg.Header().Unique, op, nil)
+}
+
+func BenchmarkDecodeEncode(b *testing.B) {
+	for _, req := range benchRequests() {
+		req := req
+		b.Run(req.name, func(b *testing.B) {
+			p := newBenchPipeline()
+			b.SetBytes(int64(len(req.msg)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				p.run(b, req.msg)
+			}
+		})
+	}
+}
+
+func TestHotPathAllocs(t *testing.T) {
+	for _, req := range benchRequests() {
+		p := newBenchPipeline()
+		allocs := testing.AllocsPerRun(100, func() { p.run(t, req.msg) })
+		if allocs > req.allocs {
+			t.Errorf("%s: %v allocations, budget %v", req.name, allocs, req.allocs)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package fuse
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestReadDontCache(t *testing.T) {
+	c, kernel, _ := initWithKernelSocket(t, MountConfig{}, 0, 0)
+
+	// Answer a read of inode 2 (cf. rawMessage) with the supplied number of
+	// bytes, asking for them not to be cached.
+	read := func(bytesRead int) {
+		msg := rawMessage(fusekernel.OpRead, wireBytes(fusekernel.ReadIn{Offset: 8192, Size: 4096}))
+		if _, err := kernel.Write(msg); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		readOp, ok := op.(*fuseops.ReadFileOp)
+		if !ok {
+			t.Fatalf("Unexpected op: %#v", op)
+		}
+
+		readOp.BytesRead = bytesRead
+		readOp.DontCache = true
+		if err := c.Reply(ctx, nil); err != nil {
+			t.Fatalf("Reply: %v", err)
+		}
+	}
+
+	// Read the next message written to the device, returning its header and
+	// body.
+	buf := make([]byte, 1<<16)
+	next := func() (*fusekernel.OutHeader, []byte) {
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		const hdrSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+		return (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0])), buf[hdrSize:n]
+	}
+
+	// The reply is followed by an invalidation of the range read.
+	read(100)
+	if h, body := next(); h.Unique != 1 || h.Error != 0 || len(body) != 100 {
+		t.Fatalf("Unexpected reply: %+v, %d bytes", *h, len(body))
+	}
+
+	h, body := next()
+	if h.Unique != 0 || h.Error != fusekernel.NotifyCodeInvalInode || len(body) != fusekernel.NotifyInvalInodeOutSize {
+		t.Fatalf("Unexpected notification: %+v, %d bytes", *h, len(body))
+	}
+
+	out := (*fusekernel.NotifyInvalInodeOut)(unsafe.Pointer(&body[0]))
+	if out.Ino != 2 || out.Off != 8192 || out.Len != 100 {
+		t.Errorf("Unexpected invalidation: %+v", *out)
+	}
+
+	// Nothing was cached by an empty read, so nothing is invalidated: the
+	// message after its reply is the next one sent.
+	read(0)
+	if h, _ := next(); h.Unique != 1 || h.Error != 0 {
+		t.Fatalf("Unexpected reply: %+v", *h)
+	}
+
+	if err := c.NotifyPoll(17); err != nil {
+		t.Fatalf("NotifyPoll: %v", err)
+	}
+
+	if h, _ := next(); h.Error != fusekernel.NotifyCodePoll {
+		t.Errorf("Unexpected message after an empty read: %+v", *h)
+	}
+}
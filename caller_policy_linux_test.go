@@ -0,0 +1,93 @@
+package fuse
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestCallerPolicy(t *testing.T) {
+	// A policy that turns away everyone but root, noting what it was asked.
+	var asked []string
+	cfg := MountConfig{
+		CallerPolicy: func(op interface{}, caller fuseops.OpContext) error {
+			asked = append(asked, fmt.Sprintf("%T from %d", op, caller.Uid))
+			if caller.Uid != 0 {
+				return syscall.EACCES
+			}
+
+			return nil
+		},
+	}
+
+	c, kernel, _ := initWithKernelSocket(t, cfg, 0, 0)
+	if len(asked) != 0 {
+		t.Errorf("Policy asked about %q during init", asked)
+	}
+
+	fromUID := func(uid uint32, m []byte) []byte {
+		(*fusekernel.InHeader)(unsafe.Pointer(&m[0])).Uid = uid
+		return m
+	}
+
+	getattrIn := make([]byte, unsafe.Sizeof(fusekernel.GetattrIn{}))
+	msgs := [][]byte{
+		fromUID(1000, rawMessageID(5, fusekernel.OpGetattr, getattrIn)),
+		fromUID(1000, rawMessageID(6, fusekernel.OpForget, wireBytes(fusekernel.ForgetIn{Nlookup: 1}))),
+		fromUID(0, rawMessageID(7, fusekernel.OpGetattr, getattrIn)),
+		fromUID(1000, rawMessageID(8, fusekernel.OpDestroy)),
+	}
+
+	for _, m := range msgs {
+		if _, err := kernel.Write(m); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// The rejected getattr never reaches us; everything else does.
+	var got []string
+	for range msgs[1:] {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		got = append(got, fmt.Sprintf("%T", op))
+		if _, ok := op.(*fuseops.GetInodeAttributesOp); ok {
+			c.Reply(ctx, nil)
+		}
+	}
+
+	wantOps := []string{"*fuseops.ForgetInodeOp", "*fuseops.GetInodeAttributesOp", "*fuseops.DestroyOp"}
+	if fmt.Sprint(got) != fmt.Sprint(wantOps) {
+		t.Errorf("Ops %q, want %q", got, wantOps)
+	}
+
+	// Only the getattrs were put to the policy.
+	wantAsked := []string{"*fuseops.GetInodeAttributesOp from 1000", "*fuseops.GetInodeAttributesOp from 0"}
+	if fmt.Sprint(asked) != fmt.Sprint(wantAsked) {
+		t.Errorf("Policy asked about %q, want %q", asked, wantAsked)
+	}
+
+	// The rejected getattr was failed with the policy's error, and the other
+	// answered as normal.
+	buf := make([]byte, 4096)
+	for _, want := range []struct {
+		unique uint64
+		errno  int32
+	}{{5, -int32(syscall.EACCES)}, {7, 0}} {
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+		if n < int(unsafe.Sizeof(*h)) || h.Unique != want.unique || h.Error != want.errno {
+			t.Errorf("Reply %x, want unique %d with error %d", buf[:n], want.unique, want.errno)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"runtime"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// Open a new device attached to the same connection as dev, with its own
+// queue of requests being processed and replied to.
+func cloneDevice(dev *os.File) (*os.File, error) {
+	clone, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := uint32(dev.Fd())
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		clone.Fd(),
+		fusekernel.DevIocClone,
+		uintptr(unsafe.Pointer(&fd)))
+	runtime.KeepAlive(dev)
+
+	if errno != 0 {
+		clone.Close()
+		return nil, &os.SyscallError{Syscall: "FUSE_DEV_IOC_CLONE", Err: errno}
+	}
+
+	return clone, nil
+}
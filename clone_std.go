@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package fuse
+
+import (
+	"os"
+	"syscall"
+)
+
+// Cloning the device is Linux only.
+func cloneDevice(dev *os.File) (*os.File, error) {
+	return nil, syscall.ENOSYS
+}
@@ -16,13 +16,15 @@ package fuse
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"os"
 	"path"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/jacobsa/fuse/fuseops"
@@ -57,22 +59,83 @@ const maxReadahead = 1 << 20
 // Connection represents a connection to the fuse kernel process. It is used to
 // receive and reply to requests from the kernel.
 type Connection struct {
-	cfg         MountConfig
-	debugLogger *log.Logger
-	errorLogger *log.Logger
+	cfg    MountConfig
+	logger Logger
 
 	// The device through which we're talking to the kernel, and the protocol
 	// version that we're using to talk to it.
 	dev      *os.File
 	protocol fusekernel.Protocol
 
+	// With MountConfig.DeviceReaders > 1, the clones of dev being read from in
+	// addition to it, the channel through which the reader goroutines hand
+	// messages to ReadOp, and a channel closed to stop them. Serviced by
+	// readers.go, and constant after newConnection.
+	clones   []*os.File
+	incoming chan readResult
+	closing  chan struct{}
+
+	// With MountConfig.UseIOURing, the rings through which each device is read
+	// and written. Serviced by uring.go, and constant after newConnection.
+	rings map[*os.File]*deviceRings
+
+	// With MountConfig.RecordOps, serializes writes to it, and the error that
+	// stopped recording, if any. Serviced by replay.go.
+	recordMu  sync.Mutex
+	recordErr error // GUARDED_BY(recordMu)
+
+	// The effective limits negotiated with the kernel during Init. Constant
+	// afterward.
+	maxWrite     uint32
+	maxReadahead uint32
+	features     Features
+
+	// The directory on which the connection is mounted and, if known, its ID
+	// under /sys/fs/fuse/connections. Set by Mount once mounting completes, and
+	// used by Abort.
+	//
+	// GUARDED_BY(mu)
+	mountPoint   string
+	connectionID string
+
+	// Non-zero once Shutdown has begun.
+	shuttingDown int32 // Atomic
+
 	mu sync.Mutex
 
 	// A map from fuse "unique" request ID (*not* the op ID for logging used
 	// above) to a function that cancel's its associated context.
 	//
 	// GUARDED_BY(mu)
-	cancelFuncs map[uint64]func()
+	cancelFuncs map[uint64]context.CancelCauseFunc
+
+	// The number of ops delivered by ReadOp and not yet replied to, and the
+	// channels to close when it next drops to zero. Serviced by shutdown.go.
+	//
+	// GUARDED_BY(mu)
+	inFlight     int
+	drainWaiters []chan struct{}
+
+	// NotifyRetrieve calls awaiting the kernel's reply, indexed by the unique
+	// ID sent with the notification, and the last such ID issued. Serviced by
+	// notify.go.
+	//
+	// GUARDED_BY(mu)
+	retrieves  map[uint64]*retrieveWaiter
+	retrieveID uint64
+
+	// With more than one reader, an interrupt may be read before the request
+	// it refers to has been returned by ReadOp. The IDs of such requests, to
+	// be cancelled as soon as they begin.
+	//
+	// GUARDED_BY(mu)
+	earlyInterrupts map[uint64]struct{}
+
+	// With a control socket, the ops returned by ReadOp and not yet replied
+	// to, indexed by fuse ID. Serviced by control.go.
+	//
+	// GUARDED_BY(mu)
+	running map[uint64]runningOp
 
 	// Freelists, serviced by freelists.go.
 	inMessages  freelist.Freelist // GUARDED_BY(mu)
@@ -82,34 +145,74 @@ type Connection struct {
 // State that is maintained for each in-flight op. This is stuffed into the
 // context that the user uses to reply to the op.
 type opState struct {
+	inMsg   *buffer.InMessage
+	outMsg  *buffer.OutMessage
+	op      interface{}
+	buffers *opBuffers
+	trace   *OpTrace
+
+	// The device the op was read from, to which its reply must be written.
+	dev *os.File
+}
+
+// The messages for an in-flight op, which go back to the freelists once the
+// op has been replied to and every hold taken by RetainBuffers released.
+type opBuffers struct {
+	c      *Connection
 	inMsg  *buffer.InMessage
 	outMsg *buffer.OutMessage
-	op     interface{}
+
+	// The number of holds on the messages, counting one for the reply.
+	refs int32 // Accessed atomically
+}
+
+func (b *opBuffers) release() {
+	switch n := atomic.AddInt32(&b.refs, -1); {
+	case n == 0:
+		b.c.putInMessage(b.inMsg)
+		b.c.putOutMessage(b.outMsg)
+
+	case n < 0:
+		panic("Buffers released too many times")
+	}
 }
 
 // Create a connection wrapping the supplied file descriptor connected to the
 // kernel. You must eventually call c.close().
-//
-// The loggers may be nil.
 func newConnection(
 	cfg MountConfig,
-	debugLogger *log.Logger,
-	errorLogger *log.Logger,
+	logger Logger,
 	dev *os.File) (*Connection, error) {
 	c := &Connection{
 		cfg:         cfg,
-		debugLogger: debugLogger,
-		errorLogger: errorLogger,
+		logger:      logger,
 		dev:         dev,
-		cancelFuncs: make(map[uint64]func()),
+		cancelFuncs: make(map[uint64]context.CancelCauseFunc),
 	}
 
-	// Initialize.
-	if err := c.Init(); err != nil {
+	if cfg.ControlSocket != "" {
+		c.running = make(map[uint64]runningOp)
+	}
+
+	// Initialize, or pick up where a previous daemon left off.
+	if cfg.ResumeState != nil {
+		if err := c.resume(cfg.ResumeState); err != nil {
+			c.close()
+			return nil, fmt.Errorf("Resuming: %w", err)
+		}
+	} else if err := c.Init(); err != nil {
 		c.close()
-		return nil, fmt.Errorf("Init: %v", err)
+		return nil, fmt.Errorf("Init: %w", err)
+	}
+
+	// Set up any further readers now that the kernel is talking to us.
+	c.cloneDevices()
+	if c.cfg.UseIOURing {
+		c.setUpRings()
 	}
 
+	c.startReaders()
+
 	return c, nil
 }
 
@@ -135,7 +238,7 @@ func (c *Connection) Init() error {
 
 	if initOp.Kernel.LT(min) {
 		c.Reply(ctx, syscall.EPROTO)
-		return fmt.Errorf("Version too old: %v", initOp.Kernel)
+		return fmt.Errorf("%w: %v", ErrKernelTooOld, initOp.Kernel)
 	}
 
 	// Downgrade our protocol if necessary.
@@ -148,16 +251,30 @@ func (c *Connection) Init() error {
 		c.protocol = initOp.Kernel
 	}
 
+	kernelFlags := initOp.Flags
+	kernelFlags2 := initOp.Flags2
 	cacheSymlinks := initOp.Flags&fusekernel.InitCacheSymlinks > 0
 	noOpenSupport := initOp.Flags&fusekernel.InitNoOpenSupport > 0
 	noOpendirSupport := initOp.Flags&fusekernel.InitNoOpendirSupport > 0
+	maxPagesSupport := initOp.Flags&fusekernel.InitMaxPages > 0
+	atomicTruncSupport := initOp.Flags&fusekernel.InitAtomicTrunc > 0
+	autoInvalDataSupport := initOp.Flags&fusekernel.InitAutoInvalData > 0
+	explicitInvalDataSupport := initOp.Flags&fusekernel.InitExplicitInvalData > 0
+	readdirplusSupport := initOp.Flags&fusekernel.InitDoReaddirplus > 0
+	ioctlDirSupport := initOp.Flags&fusekernel.InitHasIoctlDir > 0
+	posixLocksSupport := initOp.Flags&fusekernel.InitPosixLocks > 0
+	flockLocksSupport := initOp.Flags&fusekernel.InitFlockLocks > 0
+	passthroughSupport := initOp.Flags2&fusekernel.InitPassthrough > 0
+	idmapSupport := initOp.Flags2&fusekernel.InitAllowIdmap > 0
+	kernelMaxReadahead := initOp.MaxReadahead
 
 	// Respond to the init op.
 	initOp.Library = c.protocol
 	initOp.MaxReadahead = maxReadahead
-	initOp.MaxWrite = buffer.MaxWriteSize
+	initOp.MaxWrite = uint32(c.cfg.maxWrite())
 
 	initOp.Flags = 0
+	initOp.Flags2 = 0
 
 	// Tell the kernel not to use pitifully small 4 KiB writes.
 	initOp.Flags |= fusekernel.InitBigWrites
@@ -166,12 +283,43 @@ func (c *Connection) Init() error {
 		initOp.Flags |= fusekernel.InitAsyncRead
 	}
 
-	// kernel 4.20 increases the max from 32 -> 256
+	// Ask for enough pages per request for our largest write. Kernel 4.20
+	// increases the max from 32 -> 256, and 6.13 makes it configurable; the
+	// kernel silently caps what we ask for at its limit.
 	initOp.Flags |= fusekernel.InitMaxPages
-	initOp.MaxPages = 256
+	initOp.MaxPages = maxPagesFor(c.cfg.maxWrite())
+
+	// Record the limits that will actually be in effect. The kernel uses the
+	// smaller of our readahead and its own, and never sends more than its
+	// maximum number of pages per request (32 if it doesn't support raising
+	// it) in a write.
+	c.maxReadahead = initOp.MaxReadahead
+	if kernelMaxReadahead < c.maxReadahead {
+		c.maxReadahead = kernelMaxReadahead
+	}
+
+	maxPages := uint32(32)
+	if maxPagesSupport {
+		maxPages = uint32(initOp.MaxPages)
+	}
+
+	c.maxWrite = initOp.MaxWrite
+	if pagesSize := maxPages * uint32(os.Getpagesize()); pagesSize < c.maxWrite {
+		c.maxWrite = pagesSize
+	}
+
+	// Let the file system hand over open files to backing files, in which case
+	// the kernel needs to know how deeply file systems are stacked below it
+	// (just one level, the backing file's own file system). The kernel refuses
+	// passthrough in combination with writeback caching.
+	passthrough := c.cfg.EnablePassthrough && passthroughSupport
+	if passthrough {
+		initOp.Flags2 |= fusekernel.InitPassthrough
+		initOp.MaxStackDepth = 1
+	}
 
 	// Enable writeback caching if the user hasn't asked us not to.
-	if !c.cfg.DisableWritebackCaching {
+	if !c.cfg.DisableWritebackCaching && !passthrough {
 		initOp.Flags |= fusekernel.InitWritebackCache
 	}
 
@@ -193,14 +341,79 @@ func (c *Connection) Init() error {
 		initOp.Flags |= fusekernel.InitNoOpendirSupport
 	}
 
+	// Have the kernel leave O_TRUNC to OpenFile, rather than following the open
+	// with a separate truncating setattr.
+	if c.cfg.EnableAtomicTrunc && atomicTruncSupport {
+		initOp.Flags |= fusekernel.InitAtomicTrunc
+	}
+
+	// Have the kernel send locks to the file system, rather than keeping track
+	// of them locally.
+	if c.cfg.EnablePosixLocks && posixLocksSupport {
+		initOp.Flags |= fusekernel.InitPosixLocks
+	}
+
+	if c.cfg.EnableFlockLocks && flockLocksSupport {
+		initOp.Flags |= fusekernel.InitFlockLocks
+	}
+
+	// Choose how the kernel invalidates cached file data. The kernel prefers
+	// auto invalidation if both are offered, so we never send both.
+	switch {
+	case c.cfg.EnableAutoInvalData && autoInvalDataSupport:
+		initOp.Flags |= fusekernel.InitAutoInvalData
+	case c.cfg.EnableExplicitInvalData && explicitInvalDataSupport:
+		initOp.Flags |= fusekernel.InitExplicitInvalData
+	}
+
+	// Have the kernel read directories with ReadDirPlusOp, either always or
+	// when it guesses that the attributes will be wanted (Linux >= 3.9).
+	if (c.cfg.EnableReaddirplus || c.cfg.EnableReaddirplusAuto) && readdirplusSupport {
+		initOp.Flags |= fusekernel.InitDoReaddirplus
+		if c.cfg.EnableReaddirplusAuto {
+			initOp.Flags |= fusekernel.InitReaddirplusAuto
+		}
+	}
+
+	// Send ioctls on directories to the file system too, rather than failing
+	// them with ENOTTY.
+	if ioctlDirSupport {
+		initOp.Flags |= fusekernel.InitHasIoctlDir
+	}
+
+	// Let Mount set up an ID-mapped mount once we're initialized (Linux >=
+	// 6.12). The kernel only allows this with default_permissions.
+	if c.cfg.IDMapUserNamespace != nil && !c.cfg.DisableDefaultPermissions && idmapSupport {
+		initOp.Flags2 |= fusekernel.InitAllowIdmap
+	}
+
 	// Tell the Kernel to allow sending parallel lookup and readdir operations.
 	if c.cfg.EnableParallelDirOps {
 		initOp.Flags |= fusekernel.InitParallelDirOps
 	}
 
+	// The kernel enables only those of our flags that it also offered.
+	c.features = featuresForFlags(initOp.Flags&kernelFlags, initOp.Flags2&kernelFlags2)
+
+	// Rename flags have no init flag; the kernel sends them to any file system
+	// speaking a new enough protocol until it is told they are unsupported.
+	c.features.RenameFlags = c.cfg.EnableRenameFlags && c.protocol.HasRename2()
+
 	return c.Reply(ctx, nil)
 }
 
+// Return the number of pages per request to ask the kernel for in order to
+// receive writes of the supplied size.
+func maxPagesFor(maxWrite int) uint16 {
+	pageSize := os.Getpagesize()
+	n := (maxWrite + pageSize - 1) / pageSize
+	if n > math.MaxUint16 {
+		n = math.MaxUint16
+	}
+
+	return uint16(n)
+}
+
 // Log information for an operation with the given ID. calldepth is the depth
 // to use when recovering file:line information with runtime.Caller.
 func (c *Connection) debugLog(
@@ -208,7 +421,7 @@ func (c *Connection) debugLog(
 	calldepth int,
 	format string,
 	v ...interface{}) {
-	if c.debugLogger == nil {
+	if !c.logger.Enabled(LogDebug, LogOp) {
 		return
 	}
 
@@ -232,13 +445,13 @@ func (c *Connection) debugLog(
 		fmt.Sprintf(format, v...))
 
 	// Print it.
-	c.debugLogger.Println(msg)
+	c.logger.Debugf(LogOp, "%s", msg)
 }
 
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) recordCancelFunc(
 	fuseID uint64,
-	f func()) {
+	f context.CancelCauseFunc) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -258,6 +471,8 @@ func (c *Connection) recordCancelFunc(
 func (c *Connection) beginOp(
 	opCode uint32,
 	fuseID uint64) context.Context {
+	c.opStarted()
+
 	// Start with the parent context.
 	ctx := c.cfg.OpContext
 
@@ -270,9 +485,13 @@ func (c *Connection) beginOp(
 	//
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
 	if opCode != fusekernel.OpForget {
-		var cancel func()
-		ctx, cancel = context.WithCancel(ctx)
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
 		c.recordCancelFunc(fuseID, cancel)
+
+		if c.takeEarlyInterrupt(fuseID) {
+			cancel(ErrInterrupted)
+		}
 	}
 
 	return ctx
@@ -302,9 +521,12 @@ func (c *Connection) finishOp(
 			panic(fmt.Sprintf("Unknown request ID in finishOp: %v", fuseID))
 		}
 
-		cancel()
+		cancel(nil)
 		delete(c.cancelFuncs, fuseID)
+		delete(c.running, fuseID)
 	}
+
+	c.opFinished()
 }
 
 // LOCKS_EXCLUDED(c.mu)
@@ -326,83 +548,95 @@ func (c *Connection) handleInterrupt(fuseID uint64) {
 	//
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
 	// Cf. http://comments.gmane.org/gmane.comp.file-systems.fuse.devel/14675
+	//
+	// That no longer holds with several readers, which may return the interrupt
+	// from ReadOp first; remember it for beginOp in that case.
 	cancel, ok := c.cancelFuncs[fuseID]
 	if !ok {
+		if len(c.clones) > 0 {
+			c.recordEarlyInterrupt(fuseID)
+		}
+
 		return
 	}
 
-	cancel()
+	cancel(ErrInterrupted)
 }
 
-// Read the next message from the kernel. The message must later be destroyed
-// using destroyInMessage.
-func (c *Connection) readMessage() (*buffer.InMessage, error) {
+// Read the next message from the kernel, returning it along with the device
+// it was read from. The message must later be destroyed using
+// destroyInMessage.
+func (c *Connection) readMessage() (*buffer.InMessage, *os.File, error) {
+	if c.incoming != nil {
+		r := <-c.incoming
+		return r.m, r.dev, r.err
+	}
+
+	m, err := c.readMessageFrom(c.dev)
+	return m, c.dev, err
+}
+
+// Read the next message from the supplied device.
+func (c *Connection) readMessageFrom(dev *os.File) (*buffer.InMessage, error) {
 	// Allocate a message.
 	m := c.getInMessage()
 
+	var r io.Reader = dev
+	if rings := c.rings[dev]; rings != nil {
+		r = rings.reads
+	}
+
 	// Loop past transient errors.
-	for {
+	for attempt := 1; ; attempt++ {
 		// Attempt a read.
-		err := m.Init(c.dev)
-
-		// Special cases:
-		//
-		//  *  ENODEV means fuse has hung up.
-		//
-		//  *  EINTR means we should try again. (This seems to happen often on
-		//     OS X, cf. http://golang.org/issue/11180)
-		//
-		if pe, ok := err.(*os.PathError); ok {
-			switch pe.Err {
-			case syscall.ENODEV:
-				err = io.EOF
-
-			case syscall.EINTR:
-				err = nil
-				continue
+		err := m.Init(r)
+		if err == nil {
+			if c.cfg.RecordOps != nil {
+				c.record(m)
 			}
-		}
 
-		if err != nil {
-			c.putInMessage(m)
-			return nil, err
+			return m, nil
 		}
 
-		return m, nil
-	}
-}
+		e := &DeviceError{Op: "read", Attempt: attempt, Err: err}
+		switch c.deviceErrorAction(e) {
+		case DeviceErrorRetry:
+			continue
 
-// Write the supplied message to the kernel.
-func (c *Connection) writeMessage(msg []byte) error {
-	// Avoid the retry loop in os.File.Write.
-	n, err := syscall.Write(int(c.dev.Fd()), msg)
-	if err != nil {
-		return err
-	}
+		case DeviceErrorEOF:
+			c.putInMessage(m)
+			return nil, io.EOF
+		}
 
-	if n != len(msg) {
-		return fmt.Errorf("Wrote %d bytes; expected %d", n, len(msg))
+		c.putInMessage(m)
+		return nil, e
 	}
-
-	return nil
 }
 
 // ReadOp consumes the next op from the kernel process, returning the op and a
 // context that should be used for work related to the op. It returns io.EOF if
-// the kernel has closed the connection.
+// the kernel has closed the connection, and a *DeviceError if reading failed
+// otherwise (cf. MountConfig.DeviceErrorPolicy). Requests that can't be
+// decoded are logged and replied to with EIO rather than returned.
 //
 // If err != nil, the user is responsible for later calling c.Reply with the
 // returned context.
 //
+// The context is cancelled if the kernel interrupts the op, e.g. because the
+// process that caused it received a signal, in which case context.Cause
+// returns ErrInterrupted. Ops that give up as a result should return the
+// context's error (or EINTR), which is replied to with EINTR.
+//
 // This function delivers ops in exactly the order they are received from
-// /dev/fuse. It must not be called multiple times concurrently.
+// /dev/fuse, unless MountConfig.DeviceReaders is greater than one. It must not
+// be called multiple times concurrently.
 //
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 	// Keep going until we find a request we know how to convert.
 	for {
 		// Read the next message from the kernel.
-		inMsg, err := c.readMessage()
+		inMsg, dev, err := c.readMessage()
 		if err != nil {
 			return nil, nil, err
 		}
@@ -411,30 +645,164 @@ func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 		outMsg := c.getOutMessage()
 		op, err = convertInMessage(&c.cfg, inMsg, outMsg, c.protocol)
 		if err != nil {
-			c.putOutMessage(outMsg)
-			return nil, nil, fmt.Errorf("convertInMessage: %v", err)
+			c.rejectMalformed(dev, inMsg, outMsg, err)
+			continue
 		}
 
-		// Choose an ID for this operation for the purposes of logging, and log it.
-		if c.debugLogger != nil {
-			c.debugLog(inMsg.Header().Unique, 1, "<- %s", describeRequest(op))
+		// Show the user its own inode IDs, if they differ from the kernel's.
+		c.remapInodes(op)
+
+		// Apply the mount's umask, if any, to newly created inodes.
+		c.applyUmask(op)
+
+		// Log the requests handled inline below. Other ops are logged by the
+		// debug tracer (cf. startTrace).
+		switch op.(type) {
+		case *interruptOp, *notifyReplyOp:
+			if c.logger.Enabled(LogDebug, LogOp) {
+				c.debugLog(inMsg.Header().Unique, 1, "<- %s", describeRequest(op))
+			}
 		}
 
 		// Special case: handle interrupt requests inline.
 		if interruptOp, ok := op.(*interruptOp); ok {
 			c.handleInterrupt(interruptOp.FuseID)
+			c.putInMessage(inMsg)
+			c.putOutMessage(outMsg)
+			continue
+		}
+
+		// Likewise the replies to retrieve notifications, which the kernel
+		// doesn't expect us to answer.
+		if replyOp, ok := op.(*notifyReplyOp); ok {
+			c.handleNotifyReply(replyOp)
+			c.putInMessage(inMsg)
+			c.putOutMessage(outMsg)
 			continue
 		}
 
 		// Set up a context that remembers information about this op.
 		ctx := c.beginOp(inMsg.Header().Opcode, inMsg.Header().Unique)
-		ctx = context.WithValue(ctx, contextKey, opState{inMsg, outMsg, op})
+		c.recordRunning(inMsg.Header().Opcode, inMsg.Header().Unique, op)
+		ctx, trace := c.startTrace(ctx, inMsg.Header().Opcode, inMsg.Header().Unique, op)
+		buffers := &opBuffers{c: c, inMsg: inMsg, outMsg: outMsg, refs: 1}
+		ctx = context.WithValue(ctx, contextKey, opState{inMsg, outMsg, op, buffers, trace, dev})
+
+		// Turn away new ops once a shutdown has begun.
+		if err := c.checkShutdown(op); err != nil {
+			c.Reply(ctx, err)
+			continue
+		}
+
+		// Fail ops from our own process fast, if asked to.
+		if err := c.checkSelfDeadlock(inMsg, op); err != nil {
+			c.Reply(ctx, err)
+			continue
+		}
+
+		// Give the caller policy, if any, a chance to reject the op before the
+		// user ever sees it.
+		if err := c.checkCallerPolicy(inMsg, op); err != nil {
+			c.Reply(ctx, err)
+			continue
+		}
 
 		// Return the op to the user.
 		return ctx, op, nil
 	}
 }
 
+// Deal with a message from the kernel that couldn't be decoded: log it, reply
+// to it with EIO if it expects a reply so that the process waiting for it
+// isn't left hanging, and free the messages.
+func (c *Connection) rejectMalformed(
+	dev *os.File,
+	inMsg *buffer.InMessage,
+	outMsg *buffer.OutMessage,
+	err error) {
+	defer c.putInMessage(inMsg)
+	defer c.putOutMessage(outMsg)
+
+	h := inMsg.Header()
+	c.logger.Errorf(LogDispatch, "Malformed request %d (opcode %d): %v", h.Unique, h.Opcode, err)
+
+	switch h.Opcode {
+	case fusekernel.OpForget, fusekernel.OpBatchForget, fusekernel.OpInterrupt, fusekernel.OpNotifyReply:
+		return
+	}
+
+	outMsg.Reset()
+	out := outMsg.OutHeader()
+	out.Unique = h.Unique
+	out.Error = -int32(syscall.EIO)
+	out.Len = uint32(outMsg.Len())
+
+	if err := c.writeReply(dev, outMsg); err != nil {
+		c.logger.Errorf(LogDispatch, "Replying to malformed request %d: %v", h.Unique, err)
+	}
+}
+
+// Apply c.cfg.CallerPolicy to the supplied op, returning the error with which
+// it should be rejected or nil if it should be delivered to the user.
+func (c *Connection) checkCallerPolicy(
+	inMsg *buffer.InMessage,
+	op interface{}) error {
+	if c.cfg.CallerPolicy == nil {
+		return nil
+	}
+
+	// Ops for which the kernel expects no reply can't be rejected; refusing to
+	// process a forget would only leak lookup counts. The init op is internal
+	// to the connection, and destroy is sent by the kernel itself.
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp, *fuseops.DestroyOp, *initOp:
+		return nil
+	}
+
+	h := inMsg.Header()
+	caller := fuseops.OpContext{
+		FuseID: h.Unique,
+		Pid:    h.Pid,
+		Uid:    h.Uid,
+		Gid:    h.Gid,
+		Header: requestHeader(inMsg),
+	}
+
+	return c.cfg.CallerPolicy(op, caller)
+}
+
+// If c.cfg.DetectSelfDeadlock is set, return EDEADLK for ops issued by our
+// own process.
+func (c *Connection) checkSelfDeadlock(
+	inMsg *buffer.InMessage,
+	op interface{}) error {
+	if !c.cfg.DetectSelfDeadlock {
+		return nil
+	}
+
+	// As for checkCallerPolicy, leave alone the ops that can't be failed.
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp, *fuseops.DestroyOp, *initOp:
+		return nil
+	}
+
+	pid := inMsg.Header().Pid
+	if pid == 0 || !isOwnProcess(pid) {
+		return nil
+	}
+
+	if c.logger.Enabled(LogError, LogDispatch) {
+		c.logger.Errorf(
+			LogDispatch,
+			"Failing %s with EDEADLK: sent by the file system's own process "+
+				"(PID %d), which would likely deadlock",
+			describeRequest(op),
+			pid)
+	}
+
+	return syscall.EDEADLK
+}
+
 // Skip errors that happen as a matter of course, since they spook users.
 func (c *Connection) shouldLogError(
 	op interface{},
@@ -445,7 +813,20 @@ func (c *Connection) shouldLogError(
 	}
 
 	// We can't log if there's nothing to log to.
-	if c.errorLogger == nil {
+	if !c.logger.Enabled(LogError, LogOp) {
+		return false
+	}
+
+	// Decide based on the errno the kernel will see, however it was wrapped.
+	errno := c.errnoForError(err)
+
+	// Ops turned away during a shutdown are expected.
+	if err == errShuttingDown {
+		return false
+	}
+
+	// Giving up on an op that was cancelled (e.g. interrupted) is routine.
+	if errno == syscall.EINTR && errors.Is(err, context.Canceled) {
 		return false
 	}
 
@@ -454,16 +835,31 @@ func (c *Connection) shouldLogError(
 		// It is totally normal for the kernel to ask to look up an inode by name
 		// and find the name doesn't exist. For example, this happens when linking
 		// a new file.
-		if err == syscall.ENOENT {
+		if errno == syscall.ENOENT {
 			return false
 		}
 	case *fuseops.GetXattrOp, *fuseops.ListXattrOp:
-		if err == syscall.ENOSYS || err == syscall.ENODATA || err == syscall.ERANGE {
+		if errno == syscall.ENOSYS || errno == syscall.ENODATA || errno == syscall.ERANGE {
+			return false
+		}
+	case *fuseops.OpenFileOp:
+		// With no-open support, ENOSYS tells the kernel to stop sending opens.
+		if errno == syscall.ENOSYS && c.cfg.EnableNoOpenSupport {
+			return false
+		}
+	case *fuseops.OpenDirOp:
+		if errno == syscall.ENOSYS && c.cfg.EnableNoOpendirSupport {
+			return false
+		}
+	case *fuseops.PollOp, *fuseops.CopyFileRangeOp, *fuseops.IoctlOp, *fuseops.LSeekOp, *fuseops.AccessOp:
+		// ENOSYS is how file systems opt out, after which the kernel stops
+		// sending the op.
+		if errno == syscall.ENOSYS {
 			return false
 		}
 	case *unknownOp:
 		// Don't bother the user with methods we intentionally don't support.
-		if err == syscall.ENOSYS {
+		if errno == syscall.ENOSYS {
 			return false
 		}
 	}
@@ -489,8 +885,6 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 	op := state.op
 	inMsg := state.inMsg
 	outMsg := state.outMsg
-	fuseID := inMsg.Header().Unique
-
 	defer func() {
 		// Invoke any callbacks set by the FUSE server after the response to the kernel is
 		// complete and before the inMessage and outMessage memory buffers have been freed.
@@ -499,55 +893,173 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 			callback()
 		}
 
-		// Make sure we destroy the messages when we're done.
-		c.putInMessage(inMsg)
-		c.putOutMessage(outMsg)
+		// Make sure we destroy the messages when we're done, unless the user
+		// has retained them.
+		state.buffers.release()
 	}()
 
 	// Clean up state for this op.
 	c.finishOp(inMsg.Header().Opcode, inMsg.Header().Unique)
 
-	// Debug logging
-	if c.debugLogger != nil {
-		if opErr == nil {
-			c.debugLog(fuseID, 1, "-> OK (%s)", describeResponse(op))
+	// Error logging
+	if c.shouldLogError(op, opErr) {
+		if _, ok := translateError(opErr, c.cfg.ErrorTranslator); ok {
+			c.logger.Errorf(LogOp, "%T error: %v", op, opErr)
 		} else {
-			c.debugLog(fuseID, 1, "-> Error: %q", opErr.Error())
+			c.logger.Errorf(LogOp, "%T error with no errno, replying EIO: %v", op, opErr)
 		}
 	}
 
-	// Error logging
-	if c.shouldLogError(op, opErr) {
-		c.errorLogger.Printf("%T error: %v", op, opErr)
+	c.endTrace(ctx, state.trace, op, opErr)
+
+	// Send the reply to the kernel, if one is required, in terms of the
+	// kernel's inode IDs and with default timeouts filled in.
+	if opErr == nil {
+		c.applyDefaultTimeouts(op)
 	}
 
-	// Send the reply to the kernel, if one is required.
+	c.remapInodes(op)
 	noResponse := c.kernelResponse(outMsg, inMsg.Header().Unique, op, opErr)
 
-	if !noResponse {
-		// writev is not atomic
-		writeLock.Lock()
-		defer writeLock.Unlock()
+	if o, ok := op.(*fuseops.ReadFileOp); ok && opErr == nil && o.SpliceFile != nil {
+		if err := c.writeSplicedReply(state.dev, outMsg, o); err != nil {
+			return err
+		}
+	} else if !noResponse {
+		if err := c.writeReply(state.dev, outMsg); err != nil {
+			return err
+		}
+	}
+
+	// Act on any cache hints the user supplied, now that the kernel has the
+	// data the hints refer to.
+	if opErr == nil {
+		c.applyCacheHints(op)
+	}
+
+	return nil
+}
+
+// RetainBuffers keeps the buffers of the op with the supplied context, as
+// returned by ReadOp, from being reused when the op is replied to, until the
+// returned function is called. WriteFileOp.Data and ReadFileOp.Dst point into
+// these buffers, so this lets a file system that writes back asynchronously
+// acknowledge a write at once and hand the data to a background flush without
+// copying it.
+//
+// The buffers are large enough for the biggest write the kernel may send, so
+// they should not be held for long. The returned function must be called
+// eventually, whether before or after the op is replied to; calls after the
+// first have no effect.
+func RetainBuffers(ctx context.Context) (release func()) {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		panic(fmt.Sprintf("RetainBuffers called with invalid context: %#v", ctx))
+	}
+
+	b := state.buffers
+	if atomic.AddInt32(&b.refs, 1) <= 1 {
+		panic("RetainBuffers called after the buffers were released")
+	}
+
+	var once sync.Once
+	return func() { once.Do(b.release) }
+}
 
+// Write the supplied reply to the kernel through the given device.
+func (c *Connection) writeReply(dev *os.File, outMsg *buffer.OutMessage) error {
+	// writev is not atomic
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	for attempt := 1; ; attempt++ {
 		var err error
-		if outMsg.Sglist != nil {
-			_, err = writev(int(c.dev.Fd()), outMsg.Sglist)
+		if rings := c.rings[dev]; rings != nil {
+			err = rings.write(outMsg)
+		} else if outMsg.Sglist != nil {
+			_, err = writev(dev, outMsg.Sglist)
 		} else {
-			err = c.writeMessage(outMsg.OutHeaderBytes())
+			err = writeMessage(dev, outMsg.OutHeaderBytes())
 		}
-		if err != nil {
-			writeErrMsg := fmt.Sprintf("writeMessage: %v %v", err, outMsg.OutHeaderBytes())
-			if c.errorLogger != nil {
-				c.errorLogger.Print(writeErrMsg)
-			}
-			return fmt.Errorf(writeErrMsg)
+		if err == nil {
+			break
 		}
-		outMsg.Sglist = nil
+
+		e := &DeviceError{Op: "write", Attempt: attempt, Err: err}
+		switch c.deviceErrorAction(e) {
+		case DeviceErrorRetry:
+			continue
+
+		case DeviceErrorEOF:
+			outMsg.Sglist = nil
+			return nil
+		}
+
+		c.logger.Errorf(LogDispatch, "writeMessage: %v %v", err, outMsg.OutHeaderBytes())
+		return e
 	}
+	outMsg.Sglist = nil
 
 	return nil
 }
 
+// Write the reply to a read whose data is to come from o.SpliceFile, given the
+// message for the rest of the reply. The data is spliced if possible, and
+// otherwise read into memory and written as usual.
+func (c *Connection) writeSplicedReply(
+	dev *os.File,
+	outMsg *buffer.OutMessage,
+	o *fuseops.ReadFileOp) error {
+	if o.BytesRead == 0 {
+		return c.writeReply(dev, outMsg)
+	}
+
+	err := c.spliceReply(dev, outMsg, o)
+	if err == nil {
+		return nil
+	}
+
+	if c.logger.Enabled(LogDebug, LogDispatch) {
+		c.debugLog(outMsg.OutHeader().Unique, 1, "Splicing read reply: %v; copying", err)
+	}
+
+	buf := o.Dst
+	if len(buf) < o.BytesRead {
+		buf = make([]byte, o.BytesRead)
+	}
+
+	buf = buf[:o.BytesRead]
+	if _, err := o.SpliceFile.ReadAt(buf, o.SpliceOffset); err != nil {
+		c.logger.Errorf(LogOp, "Reading data to reply to read: %v", err)
+		h := outMsg.OutHeader()
+		h.Error = -int32(syscall.EIO)
+		return c.writeReply(dev, outMsg)
+	}
+
+	outMsg.Append(buf)
+	outMsg.OutHeader().Len = uint32(outMsg.Len())
+	return c.writeReply(dev, outMsg)
+}
+
+// Handle the per-op cache hints that can only be acted on after replying. The
+// op's inode IDs are the kernel's at this point.
+func (c *Connection) applyCacheHints(op interface{}) {
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		if !o.DontCache || o.BytesRead == 0 {
+			return
+		}
+
+		// The kernel put the data into the page cache when it received the reply,
+		// so evict it again. ENOENT means the kernel has already forgotten the
+		// inode, so there is nothing to evict.
+		err := c.notifyInvalInode(o.Inode, o.Offset, int64(o.BytesRead))
+		if err != nil && err != syscall.ENOENT {
+			c.logger.Errorf(LogNotify, "Evicting read data from the page cache: %v", err)
+		}
+	}
+}
+
 func (c *Connection) callbackForOp(op interface{}) func() {
 	switch o := op.(type) {
 	case *fuseops.ReadFileOp:
@@ -558,11 +1070,79 @@ func (c *Connection) callbackForOp(op interface{}) func() {
 	return nil
 }
 
+// Record where the connection is mounted, for use by Abort.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) setMountPoint(dir string) {
+	// Failure just means that Abort will have to rely on unmounting.
+	id, _ := fuseConnectionID(dir)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mountPoint = dir
+	c.connectionID = id
+}
+
+// Abort tears down the connection for a server that can't continue, e.g.
+// because it is panicking: it aborts the connection in the kernel where
+// supported (Linux), so that pending and future file system calls by other
+// processes fail with ENOTCONN instead of hanging, and then attempts to
+// unmount the file system so that no dead mount point is left behind.
+//
+// Connections returned by Mount are aborted automatically if the server's
+// ServeOps method panics, as are those served by fuseutil.NewFileSystemServer
+// if a FileSystem method panics.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) Abort() error {
+	c.mu.Lock()
+	dir, id := c.mountPoint, c.connectionID
+	c.mu.Unlock()
+
+	if dir == "" {
+		return errors.New("Abort: connection is not mounted")
+	}
+
+	var abortErr error
+	if id != "" {
+		abortErr = abortConnection(id)
+	}
+
+	if err := unmount(dir); err != nil {
+		if abortErr != nil {
+			return fmt.Errorf("Abort: %v; unmount: %v", abortErr, err)
+		}
+
+		// An aborted connection with its mount point still in place at least
+		// doesn't hang anybody.
+		if id == "" {
+			return fmt.Errorf("unmount: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// If the calling goroutine is panicking, abort the connection before letting
+// the panic continue. Must be deferred directly.
+func (c *Connection) abortOnPanic() {
+	if r := recover(); r != nil {
+		if err := c.Abort(); err != nil {
+			c.logger.Errorf(LogDispatch, "Aborting after panic: %v", err)
+		}
+
+		panic(r)
+	}
+}
+
 // Close the connection. Must not be called until operations that were read
 // from the connection have been responded to.
 func (c *Connection) close() error {
 	// Posix doesn't say that close can be called concurrently with read or
 	// write, but luckily we exclude the possibility of a race by requiring the
 	// user to respond to all ops first.
+	c.stopReaders()
+	c.closeRings()
 	return c.dev.Close()
 }
@@ -0,0 +1,35 @@
+package fuse
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+func TestRetainBuffers(t *testing.T) {
+	c := &Connection{}
+	inMsg := c.getInMessage()
+	outMsg := c.getOutMessage()
+
+	b := &opBuffers{c: c, inMsg: inMsg, outMsg: outMsg, refs: 1}
+	ctx := context.WithValue(context.Background(), contextKey, opState{inMsg, outMsg, nil, b, nil, nil})
+
+	release := RetainBuffers(ctx)
+
+	// Replying doesn't free the buffers while they're retained.
+	b.release()
+	if c.inMessages.Get() != nil || c.outMessages.Get() != nil {
+		t.Fatalf("Buffers freed while retained")
+	}
+
+	release()
+	release()
+	if (*buffer.InMessage)(c.inMessages.Get()) != inMsg {
+		t.Errorf("InMessage not freed")
+	}
+
+	if (*buffer.OutMessage)(c.outMessages.Get()) != outMsg {
+		t.Errorf("OutMessage not freed")
+	}
+}
@@ -0,0 +1,363 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// ControlCommand implements a command given over MountConfig.ControlSocket,
+// receiving the words that followed the command's name and returning the text
+// to send back. It may be called concurrently with itself and with serving.
+type ControlCommand func(args []string) (string, error)
+
+// How long the "unmount" control command waits for in-flight ops by default.
+const defaultControlShutdownTimeout = time.Minute
+
+// The commands every control socket understands, other than "help".
+var controlBuiltins = map[string]struct {
+	usage string
+	run   func(c *Connection, args []string) (string, error)
+}{
+	"ops": {
+		usage: "ops: list the ops being handled, oldest first",
+		run:   (*Connection).controlOps,
+	},
+	"loglevel": {
+		usage: "loglevel <level> [category]: set the minimum level logged, in all categories or one",
+		run:   (*Connection).controlLogLevel,
+	},
+	"unmount": {
+		usage: "unmount [timeout]: unmount gracefully, as for Connection.Shutdown",
+		run:   (*Connection).controlUnmount,
+	},
+}
+
+func isBuiltinControlCommand(name string) bool {
+	_, ok := controlBuiltins[name]
+	return ok || name == "help"
+}
+
+// SendControlCommand runs a command on the mount whose MountConfig.ControlSocket
+// is at the supplied path, returning its output.
+//
+// The protocol is simple enough to use with e.g. socat(1) too: the client
+// sends one line holding the command's name and arguments separated by
+// spaces, and the daemon replies with a line reading "ok" followed by the
+// output, or with a line reading "error: " followed by the error, and then
+// closes the connection. The built-in commands are:
+//
+//	help: list the commands available
+//	ops: list the ops being handled, oldest first
+//	loglevel <level> [category]: set the minimum level logged, in all
+//	  categories or one, for a MountConfig.Logger with a SetLevel method
+//	  such as LevelLogger
+//	unmount [timeout]: unmount gracefully, as for Connection.Shutdown,
+//	  aborting after the timeout (one minute by default)
+//
+// Further commands may be supplied with MountConfig.ControlCommands.
+func SendControlCommand(socket string, args ...string) (string, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, strings.Join(args, " ")+"\n"); err != nil {
+		return "", err
+	}
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("reading reply: %w", err)
+	}
+
+	status = strings.TrimSuffix(status, "\n")
+	if msg, ok := strings.CutPrefix(status, "error: "); ok {
+		return "", errors.New(msg)
+	}
+
+	if status != "ok" {
+		return "", fmt.Errorf("malformed reply: %q", status)
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("reading reply: %w", err)
+	}
+
+	return string(out), nil
+}
+
+// An op returned by ReadOp and not yet replied to, as listed by the "ops"
+// control command.
+type runningOp struct {
+	desc  string
+	start time.Time
+}
+
+// Remember an op about to be returned by ReadOp, if there is a control socket
+// through which to list it.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) recordRunning(opCode uint32, fuseID uint64, op interface{}) {
+	// As in beginOp, forget IDs may be reused at once.
+	if c.running == nil || opCode == fusekernel.OpForget {
+		return
+	}
+
+	// Describe the op now, since the file system may change it later.
+	r := runningOp{desc: describeRequest(op), start: time.Now()}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.running[fuseID] = r
+}
+
+// Listen on c.cfg.ControlSocket, serving commands until done is closed.
+func (c *Connection) serveControl(done <-chan struct{}) error {
+	path := c.cfg.ControlSocket
+	l, err := listenControl(path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	go func() {
+		<-done
+		l.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go c.handleControl(conn)
+		}
+	}()
+
+	return nil
+}
+
+// Listen on a unix socket at path, replacing a stale one nobody is listening
+// on.
+func listenControl(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		return l, err
+	}
+
+	conn, dialErr := net.Dial("unix", path)
+	if dialErr == nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if !errors.Is(dialErr, syscall.ECONNREFUSED) {
+		return nil, err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+
+	return net.Listen("unix", path)
+}
+
+// Run the command read from a control connection and send back its result.
+func (c *Connection) handleControl(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	out, err := c.runControlCommand(strings.Fields(line))
+	if err != nil {
+		fmt.Fprintf(conn, "error: %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+		return
+	}
+
+	if out != "" && !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+
+	fmt.Fprintf(conn, "ok\n%s", out)
+}
+
+func (c *Connection) runControlCommand(words []string) (string, error) {
+	if len(words) == 0 {
+		return "", errors.New("no command given")
+	}
+
+	name, args := words[0], words[1:]
+	c.logger.Infof(LogMount, "Control command: %s", strings.Join(words, " "))
+
+	if name == "help" {
+		return c.controlHelp(), nil
+	}
+
+	if b, ok := controlBuiltins[name]; ok {
+		return b.run(c, args)
+	}
+
+	if f, ok := c.cfg.ControlCommands[name]; ok {
+		return f(args)
+	}
+
+	return "", fmt.Errorf("unknown command %q; try help", name)
+}
+
+func (c *Connection) controlHelp() string {
+	lines := []string{"help: list the commands available"}
+	for _, b := range controlBuiltins {
+		lines = append(lines, b.usage)
+	}
+
+	for name := range c.cfg.ControlCommands {
+		lines = append(lines, name)
+	}
+
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) controlOps(args []string) (string, error) {
+	if len(args) != 0 {
+		return "", errors.New("usage: ops")
+	}
+
+	type entry struct {
+		fuseID uint64
+		op     runningOp
+	}
+
+	c.mu.Lock()
+	entries := make([]entry, 0, len(c.running))
+	for id, r := range c.running {
+		entries = append(entries, entry{id, r})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].op.start.Before(entries[j].op.start)
+	})
+
+	now := time.Now()
+	var b strings.Builder
+	for _, e := range entries {
+		age := now.Sub(e.op.start).Round(time.Millisecond)
+		fmt.Fprintf(&b, "%d %v %s\n", e.fuseID, age, e.op.desc)
+	}
+
+	return b.String(), nil
+}
+
+func (c *Connection) controlLogLevel(args []string) (string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", errors.New("usage: loglevel <level> [category]")
+	}
+
+	setter, ok := c.logger.(interface {
+		SetLevel(LogCategory, LogLevel)
+	})
+	if !ok {
+		return "", errors.New("the logger doesn't support changing levels")
+	}
+
+	level, ok := parseLogLevel(args[0])
+	if !ok {
+		return "", fmt.Errorf("unknown level %q", args[0])
+	}
+
+	if len(args) == 1 {
+		for cat := LogCategory(0); cat < numLogCategories; cat++ {
+			setter.SetLevel(cat, level)
+		}
+
+		return "", nil
+	}
+
+	cat, ok := parseLogCategory(args[1])
+	if !ok {
+		return "", fmt.Errorf("unknown category %q", args[1])
+	}
+
+	setter.SetLevel(cat, level)
+	return "", nil
+}
+
+func parseLogLevel(s string) (LogLevel, bool) {
+	for l := LogDebug; l <= LogOff; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, true
+		}
+	}
+
+	return 0, false
+}
+
+func parseLogCategory(s string) (LogCategory, bool) {
+	for cat := LogCategory(0); cat < numLogCategories; cat++ {
+		if s == cat.String() {
+			return cat, true
+		}
+	}
+
+	return 0, false
+}
+
+func (c *Connection) controlUnmount(args []string) (string, error) {
+	timeout := defaultControlShutdownTimeout
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		if timeout, err = time.ParseDuration(args[0]); err != nil {
+			return "", err
+		}
+
+	default:
+		return "", errors.New("usage: unmount [timeout]")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return "", c.Shutdown(ctx)
+}
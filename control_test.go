@@ -0,0 +1,138 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestControlSocket(t *testing.T) {
+	socket := path.Join(t.TempDir(), "control")
+	logger := NewLevelLogger(log.New(&bytes.Buffer{}, "", 0), LogError)
+	c := &Connection{
+		cfg: MountConfig{
+			OpContext:     context.Background(),
+			ControlSocket: socket,
+			ControlCommands: map[string]ControlCommand{
+				"flush": func(args []string) (string, error) {
+					return "flushed " + strings.Join(args, ","), nil
+				},
+			},
+		},
+		cancelFuncs: make(map[uint64]context.CancelCauseFunc),
+		running:     make(map[uint64]runningOp),
+		logger:      logger,
+	}
+
+	done := make(chan struct{})
+	if err := c.serveControl(done); err != nil {
+		t.Fatalf("serveControl: %v", err)
+	}
+
+	// In-flight ops are listed until they are replied to.
+	c.beginOp(fusekernel.OpGetattr, 17)
+	c.recordRunning(fusekernel.OpGetattr, 17, &fuseops.GetInodeAttributesOp{Inode: 23})
+
+	out, err := SendControlCommand(socket, "ops")
+	if err != nil {
+		t.Fatalf("ops: %v", err)
+	}
+
+	if !strings.HasPrefix(out, "17 ") || !strings.Contains(out, "GetInodeAttributes") {
+		t.Errorf("ops: %q", out)
+	}
+
+	c.finishOp(fusekernel.OpGetattr, 17)
+	if out, err := SendControlCommand(socket, "ops"); err != nil || out != "" {
+		t.Errorf("ops after reply: %q, %v", out, err)
+	}
+
+	// Log levels, for all categories or one.
+	if _, err := SendControlCommand(socket, "loglevel", "debug"); err != nil {
+		t.Fatalf("loglevel: %v", err)
+	}
+
+	if !logger.Enabled(LogDebug, LogNotify) {
+		t.Errorf("Debug logging not enabled")
+	}
+
+	if _, err := SendControlCommand(socket, "loglevel", "off", "op"); err != nil {
+		t.Fatalf("loglevel: %v", err)
+	}
+
+	if logger.Enabled(LogError, LogOp) || !logger.Enabled(LogDebug, LogMount) {
+		t.Errorf("Unexpected levels after disabling ops")
+	}
+
+	if _, err := SendControlCommand(socket, "loglevel", "loud"); err == nil {
+		t.Errorf("Expected an error for an unknown level")
+	}
+
+	// The file system's own commands.
+	if out, err := SendControlCommand(socket, "flush", "a", "b"); err != nil || out != "flushed a,b\n" {
+		t.Errorf("flush: %q, %v", out, err)
+	}
+
+	out, err = SendControlCommand(socket, "help")
+	if err != nil || !strings.Contains(out, "unmount") || !strings.Contains(out, "flush") {
+		t.Errorf("help: %q, %v", out, err)
+	}
+
+	if _, err := SendControlCommand(socket, "frobnicate"); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("frobnicate: %v", err)
+	}
+
+	// Unmounting needs a mount.
+	if _, err := SendControlCommand(socket, "unmount"); err == nil {
+		t.Errorf("Expected unmount to fail")
+	}
+
+	// The socket goes away when serving ends.
+	close(done)
+	for {
+		_, err := SendControlCommand(socket, "help")
+		if err != nil {
+			break
+		}
+	}
+}
+
+func TestControlSocketReplacesStale(t *testing.T) {
+	socket := path.Join(t.TempDir(), "control")
+
+	// A socket left behind by a daemon that died without cleaning up.
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	c := &Connection{
+		cfg:    MountConfig{ControlSocket: socket},
+		logger: NewLevelLogger(log.New(&bytes.Buffer{}, "", 0), LogError),
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if err := c.serveControl(done); err != nil {
+		t.Fatalf("serveControl: %v", err)
+	}
+
+	// But not one that is still in use.
+	if err := c.serveControl(done); err == nil {
+		t.Errorf("Expected an error for a live socket")
+	}
+
+	if _, err := SendControlCommand(socket, "help"); err != nil {
+		t.Errorf("help: %v", err)
+	}
+}
@@ -18,8 +18,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"reflect"
+	"runtime"
 	"syscall"
 	"time"
 	"unsafe"
@@ -57,6 +59,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -67,6 +71,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -83,43 +89,84 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 		o = to
 
 		valid := fusekernel.SetattrValid(in.Valid)
 		if valid&fusekernel.SetattrUid != 0 {
+			to.Valid |= fuseops.SetAttrUid
 			to.Uid = &in.Uid
 		}
 
 		if valid&fusekernel.SetattrGid != 0 {
+			to.Valid |= fuseops.SetAttrGid
 			to.Gid = &in.Gid
 		}
 
 		if valid&fusekernel.SetattrSize != 0 {
+			to.Valid |= fuseops.SetAttrSize
 			to.Size = &in.Size
 		}
 
 		if valid&fusekernel.SetattrMode != 0 {
+			to.Valid |= fuseops.SetAttrMode
 			mode := ConvertFileMode(in.Mode)
 			to.Mode = &mode
 		}
 
 		if valid&fusekernel.SetattrAtime != 0 {
+			to.Valid |= fuseops.SetAttrAtime
+			if valid&fusekernel.SetattrAtimeNow != 0 {
+				to.Valid |= fuseops.SetAttrAtimeNow
+			}
+
 			t := time.Unix(int64(in.Atime), int64(in.AtimeNsec))
 			to.Atime = &t
 		}
 
 		if valid&fusekernel.SetattrMtime != 0 {
+			to.Valid |= fuseops.SetAttrMtime
+			if valid&fusekernel.SetattrMtimeNow != 0 {
+				to.Valid |= fuseops.SetAttrMtimeNow
+			}
+
 			t := time.Unix(int64(in.Mtime), int64(in.MtimeNsec))
 			to.Mtime = &t
 		}
 
+		if valid&fusekernel.SetattrCtime != 0 {
+			to.Valid |= fuseops.SetAttrCtime
+			t := time.Unix(int64(in.Ctime), int64(in.CtimeNsec))
+			to.Ctime = &t
+		}
+
 		if valid.Handle() {
 			t := fuseops.HandleID(in.Fh)
 			to.Handle = &t
 		}
 
+	case fusekernel.OpAccess:
+		type input fusekernel.AccessIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpAccess")
+		}
+
+		o = &fuseops.AccessOp{
+			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
+			Mask:  in.Mask,
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
+			},
+		}
+
 	case fusekernel.OpForget:
 		type input fusekernel.ForgetIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -134,6 +181,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -144,9 +193,15 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpBatchForget")
 		}
 
+		// Check the count against what was sent before trusting it with an
+		// allocation.
+		type entry fusekernel.BatchForgetEntryIn
+		if uintptr(in.Count) > inMsg.Len()/unsafe.Sizeof(entry{}) {
+			return nil, errors.New("Corrupt OpBatchForget")
+		}
+
 		entries := make([]fuseops.BatchForgetEntry, 0, in.Count)
 		for i := uint32(0); i < in.Count; i++ {
-			type entry fusekernel.BatchForgetEntryIn
 			ein := (*entry)(inMsg.Consume(unsafe.Sizeof(entry{})))
 			if ein == nil {
 				return nil, errors.New("Corrupt OpBatchForget")
@@ -164,6 +219,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -195,6 +252,9 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
+				Umask:  convertUmask(in.Umask, protocol),
 			},
 		}
 
@@ -220,6 +280,9 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
+				Umask:  convertUmask(in.Umask, protocol),
 			},
 		}
 
@@ -237,13 +300,17 @@ func convertInMessage(
 		name = name[:i]
 
 		o = &fuseops.CreateFileOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(name),
-			Mode:   ConvertFileMode(in.Mode),
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(name),
+			Mode:      ConvertFileMode(in.Mode),
+			OpenFlags: fusekernel.OpenFlags(in.Flags),
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
+				Umask:  convertUmask(in.Umask, protocol),
 			},
 		}
 
@@ -254,7 +321,7 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpSymlink")
 		}
 		i := bytes.IndexByte(names, '\x00')
-		if i < 0 {
+		if i < 0 || i == len(names)-1 {
 			return nil, errors.New("Corrupt OpSymlink")
 		}
 		newName, target := names[0:i], names[i+1:len(names)-1]
@@ -267,6 +334,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -291,29 +360,31 @@ func convertInMessage(
 			names[4] == 0 && names[5] == 0 && names[6] == 0 && names[7] == 0 {
 			names = names[8:]
 		}
-		// names should be "old\x00new\x00"
-		if len(names) < 4 {
-			return nil, errors.New("Corrupt OpRename")
+		o, err = convertRename(inMsg, in.Newdir, 0, names)
+		if err != nil {
+			return nil, err
 		}
-		if names[len(names)-1] != '\x00' {
-			return nil, errors.New("Corrupt OpRename")
+
+	case fusekernel.OpRename2:
+		// Leave the op unimplemented unless asked for it, so that the kernel
+		// stops sending it and fails renameat2 calls with flags with EINVAL.
+		if !config.EnableRenameFlags {
+			o = &unknownOp{
+				OpCode: inMsg.Header().Opcode,
+				Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			}
+			break
 		}
-		i := bytes.IndexByte(names, '\x00')
-		if i < 0 {
-			return nil, errors.New("Corrupt OpRename")
+
+		type input fusekernel.Rename2In
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpRename2")
 		}
-		oldName, newName := names[:i], names[i+1:len(names)-1]
 
-		o = &fuseops.RenameOp{
-			OldParent: fuseops.InodeID(inMsg.Header().Nodeid),
-			OldName:   string(oldName),
-			NewParent: fuseops.InodeID(in.Newdir),
-			NewName:   string(newName),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+		o, err = convertRename(inMsg, in.Newdir, in.Flags, inMsg.ConsumeBytes(inMsg.Len()))
+		if err != nil {
+			return nil, err
 		}
 
 	case fusekernel.OpUnlink:
@@ -330,6 +401,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -347,6 +420,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -364,6 +439,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -374,12 +451,14 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
 	case fusekernel.OpRead:
 		in := (*fusekernel.ReadIn)(inMsg.Consume(fusekernel.ReadInSize(protocol)))
-		if in == nil {
+		if in == nil || !validReadSize(config, in.Size) {
 			return nil, errors.New("Corrupt OpRead")
 		}
 
@@ -392,6 +471,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 		if !config.UseVectoredRead {
@@ -403,7 +484,7 @@ func convertInMessage(
 
 	case fusekernel.OpReaddir:
 		in := (*fusekernel.ReadIn)(inMsg.Consume(fusekernel.ReadInSize(protocol)))
-		if in == nil {
+		if in == nil || !validReadSize(config, in.Size) {
 			return nil, errors.New("Corrupt OpReaddir")
 		}
 
@@ -415,20 +496,44 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 		o = to
 
 		readSize := int(in.Size)
-		p := outMsg.Grow(readSize)
-		if p == nil {
-			return nil, fmt.Errorf("Can't grow for %d-byte read", readSize)
+		if readSize > 0 {
+			p := outMsg.Grow(readSize)
+			if p == nil {
+				return nil, fmt.Errorf("Can't grow for %d-byte read", readSize)
+			}
+
+			sh := (*reflect.SliceHeader)(unsafe.Pointer(&to.Dst))
+			sh.Data = uintptr(p)
+			sh.Len = readSize
+			sh.Cap = readSize
 		}
 
-		sh := (*reflect.SliceHeader)(unsafe.Pointer(&to.Dst))
-		sh.Data = uintptr(p)
-		sh.Len = readSize
-		sh.Cap = readSize
+	case fusekernel.OpReaddirplus:
+		in := (*fusekernel.ReadIn)(inMsg.Consume(fusekernel.ReadInSize(protocol)))
+		if in == nil || !validReadSize(config, in.Size) {
+			return nil, errors.New("Corrupt OpReaddirplus")
+		}
+
+		o = &fuseops.ReadDirPlusOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+			Offset: fuseops.DirOffset(in.Offset),
+			Size:   int(in.Size),
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
+			},
+		}
 
 	case fusekernel.OpRelease:
 		type input fusekernel.ReleaseIn
@@ -438,11 +543,15 @@ func convertInMessage(
 		}
 
 		o = &fuseops.ReleaseFileHandleOp{
-			Handle: fuseops.HandleID(in.Fh),
+			Handle:      fuseops.HandleID(in.Fh),
+			LockOwner:   in.LockOwner,
+			FlockUnlock: fusekernel.ReleaseFlags(in.ReleaseFlags)&fusekernel.ReleaseFlockUnlock != 0,
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -459,6 +568,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -482,6 +593,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -493,12 +606,15 @@ func convertInMessage(
 		}
 
 		o = &fuseops.SyncFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:   fuseops.HandleID(in.Fh),
+			Datasync: fusekernel.FsyncFlags(in.FsyncFlags)&fusekernel.FsyncFdatasync != 0,
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -510,12 +626,15 @@ func convertInMessage(
 		}
 
 		o = &fuseops.FlushFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			LockOwner: in.LockOwner,
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -526,11 +645,32 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
 	case fusekernel.OpStatfs:
-		o = &fuseops.StatFSOp{}
+		o = &fuseops.StatFSOp{
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
+			},
+		}
+
+	case fusekernel.OpDestroy:
+		o = &fuseops.DestroyOp{
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
+			},
+		}
 
 	case fusekernel.OpInterrupt:
 		type input fusekernel.InterruptIn
@@ -543,6 +683,24 @@ func convertInMessage(
 			FuseID: in.Unique,
 		}
 
+	case fusekernel.OpNotifyReply:
+		type input fusekernel.NotifyRetrieveIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpNotifyReply")
+		}
+
+		data := inMsg.ConsumeBytes(uintptr(in.Size))
+		if data == nil && in.Size != 0 {
+			return nil, errors.New("Corrupt OpNotifyReply")
+		}
+
+		o = &notifyReplyOp{
+			Unique: inMsg.Header().Unique,
+			Offset: in.Offset,
+			Data:   data,
+		}
+
 	case fusekernel.OpInit:
 		type input fusekernel.InitIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -550,12 +708,21 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpInit")
 		}
 
-		o = &initOp{
+		op := &initOp{
 			Kernel:       fusekernel.Protocol{in.Major, in.Minor},
 			MaxReadahead: in.MaxReadahead,
 			Flags:        fusekernel.InitFlags(in.Flags),
 		}
 
+		if op.Flags&fusekernel.InitExt != 0 {
+			type ext fusekernel.InitInExt
+			if e := (*ext)(inMsg.Consume(unsafe.Sizeof(ext{}))); e != nil {
+				op.Flags2 = fusekernel.InitFlags2(e.Flags2)
+			}
+		}
+
+		o = op
+
 	case fusekernel.OpLink:
 		type input fusekernel.LinkIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -581,6 +748,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -598,13 +767,74 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
+	case fusekernel.OpGetlk, fusekernel.OpSetlk, fusekernel.OpSetlkw:
+		in := (*fusekernel.LkIn)(inMsg.Consume(fusekernel.LkInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpGetlk/OpSetlk/OpSetlkw")
+		}
+
+		inode := fuseops.InodeID(inMsg.Header().Nodeid)
+		handle := fuseops.HandleID(in.Fh)
+		lock := fuseops.FileLock{
+			Start: in.Lk.Start,
+			End:   in.Lk.End,
+			Type:  in.Lk.Type,
+			Pid:   in.Lk.Pid,
+		}
+		flock := protocol.GE(fusekernel.Protocol{Major: 7, Minor: 9}) && in.LkFlags&fusekernel.LkFlock != 0
+		opCtx := fuseops.OpContext{
+			FuseID: inMsg.Header().Unique,
+			Pid:    inMsg.Header().Pid,
+			Uid:    inMsg.Header().Uid,
+			Gid:    inMsg.Header().Gid,
+			Header: requestHeader(inMsg),
+		}
+
+		switch inMsg.Header().Opcode {
+		case fusekernel.OpGetlk:
+			o = &fuseops.GetLkOp{
+				Inode:  inode,
+				Handle: handle,
+				Owner:  in.Owner,
+				Lock:   lock,
+				Conflict: fuseops.FileLock{
+					Start: lock.Start,
+					End:   lock.End,
+					Type:  fuseops.LockUnlock,
+				},
+				OpContext: opCtx,
+			}
+
+		case fusekernel.OpSetlk:
+			o = &fuseops.SetLkOp{
+				Inode:     inode,
+				Handle:    handle,
+				Owner:     in.Owner,
+				Lock:      lock,
+				Flock:     flock,
+				OpContext: opCtx,
+			}
+
+		default:
+			o = &fuseops.SetLkWOp{
+				Inode:     inode,
+				Handle:    handle,
+				Owner:     in.Owner,
+				Lock:      lock,
+				Flock:     flock,
+				OpContext: opCtx,
+			}
+		}
+
 	case fusekernel.OpGetxattr:
 		type input fusekernel.GetxattrIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
-		if in == nil {
+		if in == nil || !validReadSize(config, in.Size) {
 			return nil, errors.New("Corrupt OpGetxattr")
 		}
 
@@ -616,12 +846,15 @@ func convertInMessage(
 		name = name[:i]
 
 		to := &fuseops.GetXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:  string(name),
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:     string(name),
+			Position: (*fusekernel.GetxattrIn)(in).GetPosition(),
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 		o = to
@@ -644,7 +877,7 @@ func convertInMessage(
 	case fusekernel.OpListxattr:
 		type input fusekernel.ListxattrIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
-		if in == nil {
+		if in == nil || !validReadSize(config, in.Size) {
 			return nil, errors.New("Corrupt OpListxattr")
 		}
 
@@ -654,6 +887,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 		o = to
@@ -687,16 +922,23 @@ func convertInMessage(
 		}
 
 		name, value := payload[:i], payload[i+1:len(payload)]
+		if uint32(len(value)) < in.Size {
+			return nil, errors.New("Corrupt OpSetxattr")
+		}
+		value = value[:in.Size]
 
 		o = &fuseops.SetXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:  string(name),
-			Value: value,
-			Flags: in.Flags,
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:     string(name),
+			Value:    value,
+			Flags:    in.Flags,
+			Position: (*fusekernel.SetxattrIn)(in).GetPosition(),
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 	case fusekernel.OpFallocate:
@@ -716,6 +958,106 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
+			},
+		}
+
+	case fusekernel.OpLseek:
+		type input fusekernel.LseekIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpLseek")
+		}
+
+		o = &fuseops.LSeekOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+			Offset: int64(in.Offset),
+			Whence: in.Whence,
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
+			},
+		}
+
+	case fusekernel.OpCopyFileRange:
+		type input fusekernel.CopyFileRangeIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpCopyFileRange")
+		}
+
+		o = &fuseops.CopyFileRangeOp{
+			SrcInode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			SrcHandle: fuseops.HandleID(in.FhIn),
+			SrcOffset: in.OffIn,
+			DstInode:  fuseops.InodeID(in.NodeidOut),
+			DstHandle: fuseops.HandleID(in.FhOut),
+			DstOffset: in.OffOut,
+			Length:    in.Len,
+			Flags:     in.Flags,
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
+			},
+		}
+
+	case fusekernel.OpIoctl:
+		type input fusekernel.IoctlIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpIoctl")
+		}
+
+		var data []byte
+		if in.InSize > 0 {
+			if data = inMsg.ConsumeBytes(uintptr(in.InSize)); data == nil {
+				return nil, errors.New("Corrupt OpIoctl: short input")
+			}
+		}
+
+		o = &fuseops.IoctlOp{
+			Inode:      fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:     fuseops.HandleID(in.Fh),
+			Cmd:        in.Cmd,
+			Arg:        in.Arg,
+			Flags:      in.Flags,
+			Input:      data,
+			OutputSize: in.OutSize,
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
+			},
+		}
+
+	case fusekernel.OpPoll:
+		in := (*fusekernel.PollIn)(inMsg.Consume(fusekernel.PollInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpPoll")
+		}
+
+		o = &fuseops.PollOp{
+			Inode:          fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:         fuseops.HandleID(in.Fh),
+			Events:         in.Events,
+			ScheduleNotify: in.Flags&fusekernel.PollScheduleNotify != 0,
+			PollHandle:     fuseops.PollHandle(in.Kh),
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Header: requestHeader(inMsg),
 			},
 		}
 
@@ -762,10 +1104,7 @@ func (c *Connection) kernelResponse(
 		handled := false
 
 		if !handled {
-			m.OutHeader().Error = -int32(syscall.EIO)
-			if errno, ok := opErr.(syscall.Errno); ok {
-				m.OutHeader().Error = -int32(errno)
-			}
+			m.OutHeader().Error = -int32(c.errnoForError(opErr))
 
 			// Special case: for some types, convertInMessage grew the message in order
 			// to obtain a destination buffer. Make sure that we shrink back to just
@@ -811,6 +1150,9 @@ func (c *Connection) kernelResponseForOp(
 			o.AttributesExpiration)
 		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
 
+	case *fuseops.AccessOp:
+		// Empty response
+
 	case *fuseops.MkDirOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
@@ -829,6 +1171,12 @@ func (c *Connection) kernelResponseForOp(
 
 		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		oo.Fh = uint64(o.Handle)
+		oo.OpenFlags = c.openResponseFlags(o.KeepPageCache, o.UseDirectIO, o.NonSeekable)
+
+		if o.BackingID != 0 {
+			oo.OpenFlags |= uint32(fusekernel.OpenPassthrough)
+			oo.BackingID = int32(o.BackingID)
+		}
 
 	case *fuseops.CreateSymlinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
@@ -859,22 +1207,28 @@ func (c *Connection) kernelResponseForOp(
 		// much the user read.
 		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 
+	case *fuseops.ReadDirPlusOp:
+		writeDirentsPlus(m, o)
+
 	case *fuseops.ReleaseDirHandleOp:
 		// Empty response
 
 	case *fuseops.OpenFileOp:
 		out := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		out.Fh = uint64(o.Handle)
+		out.OpenFlags = c.openResponseFlags(o.KeepPageCache, o.UseDirectIO, o.NonSeekable)
 
-		if o.KeepPageCache {
-			out.OpenFlags |= uint32(fusekernel.OpenKeepCache)
+		if o.BackingID != 0 {
+			out.OpenFlags |= uint32(fusekernel.OpenPassthrough)
+			out.BackingID = int32(o.BackingID)
 		}
 
-		if o.UseDirectIO {
-			out.OpenFlags |= uint32(fusekernel.OpenDirectIO)
+	case *fuseops.ReadFileOp:
+		if o.SpliceFile != nil {
+			// The data is sent separately; cf. Connection.writeSplicedReply.
+			break
 		}
 
-	case *fuseops.ReadFileOp:
 		if o.Dst != nil {
 			m.Append(o.Dst)
 		} else {
@@ -886,6 +1240,50 @@ func (c *Connection) kernelResponseForOp(
 		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
 		out.Size = uint32(len(o.Data))
 
+	case *fuseops.LSeekOp:
+		out := (*fusekernel.LseekOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LseekOut{}))))
+		out.Offset = uint64(o.ResultOffset)
+
+	case *fuseops.CopyFileRangeOp:
+		n := o.BytesCopied
+		if n > math.MaxUint32 {
+			n = math.MaxUint32
+		}
+
+		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
+		out.Size = uint32(n)
+
+	case *fuseops.IoctlOp:
+		out := (*fusekernel.IoctlOut)(m.Grow(int(unsafe.Sizeof(fusekernel.IoctlOut{}))))
+		if len(o.RetryIn) > 0 || len(o.RetryOut) > 0 {
+			out.Flags = fusekernel.IoctlRetry
+			out.InIovs = uint32(len(o.RetryIn))
+			out.OutIovs = uint32(len(o.RetryOut))
+			for _, iovs := range [][]fuseops.IoctlIovec{o.RetryIn, o.RetryOut} {
+				for _, v := range iovs {
+					iov := (*fusekernel.IoctlIovec)(m.Grow(int(unsafe.Sizeof(fusekernel.IoctlIovec{}))))
+					iov.Base = v.Base
+					iov.Len = v.Len
+				}
+			}
+
+			break
+		}
+
+		out.Result = o.Result
+		data := o.Output
+		if len(data) > int(o.OutputSize) {
+			data = data[:o.OutputSize]
+		}
+
+		if len(data) > 0 {
+			m.Append(data)
+		}
+
+	case *fuseops.PollOp:
+		out := (*fusekernel.PollOut)(m.Grow(int(unsafe.Sizeof(fusekernel.PollOut{}))))
+		out.Revents = o.Revents
+
 	case *fuseops.SyncFileOp:
 		// Empty response
 
@@ -905,7 +1303,25 @@ func (c *Connection) kernelResponseForOp(
 		out.St.Bavail = o.BlocksAvailable
 		out.St.Files = o.Inodes
 		out.St.Ffree = o.InodesFree
-		out.St.Namelen = 255
+
+		// Callers compute usage by subtracting, so make sure the free counts
+		// can't exceed the totals they belong to.
+		if out.St.Bfree > out.St.Blocks {
+			out.St.Bfree = out.St.Blocks
+		}
+
+		if out.St.Bavail > out.St.Bfree {
+			out.St.Bavail = out.St.Bfree
+		}
+
+		if out.St.Ffree > out.St.Files {
+			out.St.Ffree = out.St.Files
+		}
+
+		out.St.Namelen = o.NameMax
+		if out.St.Namelen == 0 {
+			out.St.Namelen = 255
+		}
 
 		// The posix spec for sys/statvfs.h (http://goo.gl/LktgrF) defines the
 		// following fields of statvfs, among others:
@@ -935,6 +1351,37 @@ func (c *Connection) kernelResponseForOp(
 		out.St.Bsize = o.IoSize
 		out.St.Frsize = o.BlockSize
 
+		// Block counts are meaningless without a block size, so fill in whichever
+		// is missing. osxfuse already treats a zero f_iosize as 65536, so leave
+		// that to it rather than shrinking it to the block size.
+		if out.St.Frsize == 0 {
+			out.St.Frsize = out.St.Bsize
+		}
+
+		if out.St.Frsize == 0 {
+			out.St.Frsize = 4096
+		}
+
+		if out.St.Bsize == 0 && runtime.GOOS != "darwin" {
+			out.St.Bsize = out.St.Frsize
+		}
+
+	case *fuseops.DestroyOp:
+		// Empty response
+
+	case *fuseops.GetLkOp:
+		out := (*fusekernel.LkOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LkOut{}))))
+		out.Lk.Start = o.Conflict.Start
+		out.Lk.End = o.Conflict.End
+		out.Lk.Type = o.Conflict.Type
+		out.Lk.Pid = o.Conflict.Pid
+
+	case *fuseops.SetLkOp:
+		// Empty response
+
+	case *fuseops.SetLkWOp:
+		// Empty response
+
 	case *fuseops.RemoveXattrOp:
 		// Empty response
 
@@ -974,6 +1421,11 @@ func (c *Connection) kernelResponseForOp(
 		out.MaxWrite = o.MaxWrite
 		out.TimeGran = 1
 		out.MaxPages = o.MaxPages
+		out.Flags2 = uint32(o.Flags2)
+		out.MaxStackDepth = o.MaxStackDepth
+		if o.Flags2 != 0 {
+			out.Flags |= uint32(fusekernel.InitExt)
+		}
 
 	default:
 		panic(fmt.Sprintf("Unexpected op: %#v", op))
@@ -1006,8 +1458,11 @@ func convertAttributes(
 	out.Nlink = in.Nlink
 	out.Uid = in.Uid
 	out.Gid = in.Gid
-	// round up to the nearest 512 boundary
-	out.Blocks = (in.Size + 512 - 1) / 512
+	// round up to the nearest 512 boundary, unless the file system knows better
+	out.Blocks = in.Blocks
+	if out.Blocks == 0 {
+		out.Blocks = (in.Size + 512 - 1) / 512
+	}
 
 	// Set the mode.
 	out.Mode = ConvertGoMode(in.Mode)
@@ -1017,6 +1472,25 @@ func convertAttributes(
 	}
 }
 
+// Compute the FOPEN_* flags for a reply to an open or create request from the
+// caching choices the file system made for the handle.
+func (c *Connection) openResponseFlags(keepCache, directIO, nonSeekable bool) uint32 {
+	var flags fusekernel.OpenResponseFlags
+	if keepCache {
+		flags |= fusekernel.OpenKeepCache
+	}
+
+	if directIO {
+		flags |= fusekernel.OpenDirectIO
+	}
+
+	if nonSeekable && c.protocol.HasOpenNonSeekable() {
+		flags |= fusekernel.OpenNonSeekable
+	}
+
+	return uint32(flags)
+}
+
 // Convert an absolute cache expiration time to a relative time from now for
 // consumption by the fuse kernel module.
 func convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
@@ -1113,7 +1587,121 @@ func ConvertGoMode(inMode os.FileMode) uint32 {
 	return outMode
 }
 
+// Write the entries of a ReadDirPlusOp in the format of fuse_direntplus,
+// leaving out any that don't fit in the size of the read.
+func writeDirentsPlus(m *buffer.OutMessage, o *fuseops.ReadDirPlusOp) {
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	const direntAlignment = 8
+
+	sizeOf := func(e *fuseops.DirentPlus) int {
+		n := entrySize + fusekernel.DirentSize + len(e.Name)
+		return (n + direntAlignment - 1) &^ (direntAlignment - 1)
+	}
+
+	var total int
+	entries := o.Entries
+	for i := range entries {
+		n := sizeOf(&entries[i])
+		if total+n > o.Size {
+			entries = entries[:i]
+			break
+		}
+
+		total += n
+	}
+
+	if total == 0 {
+		return
+	}
+
+	buf := (*[1 << 30]byte)(m.Grow(total))[:total:total]
+	for i := range entries {
+		e := &entries[i]
+		convertChildInodeEntry(&e.Entry, (*fusekernel.EntryOut)(unsafe.Pointer(&buf[0])))
+
+		de := (*fusekernel.Dirent)(unsafe.Pointer(&buf[entrySize]))
+		de.Ino = uint64(e.Entry.Child)
+		de.Off = uint64(e.Offset)
+		de.Namelen = uint32(len(e.Name))
+		de.Type = (ConvertGoMode(e.Entry.Attributes.Mode) & syscall.S_IFMT) >> 12
+		copy(buf[entrySize+fusekernel.DirentSize:], e.Name)
+
+		buf = buf[sizeOf(e):]
+	}
+}
+
 func writeXattrSize(m *buffer.OutMessage, size uint32) {
 	out := (*fusekernel.GetxattrOut)(m.Grow(int(unsafe.Sizeof(fusekernel.GetxattrOut{}))))
 	out.Size = size
 }
+
+// Decode the caller's umask sent with a create-type op, which older protocols
+// lack.
+func convertUmask(umask uint32, protocol fusekernel.Protocol) os.FileMode {
+	if !protocol.HasUmask() {
+		return 0
+	}
+
+	return os.FileMode(umask) & os.ModePerm
+}
+
+// convertRename builds a RenameOp from the tail of a rename request, which
+// should be "old\x00new\x00".
+func convertRename(
+	inMsg *buffer.InMessage,
+	newDir uint64,
+	flags uint32,
+	names []byte) (*fuseops.RenameOp, error) {
+	if len(names) < 4 {
+		return nil, errors.New("Corrupt OpRename")
+	}
+	if names[len(names)-1] != '\x00' {
+		return nil, errors.New("Corrupt OpRename")
+	}
+	i := bytes.IndexByte(names, '\x00')
+	if i < 0 || i == len(names)-1 {
+		return nil, errors.New("Corrupt OpRename")
+	}
+	oldName, newName := names[:i], names[i+1:len(names)-1]
+
+	return &fuseops.RenameOp{
+		OldParent: fuseops.InodeID(inMsg.Header().Nodeid),
+		OldName:   string(oldName),
+		NewParent: fuseops.InodeID(newDir),
+		NewName:   string(newName),
+		Flags:     flags,
+		OpContext: fuseops.OpContext{
+			FuseID: inMsg.Header().Unique,
+			Pid:    inMsg.Header().Pid,
+			Uid:    inMsg.Header().Uid,
+			Gid:    inMsg.Header().Gid,
+			Header: requestHeader(inMsg),
+		},
+	}, nil
+}
+
+// Return the header of the message in the form exposed in fuseops.OpContext.
+func requestHeader(inMsg *buffer.InMessage) fuseops.RequestHeader {
+	h := inMsg.Header()
+	return fuseops.RequestHeader{
+		Len:    h.Len,
+		Opcode: h.Opcode,
+		Unique: h.Unique,
+		Nodeid: h.Nodeid,
+		Uid:    h.Uid,
+		Gid:    h.Gid,
+		Pid:    h.Pid,
+	}
+}
+
+// Return whether a size requested by a read-type op is one the kernel could
+// have sent, given the per-request page limit agreed at init time. Buggy
+// kernels could otherwise have us allocate without bound.
+func validReadSize(config *MountConfig, size uint32) bool {
+	limit := int(maxPagesFor(config.maxWrite())) * os.Getpagesize()
+	if limit < buffer.MaxReadSize {
+		limit = buffer.MaxReadSize
+	}
+
+	return int64(size) <= int64(limit)
+}
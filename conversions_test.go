@@ -0,0 +1,693 @@
+package fuse
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestStatFSDefaults(t *testing.T) {
+	testCases := []struct {
+		op          fuseops.StatFSOp
+		wantBsize   uint32
+		wantFrsize  uint32
+		wantNamelen uint32
+	}{
+		{fuseops.StatFSOp{}, 4096, 4096, 255},
+		{fuseops.StatFSOp{BlockSize: 512}, 512, 512, 255},
+		{fuseops.StatFSOp{IoSize: 1 << 16, NameMax: 1024}, 1 << 16, 1 << 16, 1024},
+		{fuseops.StatFSOp{BlockSize: 512, IoSize: 4096}, 4096, 512, 255},
+	}
+
+	c := &Connection{}
+	for _, tc := range testCases {
+		var m buffer.OutMessage
+		m.Reset()
+		c.kernelResponseForOp(&m, &tc.op)
+
+		// osxfuse gets a zero IO size as is, and applies its own default.
+		if runtime.GOOS == "darwin" && tc.op.IoSize == 0 {
+			tc.wantBsize = 0
+		}
+
+		out := (*fusekernel.StatfsOut)(unsafe.Pointer(&m.Sglist[1][0]))
+		if out.St.Bsize != tc.wantBsize || out.St.Frsize != tc.wantFrsize || out.St.Namelen != tc.wantNamelen {
+			t.Errorf("%+v: got bsize %d, frsize %d, namelen %d; want %d, %d, %d",
+				tc.op, out.St.Bsize, out.St.Frsize, out.St.Namelen,
+				tc.wantBsize, tc.wantFrsize, tc.wantNamelen)
+		}
+	}
+}
+
+func TestStatFSCounts(t *testing.T) {
+	c := &Connection{}
+	var m buffer.OutMessage
+	m.Reset()
+	c.kernelResponseForOp(&m, &fuseops.StatFSOp{
+		Blocks:          10,
+		BlocksFree:      20,
+		BlocksAvailable: 30,
+		Inodes:          5,
+		InodesFree:      6,
+	})
+
+	out := (*fusekernel.StatfsOut)(unsafe.Pointer(&m.Sglist[1][0]))
+	if out.St.Blocks != 10 || out.St.Bfree != 10 || out.St.Bavail != 10 {
+		t.Errorf("Blocks: %d, %d, %d", out.St.Blocks, out.St.Bfree, out.St.Bavail)
+	}
+
+	if out.St.Files != 5 || out.St.Ffree != 5 {
+		t.Errorf("Inodes: %d, %d", out.St.Files, out.St.Ffree)
+	}
+
+	// Consistent counts are left alone.
+	m.Reset()
+	c.kernelResponseForOp(&m, &fuseops.StatFSOp{Blocks: 10, BlocksFree: 7, BlocksAvailable: 3, Inodes: 5, InodesFree: 1})
+
+	out = (*fusekernel.StatfsOut)(unsafe.Pointer(&m.Sglist[1][0]))
+	if out.St.Bfree != 7 || out.St.Bavail != 3 || out.St.Ffree != 1 {
+		t.Errorf("Unexpected counts: %+v", out.St)
+	}
+}
+
+func TestReadDirPlusResponse(t *testing.T) {
+	op := &fuseops.ReadDirPlusOp{
+		Entries: []fuseops.DirentPlus{
+			{
+				Offset: 1,
+				Name:   "foo",
+				Entry: fuseops.ChildInodeEntry{
+					Child:      17,
+					Attributes: fuseops.InodeAttributes{Size: 3, Mode: 0644},
+				},
+			},
+			{
+				Offset: 2,
+				Name:   "dir",
+				Entry: fuseops.ChildInodeEntry{
+					Child:      19,
+					Attributes: fuseops.InodeAttributes{Mode: os.ModeDir | 0755},
+				},
+			},
+		},
+	}
+
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	const size = entrySize + fusekernel.DirentSize + 8
+
+	// Only the first entry fits.
+	op.Size = 2*size - 1
+
+	c := &Connection{}
+	var m buffer.OutMessage
+	m.Reset()
+	c.kernelResponseForOp(&m, op)
+
+	if got := m.Len() - buffer.OutMessageHeaderSize; got != size {
+		t.Fatalf("Response length: got %d, want %d", got, size)
+	}
+
+	buf := m.Sglist[1]
+	e := (*fusekernel.EntryOut)(unsafe.Pointer(&buf[0]))
+	if e.Nodeid != 17 || e.Attr.Ino != 17 || e.Attr.Size != 3 {
+		t.Errorf("Unexpected entry: %+v", *e)
+	}
+
+	de := (*fusekernel.Dirent)(unsafe.Pointer(&buf[entrySize]))
+	if de.Ino != 17 || de.Off != 1 || de.Namelen != 3 || de.Type != 8 {
+		t.Errorf("Unexpected dirent: %+v", *de)
+	}
+
+	if name := string(buf[entrySize+fusekernel.DirentSize:][:3]); name != "foo" {
+		t.Errorf("Name: got %q", name)
+	}
+
+	// Both fit.
+	op.Size = 2 * size
+	m.Reset()
+	c.kernelResponseForOp(&m, op)
+
+	if got := m.Len() - buffer.OutMessageHeaderSize; got != 2*size {
+		t.Fatalf("Response length: got %d, want %d", got, 2*size)
+	}
+
+	de = (*fusekernel.Dirent)(unsafe.Pointer(&m.Sglist[1][size+entrySize]))
+	if de.Ino != 19 || de.Off != 2 || de.Type != 4 {
+		t.Errorf("Unexpected dirent: %+v", *de)
+	}
+}
+
+func TestCopyFileRangeResponse(t *testing.T) {
+	testCases := []struct {
+		copied uint64
+		want   uint32
+	}{
+		{0, 0},
+		{4096, 4096},
+		{1 << 32, 1<<32 - 1},
+	}
+
+	c := &Connection{}
+	for _, tc := range testCases {
+		var m buffer.OutMessage
+		m.Reset()
+		c.kernelResponseForOp(&m, &fuseops.CopyFileRangeOp{BytesCopied: tc.copied})
+
+		out := (*fusekernel.WriteOut)(unsafe.Pointer(&m.Sglist[1][0]))
+		if out.Size != tc.want {
+			t.Errorf("BytesCopied %d: got size %d, want %d", tc.copied, out.Size, tc.want)
+		}
+	}
+}
+
+func TestConvertPoll(t *testing.T) {
+	type pollMsg struct {
+		h  fusekernel.InHeader
+		in fusekernel.PollIn
+	}
+
+	msg := pollMsg{
+		h: fusekernel.InHeader{
+			Opcode: fusekernel.OpPoll,
+			Unique: 1,
+			Nodeid: 2,
+		},
+		in: fusekernel.PollIn{
+			Fh:     3,
+			Kh:     4,
+			Flags:  fusekernel.PollScheduleNotify,
+			Events: 1,
+		},
+	}
+
+	// Kernels older than 7.21 don't send the events.
+	testCases := []struct {
+		protocol   fusekernel.Protocol
+		wantEvents uint32
+	}{
+		{fusekernel.Protocol{Major: 7, Minor: 20}, 0},
+		{fusekernel.Protocol{Major: 7, Minor: 31}, 1},
+	}
+
+	for _, tc := range testCases {
+		size := int(unsafe.Sizeof(fusekernel.InHeader{}) + fusekernel.PollInSize(tc.protocol))
+		msg.h.Len = uint32(size)
+		b := (*[unsafe.Sizeof(pollMsg{})]byte)(unsafe.Pointer(&msg))[:size]
+
+		inMsg := buffer.NewInMessage(4096)
+		if err := inMsg.Init(bytes.NewReader(b)); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		op, err := convertInMessage(&MountConfig{}, inMsg, nil, tc.protocol)
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		want := &fuseops.PollOp{
+			Inode:          2,
+			Handle:         3,
+			Events:         tc.wantEvents,
+			ScheduleNotify: true,
+			PollHandle:     4,
+			OpContext: fuseops.OpContext{
+				FuseID: 1,
+				Header: fuseops.RequestHeader{Len: uint32(size), Opcode: fusekernel.OpPoll, Unique: 1, Nodeid: 2},
+			},
+		}
+
+		if got := op.(*fuseops.PollOp); *got != *want {
+			t.Errorf("%v: got %+v, want %+v", tc.protocol, *got, *want)
+		}
+	}
+}
+
+func TestIoctlResponse(t *testing.T) {
+	const outSize = int(unsafe.Sizeof(fusekernel.IoctlOut{}))
+	c := &Connection{}
+
+	// Output beyond the argument buffer is dropped.
+	var m buffer.OutMessage
+	m.Reset()
+	c.kernelResponseForOp(&m, &fuseops.IoctlOp{OutputSize: 4, Result: 1, Output: []byte("tacos")})
+
+	if got := m.Len() - buffer.OutMessageHeaderSize; got != outSize+4 {
+		t.Fatalf("Response length: got %d, want %d", got, outSize+4)
+	}
+
+	out := (*fusekernel.IoctlOut)(unsafe.Pointer(&m.Sglist[1][0]))
+	if out.Result != 1 || out.Flags != 0 || string(m.Sglist[2]) != "taco" {
+		t.Errorf("Unexpected response: %+v, %q", *out, m.Sglist[2])
+	}
+
+	// Asking for a retry.
+	m.Reset()
+	c.kernelResponseForOp(&m, &fuseops.IoctlOp{
+		Flags:    fuseops.IoctlUnrestricted,
+		Output:   []byte("ignored"),
+		RetryIn:  []fuseops.IoctlIovec{{Base: 0x1000, Len: 8}},
+		RetryOut: []fuseops.IoctlIovec{{Base: 0x2000, Len: 16}, {Base: 0x3000, Len: 4}},
+	})
+
+	const iovSize = int(unsafe.Sizeof(fusekernel.IoctlIovec{}))
+	if got := m.Len() - buffer.OutMessageHeaderSize; got != outSize+3*iovSize {
+		t.Fatalf("Response length: got %d, want %d", got, outSize+3*iovSize)
+	}
+
+	out = (*fusekernel.IoctlOut)(unsafe.Pointer(&m.Sglist[1][0]))
+	if out.Flags != fusekernel.IoctlRetry || out.InIovs != 1 || out.OutIovs != 2 {
+		t.Errorf("Unexpected response: %+v", *out)
+	}
+
+	iov := (*fusekernel.IoctlIovec)(unsafe.Pointer(&m.Sglist[3][0]))
+	if iov.Base != 0x2000 || iov.Len != 16 {
+		t.Errorf("Unexpected iovec: %+v", *iov)
+	}
+}
+
+func TestLSeekResponse(t *testing.T) {
+	c := &Connection{}
+	var m buffer.OutMessage
+	m.Reset()
+	c.kernelResponseForOp(&m, &fuseops.LSeekOp{Offset: 1, Whence: fuseops.SeekHole, ResultOffset: 1 << 33})
+
+	out := (*fusekernel.LseekOut)(unsafe.Pointer(&m.Sglist[1][0]))
+	if out.Offset != 1<<33 {
+		t.Errorf("Offset: got %d", out.Offset)
+	}
+}
+
+func TestConvertDestroy(t *testing.T) {
+	h := fusekernel.InHeader{
+		Len:    uint32(unsafe.Sizeof(fusekernel.InHeader{})),
+		Opcode: fusekernel.OpDestroy,
+		Unique: 7,
+	}
+	b := (*[unsafe.Sizeof(fusekernel.InHeader{})]byte)(unsafe.Pointer(&h))[:]
+
+	inMsg := buffer.NewInMessage(4096)
+	if err := inMsg.Init(bytes.NewReader(b)); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	op, err := convertInMessage(&MountConfig{}, inMsg, nil, fusekernel.Protocol{Major: 7, Minor: 31})
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	if got, ok := op.(*fuseops.DestroyOp); !ok || got.OpContext.FuseID != 7 {
+		t.Errorf("Unexpected op: %#v", op)
+	}
+
+	// The kernel waits for a reply, which has no body.
+	c := &Connection{}
+	var m buffer.OutMessage
+	m.Reset()
+	if noResponse := c.kernelResponse(&m, 7, op, nil); noResponse {
+		t.Error("Expected a response")
+	}
+
+	if got := m.Len(); got != buffer.OutMessageHeaderSize {
+		t.Errorf("Response length: got %d", got)
+	}
+}
+
+func TestOpenPassthroughResponse(t *testing.T) {
+	c := &Connection{}
+	var m buffer.OutMessage
+	m.Reset()
+	c.kernelResponseForOp(&m, &fuseops.OpenFileOp{Handle: 2, BackingID: 3})
+
+	out := (*fusekernel.OpenOut)(unsafe.Pointer(&m.Sglist[1][0]))
+	if out.Fh != 2 || out.OpenFlags&uint32(fusekernel.OpenPassthrough) == 0 || out.BackingID != 3 {
+		t.Errorf("Unexpected response: %+v", *out)
+	}
+
+	// No backing file, no passthrough.
+	m.Reset()
+	c.kernelResponseForOp(&m, &fuseops.OpenFileOp{Handle: 2})
+
+	out = (*fusekernel.OpenOut)(unsafe.Pointer(&m.Sglist[1][0]))
+	if out.OpenFlags&uint32(fusekernel.OpenPassthrough) != 0 || out.BackingID != 0 {
+		t.Errorf("Unexpected response: %+v", *out)
+	}
+}
+
+func TestOpenResponseCacheFlags(t *testing.T) {
+	c := &Connection{protocol: fusekernel.Protocol{Major: 7, Minor: 31}}
+	all := uint32(fusekernel.OpenKeepCache | fusekernel.OpenDirectIO | fusekernel.OpenNonSeekable)
+
+	var m buffer.OutMessage
+	m.Reset()
+	c.kernelResponseForOp(&m, &fuseops.OpenFileOp{KeepPageCache: true, UseDirectIO: true, NonSeekable: true})
+
+	out := (*fusekernel.OpenOut)(unsafe.Pointer(&m.Sglist[1][0]))
+	if out.OpenFlags != all {
+		t.Errorf("OpenFileOp flags: got %#x, want %#x", out.OpenFlags, all)
+	}
+
+	m.Reset()
+	c.kernelResponseForOp(&m, &fuseops.CreateFileOp{KeepPageCache: true, UseDirectIO: true, NonSeekable: true})
+
+	oo := (*fusekernel.OpenOut)(unsafe.Pointer(&m.Sglist[2][0]))
+	if oo.OpenFlags != all {
+		t.Errorf("CreateFileOp flags: got %#x, want %#x", oo.OpenFlags, all)
+	}
+
+	// Kernels that predate FOPEN_NONSEEKABLE don't get it.
+	c.protocol = fusekernel.Protocol{Major: 7, Minor: 8}
+	m.Reset()
+	c.kernelResponseForOp(&m, &fuseops.OpenFileOp{NonSeekable: true})
+
+	out = (*fusekernel.OpenOut)(unsafe.Pointer(&m.Sglist[1][0]))
+	if out.OpenFlags != 0 {
+		t.Errorf("Old protocol flags: got %#x", out.OpenFlags)
+	}
+}
+
+func TestConvertUmask(t *testing.T) {
+	type mkdirMsg struct {
+		h    fusekernel.InHeader
+		in   fusekernel.MkdirIn
+		name [4]byte
+	}
+
+	msg := mkdirMsg{
+		h: fusekernel.InHeader{
+			Len:    uint32(unsafe.Sizeof(mkdirMsg{})),
+			Opcode: fusekernel.OpMkdir,
+			Unique: 1,
+			Nodeid: 2,
+			Uid:    1000,
+			Gid:    100,
+			Pid:    17,
+		},
+		in:   fusekernel.MkdirIn{Mode: 0755, Umask: 022},
+		name: [4]byte{'f', 'o', 'o', 0},
+	}
+
+	// Kernels older than 7.12 don't send the umask.
+	testCases := []struct {
+		protocol  fusekernel.Protocol
+		wantUmask os.FileMode
+	}{
+		{fusekernel.Protocol{Major: 7, Minor: 11}, 0},
+		{fusekernel.Protocol{Major: 7, Minor: 31}, 022},
+	}
+
+	for _, tc := range testCases {
+		b := (*[unsafe.Sizeof(mkdirMsg{})]byte)(unsafe.Pointer(&msg))[:]
+
+		inMsg := buffer.NewInMessage(4096)
+		if err := inMsg.Init(bytes.NewReader(b)); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		op, err := convertInMessage(&MountConfig{}, inMsg, nil, tc.protocol)
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		want := fuseops.OpContext{
+			FuseID: 1,
+			Pid:    17,
+			Uid:    1000,
+			Gid:    100,
+			Umask:  tc.wantUmask,
+			Header: fuseops.RequestHeader{
+				Len:    msg.h.Len,
+				Opcode: fusekernel.OpMkdir,
+				Unique: 1,
+				Nodeid: 2,
+				Uid:    1000,
+				Gid:    100,
+				Pid:    17,
+			},
+		}
+		if got := op.(*fuseops.MkDirOp); got.OpContext != want || got.Name != "foo" {
+			t.Errorf("%v: got %+v", tc.protocol, *got)
+		}
+	}
+}
+
+func TestConvertAccess(t *testing.T) {
+	type accessMsg struct {
+		h  fusekernel.InHeader
+		in fusekernel.AccessIn
+	}
+
+	msg := accessMsg{
+		h: fusekernel.InHeader{
+			Len:    uint32(unsafe.Sizeof(accessMsg{})),
+			Opcode: fusekernel.OpAccess,
+			Unique: 1,
+			Nodeid: 2,
+			Uid:    1000,
+		},
+		in: fusekernel.AccessIn{Mask: fuseops.AccessRead | fuseops.AccessExecute},
+	}
+	b := (*[unsafe.Sizeof(accessMsg{})]byte)(unsafe.Pointer(&msg))[:]
+
+	inMsg := buffer.NewInMessage(4096)
+	if err := inMsg.Init(bytes.NewReader(b)); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	op, err := convertInMessage(&MountConfig{}, inMsg, nil, fusekernel.Protocol{Major: 7, Minor: 31})
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	want := &fuseops.AccessOp{
+		Inode: 2,
+		Mask:  5,
+		OpContext: fuseops.OpContext{
+			FuseID: 1,
+			Uid:    1000,
+			Header: fuseops.RequestHeader{Len: msg.h.Len, Opcode: fusekernel.OpAccess, Unique: 1, Nodeid: 2, Uid: 1000},
+		},
+	}
+
+	if got, ok := op.(*fuseops.AccessOp); !ok || *got != *want {
+		t.Errorf("Got %#v, want %#v", op, want)
+	}
+
+	// Granted access has an empty reply.
+	c := &Connection{}
+	var m buffer.OutMessage
+	m.Reset()
+	if c.kernelResponse(&m, 1, op, nil); m.Len() != buffer.OutMessageHeaderSize {
+		t.Errorf("Response length: got %d", m.Len())
+	}
+}
+
+func TestConvertLocks(t *testing.T) {
+	type lkMsg struct {
+		h  fusekernel.InHeader
+		in fusekernel.LkIn
+	}
+
+	msg := lkMsg{
+		h: fusekernel.InHeader{
+			Len:    uint32(unsafe.Sizeof(lkMsg{})),
+			Unique: 1,
+			Nodeid: 2,
+		},
+		in: fusekernel.LkIn{
+			Fh:      3,
+			Owner:   4,
+			LkFlags: fusekernel.LkFlock,
+		},
+	}
+	msg.in.Lk.End = uint64(fuseops.LockToEOF)
+	msg.in.Lk.Type = fuseops.LockWrite
+	msg.in.Lk.Pid = 17
+
+	convert := func(opcode uint32) interface{} {
+		msg.h.Opcode = opcode
+		b := (*[unsafe.Sizeof(lkMsg{})]byte)(unsafe.Pointer(&msg))[:]
+
+		inMsg := buffer.NewInMessage(4096)
+		if err := inMsg.Init(bytes.NewReader(b)); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		op, err := convertInMessage(&MountConfig{}, inMsg, nil, fusekernel.Protocol{Major: 7, Minor: 31})
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		return op
+	}
+
+	wantLock := fuseops.FileLock{End: fuseops.LockToEOF, Type: fuseops.LockWrite, Pid: 17}
+	want := fuseops.SetLkWOp{
+		Inode:  2,
+		Handle: 3,
+		Owner:  4,
+		Lock:   wantLock,
+		Flock:  true,
+		OpContext: fuseops.OpContext{
+			FuseID: 1,
+			Header: fuseops.RequestHeader{Len: msg.h.Len, Opcode: fusekernel.OpSetlkw, Unique: 1, Nodeid: 2},
+		},
+	}
+
+	if got, ok := convert(fusekernel.OpSetlkw).(*fuseops.SetLkWOp); !ok || *got != want {
+		t.Errorf("SetLkW: got %+v, want %+v", got, want)
+	}
+
+	if got, ok := convert(fusekernel.OpSetlk).(*fuseops.SetLkOp); !ok || got.Lock != wantLock || !got.Flock {
+		t.Errorf("SetLk: got %+v", got)
+	}
+
+	// GetLk reports no conflict unless the file system says otherwise.
+	getLk, ok := convert(fusekernel.OpGetlk).(*fuseops.GetLkOp)
+	if !ok || getLk.Lock != wantLock || getLk.Conflict.Type != fuseops.LockUnlock {
+		t.Fatalf("GetLk: got %+v", getLk)
+	}
+
+	getLk.Conflict = fuseops.FileLock{Start: 10, End: 20, Type: fuseops.LockRead, Pid: 18}
+
+	c := &Connection{}
+	var m buffer.OutMessage
+	m.Reset()
+	c.kernelResponseForOp(&m, getLk)
+
+	out := (*fusekernel.LkOut)(unsafe.Pointer(&m.Sglist[1][0]))
+	if out.Lk.Start != 10 || out.Lk.End != 20 || out.Lk.Type != fuseops.LockRead || out.Lk.Pid != 18 {
+		t.Errorf("Unexpected response: %+v", *out)
+	}
+}
+
+func TestConvertRename2(t *testing.T) {
+	type rename2Msg struct {
+		h     fusekernel.InHeader
+		in    fusekernel.Rename2In
+		names [8]byte
+	}
+
+	msg := rename2Msg{
+		h: fusekernel.InHeader{
+			Len:    uint32(unsafe.Sizeof(rename2Msg{})),
+			Opcode: fusekernel.OpRename2,
+			Unique: 1,
+			Nodeid: 2,
+		},
+		in: fusekernel.Rename2In{
+			Newdir: 3,
+			Flags:  fuseops.RenameExchange,
+		},
+		names: [8]byte{'f', 'o', 'o', 0, 'b', 'a', 'r', 0},
+	}
+	b := (*[unsafe.Sizeof(rename2Msg{})]byte)(unsafe.Pointer(&msg))[:]
+
+	convert := func(cfg *MountConfig) interface{} {
+		inMsg := buffer.NewInMessage(4096)
+		if err := inMsg.Init(bytes.NewReader(b)); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		op, err := convertInMessage(cfg, inMsg, nil, fusekernel.Protocol{Major: 7, Minor: 31})
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		return op
+	}
+
+	// Without the config option, the op is left unimplemented.
+	if op, ok := convert(&MountConfig{}).(*unknownOp); !ok || op.OpCode != fusekernel.OpRename2 {
+		t.Errorf("Got %#v, want unknownOp", op)
+	}
+
+	want := &fuseops.RenameOp{
+		OldParent: 2,
+		OldName:   "foo",
+		NewParent: 3,
+		NewName:   "bar",
+		Flags:     fuseops.RenameExchange,
+		OpContext: fuseops.OpContext{
+			FuseID: 1,
+			Header: fuseops.RequestHeader{Len: msg.h.Len, Opcode: fusekernel.OpRename2, Unique: 1, Nodeid: 2},
+		},
+	}
+
+	op := convert(&MountConfig{EnableRenameFlags: true})
+	if got, ok := op.(*fuseops.RenameOp); !ok || *got != *want {
+		t.Errorf("Got %#v, want %#v", op, want)
+	}
+}
+
+func TestConvertSetattr(t *testing.T) {
+	in := fusekernel.SetattrIn{}
+	in.Valid = uint32(fusekernel.SetattrGid | fusekernel.SetattrAtime | fusekernel.SetattrAtimeNow |
+		fusekernel.SetattrMtime | fusekernel.SetattrCtime)
+	in.Gid = 7
+	in.Atime = 100
+	in.Mtime = 200
+	in.Ctime = 300
+	in.CtimeNsec = 5
+
+	b := rawMessage(fusekernel.OpSetattr, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+	op, err := decodeMessage(&MountConfig{}, b, fusekernel.Protocol{Major: 7, Minor: 31})
+	if err != nil {
+		t.Fatalf("decodeMessage: %v", err)
+	}
+
+	got, ok := op.(*fuseops.SetInodeAttributesOp)
+	if !ok {
+		t.Fatalf("Got %#v", op)
+	}
+
+	// chown(2) with only a group leaves the owner alone; touch(1) without a
+	// time asks for the current one.
+	want := fuseops.SetAttrGid | fuseops.SetAttrAtime | fuseops.SetAttrAtimeNow |
+		fuseops.SetAttrMtime | fuseops.SetAttrCtime
+	if got.Valid != want {
+		t.Errorf("Valid = %#x, want %#x", got.Valid, want)
+	}
+
+	if got.Uid != nil || got.Gid == nil || *got.Gid != 7 || got.Size != nil || got.Mode != nil {
+		t.Errorf("Unexpected fields: %v", got)
+	}
+
+	if got.Atime == nil || got.Atime.Unix() != 100 || got.Mtime == nil || got.Mtime.Unix() != 200 {
+		t.Errorf("Unexpected times: %v, %v", got.Atime, got.Mtime)
+	}
+
+	if got.Ctime == nil || !got.Ctime.Equal(time.Unix(300, 5)) {
+		t.Errorf("Ctime = %v", got.Ctime)
+	}
+}
+
+func TestConvertFsync(t *testing.T) {
+	for _, datasync := range []bool{false, true} {
+		in := fusekernel.FsyncIn{Fh: 9}
+		if datasync {
+			in.FsyncFlags = uint32(fusekernel.FsyncFdatasync)
+		}
+
+		b := rawMessage(fusekernel.OpFsync, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+		op, err := decodeMessage(&MountConfig{}, b, fusekernel.Protocol{Major: 7, Minor: 31})
+		if err != nil {
+			t.Fatalf("decodeMessage: %v", err)
+		}
+
+		got, ok := op.(*fuseops.SyncFileOp)
+		if !ok {
+			t.Fatalf("Got %#v", op)
+		}
+
+		if got.Handle != 9 || got.Datasync != datasync {
+			t.Errorf("Got %+v, want Datasync %v", got, datasync)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+)
+
+// errOSXFUSENotFound is returned from Mount when no macFUSE or OSXFUSE
+// installation is detected.
+var errOSXFUSENotFound = fmt.Errorf("cannot locate macFUSE or OSXFUSE: %w", ErrNoFuseDevice)
+
+// osxfuseInstallation describes the paths used by an installed OSXFUSE
+// version.
+type osxfuseInstallation struct {
+	// Prefix for the device file. At mount time, an incrementing number is
+	// suffixed until a free FUSE device is found.
+	DevicePrefix string
+
+	// Path of the load helper, used to load the kernel extension if no device
+	// files are found.
+	Load string
+
+	// Path of the mount helper, used for the actual mount operation.
+	Mount string
+
+	// Environment variable used to pass the path to the executable calling the
+	// mount helper.
+	DaemonVar string
+
+	// Environment variable used to pass the "called by library" flag.
+	LibVar string
+
+	// Open device manually (false) or receive the FD through a UNIX socket,
+	// like with fusermount (true)
+	UseCommFD bool
+}
+
+var (
+	osxfuseInstallations = []osxfuseInstallation{
+		// v4
+		{
+			DevicePrefix: "/dev/macfuse",
+			Load:         "/Library/Filesystems/macfuse.fs/Contents/Resources/load_macfuse",
+			Mount:        "/Library/Filesystems/macfuse.fs/Contents/Resources/mount_macfuse",
+			DaemonVar:    "_FUSE_DAEMON_PATH",
+			LibVar:       "_FUSE_CALL_BY_LIB",
+			UseCommFD:    true,
+		},
+
+		// v3
+		{
+			DevicePrefix: "/dev/osxfuse",
+			Load:         "/Library/Filesystems/osxfuse.fs/Contents/Resources/load_osxfuse",
+			Mount:        "/Library/Filesystems/osxfuse.fs/Contents/Resources/mount_osxfuse",
+			DaemonVar:    "MOUNT_OSXFUSE_DAEMON_PATH",
+			LibVar:       "MOUNT_OSXFUSE_CALL_BY_LIB",
+		},
+
+		// v2
+		{
+			DevicePrefix: "/dev/osxfuse",
+			Load:         "/Library/Filesystems/osxfusefs.fs/Support/load_osxfusefs",
+			Mount:        "/Library/Filesystems/osxfusefs.fs/Support/mount_osxfusefs",
+			DaemonVar:    "MOUNT_FUSEFS_DAEMON_PATH",
+			LibVar:       "MOUNT_FUSEFS_CALL_BY_LIB",
+		},
+	}
+)
+
+const FUSET_SRV_PATH = "/usr/local/bin/go-nfsv4"
+
+// darwinLayout is the view of the file system used to choose a backend on OS
+// X. It is not build-constrained so that the choice can be tested against a
+// fake layout on any platform.
+type darwinLayout struct {
+	// Report whether the given path exists.
+	exists func(path string) bool
+
+	// Return the value of the given environment variable.
+	getenv func(key string) string
+}
+
+var hostDarwinLayout = darwinLayout{
+	exists: func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	},
+	getenv: os.Getenv,
+}
+
+// darwinBackendChoice is the result of chooseBackend: exactly one of the
+// fields is set.
+type darwinBackendChoice struct {
+	// Path of the FUSE-T NFS server.
+	fuseT string
+
+	// The newest OSXFUSE installation found.
+	osxfuse *osxfuseInstallation
+}
+
+// Return the path of the FUSE-T NFS server, which may be overridden by the
+// FUSE_NFSSRV_PATH environment variable.
+func (l darwinLayout) fusetBinary() (string, error) {
+	path := l.getenv("FUSE_NFSSRV_PATH")
+	if path == "" {
+		path = FUSET_SRV_PATH
+	}
+
+	if l.exists(path) {
+		return path, nil
+	}
+
+	return "", fmt.Errorf("FUSE-T not found: %w", ErrNoFuseDevice)
+}
+
+// Return the newest OSXFUSE version installed, judged by its mount helper.
+func (l darwinLayout) osxfuseInstallation() (*osxfuseInstallation, error) {
+	for i := range osxfuseInstallations {
+		if l.exists(osxfuseInstallations[i].Mount) {
+			return &osxfuseInstallations[i], nil
+		}
+	}
+
+	return nil, errOSXFUSENotFound
+}
+
+// Choose how to mount for the given MountConfig.DarwinBackend.
+func (l darwinLayout) chooseBackend(b DarwinBackend) (darwinBackendChoice, error) {
+	switch b {
+	case DarwinBackendAuto:
+		if path, err := l.fusetBinary(); err == nil {
+			return darwinBackendChoice{fuseT: path}, nil
+		}
+		fallthrough
+
+	case DarwinBackendMacFUSE:
+		loc, err := l.osxfuseInstallation()
+		if err != nil {
+			return darwinBackendChoice{}, err
+		}
+		return darwinBackendChoice{osxfuse: loc}, nil
+
+	case DarwinBackendFuseT:
+		path, err := l.fusetBinary()
+		if err != nil {
+			return darwinBackendChoice{}, err
+		}
+		return darwinBackendChoice{fuseT: path}, nil
+	}
+
+	return darwinBackendChoice{}, fmt.Errorf("unknown DarwinBackend: %v", b)
+}
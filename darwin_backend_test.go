@@ -0,0 +1,141 @@
+package fuse
+
+import (
+	"errors"
+	"testing"
+)
+
+// A fake layout containing the given paths, with FUSE_NFSSRV_PATH set to
+// nfssrv if non-empty.
+func fakeDarwinLayout(nfssrv string, paths ...string) darwinLayout {
+	present := make(map[string]bool)
+	for _, p := range paths {
+		present[p] = true
+	}
+
+	return darwinLayout{
+		exists: func(path string) bool { return present[path] },
+		getenv: func(key string) string {
+			if key == "FUSE_NFSSRV_PATH" {
+				return nfssrv
+			}
+			return ""
+		},
+	}
+}
+
+func TestChooseDarwinBackend(t *testing.T) {
+	macfuse := osxfuseInstallations[0].Mount
+	osxfuse3 := osxfuseInstallations[1].Mount
+	osxfuse2 := osxfuseInstallations[2].Mount
+
+	testCases := []struct {
+		name    string
+		layout  darwinLayout
+		backend DarwinBackend
+
+		// Expected FUSE-T server or OSXFUSE mount helper, or error.
+		wantFuseT string
+		wantMount string
+		wantErr   error
+	}{
+		{
+			name:    "nothing installed",
+			layout:  fakeDarwinLayout(""),
+			backend: DarwinBackendAuto,
+			wantErr: ErrNoFuseDevice,
+		},
+		{
+			name:      "auto prefers FUSE-T",
+			layout:    fakeDarwinLayout("", FUSET_SRV_PATH, macfuse),
+			backend:   DarwinBackendAuto,
+			wantFuseT: FUSET_SRV_PATH,
+		},
+		{
+			name:      "auto falls back to macFUSE",
+			layout:    fakeDarwinLayout("", macfuse),
+			backend:   DarwinBackendAuto,
+			wantMount: macfuse,
+		},
+		{
+			name:      "auto honours FUSE_NFSSRV_PATH",
+			layout:    fakeDarwinLayout("/opt/go-nfsv4", "/opt/go-nfsv4"),
+			backend:   DarwinBackendAuto,
+			wantFuseT: "/opt/go-nfsv4",
+		},
+		{
+			name:      "FUSE_NFSSRV_PATH missing",
+			layout:    fakeDarwinLayout("/opt/go-nfsv4", FUSET_SRV_PATH, osxfuse3),
+			backend:   DarwinBackendAuto,
+			wantMount: osxfuse3,
+		},
+		{
+			name:      "macFUSE chosen despite FUSE-T",
+			layout:    fakeDarwinLayout("", FUSET_SRV_PATH, macfuse),
+			backend:   DarwinBackendMacFUSE,
+			wantMount: macfuse,
+		},
+		{
+			name:      "newest OSXFUSE wins",
+			layout:    fakeDarwinLayout("", osxfuse2, osxfuse3),
+			backend:   DarwinBackendMacFUSE,
+			wantMount: osxfuse3,
+		},
+		{
+			name:      "OSXFUSE v2",
+			layout:    fakeDarwinLayout("", osxfuse2),
+			backend:   DarwinBackendMacFUSE,
+			wantMount: osxfuse2,
+		},
+		{
+			name:    "macFUSE missing",
+			layout:  fakeDarwinLayout("", FUSET_SRV_PATH),
+			backend: DarwinBackendMacFUSE,
+			wantErr: errOSXFUSENotFound,
+		},
+		{
+			name:      "FUSE-T chosen despite macFUSE",
+			layout:    fakeDarwinLayout("", FUSET_SRV_PATH, macfuse),
+			backend:   DarwinBackendFuseT,
+			wantFuseT: FUSET_SRV_PATH,
+		},
+		{
+			name:    "FUSE-T missing",
+			layout:  fakeDarwinLayout("", macfuse),
+			backend: DarwinBackendFuseT,
+			wantErr: ErrNoFuseDevice,
+		},
+		{
+			name:    "unknown backend",
+			layout:  fakeDarwinLayout("", FUSET_SRV_PATH, macfuse),
+			backend: DarwinBackend(17),
+			wantErr: errors.New("unknown DarwinBackend: DarwinBackend(17)"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			choice, err := tc.layout.chooseBackend(tc.backend)
+			if tc.wantErr != nil {
+				if err == nil || (!errors.Is(err, tc.wantErr) && err.Error() != tc.wantErr.Error()) {
+					t.Fatalf("got %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("chooseBackend: %v", err)
+			}
+
+			if choice.fuseT != tc.wantFuseT {
+				t.Errorf("fuseT = %q, want %q", choice.fuseT, tc.wantFuseT)
+			}
+			var gotMount string
+			if choice.osxfuse != nil {
+				gotMount = choice.osxfuse.Mount
+			}
+			if gotMount != tc.wantMount {
+				t.Errorf("OSXFUSE mount helper = %q, want %q", gotMount, tc.wantMount)
+			}
+		})
+	}
+}
@@ -70,6 +70,14 @@ func describeRequest(op interface{}) (s string) {
 		addComponent("opcode %d", typed.OpCode)
 
 	case *fuseops.SetInodeAttributesOp:
+		if typed.Uid != nil {
+			addComponent("uid %d", *typed.Uid)
+		}
+
+		if typed.Gid != nil {
+			addComponent("gid %d", *typed.Gid)
+		}
+
 		if typed.Size != nil {
 			addComponent("size %d", *typed.Size)
 		}
@@ -78,19 +86,32 @@ func describeRequest(op interface{}) (s string) {
 			addComponent("mode %v", *typed.Mode)
 		}
 
-		if typed.Atime != nil {
+		switch {
+		case typed.Valid&fuseops.SetAttrAtimeNow != 0:
+			addComponent("atime now")
+		case typed.Atime != nil:
 			addComponent("atime %v", *typed.Atime)
 		}
 
-		if typed.Mtime != nil {
+		switch {
+		case typed.Valid&fuseops.SetAttrMtimeNow != 0:
+			addComponent("mtime now")
+		case typed.Mtime != nil:
 			addComponent("mtime %v", *typed.Mtime)
 		}
 
+		if typed.Ctime != nil {
+			addComponent("ctime %v", *typed.Ctime)
+		}
+
 	case *fuseops.RenameOp:
 		addComponent("old_parent %v", typed.OldParent)
 		addComponent("old_name %q", typed.OldName)
 		addComponent("new_parent %v", typed.NewParent)
 		addComponent("new_name %q", typed.NewName)
+		if typed.Flags != 0 {
+			addComponent("flags %#x", typed.Flags)
+		}
 
 	case *fuseops.ReadFileOp:
 		addComponent("handle %d", typed.Handle)
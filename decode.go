@@ -0,0 +1,42 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// decodeMessage decodes a single raw message from the kernel, i.e. a
+// fusekernel.InHeader followed by its payload, as ReadOp would, returning the
+// resulting op or an error. It is the entry point for fuzzing the decoder:
+// malformed messages must produce errors, never panics.
+func decodeMessage(
+	config *MountConfig,
+	msg []byte,
+	protocol fusekernel.Protocol) (op interface{}, err error) {
+	inMsg := buffer.NewInMessage(len(msg))
+	if err := inMsg.Init(bytes.NewReader(msg)); err != nil {
+		return nil, fmt.Errorf("Init: %v", err)
+	}
+
+	var outMsg buffer.OutMessage
+	outMsg.Reset()
+
+	return convertInMessage(config, inMsg, &outMsg, protocol)
+}
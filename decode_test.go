@@ -0,0 +1,141 @@
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Build a raw message with the given opcode and payload, with the header's
+// length filled in.
+func rawMessage(opcode uint32, payload ...[]byte) []byte {
+	h := fusekernel.InHeader{
+		Opcode: opcode,
+		Unique: 1,
+		Nodeid: 2,
+	}
+
+	b := append([]byte(nil), (*[unsafe.Sizeof(h)]byte)(unsafe.Pointer(&h))[:]...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+
+	(*fusekernel.InHeader)(unsafe.Pointer(&b[0])).Len = uint32(len(b))
+	return b
+}
+
+// The bytes of a fixed-size kernel struct, all of which are laid out without
+// implicit padding, in the little-endian order of the platforms we support.
+func wireBytes(v interface{}) []byte {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, seed := range decodeCorpus() {
+		f.Add(seed.msg)
+	}
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		for _, cfg := range []*MountConfig{{}, {UseVectoredRead: true, EnableRenameFlags: true}} {
+			decodeMessage(cfg, msg, fusekernel.Protocol{Major: 7, Minor: 31})
+			decodeMessage(cfg, msg, fusekernel.Protocol{Major: 7, Minor: 8})
+		}
+	})
+}
+
+type decodeCase struct {
+	name string
+	msg  []byte
+
+	// The %T of the op the message should decode to, or empty if it should be
+	// rejected.
+	want string
+}
+
+// A corpus of well-formed and malformed messages, seeding the fuzzer and
+// checked by TestDecodeConformance.
+func decodeCorpus() []decodeCase {
+	// Some structs have fields promoted from embedded ones, which can't be
+	// set in literals.
+	var setattr fusekernel.SetattrIn
+	setattr.Valid = uint32(fusekernel.SetattrSize)
+	setattr.Size = 3
+
+	var setxattr, setxattrLong fusekernel.SetxattrIn
+	setxattr.Size = 1
+	setxattrLong.Size = 100
+
+	var getxattr, getxattrHuge fusekernel.GetxattrIn
+	getxattr.Size = 16
+	getxattrHuge.Size = 1 << 31
+
+	return []decodeCase{
+		{"lookup", rawMessage(fusekernel.OpLookup, []byte("foo\x00")), "*fuseops.LookUpInodeOp"},
+		{"lookup without NUL", rawMessage(fusekernel.OpLookup, []byte("foo")), ""},
+		{"lookup empty", rawMessage(fusekernel.OpLookup), ""},
+		{"getattr", rawMessage(fusekernel.OpGetattr), "*fuseops.GetInodeAttributesOp"},
+		{"setattr", rawMessage(fusekernel.OpSetattr, wireBytes(&setattr)), "*fuseops.SetInodeAttributesOp"},
+		{"setattr short", rawMessage(fusekernel.OpSetattr, []byte{1, 2, 3}), ""},
+		{"forget", rawMessage(fusekernel.OpForget, wireBytes(&fusekernel.ForgetIn{Nlookup: 1})), "*fuseops.ForgetInodeOp"},
+		{"batch forget", rawMessage(fusekernel.OpBatchForget, wireBytes(&fusekernel.BatchForgetCountIn{Count: 1}), wireBytes(&fusekernel.BatchForgetEntryIn{Inode: 2, Nlookup: 1})), "*fuseops.BatchForgetOp"},
+		{"batch forget overlong count", rawMessage(fusekernel.OpBatchForget, wireBytes(&fusekernel.BatchForgetCountIn{Count: 1 << 30})), ""},
+		{"mkdir", rawMessage(fusekernel.OpMkdir, wireBytes(&fusekernel.MkdirIn{Mode: 0755}), []byte("dir\x00")), "*fuseops.MkDirOp"},
+		{"mkdir without name", rawMessage(fusekernel.OpMkdir, wireBytes(&fusekernel.MkdirIn{Mode: 0755})), ""},
+		{"create", rawMessage(fusekernel.OpCreate, wireBytes(&fusekernel.CreateIn{Mode: 0644}), []byte("f\x00")), "*fuseops.CreateFileOp"},
+		{"symlink", rawMessage(fusekernel.OpSymlink, []byte("link\x00target\x00")), "*fuseops.CreateSymlinkOp"},
+		{"symlink one name", rawMessage(fusekernel.OpSymlink, []byte("link\x00")), ""},
+		{"rename", rawMessage(fusekernel.OpRename, wireBytes(&fusekernel.RenameIn{Newdir: 3}), []byte("a\x00b\x00")), "*fuseops.RenameOp"},
+		{"rename one name", rawMessage(fusekernel.OpRename, wireBytes(&fusekernel.RenameIn{Newdir: 3}), []byte("ab\x00")), ""},
+		{"rename one long name", rawMessage(fusekernel.OpRename, wireBytes(&fusekernel.RenameIn{Newdir: 3}), []byte("abc\x00")), ""},
+		{"read", rawMessage(fusekernel.OpRead, wireBytes(&fusekernel.ReadIn{Size: 4096})), "*fuseops.ReadFileOp"},
+		{"read huge", rawMessage(fusekernel.OpRead, wireBytes(&fusekernel.ReadIn{Size: 1 << 31})), ""},
+		{"readdir", rawMessage(fusekernel.OpReaddir, wireBytes(&fusekernel.ReadIn{Size: 4096})), "*fuseops.ReadDirOp"},
+		{"readdir huge", rawMessage(fusekernel.OpReaddir, wireBytes(&fusekernel.ReadIn{Size: 1 << 31})), ""},
+		{"write", rawMessage(fusekernel.OpWrite, wireBytes(&fusekernel.WriteIn{Size: 4}), []byte("taco")), "*fuseops.WriteFileOp"},
+		{"write overlong size", rawMessage(fusekernel.OpWrite, wireBytes(&fusekernel.WriteIn{Size: 5}), []byte("taco")), ""},
+		{"setxattr", rawMessage(fusekernel.OpSetxattr, wireBytes(&setxattr), []byte("user.a\x00b")), "*fuseops.SetXattrOp"},
+		{"setxattr overlong value", rawMessage(fusekernel.OpSetxattr, wireBytes(&setxattrLong), []byte("user.a\x00b")), ""},
+		{"getxattr", rawMessage(fusekernel.OpGetxattr, wireBytes(&getxattr), []byte("user.a\x00")), "*fuseops.GetXattrOp"},
+		{"getxattr huge", rawMessage(fusekernel.OpGetxattr, wireBytes(&getxattrHuge), []byte("user.a\x00")), ""},
+		{"ioctl overlong input", rawMessage(fusekernel.OpIoctl, wireBytes(&fusekernel.IoctlIn{InSize: 10})), ""},
+		{"init", rawMessage(fusekernel.OpInit, wireBytes(&fusekernel.InitIn{Major: 7, Minor: 31})), "*fuse.initOp"},
+		{"getlk", rawMessage(fusekernel.OpGetlk, wireBytes(&fusekernel.LkIn{})), "*fuseops.GetLkOp"},
+		{"notify reply overlong", rawMessage(fusekernel.OpNotifyReply, wireBytes(&fusekernel.NotifyRetrieveIn{Size: 10})), ""},
+		{"unknown opcode", rawMessage(1000), "*fuse.unknownOp"},
+	}
+}
+
+func TestDecodeConformance(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 31}
+
+	for _, tc := range decodeCorpus() {
+		op, err := decodeMessage(&MountConfig{}, tc.msg, protocol)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("%s: got %T, want an error", tc.name, op)
+
+		case tc.want != "" && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+
+		case tc.want != "" && fmt.Sprintf("%T", op) != tc.want:
+			t.Errorf("%s: got %T, want %s", tc.name, op, tc.want)
+		}
+
+		// Every truncation of the message must decode or fail cleanly.
+		const hdrSize = int(unsafe.Sizeof(fusekernel.InHeader{}))
+		for n := hdrSize; n < len(tc.msg); n++ {
+			truncated := append([]byte(nil), tc.msg[:n]...)
+			(*fusekernel.InHeader)(unsafe.Pointer(&truncated[0])).Len = uint32(n)
+			decodeMessage(&MountConfig{}, truncated, protocol)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+// DeviceError describes a failure to read a request from or write a reply to
+// the fuse device. It is passed to MountConfig.DeviceErrorPolicy, and returned
+// by ReadOp and Reply when the failure isn't otherwise dealt with.
+type DeviceError struct {
+	// Either "read" or "write".
+	Op string
+
+	// The number of times this read or write has failed so far, starting at
+	// one, for policies that retry a bounded number of times.
+	Attempt int
+
+	// The underlying error, typically wrapping a syscall.Errno.
+	Err error
+}
+
+func (e *DeviceError) Error() string {
+	return fmt.Sprintf("%s fuse device: %v", e.Op, e.Err)
+}
+
+func (e *DeviceError) Unwrap() error {
+	return e.Err
+}
+
+// DeviceErrorAction says what to do about a DeviceError.
+type DeviceErrorAction int
+
+const (
+	// Do whatever the connection would do without a policy (see
+	// MountConfig.DeviceErrorPolicy).
+	DeviceErrorDefault DeviceErrorAction = iota
+
+	// Try the read or write again immediately. Policies that want to back off
+	// can sleep before returning this.
+	DeviceErrorRetry
+
+	// Treat the kernel as having hung up: ReadOp returns io.EOF, so that
+	// servers shut down as they do on unmount, and Reply drops the reply and
+	// returns nil.
+	DeviceErrorEOF
+
+	// Report the error: ReadOp or Reply returns the *DeviceError.
+	DeviceErrorFail
+)
+
+// Decide what to do about a failed read or write.
+func (c *Connection) deviceErrorAction(e *DeviceError) DeviceErrorAction {
+	if c.cfg.DeviceErrorPolicy != nil {
+		if a := c.cfg.DeviceErrorPolicy(e); a != DeviceErrorDefault {
+			return a
+		}
+	}
+
+	return defaultDeviceErrorAction(e)
+}
+
+func defaultDeviceErrorAction(e *DeviceError) DeviceErrorAction {
+	if e.Op != "read" {
+		return DeviceErrorFail
+	}
+
+	switch {
+	// ENODEV means fuse has hung up.
+	case errors.Is(e.Err, io.EOF), errors.Is(e.Err, syscall.ENODEV):
+		return DeviceErrorEOF
+
+	// EINTR means we should try again. (This seems to happen often on OS X,
+	// cf. http://golang.org/issue/11180)
+	case errors.Is(e.Err, syscall.EINTR):
+		return DeviceErrorRetry
+	}
+
+	return DeviceErrorFail
+}
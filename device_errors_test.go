@@ -0,0 +1,67 @@
+package fuse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestDefaultDeviceErrorAction(t *testing.T) {
+	testCases := []struct {
+		op   string
+		err  error
+		want DeviceErrorAction
+	}{
+		{"read", &os.PathError{Op: "read", Path: "/dev/fuse", Err: syscall.ENODEV}, DeviceErrorEOF},
+		{"read", &os.PathError{Op: "read", Path: "/dev/fuse", Err: syscall.EINTR}, DeviceErrorRetry},
+		{"read", io.EOF, DeviceErrorEOF},
+		{"read", syscall.EIO, DeviceErrorFail},
+		{"write", syscall.ENODEV, DeviceErrorFail},
+	}
+
+	for _, tc := range testCases {
+		e := &DeviceError{Op: tc.op, Attempt: 1, Err: tc.err}
+		if got := defaultDeviceErrorAction(e); got != tc.want {
+			t.Errorf("%s %v: got %v, want %v", tc.op, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestDeviceErrorPolicy(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	w.Close()
+
+	// Reads of the pipe return io.EOF, which by default ends the connection.
+	// Have the policy retry a couple of times and then report it instead.
+	var attempts []int
+	c := &Connection{
+		dev: r,
+		cfg: MountConfig{
+			DeviceErrorPolicy: func(e *DeviceError) DeviceErrorAction {
+				attempts = append(attempts, e.Attempt)
+				if e.Attempt < 3 {
+					return DeviceErrorRetry
+				}
+
+				return DeviceErrorFail
+			},
+		},
+	}
+
+	_, _, err = c.readMessage()
+
+	var e *DeviceError
+	if !errors.As(err, &e) || e.Op != "read" || !errors.Is(err, io.EOF) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if len(attempts) != 3 || attempts[2] != 3 {
+		t.Errorf("Attempts: %v", attempts)
+	}
+}
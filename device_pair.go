@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Create the two ends of an in-process stand-in for /dev/fuse: the kernel's,
+// and the device to hand to newConnection. Each write to either end is read
+// as a single message at the other, as with the real device.
+func newDevicePair() (kernel, dev *os.File, err error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Socketpair: %w", err)
+	}
+
+	kernel = os.NewFile(uintptr(fds[0]), "replay")
+	dev = os.NewFile(uintptr(fds[1]), "/dev/fuse")
+	return kernel, dev, nil
+}
+
+// Stop sending from the kernel's end of a device pair, so that the connection
+// sees EOF, while still receiving what it writes.
+func hangUp(kernel *os.File) {
+	syscall.Shutdown(int(kernel.Fd()), syscall.SHUT_WR)
+}
@@ -0,0 +1,19 @@
+//go:build !go1.25
+// +build !go1.25
+
+package fuse
+
+import (
+	"errors"
+	"os"
+)
+
+// Before Go 1.25, os.NewFile doesn't recognise overlapped handles, which the
+// device pair needs; see device_pair_windows.go.
+func newDevicePair() (kernel, dev *os.File, err error) {
+	return nil, nil, errors.New("serving file systems on Windows requires Go 1.25 or later")
+}
+
+func hangUp(kernel *os.File) {
+	kernel.Close()
+}
@@ -0,0 +1,79 @@
+//go:build go1.25
+// +build go1.25
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+var devicePairs atomic.Uint64
+
+// Create the two ends of an in-process stand-in for /dev/fuse: the kernel's,
+// here the WinFsp layer's, and the device to hand to newConnection. They are
+// the ends of a message-mode named pipe, so each write to either end is read
+// as a single message at the other, as with the real device.
+//
+// Both ends are opened for overlapped I/O, so that a read pending on one
+// doesn't hold up writes to it. os.NewFile only recognises such handles, and
+// hands them to the runtime's poller, from Go 1.25 on.
+func newDevicePair() (kernel, dev *os.File, err error) {
+	name, err := windows.UTF16PtrFromString(fmt.Sprintf(
+		`\\.\pipe\jacobsa-fuse-%d-%d`,
+		os.Getpid(),
+		devicePairs.Add(1)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	const size = buffer.MaxWriteSize + buffer.MaxReadSize
+	server, err := windows.CreateNamedPipe(
+		name,
+		windows.PIPE_ACCESS_DUPLEX|windows.FILE_FLAG_OVERLAPPED|windows.FILE_FLAG_FIRST_PIPE_INSTANCE,
+		windows.PIPE_TYPE_MESSAGE|windows.PIPE_READMODE_MESSAGE|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		1,
+		size,
+		size,
+		0,
+		nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("CreateNamedPipe: %w", err)
+	}
+
+	client, err := windows.CreateFile(
+		name,
+		windows.GENERIC_READ|windows.GENERIC_WRITE,
+		0,
+		nil,
+		windows.OPEN_EXISTING,
+		windows.FILE_FLAG_OVERLAPPED,
+		0)
+	if err != nil {
+		windows.CloseHandle(server)
+		return nil, nil, fmt.Errorf("CreateFile: %w", err)
+	}
+
+	mode := uint32(windows.PIPE_READMODE_MESSAGE)
+	if err := windows.SetNamedPipeHandleState(client, &mode, nil, nil); err != nil {
+		windows.CloseHandle(server)
+		windows.CloseHandle(client)
+		return nil, nil, fmt.Errorf("SetNamedPipeHandleState: %w", err)
+	}
+
+	kernel = os.NewFile(uintptr(server), "winfsp")
+	dev = os.NewFile(uintptr(client), "/dev/fuse")
+	return kernel, dev, nil
+}
+
+// Make the connection see EOF. A pipe can't be shut down in one direction
+// only, so this closes the kernel's end altogether, and nothing more that the
+// connection writes is received.
+func hangUp(kernel *os.File) {
+	kernel.Close()
+}
@@ -30,7 +30,16 @@
 // as tests for this package: http://godoc.org/github.com/jacobsa/fuse/samples
 //
 // In order to use this package to mount file systems on OS X, the system must
-// have FUSE for OS X installed (see http://osxfuse.github.io/). Do note that
-// there are several OS X-specific oddities; grep through the documentation for
-// more info.
+// have macFUSE (see https://osxfuse.github.io/) or FUSE-T (see
+// https://www.fuse-t.org/) installed; MountConfig.DarwinBackend chooses
+// between them. Do note that there are several OS X-specific oddities; grep
+// through the documentation for more info.
+//
+// On Windows, file systems are mounted with WinFsp (see https://winfsp.dev/),
+// which must be installed, by way of its FUSE API (see
+// https://github.com/winfsp/cgofuse). This needs Go 1.25 or later, and the
+// mount point must be a drive letter such as "X:" or a directory that doesn't
+// exist yet. Requests reach the Server as they would from the Linux kernel,
+// translated from WinFsp's path-based calls; the loopback samples and the
+// fusedaemon background mode are not available.
 package fuse
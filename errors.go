@@ -14,7 +14,19 @@
 
 package fuse
 
-import "syscall"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"syscall"
+)
+
+// Errno is the type of the error numbers with which the kernel is replied to.
+// It is the same type as syscall.Errno, so the two may be used
+// interchangeably.
+type Errno = syscall.Errno
 
 const (
 	// Errors corresponding to kernel error numbers. These may be treated
@@ -27,4 +39,183 @@ const (
 	ENOSYS    = syscall.ENOSYS
 	ENOTDIR   = syscall.ENOTDIR
 	ENOTEMPTY = syscall.ENOTEMPTY
+
+	// Further errors that file systems commonly reply with.
+	EACCES       = syscall.EACCES
+	EAGAIN       = syscall.EAGAIN
+	EBADF        = syscall.EBADF
+	EBUSY        = syscall.EBUSY
+	EINTR        = syscall.EINTR
+	EISDIR       = syscall.EISDIR
+	ENAMETOOLONG = syscall.ENAMETOOLONG
+	ENOSPC       = syscall.ENOSPC
+	ENOTSUP      = syscall.ENOTSUP
+	EPERM        = syscall.EPERM
+	EROFS        = syscall.EROFS
+	ETIMEDOUT    = syscall.ETIMEDOUT
+	EXDEV        = syscall.EXDEV
 )
+
+// ErrInterrupted is the cause (cf. context.Cause) with which the context for
+// an op is cancelled when the kernel sends an interrupt request for it.
+var ErrInterrupted = errors.New("fuse: op interrupted")
+
+// Error is an error that carries both the errno with which the kernel should be
+// replied to and a message for the operator, optionally wrapping an
+// underlying error. When a file system returns one from an op, Connection.Reply
+// sends the errno to the kernel and logs the message as an error (cf.
+// MountConfig.Logger), so that file systems needn't choose between informative
+// errors and correct replies.
+//
+// Errors that merely wrap a syscall.Errno (e.g. using fmt.Errorf with %w) are
+// also replied to with that errno; Error is for cases that want to say more.
+type Error struct {
+	// The error number to send to the kernel. Zero is not a valid reply to an
+	// op that failed, so a zero Errno is ignored and the error is replied to
+	// as if it were any other error, normally with EIO.
+	Errno syscall.Errno
+
+	// A message describing what went wrong, for the operator. May be empty.
+	Message string
+
+	// The underlying error, if any, returned by Unwrap.
+	Err error
+}
+
+// NewError returns an error that replies to the kernel with the supplied errno
+// and has the given formatted message.
+func NewError(errno syscall.Errno, format string, v ...interface{}) *Error {
+	return &Error{
+		Errno:   errno,
+		Message: fmt.Sprintf(format, v...),
+	}
+}
+
+// WrapError returns an error that replies to the kernel with the supplied
+// errno and wraps err, with an optional message giving context.
+func WrapError(errno syscall.Errno, err error, message string) *Error {
+	return &Error{
+		Errno:   errno,
+		Message: message,
+		Err:     err,
+	}
+}
+
+// WithErrno returns an error that replies to the kernel with the supplied
+// errno and otherwise behaves like err, or nil if err is nil. This suits
+// passing on an error from a backend whose meaning the file system knows, e.g.
+// WithErrno(err, ENOSPC) for a quota error.
+func WithErrno(err error, errno syscall.Errno) error {
+	if err == nil {
+		return nil
+	}
+
+	return &Error{Errno: errno, Err: err}
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = e.Errno.Error()
+	}
+
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the error's errno, so that e.g.
+// errors.Is(err, fuse.ENOENT) works for a *Error with Errno ENOENT.
+func (e *Error) Is(target error) bool {
+	errno, ok := target.(syscall.Errno)
+	return ok && errno == e.Errno
+}
+
+// ErrorTranslator maps an error returned by a file system, which carries no
+// errno of its own, to the errno with which to reply to the kernel, returning
+// false if it doesn't recognize the error (cf. MountConfig.ErrorTranslator).
+// A zero errno counts as not recognizing it, since it isn't a valid reply to
+// an op that failed.
+type ErrorTranslator func(err error) (errno syscall.Errno, ok bool)
+
+// TranslateStandardErrors is an ErrorTranslator for the errors of the standard
+// library that have an obvious errno: the io/fs errors (as returned by fs.FS
+// implementations), context.DeadlineExceeded (ETIMEDOUT), and io.EOF and
+// io.ErrUnexpectedEOF as seen when a backend hangs up mid-read (EIO).
+func TranslateStandardErrors(err error) (syscall.Errno, bool) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT, true
+
+	case errors.Is(err, fs.ErrExist):
+		return syscall.EEXIST, true
+
+	case errors.Is(err, fs.ErrPermission):
+		return syscall.EACCES, true
+
+	case errors.Is(err, fs.ErrInvalid):
+		return syscall.EINVAL, true
+
+	case errors.Is(err, fs.ErrClosed):
+		return syscall.EBADF, true
+
+	case errors.Is(err, context.DeadlineExceeded):
+		return syscall.ETIMEDOUT, true
+
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return syscall.EIO, true
+	}
+
+	return 0, false
+}
+
+// Return the errno with which the kernel should be replied to for the supplied
+// error returned by the user: the Errno of a *Error, or a syscall.Errno found
+// in the chain of wrapped errors. Cancellation, as when the op's context is
+// cancelled because the kernel interrupted it, becomes EINTR. Anything else
+// becomes EIO.
+func errnoForError(err error) syscall.Errno {
+	errno, _ := translateError(err, nil)
+	return errno
+}
+
+// Like errnoForError, but consulting the supplied translator, if any, for
+// errors that don't carry an errno before falling back to the default. Also
+// return whether the error was mapped at all, rather than defaulting to EIO.
+func translateError(err error, translate ErrorTranslator) (syscall.Errno, bool) {
+	// A zero errno would reply to the kernel with success, so look past one.
+	var e *Error
+	if errors.As(err, &e) && e.Errno != 0 {
+		return e.Errno, true
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) && errno != 0 {
+		return errno, true
+	}
+
+	if translate != nil {
+		if errno, ok := translate(err); ok && errno != 0 {
+			return errno, true
+		}
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrInterrupted) {
+		return syscall.EINTR, true
+	}
+
+	return syscall.EIO, false
+}
+
+// Return the errno with which to reply to the kernel for an error returned by
+// the user, as for translateError with c.cfg.ErrorTranslator.
+func (c *Connection) errnoForError(err error) syscall.Errno {
+	errno, _ := translateError(err, c.cfg.ErrorTranslator)
+	return errno
+}
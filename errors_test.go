@@ -0,0 +1,166 @@
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+func Test_errnoForError(t *testing.T) {
+	underlying := errors.New("connection reset")
+
+	testCases := []struct {
+		err  error
+		want syscall.Errno
+	}{
+		{ENOENT, syscall.ENOENT},
+		{fmt.Errorf("stat: %w", syscall.EACCES), syscall.EACCES},
+		{NewError(syscall.EROFS, "bucket %q is read-only", "foo"), syscall.EROFS},
+		{WrapError(syscall.EAGAIN, underlying, "backend"), syscall.EAGAIN},
+		{fmt.Errorf("op: %w", WrapError(syscall.EAGAIN, underlying, "")), syscall.EAGAIN},
+		{underlying, syscall.EIO},
+		{context.Canceled, syscall.EINTR},
+		{fmt.Errorf("fetching object: %w", context.Canceled), syscall.EINTR},
+		{context.DeadlineExceeded, syscall.EIO},
+
+		// A zero errno is no errno at all.
+		{&Error{Message: "x"}, syscall.EIO},
+		{WrapError(0, underlying, "backend"), syscall.EIO},
+		{WithErrno(underlying, 0), syscall.EIO},
+		{WithErrno(fmt.Errorf("stat: %w", syscall.EACCES), 0), syscall.EACCES},
+	}
+
+	for _, tc := range testCases {
+		if got := errnoForError(tc.err); got != tc.want {
+			t.Errorf("errnoForError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	underlying := errors.New("connection reset")
+	err := WrapError(syscall.EAGAIN, underlying, "fetching object")
+
+	if got, want := err.Error(), "fetching object: connection reset"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+
+	if !errors.Is(err, underlying) || !errors.Is(err, syscall.EAGAIN) {
+		t.Errorf("errors.Is failed for %v", err)
+	}
+
+	if got, want := (&Error{Errno: syscall.ENOENT}).Error(), syscall.ENOENT.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestWithErrno(t *testing.T) {
+	if WithErrno(nil, ENOSPC) != nil {
+		t.Errorf("Expected nil for a nil error")
+	}
+
+	quota := errors.New("quota exceeded")
+	err := WithErrno(quota, ENOSPC)
+	if err.Error() != "no space left on device: quota exceeded" {
+		t.Errorf("Error() = %q", err.Error())
+	}
+
+	if !errors.Is(err, quota) || errnoForError(fmt.Errorf("put: %w", err)) != syscall.ENOSPC {
+		t.Errorf("Unexpected behavior for %v", err)
+	}
+}
+
+func TestZeroErrnoReply(t *testing.T) {
+	c := &Connection{}
+	for _, err := range []error{
+		&Error{Message: "x"},
+		WrapError(0, errors.New("backend"), ""),
+		WithErrno(errors.New("backend"), 0),
+	} {
+		var m buffer.OutMessage
+		m.Reset()
+		c.kernelResponse(&m, 1, &fuseops.GetInodeAttributesOp{}, err)
+
+		if got := m.OutHeader().Error; got != -int32(syscall.EIO) {
+			t.Errorf("%v: replied with error %d, want %d", err, got, -int32(syscall.EIO))
+		}
+	}
+}
+
+func TestErrorTranslator(t *testing.T) {
+	backendErr := errors.New("backend: throttled")
+	zeroErr := errors.New("backend: confused")
+	translate := func(err error) (Errno, bool) {
+		if errors.Is(err, backendErr) {
+			return EAGAIN, true
+		}
+
+		if errors.Is(err, zeroErr) {
+			return 0, true
+		}
+
+		return TranslateStandardErrors(err)
+	}
+
+	testCases := []struct {
+		err        error
+		want       syscall.Errno
+		wantMapped bool
+	}{
+		{fmt.Errorf("get: %w", backendErr), syscall.EAGAIN, true},
+		{fs.ErrNotExist, syscall.ENOENT, true},
+		{fmt.Errorf("open: %w", fs.ErrPermission), syscall.EACCES, true},
+		{context.DeadlineExceeded, syscall.ETIMEDOUT, true},
+		{io.ErrUnexpectedEOF, syscall.EIO, true},
+
+		// Errnos chosen by the file system win.
+		{WithErrno(backendErr, ENOSPC), syscall.ENOSPC, true},
+		{fmt.Errorf("%w: %v", syscall.EROFS, fs.ErrNotExist), syscall.EROFS, true},
+
+		// The defaults otherwise.
+		{context.Canceled, syscall.EINTR, true},
+		{errors.New("mystery"), syscall.EIO, false},
+
+		// A zero errno from the translator maps nothing.
+		{zeroErr, syscall.EIO, false},
+	}
+
+	for _, tc := range testCases {
+		got, mapped := translateError(tc.err, translate)
+		if got != tc.want || mapped != tc.wantMapped {
+			t.Errorf("translateError(%v) = (%v, %v), want (%v, %v)", tc.err, got, mapped, tc.want, tc.wantMapped)
+		}
+	}
+}
+
+func TestInterruptCause(t *testing.T) {
+	c := &Connection{
+		cfg:         MountConfig{OpContext: context.Background()},
+		cancelFuncs: make(map[uint64]context.CancelCauseFunc),
+	}
+
+	ctx := c.beginOp(0, 17)
+	c.handleInterrupt(17)
+	if ctx.Err() != context.Canceled || context.Cause(ctx) != ErrInterrupted {
+		t.Errorf("Interrupted: got %v, cause %v", ctx.Err(), context.Cause(ctx))
+	}
+
+	// Interrupts for unknown requests are ignored, and finishing an op that
+	// wasn't interrupted cancels its context without blaming the kernel.
+	c.handleInterrupt(17)
+	c.finishOp(0, 17)
+
+	ctx = c.beginOp(0, 19)
+	c.handleInterrupt(23)
+	c.finishOp(0, 19)
+	if context.Cause(ctx) != context.Canceled {
+		t.Errorf("Finished: got cause %v", context.Cause(ctx))
+	}
+}
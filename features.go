@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Features describes the optional kernel behaviors in effect for a
+// connection, as agreed with the kernel when it was initialized. Each is
+// requested through the corresponding MountConfig field (e.g.
+// EnableAsyncReads for AsyncReads) or, for WritebackCache, by not setting
+// DisableWritebackCaching, and is false if the kernel doesn't support it.
+//
+// File systems whose behavior depends on one of these should check it rather
+// than the config; e.g. with writeback caching, the kernel may send writes
+// long after the file was closed, from a different process, and sends size
+// and mtime updates itself.
+type Features struct {
+	WritebackCache    bool
+	AsyncReads        bool
+	AtomicTrunc       bool
+	AutoInvalData     bool
+	ExplicitInvalData bool
+	Readdirplus       bool
+	ReaddirplusAuto   bool
+	ParallelDirOps    bool
+	SymlinkCaching    bool
+	NoOpenSupport     bool
+	NoOpendirSupport  bool
+	Passthrough       bool
+	PosixLocks        bool
+	FlockLocks        bool
+	RenameFlags       bool
+	IDMap             bool
+}
+
+func featuresForFlags(
+	flags fusekernel.InitFlags,
+	flags2 fusekernel.InitFlags2) Features {
+	has := func(f fusekernel.InitFlags) bool { return flags&f != 0 }
+
+	return Features{
+		WritebackCache:    has(fusekernel.InitWritebackCache),
+		AsyncReads:        has(fusekernel.InitAsyncRead),
+		AtomicTrunc:       has(fusekernel.InitAtomicTrunc),
+		AutoInvalData:     has(fusekernel.InitAutoInvalData),
+		ExplicitInvalData: has(fusekernel.InitExplicitInvalData),
+		Readdirplus:       has(fusekernel.InitDoReaddirplus),
+		ReaddirplusAuto:   has(fusekernel.InitReaddirplusAuto),
+		ParallelDirOps:    has(fusekernel.InitParallelDirOps),
+		SymlinkCaching:    has(fusekernel.InitCacheSymlinks),
+		NoOpenSupport:     has(fusekernel.InitNoOpenSupport),
+		NoOpendirSupport:  has(fusekernel.InitNoOpendirSupport),
+		Passthrough:       flags2&fusekernel.InitPassthrough != 0,
+		PosixLocks:        has(fusekernel.InitPosixLocks),
+		FlockLocks:        has(fusekernel.InitFlockLocks),
+		IDMap:             flags2&fusekernel.InitAllowIdmap != 0,
+	}
+}
+
+// Features returns the optional behaviors agreed with the kernel. It is valid
+// once Init has returned, i.e. whenever the Server is serving ops, as are the
+// other accessors below.
+func (c *Connection) Features() Features {
+	return c.features
+}
+
+// Protocol returns the version of the fuse kernel protocol negotiated with
+// the kernel: the older of the kernel's and this package's. Features from
+// newer protocol versions than this are unavailable.
+func (c *Connection) Protocol() (major, minor uint32) {
+	return c.protocol.Major, c.protocol.Minor
+}
+
+// MaxWrite returns the largest amount of data the kernel will send in a single
+// WriteFileOp, taking into account both what we asked for and the kernel's
+// own per-request page limit.
+func (c *Connection) MaxWrite() uint32 {
+	return c.maxWrite
+}
+
+// MaxReadahead returns the maximum number of bytes the kernel will read ahead
+// of the application, as negotiated with the kernel.
+func (c *Connection) MaxReadahead() uint32 {
+	return c.maxReadahead
+}
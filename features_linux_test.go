@@ -0,0 +1,316 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Play the kernel's part of Init over a socket pair, offering the supplied
+// flags, and return the connection along with the flags in its reply.
+func initWithKernelFlags(
+	t testing.TB,
+	cfg MountConfig,
+	offered fusekernel.InitFlags) (*Connection, fusekernel.InitFlags) {
+	c, out := initWithKernel(t, cfg, offered, 0)
+	return c, fusekernel.InitFlags(out.Flags)
+}
+
+// Like initWithKernelFlags, but also offering the supplied upper flags, and
+// returning the whole reply.
+func initWithKernel(
+	t testing.TB,
+	cfg MountConfig,
+	offered fusekernel.InitFlags,
+	offered2 fusekernel.InitFlags2) (*Connection, fusekernel.InitOut) {
+	c, _, out := initWithKernelSocket(t, cfg, offered, offered2)
+	return c, out
+}
+
+// Like initWithKernel, but also returning the kernel's end of the socket pair,
+// for sending further requests.
+func initWithKernelSocket(
+	t testing.TB,
+	cfg MountConfig,
+	offered fusekernel.InitFlags,
+	offered2 fusekernel.InitFlags2) (*Connection, *os.File, fusekernel.InitOut) {
+	in := fusekernel.InitIn{
+		Major:        fusekernel.ProtoVersionMaxMajor,
+		Minor:        fusekernel.ProtoVersionMaxMinor,
+		MaxReadahead: 1 << 17,
+		Flags:        uint32(offered),
+	}
+
+	return initWithKernelIn(t, cfg, in, offered2)
+}
+
+// Like initWithKernelSocket, but with the whole of the kernel's init request
+// (cf. InitIn) under the caller's control.
+func initWithKernelIn(
+	t testing.TB,
+	cfg MountConfig,
+	in fusekernel.InitIn,
+	offered2 fusekernel.InitFlags2) (*Connection, *os.File, fusekernel.InitOut) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	t.Cleanup(func() {
+		kernel.Close()
+		dev.Close()
+	})
+
+	type initMsg struct {
+		h   fusekernel.InHeader
+		in  fusekernel.InitIn
+		ext fusekernel.InitInExt
+	}
+
+	msg := initMsg{
+		h: fusekernel.InHeader{
+			Len:    uint32(unsafe.Sizeof(initMsg{})),
+			Opcode: fusekernel.OpInit,
+			Unique: 1,
+		},
+		in: in,
+		ext: fusekernel.InitInExt{
+			Flags2: uint32(offered2),
+		},
+	}
+
+	msg.in.Flags |= uint32(fusekernel.InitExt)
+	if _, err := kernel.Write((*[unsafe.Sizeof(initMsg{})]byte)(unsafe.Pointer(&msg))[:]); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	cfg.OpContext = context.Background()
+	c := &Connection{
+		cfg:         cfg,
+		logger:      NewLevelLogger(log.New(&bytes.Buffer{}, "", 0), LogError),
+		dev:         dev,
+		cancelFuncs: make(map[uint64]context.CancelCauseFunc),
+	}
+
+	if err := c.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	const hdrSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+	if n < hdrSize+int(unsafe.Offsetof(fusekernel.InitOut{}.MaxBackground)) {
+		t.Fatalf("Short init reply: %d bytes", n)
+	}
+
+	var out fusekernel.InitOut
+	copy((*[unsafe.Sizeof(out)]byte)(unsafe.Pointer(&out))[:], buf[hdrSize:n])
+	return c, kernel, out
+}
+
+func TestFeatures(t *testing.T) {
+	// A kernel that supports writeback caching and READDIRPLUS but not
+	// parallel dir ops, serving a config that asks for all three.
+	cfg := MountConfig{
+		EnableReaddirplus:    true,
+		EnableParallelDirOps: true,
+	}
+
+	offered := fusekernel.InitWritebackCache | fusekernel.InitDoReaddirplus | fusekernel.InitReaddirplusAuto
+	c, replied := initWithKernelFlags(t, cfg, offered)
+
+	want := Features{WritebackCache: true, Readdirplus: true}
+	if got := c.Features(); got != want {
+		t.Errorf("Features: got %+v, want %+v", got, want)
+	}
+
+	if replied&fusekernel.InitReaddirplusAuto != 0 {
+		t.Errorf("Unexpected InitReaddirplusAuto in reply: %v", replied)
+	}
+
+	if major, minor := c.Protocol(); major != 7 || minor != fusekernel.ProtoVersionMaxMinor {
+		t.Errorf("Protocol: got %d.%d", major, minor)
+	}
+
+	// The kernel didn't offer to raise its limit of 32 pages per request.
+	if got, want := c.MaxWrite(), uint32(32*os.Getpagesize()); got != want {
+		t.Errorf("MaxWrite: got %d, want %d", got, want)
+	}
+
+	// Writeback caching is on unless disabled.
+	c, _ = initWithKernelFlags(t, MountConfig{DisableWritebackCaching: true}, offered)
+	if c.Features().WritebackCache {
+		t.Errorf("WritebackCache despite DisableWritebackCaching")
+	}
+
+	// Locks are sent to the file system only if asked for and offered.
+	locks := fusekernel.InitPosixLocks | fusekernel.InitFlockLocks
+	c, replied = initWithKernelFlags(t, MountConfig{EnablePosixLocks: true}, locks)
+	if f := c.Features(); !f.PosixLocks || f.FlockLocks || replied&locks != fusekernel.InitPosixLocks {
+		t.Errorf("Locks: got %+v, replied %v", f, replied)
+	}
+
+	// Rename flags depend only on the config, given a new enough protocol.
+	c, _ = initWithKernelFlags(t, MountConfig{EnableRenameFlags: true}, 0)
+	if !c.Features().RenameFlags {
+		t.Errorf("RenameFlags not in effect")
+	}
+}
+
+func TestMaxWrite(t *testing.T) {
+	cfg := MountConfig{MaxWrite: 4 << 20}
+	c, _ := initWithKernelFlags(t, cfg, fusekernel.InitMaxPages)
+	if got := c.MaxWrite(); got != 4<<20 {
+		t.Errorf("MaxWrite: got %d", got)
+	}
+
+	// Message buffers are sized to match.
+	if got, want := len(c.getInMessage().GetFree(4<<20)), 4<<20; got != want {
+		t.Errorf("Free space in message: got %d, want %d", got, want)
+	}
+
+	if got := maxPagesFor(4<<20 + 1); got != uint16((4<<20)/os.Getpagesize()+1) {
+		t.Errorf("maxPagesFor: got %d", got)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	offered := fusekernel.InitWritebackCache
+
+	// Not asked for.
+	c, out := initWithKernel(t, MountConfig{}, offered, fusekernel.InitPassthrough)
+	if c.Features().Passthrough || out.Flags2 != 0 || !c.Features().WritebackCache {
+		t.Errorf("Unexpected passthrough: %+v, %+v", c.Features(), out)
+	}
+
+	// Asked for but not offered.
+	cfg := MountConfig{EnablePassthrough: true}
+	c, out = initWithKernel(t, cfg, offered, 0)
+	if c.Features().Passthrough || !c.Features().WritebackCache {
+		t.Errorf("Unexpected features: %+v", c.Features())
+	}
+
+	// Both, which turns off writeback caching.
+	c, out = initWithKernel(t, cfg, offered, fusekernel.InitPassthrough)
+	if !c.Features().Passthrough || c.Features().WritebackCache {
+		t.Errorf("Unexpected features: %+v", c.Features())
+	}
+
+	if fusekernel.InitFlags(out.Flags)&fusekernel.InitExt == 0 ||
+		fusekernel.InitFlags2(out.Flags2) != fusekernel.InitPassthrough ||
+		out.MaxStackDepth != 1 {
+		t.Errorf("Unexpected reply: %+v", out)
+	}
+}
+
+func TestIDMap(t *testing.T) {
+	// Not asked for.
+	c, out := initWithKernel(t, MountConfig{}, 0, fusekernel.InitAllowIdmap)
+	if c.Features().IDMap || out.Flags2 != 0 {
+		t.Errorf("Unexpected ID mapping: %+v, %+v", c.Features(), out)
+	}
+
+	// Asked for, but without default permissions, which the kernel requires.
+	cfg := MountConfig{IDMapUserNamespace: os.Stdin, DisableDefaultPermissions: true}
+	c, out = initWithKernel(t, cfg, 0, fusekernel.InitAllowIdmap)
+	if c.Features().IDMap || out.Flags2 != 0 {
+		t.Errorf("Unexpected ID mapping: %+v, %+v", c.Features(), out)
+	}
+
+	// Asked for and offered.
+	cfg.DisableDefaultPermissions = false
+	c, out = initWithKernel(t, cfg, 0, fusekernel.InitAllowIdmap)
+	if !c.Features().IDMap || fusekernel.InitFlags2(out.Flags2) != fusekernel.InitAllowIdmap {
+		t.Errorf("Unexpected ID mapping: %+v, %+v", c.Features(), out)
+	}
+}
+
+func TestAtomicTrunc(t *testing.T) {
+	testCases := []struct {
+		enable  bool
+		offered fusekernel.InitFlags
+		want    bool
+	}{
+		{false, 0, false},
+		{false, fusekernel.InitAtomicTrunc, false},
+		{true, 0, false},
+		{true, fusekernel.InitAtomicTrunc, true},
+	}
+
+	for _, tc := range testCases {
+		_, replied := initWithKernelFlags(t, MountConfig{EnableAtomicTrunc: tc.enable}, tc.offered)
+		if got := replied&fusekernel.InitAtomicTrunc != 0; got != tc.want {
+			t.Errorf("Enabled %v, offered %v: requested %v, want %v", tc.enable, tc.offered, got, tc.want)
+		}
+	}
+
+	// With atomic O_TRUNC, the kernel passes O_TRUNC on to OpenFile.
+	c, kernel, _ := initWithKernelSocket(t, MountConfig{EnableAtomicTrunc: true}, fusekernel.InitAtomicTrunc, 0)
+	in := fusekernel.OpenIn{Flags: uint32(syscall.O_WRONLY | syscall.O_TRUNC)}
+	if _, err := kernel.Write(rawMessage(fusekernel.OpOpen, wireBytes(in))); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	_, op, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	openOp, ok := op.(*fuseops.OpenFileOp)
+	if !ok {
+		t.Fatalf("Unexpected op: %#v", op)
+	}
+
+	if !openOp.OpenFlags.IsTruncate() || !openOp.OpenFlags.IsWriteOnly() {
+		t.Errorf("OpenFlags: got %v", openOp.OpenFlags)
+	}
+}
+
+func TestInvalData(t *testing.T) {
+	const (
+		auto     = fusekernel.InitAutoInvalData
+		explicit = fusekernel.InitExplicitInvalData
+		both     = auto | explicit
+	)
+
+	testCases := []struct {
+		cfg     MountConfig
+		offered fusekernel.InitFlags
+		want    fusekernel.InitFlags
+	}{
+		// Neither is asked for unless configured.
+		{MountConfig{}, both, 0},
+
+		{MountConfig{EnableAutoInvalData: true}, both, auto},
+		{MountConfig{EnableAutoInvalData: true}, explicit, 0},
+
+		{MountConfig{EnableExplicitInvalData: true}, both, explicit},
+		{MountConfig{EnableExplicitInvalData: true}, auto, 0},
+
+		// Auto wins if both are configured, but only if the kernel offers it.
+		{MountConfig{EnableAutoInvalData: true, EnableExplicitInvalData: true}, both, auto},
+		{MountConfig{EnableAutoInvalData: true, EnableExplicitInvalData: true}, auto, auto},
+		{MountConfig{EnableAutoInvalData: true, EnableExplicitInvalData: true}, explicit, explicit},
+		{MountConfig{EnableAutoInvalData: true, EnableExplicitInvalData: true}, 0, 0},
+	}
+
+	for i, tc := range testCases {
+		_, replied := initWithKernelFlags(t, tc.cfg, tc.offered)
+		if got := replied & both; got != tc.want {
+			t.Errorf("Case %d: requested %v, want %v", i, got, tc.want)
+		}
+	}
+}
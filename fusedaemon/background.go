@@ -0,0 +1,139 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package fusedaemon
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The environment variable through which a backgrounded daemon learns the
+// descriptor on which to report its status.
+const statusFDEnv = "FUSEDAEMON_STATUS_FD"
+
+func isBackgroundChild() bool {
+	return os.Getenv(statusFDEnv) != ""
+}
+
+// Start a copy of the program in the background with the same arguments, and
+// wait for it to report whether mounting succeeded. The copy runs in its own
+// session so that it outlives the terminal, with stdin and stdout on
+// /dev/null and stderr kept for logging.
+func (d *Daemon) daemonize(args []string) int {
+	exe, err := os.Executable()
+	if err != nil {
+		d.errorf("Executable: %v", err)
+		return ExitSystem
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		d.errorf("Pipe: %v", err)
+		return ExitSystem
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), statusFDEnv+"=3")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Stderr = d.stderr()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		d.errorf("Starting background process: %v", err)
+		return ExitSystem
+	}
+
+	// The child reports "<status> <message>" and closes the pipe. If it dies
+	// first we see EOF.
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		cmd.Wait()
+		d.errorf("Background process exited before mounting")
+		return ExitMountFailed
+	}
+
+	status, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		d.errorf("Malformed status from background process: %q", line)
+		return ExitSystem
+	}
+
+	// The child has already logged any error.
+	cmd.Process.Release()
+	return code
+}
+
+// Tell the parent of a backgrounded daemon how mounting went, then stop
+// talking to it. Does nothing in the foreground.
+func reportToParent(status int, msg string) {
+	v := os.Getenv(statusFDEnv)
+	if v == "" {
+		return
+	}
+
+	os.Unsetenv(statusFDEnv)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "status")
+	fmt.Fprintf(f, "%d %s\n", status, strings.ReplaceAll(msg, "\n", " "))
+	f.Close()
+
+	// Detach from the terminal now that nobody is waiting on us, except for
+	// stderr, where errors continue to be logged.
+	if devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0); err == nil {
+		syscall.Dup2(int(devNull.Fd()), int(os.Stdin.Fd()))
+		syscall.Dup2(int(devNull.Fd()), int(os.Stdout.Fd()))
+		devNull.Close()
+	}
+}
+
+// Send a state change to systemd, if we are running as a Type=notify service
+// (cf. sd_notify(3)).
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+
+	// A leading @ denotes the abstract namespace.
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.Write([]byte(state))
+}
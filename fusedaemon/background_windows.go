@@ -0,0 +1,18 @@
+package fusedaemon
+
+// A WinFsp mount lasts only as long as the process serving it, and there is
+// no session to detach from, so the daemon only runs in the foreground.
+
+func isBackgroundChild() bool {
+	return false
+}
+
+func (d *Daemon) daemonize(args []string) int {
+	d.errorf("Running in the background isn't supported on Windows; pass -f")
+	return ExitUsage
+}
+
+func reportToParent(status int, msg string) {}
+
+// There is no systemd to notify.
+func sdNotify(state string) {}
@@ -0,0 +1,378 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusedaemon
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+)
+
+// Exit statuses, following the conventions of mount(8) helpers.
+const (
+	ExitOK = 0
+
+	// Incorrect invocation, e.g. a missing mount point or unknown flag.
+	ExitUsage = 1
+
+	// Something went wrong other than mounting, e.g. an error while serving.
+	ExitSystem = 2
+
+	// The file system couldn't be mounted, including because NewServer failed.
+	ExitMountFailed = 32
+)
+
+// Daemon describes a fuse daemon's command line interface. Only NewServer is
+// required.
+type Daemon struct {
+	// The program name for usage and log messages. Defaults to the base name
+	// of os.Args[0].
+	Name string
+
+	// If set, the daemon takes a source argument (e.g. a device, bucket or
+	// directory to serve) before the mount point, as mount(8) supplies for
+	// /etc/fstab entries.
+	HasSource bool
+
+	// If set, called with the flag set before the command line is parsed, to
+	// add the daemon's own flags.
+	SetUpFlags func(fs *flag.FlagSet)
+
+	// The mount configuration to start from. Mount options from the command
+	// line are applied on top of a copy of it.
+	Config fuse.MountConfig
+
+	// Create the server once the command line has been parsed. source is empty
+	// unless HasSource is set. cfg is the configuration that will be used to
+	// mount, and may be modified.
+	NewServer func(source string, cfg *fuse.MountConfig) (fuse.Server, error)
+
+	// Where to write usage and error messages. Defaults to os.Stderr.
+	Stderr io.Writer
+}
+
+// The result of parsing the command line.
+type invocation struct {
+	source     string
+	mountPoint string
+	cfg        fuse.MountConfig
+	foreground bool
+	debug      bool
+}
+
+// Main runs the daemon with the process's command line and exits with the
+// resulting status. It doesn't return.
+func (d *Daemon) Main() {
+	os.Exit(d.Run(context.Background(), os.Args[1:]))
+}
+
+// Run runs the daemon with the supplied command line arguments (not
+// including the program name), returning the exit status. Cancelling ctx
+// unmounts the file system, as SIGINT and SIGTERM do.
+func (d *Daemon) Run(ctx context.Context, args []string) int {
+	inv, err := d.parse(args)
+	if err == flag.ErrHelp {
+		return ExitOK
+	}
+
+	if err != nil {
+		d.errorf("%v", err)
+		return ExitUsage
+	}
+
+	if inv.foreground || isBackgroundChild() {
+		return d.serve(ctx, inv)
+	}
+
+	return d.daemonize(args)
+}
+
+func (d *Daemon) name() string {
+	if d.Name != "" {
+		return d.Name
+	}
+
+	return filepath.Base(os.Args[0])
+}
+
+func (d *Daemon) stderr() io.Writer {
+	if d.Stderr != nil {
+		return d.Stderr
+	}
+
+	return os.Stderr
+}
+
+func (d *Daemon) errorf(format string, v ...interface{}) {
+	fmt.Fprintf(d.stderr(), "%s: %s\n", d.name(), fmt.Sprintf(format, v...))
+}
+
+// Parse the command line. Unlike the flag package's default, flags may
+// follow the positional arguments, since mount(8) puts -o last.
+func (d *Daemon) parse(args []string) (*invocation, error) {
+	inv := &invocation{cfg: d.Config}
+
+	// Options from the command line mustn't write through to d.Config.
+	if d.Config.Options != nil {
+		inv.cfg.Options = make(map[string]string, len(d.Config.Options))
+		for k, v := range d.Config.Options {
+			inv.cfg.Options[k] = v
+		}
+	}
+
+	fs := flag.NewFlagSet(d.name(), flag.ContinueOnError)
+	fs.SetOutput(d.stderr())
+
+	var options []string
+	fs.Func("o", "Mount options, as for mount(8). May be repeated.", func(s string) error {
+		options = append(options, s)
+		return nil
+	})
+
+	fs.BoolVar(&inv.foreground, "f", false, "Stay in the foreground.")
+	fs.BoolVar(&inv.debug, "d", false, "Log every op to stderr. Implies -f.")
+
+	if d.SetUpFlags != nil {
+		d.SetUpFlags(fs)
+	}
+
+	usage := "[flags] mountpoint"
+	if d.HasSource {
+		usage = "[flags] source mountpoint"
+	}
+
+	fs.Usage = func() {
+		fmt.Fprintf(d.stderr(), "Usage: %s %s\n", d.name(), usage)
+		fs.PrintDefaults()
+	}
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		if fs.NArg() == 0 {
+			break
+		}
+
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	want := 1
+	if d.HasSource {
+		want = 2
+	}
+
+	if len(positional) != want {
+		fs.Usage()
+		return nil, fmt.Errorf("Expected %d arguments, got %d", want, len(positional))
+	}
+
+	if d.HasSource {
+		inv.source = positional[0]
+	}
+
+	inv.mountPoint = positional[len(positional)-1]
+
+	for _, s := range options {
+		if applyMountOptions(&inv.cfg, s) {
+			inv.debug = true
+		}
+	}
+
+	if inv.debug {
+		inv.foreground = true
+	}
+
+	return inv, nil
+}
+
+// Mount the file system and serve it until it is unmounted.
+func (d *Daemon) serve(ctx context.Context, inv *invocation) int {
+	logger := log.New(d.stderr(), d.name()+": ", log.LstdFlags)
+
+	// Unless the daemon has chosen its own loggers, log through a LevelLogger,
+	// so that the level can be changed on a running mount (cf.
+	// MountConfig.ControlSocket).
+	if inv.cfg.Logger == nil && inv.cfg.ErrorLogger == nil && inv.cfg.DebugLogger == nil {
+		level := fuse.LogError
+		if inv.debug {
+			level = fuse.LogDebug
+		}
+
+		inv.cfg.Logger = fuse.NewLevelLogger(
+			log.New(d.stderr(), d.name()+": ", log.LstdFlags|log.Lmicroseconds),
+			level)
+	}
+
+	server, err := d.NewServer(inv.source, &inv.cfg)
+	if err != nil {
+		return d.failed(ExitMountFailed, "%v", err)
+	}
+
+	mfs, err := fuse.Mount(inv.mountPoint, server, &inv.cfg)
+	if err != nil {
+		return d.failed(ExitMountFailed, "Mount: %v", err)
+	}
+
+	d.ready()
+
+	// Unmount when asked to. If the file system is busy, keep serving; another
+	// signal tries again.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	joined := make(chan error, 1)
+	go func() {
+		joined <- mfs.Join(context.Background())
+	}()
+
+	done := ctx.Done()
+	for {
+		select {
+		case err := <-joined:
+			if err != nil {
+				logger.Printf("Serving: %v", err)
+				return ExitSystem
+			}
+
+			return ExitOK
+
+		case <-done:
+			done = nil
+			d.unmount(logger, inv.mountPoint)
+
+		case <-signals:
+			d.unmount(logger, inv.mountPoint)
+		}
+	}
+}
+
+func (d *Daemon) unmount(logger *log.Logger, dir string) {
+	sdNotify("STOPPING=1")
+	if err := fuse.Unmount(dir); err != nil {
+		logger.Printf("Unmount: %v", err)
+	}
+}
+
+// Report that mounting failed, to the backgrounding parent if any, and
+// return the supplied status.
+func (d *Daemon) failed(status int, format string, v ...interface{}) int {
+	msg := fmt.Sprintf(format, v...)
+	d.errorf("%s", msg)
+	reportToParent(status, msg)
+	return status
+}
+
+// Report that the file system is mounted.
+func (d *Daemon) ready() {
+	reportToParent(ExitOK, "")
+	sdNotify("READY=1")
+}
+
+// Apply a comma-separated list of mount options to the supplied config,
+// returning whether debug logging was requested.
+func applyMountOptions(cfg *fuse.MountConfig, s string) (debug bool) {
+	for _, opt := range splitMountOptions(s) {
+		k, v, _ := strings.Cut(opt, "=")
+		switch {
+		case k == "":
+			continue
+
+		case k == "ro":
+			cfg.ReadOnly = true
+
+		case k == "rw":
+			cfg.ReadOnly = false
+
+		case k == "fsname":
+			cfg.FSName = v
+
+		case k == "subtype":
+			cfg.Subtype = v
+
+		case k == "nonempty":
+			cfg.AllowNonEmptyMountPoint = true
+
+		case k == "debug":
+			debug = true
+
+		case k == "max_write" && parseUint32(v, &cfg.MaxWrite):
+			continue
+
+		// Options for mount(8) and systemd rather than the file system.
+		case k == "defaults", k == "auto", k == "noauto", k == "user",
+			k == "nouser", k == "users", k == "owner", k == "_netdev",
+			k == "nofail", k == "comment", strings.HasPrefix(k, "x-"):
+			continue
+
+		default:
+			if cfg.Options == nil {
+				cfg.Options = make(map[string]string)
+			}
+
+			cfg.Options[k] = v
+		}
+	}
+
+	return debug
+}
+
+// Parse a decimal uint32 into *dst, reporting whether it was valid.
+func parseUint32(s string, dst *uint32) bool {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return false
+	}
+
+	*dst = uint32(n)
+	return true
+}
+
+// Split a mount options string on commas, honoring backslash escapes as
+// written by the fuse package.
+func splitMountOptions(s string) []string {
+	var opts []string
+	var cur strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+			cur.WriteByte(s[i])
+
+		case s[i] == ',':
+			opts = append(opts, cur.String())
+			cur.Reset()
+
+		default:
+			cur.WriteByte(s[i])
+		}
+	}
+
+	return append(opts, cur.String())
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusedaemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestSplitMountOptions(t *testing.T) {
+	got := splitMountOptions(`ro,a=b\,c,,d\\`)
+	want := []string{"ro", "a=b,c", "", `d\`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitMountOptions: got %q, want %q", got, want)
+	}
+}
+
+func TestApplyMountOptions(t *testing.T) {
+	var cfg fuse.MountConfig
+	debug := applyMountOptions(&cfg, "defaults,noauto,_netdev,x-systemd.automount,ro,fsname=src,subtype=foo,nonempty,allow_other,max_read=4096,max_write=262144")
+	if debug {
+		t.Errorf("debug: got true")
+	}
+
+	if !cfg.ReadOnly || cfg.FSName != "src" || cfg.Subtype != "foo" || !cfg.AllowNonEmptyMountPoint || cfg.MaxWrite != 262144 {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+
+	want := map[string]string{"allow_other": "", "max_read": "4096"}
+	if !reflect.DeepEqual(cfg.Options, want) {
+		t.Errorf("Options: got %v, want %v", cfg.Options, want)
+	}
+
+	if !applyMountOptions(&cfg, "rw,debug") {
+		t.Errorf("debug: got false")
+	}
+
+	if cfg.ReadOnly {
+		t.Errorf("ReadOnly: rw was not applied")
+	}
+}
+
+func TestParse(t *testing.T) {
+	var extra string
+	d := &Daemon{
+		Name:      "test",
+		HasSource: true,
+		SetUpFlags: func(fs *flag.FlagSet) {
+			fs.StringVar(&extra, "extra", "", "")
+		},
+		Config: fuse.MountConfig{Subtype: "default"},
+		Stderr: new(bytes.Buffer),
+	}
+
+	// The order mount(8) uses, with flags after the positional arguments.
+	inv, err := d.parse([]string{"src", "/mnt", "-o", "ro,foo=bar", "-extra", "x", "-o", "debug"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if inv.source != "src" || inv.mountPoint != "/mnt" {
+		t.Errorf("Unexpected arguments: %q, %q", inv.source, inv.mountPoint)
+	}
+
+	if !inv.debug || !inv.foreground {
+		t.Errorf("The debug option should imply -d and -f")
+	}
+
+	if !inv.cfg.ReadOnly || inv.cfg.Subtype != "default" || inv.cfg.Options["foo"] != "bar" {
+		t.Errorf("Unexpected config: %+v", inv.cfg)
+	}
+
+	if extra != "x" {
+		t.Errorf("extra: got %q", extra)
+	}
+
+	// The daemon's own config must not have been modified.
+	if d.Config.ReadOnly || d.Config.Options != nil {
+		t.Errorf("Daemon.Config was modified: %+v", d.Config)
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	d := &Daemon{Name: "test", Stderr: new(bytes.Buffer)}
+	for _, args := range [][]string{
+		{},
+		{"a", "b"},
+		{"-nosuchflag", "/mnt"},
+	} {
+		if got := d.Run(context.Background(), args); got != ExitUsage {
+			t.Errorf("Run(%q): got %d, want %d", args, got, ExitUsage)
+		}
+	}
+}
+
+func TestRunMountFailed(t *testing.T) {
+	stderr := new(bytes.Buffer)
+	d := &Daemon{
+		Name:   "test",
+		Stderr: stderr,
+		NewServer: func(source string, cfg *fuse.MountConfig) (fuse.Server, error) {
+			return fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}), nil
+		},
+	}
+
+	dir := filepath.Join(t.TempDir(), "nonexistent")
+	if got := d.Run(context.Background(), []string{"-f", dir}); got != ExitMountFailed {
+		t.Errorf("Run: got %d, want %d; stderr: %s", got, ExitMountFailed, stderr)
+	}
+
+	d.NewServer = func(source string, cfg *fuse.MountConfig) (fuse.Server, error) {
+		return nil, errors.New("taco")
+	}
+
+	if got := d.Run(context.Background(), []string{"-f", dir}); got != ExitMountFailed {
+		t.Errorf("Run: got %d, want %d", got, ExitMountFailed)
+	}
+}
+
+func TestRunConfig(t *testing.T) {
+	var got *fuse.MountConfig
+	d := &Daemon{
+		Name:   "test",
+		Stderr: new(bytes.Buffer),
+		Config: fuse.MountConfig{Options: map[string]string{"a": "b"}},
+		NewServer: func(source string, cfg *fuse.MountConfig) (fuse.Server, error) {
+			got = cfg
+			return nil, errors.New("taco")
+		},
+	}
+
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		args  []string
+		debug bool
+	}{
+		{[]string{"-f", "-o", "foo=bar", dir}, false},
+		{[]string{"-d", dir}, true},
+	} {
+		if status := d.Run(context.Background(), tc.args); status != ExitMountFailed {
+			t.Fatalf("Run(%q): got %d", tc.args, status)
+		}
+
+		// Logging can be changed at runtime, starting at the level asked for.
+		logger, ok := got.Logger.(*fuse.LevelLogger)
+		if !ok {
+			t.Fatalf("Run(%q): Logger is %T", tc.args, got.Logger)
+		}
+
+		if logger.Enabled(fuse.LogDebug, fuse.LogOp) != tc.debug || !logger.Enabled(fuse.LogError, fuse.LogOp) {
+			t.Errorf("Run(%q): unexpected log levels", tc.args)
+		}
+	}
+
+	// The daemon's own options must not have been modified.
+	if want := map[string]string{"a": "b"}; !reflect.DeepEqual(d.Config.Options, want) {
+		t.Errorf("Daemon.Config.Options: got %v, want %v", d.Config.Options, want)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fusedaemon provides the skeleton of main() for a fuse daemon, with
+// the command line conventions of mount helpers, so that it can be run by
+// hand, from /etc/fstab via mount(8), or as a systemd service:
+//
+//	prog [flags] [source] mountpoint [-o option[,option...]]
+//
+// The flags are:
+//
+//	-o options  Mount options, as for mount(8). May be repeated.
+//	-f          Stay in the foreground rather than daemonizing.
+//	-d          Log every op to stderr. Implies -f.
+//
+// Mount options understood by this package (ro, rw, fsname, subtype,
+// nonempty, debug, max_write, and those only meaningful to mount(8) such as
+// noauto and _netdev) are applied to the MountConfig or dropped; all others are passed
+// through in MountConfig.Options.
+//
+// Unless -f or -d is given, the daemon starts a copy of itself in the
+// background and exits once that copy has mounted the file system, with a
+// status reporting whether it succeeded, as mount(8) expects. In the
+// foreground, readiness is reported to systemd if $NOTIFY_SOCKET is set. The
+// file system is unmounted on SIGINT or SIGTERM.
+//
+// A minimal program:
+//
+//	func main() {
+//		d := &fusedaemon.Daemon{
+//			NewServer: func(source string, cfg *fuse.MountConfig) (fuse.Server, error) {
+//				return hellofs.NewHelloFS(timeutil.RealClock())
+//			},
+//		}
+//
+//		d.Main()
+//	}
+package fusedaemon
@@ -0,0 +1,270 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Every op type has a String method returning a concise one-line summary of
+// its non-zero fields, e.g.
+//
+//	LookUpInode{Parent: 1, Name: "foo"}
+//
+// and a MarshalJSON method producing an object with an "Op" key holding the
+// op name and one key per field. In both, the OpContext is omitted from the
+// string but included in the JSON, byte payloads are summarized by their
+// length rather than included, and callbacks are omitted.
+//
+// Both are intended for logging and tracing and are safe to call at any point
+// in an op's life, so they describe whichever outputs have been filled in so
+// far too.
+
+// Return the name of the op, stripping the "Op" from "FooOp".
+func opName(v reflect.Value) string {
+	return strings.TrimSuffix(v.Type().Name(), "Op")
+}
+
+// A summary of a byte payload, used in place of the bytes themselves.
+type byteSummary struct {
+	Len int `json:"len"`
+}
+
+// Format the value of a field for String, returning false if it should be
+// left out because it is zero or not useful.
+func formatField(f reflect.Value) (string, bool) {
+	if f.IsZero() {
+		return "", false
+	}
+
+	switch v := f.Interface().(type) {
+	case OpContext:
+		return "", false
+
+	case []byte:
+		return fmt.Sprintf("%d bytes", len(v)), true
+
+	case [][]byte:
+		var n int
+		for _, b := range v {
+			n += len(b)
+		}
+		return fmt.Sprintf("%d bytes in %d slices", n, len(v)), true
+
+	case string:
+		return fmt.Sprintf("%q", v), true
+
+	case *os.File:
+		return fmt.Sprintf("%q", v.Name()), true
+
+	case time.Time:
+		return v.Format(time.RFC3339Nano), true
+
+	case InodeAttributes:
+		return fmt.Sprintf("{%s}", v.DebugString()), true
+
+	case ChildInodeEntry:
+		return fmt.Sprintf("{Child: %v}", v.Child), true
+	}
+
+	switch f.Kind() {
+	case reflect.Func:
+		return "", false
+
+	case reflect.Ptr:
+		return formatField(f.Elem())
+
+	case reflect.Slice:
+		return fmt.Sprintf("%d entries", f.Len()), true
+	}
+
+	return fmt.Sprintf("%v", f.Interface()), true
+}
+
+func describeOp(op interface{}) string {
+	v := reflect.ValueOf(op).Elem()
+	t := v.Type()
+
+	var components []string
+	for i := 0; i < t.NumField(); i++ {
+		if s, ok := formatField(v.Field(i)); ok {
+			components = append(components, fmt.Sprintf("%s: %s", t.Field(i).Name, s))
+		}
+	}
+
+	return fmt.Sprintf("%s{%s}", opName(v), strings.Join(components, ", "))
+}
+
+func marshalOp(op interface{}) ([]byte, error) {
+	v := reflect.ValueOf(op).Elem()
+	t := v.Type()
+
+	// encoding/json sorts map keys, which keeps the output stable.
+	m := map[string]interface{}{
+		"Op": opName(v),
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := v.Field(i)
+		name := t.Field(i).Name
+
+		switch val := f.Interface().(type) {
+		case []byte:
+			m[name] = byteSummary{Len: len(val)}
+
+		case [][]byte:
+			summaries := make([]byteSummary, len(val))
+			for j, b := range val {
+				summaries[j] = byteSummary{Len: len(b)}
+			}
+			m[name] = summaries
+
+		case *os.File:
+			m[name] = nil
+			if val != nil {
+				m[name] = val.Name()
+			}
+
+		default:
+			if f.Kind() != reflect.Func {
+				m[name] = val
+			}
+		}
+	}
+
+	return json.Marshal(m)
+}
+
+func (o *StatFSOp) String() string               { return describeOp(o) }
+func (o *StatFSOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *DestroyOp) String() string               { return describeOp(o) }
+func (o *DestroyOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *LookUpInodeOp) String() string               { return describeOp(o) }
+func (o *LookUpInodeOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *GetInodeAttributesOp) String() string               { return describeOp(o) }
+func (o *GetInodeAttributesOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *SetInodeAttributesOp) String() string               { return describeOp(o) }
+func (o *SetInodeAttributesOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *AccessOp) String() string               { return describeOp(o) }
+func (o *AccessOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *ForgetInodeOp) String() string               { return describeOp(o) }
+func (o *ForgetInodeOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *BatchForgetOp) String() string               { return describeOp(o) }
+func (o *BatchForgetOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *MkDirOp) String() string               { return describeOp(o) }
+func (o *MkDirOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *MkNodeOp) String() string               { return describeOp(o) }
+func (o *MkNodeOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *CreateFileOp) String() string               { return describeOp(o) }
+func (o *CreateFileOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *CreateSymlinkOp) String() string               { return describeOp(o) }
+func (o *CreateSymlinkOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *CreateLinkOp) String() string               { return describeOp(o) }
+func (o *CreateLinkOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *RenameOp) String() string               { return describeOp(o) }
+func (o *RenameOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *RmDirOp) String() string               { return describeOp(o) }
+func (o *RmDirOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *UnlinkOp) String() string               { return describeOp(o) }
+func (o *UnlinkOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *OpenDirOp) String() string               { return describeOp(o) }
+func (o *OpenDirOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *ReadDirOp) String() string               { return describeOp(o) }
+func (o *ReadDirOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *ReadDirPlusOp) String() string               { return describeOp(o) }
+func (o *ReadDirPlusOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *ReleaseDirHandleOp) String() string               { return describeOp(o) }
+func (o *ReleaseDirHandleOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *OpenFileOp) String() string               { return describeOp(o) }
+func (o *OpenFileOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *ReadFileOp) String() string               { return describeOp(o) }
+func (o *ReadFileOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *WriteFileOp) String() string               { return describeOp(o) }
+func (o *WriteFileOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *SyncFileOp) String() string               { return describeOp(o) }
+func (o *SyncFileOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *FlushFileOp) String() string               { return describeOp(o) }
+func (o *FlushFileOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *ReleaseFileHandleOp) String() string               { return describeOp(o) }
+func (o *ReleaseFileHandleOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *ReadSymlinkOp) String() string               { return describeOp(o) }
+func (o *ReadSymlinkOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *GetLkOp) String() string               { return describeOp(o) }
+func (o *GetLkOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *SetLkOp) String() string               { return describeOp(o) }
+func (o *SetLkOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *SetLkWOp) String() string               { return describeOp(o) }
+func (o *SetLkWOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *RemoveXattrOp) String() string               { return describeOp(o) }
+func (o *RemoveXattrOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *GetXattrOp) String() string               { return describeOp(o) }
+func (o *GetXattrOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *ListXattrOp) String() string               { return describeOp(o) }
+func (o *ListXattrOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *SetXattrOp) String() string               { return describeOp(o) }
+func (o *SetXattrOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *FallocateOp) String() string               { return describeOp(o) }
+func (o *FallocateOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *IoctlOp) String() string               { return describeOp(o) }
+func (o *IoctlOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *PollOp) String() string               { return describeOp(o) }
+func (o *PollOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *LSeekOp) String() string               { return describeOp(o) }
+func (o *LSeekOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
+
+func (o *CopyFileRangeOp) String() string               { return describeOp(o) }
+func (o *CopyFileRangeOp) MarshalJSON() ([]byte, error) { return marshalOp(o) }
@@ -0,0 +1,73 @@
+package fuseops
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestOpString(t *testing.T) {
+	testCases := []struct {
+		op   interface{ String() string }
+		want string
+	}{
+		{&StatFSOp{}, "StatFS{}"},
+		{
+			&LookUpInodeOp{Parent: 1, Name: "foo", OpContext: OpContext{Pid: 17}},
+			`LookUpInode{Parent: 1, Name: "foo"}`,
+		},
+		{
+			&WriteFileOp{Inode: 2, Handle: 3, Offset: 4, Data: []byte("taco")},
+			"WriteFile{Inode: 2, Handle: 3, Offset: 4, Data: 4 bytes}",
+		},
+		{
+			&ReadFileOp{Inode: 2, Size: 10, Data: [][]byte{[]byte("ab"), []byte("c")}},
+			"ReadFile{Inode: 2, Size: 10, Data: 3 bytes in 2 slices}",
+		},
+		{
+			&ReadFileOp{Inode: 2, BytesRead: 4, SpliceFile: os.Stdin},
+			`ReadFile{Inode: 2, BytesRead: 4, SpliceFile: "/dev/stdin"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.op.String(); got != tc.want {
+			t.Errorf("String() = %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestOpJSON(t *testing.T) {
+	op := &WriteFileOp{
+		Inode:     2,
+		Data:      []byte("taco"),
+		Callback:  func() {},
+		OpContext: OpContext{Pid: 17},
+	}
+
+	b, err := json.Marshal(op)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if m["Op"] != "WriteFile" || m["Inode"] != 2.0 {
+		t.Errorf("Unexpected JSON: %s", b)
+	}
+
+	if d, ok := m["Data"].(map[string]interface{}); !ok || d["len"] != 4.0 {
+		t.Errorf("Unexpected Data summary: %s", b)
+	}
+
+	if _, ok := m["Callback"]; ok {
+		t.Errorf("Unexpected Callback: %s", b)
+	}
+
+	if c, ok := m["OpContext"].(map[string]interface{}); !ok || c["Pid"] != 17.0 {
+		t.Errorf("Unexpected OpContext: %s", b)
+	}
+}
@@ -27,6 +27,10 @@ import (
 
 // OpContext contains extra context that may be needed by some file systems.
 // See https://libfuse.github.io/doxygen/structfuse__context.html as a reference.
+//
+// Every op delivered by fuse.Connection.ReadOp carries an OpContext, decoded
+// from the fuse_in_header of the request, so that file systems can implement
+// per-caller authorization, quotas and auditing uniformly.
 type OpContext struct {
 	// FuseID is the Unique identifier for each operation from the kernel.
 	FuseID uint64
@@ -38,6 +42,45 @@ type OpContext struct {
 	// UID of the process that is invoking the operation.
 	// Not filled in case of a writepage operation.
 	Uid uint32
+
+	// GID of the process that is invoking the operation.
+	// Not filled in case of a writepage operation.
+	Gid uint32
+
+	// Umask of the process that is invoking the operation, for MkDirOp,
+	// MkNodeOp and CreateFileOp on Linux; zero for other ops. The kernel has
+	// already cleared these bits from the op's mode, so this is for file
+	// systems that inherit permissions some other way, e.g. from default
+	// ACLs.
+	Umask os.FileMode
+
+	// The header of the kernel request that carried the op, for file systems
+	// that need more of it than the fields above, e.g. to audit requests at
+	// the protocol level.
+	Header RequestHeader
+}
+
+// RequestHeader mirrors the fuse_in_header that the kernel sends at the start
+// of every request.
+type RequestHeader struct {
+	// The length of the request in bytes, including the header.
+	Len uint32
+
+	// The FUSE opcode of the request, e.g. 1 for FUSE_LOOKUP.
+	Opcode uint32
+
+	// The request's unique ID, as in OpContext.FuseID.
+	Unique uint64
+
+	// The inode the request concerns, as the kernel sent it: before any
+	// remapping for fuse.MountConfig.RootInode, so it may differ from the
+	// inode IDs in the op.
+	Nodeid uint64
+
+	// The caller's identity, as in OpContext.
+	Uid uint32
+	Gid uint32
+	Pid uint32
 }
 
 // Return statistics about the file system's capacity and available resources.
@@ -58,6 +101,12 @@ type OpContext struct {
 // This op is particularly important on OS X: if you don't implement it, the
 // file system will not successfully mount. If you don't model a sane amount of
 // free space, the Finder will refuse to copy files into the file system.
+//
+// There is no way to report mount flags (statvfs::f_flag, e.g. ST_RDONLY)
+// here: the kernel's fuse_kstatfs reply has no field for them, and the kernel
+// fills them in from the mount's own options instead. Set them with
+// MountConfig.ReadOnly and MountConfig.Options. Likewise the file system ID,
+// which on OS X may be set with MountConfig.FSID.
 type StatFSOp struct {
 	// The size of the file system's blocks. This may be used, in combination
 	// with the block counts below,  by callers of statfs(2) to infer the file
@@ -80,6 +129,8 @@ type StatFSOp struct {
 	// zero is treated as 4096.
 	//
 	// This interface does not distinguish between blocks and block fragments.
+	//
+	// If zero, IoSize is used instead, or 4096 if that is also zero.
 	BlockSize uint32
 
 	// The total number of blocks in the file system, the number of unused
@@ -87,7 +138,8 @@ type StatFSOp struct {
 	// users.
 	//
 	// For each category, the corresponding number of bytes is derived by
-	// multiplying by BlockSize.
+	// multiplying by BlockSize. Counts that exceed the count they are part of
+	// are reduced to it, so that tools like df don't report negative usage.
 	Blocks          uint64
 	BlocksFree      uint64
 	BlocksAvailable uint64
@@ -104,11 +156,34 @@ type StatFSOp struct {
 	// On Linux this can be any value. On OS X it appears that only powers of 2
 	// in the range [2^12, 2^25] are faithfully preserved, and a value of zero is
 	// treated as 65536.
+	//
+	// If zero on Linux, BlockSize is used instead, or 4096 if that is also
+	// zero. On OS X zero is passed through, so gets the default above.
 	IoSize uint32
 
 	// The total number of inodes in the file system, and how many remain free.
+	// As with blocks, InodesFree is capped at Inodes.
 	Inodes     uint64
 	InodesFree uint64
+
+	// The maximum length in bytes of a file name, surfaced as
+	// statfs::f_namelen and used by pathconf(_PC_NAME_MAX). Zero is treated as
+	// 255, the limit on Linux.
+	NameMax uint32
+
+	OpContext OpContext
+}
+
+// Sent by the kernel when the file system is being torn down, after all other
+// ops have been answered. File systems should flush any outstanding state and
+// release their resources.
+//
+// The kernel only sends this op in some situations: on Linux, only for
+// fuseblk mounts. fuseutil.FileSystem implementations see it as a call to
+// Destroy, which the server guarantees to make exactly once whether or not the
+// op arrives, after the connection is closed if it doesn't.
+type DestroyOp struct {
+	OpContext OpContext
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -167,7 +242,14 @@ type SetInodeAttributesOp struct {
 	// If set, this is ftruncate(2), otherwise it's truncate(2)
 	Handle *HandleID
 
+	// Exactly which attributes the caller asked to change. The pointer fields
+	// below are non-nil for the corresponding bits, and Valid additionally
+	// says whether new times are the current time (see SetAttrAtimeNow).
+	Valid SetAttrMask
+
 	// The attributes to modify, or nil for attributes that don't need a change.
+	// Uid and Gid are independent: chown(2) with -1 for one of them sets only
+	// the other.
 	Uid   *uint32
 	Gid   *uint32
 	Size  *uint64
@@ -175,6 +257,12 @@ type SetInodeAttributesOp struct {
 	Atime *time.Time
 	Mtime *time.Time
 
+	// Linux only. The kernel sets the change time itself only when it
+	// maintains times for the file system, i.e. with
+	// MountConfig.EnableWritebackCache; otherwise the file system is expected
+	// to update it on any change, as usual.
+	Ctime *time.Time
+
 	// Set by the file system: the new attributes for the inode, and the time at
 	// which they should expire. See notes on
 	// ChildInodeEntry.AttributesExpiration for more.
@@ -183,6 +271,56 @@ type SetInodeAttributesOp struct {
 	OpContext            OpContext
 }
 
+// SetAttrMask is a set of the attributes that a SetInodeAttributesOp changes.
+type SetAttrMask uint32
+
+const (
+	SetAttrMode SetAttrMask = 1 << iota
+	SetAttrUid
+	SetAttrGid
+	SetAttrSize
+	SetAttrAtime
+	SetAttrMtime
+	SetAttrCtime
+
+	// Set along with SetAttrAtime (resp. SetAttrMtime) when the caller asked
+	// for the current time, e.g. with UTIME_NOW or utimes(2) with no times,
+	// rather than for a particular one. The time supplied is then the kernel's
+	// idea of now; a file system with a clock of its own (e.g. a server's)
+	// should use that instead. The permission rules differ too: any process
+	// that may write the file may set its times to the current time, whereas
+	// only the owner may set particular ones (cf. utimensat(2)), which matters
+	// when MountConfig.DisableDefaultPermissions is set.
+	SetAttrAtimeNow
+	SetAttrMtimeNow
+)
+
+// Check whether the caller may access an inode, for access(2) and chdir(2).
+// The kernel sends this only when it isn't checking permissions itself (cf.
+// MountConfig.DisableDefaultPermissions), so that file systems with their own
+// permission model, e.g. ACLs kept in a database, can enforce it. The caller
+// is described by OpContext.
+//
+// Return nil to allow the access, and EACCES to deny it. Returning ENOSYS
+// makes the kernel allow this and every later access check on the mount
+// without asking.
+type AccessOp struct {
+	// The inode of interest.
+	Inode InodeID
+
+	// The access to check: a bitwise OR of AccessRead, AccessWrite and
+	// AccessExecute, or zero to check only that the inode exists.
+	Mask      uint32
+	OpContext OpContext
+}
+
+// Bits of AccessOp.Mask, as for access(2).
+const (
+	AccessExecute uint32 = 1
+	AccessWrite   uint32 = 2
+	AccessRead    uint32 = 4
+)
+
 // Decrement the reference count for an inode ID previously issued by the file
 // system.
 //
@@ -300,6 +438,10 @@ type MkDirOp struct {
 // doesn't matter what the kernel does anyway.
 //
 // Therefore the file system should return EEXIST if the name already exists.
+//
+// The type bits of Mode say what to create: os.ModeNamedPipe for a FIFO,
+// os.ModeSocket for a socket, os.ModeDevice for a block device or with
+// os.ModeCharDevice for a character device, and none for a regular file.
 type MkNodeOp struct {
 	// The ID of parent directory inode within which to create the child.
 	Parent InodeID
@@ -308,7 +450,8 @@ type MkNodeOp struct {
 	Name string
 	Mode os.FileMode
 
-	// The device number (only valid if created file is a device)
+	// The device number (only valid if created file is a device), as for
+	// InodeAttributes.Rdev.
 	Rdev uint32
 
 	// Set by the file system: information about the inode that was created.
@@ -351,7 +494,21 @@ type CreateFileOp struct {
 	// The handle may be supplied in future ops like ReadFileOp that contain a
 	// file handle. The file system must ensure this ID remains valid until a
 	// later call to ReleaseFileHandle.
-	Handle    HandleID
+	Handle HandleID
+
+	// Set by the file system: page cache and seeking behavior for the new
+	// handle, as for OpenFileOp.KeepPageCache, UseDirectIO and NonSeekable.
+	KeepPageCache bool
+	UseDirectIO   bool
+	NonSeekable   bool
+
+	// Set by the file system: a backing file to open the file with, as for
+	// OpenFileOp.BackingID.
+	BackingID BackingID
+
+	// The flags passed to open(2), as for OpenFileOp.
+	OpenFlags fusekernel.OpenFlags
+
 	OpContext OpContext
 }
 
@@ -434,6 +591,11 @@ type CreateLinkOp struct {
 //     posix and the man pages are imprecise about the actual semantics of a
 //     rename if it's not atomic, so it is probably not disastrous to be loose
 //     about this.
+//
+// If MountConfig.EnableRenameFlags is set, Flags carries the flags passed to
+// renameat2(2). The kernel checks them for sanity, e.g. that RenameNoReplace
+// and RenameExchange are not both set, but leaves their semantics to the file
+// system; return EINVAL for any it doesn't support.
 type RenameOp struct {
 	// The old parent directory, and the name of the entry within it to be
 	// relocated.
@@ -444,9 +606,22 @@ type RenameOp struct {
 	// overwritten within it.
 	NewParent InodeID
 	NewName   string
+
+	// A bitwise OR of RenameNoReplace, RenameExchange and any other renameat2
+	// flags, or zero for an ordinary rename.
+	Flags     uint32
 	OpContext OpContext
 }
 
+// Bits of RenameOp.Flags, as for renameat2(2).
+const (
+	// Fail with EEXIST rather than replacing the new name if it exists.
+	RenameNoReplace uint32 = 1 << 0
+
+	// Atomically swap the old and new names, both of which must exist.
+	RenameExchange uint32 = 1 << 1
+)
+
 // Unlink a directory from its parent. Because directories cannot have a link
 // count above one, this means the directory inode should be deleted as well
 // once the kernel sends ForgetInodeOp.
@@ -595,6 +770,38 @@ type ReadDirOp struct {
 	OpContext OpContext
 }
 
+// Read entries from a directory previously opened with OpenDir, together with
+// the result of looking each one up, so that the kernel can populate its
+// dentry and attribute caches without a LookUpInodeOp per entry (as e.g.
+// `ls -l` would otherwise cause). Sent in place of ReadDirOp only if
+// MountConfig.EnableReaddirplus is set; see the notes there.
+//
+// Each entry returned counts as a lookup of Entry.Child, exactly as if it had
+// been returned by LookUpInodeOp, except for entries named "." and "..", which
+// the kernel doesn't cache. The file system must therefore be prepared for
+// the corresponding ForgetInodeOps.
+type ReadDirPlusOp struct {
+	// The directory inode that we are reading, and the handle previously
+	// returned by OpenDir when opening that inode.
+	Inode  InodeID
+	Handle HandleID
+
+	// The offset within the directory at which to read, with the same meaning
+	// as ReadDirOp.Offset.
+	Offset DirOffset
+
+	// The size of the read in bytes. Each entry takes up
+	// fuseutil.DirentPlusSize(name) bytes; use fuseutil.AppendDirentPlus to add
+	// only entries that fit. Entries beyond the limit are dropped without
+	// being counted as lookups by the kernel.
+	Size int
+
+	// Set by the file system: the entries read. Empty means that the end of the
+	// directory has been reached, as for ReadDirOp.BytesRead.
+	Entries   []DirentPlus
+	OpContext OpContext
+}
+
 // Release a previously-minted directory handle. The kernel sends this when
 // there are no more references to an open directory: all file descriptors are
 // closed and all memory mappings are unmapped.
@@ -659,6 +866,28 @@ type OpenFileOp struct {
 	// advance, for example, because contents are generated on the fly.
 	UseDirectIO bool
 
+	// Whether the file handle is a stream that doesn't support seeking, such as
+	// a pipe-like endpoint. If set, the kernel fails lseek(2) and pread(2) on the
+	// handle with ESPIPE and sends every ReadFileOp and WriteFileOp with a
+	// meaningless offset. Ignored on OS X.
+	NonSeekable bool
+
+	// Linux only: a backing file from which the kernel should serve reads and
+	// writes for this handle itself, bypassing the file system, as for an
+	// overlay over another file system. Requires
+	// fuse.MountConfig.EnablePassthrough and Features.Passthrough.
+	//
+	// Once an inode is open for passthrough, the kernel fails other opens of
+	// it that don't use passthrough too. The backing file may be unregistered
+	// as soon as this op has been replied to; the kernel holds its own
+	// reference for as long as the handle is open.
+	BackingID BackingID
+
+	// The flags passed to open(2), minus O_CREAT, O_EXCL and O_NOCTTY. If
+	// fuse.MountConfig.EnableAtomicTrunc is set and the kernel supports it,
+	// these may include O_TRUNC, in which case the file system must truncate
+	// the file to zero length before replying; the kernel won't send a
+	// separate SetInodeAttributesOp for the truncation.
 	OpenFlags fusekernel.OpenFlags
 
 	OpContext OpContext
@@ -700,6 +929,38 @@ type ReadFileOp struct {
 	//
 	// If direct IO is enabled, semantics should match those of read(2).
 	BytesRead int
+
+	// Set by the file system: a hint that the data read is unlikely to be read
+	// again soon, e.g. because it is part of a one-off scan of a large cold
+	// file, and so shouldn't displace other data in the kernel's page cache.
+	//
+	// The fuse protocol has no way to return data without it entering the page
+	// cache (short of UseDirectIO on OpenFileOp, which applies to the whole
+	// handle), so the data is evicted right after the reply using an inode
+	// invalidation notification. Pages that are mapped or dirty may stay
+	// cached. Ignored by kernels that don't support notifications.
+	//
+	// The notification also invalidates the inode's cached attributes, which
+	// the kernel can't be told to keep, so the next access to the inode after
+	// such a read causes a GetInodeAttributesOp.
+	DontCache bool
+
+	// Set by the file system, instead of filling in Dst or Data: a file from
+	// which the BytesRead bytes of the reply are to be taken, starting at
+	// SpliceOffset. This suits file systems that pass reads through to files
+	// on another file system.
+	//
+	// On Linux the data is moved from the file to the kernel with splice(2),
+	// without being copied through user space, which can make large reads
+	// much faster. Elsewhere, or if splicing fails, it is read into Dst (or a
+	// buffer allocated for the purpose, for vectored reads) with pread(2).
+	//
+	// The file must stay open until Callback is invoked, and BytesRead must not
+	// extend past its end; reading fewer bytes than promised fails the op with
+	// EIO.
+	SpliceFile   *os.File
+	SpliceOffset int64
+
 	OpContext OpContext
 
 	// If set, this function will be invoked after the operation response has been
@@ -764,6 +1025,10 @@ type WriteFileOp struct {
 	// be written, except on error (http://goo.gl/KUpwwn). This appears to be
 	// because it uses file mmapping machinery (http://goo.gl/SGxnaN) to write a
 	// page at a time.
+	//
+	// Data points into a buffer that is reused once the op has been replied
+	// to. File systems that want to keep it for longer without copying it can
+	// use fuse.RetainBuffers.
 	Data      []byte
 	OpContext OpContext
 
@@ -791,8 +1056,13 @@ type WriteFileOp struct {
 // file (but which is not used in "real" file systems).
 type SyncFileOp struct {
 	// The file and handle being sync'd.
-	Inode     InodeID
-	Handle    HandleID
+	Inode  InodeID
+	Handle HandleID
+
+	// Set for fdatasync(2), and for the kernel writing back a file's data
+	// without its metadata: only the contents, and what is needed to read them
+	// back such as the size, need be made durable, not e.g. the times.
+	Datasync  bool
 	OpContext OpContext
 }
 
@@ -846,8 +1116,14 @@ type SyncFileOp struct {
 // return any errors that occur.
 type FlushFileOp struct {
 	// The file and handle being flushed.
-	Inode     InodeID
-	Handle    HandleID
+	Inode  InodeID
+	Handle HandleID
+
+	// The lock owner (cf. SetLkOp.Owner) of the file descriptor being closed.
+	// close(2) releases all of the POSIX locks the owner holds on the inode, so
+	// file systems that implement them (cf. MountConfig.EnablePosixLocks)
+	// should release them here.
+	LockOwner uint64
 	OpContext OpContext
 }
 
@@ -858,12 +1134,112 @@ type FlushFileOp struct {
 // The kernel guarantees that the handle ID will not be used in further calls
 // to the file system (unless it is reissued by the file system).
 //
+// Dirty pages of a shared mapping are written back with WriteFileOps when it
+// is unmapped, and may be after every file descriptor has been closed and its
+// FlushFileOp sent, so this is the only op that follows the last write to the
+// handle. File systems that upload a file once it is closed should do so here
+// rather than in FlushFileOp, or they may lose trailing writes made through a
+// mapping. The server returned by fuseutil.NewFileSystemServer doesn't call
+// ReleaseFileHandle until the methods for all of the writes, syncs, flushes,
+// fallocates and copies to the handle received before this op have returned,
+// even if they have already been replied to (e.g. because of
+// fuseutil.ServerConfig.ReplyOnTimeout).
+//
 // Errors from this op are ignored by the kernel (cf. http://goo.gl/RL38Do).
 type ReleaseFileHandleOp struct {
 	// The handle ID to be released. The kernel guarantees that this ID will not
 	// be used in further calls to the file system (unless it is reissued by the
 	// file system).
+	Handle HandleID
+
+	// The lock owner of the last file descriptor for the handle, and whether
+	// the file system should release the flock(2) lock it may hold, as it does
+	// when flock locks are enabled (cf. MountConfig.EnableFlockLocks).
+	LockOwner   uint64
+	FlockUnlock bool
+	OpContext   OpContext
+}
+
+////////////////////////////////////////////////////////////////////////
+// File locking
+////////////////////////////////////////////////////////////////////////
+
+// FileLock describes an advisory lock on a range of a file.
+type FileLock struct {
+	// The range locked, from Start up to and including End. A lock running to
+	// the end of the file, however large it grows, has End LockToEOF.
+	Start uint64
+	End   uint64
+
+	// LockRead, LockWrite or LockUnlock.
+	Type uint32
+
+	// The process holding the lock, or asking for it.
+	Pid uint32
+}
+
+// Values for FileLock.
+const (
+	LockRead   uint32 = lockRead
+	LockWrite  uint32 = lockWrite
+	LockUnlock uint32 = lockUnlock
+
+	LockToEOF uint64 = 1<<63 - 1
+)
+
+// Find a POSIX lock conflicting with the one described, for fcntl(2) with
+// F_GETLK. The kernel sends this only if POSIX locks are enabled (cf.
+// MountConfig.EnablePosixLocks); otherwise it keeps track of locks itself,
+// which suffices for file systems seen by only one machine.
+type GetLkOp struct {
+	// The file and handle through which the lock is tested.
+	Inode  InodeID
+	Handle HandleID
+
+	// An opaque ID for the owner asking, the same for all of the file
+	// descriptors that share its locks, and the lock it would like to take.
+	// Locks held by the same owner never conflict.
+	Owner uint64
+	Lock  FileLock
+
+	// Set by the file system: a lock held by another owner that conflicts
+	// with Lock, if any. Initially has Type LockUnlock, meaning there is none.
+	Conflict  FileLock
+	OpContext OpContext
+}
+
+// Take, change or release a lock without waiting, for fcntl(2) with F_SETLK
+// or, if Flock is set, flock(2) with LOCK_NB. The kernel sends this only if
+// the corresponding kind of lock is enabled (cf. MountConfig.EnablePosixLocks
+// and EnableFlockLocks).
+//
+// Return EAGAIN if the lock conflicts with one held by another owner. The
+// lock replaces any locks the owner holds on the same range.
+type SetLkOp struct {
+	// The file and handle through which the lock is taken.
+	Inode  InodeID
+	Handle HandleID
+
+	// The owner taking the lock, as in GetLkOp, and the lock to take. A lock
+	// of Type LockUnlock releases the owner's locks on the range.
+	Owner uint64
+	Lock  FileLock
+
+	// Set for flock(2) locks, which cover the whole file and are owned by the
+	// open file description rather than the process.
+	Flock     bool
+	OpContext OpContext
+}
+
+// As for SetLkOp, but waiting until the lock can be taken, for fcntl(2) with
+// F_SETLKW or flock(2) without LOCK_NB. If the waiting process is
+// interrupted, the op's context is cancelled; return EINTR promptly then.
+type SetLkWOp struct {
+	Inode     InodeID
 	Handle    HandleID
+	Owner     uint64
+	Lock      FileLock
+	Flock     bool
 	OpContext OpContext
 }
 
@@ -909,8 +1285,14 @@ type GetXattrOp struct {
 	// The name of the extended attribute.
 	Name string
 
+	// OS X only: the offset within the value at which to start reading, which
+	// is non-zero only for com.apple.ResourceFork. Always zero on Linux.
+	Position uint32
+
 	// The destination buffer.  If the size is too small for the
 	// value, the ERANGE error should be sent.
+	//
+	// A nil Dst asks only for the size of the value, in BytesRead.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read into Dst, or
@@ -932,6 +1314,8 @@ type ListXattrOp struct {
 	//
 	// The output data should consist of a sequence of NUL-terminated strings,
 	// one for each xattr.
+	//
+	// A nil Dst asks only for the size of the list, in BytesRead.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read into Dst, or
@@ -955,6 +1339,10 @@ type SetXattrOp struct {
 	// The value to for the extened attribute.
 	Value []byte
 
+	// OS X only: the offset within the attribute at which to write Value,
+	// which is non-zero only for com.apple.ResourceFork. Always zero on Linux.
+	Position uint32
+
 	// If Flags is 0x1, and the attribute exists already, EEXIST should be returned.
 	// If Flags is 0x2, and the attribute does not exist, ENOATTR should be returned.
 	// If Flags is 0x0, the extended attribute will be created if need be, or will
@@ -963,6 +1351,12 @@ type SetXattrOp struct {
 	OpContext OpContext
 }
 
+// Manipulate the space allocated to a file.
+//
+// This is sent in response to fallocate(2), and by posix_fallocate(3) on
+// Linux. Return EOPNOTSUPP for modes that aren't supported; ENOSYS instead
+// makes the kernel fail all further fallocate calls for the mount with
+// EOPNOTSUPP, without consulting the file system.
 type FallocateOp struct {
 	// The inode and handle we are fallocating
 	Inode  InodeID
@@ -979,6 +1373,190 @@ type FallocateOp struct {
 	// If Mode has 0x2, deallocate space within the range specified
 	// If Mode has 0x2, it sbould also have 0x1 (deallocate should not increase
 	// file size)
+	//
+	// See the Fallocate* constants for the flags.
 	Mode      uint32
 	OpContext OpContext
 }
+
+// Find the next data or hole in a file, as for lseek(2) with SEEK_DATA or
+// SEEK_HOLE, so that tools like cp and tar can skip over holes in sparse
+// files. Other lseek calls are handled by the kernel.
+//
+// Return ENXIO if Offset is at or past the end of the file, or if Whence is
+// SeekData and there is no data after Offset. Return ENOSYS to have the
+// kernel treat every file in the mount as a single extent of data for this
+// and every later call, as for file systems without holes.
+type LSeekOp struct {
+	// The file, and the handle through which it was opened.
+	Inode  InodeID
+	Handle HandleID
+
+	// The offset from which to search, and SeekData or SeekHole.
+	Offset int64
+	Whence uint32
+
+	// Set by the file system: the offset of the start of the next data or
+	// hole at or after Offset. The end of the file counts as a hole.
+	ResultOffset int64
+	OpContext    OpContext
+}
+
+// Values for LSeekOp.Whence, as for lseek(2).
+const (
+	SeekData uint32 = 3
+	SeekHole uint32 = 4
+)
+
+// Copy a range of bytes from one file to another, or within a file, without
+// the data passing through the kernel. This is sent in response to
+// copy_file_range(2) on Linux >= 4.20, for files within the same mount.
+//
+// Return ENOSYS to have the kernel fall back to copying with ReadFileOp and
+// WriteFileOp, for this and every later copy on the mount; EOPNOTSUPP or
+// EXDEV to fall back once. If writeback caching is enabled, the kernel
+// flushes dirty pages of the source range and invalidates those of the
+// destination range first.
+type CopyFileRangeOp struct {
+	// The file being copied from, the handle through which it was opened, and
+	// the offset of the range.
+	SrcInode  InodeID
+	SrcHandle HandleID
+	SrcOffset uint64
+
+	// The file being copied to, and likewise. It may be the same as the
+	// source.
+	DstInode  InodeID
+	DstHandle HandleID
+	DstOffset uint64
+
+	// The number of bytes to copy, less than 4 GiB. The source range may
+	// extend past its end of file, in which case only the bytes up to it are
+	// copied.
+	Length uint64
+
+	// Flags from copy_file_range(2). Currently always zero.
+	Flags uint64
+
+	// Set by the file system: the number of bytes copied, which may be less
+	// than Length.
+	BytesCopied uint64
+	OpContext   OpContext
+}
+
+// Perform a device-specific request on an open file or directory, as for
+// ioctl(2). Commands that the file system doesn't recognize should fail with
+// ENOTTY, which is also what the caller sees if the file system returns
+// ENOSYS.
+//
+// Ordinary mounts receive only "restricted" ioctls, whose argument is either
+// a plain integer or a pointer to a buffer whose size and direction are
+// encoded in the command number, as by the _IOR and _IOW macros. The kernel
+// copies that buffer into Input and copies Output back out, so file systems
+// never deal with the caller's memory. Unrestricted ioctls, whose arguments
+// are arbitrary structures in the caller's address space, are sent only for
+// CUSE devices; cf. RetryIn.
+type IoctlOp struct {
+	// The file or directory, and the handle through which it was opened.
+	Inode  InodeID
+	Handle HandleID
+
+	// The request and its argument as passed to ioctl(2). For restricted
+	// ioctls that carry a buffer, Arg is the address of the buffer in the
+	// caller's address space and is of use only for unrestricted ones.
+	Cmd uint32
+	Arg uint64
+
+	// A combination of the Ioctl* flags describing the request.
+	Flags uint32
+
+	// The contents of the argument buffer, for commands that read it.
+	Input []byte
+
+	// The size of the argument buffer, for commands that write it. Output
+	// beyond this is dropped.
+	OutputSize uint32
+
+	// Set by the file system: the value for ioctl(2) to return, which must not
+	// be negative (return an error instead to fail), and the data to copy back
+	// to the argument buffer.
+	Result int32
+	Output []byte
+
+	// Set by the file system, only for IoctlUnrestricted requests: the ranges
+	// of the caller's memory that the file system needs to read and write to
+	// carry out the request. If either is non-empty, the kernel ignores the
+	// rest of the reply, and sends the request again with Input holding the
+	// contents of RetryIn, concatenated, and OutputSize the total length of
+	// RetryOut, whose ranges are filled from Output in turn.
+	RetryIn  []IoctlIovec
+	RetryOut []IoctlIovec
+
+	OpContext OpContext
+}
+
+// A range of the memory of the process calling ioctl(2) (cf. IoctlOp).
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+// Flags for IoctlOp.Flags.
+const (
+	// The caller is a 32-bit process on a 64-bit kernel, using the compat
+	// ioctl entry point.
+	IoctlCompat uint32 = 0x1
+
+	// The request is unrestricted (CUSE only). Cf. IoctlOp.RetryIn.
+	IoctlUnrestricted uint32 = 0x2
+
+	// The caller is a 32-bit process.
+	Ioctl32Bit uint32 = 0x8
+
+	// The request is for a directory.
+	IoctlDir uint32 = 0x10
+)
+
+// Report the readiness of an open file for I/O, as for poll(2), select(2) and
+// epoll(7). Files of file systems that return ENOSYS are always ready for
+// reading and writing, which is right for regular files but makes pollers of
+// e.g. event streams or pipes spin.
+type PollOp struct {
+	// The file being polled, and the handle through which it was opened.
+	Inode  InodeID
+	Handle HandleID
+
+	// The events the caller is interested in, as poll(2) flags like POLLIN and
+	// POLLOUT. Zero on kernels older than Linux 3.11, in which case all events
+	// should be reported.
+	Events uint32
+
+	// If set, the caller is going to wait, and the kernel wants to be told
+	// when the file's readiness may have changed by a call to
+	// fuse.Connection.NotifyPoll with PollHandle. Once notified, the kernel
+	// polls again. Ignored when the file is ready already.
+	ScheduleNotify bool
+	PollHandle     PollHandle
+
+	// Set by the file system: the events that are ready now.
+	Revents   uint32
+	OpContext OpContext
+}
+
+// PollHandle identifies a poll request that is waiting for its file to become
+// ready (cf. PollOp).
+type PollHandle uint64
+
+// Flags for FallocateOp.Mode, as for fallocate(2). The kernel accepts only
+// modes made of FallocateKeepSize, FallocatePunchHole and FallocateZeroRange,
+// with FallocateKeepSize always accompanying FallocatePunchHole.
+const (
+	// Don't extend the file, even if the range extends past its end.
+	FallocateKeepSize uint32 = 0x1
+
+	// Deallocate the range, which then reads as zeros.
+	FallocatePunchHole uint32 = 0x2
+
+	// Zero the range, allocating it if necessary.
+	FallocateZeroRange uint32 = 0x10
+)
@@ -87,9 +87,17 @@ type InodeAttributes struct {
 	//
 	Mode os.FileMode
 
-	// The device number. Only valid if the file is a device
+	// The device number. Only valid if the file is a device. This is in the
+	// kernel's encoding, which golang.org/x/sys/unix's Major, Minor and Mkdev
+	// convert to and from on both Linux and OS X, for device numbers that fit:
+	// on Linux, majors of up to 12 bits and minors of up to 20.
 	Rdev uint32
 
+	// The number of 512-byte blocks allocated to the inode, as reported in
+	// stat::st_blocks. If zero, the size rounded up to a multiple of 512 bytes
+	// is reported instead, which is right for file systems without sparse files.
+	Blocks uint64
+
 	// Time information. See `man 2 stat` for full details.
 	Atime  time.Time // Time of last access
 	Mtime  time.Time // Time of last modification
@@ -134,11 +142,31 @@ type GenerationNumber uint64
 // This corresponds to fuse_file_info::fh.
 type HandleID uint64
 
+// BackingID identifies a file registered with the kernel, by
+// fuse.Connection.RegisterBackingFile, to serve the reads and writes of files
+// opened with it directly. Zero means none.
+type BackingID int32
+
 // DirOffset is an offset into an open directory handle. This is opaque to
 // FUSE, and can be used for whatever purpose the file system desires. See
 // notes on ReadDirOp.Offset for details.
 type DirOffset uint64
 
+// DirentPlus is an entry within a directory, returned by ReadDirPlusOp along
+// with the result of looking it up.
+type DirentPlus struct {
+	// The (opaque) offset within the directory of the entry following this one.
+	// See notes on ReadDirOp.Offset for details.
+	Offset DirOffset
+
+	// The name of the child within the directory.
+	Name string
+
+	// The child, as would be returned by LookUpInodeOp. The entry's type is
+	// taken from Entry.Attributes.Mode, so the attributes must be filled in.
+	Entry ChildInodeEntry
+}
+
 // ChildInodeEntry contains information about a child inode within its parent
 // directory. It is shared by LookUpInodeOp, MkDirOp, CreateFileOp, etc, and is
 // consumed by the kernel in order to set up a dcache entry.
@@ -192,7 +220,8 @@ type ChildInodeEntry struct {
 	//
 	// This field controls when the attributes returned in this response and
 	// stashed in the struct inode should be re-queried. Leave at the zero value
-	// to disable caching.
+	// to use MountConfig.DefaultAttributeTimeout, which disables caching unless
+	// set; use ExpireAfter for an explicit lifetime, including zero.
 	//
 	// More reading:
 	//     http://stackoverflow.com/q/21540315/1505451
@@ -216,9 +245,27 @@ type ChildInodeEntry struct {
 	//     inode if fuse_dentry_time(entry) hasn't passed. Otherwise it sends a
 	//     lookup request.
 	//
-	// Leave at the zero value to disable caching.
+	// Leave at the zero value to use MountConfig.DefaultEntryTimeout, which
+	// disables caching unless set; use ExpireAfter for an explicit lifetime,
+	// including zero.
 	//
 	// Beware: this value is ignored on OS X, where entry caching is disabled by
 	// default. See notes on MountConfig.EnableVnodeCaching for more.
 	EntryExpiration time.Time
 }
+
+// ExpireAfter returns the expiration time for an entry or attributes that may
+// be cached for d from now, for use in fields like
+// ChildInodeEntry.EntryExpiration. Unlike leaving such a field at the zero
+// value, a d of zero or less disables caching even if the mount has a default
+// timeout.
+func ExpireAfter(d time.Duration) time.Time {
+	if d <= 0 {
+		return neverCache
+	}
+
+	return time.Now().Add(d)
+}
+
+// A non-zero time in the past, which the kernel treats as already expired.
+var neverCache = time.Unix(0, 0)
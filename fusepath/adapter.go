@@ -0,0 +1,573 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusepath
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Config contains options for NewFileSystem.
+type Config struct {
+	// How long the kernel may cache the attributes of an inode, and the mapping
+	// from a name to an inode, before asking again. Zero means that it must ask
+	// every time, which is the right choice if files may change other than
+	// through the mount.
+	AttributesTTL time.Duration
+	EntryTTL      time.Duration
+}
+
+// NewFileSystem returns a fuseutil.FileSystem that serves fs. Inode IDs are
+// assigned on lookup and recycled once the kernel forgets them; hard links
+// aren't recognized as such.
+func NewFileSystem(fs FileSystem, cfg Config) fuseutil.FileSystem {
+	return &pathFS{
+		fs:        fs,
+		cfg:       cfg,
+		entries:   fuseutil.NewEntryMap(),
+		handles:   fuseutil.NewHandleTable(),
+		nextInode: fuseops.RootInodeID + 1,
+	}
+}
+
+type pathFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	fs      FileSystem
+	cfg     Config
+	entries *fuseutil.EntryMap
+	handles *fuseutil.HandleTable
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	nextInode fuseops.InodeID
+}
+
+// A directory handle: the directory's path and a snapshot of its entries.
+type dirHandle struct {
+	name    string
+	entries []DirEntry
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Translate an error from fs into one for the kernel.
+func convertError(err error) error {
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return nil
+
+	case errors.As(err, &errno):
+		return errno
+
+	case errors.Is(err, iofs.ErrNotExist):
+		return fuse.ENOENT
+
+	case errors.Is(err, iofs.ErrExist):
+		return fuse.EEXIST
+
+	case errors.Is(err, iofs.ErrPermission):
+		return syscall.EACCES
+
+	case errors.Is(err, iofs.ErrInvalid):
+		return fuse.EINVAL
+	}
+
+	return fuse.WrapError(fuse.EIO, err, "fusepath")
+}
+
+// Return the path of the supplied inode.
+func (p *pathFS) pathOf(id fuseops.InodeID) (string, error) {
+	name, ok := p.entries.Path(id)
+	if !ok {
+		return "", fuse.ENOENT
+	}
+
+	return name, nil
+}
+
+func (p *pathFS) childPath(
+	parent fuseops.InodeID,
+	name string) (string, error) {
+	dir, err := p.pathOf(parent)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(dir, name), nil
+}
+
+// Return the attributes of the named file and when they expire.
+func (p *pathFS) getAttr(
+	ctx context.Context,
+	name string) (fuseops.InodeAttributes, time.Time, error) {
+	attrs, err := p.fs.GetAttr(ctx, name)
+	if err != nil {
+		return attrs, time.Time{}, convertError(err)
+	}
+
+	var expiration time.Time
+	if p.cfg.AttributesTTL > 0 {
+		expiration = time.Now().Add(p.cfg.AttributesTTL)
+	}
+
+	return attrs, expiration, nil
+}
+
+// Fill in a ChildInodeEntry for the supplied name, recording the lookup.
+func (p *pathFS) lookedUp(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string,
+	childPath string,
+	e *fuseops.ChildInodeEntry) error {
+	attrs, expiration, err := p.getAttr(ctx, childPath)
+	if err != nil {
+		return err
+	}
+
+	id, ok := p.entries.LookUp(parent, name)
+	if !ok {
+		p.mu.Lock()
+		id = p.nextInode
+		p.nextInode++
+		p.mu.Unlock()
+	}
+
+	p.entries.LookedUp(parent, name, id)
+	e.Child = id
+	e.Attributes = attrs
+	e.AttributesExpiration = expiration
+	if p.cfg.EntryTTL > 0 {
+		e.EntryExpiration = time.Now().Add(p.cfg.EntryTTL)
+	}
+
+	return nil
+}
+
+func (p *pathFS) file(id fuseops.HandleID) (File, error) {
+	h, _ := p.handles.Get(id)
+	f, ok := h.(File)
+	if !ok {
+		return nil, fuse.EINVAL
+	}
+
+	return f, nil
+}
+
+func (p *pathFS) dir(id fuseops.HandleID) (*dirHandle, error) {
+	h, _ := p.handles.Get(id)
+	d, ok := h.(*dirHandle)
+	if !ok {
+		return nil, fuse.EINVAL
+	}
+
+	return d, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// fuseutil.FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (p *pathFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (p *pathFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	name, err := p.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	return p.lookedUp(ctx, op.Parent, op.Name, name, &op.Entry)
+}
+
+func (p *pathFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	name, err := p.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes, op.AttributesExpiration, err = p.getAttr(ctx, name)
+	return err
+}
+
+func (p *pathFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	name, err := p.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if op.Size != nil {
+		if err := p.fs.Truncate(ctx, name, *op.Size); err != nil {
+			return convertError(err)
+		}
+	}
+
+	if op.Mode != nil {
+		if err := p.fs.Chmod(ctx, name, *op.Mode); err != nil {
+			return convertError(err)
+		}
+	}
+
+	if op.Atime != nil || op.Mtime != nil {
+		if err := p.fs.Utimens(ctx, name, op.Atime, op.Mtime); err != nil {
+			return convertError(err)
+		}
+	}
+
+	op.Attributes, op.AttributesExpiration, err = p.getAttr(ctx, name)
+	return err
+}
+
+func (p *pathFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	p.entries.Forget(op.Inode, op.N)
+	return nil
+}
+
+func (p *pathFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		p.entries.Forget(e.Inode, e.N)
+	}
+
+	return nil
+}
+
+func (p *pathFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	name, err := p.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := p.fs.Mkdir(ctx, name, op.Mode); err != nil {
+		return convertError(err)
+	}
+
+	return p.lookedUp(ctx, op.Parent, op.Name, name, &op.Entry)
+}
+
+func (p *pathFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	name, err := p.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	f, err := p.fs.Create(ctx, name, int(op.OpenFlags), op.Mode)
+	if err != nil {
+		return convertError(err)
+	}
+
+	if err := p.lookedUp(ctx, op.Parent, op.Name, name, &op.Entry); err != nil {
+		f.Close()
+		return err
+	}
+
+	op.Handle = p.handles.Add(f)
+	return nil
+}
+
+func (p *pathFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	name, err := p.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := p.fs.Symlink(ctx, op.Target, name); err != nil {
+		return convertError(err)
+	}
+
+	return p.lookedUp(ctx, op.Parent, op.Name, name, &op.Entry)
+}
+
+func (p *pathFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	name, err := p.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := p.fs.Mknod(ctx, name, op.Mode, op.Rdev); err != nil {
+		return convertError(err)
+	}
+
+	return p.lookedUp(ctx, op.Parent, op.Name, name, &op.Entry)
+}
+
+func (p *pathFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	oldName, err := p.pathOf(op.Target)
+	if err != nil {
+		return err
+	}
+
+	name, err := p.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := p.fs.Link(ctx, oldName, name); err != nil {
+		return convertError(err)
+	}
+
+	return p.lookedUp(ctx, op.Parent, op.Name, name, &op.Entry)
+}
+
+func (p *pathFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	name, err := p.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Target, err = p.fs.Readlink(ctx, name)
+	return convertError(err)
+}
+
+func (p *pathFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	// FileSystem.Rename has no way to honour renameat2 flags.
+	if op.Flags != 0 {
+		return fuse.EINVAL
+	}
+
+	oldName, err := p.childPath(op.OldParent, op.OldName)
+	if err != nil {
+		return err
+	}
+
+	newName, err := p.childPath(op.NewParent, op.NewName)
+	if err != nil {
+		return err
+	}
+
+	if err := p.fs.Rename(ctx, oldName, newName); err != nil {
+		return convertError(err)
+	}
+
+	// Anything below a renamed directory follows along, since paths are
+	// derived from names.
+	p.entries.Rename(op.OldParent, op.OldName, op.NewParent, op.NewName)
+	return nil
+}
+
+func (p *pathFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	name, err := p.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := p.fs.Rmdir(ctx, name); err != nil {
+		return convertError(err)
+	}
+
+	p.entries.Unlink(op.Parent, op.Name)
+	return nil
+}
+
+func (p *pathFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	name, err := p.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := p.fs.Unlink(ctx, name); err != nil {
+		return convertError(err)
+	}
+
+	p.entries.Unlink(op.Parent, op.Name)
+	return nil
+}
+
+func (p *pathFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	name, err := p.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	entries, err := p.fs.ReadDir(ctx, name)
+	if err != nil {
+		return convertError(err)
+	}
+
+	op.Handle = p.handles.Add(&dirHandle{name: name, entries: entries})
+	return nil
+}
+
+func (p *pathFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	d, err := p.dir(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	for i := int(op.Offset); i < len(d.entries); i++ {
+		e := d.entries[i]
+
+		// Use the inode's ID if the kernel knows it. Otherwise any non-zero
+		// value will do, since the kernel ignores it.
+		id, ok := p.entries.LookUp(op.Inode, e.Name)
+		if !ok {
+			id = fuseutil.HashInodeID(path.Join(d.name, e.Name))
+		}
+
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  id,
+			Name:   e.Name,
+			Type:   fuseutil.DirentTypeForMode(e.Mode),
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (p *pathFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	p.handles.Release(op.Handle)
+	return nil
+}
+
+func (p *pathFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	name, err := p.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	// The kernel supplies the offset of every write, even in append mode.
+	f, err := p.fs.Open(ctx, name, int(op.OpenFlags)&^os.O_APPEND)
+	if err != nil {
+		return convertError(err)
+	}
+
+	op.Handle = p.handles.Add(f)
+	return nil
+}
+
+func (p *pathFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	f, err := p.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead, err = f.ReadAt(op.Dst, op.Offset)
+
+	// Short reads are how the kernel learns of EOF.
+	if err == io.EOF {
+		err = nil
+	}
+
+	return convertError(err)
+}
+
+func (p *pathFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	f, err := p.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(op.Data, op.Offset)
+	return convertError(err)
+}
+
+func (p *pathFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	f, err := p.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	s, ok := f.(interface{ Sync() error })
+	if !ok {
+		return nil
+	}
+
+	return convertError(s.Sync())
+}
+
+func (p *pathFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (p *pathFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	if h, ok := p.handles.Release(op.Handle); ok {
+		if f, ok := h.(File); ok {
+			f.Close()
+		}
+	}
+
+	return nil
+}
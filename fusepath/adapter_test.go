@@ -0,0 +1,240 @@
+package fusepath
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A flat in-memory file system keyed by path, recording the paths it is asked
+// about.
+type memFS struct {
+	NotImplementedFileSystem
+
+	files map[string]*memFile
+	dirs  map[string]bool
+	nodes map[string]fuseops.InodeAttributes
+	asked []string
+}
+
+type memFile struct {
+	bytes.Buffer
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(f.Bytes()).ReadAt(p, off)
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.Write(p)
+}
+
+func (f *memFile) Close() error { return nil }
+
+func (fs *memFS) GetAttr(
+	ctx context.Context,
+	name string) (fuseops.InodeAttributes, error) {
+	fs.asked = append(fs.asked, name)
+	switch {
+	case fs.dirs[name]:
+		return fuseops.InodeAttributes{Mode: os.ModeDir | 0755}, nil
+
+	case fs.files[name] != nil:
+		return fuseops.InodeAttributes{Size: uint64(fs.files[name].Len()), Mode: 0644}, nil
+
+	case fs.nodes[name].Mode != 0:
+		return fs.nodes[name], nil
+	}
+
+	return fuseops.InodeAttributes{}, os.ErrNotExist
+}
+
+func (fs *memFS) Mkdir(ctx context.Context, name string, mode os.FileMode) error {
+	fs.dirs[name] = true
+	return nil
+}
+
+func (fs *memFS) Create(
+	ctx context.Context,
+	name string,
+	flags int,
+	mode os.FileMode) (File, error) {
+	fs.files[name] = &memFile{}
+	return fs.files[name], nil
+}
+
+func (fs *memFS) Mknod(
+	ctx context.Context,
+	name string,
+	mode os.FileMode,
+	rdev uint32) error {
+	fs.nodes[name] = fuseops.InodeAttributes{Mode: mode, Rdev: rdev}
+	return nil
+}
+
+func (fs *memFS) Link(ctx context.Context, oldName, newName string) error {
+	fs.files[newName] = fs.files[oldName]
+	return nil
+}
+
+func (fs *memFS) Rename(ctx context.Context, oldName, newName string) error {
+	for name, f := range fs.files {
+		if len(name) > len(oldName) && name[:len(oldName)+1] == oldName+"/" {
+			delete(fs.files, name)
+			fs.files[newName+name[len(oldName):]] = f
+		}
+	}
+
+	delete(fs.dirs, oldName)
+	fs.dirs[newName] = true
+	return nil
+}
+
+func (fs *memFS) ReadDir(ctx context.Context, name string) ([]DirEntry, error) {
+	var entries []DirEntry
+	for p := range fs.files {
+		if len(p) > len(name) && p[:len(name)+1] == name+"/" {
+			entries = append(entries, DirEntry{Name: p[len(name)+1:]})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func TestPathFS(t *testing.T) {
+	ctx := context.Background()
+	mem := &memFS{
+		files: make(map[string]*memFile),
+		dirs:  map[string]bool{"/": true},
+	}
+
+	fs := NewFileSystem(mem, Config{EntryTTL: time.Minute})
+
+	mkdir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir", Mode: os.ModeDir | 0755}
+	if err := fs.MkDir(ctx, mkdir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	if mkdir.Entry.EntryExpiration.IsZero() || !mkdir.Entry.AttributesExpiration.IsZero() {
+		t.Errorf("Unexpected expirations: %+v", mkdir.Entry)
+	}
+
+	create := &fuseops.CreateFileOp{Parent: mkdir.Entry.Child, Name: "foo", Mode: 0644}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	write := &fuseops.WriteFileOp{Handle: create.Handle, Data: []byte("taco")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// Renaming the directory moves the file along with it.
+	rename := &fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "dir",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "renamed",
+	}
+
+	if err := fs.Rename(ctx, rename); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	mem.asked = nil
+	getAttr := &fuseops.GetInodeAttributesOp{Inode: create.Entry.Child}
+	if err := fs.GetInodeAttributes(ctx, getAttr); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if len(mem.asked) != 1 || mem.asked[0] != "/renamed/foo" || getAttr.Attributes.Size != 4 {
+		t.Errorf("Asked about %v, got %+v", mem.asked, getAttr.Attributes)
+	}
+
+	// Errors from fs are translated.
+	lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "missing"}
+	if err := fs.LookUpInode(ctx, lookUp); err != fuse.ENOENT {
+		t.Errorf("LookUpInode: got %v, want ENOENT", err)
+	}
+
+	// Listing a directory.
+	openDir := &fuseops.OpenDirOp{Inode: mkdir.Entry.Child}
+	if err := fs.OpenDir(ctx, openDir); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	readDir := &fuseops.ReadDirOp{Inode: mkdir.Entry.Child, Handle: openDir.Handle, Dst: make([]byte, 1024)}
+	if err := fs.ReadDir(ctx, readDir); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	if readDir.BytesRead == 0 || !bytes.Contains(readDir.Dst, []byte("foo")) {
+		t.Errorf("Unexpected listing: %q", readDir.Dst[:readDir.BytesRead])
+	}
+
+	// Once forgotten, the inode is no longer known.
+	err := fs.BatchForget(ctx, &fuseops.BatchForgetOp{
+		Entries: []fuseops.BatchForgetEntry{{Inode: create.Entry.Child, N: 1}},
+	})
+	if err != nil {
+		t.Fatalf("BatchForget: %v", err)
+	}
+
+	getAttr = &fuseops.GetInodeAttributesOp{Inode: create.Entry.Child}
+	if err := fs.GetInodeAttributes(ctx, getAttr); err != fuse.ENOENT {
+		t.Errorf("GetInodeAttributes after forget: got %v, want ENOENT", err)
+	}
+}
+
+func TestPathFSNodes(t *testing.T) {
+	ctx := context.Background()
+	mem := &memFS{
+		files: make(map[string]*memFile),
+		dirs:  map[string]bool{"/": true},
+		nodes: make(map[string]fuseops.InodeAttributes),
+	}
+
+	fs := NewFileSystem(mem, Config{})
+
+	mknod := &fuseops.MkNodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "null",
+		Mode:   os.ModeDevice | os.ModeCharDevice | 0666,
+		Rdev:   1<<8 | 3,
+	}
+
+	if err := fs.MkNode(ctx, mknod); err != nil {
+		t.Fatalf("MkNode: %v", err)
+	}
+
+	if a := mknod.Entry.Attributes; a.Mode != mknod.Mode || a.Rdev != mknod.Rdev {
+		t.Errorf("Unexpected attributes: %+v", a)
+	}
+
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "foo", Mode: 0644}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	link := &fuseops.CreateLinkOp{Parent: fuseops.RootInodeID, Name: "bar", Target: create.Entry.Child}
+	if err := fs.CreateLink(ctx, link); err != nil {
+		t.Fatalf("CreateLink: %v", err)
+	}
+
+	if mem.files["/bar"] != mem.files["/foo"] || link.Entry.Child == 0 {
+		t.Errorf("Unexpected link: %+v, %v", link.Entry, mem.files)
+	}
+
+	// Linking an unknown inode fails.
+	link = &fuseops.CreateLinkOp{Parent: fuseops.RootInodeID, Name: "baz", Target: 1000}
+	if err := fs.CreateLink(ctx, link); err != fuse.ENOENT {
+		t.Errorf("CreateLink of unknown inode: got %v", err)
+	}
+}
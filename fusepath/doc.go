@@ -0,0 +1,24 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fusepath lets file systems be written in terms of paths rather than
+// inode IDs.
+//
+// Implement FileSystem, usually by embedding NotImplementedFileSystem and
+// overriding the methods of interest, then serve it with
+// fuseutil.NewFileSystemServer(fusepath.NewFileSystem(fs, fusepath.Config{})).
+// The adapter takes care of inode IDs, the kernel's lookup counts (see the
+// notes on fuseops.ForgetInodeOp), handle allocation, and keeping paths
+// straight across renames of the inodes the kernel knows about.
+package fusepath
@@ -0,0 +1,195 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusepath
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// FileSystem is a file system addressed by path. Paths are slash-separated
+// and absolute, with "/" the root of the mount.
+//
+// Return a syscall.Errno such as fuse.ENOENT to report a particular error to
+// the kernel. The io/fs sentinel errors (fs.ErrNotExist and so on) are also
+// recognized; anything else is reported as EIO.
+//
+// Methods may be called concurrently, including for the same path.
+type FileSystem interface {
+	// Return the attributes of the named file, without following symlinks.
+	GetAttr(ctx context.Context, name string) (fuseops.InodeAttributes, error)
+
+	// Change the attributes of the named file. For Utimens, a nil time leaves
+	// that time alone.
+	Chmod(ctx context.Context, name string, mode os.FileMode) error
+	Truncate(ctx context.Context, name string, size uint64) error
+	Utimens(ctx context.Context, name string, atime, mtime *time.Time) error
+
+	// Create things. Each should fail with fuse.EEXIST if the name exists.
+	// Mknod creates a FIFO, socket or device node, as for mknod(2), with the
+	// device number in the kernel's encoding (see
+	// fuseops.InodeAttributes.Rdev). Link creates newName as a hard link to
+	// oldName; the adapter gives the two names different inode IDs, so return
+	// the link count from GetAttr for both.
+	Mkdir(ctx context.Context, name string, mode os.FileMode) error
+	Create(ctx context.Context, name string, flags int, mode os.FileMode) (File, error)
+	Symlink(ctx context.Context, target, name string) error
+	Mknod(ctx context.Context, name string, mode os.FileMode, rdev uint32) error
+	Link(ctx context.Context, oldName, newName string) error
+
+	// Return the target of the named symlink.
+	Readlink(ctx context.Context, name string) (string, error)
+
+	// Remove the named directory, which should be empty, or non-directory.
+	Rmdir(ctx context.Context, name string) error
+	Unlink(ctx context.Context, name string) error
+
+	// Move oldName to newName, replacing anything already there.
+	Rename(ctx context.Context, oldName, newName string) error
+
+	// Return the entries of the named directory, excluding "." and "..". The
+	// listing is taken when the directory is opened, and served from there.
+	ReadDir(ctx context.Context, name string) ([]DirEntry, error)
+
+	// Open the named file with the supplied open(2) flags.
+	Open(ctx context.Context, name string, flags int) (File, error)
+}
+
+// File is a file opened by FileSystem.Open or FileSystem.Create. Close is
+// called when the kernel releases the last descriptor sharing the open. If
+// the file also has a method Sync() error, that is called for fsync(2).
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// DirEntry is an entry returned by FileSystem.ReadDir. Only the type bits of
+// the mode are used.
+type DirEntry struct {
+	Name string
+	Mode os.FileMode
+}
+
+// NotImplementedFileSystem may be embedded to give a FileSystem default
+// implementations that fail with ENOSYS.
+type NotImplementedFileSystem struct {
+}
+
+var _ FileSystem = &NotImplementedFileSystem{}
+
+func (fs *NotImplementedFileSystem) GetAttr(
+	ctx context.Context,
+	name string) (fuseops.InodeAttributes, error) {
+	return fuseops.InodeAttributes{}, fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Chmod(
+	ctx context.Context,
+	name string,
+	mode os.FileMode) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Truncate(
+	ctx context.Context,
+	name string,
+	size uint64) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Utimens(
+	ctx context.Context,
+	name string,
+	atime, mtime *time.Time) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Mkdir(
+	ctx context.Context,
+	name string,
+	mode os.FileMode) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Create(
+	ctx context.Context,
+	name string,
+	flags int,
+	mode os.FileMode) (File, error) {
+	return nil, fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Symlink(
+	ctx context.Context,
+	target, name string) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Mknod(
+	ctx context.Context,
+	name string,
+	mode os.FileMode,
+	rdev uint32) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Link(
+	ctx context.Context,
+	oldName, newName string) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Readlink(
+	ctx context.Context,
+	name string) (string, error) {
+	return "", fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Rmdir(
+	ctx context.Context,
+	name string) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Unlink(
+	ctx context.Context,
+	name string) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Rename(
+	ctx context.Context,
+	oldName, newName string) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) ReadDir(
+	ctx context.Context,
+	name string) ([]DirEntry, error) {
+	return nil, fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Open(
+	ctx context.Context,
+	name string,
+	flags int) (File, error) {
+	return nil, fuse.ENOSYS
+}
@@ -0,0 +1,650 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package fusetesting
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// ErrSkipped is wrapped by the errors of conformance checks that can't be run
+// in the current environment, e.g. because they need to be root.
+var ErrSkipped = errors.New("skipped")
+
+// A ConformanceCheck checks one aspect of POSIX file system behavior through
+// the usual system calls. Run is given an empty directory on the file system
+// under test, and returns an error describing what went wrong, if anything.
+type ConformanceCheck struct {
+	Name string
+	Run  func(dir string) error
+}
+
+// ConformanceResult is the outcome of a ConformanceCheck.
+type ConformanceResult struct {
+	Name string
+	Err  error
+}
+
+// Passed reports whether the check ran and found nothing wrong.
+func (r ConformanceResult) Passed() bool {
+	return r.Err == nil
+}
+
+// Skipped reports whether the check couldn't be run, either because of the
+// environment or because the file system doesn't implement the ops it needs
+// (ENOSYS or EOPNOTSUPP).
+func (r ConformanceResult) Skipped() bool {
+	return errors.Is(r.Err, ErrSkipped) ||
+		errors.Is(r.Err, syscall.ENOSYS) ||
+		errors.Is(r.Err, syscall.EOPNOTSUPP)
+}
+
+func (r ConformanceResult) String() string {
+	switch {
+	case r.Passed():
+		return "PASS " + r.Name
+
+	case r.Skipped():
+		return fmt.Sprintf("SKIP %s: %v", r.Name, r.Err)
+	}
+
+	return fmt.Sprintf("FAIL %s: %v", r.Name, r.Err)
+}
+
+// ConformanceChecks is the battery run by RunConformance.
+var ConformanceChecks = []ConformanceCheck{
+	{"rename over existing file", checkRenameOverFile},
+	{"rename directories", checkRenameDirs},
+	{"O_EXCL", checkExclusiveCreate},
+	{"O_APPEND", checkAppend},
+	{"truncate", checkTruncate},
+	{"sparse file", checkSparseFile},
+	{"unlinked open file", checkUnlinkedOpenFile},
+	{"hard links", checkHardLinks},
+	{"sticky directory", checkStickyDir},
+	{"mmap coherence", checkMmapCoherence},
+}
+
+// CheckConformance runs the supplied checks against a directory, which may be
+// on any file system, each in a new subdirectory of its own. This allows the
+// checks themselves to be validated against a local file system.
+func CheckConformance(
+	dir string,
+	checks []ConformanceCheck) []ConformanceResult {
+	var results []ConformanceResult
+	for i, c := range checks {
+		r := ConformanceResult{Name: c.Name}
+		sub := path.Join(dir, fmt.Sprintf("check%d", i))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			r.Err = fmt.Errorf("Mkdir: %w", err)
+		} else {
+			r.Err = c.Run(sub)
+		}
+
+		results = append(results, r)
+	}
+
+	return results
+}
+
+// RunConformance mounts the server (e.g. fuseutil.NewFileSystemServer(fs)) on
+// a temporary directory with the supplied config, runs ConformanceChecks
+// against it, and unmounts it again. The error is for failures to mount or
+// unmount; the outcome of each check is in its result.
+//
+// The file system must support at least creating directories and files; the
+// checks skip, rather than fail, when it returns ENOSYS for anything more.
+func RunConformance(
+	ctx context.Context,
+	server fuse.Server,
+	cfg *fuse.MountConfig) ([]ConformanceResult, error) {
+	dir, err := ioutil.TempDir("", "conformance")
+	if err != nil {
+		return nil, fmt.Errorf("TempDir: %w", err)
+	}
+	defer os.Remove(dir)
+
+	mfs, err := fuse.Mount(dir, server, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Mount: %w", err)
+	}
+
+	results := CheckConformance(dir, ConformanceChecks)
+
+	// Unmounting may fail with EBUSY while the kernel finishes with files the
+	// checks closed.
+	delay := 10 * time.Millisecond
+	for {
+		err = fuse.Unmount(dir)
+		if err == nil || !errors.Is(err, syscall.EBUSY) || ctx.Err() != nil {
+			break
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	if err != nil {
+		return results, fmt.Errorf("Unmount: %w", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		return results, fmt.Errorf("Join: %w", err)
+	}
+
+	return results, nil
+}
+
+// RunConformanceTests is like RunConformance, reporting each check as a
+// subtest of t, for use from the tests of a file system built on this
+// package.
+func RunConformanceTests(
+	t *testing.T,
+	server fuse.Server,
+	cfg *fuse.MountConfig) {
+	results, err := RunConformance(context.Background(), server, cfg)
+	for _, r := range results {
+		r := r
+		t.Run(r.Name, func(t *testing.T) {
+			switch {
+			case r.Skipped():
+				t.Skip(r.Err)
+
+			case !r.Passed():
+				t.Error(r.Err)
+			}
+		})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Checks
+////////////////////////////////////////////////////////////////////////
+
+// Return an error unless err is one of the supplied errnos.
+func wantErrno(what string, err error, errnos ...syscall.Errno) error {
+	for _, e := range errnos {
+		if errors.Is(err, e) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: got %v, want %v", what, err, errnos)
+}
+
+// Return an error unless the file has the supplied contents.
+func wantContents(p string, want []byte) error {
+	got, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%s contains %q, want %q", path.Base(p), got, want)
+	}
+
+	return nil
+}
+
+func checkRenameOverFile(dir string) error {
+	from := path.Join(dir, "from")
+	to := path.Join(dir, "to")
+	if err := ioutil.WriteFile(from, []byte("taco"), 0644); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(to, []byte("burrito"), 0644); err != nil {
+		return err
+	}
+
+	// A handle open on the file replaced keeps its contents.
+	f, err := os.Open(to)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(from); !os.IsNotExist(err) {
+		return fmt.Errorf("Lstat(from) after rename: %v", err)
+	}
+
+	if err := wantContents(to, []byte("taco")); err != nil {
+		return err
+	}
+
+	old, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("reading replaced file: %w", err)
+	}
+
+	if string(old) != "burrito" {
+		return fmt.Errorf("replaced file contains %q", old)
+	}
+
+	return nil
+}
+
+func checkRenameDirs(dir string) error {
+	a := path.Join(dir, "a")
+	b := path.Join(dir, "b")
+	file := path.Join(dir, "file")
+	// (os.Rename refuses to replace directories itself.)
+	for _, d := range []string{a, b} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path.Join(b, "child"), nil, 0644); err != nil {
+		return err
+	}
+
+	if err := wantErrno("rename over non-empty directory", syscall.Rename(a, b), syscall.ENOTEMPTY, syscall.EEXIST); err != nil {
+		return err
+	}
+
+	if err := wantErrno("rename file over directory", syscall.Rename(file, a), syscall.EISDIR); err != nil {
+		return err
+	}
+
+	if err := wantErrno("rename directory over file", syscall.Rename(a, file), syscall.ENOTDIR); err != nil {
+		return err
+	}
+
+	if err := wantErrno("rename directory into itself", syscall.Rename(b, path.Join(b, "sub")), syscall.EINVAL); err != nil {
+		return err
+	}
+
+	// Over an empty directory is fine, and takes the children along.
+	if err := os.Remove(path.Join(b, "child")); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path.Join(a, "child"), nil, 0644); err != nil {
+		return err
+	}
+
+	if err := syscall.Rename(a, b); err != nil {
+		return fmt.Errorf("rename over empty directory: %w", err)
+	}
+
+	_, err := os.Lstat(path.Join(b, "child"))
+	return err
+}
+
+func checkExclusiveCreate(dir string) error {
+	p := path.Join(dir, "foo")
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("creating: %w", err)
+	}
+	f.Close()
+
+	_, err = os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err := wantErrno("O_EXCL on existing file", err, syscall.EEXIST); err != nil {
+		return err
+	}
+
+	// The same goes for a dangling symlink, which isn't followed.
+	link := path.Join(dir, "link")
+	if err := os.Symlink(path.Join(dir, "missing"), link); err != nil {
+		if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM) {
+			return nil
+		}
+
+		return err
+	}
+
+	_, err = os.OpenFile(link, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	return wantErrno("O_EXCL on dangling symlink", err, syscall.EEXIST)
+}
+
+func checkAppend(dir string) error {
+	p := path.Join(dir, "foo")
+	if err := ioutil.WriteFile(p, []byte("taco"), 0644); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Writes go to the end even after seeking, and even when the file has
+	// grown through another handle.
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(p, []byte("tacoburrito"), 0644); err != nil {
+		return err
+	}
+
+	if _, err := f.Write([]byte("enchilada")); err != nil {
+		return err
+	}
+
+	return wantContents(p, []byte("tacoburritoenchilada"))
+}
+
+func checkTruncate(dir string) error {
+	p := path.Join(dir, "foo")
+	if err := ioutil.WriteFile(p, []byte("tacoburrito"), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Truncate(p, 4); err != nil {
+		return err
+	}
+
+	if err := wantContents(p, []byte("taco")); err != nil {
+		return fmt.Errorf("after shrinking: %w", err)
+	}
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(8); err != nil {
+		return err
+	}
+
+	if err := wantContents(p, []byte("taco\x00\x00\x00\x00")); err != nil {
+		return fmt.Errorf("after growing: %w", err)
+	}
+
+	// O_TRUNC empties the file.
+	g, err := os.OpenFile(p, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	g.Close()
+
+	return wantContents(p, nil)
+}
+
+func checkSparseFile(dir string) error {
+	const offset = 1<<20 + 17
+	p := path.Join(dir, "foo")
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt([]byte("taco"), offset); err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() != offset+4 {
+		return fmt.Errorf("size %d, want %d", fi.Size(), offset+4)
+	}
+
+	// The hole reads as zeros, right up to the data.
+	buf := make([]byte, 4096+4)
+	if _, err := f.ReadAt(buf, offset-4096); err != nil {
+		return err
+	}
+
+	want := append(make([]byte, 4096), "taco"...)
+	if !bytes.Equal(buf, want) {
+		return fmt.Errorf("hole doesn't read as zeros")
+	}
+
+	return nil
+}
+
+func checkUnlinkedOpenFile(dir string) error {
+	p := path.Join(dir, "foo")
+	if err := ioutil.WriteFile(p, []byte("taco"), 0644); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(p); !os.IsNotExist(err) {
+		return fmt.Errorf("Lstat after unlink: %v", err)
+	}
+
+	// The file lives on through the handle, and can still be written.
+	if _, err := f.WriteAt([]byte("burrito"), 4); err != nil {
+		return fmt.Errorf("writing unlinked file: %w", err)
+	}
+
+	buf := make([]byte, 11)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return fmt.Errorf("reading unlinked file: %w", err)
+	}
+
+	if string(buf) != "tacoburrito" {
+		return fmt.Errorf("unlinked file contains %q", buf)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if n := nlink(fi); n != 0 {
+		return fmt.Errorf("unlinked file has %d links", n)
+	}
+
+	return nil
+}
+
+func checkHardLinks(dir string) error {
+	p := path.Join(dir, "foo")
+	q := path.Join(dir, "bar")
+	if err := ioutil.WriteFile(p, []byte("taco"), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Link(p, q); err != nil {
+		return err
+	}
+
+	// The names share an inode, and so contents and attributes.
+	if err := ioutil.WriteFile(q, []byte("burrito"), 0644); err != nil {
+		return err
+	}
+
+	if err := wantContents(p, []byte("burrito")); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(q, 0600); err != nil {
+		return err
+	}
+
+	pi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	qi, err := os.Stat(q)
+	if err != nil {
+		return err
+	}
+
+	if !os.SameFile(pi, qi) || nlink(pi) != 2 || pi.Mode().Perm() != 0600 {
+		return fmt.Errorf("after linking: %v and %v, %d links", pi.Mode(), qi.Mode(), nlink(pi))
+	}
+
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+
+	qi, err = os.Stat(q)
+	if err != nil {
+		return err
+	}
+
+	if nlink(qi) != 1 {
+		return fmt.Errorf("after unlinking: %d links", nlink(qi))
+	}
+
+	return nil
+}
+
+// Another user may remove their own files from a sticky directory, but not
+// ours. This needs root to act as that user, and the file system to be
+// mounted with MountConfig.AllowOther for them to see it.
+func checkStickyDir(dir string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("%w: needs root", ErrSkipped)
+	}
+
+	const nobody = 65534
+	if err := os.Chmod(dir, os.ModeSticky|0777); err != nil {
+		return err
+	}
+
+	ours := path.Join(dir, "ours")
+	theirs := path.Join(dir, "theirs")
+	for _, p := range []string{ours, theirs} {
+		if err := ioutil.WriteFile(p, nil, 0666); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Chown(theirs, nobody, nobody); err != nil {
+		return err
+	}
+
+	removeAsNobody := func(p string) error {
+		cmd := exec.Command("rm", p)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: nobody, Gid: nobody},
+		}
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+
+		return nil
+	}
+
+	if err := removeAsNobody(theirs); err != nil {
+		return fmt.Errorf("%w: another user can't remove their own file (%v)", ErrSkipped, err)
+	}
+
+	if err := removeAsNobody(ours); err == nil {
+		return fmt.Errorf("another user removed our file from a sticky directory")
+	}
+
+	_, err := os.Lstat(ours)
+	return err
+}
+
+// Changes made through write(2) are seen by a mapping of the file, and
+// changes made through a mapping are seen by read(2) once synced.
+func checkMmapCoherence(dir string) error {
+	p := path.Join(dir, "foo")
+	if err := ioutil.WriteFile(p, bytes.Repeat([]byte{'a'}, 4096), 0644); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m, err := unix.Mmap(int(f.Fd()), 0, 4096, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("Mmap: %w", err)
+	}
+	defer unix.Munmap(m)
+
+	if _, err := f.WriteAt([]byte("taco"), 0); err != nil {
+		return err
+	}
+
+	if string(m[:4]) != "taco" {
+		return fmt.Errorf("mapping shows %q after write(2)", m[:4])
+	}
+
+	copy(m[8:], "burrito")
+	if err := unix.Msync(m, unix.MS_SYNC); err != nil {
+		return fmt.Errorf("Msync: %w", err)
+	}
+
+	g, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+
+	buf := make([]byte, 7)
+	if _, err := g.ReadAt(buf, 8); err != nil {
+		return err
+	}
+
+	if string(buf) != "burrito" {
+		return fmt.Errorf("read(2) shows %q after writing through the mapping", buf)
+	}
+
+	return nil
+}
+
+func nlink(fi os.FileInfo) uint64 {
+	n, _ := extractNlink(fi.Sys())
+	return n
+}
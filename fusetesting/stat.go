@@ -18,7 +18,6 @@ import (
 	"fmt"
 	"os"
 	"reflect"
-	"syscall"
 	"time"
 
 	"github.com/jacobsa/oglematchers"
@@ -99,7 +98,7 @@ func birthtimeIsWithin(
 // Extract time information from the supplied file info. Panic on platforms
 // where this is not possible.
 func GetTimes(fi os.FileInfo) (atime, ctime, mtime time.Time) {
-	return getTimes(fi.Sys().(*syscall.Stat_t))
+	return getTimes(fi.Sys())
 }
 
 // Match os.FileInfo values that specify a number of links equal to the given
@@ -31,7 +31,8 @@ func extractNlink(sys interface{}) (nlink uint64, ok bool) {
 	return uint64(sys.(*syscall.Stat_t).Nlink), true
 }
 
-func getTimes(stat *syscall.Stat_t) (atime, ctime, mtime time.Time) {
+func getTimes(sys interface{}) (atime, ctime, mtime time.Time) {
+	stat := sys.(*syscall.Stat_t)
 	atime = time.Unix(stat.Atimespec.Unix())
 	ctime = time.Unix(stat.Ctimespec.Unix())
 	mtime = time.Unix(stat.Mtimespec.Unix())
@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// AppendSerializer helps file systems that use direct IO implement O_APPEND
+// correctly. Without the page cache the kernel doesn't know the file's true
+// size, so the offset it sends for a write to a handle opened with O_APPEND
+// may be stale, e.g. if another process appended in the meantime. Honouring
+// it would overwrite the other process's data, which for log files means
+// silent corruption.
+//
+// AppendSerializer tracks which handles were opened with O_APPEND, and
+// serializes writes per inode so that, for those handles, the offset can be
+// replaced with the current size and the write performed atomically with
+// respect to other writes through the serializer.
+//
+// Call Opened from OpenFile and CreateFile, Released from ReleaseFileHandle,
+// and route all writes through WriteFile. Safe for concurrent access.
+type AppendSerializer struct {
+	mu sync.Mutex
+
+	// The inodes of handles opened with O_APPEND.
+	//
+	// GUARDED_BY(mu)
+	appendHandles map[fuseops.HandleID]fuseops.InodeID
+
+	// A lock for each inode that has been written, held while writing.
+	//
+	// GUARDED_BY(mu)
+	inodeLocks map[fuseops.InodeID]*sync.Mutex
+}
+
+// NewAppendSerializer creates a serializer with no handles registered.
+func NewAppendSerializer() *AppendSerializer {
+	return &AppendSerializer{
+		appendHandles: make(map[fuseops.HandleID]fuseops.InodeID),
+		inodeLocks:    make(map[fuseops.InodeID]*sync.Mutex),
+	}
+}
+
+// Opened registers a newly opened handle, with the flags from
+// OpenFileOp.OpenFlags or CreateFileOp.OpenFlags.
+func (a *AppendSerializer) Opened(
+	inode fuseops.InodeID,
+	h fuseops.HandleID,
+	flags uint32) {
+	if flags&syscall.O_APPEND == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.appendHandles[h] = inode
+}
+
+// Released forgets the handle.
+func (a *AppendSerializer) Released(h fuseops.HandleID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.appendHandles, h)
+}
+
+// Forget discards the state for the inode, e.g. from ForgetInode. There must
+// be no writes to it in progress.
+func (a *AppendSerializer) Forget(inode fuseops.InodeID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.inodeLocks, inode)
+}
+
+// WriteFile performs the write with write, holding the lock for the inode.
+// If the handle was opened with O_APPEND, op.Offset is first set to the
+// inode's current size as returned by size.
+func (a *AppendSerializer) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp,
+	size func(inode fuseops.InodeID) (int64, error),
+	write func(ctx context.Context, op *fuseops.WriteFileOp) error) error {
+	a.mu.Lock()
+	_, isAppend := a.appendHandles[op.Handle]
+	l := a.inodeLocks[op.Inode]
+	if l == nil {
+		l = new(sync.Mutex)
+		a.inodeLocks[op.Inode] = l
+	}
+	a.mu.Unlock()
+
+	l.Lock()
+	defer l.Unlock()
+
+	if isAppend {
+		off, err := size(op.Inode)
+		if err != nil {
+			return err
+		}
+
+		op.Offset = off
+	}
+
+	return write(ctx, op)
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestAppendSerializer(t *testing.T) {
+	a := NewAppendSerializer()
+	a.Opened(2, 10, syscall.O_WRONLY|syscall.O_APPEND)
+	a.Opened(2, 11, syscall.O_WRONLY)
+
+	var contents []byte
+	size := func(fuseops.InodeID) (int64, error) {
+		return int64(len(contents)), nil
+	}
+
+	write := func(ctx context.Context, op *fuseops.WriteFileOp) error {
+		end := int(op.Offset) + len(op.Data)
+		for len(contents) < end {
+			contents = append(contents, 0)
+		}
+
+		copy(contents[op.Offset:], op.Data)
+		return nil
+	}
+
+	// Concurrent appends with stale offsets must not overwrite each other.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			op := &fuseops.WriteFileOp{Inode: 2, Handle: 10, Offset: 0, Data: []byte("ab")}
+			if err := a.WriteFile(context.Background(), op, size, write); err != nil {
+				t.Errorf("WriteFile: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(contents) != 100 {
+		t.Fatalf("len(contents) = %d, want 100", len(contents))
+	}
+
+	// Other handles keep their offsets.
+	op := &fuseops.WriteFileOp{Inode: 2, Handle: 11, Offset: 0, Data: []byte("X")}
+	a.WriteFile(context.Background(), op, size, write)
+	if contents[0] != 'X' || len(contents) != 100 {
+		t.Errorf("non-append write went to the wrong place")
+	}
+}
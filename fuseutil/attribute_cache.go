@@ -0,0 +1,174 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// A function that fetches fresh attributes for an inode, e.g. from a backing
+// store.
+type AttributeRefreshFunc func(ctx context.Context) (fuseops.InodeAttributes, error)
+
+// AttributeCache holds the attributes of a single inode, calling a refresh
+// function to fetch them when they are first needed and again whenever the
+// cached copy is older than a TTL.
+//
+// The expiration time returned by Get is the moment the cached copy goes
+// stale, and is intended to be used directly as the AttributesExpiration (or
+// EntryExpiration) of an op. That way the kernel never caches attributes for
+// longer than we do, and doesn't ask again while we would only serve it the
+// same cached value.
+//
+// Safe for concurrent access. Concurrent calls to Get on an expired cache
+// result in a single call to the refresh function, which is made without
+// holding the cache's lock so that Set and Invalidate don't wait for it.
+type AttributeCache struct {
+	clock   timeutil.Clock
+	ttl     time.Duration
+	refresh AttributeRefreshFunc
+
+	mu sync.Mutex
+
+	// The cached attributes and the time at which they go stale. A zero
+	// expiration means there is nothing cached.
+	//
+	// GUARDED_BY(mu)
+	attrs      fuseops.InodeAttributes
+	expiration time.Time
+
+	// Incremented by Set and Invalidate, so that a refresh that was started
+	// before either can tell that its result is out of date.
+	//
+	// GUARDED_BY(mu)
+	epoch uint64
+
+	// Non-nil while a refresh is in progress, and closed when it completes.
+	//
+	// GUARDED_BY(mu)
+	refreshing chan struct{}
+}
+
+// NewAttributeCache creates an empty cache that calls refresh when attributes
+// are needed and the cached copy is missing or older than ttl.
+func NewAttributeCache(
+	clock timeutil.Clock,
+	ttl time.Duration,
+	refresh AttributeRefreshFunc) *AttributeCache {
+	return &AttributeCache{
+		clock:   clock,
+		ttl:     ttl,
+		refresh: refresh,
+	}
+}
+
+// Get returns the cached attributes if they are still fresh, and otherwise
+// calls the refresh function. It also returns the time at which the returned
+// attributes go stale.
+//
+// If the refresh function fails, its error is returned and nothing is cached.
+// If Set or Invalidate is called while the refresh is in progress, its result
+// isn't cached either, since it may predate the change.
+func (c *AttributeCache) Get(
+	ctx context.Context) (fuseops.InodeAttributes, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Wait for any refresh already in progress, which may leave us with fresh
+	// attributes.
+	for {
+		if c.clock.Now().Before(c.expiration) {
+			return c.attrs, c.expiration, nil
+		}
+
+		done := c.refreshing
+		if done == nil {
+			break
+		}
+
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			c.mu.Lock()
+			return fuseops.InodeAttributes{}, time.Time{}, ctx.Err()
+		}
+		c.mu.Lock()
+	}
+
+	done := make(chan struct{})
+	c.refreshing = done
+	epoch := c.epoch
+	now := c.clock.Now()
+
+	c.mu.Unlock()
+	attrs, err := c.refresh(ctx)
+	c.mu.Lock()
+
+	c.refreshing = nil
+	close(done)
+
+	if err != nil {
+		if c.epoch == epoch {
+			c.expiration = time.Time{}
+		}
+
+		return fuseops.InodeAttributes{}, time.Time{}, err
+	}
+
+	// If the cache was changed in the meantime, prefer what was set over what
+	// we fetched, and don't let the kernel cache a fetched value that may
+	// already be stale.
+	if c.epoch != epoch {
+		if c.clock.Now().Before(c.expiration) {
+			return c.attrs, c.expiration, nil
+		}
+
+		return attrs, now, nil
+	}
+
+	c.attrs = attrs
+	c.expiration = now.Add(c.ttl)
+	return c.attrs, c.expiration, nil
+}
+
+// Set replaces the cached attributes with the supplied ones and restarts the
+// TTL, e.g. after the file system itself has modified the inode in response
+// to a SetInodeAttributesOp.
+func (c *AttributeCache) Set(attrs fuseops.InodeAttributes) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.attrs = attrs
+	c.expiration = c.clock.Now().Add(c.ttl)
+	c.epoch++
+	return c.expiration
+}
+
+// Invalidate discards the cached attributes, so that the next call to Get
+// calls the refresh function. Note that this doesn't affect the kernel's
+// cache, which expires on its own at the time previously returned by Get.
+func (c *AttributeCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expiration = time.Time{}
+	c.epoch++
+}
@@ -0,0 +1,117 @@
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestAttributeCache(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 3, 26, 0, 0, 0, 0, time.UTC))
+
+	var calls int
+	var refreshErr error
+	c := NewAttributeCache(&clock, time.Second, func(ctx context.Context) (fuseops.InodeAttributes, error) {
+		calls++
+		return fuseops.InodeAttributes{Size: uint64(calls)}, refreshErr
+	})
+
+	ctx := context.Background()
+
+	// The first call refreshes, and the expiration follows the TTL.
+	attrs, exp, err := c.Get(ctx)
+	if err != nil || attrs.Size != 1 || !exp.Equal(clock.Now().Add(time.Second)) {
+		t.Fatalf("Get = %v, %v, %v", attrs, exp, err)
+	}
+
+	// Before the TTL elapses the cached copy is served.
+	clock.AdvanceTime(time.Second / 2)
+	if attrs, _, _ = c.Get(ctx); attrs.Size != 1 || calls != 1 {
+		t.Errorf("Expected cached attributes, got size %d after %d calls", attrs.Size, calls)
+	}
+
+	// Afterward it is refreshed.
+	clock.AdvanceTime(time.Second / 2)
+	if attrs, _, _ = c.Get(ctx); attrs.Size != 2 {
+		t.Errorf("Expected refreshed attributes, got size %d", attrs.Size)
+	}
+
+	// Invalidation forces a refresh, whose errors aren't cached.
+	c.Invalidate()
+	refreshErr = errors.New("taco")
+	if _, _, err = c.Get(ctx); err != refreshErr {
+		t.Errorf("Get error = %v, want %v", err, refreshErr)
+	}
+
+	refreshErr = nil
+	if attrs, _, _ = c.Get(ctx); attrs.Size != 4 {
+		t.Errorf("Expected refresh after error, got size %d", attrs.Size)
+	}
+
+	// Set replaces the cached copy.
+	c.Set(fuseops.InodeAttributes{Size: 17})
+	if attrs, _, _ = c.Get(ctx); attrs.Size != 17 || calls != 4 {
+		t.Errorf("Expected set attributes, got size %d after %d calls", attrs.Size, calls)
+	}
+}
+
+func TestAttributeCacheRefreshUnlocked(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 3, 26, 0, 0, 0, 0, time.UTC))
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls int
+	c := NewAttributeCache(&clock, time.Second, func(ctx context.Context) (fuseops.InodeAttributes, error) {
+		calls++
+		close(started)
+		<-release
+		return fuseops.InodeAttributes{Size: 1}, nil
+	})
+
+	ctx := context.Background()
+	sizes := make(chan uint64, 2)
+	get := func() {
+		attrs, _, err := c.Get(ctx)
+		if err != nil {
+			t.Errorf("Get: %v", err)
+		}
+
+		sizes <- attrs.Size
+	}
+
+	go get()
+	<-started
+	go get()
+
+	// Set shouldn't wait for the refresh.
+	set := make(chan struct{})
+	go func() {
+		c.Set(fuseops.InodeAttributes{Size: 17})
+		close(set)
+	}()
+
+	select {
+	case <-set:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Set blocked on the refresh")
+	}
+
+	// Once the refresh completes, its stale result should lose out to what
+	// was set, for both callers.
+	close(release)
+	for i := 0; i < 2; i++ {
+		if size := <-sizes; size != 17 {
+			t.Errorf("Get returned size %d, want 17", size)
+		}
+	}
+
+	if attrs, _, _ := c.Get(ctx); attrs.Size != 17 || calls != 1 {
+		t.Errorf("Expected set attributes, got size %d after %d calls", attrs.Size, calls)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"os"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The mode bits that can be expressed to the kernel: permissions, the
+// setuid/setgid/sticky bits, and the file type bits that have a posix
+// equivalent (cf. fuse.ConvertGoMode).
+const representableModeBits = os.ModePerm |
+	os.ModeSetuid |
+	os.ModeSetgid |
+	os.ModeSticky |
+	os.ModeDir |
+	os.ModeSymlink |
+	os.ModeDevice |
+	os.ModeCharDevice |
+	os.ModeNamedPipe |
+	os.ModeSocket
+
+// SanitizeMode returns the supplied mode with any bits that can't be
+// represented in a posix mode removed, and with the type bits made consistent:
+//
+//   - os.ModeAppend, os.ModeExclusive, os.ModeTemporary and os.ModeIrregular
+//     have no posix equivalent and are dropped.
+//
+//   - os.ModeCharDevice is only meaningful together with os.ModeDevice (a
+//     character device is a device), so the latter is added if missing.
+//
+//   - If more than one file type is set, the one that fuse.ConvertGoMode would
+//     pick wins.
+func SanitizeMode(m os.FileMode) os.FileMode {
+	m &= representableModeBits
+
+	if m&os.ModeCharDevice != 0 {
+		m |= os.ModeDevice
+	}
+
+	typ := m & os.ModeType
+	switch {
+	case typ&os.ModeDir != 0:
+		typ = os.ModeDir
+	case typ&os.ModeDevice != 0:
+		typ &= os.ModeDevice | os.ModeCharDevice
+	case typ&os.ModeNamedPipe != 0:
+		typ = os.ModeNamedPipe
+	case typ&os.ModeSymlink != 0:
+		typ = os.ModeSymlink
+	case typ&os.ModeSocket != 0:
+		typ = os.ModeSocket
+	}
+
+	return m&^os.ModeType | typ
+}
+
+// AttributesFromFileInfo converts the supplied os.FileInfo (e.g. the result of
+// os.Lstat) to inode attributes.
+//
+// If fi.Sys() returns a *syscall.Stat_t, as is the case for os.Lstat on Linux
+// and OS X, all of its fields are used (cf. AttributesFromStat). If fi was
+// returned by FileInfoFromAttributes, the original attributes are returned.
+// Otherwise only the size, mode and modification time are known; the
+// other times are set to the modification time and the link count to one.
+func AttributesFromFileInfo(fi os.FileInfo) fuseops.InodeAttributes {
+	if attrs, ok := attributesFromSys(fi.Sys()); ok {
+		return attrs
+	}
+
+	mtime := fi.ModTime()
+	return fuseops.InodeAttributes{
+		Size:   uint64(fi.Size()),
+		Nlink:  1,
+		Mode:   SanitizeMode(fi.Mode()),
+		Atime:  mtime,
+		Mtime:  mtime,
+		Ctime:  mtime,
+		Crtime: mtime,
+	}
+}
+
+func attributesFromSys(sys interface{}) (fuseops.InodeAttributes, bool) {
+	if s, ok := sys.(*fuseops.InodeAttributes); ok {
+		return *s, true
+	}
+
+	return attributesFromStatSys(sys)
+}
+
+// FileInfoFromAttributes returns an os.FileInfo with the supplied base name
+// describing an inode with the supplied attributes. Its Sys method returns a
+// *fuseops.InodeAttributes.
+func FileInfoFromAttributes(
+	name string,
+	attrs fuseops.InodeAttributes) os.FileInfo {
+	return &attributesFileInfo{
+		name:  name,
+		attrs: attrs,
+	}
+}
+
+type attributesFileInfo struct {
+	name  string
+	attrs fuseops.InodeAttributes
+}
+
+func (fi *attributesFileInfo) Name() string       { return fi.name }
+func (fi *attributesFileInfo) Size() int64        { return int64(fi.attrs.Size) }
+func (fi *attributesFileInfo) Mode() os.FileMode  { return fi.attrs.Mode }
+func (fi *attributesFileInfo) ModTime() time.Time { return fi.attrs.Mtime }
+func (fi *attributesFileInfo) IsDir() bool        { return fi.attrs.Mode.IsDir() }
+func (fi *attributesFileInfo) Sys() interface{}   { return &fi.attrs }
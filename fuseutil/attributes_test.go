@@ -0,0 +1,80 @@
+package fuseutil
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestSanitizeMode(t *testing.T) {
+	testCases := []struct {
+		in   os.FileMode
+		want os.FileMode
+	}{
+		{0644, 0644},
+		{os.ModeDir | 0755, os.ModeDir | 0755},
+		{os.ModeCharDevice | 0600, os.ModeDevice | os.ModeCharDevice | 0600},
+		{os.ModeAppend | os.ModeExclusive | 0644, 0644},
+		{os.ModeIrregular | os.ModeTemporary | 0644, 0644},
+		{os.ModeDir | os.ModeSymlink | 0755, os.ModeDir | 0755},
+		{os.ModeSetuid | os.ModeSticky | 0755, os.ModeSetuid | os.ModeSticky | 0755},
+	}
+
+	for _, tc := range testCases {
+		if got := SanitizeMode(tc.in); got != tc.want {
+			t.Errorf("SanitizeMode(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestFileInfoRoundTrip(t *testing.T) {
+	attrs := fuseops.InodeAttributes{
+		Size:  17,
+		Nlink: 2,
+		Mode:  os.ModeDir | 0700,
+		Mtime: time.Date(2015, 3, 26, 0, 0, 0, 0, time.UTC),
+		Uid:   123,
+		Gid:   456,
+	}
+
+	fi := FileInfoFromAttributes("foo", attrs)
+	if fi.Name() != "foo" || fi.Size() != 17 || !fi.IsDir() {
+		t.Errorf("Unexpected FileInfo: %v %v %v", fi.Name(), fi.Size(), fi.IsDir())
+	}
+
+	if got := AttributesFromFileInfo(fi); got != attrs {
+		t.Errorf("AttributesFromFileInfo = %#v, want %#v", got, attrs)
+	}
+}
+
+func TestAttributesFromStat(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString("taco"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+
+	fi, err := os.Lstat(f.Name())
+	if err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+
+	attrs := AttributesFromFileInfo(fi)
+	if attrs.Size != 4 || attrs.Mode != fi.Mode() || attrs.Nlink != 1 {
+		t.Errorf("Unexpected attributes: %#v", attrs)
+	}
+
+	if !attrs.Mtime.Equal(fi.ModTime()) {
+		t.Errorf("Mtime = %v, want %v", attrs.Mtime, fi.ModTime())
+	}
+
+	if attrs.Uid != uint32(os.Getuid()) || attrs.Gid != uint32(os.Getgid()) {
+		t.Errorf("Unexpected owner: %d:%d", attrs.Uid, attrs.Gid)
+	}
+}
@@ -0,0 +1,596 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// Configuration for NewCachingFileSystem. A zero TTL disables caching of that
+// kind.
+type CachingConfig struct {
+	// How long attributes returned by the wrapped file system, from
+	// GetInodeAttributes or along with an entry, are served from the cache.
+	AttributeTTL time.Duration
+
+	// How long the entries found by LookUpInode are served from the cache.
+	EntryTTL time.Duration
+
+	// How long a name found not to exist, whether by an ENOENT error or by an
+	// entry with a zero Child, is reported missing without asking again.
+	NegativeEntryTTL time.Duration
+
+	// The clock against which TTLs are measured. Defaults to the real clock.
+	Clock timeutil.Clock
+}
+
+// CachingFileSystem wraps a FileSystem, typically one backed by a remote
+// service, so that lookups and attribute requests are answered from a cache
+// of recent results rather than each going to the wrapped file system. This
+// is in addition to the kernel's own caching, which is governed as usual by
+// the expiration times the wrapped file system returns and which is often
+// kept short (or disabled) so that changes on the backend show up promptly.
+// Cached replies carry the expiration times originally returned.
+//
+// Lookups answered from the cache aren't seen by the wrapped file system, so
+// the kernel's lookup counts run ahead of those it issued; the excess is taken
+// off forgets before they are passed on. An inode's cached entries are
+// dropped as soon as any forget reaches the wrapped file system, since it may
+// then have forgotten the inode.
+//
+// Ops through the mount that change what is cached invalidate it: creating,
+// removing, linking and renaming entries, SetInodeAttributes, WriteFile,
+// Fallocate, CopyFileRange and changes to extended attributes. Changes made
+// to the backend in other ways can be made visible early with
+// InvalidateInode, InvalidateEntry and InvalidateAll; note that these leave
+// the kernel's cache alone (cf. fuse.Connection.NotifyInvalInode).
+type CachingFileSystem struct {
+	FileSystem
+	cfg CachingConfig
+
+	mu sync.Mutex
+
+	// Incremented by each invalidation, so that results requested from the
+	// wrapped file system before it aren't cached after it.
+	//
+	// GUARDED_BY(mu)
+	epoch uint64
+
+	// GUARDED_BY(mu)
+	attrs map[fuseops.InodeID]cachedAttributes
+
+	// Cached entries by parent and name, and the names cached for each child.
+	//
+	// GUARDED_BY(mu)
+	entries map[fuseops.InodeID]map[string]cachedEntry
+	names   map[fuseops.InodeID]map[cachedName]struct{}
+
+	// The child each name was last seen to refer to, whether or not its entry
+	// is cached, so that removing or replacing the name can drop the child's
+	// cached attributes. Kept until the child is forgotten.
+	//
+	// GUARDED_BY(mu)
+	children   map[cachedName]fuseops.InodeID
+	childNames map[fuseops.InodeID]map[cachedName]struct{}
+
+	// The lookups of each inode answered from the cache and not yet forgotten.
+	//
+	// GUARDED_BY(mu)
+	extraLookups map[fuseops.InodeID]uint64
+}
+
+type cachedAttributes struct {
+	attrs      fuseops.InodeAttributes
+	expiration time.Time
+	stale      time.Time
+}
+
+// A cached result of LookUpInode. A zero Child means that the name doesn't
+// exist, as reported by err or by the negative entry.
+type cachedEntry struct {
+	entry fuseops.ChildInodeEntry
+	err   error
+	stale time.Time
+}
+
+type cachedName struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// NewCachingFileSystem wraps the supplied file system. The cache starts out
+// empty.
+func NewCachingFileSystem(
+	wrapped FileSystem,
+	cfg CachingConfig) *CachingFileSystem {
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	return &CachingFileSystem{
+		FileSystem:   wrapped,
+		cfg:          cfg,
+		attrs:        make(map[fuseops.InodeID]cachedAttributes),
+		entries:      make(map[fuseops.InodeID]map[string]cachedEntry),
+		names:        make(map[fuseops.InodeID]map[cachedName]struct{}),
+		children:     make(map[cachedName]fuseops.InodeID),
+		childNames:   make(map[fuseops.InodeID]map[cachedName]struct{}),
+		extraLookups: make(map[fuseops.InodeID]uint64),
+	}
+}
+
+// InvalidateInode discards the cached attributes of the inode and, if it is a
+// directory, the cached entries within it.
+func (fs *CachingFileSystem) InvalidateInode(id fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.epoch++
+	delete(fs.attrs, id)
+	for name := range fs.entries[id] {
+		fs.dropEntryLocked(cachedName{id, name})
+	}
+}
+
+// InvalidateEntry discards the cached result of looking up the name within
+// the parent, positive or negative.
+func (fs *CachingFileSystem) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.epoch++
+	fs.dropEntryLocked(cachedName{parent, name})
+}
+
+// InvalidateAll discards everything cached.
+func (fs *CachingFileSystem) InvalidateAll() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.epoch++
+	fs.attrs = make(map[fuseops.InodeID]cachedAttributes)
+	fs.entries = make(map[fuseops.InodeID]map[string]cachedEntry)
+	fs.names = make(map[fuseops.InodeID]map[cachedName]struct{})
+}
+
+// EXCLUSIVE_LOCKS_REQUIRED(fs.mu)
+func (fs *CachingFileSystem) dropEntryLocked(n cachedName) {
+	ce, ok := fs.entries[n.parent][n.name]
+	if !ok {
+		return
+	}
+
+	delete(fs.entries[n.parent], n.name)
+	if len(fs.entries[n.parent]) == 0 {
+		delete(fs.entries, n.parent)
+	}
+
+	if child := ce.entry.Child; child != 0 {
+		delete(fs.names[child], n)
+		if len(fs.names[child]) == 0 {
+			delete(fs.names, child)
+		}
+	}
+}
+
+// EXCLUSIVE_LOCKS_REQUIRED(fs.mu)
+func (fs *CachingFileSystem) putEntryLocked(n cachedName, ce cachedEntry) {
+	fs.dropEntryLocked(n)
+
+	if fs.entries[n.parent] == nil {
+		fs.entries[n.parent] = make(map[string]cachedEntry)
+	}
+
+	fs.entries[n.parent][n.name] = ce
+	if child := ce.entry.Child; child != 0 {
+		if fs.names[child] == nil {
+			fs.names[child] = make(map[cachedName]struct{})
+		}
+
+		fs.names[child][n] = struct{}{}
+	}
+}
+
+// Record that the name refers to the child, or to nothing if child is zero.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(fs.mu)
+func (fs *CachingFileSystem) setChildLocked(
+	n cachedName,
+	child fuseops.InodeID) {
+	if old := fs.children[n]; old != 0 {
+		delete(fs.children, n)
+		delete(fs.childNames[old], n)
+		if len(fs.childNames[old]) == 0 {
+			delete(fs.childNames, old)
+		}
+	}
+
+	if child == 0 {
+		return
+	}
+
+	fs.children[n] = child
+	if fs.childNames[child] == nil {
+		fs.childNames[child] = make(map[cachedName]struct{})
+	}
+
+	fs.childNames[child][n] = struct{}{}
+}
+
+// Record the child a name refers to after a successful op through the mount,
+// or that it is gone if child is zero.
+func (fs *CachingFileSystem) setChild(
+	n cachedName,
+	child fuseops.InodeID,
+	err error) {
+	if err != nil {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.setChildLocked(n, child)
+}
+
+// Discard what an op through the mount may have changed: the given names,
+// the attributes of the inodes they referred to, and those of the given
+// inodes along with the entries that refer to them, which carry copies.
+// Returns the children the names referred to, zero where unknown.
+func (fs *CachingFileSystem) invalidate(
+	names []cachedName,
+	inodes ...fuseops.InodeID) []fuseops.InodeID {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.epoch++
+	children := make([]fuseops.InodeID, len(names))
+	for i, n := range names {
+		children[i] = fs.children[n]
+		delete(fs.attrs, children[i])
+		fs.dropEntryLocked(n)
+	}
+
+	for _, id := range inodes {
+		delete(fs.attrs, id)
+		for n := range fs.names[id] {
+			fs.dropEntryLocked(n)
+		}
+	}
+
+	return children
+}
+
+// Take up to n forgets of the inode off the lookups answered from the cache,
+// returning the number left to pass on to the wrapped file system.
+func (fs *CachingFileSystem) absorbForgets(
+	id fuseops.InodeID,
+	n uint64) uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	extra := fs.extraLookups[id]
+	if n <= extra {
+		fs.extraLookups[id] = extra - n
+		if extra == n {
+			delete(fs.extraLookups, id)
+		}
+
+		return 0
+	}
+
+	// The wrapped file system may now forget the inode, so stop handing out
+	// entries for it.
+	delete(fs.extraLookups, id)
+	delete(fs.attrs, id)
+	for n := range fs.names[id] {
+		fs.dropEntryLocked(n)
+	}
+
+	for n := range fs.childNames[id] {
+		fs.setChildLocked(n, 0)
+	}
+
+	return n - extra
+}
+
+func (fs *CachingFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	key := cachedName{op.Parent, op.Name}
+	now := fs.cfg.Clock.Now()
+
+	fs.mu.Lock()
+	if ce, ok := fs.entries[op.Parent][op.Name]; ok && now.Before(ce.stale) {
+		child := ce.entry.Child
+		ca, fresh := fs.attrs[child]
+		fresh = fresh && now.Before(ca.stale)
+
+		// The attributes stored with the entry are as old as it is, so unless
+		// attributes aren't cached at all, only answer with fresh ones.
+		if child == 0 || fresh || fs.cfg.AttributeTTL == 0 {
+			op.Entry = ce.entry
+			if child != 0 {
+				fs.extraLookups[child]++
+			}
+
+			if fresh {
+				op.Entry.Attributes = ca.attrs
+				op.Entry.AttributesExpiration = ca.expiration
+			}
+
+			fs.mu.Unlock()
+			return ce.err
+		}
+	}
+
+	epoch := fs.epoch
+	fs.mu.Unlock()
+
+	err := fs.FileSystem.LookUpInode(ctx, op)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Even a result overtaken by an invalidation names an inode the kernel
+	// now holds, whose attributes a later removal of the name must drop.
+	if err == nil && op.Entry.Child != 0 {
+		fs.setChildLocked(key, op.Entry.Child)
+	}
+
+	if fs.epoch != epoch {
+		return err
+	}
+
+	switch {
+	case err == nil && op.Entry.Child != 0:
+		if fs.cfg.EntryTTL > 0 {
+			fs.putEntryLocked(key, cachedEntry{
+				entry: op.Entry,
+				stale: now.Add(fs.cfg.EntryTTL),
+			})
+		}
+
+		if fs.cfg.AttributeTTL > 0 {
+			fs.attrs[op.Entry.Child] = cachedAttributes{
+				attrs:      op.Entry.Attributes,
+				expiration: op.Entry.AttributesExpiration,
+				stale:      now.Add(fs.cfg.AttributeTTL),
+			}
+		}
+
+	case err == nil || errors.Is(err, syscall.ENOENT):
+		if fs.cfg.NegativeEntryTTL > 0 {
+			ce := cachedEntry{err: err, stale: now.Add(fs.cfg.NegativeEntryTTL)}
+			if err == nil {
+				ce.entry = op.Entry
+			}
+
+			fs.putEntryLocked(key, ce)
+		}
+	}
+
+	return err
+}
+
+func (fs *CachingFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	now := fs.cfg.Clock.Now()
+
+	fs.mu.Lock()
+	if ca, ok := fs.attrs[op.Inode]; ok && now.Before(ca.stale) {
+		fs.mu.Unlock()
+		op.Attributes = ca.attrs
+		op.AttributesExpiration = ca.expiration
+		return nil
+	}
+
+	epoch := fs.epoch
+	fs.mu.Unlock()
+
+	if err := fs.FileSystem.GetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.epoch == epoch && fs.cfg.AttributeTTL > 0 {
+		fs.attrs[op.Inode] = cachedAttributes{
+			attrs:      op.Attributes,
+			expiration: op.AttributesExpiration,
+			stale:      now.Add(fs.cfg.AttributeTTL),
+		}
+	}
+
+	return nil
+}
+
+func (fs *CachingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	err := fs.FileSystem.SetInodeAttributes(ctx, op)
+	fs.invalidate(nil, op.Inode)
+	return err
+}
+
+func (fs *CachingFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	n := fs.absorbForgets(op.Inode, op.N)
+	if n == 0 {
+		return nil
+	}
+
+	inner := *op
+	inner.N = n
+	return fs.FileSystem.ForgetInode(ctx, &inner)
+}
+
+func (fs *CachingFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	inner := *op
+	inner.Entries = nil
+	for _, e := range op.Entries {
+		e.N = fs.absorbForgets(e.Inode, e.N)
+		if e.N != 0 {
+			inner.Entries = append(inner.Entries, e)
+		}
+	}
+
+	if len(inner.Entries) == 0 {
+		return nil
+	}
+
+	return fs.FileSystem.BatchForget(ctx, &inner)
+}
+
+func (fs *CachingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	err := fs.FileSystem.MkDir(ctx, op)
+	fs.invalidate([]cachedName{{op.Parent, op.Name}}, op.Parent)
+	fs.setChild(cachedName{op.Parent, op.Name}, op.Entry.Child, err)
+	return err
+}
+
+func (fs *CachingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	err := fs.FileSystem.MkNode(ctx, op)
+	fs.invalidate([]cachedName{{op.Parent, op.Name}}, op.Parent)
+	fs.setChild(cachedName{op.Parent, op.Name}, op.Entry.Child, err)
+	return err
+}
+
+func (fs *CachingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	err := fs.FileSystem.CreateFile(ctx, op)
+	fs.invalidate([]cachedName{{op.Parent, op.Name}}, op.Parent)
+	fs.setChild(cachedName{op.Parent, op.Name}, op.Entry.Child, err)
+	return err
+}
+
+func (fs *CachingFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	err := fs.FileSystem.CreateLink(ctx, op)
+	fs.invalidate([]cachedName{{op.Parent, op.Name}}, op.Parent, op.Target)
+	fs.setChild(cachedName{op.Parent, op.Name}, op.Entry.Child, err)
+	return err
+}
+
+func (fs *CachingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	err := fs.FileSystem.CreateSymlink(ctx, op)
+	fs.invalidate([]cachedName{{op.Parent, op.Name}}, op.Parent)
+	fs.setChild(cachedName{op.Parent, op.Name}, op.Entry.Child, err)
+	return err
+}
+
+func (fs *CachingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	err := fs.FileSystem.Rename(ctx, op)
+	from := cachedName{op.OldParent, op.OldName}
+	to := cachedName{op.NewParent, op.NewName}
+	children := fs.invalidate(
+		[]cachedName{from, to},
+		op.OldParent,
+		op.NewParent)
+
+	// The attributes of both the renamed inode and any it replaced are gone
+	// now; keep track of where the former, and for an exchange the latter,
+	// went.
+	fs.setChild(to, children[0], err)
+	if op.Flags&fuseops.RenameExchange != 0 {
+		fs.setChild(from, children[1], err)
+	} else {
+		fs.setChild(from, 0, err)
+	}
+
+	return err
+}
+
+func (fs *CachingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	err := fs.FileSystem.RmDir(ctx, op)
+	fs.invalidate([]cachedName{{op.Parent, op.Name}}, op.Parent)
+	fs.setChild(cachedName{op.Parent, op.Name}, 0, err)
+	return err
+}
+
+func (fs *CachingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	err := fs.FileSystem.Unlink(ctx, op)
+	fs.invalidate([]cachedName{{op.Parent, op.Name}}, op.Parent)
+	fs.setChild(cachedName{op.Parent, op.Name}, 0, err)
+	return err
+}
+
+func (fs *CachingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	err := fs.FileSystem.WriteFile(ctx, op)
+	fs.invalidate(nil, op.Inode)
+	return err
+}
+
+func (fs *CachingFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	err := fs.FileSystem.Fallocate(ctx, op)
+	fs.invalidate(nil, op.Inode)
+	return err
+}
+
+func (fs *CachingFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	err := fs.FileSystem.CopyFileRange(ctx, op)
+	fs.invalidate(nil, op.DstInode)
+	return err
+}
+
+func (fs *CachingFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	err := fs.FileSystem.SetXattr(ctx, op)
+	fs.invalidate(nil, op.Inode)
+	return err
+}
+
+func (fs *CachingFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	err := fs.FileSystem.RemoveXattr(ctx, op)
+	fs.invalidate(nil, op.Inode)
+	return err
+}
@@ -0,0 +1,304 @@
+package fuseutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// A file system with a flat root directory, counting the calls it serves.
+type cachingTargetFS struct {
+	NotImplementedFileSystem
+	children map[string]fuseops.InodeID
+	sizes    map[fuseops.InodeID]uint64
+
+	lookUps  int
+	getAttrs int
+	forgets  map[fuseops.InodeID]uint64
+}
+
+func (fs *cachingTargetFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.lookUps++
+	child, ok := fs.children[op.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = child
+	op.Entry.Attributes.Size = fs.sizes[child]
+	return nil
+}
+
+func (fs *cachingTargetFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.getAttrs++
+	op.Attributes.Size = fs.sizes[op.Inode]
+	return nil
+}
+
+func (fs *cachingTargetFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.forgets[op.Inode] += op.N
+	return nil
+}
+
+func (fs *cachingTargetFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.forgets[e.Inode] += e.N
+	}
+
+	return nil
+}
+
+func (fs *cachingTargetFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.children[op.Name] = 3
+	return nil
+}
+
+func (fs *cachingTargetFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.sizes[op.Inode] += uint64(len(op.Data))
+	return nil
+}
+
+func (fs *cachingTargetFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	delete(fs.children, op.Name)
+	return nil
+}
+
+func (fs *cachingTargetFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	fs.children[op.NewName] = fs.children[op.OldName]
+	delete(fs.children, op.OldName)
+	return nil
+}
+
+func TestCachingFileSystem(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 3, 26, 0, 0, 0, 0, time.UTC))
+
+	ctx := context.Background()
+	wrapped := &cachingTargetFS{
+		children: map[string]fuseops.InodeID{"foo": 2},
+		sizes:    map[fuseops.InodeID]uint64{2: 4},
+		forgets:  make(map[fuseops.InodeID]uint64),
+	}
+
+	fs := NewCachingFileSystem(wrapped, CachingConfig{
+		AttributeTTL:     time.Second,
+		EntryTTL:         time.Second,
+		NegativeEntryTTL: time.Second,
+		Clock:            &clock,
+	})
+
+	lookUp := func(name string) (fuseops.ChildInodeEntry, error) {
+		op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+		err := fs.LookUpInode(ctx, op)
+		return op.Entry, err
+	}
+
+	getSize := func(id fuseops.InodeID) uint64 {
+		op := &fuseops.GetInodeAttributesOp{Inode: id}
+		if err := fs.GetInodeAttributes(ctx, op); err != nil {
+			t.Fatalf("GetInodeAttributes: %v", err)
+		}
+
+		return op.Attributes.Size
+	}
+
+	// Entries and their attributes are cached.
+	for i := 0; i < 3; i++ {
+		if e, err := lookUp("foo"); err != nil || e.Child != 2 {
+			t.Fatalf("LookUpInode(foo) = %v, %v", e.Child, err)
+		}
+	}
+
+	if getSize(2) != 4 || wrapped.lookUps != 1 || wrapped.getAttrs != 0 {
+		t.Errorf("After cached lookups: %d lookups, %d getattrs", wrapped.lookUps, wrapped.getAttrs)
+	}
+
+	// So are missing names.
+	for i := 0; i < 2; i++ {
+		if _, err := lookUp("bar"); err != fuse.ENOENT {
+			t.Fatalf("LookUpInode(bar): %v", err)
+		}
+	}
+
+	if wrapped.lookUps != 2 {
+		t.Errorf("After negative lookups: %d lookups", wrapped.lookUps)
+	}
+
+	// The kernel holds three lookups of foo, the wrapped file system only one.
+	// Forgets for those answered from the cache are kept back.
+	fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: 2, N: 2})
+	if n := wrapped.forgets[2]; n != 0 {
+		t.Errorf("Forwarded %d forgets early", n)
+	}
+
+	fs.BatchForget(ctx, &fuseops.BatchForgetOp{
+		Entries: []fuseops.BatchForgetEntry{{Inode: 2, N: 1}},
+	})
+	if n := wrapped.forgets[2]; n != 1 {
+		t.Errorf("Forwarded %d forgets, want 1", n)
+	}
+
+	// That drops the entry, since the inode may now be gone.
+	lookUp("foo")
+	if wrapped.lookUps != 3 {
+		t.Errorf("After forgetting: %d lookups", wrapped.lookUps)
+	}
+
+	// Ops through the mount invalidate what they change.
+	fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "bar"})
+	if e, err := lookUp("bar"); err != nil || e.Child != 3 {
+		t.Errorf("LookUpInode(bar) after creating = %v, %v", e.Child, err)
+	}
+
+	fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 2, Data: []byte("taco")})
+	if size := getSize(2); size != 8 {
+		t.Errorf("Size after writing: %d", size)
+	}
+
+	// As do explicit invalidations, for changes made elsewhere.
+	wrapped.sizes[2] = 100
+	if size := getSize(2); size != 8 {
+		t.Errorf("Size before invalidating: %d", size)
+	}
+
+	fs.InvalidateInode(2)
+	if size := getSize(2); size != 100 {
+		t.Errorf("Size after invalidating: %d", size)
+	}
+
+	delete(wrapped.children, "bar")
+	fs.InvalidateEntry(fuseops.RootInodeID, "bar")
+	if _, err := lookUp("bar"); err != fuse.ENOENT {
+		t.Errorf("LookUpInode(bar) after invalidating: %v", err)
+	}
+
+	// And everything expires.
+	getAttrs := wrapped.getAttrs
+	clock.AdvanceTime(time.Second)
+	getSize(2)
+	if wrapped.getAttrs != getAttrs+1 {
+		t.Error("Attributes didn't expire")
+	}
+}
+
+func TestCachingFileSystemWriteThenLookUp(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 3, 26, 0, 0, 0, 0, time.UTC))
+
+	ctx := context.Background()
+	for _, attributeTTL := range []time.Duration{0, time.Second} {
+		wrapped := &cachingTargetFS{
+			children: map[string]fuseops.InodeID{"f": 2},
+			sizes:    map[fuseops.InodeID]uint64{2: 0},
+			forgets:  make(map[fuseops.InodeID]uint64),
+		}
+
+		fs := NewCachingFileSystem(wrapped, CachingConfig{
+			AttributeTTL: attributeTTL,
+			EntryTTL:     time.Second,
+			Clock:        &clock,
+		})
+
+		lookUp := func() uint64 {
+			op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "f"}
+			if err := fs.LookUpInode(ctx, op); err != nil {
+				t.Fatalf("LookUpInode: %v", err)
+			}
+
+			return op.Entry.Attributes.Size
+		}
+
+		if size := lookUp(); size != 0 {
+			t.Fatalf("Initial size: %d", size)
+		}
+
+		if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 2, Data: []byte("taco!")}); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+
+		// The entry cached before the write mustn't be used to answer.
+		if size := lookUp(); size != 5 {
+			t.Errorf("AttributeTTL %v: size after write = %d, want 5", attributeTTL, size)
+		}
+
+		if wrapped.lookUps != 2 {
+			t.Errorf("AttributeTTL %v: %d lookups, want 2", attributeTTL, wrapped.lookUps)
+		}
+	}
+}
+
+func TestCachingFileSystemRemoveUncachedEntry(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 3, 26, 0, 0, 0, 0, time.UTC))
+
+	ctx := context.Background()
+	for _, entryTTL := range []time.Duration{0, time.Second} {
+		wrapped := &cachingTargetFS{
+			children: map[string]fuseops.InodeID{"foo": 2, "bar": 3, "baz": 4},
+			sizes:    map[fuseops.InodeID]uint64{},
+			forgets:  make(map[fuseops.InodeID]uint64),
+		}
+
+		fs := NewCachingFileSystem(wrapped, CachingConfig{
+			AttributeTTL: time.Hour,
+			EntryTTL:     entryTTL,
+			Clock:        &clock,
+		})
+
+		for _, name := range []string{"foo", "bar", "baz"} {
+			op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+			if err := fs.LookUpInode(ctx, op); err != nil {
+				t.Fatalf("LookUpInode(%s): %v", name, err)
+			}
+		}
+
+		// Let the entries, but not the attributes, expire.
+		clock.AdvanceTime(2 * time.Second)
+
+		fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "foo"})
+		fs.Rename(ctx, &fuseops.RenameOp{
+			OldParent: fuseops.RootInodeID,
+			OldName:   "bar",
+			NewParent: fuseops.RootInodeID,
+			NewName:   "baz",
+		})
+
+		// The unlinked inode, the renamed one and the one it replaced must all
+		// have their attributes fetched afresh.
+		for _, id := range []fuseops.InodeID{2, 3, 4} {
+			getAttrs := wrapped.getAttrs
+			fs.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{Inode: id})
+			if wrapped.getAttrs != getAttrs+1 {
+				t.Errorf("EntryTTL %v: attributes of inode %d served from the cache", entryTTL, id)
+			}
+		}
+
+		// The renamed inode is now known by its new name.
+		fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "baz"})
+		getAttrs := wrapped.getAttrs
+		fs.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{Inode: 3})
+		if wrapped.getAttrs != getAttrs+1 {
+			t.Errorf("EntryTTL %v: attributes of renamed inode served from the cache", entryTTL)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// DirPageFunc fetches one page of a directory listing, e.g. from a remote
+// store's paged list API. token is empty for the first page, and otherwise the
+// continuation token returned along with the previous page. An empty next
+// token means there are no more pages.
+//
+// The Offset fields of the returned entries are ignored.
+type DirPageFunc func(
+	ctx context.Context,
+	token string) (entries []Dirent, next string, err error)
+
+// DirLister serves ReadDir for one directory handle from a paged listing,
+// fetching pages on demand and keeping only the current one in memory. Create
+// one in OpenDir, keep it with the handle, and call its ReadDir from the file
+// system's ReadDir.
+//
+// Entries are given offsets counting from one in the order they were listed.
+// A read at offset zero (i.e. just after opening or after rewinddir) starts a
+// fresh listing. A read at an offset before the current page, as after
+// seekdir, also starts a fresh listing and skips forward to that offset.
+//
+// Safe for concurrent access.
+type DirLister struct {
+	fetch DirPageFunc
+
+	mu sync.Mutex
+
+	// Whether the first page has been fetched for the current listing.
+	//
+	// GUARDED_BY(mu)
+	started bool
+
+	// The current page, and the offset of the entry preceding its first entry.
+	//
+	// GUARDED_BY(mu)
+	page      []Dirent
+	pageStart fuseops.DirOffset
+
+	// The token for the page following the current one, or empty if it's the
+	// last.
+	//
+	// GUARDED_BY(mu)
+	next string
+}
+
+// NewDirLister creates a lister that fetches pages using the supplied
+// function.
+func NewDirLister(fetch DirPageFunc) *DirLister {
+	return &DirLister{
+		fetch: fetch,
+	}
+}
+
+// ReadDir fills op.Dst with entries starting at op.Offset, fetching pages as
+// necessary, and sets op.BytesRead.
+func (l *DirLister) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if op.Offset == 0 || op.Offset < l.pageStart {
+		l.started = false
+		l.page = nil
+		l.pageStart = 0
+		l.next = ""
+	}
+
+	offset := op.Offset
+	for {
+		// Move on to the page containing the offset.
+		for offset >= l.pageStart+fuseops.DirOffset(len(l.page)) {
+			if l.started && l.next == "" {
+				return nil
+			}
+
+			entries, next, err := l.fetch(ctx, l.next)
+			if err != nil {
+				// Return what we have; the error will recur on the next read.
+				if op.BytesRead > 0 {
+					return nil
+				}
+
+				return err
+			}
+
+			l.pageStart += fuseops.DirOffset(len(l.page))
+			l.page = entries
+			l.next = next
+			l.started = true
+		}
+
+		for i := int(offset - l.pageStart); i < len(l.page); i++ {
+			d := l.page[i]
+			d.Offset = l.pageStart + fuseops.DirOffset(i) + 1
+
+			n := WriteDirent(op.Dst[op.BytesRead:], d)
+			if n == 0 {
+				return nil
+			}
+
+			op.BytesRead += n
+			offset = d.Offset
+		}
+	}
+}
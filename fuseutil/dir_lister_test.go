@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Parse the output of WriteDirent back into names and offsets.
+func parseDirents(t *testing.T, buf []byte) (names []string, offsets []fuseops.DirOffset) {
+	type header struct {
+		ino     uint64
+		off     uint64
+		namelen uint32
+		type_   uint32
+	}
+
+	for len(buf) > 0 {
+		h := (*header)(unsafe.Pointer(&buf[0]))
+		start := int(unsafe.Sizeof(header{}))
+		names = append(names, string(buf[start:start+int(h.namelen)]))
+		offsets = append(offsets, fuseops.DirOffset(h.off))
+
+		n := DirentSize(Dirent{Name: names[len(names)-1]})
+		buf = buf[n:]
+	}
+
+	return
+}
+
+func TestDirLister(t *testing.T) {
+	pages := map[string][]string{
+		"":   {"a", "b"},
+		"p2": {"c", "d"},
+		"p3": {"e"},
+	}
+	nextTokens := map[string]string{"": "p2", "p2": "p3"}
+
+	var fetched []string
+	l := NewDirLister(func(ctx context.Context, token string) ([]Dirent, string, error) {
+		fetched = append(fetched, token)
+		var entries []Dirent
+		for _, name := range pages[token] {
+			entries = append(entries, Dirent{Inode: 10, Name: name})
+		}
+
+		return entries, nextTokens[token], nil
+	})
+
+	entrySize := DirentSize(Dirent{Name: "a"})
+	read := func(offset fuseops.DirOffset) ([]string, []fuseops.DirOffset) {
+		op := &fuseops.ReadDirOp{
+			Offset: offset,
+			Dst:    make([]byte, 3*entrySize),
+		}
+
+		if err := l.ReadDir(context.Background(), op); err != nil {
+			t.Fatalf("ReadDir: %v", err)
+		}
+
+		return parseDirents(t, op.Dst[:op.BytesRead])
+	}
+
+	names, offsets := read(0)
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %q, want %q", names, want)
+	}
+
+	if want := []fuseops.DirOffset{1, 2, 3}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("offsets = %v, want %v", offsets, want)
+	}
+
+	names, _ = read(3)
+	if want := []string{"d", "e"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %q, want %q", names, want)
+	}
+
+	if names, _ = read(5); len(names) != 0 {
+		t.Errorf("names at end = %q", names)
+	}
+
+	// Seeking back before the current page starts over.
+	names, _ = read(1)
+	if want := []string{"b", "c", "d"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %q, want %q", names, want)
+	}
+
+	want := []string{"", "p2", "p3", "", "p2", "p3"}
+	if !reflect.DeepEqual(fetched, want) {
+		t.Errorf("fetched %q, want %q", fetched, want)
+	}
+}
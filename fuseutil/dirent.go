@@ -15,6 +15,9 @@
 package fuseutil
 
 import (
+	"fmt"
+	"os"
+	"strings"
 	"syscall"
 	"unsafe"
 
@@ -23,17 +26,90 @@ import (
 
 type DirentType uint32
 
+// The values of DT_* in <dirent.h>, which are the same on Linux and OS X, and
+// which the WinFsp layer on Windows speaks too.
 const (
 	DT_Unknown   DirentType = 0
-	DT_Socket    DirentType = syscall.DT_SOCK
-	DT_Link      DirentType = syscall.DT_LNK
-	DT_File      DirentType = syscall.DT_REG
-	DT_Block     DirentType = syscall.DT_BLK
-	DT_Directory DirentType = syscall.DT_DIR
-	DT_Char      DirentType = syscall.DT_CHR
-	DT_FIFO      DirentType = syscall.DT_FIFO
+	DT_Socket    DirentType = 12
+	DT_Link      DirentType = 10
+	DT_File      DirentType = 8
+	DT_Block     DirentType = 6
+	DT_Directory DirentType = 4
+	DT_Char      DirentType = 2
+	DT_FIFO      DirentType = 1
 )
 
+// DirentTypeForMode returns the dirent type corresponding to the file type
+// bits of the supplied mode, e.g. as found in fuseops.InodeAttributes.Mode.
+func DirentTypeForMode(m os.FileMode) DirentType {
+	switch {
+	case m&os.ModeDir != 0:
+		return DT_Directory
+	case m&os.ModeSymlink != 0:
+		return DT_Link
+	case m&os.ModeNamedPipe != 0:
+		return DT_FIFO
+	case m&os.ModeSocket != 0:
+		return DT_Socket
+	case m&os.ModeCharDevice != 0:
+		return DT_Char
+	case m&os.ModeDevice != 0:
+		return DT_Block
+	case m&os.ModeType == 0:
+		return DT_File
+	}
+
+	return DT_Unknown
+}
+
+// The maximum length of a directory entry name accepted by the kernel
+// (NAME_MAX).
+const MaxDirentNameLen = 255
+
+// ValidateDirent returns an error if the kernel would reject or mangle the
+// supplied entry: the name must be non-empty, at most MaxDirentNameLen bytes
+// long, free of '/' and NUL bytes, and neither "." nor "..". The inode must be
+// non-zero.
+//
+// WriteDirent doesn't check any of this, so file systems that take names from
+// an untrusted source should call this first.
+func ValidateDirent(d Dirent) error {
+	switch {
+	case d.Name == "" || d.Name == "." || d.Name == "..":
+		return syscall.EINVAL
+	case len(d.Name) > MaxDirentNameLen:
+		return syscall.ENAMETOOLONG
+	case strings.ContainsAny(d.Name, "/\x00"):
+		return syscall.EINVAL
+	case d.Inode == 0:
+		return syscall.EINVAL
+	}
+
+	return nil
+}
+
+// The layout of fuse_dirent (http://goo.gl/BmFxob). The struct must be aligned
+// according to FUSE_DIRENT_ALIGN (http://goo.gl/UziWvH), which dictates 8-byte
+// alignment.
+const direntAlignment = 8
+const direntSize = 8 + 8 + 4 + 4
+
+// DirentSize returns the number of bytes WriteDirent needs to write the
+// supplied entry, including padding.
+func DirentSize(d Dirent) int {
+	return direntSize + len(d.Name) + direntPadLen(d)
+}
+
+// Compute the number of bytes of padding we'll need after the entry to
+// maintain alignment for the next one.
+func direntPadLen(d Dirent) int {
+	if len(d.Name)%direntAlignment != 0 {
+		return direntAlignment - (len(d.Name) % direntAlignment)
+	}
+
+	return 0
+}
+
 // A struct representing an entry within a directory file, describing a child.
 // See notes on fuseops.ReadDirOp and on WriteDirent for details.
 type Dirent struct {
@@ -54,10 +130,7 @@ type Dirent struct {
 // expected in fuseops.ReadFileOp.Data, returning the number of bytes written.
 // Return zero if the entry would not fit.
 func WriteDirent(buf []byte, d Dirent) (n int) {
-	// We want to write bytes with the layout of fuse_dirent
-	// (http://goo.gl/BmFxob) in host order. The struct must be aligned according
-	// to FUSE_DIRENT_ALIGN (http://goo.gl/UziWvH), which dictates 8-byte
-	// alignment.
+	// We want to write bytes with the layout of fuse_dirent in host order.
 	type fuse_dirent struct {
 		ino     uint64
 		off     uint64
@@ -66,19 +139,10 @@ func WriteDirent(buf []byte, d Dirent) (n int) {
 		name    [0]byte
 	}
 
-	const direntAlignment = 8
-	const direntSize = 8 + 8 + 4 + 4
-
-	// Compute the number of bytes of padding we'll need to maintain alignment
-	// for the next entry.
-	var padLen int
-	if len(d.Name)%direntAlignment != 0 {
-		padLen = direntAlignment - (len(d.Name) % direntAlignment)
-	}
+	padLen := direntPadLen(d)
 
 	// Do we have enough room?
-	totalLen := direntSize + len(d.Name) + padLen
-	if totalLen > len(buf) {
+	if DirentSize(d) > len(buf) {
 		return n
 	}
 
@@ -103,3 +167,82 @@ func WriteDirent(buf []byte, d Dirent) (n int) {
 
 	return n
 }
+
+// ParseDirents decodes the entries in buf, which must be in the format written
+// by WriteDirent, e.g. the filled-in part of a fuseops.ReadDirOp's
+// destination buffer. It returns an error if the last entry is truncated.
+func ParseDirents(buf []byte) ([]Dirent, error) {
+	type fuse_dirent struct {
+		ino     uint64
+		off     uint64
+		namelen uint32
+		type_   uint32
+	}
+
+	var entries []Dirent
+	for len(buf) > 0 {
+		var de fuse_dirent
+		if len(buf) < direntSize {
+			return entries, fmt.Errorf("Truncated dirent header: %d bytes", len(buf))
+		}
+
+		copy((*[direntSize]byte)(unsafe.Pointer(&de))[:], buf)
+
+		d := Dirent{
+			Offset: fuseops.DirOffset(de.off),
+			Inode:  fuseops.InodeID(de.ino),
+			Type:   DirentType(de.type_),
+		}
+
+		end := direntSize + int(de.namelen)
+		if len(buf) < end {
+			return entries, fmt.Errorf("Truncated dirent name: %d bytes", len(buf))
+		}
+
+		d.Name = string(buf[direntSize:end])
+		entries = append(entries, d)
+
+		n := DirentSize(d)
+		if n > len(buf) {
+			n = len(buf)
+		}
+
+		buf = buf[n:]
+	}
+
+	return entries, nil
+}
+
+// The size of fuse_entry_out, which precedes each fuse_dirent in a
+// READDIRPLUS reply as part of fuse_direntplus
+// (https://github.com/torvalds/linux/blob/master/include/uapi/linux/fuse.h).
+const entryOutSize = 128
+
+// DirentPlusSize returns the number of bytes an entry with the supplied name
+// takes up in the reply to a fuseops.ReadDirPlusOp, including padding.
+func DirentPlusSize(name string) int {
+	n := entryOutSize + direntSize + len(name)
+	if n%direntAlignment != 0 {
+		n += direntAlignment - n%direntAlignment
+	}
+
+	return n
+}
+
+// AppendDirentPlus adds the supplied entry to op.Entries if it fits within
+// op.Size along with those already there, returning false otherwise. Like
+// WriteDirent returning zero, false means the read is full; the entry should
+// be returned by a later read, and not counted as a lookup.
+func AppendDirentPlus(op *fuseops.ReadDirPlusOp, e fuseops.DirentPlus) bool {
+	used := DirentPlusSize(e.Name)
+	for i := range op.Entries {
+		used += DirentPlusSize(op.Entries[i].Name)
+	}
+
+	if used > op.Size {
+		return false
+	}
+
+	op.Entries = append(op.Entries, e)
+	return true
+}
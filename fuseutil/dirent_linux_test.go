@@ -0,0 +1,27 @@
+package fuseutil
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestDirentTypesMatchSyscall(t *testing.T) {
+	cases := []struct {
+		got  DirentType
+		want int
+	}{
+		{DT_Socket, syscall.DT_SOCK},
+		{DT_Link, syscall.DT_LNK},
+		{DT_File, syscall.DT_REG},
+		{DT_Block, syscall.DT_BLK},
+		{DT_Directory, syscall.DT_DIR},
+		{DT_Char, syscall.DT_CHR},
+		{DT_FIFO, syscall.DT_FIFO},
+	}
+
+	for _, c := range cases {
+		if int(c.got) != c.want {
+			t.Errorf("got %d, want %d", c.got, c.want)
+		}
+	}
+}
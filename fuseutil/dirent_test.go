@@ -0,0 +1,134 @@
+package fuseutil
+
+import (
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestDirentTypeForMode(t *testing.T) {
+	testCases := []struct {
+		in   os.FileMode
+		want DirentType
+	}{
+		{0644, DT_File},
+		{os.ModeDir | 0755, DT_Directory},
+		{os.ModeSymlink | 0777, DT_Link},
+		{os.ModeNamedPipe, DT_FIFO},
+		{os.ModeSocket, DT_Socket},
+		{os.ModeDevice, DT_Block},
+		{os.ModeDevice | os.ModeCharDevice, DT_Char},
+		{os.ModeIrregular, DT_Unknown},
+	}
+
+	for _, tc := range testCases {
+		if got := DirentTypeForMode(tc.in); got != tc.want {
+			t.Errorf("DirentTypeForMode(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestValidateDirent(t *testing.T) {
+	testCases := []struct {
+		name string
+		want error
+	}{
+		{"foo", nil},
+		{"", syscall.EINVAL},
+		{".", syscall.EINVAL},
+		{"..", syscall.EINVAL},
+		{"foo/bar", syscall.EINVAL},
+		{"foo\x00", syscall.EINVAL},
+		{strings.Repeat("a", MaxDirentNameLen), nil},
+		{strings.Repeat("a", MaxDirentNameLen+1), syscall.ENAMETOOLONG},
+	}
+
+	for _, tc := range testCases {
+		if got := ValidateDirent(Dirent{Inode: 17, Name: tc.name}); got != tc.want {
+			t.Errorf("ValidateDirent(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDirentSize(t *testing.T) {
+	for _, name := range []string{"a", "abcdefgh", "abcdefghi"} {
+		d := Dirent{Inode: 17, Name: name}
+		size := DirentSize(d)
+		if size%8 != 0 {
+			t.Errorf("DirentSize(%q) = %d, not aligned", name, size)
+		}
+
+		buf := make([]byte, 1024)
+		if n := WriteDirent(buf, d); n != size {
+			t.Errorf("WriteDirent(%q) = %d, want %d", name, n, size)
+		}
+
+		if n := WriteDirent(buf[:size-1], d); n != 0 {
+			t.Errorf("WriteDirent(%q) into short buffer = %d", name, n)
+		}
+	}
+}
+
+func TestParseDirents(t *testing.T) {
+	in := []Dirent{
+		{Offset: 1, Inode: 17, Name: "foo", Type: DT_File},
+		{Offset: 2, Inode: 19, Name: "exactly8", Type: DT_Directory},
+	}
+
+	var buf []byte
+	for _, d := range in {
+		b := make([]byte, DirentSize(d))
+		WriteDirent(b, d)
+		buf = append(buf, b...)
+	}
+
+	out, err := ParseDirents(buf)
+	if err != nil {
+		t.Fatalf("ParseDirents: %v", err)
+	}
+
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("ParseDirents = %+v, want %+v", out, in)
+	}
+
+	if _, err := ParseDirents(buf[:len(buf)-10]); err == nil {
+		t.Errorf("Expected an error for a truncated buffer")
+	}
+}
+
+func TestDirentPlusSize(t *testing.T) {
+	want := int(unsafe.Sizeof(fusekernel.EntryOut{})) + fusekernel.DirentSize + 8
+	if runtime.GOOS == "linux" && entryOutSize != int(unsafe.Sizeof(fusekernel.EntryOut{})) {
+		t.Errorf("entryOutSize = %d, want %d", entryOutSize, unsafe.Sizeof(fusekernel.EntryOut{}))
+	}
+
+	for _, name := range []string{"a", "abcdefgh"} {
+		if got := DirentPlusSize(name); runtime.GOOS == "linux" && got != want {
+			t.Errorf("DirentPlusSize(%q) = %d, want %d", name, got, want)
+		}
+	}
+
+	if got := DirentPlusSize("abcdefghi"); got != DirentPlusSize("a")+8 {
+		t.Errorf("DirentPlusSize(9 bytes) = %d", got)
+	}
+}
+
+func TestAppendDirentPlus(t *testing.T) {
+	op := &fuseops.ReadDirPlusOp{Size: 2*DirentPlusSize("foo") + 1}
+	for i, want := range []bool{true, true, false} {
+		if got := AppendDirentPlus(op, fuseops.DirentPlus{Name: "foo"}); got != want {
+			t.Errorf("Append #%d: got %v, want %v", i, got, want)
+		}
+	}
+
+	if len(op.Entries) != 2 {
+		t.Errorf("len(Entries) = %d, want 2", len(op.Entries))
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"log"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Configuration for NewDryRunFileSystem.
+type DryRunConfig struct {
+	// Called for each mutating op before deciding its result, e.g. to apply
+	// permission or quota checks. If it returns an error the op fails with it.
+	// May be nil.
+	Check func(ctx context.Context, op interface{}) error
+
+	// The error with which mutating ops that pass Check fail. Zero means they
+	// succeed without doing anything, except as noted for CreateErrno.
+	Errno syscall.Errno
+
+	// Ops that create inodes can't succeed without creating anything, because
+	// the kernel needs an inode to refer to. If Errno is zero they fail with
+	// this instead. Defaults to EROFS.
+	CreateErrno syscall.Errno
+
+	// If set, each mutating op and its result are logged here.
+	Logger *log.Logger
+}
+
+// NewDryRunFileSystem wraps the supplied file system so that mutating ops are
+// checked and logged but not passed on, which helps with staging migrations
+// and with testing how clients behave. Ops that only read are passed through.
+//
+// SetInodeAttributes reports the inode's current, unchanged attributes when
+// it succeeds, and WriteFile and CopyFileRange report all bytes written.
+func NewDryRunFileSystem(wrapped FileSystem, cfg DryRunConfig) FileSystem {
+	if cfg.CreateErrno == 0 {
+		cfg.CreateErrno = syscall.EROFS
+	}
+
+	return &dryRunFS{
+		FileSystem: wrapped,
+		cfg:        cfg,
+	}
+}
+
+type dryRunFS struct {
+	FileSystem
+	cfg DryRunConfig
+}
+
+// Decide the result of a mutating op, logging it.
+func (fs *dryRunFS) result(
+	ctx context.Context,
+	op interface{},
+	creates bool) (err error) {
+	defer func() {
+		if fs.cfg.Logger != nil {
+			fs.cfg.Logger.Printf("dry run: %v: %v", op, errorOrOK(err))
+		}
+	}()
+
+	if fs.cfg.Check != nil {
+		if err := fs.cfg.Check(ctx, op); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case fs.cfg.Errno != 0:
+		return fs.cfg.Errno
+
+	case creates:
+		return fs.cfg.CreateErrno
+	}
+
+	return nil
+}
+
+func errorOrOK(err error) interface{} {
+	if err == nil {
+		return "OK"
+	}
+
+	return err
+}
+
+func (fs *dryRunFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := fs.result(ctx, op, false); err != nil {
+		return err
+	}
+
+	get := &fuseops.GetInodeAttributesOp{
+		Inode:     op.Inode,
+		OpContext: op.OpContext,
+	}
+
+	if err := fs.FileSystem.GetInodeAttributes(ctx, get); err != nil {
+		return err
+	}
+
+	op.Attributes = get.Attributes
+	op.AttributesExpiration = get.AttributesExpiration
+	return nil
+}
+
+func (fs *dryRunFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.result(ctx, op, true)
+}
+
+func (fs *dryRunFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.result(ctx, op, true)
+}
+
+func (fs *dryRunFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.result(ctx, op, true)
+}
+
+func (fs *dryRunFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return fs.result(ctx, op, true)
+}
+
+func (fs *dryRunFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.result(ctx, op, true)
+}
+
+func (fs *dryRunFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.result(ctx, op, false)
+}
+
+func (fs *dryRunFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.result(ctx, op, false)
+}
+
+func (fs *dryRunFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.result(ctx, op, false)
+}
+
+func (fs *dryRunFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.result(ctx, op, false)
+}
+
+func (fs *dryRunFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return fs.result(ctx, op, false)
+}
+
+func (fs *dryRunFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	err := fs.result(ctx, op, false)
+	if err == nil {
+		op.BytesCopied = op.Length
+	}
+
+	return err
+}
+
+func (fs *dryRunFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.result(ctx, op, false)
+}
+
+func (fs *dryRunFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.result(ctx, op, false)
+}
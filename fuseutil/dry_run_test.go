@@ -0,0 +1,76 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type dryRunTargetFS struct {
+	NotImplementedFileSystem
+}
+
+func (fs *dryRunTargetFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes.Size = 17
+	return nil
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+
+	var logged bytes.Buffer
+	fs := NewDryRunFileSystem(&dryRunTargetFS{}, DryRunConfig{
+		Check: func(ctx context.Context, op interface{}) error {
+			if u, ok := op.(*fuseops.UnlinkOp); ok && u.Name == "protected" {
+				return syscall.EPERM
+			}
+
+			return nil
+		},
+		Logger: log.New(&logged, "", 0),
+	})
+
+	// NotImplementedFileSystem would fail these, so success means the op
+	// didn't get through.
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 2}); err != nil {
+		t.Errorf("WriteFile: %v", err)
+	}
+
+	setattr := &fuseops.SetInodeAttributesOp{Inode: 2}
+	if err := fs.SetInodeAttributes(ctx, setattr); err != nil || setattr.Attributes.Size != 17 {
+		t.Errorf("SetInodeAttributes: %v, %+v", err, setattr.Attributes)
+	}
+
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "protected"}); err != syscall.EPERM {
+		t.Errorf("Unlink: %v, want EPERM", err)
+	}
+
+	if err := fs.MkDir(ctx, &fuseops.MkDirOp{Parent: 1, Name: "d"}); err != syscall.EROFS {
+		t.Errorf("MkDir: %v, want EROFS", err)
+	}
+
+	if n := strings.Count(logged.String(), "dry run: "); n != 4 {
+		t.Errorf("logged %d ops, want 4:\n%s", n, logged.String())
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"path"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A name within a parent directory.
+type ChildName struct {
+	Parent fuseops.InodeID
+	Name   string
+}
+
+// EntryMap is a bidirectional map between names within directories and inode
+// IDs, combined with the lookup counts the kernel holds on each inode (see the
+// notes on fuseops.ForgetInodeOp). This is the core bookkeeping of most
+// path-oriented file systems:
+//
+//   - Call LookedUp whenever replying successfully to an op that returns a
+//     ChildInodeEntry (LookUpInodeOp, MkDirOp, CreateFileOp, etc.), including
+//     for each entry of a ReadDirPlusOp other than "." and "..".
+//
+//   - Call Forget for each ForgetInodeOp and BatchForgetOp entry. Once the
+//     count reaches zero the inode and all of its names are dropped.
+//
+//   - Call Unlink and Rename as names go away and move, in the backing store
+//     or through the mount. An inode whose last name goes away remains known
+//     by ID until the kernel forgets it, since open files can outlive their
+//     names.
+//
+// An inode may have several names, as for hard links. The root inode is
+// always known and never dropped.
+//
+// Safe for concurrent access.
+type EntryMap struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	ids map[ChildName]fuseops.InodeID
+
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*entryMapInode
+}
+
+type entryMapInode struct {
+	lookupCount uint64
+	names       map[ChildName]struct{}
+}
+
+// NewEntryMap creates a map that knows only the root inode.
+func NewEntryMap() *EntryMap {
+	return &EntryMap{
+		ids: make(map[ChildName]fuseops.InodeID),
+		inodes: map[fuseops.InodeID]*entryMapInode{
+			fuseops.RootInodeID: {names: make(map[ChildName]struct{})},
+		},
+	}
+}
+
+// LookedUp records that the kernel was told that the given name within the
+// given parent refers to the given inode, incrementing the inode's lookup
+// count. Any other inode previously recorded under the name loses it.
+func (m *EntryMap) LookedUp(
+	parent fuseops.InodeID,
+	name string,
+	id fuseops.InodeID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := ChildName{parent, name}
+	m.unlinkLocked(key)
+
+	in := m.inodes[id]
+	if in == nil {
+		in = &entryMapInode{names: make(map[ChildName]struct{})}
+		m.inodes[id] = in
+	}
+
+	in.lookupCount++
+	in.names[key] = struct{}{}
+	m.ids[key] = id
+}
+
+// LookUp returns the inode recorded for the given name, if any.
+func (m *EntryMap) LookUp(
+	parent fuseops.InodeID,
+	name string) (fuseops.InodeID, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok := m.ids[ChildName{parent, name}]
+	return id, ok
+}
+
+// Names returns the names recorded for the given inode, in no particular
+// order, and whether the inode is known at all.
+func (m *EntryMap) Names(id fuseops.InodeID) ([]ChildName, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	in, ok := m.inodes[id]
+	if !ok {
+		return nil, false
+	}
+
+	names := make([]ChildName, 0, len(in.names))
+	for n := range in.names {
+		names = append(names, n)
+	}
+
+	return names, true
+}
+
+// Path returns the slash-separated absolute path of the given inode, formed
+// by following names up to the root, and whether there is one. Where an inode
+// has several names the lexically first is used, so that the result is
+// deterministic.
+func (m *EntryMap) Path(id fuseops.InodeID) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var components []string
+	for depth := 0; id != fuseops.RootInodeID; depth++ {
+		in, ok := m.inodes[id]
+		if !ok || len(in.names) == 0 || depth > 4096 {
+			return "", false
+		}
+
+		var first ChildName
+		for n := range in.names {
+			if first == (ChildName{}) ||
+				n.Parent < first.Parent ||
+				n.Parent == first.Parent && n.Name < first.Name {
+				first = n
+			}
+		}
+
+		components = append(components, first.Name)
+		id = first.Parent
+	}
+
+	p := "/"
+	for i := len(components) - 1; i >= 0; i-- {
+		p = path.Join(p, components[i])
+	}
+
+	return p, true
+}
+
+// Forget decrements the lookup count of the given inode by n, as directed by
+// the kernel. If the count reaches zero the inode and its names are removed
+// from the map and Forget returns true, telling the caller that it may release
+// any resources associated with the inode.
+func (m *EntryMap) Forget(id fuseops.InodeID, n uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	in, ok := m.inodes[id]
+	if !ok || id == fuseops.RootInodeID {
+		return false
+	}
+
+	if n < in.lookupCount {
+		in.lookupCount -= n
+		return false
+	}
+
+	for key := range in.names {
+		delete(m.ids, key)
+	}
+
+	delete(m.inodes, id)
+	return true
+}
+
+// Unlink removes the given name from the map, returning the inode it referred
+// to, if any. The inode itself stays known until forgotten.
+func (m *EntryMap) Unlink(
+	parent fuseops.InodeID,
+	name string) (fuseops.InodeID, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.unlinkLocked(ChildName{parent, name})
+}
+
+// EXCLUSIVE_LOCKS_REQUIRED(m.mu)
+func (m *EntryMap) unlinkLocked(key ChildName) (fuseops.InodeID, bool) {
+	id, ok := m.ids[key]
+	if !ok {
+		return 0, false
+	}
+
+	delete(m.ids, key)
+	delete(m.inodes[id].names, key)
+	return id, true
+}
+
+// Rename moves the inode recorded under the old name to the new one,
+// returning the inode that was moved and any inode that the new name
+// previously referred to (zero if none). Does nothing and returns false if
+// nothing is recorded under the old name.
+func (m *EntryMap) Rename(
+	oldParent fuseops.InodeID,
+	oldName string,
+	newParent fuseops.InodeID,
+	newName string) (moved, replaced fuseops.InodeID, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldKey := ChildName{oldParent, oldName}
+	newKey := ChildName{newParent, newName}
+
+	moved, ok = m.ids[oldKey]
+	if !ok || oldKey == newKey {
+		return moved, 0, ok
+	}
+
+	m.unlinkLocked(oldKey)
+	replaced, _ = m.unlinkLocked(newKey)
+
+	m.ids[newKey] = moved
+	m.inodes[moved].names[newKey] = struct{}{}
+	return moved, replaced, true
+}
+
+// Exchange swaps the inodes recorded under two names, as for a rename with
+// RenameExchange. A name with nothing recorded under it takes nothing from
+// the other.
+func (m *EntryMap) Exchange(
+	parentA fuseops.InodeID,
+	nameA string,
+	parentB fuseops.InodeID,
+	nameB string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keyA := ChildName{parentA, nameA}
+	keyB := ChildName{parentB, nameB}
+	if keyA == keyB {
+		return
+	}
+
+	idA, okA := m.unlinkLocked(keyA)
+	idB, okB := m.unlinkLocked(keyB)
+
+	if okA {
+		m.ids[keyB] = idA
+		m.inodes[idA].names[keyB] = struct{}{}
+	}
+
+	if okB {
+		m.ids[keyA] = idB
+		m.inodes[idB].names[keyA] = struct{}{}
+	}
+}
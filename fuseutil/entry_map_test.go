@@ -0,0 +1,112 @@
+package fuseutil
+
+import (
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestEntryMap(t *testing.T) {
+	m := NewEntryMap()
+	root := fuseops.InodeID(fuseops.RootInodeID)
+
+	m.LookedUp(root, "foo", 2)
+	m.LookedUp(root, "foo", 2)
+	m.LookedUp(root, "link", 2)
+
+	if id, ok := m.LookUp(root, "foo"); !ok || id != 2 {
+		t.Errorf("LookUp(foo) = %v, %v", id, ok)
+	}
+
+	if names, _ := m.Names(2); len(names) != 2 {
+		t.Errorf("Names(2) = %v", names)
+	}
+
+	// Unlinking a name leaves the inode known.
+	if id, ok := m.Unlink(root, "link"); !ok || id != 2 {
+		t.Errorf("Unlink(link) = %v, %v", id, ok)
+	}
+
+	if names, ok := m.Names(2); !ok || len(names) != 1 {
+		t.Errorf("Names(2) = %v, %v", names, ok)
+	}
+
+	// Renaming over another inode takes its name.
+	m.LookedUp(root, "bar", 3)
+	moved, replaced, ok := m.Rename(root, "foo", root, "bar")
+	if !ok || moved != 2 || replaced != 3 {
+		t.Errorf("Rename = %v, %v, %v", moved, replaced, ok)
+	}
+
+	if id, _ := m.LookUp(root, "bar"); id != 2 {
+		t.Errorf("LookUp(bar) = %v, want 2", id)
+	}
+
+	if _, ok := m.LookUp(root, "foo"); ok {
+		t.Errorf("Expected foo to be gone")
+	}
+
+	// Exchanging swaps names.
+	m.LookedUp(root, "baz", 4)
+	m.Exchange(root, "bar", root, "baz")
+	if a, _ := m.LookUp(root, "bar"); a != 4 {
+		t.Errorf("LookUp(bar) = %v, want 4", a)
+	}
+
+	if b, _ := m.LookUp(root, "baz"); b != 2 {
+		t.Errorf("LookUp(baz) = %v, want 2", b)
+	}
+
+	m.Exchange(root, "bar", root, "baz")
+
+	// The inode goes away once all lookups are forgotten.
+	if m.Forget(2, 2) {
+		t.Errorf("Forget evicted early")
+	}
+
+	if !m.Forget(2, 1) {
+		t.Errorf("Forget didn't evict")
+	}
+
+	if _, ok := m.LookUp(root, "bar"); ok {
+		t.Errorf("Expected bar to be gone")
+	}
+
+	// The root is never forgotten.
+	if m.Forget(root, 1) {
+		t.Errorf("Forget evicted the root")
+	}
+
+	if _, ok := m.Names(root); !ok {
+		t.Errorf("Expected the root to be known")
+	}
+}
+
+func TestEntryMapPath(t *testing.T) {
+	m := NewEntryMap()
+	root := fuseops.InodeID(fuseops.RootInodeID)
+
+	m.LookedUp(root, "dir", 2)
+	m.LookedUp(2, "foo", 3)
+	m.LookedUp(root, "hardlink", 3)
+
+	if p, ok := m.Path(root); !ok || p != "/" {
+		t.Errorf("Path(root) = %q, %v", p, ok)
+	}
+
+	// The name under the lower-numbered parent wins.
+	if p, ok := m.Path(3); !ok || p != "/hardlink" {
+		t.Errorf("Path(3) = %q, %v", p, ok)
+	}
+
+	m.Unlink(root, "hardlink")
+	if p, ok := m.Path(3); !ok || p != "/dir/foo" {
+		t.Errorf("Path(3) = %q, %v", p, ok)
+	}
+
+	// An inode whose last name is gone has no path.
+	m.Unlink(2, "foo")
+	if p, ok := m.Path(3); ok {
+		t.Errorf("Path(3) = %q, %v", p, ok)
+	}
+}
@@ -0,0 +1,495 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The kind of change described by an Event.
+type EventKind int
+
+const (
+	// A file, directory, symlink, device node or hard link was created.
+	EventCreated EventKind = iota
+
+	// Data was written to a file. Offset and Length give the range.
+	EventWritten
+
+	// An open file was flushed, i.e. a file descriptor for it was closed. Handy
+	// for indexers that want to wait for a writer to finish.
+	EventFlushed
+
+	// An inode's attributes were changed, e.g. by chmod(2) or truncate(2).
+	EventAttributesChanged
+
+	// A name was removed by unlink(2) or rmdir(2).
+	EventRemoved
+
+	// A name was renamed. NewParent, NewName and NewPath give the destination.
+	EventRenamed
+)
+
+// An Event describes a successful change made through an EventFileSystem.
+type Event struct {
+	Kind EventKind
+
+	// The inode affected. Zero for EventRemoved and EventRenamed, where the
+	// wrapped file system isn't asked for it.
+	Inode fuseops.InodeID
+
+	// For events concerning a name: the parent directory and the name within
+	// it. For EventRenamed these are the source.
+	Parent fuseops.InodeID
+	Name   string
+
+	// The path of the inode or name relative to the root of the file system,
+	// starting with a slash, or empty if unknown. It is derived from the names
+	// the kernel has looked up, so it is one of possibly several names for an
+	// inode with hard links.
+	Path string
+
+	// For EventRenamed.
+	NewParent fuseops.InodeID
+	NewName   string
+	NewPath   string
+
+	// For EventWritten.
+	Offset int64
+	Length int
+
+	// The caller responsible.
+	OpContext fuseops.OpContext
+}
+
+// EventFileSystem wraps a FileSystem and publishes an Event for each
+// successful change made through it, so that code in the same process, such
+// as an indexer or replicator, can react without polling the backing store.
+//
+// Events are delivered to each subscriber's channel without blocking the op;
+// if a subscriber falls behind by more than its buffer, events are dropped for
+// it and counted (see Dropped).
+type EventFileSystem struct {
+	FileSystem
+
+	// The names the kernel knows of, for computing paths.
+	entries *EntryMap
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	subscribers map[*eventSubscriber]struct{}
+}
+
+type eventSubscriber struct {
+	c chan Event
+
+	// GUARDED_BY(EventFileSystem.mu)
+	dropped uint64
+}
+
+// NewEventFileSystem wraps the supplied file system.
+func NewEventFileSystem(wrapped FileSystem) *EventFileSystem {
+	return &EventFileSystem{
+		FileSystem:  wrapped,
+		entries:     NewEntryMap(),
+		subscribers: make(map[*eventSubscriber]struct{}),
+	}
+}
+
+// Subscription is a subscriber's handle on the events being published.
+type Subscription struct {
+	fs *EventFileSystem
+	s  *eventSubscriber
+}
+
+// Subscribe starts delivering events to a new channel with the supplied
+// buffer size.
+func (fs *EventFileSystem) Subscribe(buffer int) *Subscription {
+	s := &eventSubscriber{c: make(chan Event, buffer)}
+
+	fs.mu.Lock()
+	fs.subscribers[s] = struct{}{}
+	fs.mu.Unlock()
+
+	return &Subscription{fs: fs, s: s}
+}
+
+// Events returns the channel on which events are delivered. It is closed by
+// Cancel.
+func (sub *Subscription) Events() <-chan Event {
+	return sub.s.c
+}
+
+// Dropped returns the number of events that couldn't be delivered because
+// the channel was full.
+func (sub *Subscription) Dropped() uint64 {
+	sub.fs.mu.Lock()
+	defer sub.fs.mu.Unlock()
+
+	return sub.s.dropped
+}
+
+// Cancel stops delivery and closes the channel.
+func (sub *Subscription) Cancel() {
+	sub.fs.mu.Lock()
+	defer sub.fs.mu.Unlock()
+
+	if _, ok := sub.fs.subscribers[sub.s]; ok {
+		delete(sub.fs.subscribers, sub.s)
+		close(sub.s.c)
+	}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *EventFileSystem) publish(e Event) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for s := range fs.subscribers {
+		select {
+		case s.c <- e:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// Return whether anyone is listening, to avoid computing paths for nobody.
+func (fs *EventFileSystem) listening() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return len(fs.subscribers) > 0
+}
+
+// Return a path for the inode, or empty if it can't be determined.
+func (fs *EventFileSystem) pathOf(id fuseops.InodeID) string {
+	var components []string
+	for depth := 0; id != fuseops.RootInodeID; depth++ {
+		names, _ := fs.entries.Names(id)
+		if len(names) == 0 || depth > 4096 {
+			return ""
+		}
+
+		// Be deterministic in the face of hard links.
+		sort.Slice(names, func(i, j int) bool {
+			if names[i].Parent != names[j].Parent {
+				return names[i].Parent < names[j].Parent
+			}
+
+			return names[i].Name < names[j].Name
+		})
+
+		components = append(components, names[0].Name)
+		id = names[0].Parent
+	}
+
+	p := "/"
+	for i := len(components) - 1; i >= 0; i-- {
+		p = path.Join(p, components[i])
+	}
+
+	return p
+}
+
+// Return the path of a name within a directory, or empty if it can't be
+// determined.
+func (fs *EventFileSystem) childPath(
+	parent fuseops.InodeID,
+	name string) string {
+	p := fs.pathOf(parent)
+	if p == "" {
+		return ""
+	}
+
+	return path.Join(p, name)
+}
+
+// Record a new entry and publish an event for its creation.
+func (fs *EventFileSystem) created(
+	parent fuseops.InodeID,
+	name string,
+	child fuseops.InodeID,
+	opCtx fuseops.OpContext) {
+	fs.entries.LookedUp(parent, name, child)
+	if !fs.listening() {
+		return
+	}
+
+	fs.publish(Event{
+		Kind:      EventCreated,
+		Inode:     child,
+		Parent:    parent,
+		Name:      name,
+		Path:      fs.childPath(parent, name),
+		OpContext: opCtx,
+	})
+}
+
+func (fs *EventFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.entries.LookedUp(op.Parent, op.Name, op.Entry.Child)
+	return nil
+}
+
+func (fs *EventFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if err := fs.FileSystem.ReadDirPlus(ctx, op); err != nil {
+		return err
+	}
+
+	for _, e := range op.Entries {
+		if e.Name != "." && e.Name != ".." {
+			fs.entries.LookedUp(op.Inode, e.Name, e.Entry.Child)
+		}
+	}
+
+	return nil
+}
+
+func (fs *EventFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.entries.Forget(op.Inode, op.N)
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *EventFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.entries.Forget(e.Inode, e.N)
+	}
+
+	return fs.FileSystem.BatchForget(ctx, op)
+}
+
+func (fs *EventFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := fs.FileSystem.SetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	if fs.listening() {
+		fs.publish(Event{
+			Kind:      EventAttributesChanged,
+			Inode:     op.Inode,
+			Path:      fs.pathOf(op.Inode),
+			OpContext: op.OpContext,
+		})
+	}
+
+	return nil
+}
+
+func (fs *EventFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if err := fs.FileSystem.MkDir(ctx, op); err != nil {
+		return err
+	}
+
+	fs.created(op.Parent, op.Name, op.Entry.Child, op.OpContext)
+	return nil
+}
+
+func (fs *EventFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	if err := fs.FileSystem.MkNode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.created(op.Parent, op.Name, op.Entry.Child, op.OpContext)
+	return nil
+}
+
+func (fs *EventFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.created(op.Parent, op.Name, op.Entry.Child, op.OpContext)
+	return nil
+}
+
+func (fs *EventFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if err := fs.FileSystem.CreateLink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.created(op.Parent, op.Name, op.Entry.Child, op.OpContext)
+	return nil
+}
+
+func (fs *EventFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if err := fs.FileSystem.CreateSymlink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.created(op.Parent, op.Name, op.Entry.Child, op.OpContext)
+	return nil
+}
+
+func (fs *EventFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	if err := fs.FileSystem.Rename(ctx, op); err != nil {
+		return err
+	}
+
+	// Compute the source path before the entry moves.
+	var oldPath string
+	listening := fs.listening()
+	if listening {
+		oldPath = fs.childPath(op.OldParent, op.OldName)
+	}
+
+	fs.entries.Rename(op.OldParent, op.OldName, op.NewParent, op.NewName)
+	if listening {
+		fs.publish(Event{
+			Kind:      EventRenamed,
+			Parent:    op.OldParent,
+			Name:      op.OldName,
+			Path:      oldPath,
+			NewParent: op.NewParent,
+			NewName:   op.NewName,
+			NewPath:   fs.childPath(op.NewParent, op.NewName),
+			OpContext: op.OpContext,
+		})
+	}
+
+	return nil
+}
+
+// Publish an event for a removed name and forget it.
+func (fs *EventFileSystem) removed(
+	parent fuseops.InodeID,
+	name string,
+	opCtx fuseops.OpContext) {
+	if fs.listening() {
+		fs.publish(Event{
+			Kind:      EventRemoved,
+			Parent:    parent,
+			Name:      name,
+			Path:      fs.childPath(parent, name),
+			OpContext: opCtx,
+		})
+	}
+
+	fs.entries.Unlink(parent, name)
+}
+
+func (fs *EventFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if err := fs.FileSystem.RmDir(ctx, op); err != nil {
+		return err
+	}
+
+	fs.removed(op.Parent, op.Name, op.OpContext)
+	return nil
+}
+
+func (fs *EventFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := fs.FileSystem.Unlink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.removed(op.Parent, op.Name, op.OpContext)
+	return nil
+}
+
+func (fs *EventFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if err := fs.FileSystem.WriteFile(ctx, op); err != nil {
+		return err
+	}
+
+	if fs.listening() {
+		fs.publish(Event{
+			Kind:      EventWritten,
+			Inode:     op.Inode,
+			Path:      fs.pathOf(op.Inode),
+			Offset:    op.Offset,
+			Length:    len(op.Data),
+			OpContext: op.OpContext,
+		})
+	}
+
+	return nil
+}
+
+func (fs *EventFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	if err := fs.FileSystem.CopyFileRange(ctx, op); err != nil {
+		return err
+	}
+
+	if fs.listening() {
+		fs.publish(Event{
+			Kind:      EventWritten,
+			Inode:     op.DstInode,
+			Path:      fs.pathOf(op.DstInode),
+			Offset:    int64(op.DstOffset),
+			Length:    int(op.BytesCopied),
+			OpContext: op.OpContext,
+		})
+	}
+
+	return nil
+}
+
+func (fs *EventFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	if err := fs.FileSystem.FlushFile(ctx, op); err != nil {
+		return err
+	}
+
+	if fs.listening() {
+		fs.publish(Event{
+			Kind:      EventFlushed,
+			Inode:     op.Inode,
+			Path:      fs.pathOf(op.Inode),
+			OpContext: op.OpContext,
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type eventTargetFS struct {
+	NotImplementedFileSystem
+}
+
+func (fs *eventTargetFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	op.Entry.Child = 10
+	return nil
+}
+
+func (fs *eventTargetFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	op.Entry.Child = 11
+	return nil
+}
+
+func (fs *eventTargetFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return nil
+}
+
+func (fs *eventTargetFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return nil
+}
+
+func (fs *eventTargetFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return nil
+}
+
+func TestEventFileSystem(t *testing.T) {
+	ctx := context.Background()
+	fs := NewEventFileSystem(&eventTargetFS{})
+	sub := fs.Subscribe(10)
+
+	fs.MkDir(ctx, &fuseops.MkDirOp{Parent: 1, Name: "dir"})
+	fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: 10, Name: "f"})
+	fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 11, Offset: 3, Data: []byte("abc")})
+	fs.Rename(ctx, &fuseops.RenameOp{OldParent: 10, OldName: "f", NewParent: 1, NewName: "g"})
+	fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 11, Data: []byte("x")})
+	fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "g"})
+	sub.Cancel()
+
+	var got []string
+	for e := range sub.Events() {
+		got = append(got, fmt.Sprintf("%d %d %s %s %d+%d", e.Kind, e.Inode, e.Path, e.NewPath, e.Offset, e.Length))
+	}
+
+	want := []string{
+		"0 10 /dir  0+0",
+		"0 11 /dir/f  0+0",
+		"1 11 /dir/f  3+3",
+		"5 0 /dir/f /g 0+0",
+		"1 11 /g  0+1",
+		"4 0 /g  0+0",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestEventFileSystemDropsWhenFull(t *testing.T) {
+	fs := NewEventFileSystem(&eventTargetFS{})
+	sub := fs.Subscribe(1)
+
+	for i := 0; i < 3; i++ {
+		fs.WriteFile(context.Background(), &fuseops.WriteFileOp{Inode: 11})
+	}
+
+	if n := sub.Dropped(); n != 2 {
+		t.Errorf("Dropped() = %d, want 2", n)
+	}
+}
@@ -0,0 +1,172 @@
+package examples_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/spf13/afero"
+)
+
+////////////////////////////////////////////////////////////////////////
+// afero
+////////////////////////////////////////////////////////////////////////
+
+// aferoFS adapts an afero.Fs to fuseutil.WritableFS. Mkdir, Remove, Rename,
+// Chmod and Chtimes come from the embedded afero.Fs.
+type aferoFS struct{ afero.Fs }
+
+func (fs aferoFS) OpenFile(name string, flag int, perm os.FileMode) (fuseutil.WritableFile, error) {
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+// afero.Fs.Stat follows symlinks, so use LstatIfPossible where the Fs has it
+// (as afero.OsFs and afero.BasePathFs do).
+func (fs aferoFS) Stat(name string) (os.FileInfo, error) {
+	if l, ok := fs.Fs.(afero.Lstater); ok {
+		fi, _, err := l.LstatIfPossible(name)
+		return fi, err
+	}
+
+	return fs.Fs.Stat(name)
+}
+
+func (fs aferoFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return afero.ReadDir(fs.Fs, name)
+}
+
+func (fs aferoFS) Symlink(target, link string) error {
+	// afero.BasePathFs rebases the target as well as the link, so that even a
+	// relative target would become a path on the host. Assuming it wraps
+	// afero.OsFs, create the link with the target as given.
+	if b, ok := fs.Fs.(*afero.BasePathFs); ok {
+		p, err := b.RealPath(link)
+		if err != nil {
+			return err
+		}
+
+		return os.Symlink(target, p)
+	}
+
+	l, ok := fs.Fs.(afero.Linker)
+	if !ok {
+		return syscall.ENOSYS
+	}
+
+	return l.SymlinkIfPossible(target, link)
+}
+
+func (fs aferoFS) Readlink(link string) (string, error) {
+	r, ok := fs.Fs.(afero.LinkReader)
+	if !ok {
+		return "", syscall.EINVAL
+	}
+
+	return r.ReadlinkIfPossible(link)
+}
+
+// Serve a directory on disk read-write at /mnt/data through afero.
+func Example_afero() {
+	fsys := aferoFS{afero.NewBasePathFs(afero.NewOsFs(), "/srv/data")}
+	server := fuseutil.NewFileSystemServer(fuseutil.NewWritableFSFileSystem(fsys))
+
+	mfs, err := fuse.Mount("/mnt/data", server, &fuse.MountConfig{})
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	if err := mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// go-billy
+////////////////////////////////////////////////////////////////////////
+
+// billyFS adapts a billy.Filesystem to fuseutil.WritableFS. ReadDir, Remove,
+// Rename, Symlink and Readlink come from the embedded billy.Filesystem.
+type billyFS struct{ billy.Filesystem }
+
+func (fs billyFS) OpenFile(name string, flag int, perm os.FileMode) (fuseutil.WritableFile, error) {
+	f, err := fs.Filesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &billyFile{File: f}, nil
+}
+
+// billy.Filesystem.Stat follows symlinks.
+func (fs billyFS) Stat(name string) (os.FileInfo, error) {
+	return fs.Filesystem.Lstat(name)
+}
+
+// billy has only MkdirAll, which succeeds if the directory already exists.
+func (fs billyFS) Mkdir(name string, perm os.FileMode) error {
+	if _, err := fs.Filesystem.Lstat(name); err == nil {
+		return os.ErrExist
+	}
+
+	return fs.Filesystem.MkdirAll(name, perm)
+}
+
+func (fs billyFS) Chmod(name string, mode os.FileMode) error {
+	c, ok := fs.Filesystem.(billy.Change)
+	if !ok {
+		return syscall.ENOSYS
+	}
+
+	return c.Chmod(name, mode)
+}
+
+func (fs billyFS) Chtimes(name string, atime, mtime time.Time) error {
+	c, ok := fs.Filesystem.(billy.Change)
+	if !ok {
+		return syscall.ENOSYS
+	}
+
+	return c.Chtimes(name, atime, mtime)
+}
+
+// billyFile adds the WriteAt that billy.File lacks, by seeking and then
+// writing. ReadAt doesn't use the file offset, so only writes need the mutex
+// (billy.File's own Lock is an flock(2)-style lock, not a mutex).
+type billyFile struct {
+	mu sync.Mutex
+	billy.File
+}
+
+func (f *billyFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.File.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return f.File.Write(p)
+}
+
+// Serve a directory on disk read-write at /mnt/data through go-billy.
+func Example_billy() {
+	fsys := billyFS{osfs.New("/srv/data")}
+	server := fuseutil.NewFileSystemServer(fuseutil.NewWritableFSFileSystem(fsys))
+
+	mfs, err := fuse.Mount("/mnt/data", server, &fuse.MountConfig{})
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	if err := mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+module github.com/jacobsa/fuse/fuseutil/examples
+
+go 1.20
+
+replace github.com/jacobsa/fuse => ../../
+
+require (
+	github.com/go-git/go-billy/v5 v5.5.0
+	github.com/jacobsa/fuse v0.0.0
+	github.com/spf13/afero v1.11.0
+)
+
+require (
+	github.com/cyphar/filepath-securejoin v0.2.4 // indirect
+	github.com/jacobsa/oglematchers v0.0.0-20150720000706-141901ea67cd // indirect
+	github.com/jacobsa/timeutil v0.0.0-20170205232429-577e5acbbcf6 // indirect
+	github.com/winfsp/cgofuse v1.6.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
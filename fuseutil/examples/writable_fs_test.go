@@ -0,0 +1,115 @@
+package examples_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/spf13/afero"
+)
+
+// Exercise the shims in the examples through the file system they back.
+func TestShims(t *testing.T) {
+	testCases := []struct {
+		name     string
+		fsys     func(dir string) fuseutil.WritableFS
+		symlinks bool
+	}{
+		{
+			name: "afero OsFs",
+			fsys: func(dir string) fuseutil.WritableFS {
+				return aferoFS{afero.NewBasePathFs(afero.NewOsFs(), dir)}
+			},
+			symlinks: true,
+		},
+		{
+			name: "afero MemMapFs",
+			fsys: func(string) fuseutil.WritableFS {
+				return aferoFS{afero.NewMemMapFs()}
+			},
+		},
+		{
+			name: "billy osfs",
+			fsys: func(dir string) fuseutil.WritableFS {
+				return billyFS{osfs.New(dir)}
+			},
+			symlinks: true,
+		},
+		{
+			name: "billy memfs",
+			fsys: func(string) fuseutil.WritableFS {
+				return billyFS{memfs.New()}
+			},
+			symlinks: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			fs := fuseutil.NewWritableFSFileSystem(tc.fsys(t.TempDir()))
+
+			mkDir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir", Mode: 0755}
+			if err := fs.MkDir(ctx, mkDir); err != nil {
+				t.Fatalf("MkDir: %v", err)
+			}
+
+			err := fs.MkDir(ctx, &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir", Mode: 0755})
+			if !errors.Is(err, fuse.EEXIST) {
+				t.Errorf("MkDir of existing directory: %v, want EEXIST", err)
+			}
+
+			// Write out of order, so that the writes must honour their offsets.
+			create := &fuseops.CreateFileOp{Parent: mkDir.Entry.Child, Name: "a", Mode: 0644}
+			if err := fs.CreateFile(ctx, create); err != nil {
+				t.Fatalf("CreateFile: %v", err)
+			}
+
+			for _, w := range []struct {
+				off  int64
+				data string
+			}{{2, "taco"}, {0, "ab"}} {
+				write := &fuseops.WriteFileOp{Handle: create.Handle, Offset: w.off, Data: []byte(w.data)}
+				if err := fs.WriteFile(ctx, write); err != nil {
+					t.Fatalf("WriteFile: %v", err)
+				}
+			}
+
+			read := &fuseops.ReadFileOp{Handle: create.Handle, Offset: 1, Dst: make([]byte, 10)}
+			if err := fs.ReadFile(ctx, read); err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+
+			if got, want := string(read.Dst[:read.BytesRead]), "btaco"; got != want {
+				t.Errorf("ReadFile = %q, want %q", got, want)
+			}
+
+			fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: create.Handle})
+
+			if !tc.symlinks {
+				return
+			}
+
+			// A symlink must be reported as one, not as its target.
+			symlink := &fuseops.CreateSymlinkOp{Parent: fuseops.RootInodeID, Name: "l", Target: "dir"}
+			if err := fs.CreateSymlink(ctx, symlink); err != nil {
+				t.Fatalf("CreateSymlink: %v", err)
+			}
+
+			if mode := symlink.Entry.Attributes.Mode; mode&os.ModeSymlink == 0 {
+				t.Errorf("symlink has mode %v", mode)
+			}
+
+			readlink := &fuseops.ReadSymlinkOp{Inode: symlink.Entry.Child}
+			if err := fs.ReadSymlink(ctx, readlink); err != nil || readlink.Target != "dir" {
+				t.Errorf("ReadSymlink: %q, %v", readlink.Target, err)
+			}
+		})
+	}
+}
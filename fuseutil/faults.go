@@ -0,0 +1,178 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A Fault describes how a FaultInjectingFileSystem disturbs ops of a
+// particular type. The zero value passes ops through untouched.
+type Fault struct {
+	// If non-nil, the error with which the op fails, without reaching the
+	// wrapped file system. Typically a syscall.Errno such as EIO.
+	Err error
+
+	// How long to delay the op before passing it on or failing it. If the op's
+	// context is cancelled while waiting, e.g. because the kernel interrupted
+	// it, the op fails with EINTR.
+	Latency time.Duration
+
+	// For ReadFileOp and WriteFileOp, if positive: the most bytes to transfer.
+	// Reads that return more are cut short once the wrapped file system is
+	// done, and writes of more have their data truncated before being passed
+	// on, so that the kernel is told only that many bytes were written.
+	ShortBytes int
+
+	// The probability, between zero and one, that the fault applies to any
+	// given op. Zero means always.
+	Probability float64
+
+	// If positive, the number of ops to which the fault applies before it is
+	// removed.
+	Count int
+}
+
+// FaultInjectingFileSystem wraps a file system, injecting configurable
+// errors, latency and short reads and writes into ops according to their type.
+// Faults may be changed at any time, including while the file system is
+// mounted, which makes it handy for testing how applications cope with a
+// misbehaving file system.
+//
+// ForgetInode, BatchForget and Destroy are never disturbed, since the kernel
+// expects no reply to them.
+type FaultInjectingFileSystem struct {
+	FileSystem
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	faults map[reflect.Type]*Fault
+}
+
+// NewFaultInjectingFileSystem wraps the supplied file system, initially
+// without any faults.
+func NewFaultInjectingFileSystem(wrapped FileSystem) *FaultInjectingFileSystem {
+	fs := &FaultInjectingFileSystem{
+		faults: make(map[reflect.Type]*Fault),
+	}
+
+	fs.FileSystem = NewInterceptingFileSystem(wrapped, fs.inject)
+	return fs
+}
+
+// SetFault arranges for future ops of the same type as op, e.g.
+// &fuseops.ReadFileOp{}, to be disturbed as described by f, replacing any
+// fault previously set for that type.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *FaultInjectingFileSystem) SetFault(op interface{}, f Fault) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.faults[reflect.TypeOf(op)] = &f
+}
+
+// ClearFault removes any fault set for ops of the same type as op.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *FaultInjectingFileSystem) ClearFault(op interface{}) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.faults, reflect.TypeOf(op))
+}
+
+// ClearFaults removes all faults.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *FaultInjectingFileSystem) ClearFaults() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.faults = make(map[reflect.Type]*Fault)
+}
+
+// Return the fault to apply to the supplied op, if any, using up one of its
+// applications.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *FaultInjectingFileSystem) take(op interface{}) (Fault, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	t := reflect.TypeOf(op)
+	f := fs.faults[t]
+	if f == nil {
+		return Fault{}, false
+	}
+
+	if f.Probability > 0 && rand.Float64() >= f.Probability {
+		return Fault{}, false
+	}
+
+	if f.Count > 0 {
+		f.Count--
+		if f.Count == 0 {
+			delete(fs.faults, t)
+		}
+	}
+
+	return *f, true
+}
+
+// An Interceptor applying any fault set for the supplied op.
+func (fs *FaultInjectingFileSystem) inject(
+	ctx context.Context,
+	op interface{},
+	next func(ctx context.Context) error) error {
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
+		return next(ctx)
+	}
+
+	f, ok := fs.take(op)
+	if !ok {
+		return next(ctx)
+	}
+
+	if err := sleepContext(ctx, f.Latency); err != nil {
+		return err
+	}
+
+	if f.Err != nil {
+		return f.Err
+	}
+
+	if w, ok := op.(*fuseops.WriteFileOp); ok && f.ShortBytes > 0 && len(w.Data) > f.ShortBytes {
+		w.Data = w.Data[:f.ShortBytes]
+	}
+
+	if err := next(ctx); err != nil {
+		return err
+	}
+
+	if r, ok := op.(*fuseops.ReadFileOp); ok && f.ShortBytes > 0 && r.BytesRead > f.ShortBytes {
+		r.BytesRead = f.ShortBytes
+	}
+
+	return nil
+}
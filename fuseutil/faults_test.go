@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A file system whose files all contain the same bytes.
+type faultTargetFS struct {
+	NotImplementedFileSystem
+	written []byte
+}
+
+func (fs *faultTargetFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	op.BytesRead = copy(op.Dst, "tacoburrito")
+	return nil
+}
+
+func (fs *faultTargetFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.written = append(fs.written, op.Data...)
+	return nil
+}
+
+func TestFaultInjection(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &faultTargetFS{}
+	fs := NewFaultInjectingFileSystem(wrapped)
+
+	read := func() (string, error) {
+		op := &fuseops.ReadFileOp{Dst: make([]byte, 64)}
+		err := fs.ReadFile(ctx, op)
+		return string(op.Dst[:op.BytesRead]), err
+	}
+
+	// Without faults, ops pass through.
+	if s, err := read(); err != nil || s != "tacoburrito" {
+		t.Errorf("ReadFile: %q, %v", s, err)
+	}
+
+	// Errors, for a limited number of ops.
+	fs.SetFault(&fuseops.ReadFileOp{}, Fault{Err: syscall.EIO, Count: 2})
+	for i := 0; i < 2; i++ {
+		if _, err := read(); err != syscall.EIO {
+			t.Errorf("ReadFile %d: got %v, want EIO", i, err)
+		}
+	}
+
+	if _, err := read(); err != nil {
+		t.Errorf("ReadFile after count: %v", err)
+	}
+
+	// Short reads and writes.
+	fs.SetFault(&fuseops.ReadFileOp{}, Fault{ShortBytes: 4})
+	fs.SetFault(&fuseops.WriteFileOp{}, Fault{ShortBytes: 3})
+
+	if s, err := read(); err != nil || s != "taco" {
+		t.Errorf("Short ReadFile: %q, %v", s, err)
+	}
+
+	write := &fuseops.WriteFileOp{Data: []byte("enchilada")}
+	if err := fs.WriteFile(ctx, write); err != nil || string(write.Data) != "enc" || string(wrapped.written) != "enc" {
+		t.Errorf("Short WriteFile: %q, %q, %v", write.Data, wrapped.written, err)
+	}
+
+	// Latency, cut short by cancellation.
+	fs.ClearFaults()
+	fs.SetFault(&fuseops.ReadFileOp{}, Fault{Latency: time.Hour})
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := fs.ReadFile(cancelled, &fuseops.ReadFileOp{}); err != syscall.EINTR {
+		t.Errorf("Delayed ReadFile: got %v, want EINTR", err)
+	}
+
+	fs.ClearFault(&fuseops.ReadFileOp{})
+	if _, err := read(); err != nil {
+		t.Errorf("ReadFile after clearing: %v", err)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
@@ -38,6 +39,7 @@ type FileSystem interface {
 	LookUpInode(context.Context, *fuseops.LookUpInodeOp) error
 	GetInodeAttributes(context.Context, *fuseops.GetInodeAttributesOp) error
 	SetInodeAttributes(context.Context, *fuseops.SetInodeAttributesOp) error
+	Access(context.Context, *fuseops.AccessOp) error
 	ForgetInode(context.Context, *fuseops.ForgetInodeOp) error
 	BatchForget(context.Context, *fuseops.BatchForgetOp) error
 	MkDir(context.Context, *fuseops.MkDirOp) error
@@ -50,6 +52,7 @@ type FileSystem interface {
 	Unlink(context.Context, *fuseops.UnlinkOp) error
 	OpenDir(context.Context, *fuseops.OpenDirOp) error
 	ReadDir(context.Context, *fuseops.ReadDirOp) error
+	ReadDirPlus(context.Context, *fuseops.ReadDirPlusOp) error
 	ReleaseDirHandle(context.Context, *fuseops.ReleaseDirHandleOp) error
 	OpenFile(context.Context, *fuseops.OpenFileOp) error
 	ReadFile(context.Context, *fuseops.ReadFileOp) error
@@ -57,16 +60,27 @@ type FileSystem interface {
 	SyncFile(context.Context, *fuseops.SyncFileOp) error
 	FlushFile(context.Context, *fuseops.FlushFileOp) error
 	ReleaseFileHandle(context.Context, *fuseops.ReleaseFileHandleOp) error
+	GetLk(context.Context, *fuseops.GetLkOp) error
+	SetLk(context.Context, *fuseops.SetLkOp) error
+	SetLkW(context.Context, *fuseops.SetLkWOp) error
 	ReadSymlink(context.Context, *fuseops.ReadSymlinkOp) error
 	RemoveXattr(context.Context, *fuseops.RemoveXattrOp) error
 	GetXattr(context.Context, *fuseops.GetXattrOp) error
 	ListXattr(context.Context, *fuseops.ListXattrOp) error
 	SetXattr(context.Context, *fuseops.SetXattrOp) error
 	Fallocate(context.Context, *fuseops.FallocateOp) error
+	CopyFileRange(context.Context, *fuseops.CopyFileRangeOp) error
+	LSeek(context.Context, *fuseops.LSeekOp) error
+	Ioctl(context.Context, *fuseops.IoctlOp) error
+	Poll(context.Context, *fuseops.PollOp) error
 
 	// Regard all inodes (including the root inode) as having their lookup counts
 	// decremented to zero, and clean up any resources associated with the file
 	// system. No further calls to the file system will be made.
+	//
+	// Destroy is called exactly once: either when the kernel sends
+	// fuseops.DestroyOp, after all other in-flight ops have returned, or when
+	// the connection is closed if the kernel doesn't.
 	Destroy()
 }
 
@@ -74,9 +88,9 @@ type FileSystem interface {
 // method.Respond with the resulting error. Unsupported ops are responded to
 // directly with ENOSYS.
 //
-// Each call to a FileSystem method (except ForgetInode) is made on
-// its own goroutine, and is free to block. ForgetInode may be called
-// synchronously, and should not depend on calls to other methods
+// Each call to a FileSystem method (except ForgetInode and BatchForget) is made
+// on its own goroutine, and is free to block. ForgetInode and BatchForget may
+// be called synchronously, and should not depend on calls to other methods
 // being received concurrently.
 //
 // (It is safe to naively process ops concurrently because the kernel
@@ -84,14 +98,106 @@ type FileSystem interface {
 // cf. http://goo.gl/jnkHPO, fuse-devel thread "Fuse guarantees on concurrent
 // requests").
 func NewFileSystemServer(fs FileSystem) fuse.Server {
+	return NewFileSystemServerWithConfig(fs, ServerConfig{})
+}
+
+// NewSerialFileSystemServer is like NewFileSystemServer, except that ops are
+// processed strictly one at a time, in the order in which they are received
+// from the kernel. Each FileSystem method is called on the goroutine that
+// called ServeOps, and the next op is not read until the previous one has been
+// replied to.
+//
+// This trades throughput for determinism, and is useful for simple file
+// systems that don't want to bother with locking and for debugging races.
+// Beware that because no ops are read while a method is running, interrupt
+// requests for that op are not observed until it returns, so its context will
+// not be cancelled while it blocks.
+func NewSerialFileSystemServer(fs FileSystem) fuse.Server {
 	return &fileSystemServer{
-		fs: fs,
+		fs:     fs,
+		serial: true,
 	}
 }
 
+// ServerConfig contains options for NewFileSystemServerWithConfig.
+type ServerConfig struct {
+	// The maximum number of FileSystem methods called concurrently. When that
+	// many are running, no further ops are read from the kernel until one
+	// returns, which bounds the goroutines and memory used by a burst of ops
+	// against a slow backend. Zero means no limit, as for NewFileSystemServer.
+	//
+	// ForgetInode and BatchForget are called synchronously, as for
+	// NewFileSystemServer, and don't count towards the limit. Because ops
+	// aren't read while the limit is reached, neither are interrupt requests,
+	// so set it high enough that every worker being blocked is unlikely.
+	Parallelism int
+
+	// If set, called with the connection when serving begins, before any op
+	// is passed to the file system, so that the file system can adapt to what
+	// was negotiated with the kernel (cf. fuse.Connection.Features and
+	// Protocol).
+	OnServe func(c *fuse.Connection)
+
+	// If non-zero, how long a FileSystem method may run before its op is
+	// considered stuck, at which point it is logged to Logger, passed to
+	// OnHang, and replied to if ReplyOnTimeout is set. This happens once per
+	// op; the method itself is left running.
+	OpTimeout time.Duration
+
+	// If set, ops that exceed OpTimeout are replied to with EIO without waiting
+	// for their method, so that a single stuck handler doesn't hang the
+	// process that caused it. The op's context is cancelled, and the method's
+	// eventual result is dropped. Forgets, which get no reply, are exempt.
+	//
+	// The op's buffers are kept until the method returns, but the reply may
+	// race with the method changing the op, so methods that keep running past
+	// the timeout should leave the op alone once their context is done.
+	ReplyOnTimeout bool
+
+	// If set, called on its own goroutine with each op that exceeds OpTimeout
+	// and how long it has been running, e.g. to dump goroutine stacks or
+	// record a trace. Ops replied to because of ReplyOnTimeout are replied to
+	// after it returns.
+	OnHang func(ctx context.Context, op interface{}, running time.Duration)
+
+	// If set, ops that exceed OpTimeout are logged here, as errors in category
+	// fuse.LogOp. Typically the same logger as fuse.MountConfig.Logger.
+	Logger fuse.Logger
+}
+
+// NewFileSystemServerWithConfig is like NewFileSystemServer, with the supplied
+// options.
+func NewFileSystemServerWithConfig(fs FileSystem, cfg ServerConfig) fuse.Server {
+	s := &fileSystemServer{
+		fs:      fs,
+		cfg:     cfg,
+		onServe: cfg.OnServe,
+	}
+
+	if cfg.Parallelism > 0 {
+		s.workers = make(chan struct{}, cfg.Parallelism)
+	}
+
+	return s
+}
+
 type fileSystemServer struct {
 	fs          FileSystem
+	serial      bool
 	opsInFlight sync.WaitGroup
+
+	// If non-nil, a semaphore limiting the number of concurrent calls to fs.
+	workers chan struct{}
+
+	// The writes in flight to each handle, which releasing it waits for.
+	writes handleWrites
+
+	// The options the server was created with, if any.
+	cfg ServerConfig
+
+	destroyOnce sync.Once
+
+	onServe func(*fuse.Connection)
 }
 
 func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
@@ -99,9 +205,13 @@ func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
 	// destroying the file system.
 	defer func() {
 		s.opsInFlight.Wait()
-		s.fs.Destroy()
+		s.destroy()
 	}()
 
+	if s.onServe != nil {
+		s.onServe(c)
+	}
+
 	for {
 		ctx, op, err := c.ReadOp()
 		if err == io.EOF {
@@ -112,25 +222,74 @@ func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
 			panic(err)
 		}
 
+		// The kernel sends destroy as the last op on the connection, and waits
+		// for our reply before closing it. Make sure everything else is done
+		// first, so that Destroy really is the last call to the file system.
+		if _, ok := op.(*fuseops.DestroyOp); ok {
+			s.opsInFlight.Wait()
+			s.destroy()
+			c.Reply(ctx, nil)
+			continue
+		}
+
 		s.opsInFlight.Add(1)
-		if _, ok := op.(*fuseops.ForgetInodeOp); ok {
+		if h, ok := writesToHandle(op); ok {
+			s.writes.start(h)
+		}
+
+		if s.serial {
+			s.handleOp(c, ctx, op)
+			continue
+		}
+
+		switch op.(type) {
+		case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
 			// Special case: call in this goroutine for
 			// forget inode ops, which may come in a
 			// flurry from the kernel and are generally
 			// cheap for the file system to handle
 			s.handleOp(c, ctx, op)
-		} else {
-			go s.handleOp(c, ctx, op)
+
+		default:
+			if s.workers == nil {
+				go s.handleOp(c, ctx, op)
+				break
+			}
+
+			s.workers <- struct{}{}
+			go func() {
+				defer func() { <-s.workers }()
+				s.handleOp(c, ctx, op)
+			}()
 		}
 	}
 }
 
+// Call s.fs.Destroy, unless that has already been done.
+func (s *fileSystemServer) destroy() {
+	s.destroyOnce.Do(s.fs.Destroy)
+}
+
 func (s *fileSystemServer) handleOp(
 	c *fuse.Connection,
 	ctx context.Context,
 	op interface{}) {
 	defer s.opsInFlight.Done()
 
+	// Don't leave a hung mount behind if the file system panics.
+	defer func() {
+		if r := recover(); r != nil {
+			c.Abort()
+			panic(r)
+		}
+	}()
+
+	// Keep an eye on stuck methods, if asked to.
+	var w *opWatch
+	if s.cfg.OpTimeout > 0 {
+		w = s.watch(c, ctx, op)
+	}
+
 	// Dispatch to the appropriate method.
 	var err error
 	switch typed := op.(type) {
@@ -149,6 +308,9 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.SetInodeAttributesOp:
 		err = s.fs.SetInodeAttributes(ctx, typed)
 
+	case *fuseops.AccessOp:
+		err = s.fs.Access(ctx, typed)
+
 	case *fuseops.ForgetInodeOp:
 		err = s.fs.ForgetInode(ctx, typed)
 
@@ -198,6 +360,9 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.ReadDirOp:
 		err = s.fs.ReadDir(ctx, typed)
 
+	case *fuseops.ReadDirPlusOp:
+		err = s.fs.ReadDirPlus(ctx, typed)
+
 	case *fuseops.ReleaseDirHandleOp:
 		err = s.fs.ReleaseDirHandle(ctx, typed)
 
@@ -217,8 +382,20 @@ func (s *fileSystemServer) handleOp(
 		err = s.fs.FlushFile(ctx, typed)
 
 	case *fuseops.ReleaseFileHandleOp:
+		// Don't let the release overtake the writes before it, e.g. from the
+		// writeback of a mapping, whose methods may still be running.
+		s.writes.wait(typed.Handle)
 		err = s.fs.ReleaseFileHandle(ctx, typed)
 
+	case *fuseops.GetLkOp:
+		err = s.fs.GetLk(ctx, typed)
+
+	case *fuseops.SetLkOp:
+		err = s.fs.SetLk(ctx, typed)
+
+	case *fuseops.SetLkWOp:
+		err = s.fs.SetLkW(ctx, typed)
+
 	case *fuseops.ReadSymlinkOp:
 		err = s.fs.ReadSymlink(ctx, typed)
 
@@ -236,6 +413,26 @@ func (s *fileSystemServer) handleOp(
 
 	case *fuseops.FallocateOp:
 		err = s.fs.Fallocate(ctx, typed)
+
+	case *fuseops.CopyFileRangeOp:
+		err = s.fs.CopyFileRange(ctx, typed)
+
+	case *fuseops.LSeekOp:
+		err = s.fs.LSeek(ctx, typed)
+
+	case *fuseops.IoctlOp:
+		err = s.fs.Ioctl(ctx, typed)
+
+	case *fuseops.PollOp:
+		err = s.fs.Poll(ctx, typed)
+	}
+
+	if h, ok := writesToHandle(op); ok {
+		s.writes.finish(h)
+	}
+
+	if w != nil && !w.finish() {
+		return
 	}
 
 	c.Reply(ctx, err)
@@ -0,0 +1,238 @@
+package fuseutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A raw kernel request for the given inode.
+func rawRequest(unique uint64, opcode uint32, inode fuseops.InodeID, payload interface{}) []byte {
+	h := fusekernel.InHeader{
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: uint64(inode),
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	if payload != nil {
+		if err := binary.Write(&buf, binary.LittleEndian, payload); err != nil {
+			panic(err)
+		}
+	}
+
+	b := buf.Bytes()
+	(*fusekernel.InHeader)(unsafe.Pointer(&b[0])).Len = uint32(len(b))
+	return b
+}
+
+// A recording that initializes the connection, then sends a getattr for each
+// of the supplied inodes, with a forget after the first two, and finally
+// destroys the file system. Every getattr is interrupted before the destroy,
+// so that fuse.Replay sends them all without awaiting their replies.
+func getattrRecording(inodes ...fuseops.InodeID) []byte {
+	msgs := [][]byte{
+		rawRequest(1, fusekernel.OpInit, 0, fusekernel.InitIn{
+			Major:        fusekernel.ProtoVersionMaxMajor,
+			Minor:        fusekernel.ProtoVersionMaxMinor,
+			MaxReadahead: 1 << 17,
+		}),
+	}
+
+	unique := uint64(2)
+	var getattrs []uint64
+	for i, inode := range inodes {
+		msgs = append(msgs, rawRequest(unique, fusekernel.OpGetattr, inode, fusekernel.GetattrIn{}))
+		getattrs = append(getattrs, unique)
+		unique++
+
+		if i == 1 {
+			msgs = append(msgs, rawRequest(unique, fusekernel.OpForget, inode, fusekernel.ForgetIn{Nlookup: 1}))
+			unique++
+		}
+	}
+
+	for _, u := range getattrs {
+		msgs = append(msgs, rawRequest(unique, fusekernel.OpInterrupt, 0, fusekernel.InterruptIn{Unique: u}))
+		unique++
+	}
+
+	msgs = append(msgs, rawRequest(unique, fusekernel.OpDestroy, 0, nil))
+	return bytes.Join(msgs, nil)
+}
+
+// A file system whose GetInodeAttributes blocks until release is closed, and
+// then for hold, noting what it was called with and how many calls overlapped.
+type blockingFS struct {
+	NotImplementedFileSystem
+
+	hold      time.Duration
+	release   chan struct{}
+	started   chan fuseops.InodeID
+	forgotten chan struct{}
+
+	mu         sync.Mutex
+	running    int      // GUARDED_BY(mu)
+	maxRunning int      // GUARDED_BY(mu)
+	events     []string // GUARDED_BY(mu)
+}
+
+func newBlockingFS() *blockingFS {
+	return &blockingFS{
+		release:   make(chan struct{}),
+		started:   make(chan fuseops.InodeID, 16),
+		forgotten: make(chan struct{}, 16),
+	}
+}
+
+func (fs *blockingFS) note(format string, args ...interface{}) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.events = append(fs.events, fmt.Sprintf(format, args...))
+}
+
+func (fs *blockingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	fs.running++
+	if fs.running > fs.maxRunning {
+		fs.maxRunning = fs.running
+	}
+	fs.events = append(fs.events, fmt.Sprintf("start %d", op.Inode))
+	fs.mu.Unlock()
+
+	fs.started <- op.Inode
+	<-fs.release
+	time.Sleep(fs.hold)
+
+	fs.mu.Lock()
+	fs.running--
+	fs.events = append(fs.events, fmt.Sprintf("end %d", op.Inode))
+	fs.mu.Unlock()
+	return nil
+}
+
+func (fs *blockingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.note("forget %d", op.Inode)
+	fs.forgotten <- struct{}{}
+	return nil
+}
+
+func (fs *blockingFS) Destroy() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.events = append(fs.events, fmt.Sprintf("destroy with %d running", fs.running))
+}
+
+// Replay the recording against the server in the background.
+func replayInBackground(recording []byte, server fuse.Server) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fuse.Replay(bytes.NewReader(recording), server, &fuse.MountConfig{})
+	}()
+
+	return done
+}
+
+func TestFileSystemServerParallelism(t *testing.T) {
+	fs := newBlockingFS()
+	server := NewFileSystemServerWithConfig(fs, ServerConfig{Parallelism: 2})
+	done := replayInBackground(getattrRecording(11, 12, 13, 14), server)
+
+	// The first two getattrs should take up both workers.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-fs.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only %d getattrs started", i)
+		}
+	}
+
+	// The forget following them should be handled regardless.
+	select {
+	case <-fs.forgotten:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Forget not handled while the workers were busy")
+	}
+
+	// But no further getattr until a worker is free.
+	select {
+	case inode := <-fs.started:
+		t.Fatalf("Getattr for %d started while the workers were busy", inode)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(fs.release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Replay: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Replay did not finish")
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.maxRunning != 2 {
+		t.Errorf("At most %d getattrs ran at once, want 2", fs.maxRunning)
+	}
+
+	if len(fs.events) != 10 {
+		t.Fatalf("Events: %q, want 4 getattrs, a forget and a destroy", fs.events)
+	}
+
+	if got, want := fs.events[len(fs.events)-1], "destroy with 0 running"; got != want {
+		t.Errorf("Last event %q, want %q (events: %q)", got, want, fs.events)
+	}
+}
+
+func TestSerialFileSystemServer(t *testing.T) {
+	fs := newBlockingFS()
+	fs.hold = 10 * time.Millisecond
+	close(fs.release)
+
+	server := NewSerialFileSystemServer(fs)
+	done := replayInBackground(getattrRecording(11, 12, 13, 14), server)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Replay: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Replay did not finish")
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Each method is called only once the previous one has returned, in the
+	// order the kernel sent the ops.
+	want := []string{
+		"start 11", "end 11",
+		"start 12", "end 12",
+		"forget 12",
+		"start 13", "end 13",
+		"start 14", "end 14",
+		"destroy with 0 running",
+	}
+
+	if fmt.Sprint(fs.events) != fmt.Sprint(want) {
+		t.Errorf("Events: %q, want %q", fs.events, want)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"strings"
+	"syscall"
+)
+
+// Names of the extended attributes the macOS Finder uses to store metadata
+// that on HFS+ lived in the catalog record and the resource fork.
+const (
+	XattrFinderInfo   = "com.apple.FinderInfo"
+	XattrResourceFork = "com.apple.ResourceFork"
+)
+
+// FinderInfoSize is the fixed size of the com.apple.FinderInfo attribute. The
+// Finder treats a value of any other length as corrupt, and copies of such
+// files fail with a generic error.
+const FinderInfoSize = 32
+
+// IsAppleDoubleName returns true if the supplied directory entry name is an
+// AppleDouble sidecar file (e.g. "._foo"), used by macOS to emulate extended
+// attributes and resource forks on file systems that don't support them.
+//
+// When mounting with the noappledouble option (the default on OS X, cf. notes
+// in MountConfig), the kernel refuses to create such files itself. File systems
+// that are shared with macOS clients by other means (e.g. over a network) may
+// still want to reject or hide them.
+func IsAppleDoubleName(name string) bool {
+	return strings.HasPrefix(name, "._") && len(name) > 2
+}
+
+// IsFinderMetadataName returns true if the supplied directory entry name is a
+// file the Finder creates to store per-directory view state, such as
+// .DS_Store. These are not AppleDouble files, but are generally just as much
+// noise for file systems backed by remote storage.
+func IsFinderMetadataName(name string) bool {
+	switch name {
+	case ".DS_Store", ".localized", ".VolumeIcon.icns", ".fseventsd",
+		".Spotlight-V100", ".Trashes", ".TemporaryItems":
+		return true
+	}
+
+	return false
+}
+
+// SuppressAppleDouble returns the error a file system should return from a
+// LookUpInodeOp, CreateFileOp or MkNodeOp for the given name if it wishes to
+// suppress AppleDouble and Finder metadata files, or nil if the name should be
+// handled normally.
+//
+// ENOENT is used for lookups so that the Finder falls back to extended
+// attributes, and EACCES for creations so that the Finder doesn't retry.
+func SuppressAppleDouble(name string, create bool) error {
+	if !IsAppleDoubleName(name) && !IsFinderMetadataName(name) {
+		return nil
+	}
+
+	if create {
+		return syscall.EACCES
+	}
+
+	return syscall.ENOENT
+}
+
+// IsFinderXattr returns true if the supplied extended attribute name is one
+// that the Finder relies on when copying files.
+func IsFinderXattr(name string) bool {
+	return name == XattrFinderInfo || name == XattrResourceFork
+}
+
+// ValidateFinderXattr checks a value about to be stored for one of the Finder
+// extended attributes, returning EINVAL if the Finder would be unable to read
+// it back. Values for other attributes are always accepted.
+//
+// It is intended to be called from SetXattr, before the value is persisted.
+func ValidateFinderXattr(name string, value []byte) error {
+	if name == XattrFinderInfo && len(value) != FinderInfoSize {
+		return syscall.EINVAL
+	}
+
+	return nil
+}
+
+// IsEmptyFinderInfo returns true if the supplied com.apple.FinderInfo value
+// consists only of zero bytes. The Finder writes such values when clearing
+// metadata; file systems may prefer to remove the attribute entirely, since
+// macOS itself does not report all-zero FinderInfo attributes from listxattr(2).
+func IsEmptyFinderInfo(value []byte) bool {
+	for _, b := range value {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,53 @@
+package fuseutil
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestIsAppleDoubleName(t *testing.T) {
+	testCases := []struct {
+		name string
+		want bool
+	}{
+		{"._foo", true},
+		{"._.DS_Store", true},
+		{"._", false},
+		{"._.", true},
+		{"_foo", false},
+		{".foo", false},
+		{"foo._bar", false},
+		{"", false},
+		{".", false},
+	}
+
+	for _, tc := range testCases {
+		if got := IsAppleDoubleName(tc.name); got != tc.want {
+			t.Errorf("IsAppleDoubleName(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSuppressAppleDouble(t *testing.T) {
+	testCases := []struct {
+		name   string
+		create bool
+		want   error
+	}{
+		{"._foo", false, syscall.ENOENT},
+		{"._foo", true, syscall.EACCES},
+		{".DS_Store", false, syscall.ENOENT},
+		{".DS_Store", true, syscall.EACCES},
+		{".Trashes", true, syscall.EACCES},
+		{"foo", false, nil},
+		{"foo", true, nil},
+		{"._", false, nil},
+		{".ds_store", true, nil},
+	}
+
+	for _, tc := range testCases {
+		if got := SuppressAppleDouble(tc.name, tc.create); got != tc.want {
+			t.Errorf("SuppressAppleDouble(%q, %v) = %v, want %v", tc.name, tc.create, got, tc.want)
+		}
+	}
+}
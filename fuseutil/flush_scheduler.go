@@ -0,0 +1,383 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// A function that makes the dirty state of an inode durable, e.g. by
+// uploading it to a backing store.
+type FlushFunc func(ctx context.Context, inode fuseops.InodeID) error
+
+// Configuration for a FlushScheduler. Zero values disable the corresponding
+// trigger.
+type FlushSchedulerConfig struct {
+	// Flush an inode once it has been dirty for this long, even if it is still
+	// being written to.
+	MaxAge time.Duration
+
+	// Flush an inode once it hasn't been written to for this long.
+	IdleTimeout time.Duration
+
+	// Flush the inodes that have been dirty longest whenever the total dirty
+	// bytes registered exceed this. MarkDirty triggers a check as soon as it
+	// does, rather than waiting for the next interval.
+	MaxDirtyBytes int64
+
+	// How often, as measured by Clock, to check for inodes due to be flushed.
+	// Defaults to a second.
+	CheckInterval time.Duration
+
+	// Called with the error when a background flush fails. The inode stays
+	// dirty and is retried at the next check. May be nil.
+	OnError func(inode fuseops.InodeID, err error)
+
+	// The clock to use. Defaults to the real clock.
+	Clock timeutil.Clock
+}
+
+// FlushScheduler tracks the inodes a file system has dirtied and flushes them
+// in the background according to age, idleness and memory thresholds, so that
+// durability policy lives in one place. The file system should:
+//
+//   - Call MarkDirty when it accepts a WriteFileOp (or any other change it
+//     buffers).
+//
+//   - Call Flush from its SyncFile and FlushFile handlers. This waits for any
+//     background flush of the inode already in progress, so that the op
+//     returns only once everything written before it is durable.
+//
+//   - Call Forget when an inode is deleted and its dirty state is moot.
+//
+// The flush function is never called concurrently for the same inode.
+type FlushScheduler struct {
+	cfg   FlushSchedulerConfig
+	flush FlushFunc
+
+	stop    chan struct{}
+	stopped chan struct{}
+
+	// Signalled by MarkDirty when the dirty bytes exceed the threshold.
+	kick chan struct{}
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	dirty map[fuseops.InodeID]*dirtyInode
+
+	// The sum of the bytes in dirty.
+	//
+	// GUARDED_BY(mu)
+	dirtyBytes int64
+
+	// Flushes in progress, each with a channel that is closed when it
+	// completes.
+	//
+	// GUARDED_BY(mu)
+	flushing map[fuseops.InodeID]chan struct{}
+
+	// Inodes forgotten while in flushing, whose dirty state mustn't be
+	// restored should the flush fail.
+	//
+	// GUARDED_BY(mu)
+	forgotten map[fuseops.InodeID]bool
+}
+
+type dirtyInode struct {
+	since     time.Time
+	lastWrite time.Time
+	bytes     int64
+}
+
+// NewFlushScheduler creates a scheduler and starts its background goroutine,
+// which runs until Close is called.
+func NewFlushScheduler(
+	cfg FlushSchedulerConfig,
+	flush FlushFunc) *FlushScheduler {
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = time.Second
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	s := &FlushScheduler{
+		cfg:       cfg,
+		flush:     flush,
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		kick:      make(chan struct{}, 1),
+		dirty:     make(map[fuseops.InodeID]*dirtyInode),
+		flushing:  make(map[fuseops.InodeID]chan struct{}),
+		forgotten: make(map[fuseops.InodeID]bool),
+	}
+
+	go s.run(cfg.Clock.Now().Add(cfg.CheckInterval))
+	return s
+}
+
+// The longest the background goroutine sleeps before looking at the clock
+// again. The clock needn't be the real one, and may jump ahead of the time the
+// goroutine went to sleep until.
+const flushSchedulerPollInterval = 100 * time.Millisecond
+
+// Check for due inodes at next, and every CheckInterval after that, until
+// stopped.
+func (s *FlushScheduler) run(next time.Time) {
+	defer close(s.stopped)
+
+	for {
+		wait := next.Sub(s.cfg.Clock.Now())
+		if wait <= 0 {
+			s.FlushDue(context.Background())
+			next = s.cfg.Clock.Now().Add(s.cfg.CheckInterval)
+			continue
+		}
+
+		if wait > flushSchedulerPollInterval {
+			wait = flushSchedulerPollInterval
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+
+		case <-s.kick:
+			t.Stop()
+			s.FlushDue(context.Background())
+
+		case <-s.stop:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// MarkDirty records that the given number of bytes of the inode's data are
+// now buffered and not yet durable.
+func (s *FlushScheduler) MarkDirty(inode fuseops.InodeID, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.cfg.Clock.Now()
+	d := s.dirty[inode]
+	if d == nil {
+		d = &dirtyInode{since: now}
+		s.dirty[inode] = d
+	}
+
+	d.lastWrite = now
+	d.bytes += bytes
+	s.dirtyBytes += bytes
+
+	// Have the background goroutine bring the total back down now, rather
+	// than letting it grow until the next check.
+	if s.cfg.MaxDirtyBytes > 0 && s.dirtyBytes > s.cfg.MaxDirtyBytes {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Forget drops the dirty state for the inode without flushing it. If a flush
+// of the inode is in progress and fails, the inode isn't marked dirty again.
+func (s *FlushScheduler) Forget(inode fuseops.InodeID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d := s.dirty[inode]; d != nil {
+		s.dirtyBytes -= d.bytes
+		delete(s.dirty, inode)
+	}
+
+	if _, ok := s.flushing[inode]; ok {
+		s.forgotten[inode] = true
+	}
+}
+
+// DirtyBytes returns the total number of dirty bytes registered and not yet
+// flushed.
+func (s *FlushScheduler) DirtyBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dirtyBytes
+}
+
+// Flush waits for any background flush of the inode in progress and then, if
+// the inode is dirty, flushes it.
+func (s *FlushScheduler) Flush(ctx context.Context, inode fuseops.InodeID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flushLocked(ctx, inode)
+}
+
+// Flush the inode if it's dirty, waiting for any flush already in progress
+// first. Temporarily releases the lock.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(s.mu)
+func (s *FlushScheduler) flushLocked(
+	ctx context.Context,
+	inode fuseops.InodeID) error {
+	for {
+		done, ok := s.flushing[inode]
+		if !ok {
+			break
+		}
+
+		s.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			s.mu.Lock()
+			return ctx.Err()
+		}
+		s.mu.Lock()
+	}
+
+	d := s.dirty[inode]
+	if d == nil {
+		return nil
+	}
+
+	// Take the inode's dirty state for the duration of the flush; writes that
+	// arrive in the meantime start a new one.
+	delete(s.dirty, inode)
+	s.dirtyBytes -= d.bytes
+
+	done := make(chan struct{})
+	s.flushing[inode] = done
+
+	s.mu.Unlock()
+	err := s.flush(ctx, inode)
+	s.mu.Lock()
+
+	delete(s.flushing, inode)
+	close(done)
+
+	forgotten := s.forgotten[inode]
+	delete(s.forgotten, inode)
+
+	// On failure the inode is still dirty, and has been since the original
+	// time, unless it was forgotten in the meantime.
+	if err != nil && !forgotten {
+		if newer := s.dirty[inode]; newer != nil {
+			d.lastWrite = newer.lastWrite
+			d.bytes += newer.bytes
+			s.dirtyBytes -= newer.bytes
+		}
+
+		s.dirty[inode] = d
+		s.dirtyBytes += d.bytes
+	}
+
+	return err
+}
+
+// FlushDue flushes the inodes that are due according to the configuration.
+// The background goroutine calls this every CheckInterval; it is exported for
+// file systems that want to trigger a check sooner, e.g. under memory
+// pressure.
+func (s *FlushScheduler) FlushDue(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, inode := range s.dueLocked() {
+		if err := s.flushLocked(ctx, inode); err != nil && s.cfg.OnError != nil {
+			s.cfg.OnError(inode, err)
+		}
+	}
+}
+
+// Return the inodes due for flushing, oldest first.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(s.mu)
+func (s *FlushScheduler) dueLocked() []fuseops.InodeID {
+	now := s.cfg.Clock.Now()
+
+	type candidate struct {
+		inode fuseops.InodeID
+		since time.Time
+		bytes int64
+	}
+
+	var due []fuseops.InodeID
+	var rest []candidate
+	excess := s.dirtyBytes - s.cfg.MaxDirtyBytes
+
+	for inode, d := range s.dirty {
+		switch {
+		case s.cfg.MaxAge > 0 && now.Sub(d.since) >= s.cfg.MaxAge,
+			s.cfg.IdleTimeout > 0 && now.Sub(d.lastWrite) >= s.cfg.IdleTimeout:
+			due = append(due, inode)
+			excess -= d.bytes
+
+		default:
+			rest = append(rest, candidate{inode, d.since, d.bytes})
+		}
+	}
+
+	// Bring the total back under the threshold, oldest first.
+	if s.cfg.MaxDirtyBytes > 0 && excess > 0 {
+		sort.Slice(rest, func(i, j int) bool {
+			return rest[i].since.Before(rest[j].since)
+		})
+
+		for _, c := range rest {
+			if excess <= 0 {
+				break
+			}
+
+			due = append(due, c.inode)
+			excess -= c.bytes
+		}
+	}
+
+	return due
+}
+
+// Close stops the background goroutine and flushes everything still dirty,
+// returning the first error.
+func (s *FlushScheduler) Close(ctx context.Context) error {
+	close(s.stop)
+	<-s.stopped
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var inodes []fuseops.InodeID
+	for inode := range s.dirty {
+		inodes = append(inodes, inode)
+	}
+
+	var firstErr error
+	for _, inode := range inodes {
+		if err := s.flushLocked(ctx, inode); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,212 @@
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+type flushRecorder struct {
+	mu      sync.Mutex
+	flushed []fuseops.InodeID
+	err     error
+}
+
+func (r *flushRecorder) flush(ctx context.Context, inode fuseops.InodeID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.flushed = append(r.flushed, inode)
+	return r.err
+}
+
+func (r *flushRecorder) take() []fuseops.InodeID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f := r.flushed
+	r.flushed = nil
+	sort.Slice(f, func(i, j int) bool { return f[i] < f[j] })
+	return f
+}
+
+func TestFlushScheduler(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 3, 26, 0, 0, 0, 0, time.UTC))
+
+	var r flushRecorder
+	s := NewFlushScheduler(FlushSchedulerConfig{
+		MaxAge:        time.Minute,
+		IdleTimeout:   10 * time.Second,
+		MaxDirtyBytes: 100,
+		CheckInterval: time.Hour,
+		Clock:         &clock,
+	}, r.flush)
+
+	ctx := context.Background()
+
+	// Idle inodes are flushed; busy ones aren't until they are old enough.
+	s.MarkDirty(2, 10)
+	s.MarkDirty(3, 10)
+	for i := 0; i < 5; i++ {
+		clock.AdvanceTime(9 * time.Second)
+		s.MarkDirty(3, 1)
+		s.FlushDue(ctx)
+		if i == 1 {
+			if got := r.take(); len(got) != 1 || got[0] != 2 {
+				t.Fatalf("flushed %v, want [2]", got)
+			}
+		}
+	}
+
+	clock.AdvanceTime(20 * time.Second)
+	s.MarkDirty(3, 1)
+	s.FlushDue(ctx)
+	if got := r.take(); len(got) != 1 || got[0] != 3 {
+		t.Fatalf("flushed %v, want [3]", got)
+	}
+
+	// Exceeding the memory threshold flushes the oldest inodes.
+	s.MarkDirty(4, 60)
+	clock.AdvanceTime(time.Second)
+	s.MarkDirty(5, 60)
+	s.FlushDue(ctx)
+	if got := r.take(); len(got) != 1 || got[0] != 4 {
+		t.Fatalf("flushed %v, want [4]", got)
+	}
+
+	// Failed flushes leave the inode dirty.
+	r.err = errors.New("taco")
+	if err := s.Flush(ctx, 5); err != r.err {
+		t.Errorf("Flush error = %v, want %v", err, r.err)
+	}
+
+	if got := s.DirtyBytes(); got != 60 {
+		t.Errorf("DirtyBytes = %d, want 60", got)
+	}
+
+	// Close flushes everything left.
+	r.err = nil
+	r.take()
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got := r.take(); len(got) != 1 || got[0] != 5 {
+		t.Errorf("flushed %v, want [5]", got)
+	}
+}
+
+// Wait for the recorder to see a flush, for up to a few seconds.
+func (r *flushRecorder) await(t *testing.T) []fuseops.InodeID {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if got := r.take(); len(got) != 0 {
+			return got
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatal("Timed out waiting for a flush")
+	return nil
+}
+
+func TestFlushSchedulerChecksByClock(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 3, 26, 0, 0, 0, 0, time.UTC))
+
+	var r flushRecorder
+	s := NewFlushScheduler(FlushSchedulerConfig{
+		IdleTimeout:   time.Second,
+		CheckInterval: time.Hour,
+		Clock:         &clock,
+	}, r.flush)
+	defer s.Close(context.Background())
+
+	// Once an hour has passed on the clock, the background goroutine should
+	// check, however little real time has passed.
+	s.MarkDirty(2, 10)
+	clock.AdvanceTime(time.Hour)
+	if got := r.await(t); len(got) != 1 || got[0] != 2 {
+		t.Errorf("flushed %v, want [2]", got)
+	}
+}
+
+func TestFlushSchedulerMarkDirtyOverThreshold(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 3, 26, 0, 0, 0, 0, time.UTC))
+
+	var r flushRecorder
+	s := NewFlushScheduler(FlushSchedulerConfig{
+		MaxDirtyBytes: 100,
+		CheckInterval: time.Hour,
+		Clock:         &clock,
+	}, r.flush)
+	defer s.Close(context.Background())
+
+	// Going over the threshold should trigger a check without the clock
+	// moving.
+	s.MarkDirty(2, 60)
+	clock.AdvanceTime(time.Second)
+	s.MarkDirty(3, 60)
+	if got := r.await(t); len(got) != 1 || got[0] != 2 {
+		t.Errorf("flushed %v, want [2]", got)
+	}
+
+	if got := s.DirtyBytes(); got != 60 {
+		t.Errorf("DirtyBytes = %d, want 60", got)
+	}
+}
+
+func TestFlushSchedulerForgetDuringFailedFlush(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var flushes int
+	s := NewFlushScheduler(FlushSchedulerConfig{}, func(ctx context.Context, inode fuseops.InodeID) error {
+		flushes++
+		if flushes == 1 {
+			close(started)
+			<-release
+		}
+
+		return errors.New("taco")
+	})
+
+	ctx := context.Background()
+	s.MarkDirty(2, 10)
+
+	flushErr := make(chan error, 1)
+	go func() {
+		flushErr <- s.Flush(ctx, 2)
+	}()
+
+	// Forget the inode while it is being flushed, and then fail the flush.
+	<-started
+	s.Forget(2)
+	close(release)
+	if err := <-flushErr; err == nil {
+		t.Fatal("Flush succeeded")
+	}
+
+	// The inode shouldn't have come back.
+	if got := s.DirtyBytes(); got != 0 {
+		t.Errorf("DirtyBytes = %d, want 0", got)
+	}
+
+	if err := s.Close(ctx); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	if flushes != 1 {
+		t.Errorf("%d flushes, want 1", flushes)
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// ErrAlreadyFrozen is returned by FreezableFileSystem.Freeze if the file
+// system is already frozen.
+var ErrAlreadyFrozen = errors.New("file system already frozen")
+
+// FreezableFileSystem wraps a FileSystem so that ops that may modify it can be
+// temporarily blocked, e.g. to take a crash-consistent backup of the data it
+// serves. Ops that only read (lookups, attribute and directory reads, file
+// reads, etc.) continue while frozen.
+//
+// The ops considered mutating are those that create, remove, rename or change
+// the attributes or extended attributes of inodes, WriteFile, Fallocate,
+// CopyFileRange, FlushFile and SyncFile (which may write back cached data),
+// and OpenFile with O_TRUNC.
+type FreezableFileSystem struct {
+	FileSystem
+
+	mu sync.Mutex
+
+	// Whether Freeze has been called without a matching Thaw.
+	//
+	// GUARDED_BY(mu)
+	frozen bool
+
+	// Closed by Thaw. Non-nil only while frozen.
+	//
+	// GUARDED_BY(mu)
+	thawed chan struct{}
+
+	// The number of mutating ops currently in the wrapped file system.
+	//
+	// GUARDED_BY(mu)
+	inFlight int
+
+	// Closed when inFlight drops to zero, if Freeze is waiting for that.
+	//
+	// GUARDED_BY(mu)
+	drained chan struct{}
+}
+
+// NewFreezableFileSystem wraps the supplied file system. It starts out thawed.
+func NewFreezableFileSystem(wrapped FileSystem) *FreezableFileSystem {
+	return &FreezableFileSystem{
+		FileSystem: wrapped,
+	}
+}
+
+// Freeze blocks any new mutating ops and waits for those already in progress
+// to finish. When it returns successfully the wrapped file system sees no
+// modifications until Thaw is called.
+//
+// If ctx is cancelled while waiting, the file system is thawed again and the
+// context's error is returned.
+func (fs *FreezableFileSystem) Freeze(ctx context.Context) error {
+	fs.mu.Lock()
+	if fs.frozen {
+		fs.mu.Unlock()
+		return ErrAlreadyFrozen
+	}
+
+	fs.frozen = true
+	fs.thawed = make(chan struct{})
+
+	if fs.inFlight == 0 {
+		fs.mu.Unlock()
+		return nil
+	}
+
+	drained := make(chan struct{})
+	fs.drained = drained
+	fs.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+
+	case <-ctx.Done():
+		fs.Thaw()
+		return ctx.Err()
+	}
+}
+
+// Thaw releases any ops blocked by Freeze. It does nothing if the file system
+// isn't frozen.
+func (fs *FreezableFileSystem) Thaw() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.frozen {
+		return
+	}
+
+	fs.frozen = false
+	close(fs.thawed)
+	fs.thawed = nil
+	fs.drained = nil
+}
+
+// Frozen reports whether the file system is currently frozen.
+func (fs *FreezableFileSystem) Frozen() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.frozen
+}
+
+// Snapshot freezes the file system, calls capture while it is quiescent, and
+// then thaws it, returning capture's error. capture should copy or otherwise
+// record whatever state of the backing store is to be made consistent,
+// without calling back into the file system's mutating ops.
+func (fs *FreezableFileSystem) Snapshot(
+	ctx context.Context,
+	capture func(ctx context.Context) error) error {
+	if err := fs.Freeze(ctx); err != nil {
+		return err
+	}
+	defer fs.Thaw()
+
+	return capture(ctx)
+}
+
+// Wait until the file system isn't frozen, then count a mutating op as in
+// flight. The caller must call endMutation afterward if this returns nil.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *FreezableFileSystem) beginMutation(ctx context.Context) error {
+	fs.mu.Lock()
+	for fs.frozen {
+		thawed := fs.thawed
+		fs.mu.Unlock()
+
+		select {
+		case <-thawed:
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+
+		fs.mu.Lock()
+	}
+
+	fs.inFlight++
+	fs.mu.Unlock()
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *FreezableFileSystem) endMutation() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.inFlight--
+	if fs.inFlight == 0 && fs.drained != nil {
+		close(fs.drained)
+		fs.drained = nil
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Mutating ops
+////////////////////////////////////////////////////////////////////////
+
+func (fs *FreezableFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *FreezableFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.MkDir(ctx, op)
+}
+
+func (fs *FreezableFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.MkNode(ctx, op)
+}
+
+func (fs *FreezableFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.CreateFile(ctx, op)
+}
+
+func (fs *FreezableFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.CreateLink(ctx, op)
+}
+
+func (fs *FreezableFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.CreateSymlink(ctx, op)
+}
+
+func (fs *FreezableFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+func (fs *FreezableFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.RmDir(ctx, op)
+}
+
+func (fs *FreezableFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.Unlink(ctx, op)
+}
+
+func (fs *FreezableFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if uint32(op.OpenFlags)&syscall.O_TRUNC == 0 {
+		return fs.FileSystem.OpenFile(ctx, op)
+	}
+
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.OpenFile(ctx, op)
+}
+
+func (fs *FreezableFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *FreezableFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.SyncFile(ctx, op)
+}
+
+func (fs *FreezableFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.FlushFile(ctx, op)
+}
+
+func (fs *FreezableFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.RemoveXattr(ctx, op)
+}
+
+func (fs *FreezableFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.SetXattr(ctx, op)
+}
+
+func (fs *FreezableFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *FreezableFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	if err := fs.beginMutation(ctx); err != nil {
+		return err
+	}
+	defer fs.endMutation()
+
+	return fs.FileSystem.CopyFileRange(ctx, op)
+}
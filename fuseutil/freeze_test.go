@@ -0,0 +1,118 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type blockingMkDirFS struct {
+	NotImplementedFileSystem
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (fs *blockingMkDirFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.entered <- struct{}{}
+	<-fs.release
+	return nil
+}
+
+func (fs *blockingMkDirFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return nil
+}
+
+func TestFreezeDrainsAndBlocksMutations(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &blockingMkDirFS{
+		entered: make(chan struct{}, 2),
+		release: make(chan struct{}, 2),
+	}
+	fs := NewFreezableFileSystem(wrapped)
+
+	// Start a mutation and freeze while it's in flight.
+	mkdirDone := make(chan error, 2)
+	go func() { mkdirDone <- fs.MkDir(ctx, &fuseops.MkDirOp{}) }()
+	<-wrapped.entered
+
+	frozen := make(chan error)
+	go func() { frozen <- fs.Freeze(ctx) }()
+
+	select {
+	case <-frozen:
+		t.Fatalf("Freeze returned before the in-flight op finished")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	wrapped.release <- struct{}{}
+	if err := <-frozen; err != nil {
+		t.Fatalf("Freeze: %v", err)
+	}
+
+	<-mkdirDone
+
+	// Reads go through, mutations wait for Thaw.
+	if err := fs.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{}); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	go func() { mkdirDone <- fs.MkDir(ctx, &fuseops.MkDirOp{}) }()
+	select {
+	case <-wrapped.entered:
+		t.Fatalf("MkDir reached the wrapped file system while frozen")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := fs.Freeze(ctx); err != ErrAlreadyFrozen {
+		t.Errorf("second Freeze: %v, want ErrAlreadyFrozen", err)
+	}
+
+	fs.Thaw()
+	<-wrapped.entered
+	wrapped.release <- struct{}{}
+	if err := <-mkdirDone; err != nil {
+		t.Errorf("MkDir: %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	fs := NewFreezableFileSystem(&NotImplementedFileSystem{})
+
+	var sawFrozen bool
+	err := fs.Snapshot(context.Background(), func(ctx context.Context) error {
+		sawFrozen = fs.Frozen()
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	if !sawFrozen {
+		t.Errorf("capture ran while not frozen")
+	}
+
+	if fs.Frozen() {
+		t.Errorf("still frozen after Snapshot")
+	}
+}
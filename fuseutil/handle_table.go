@@ -0,0 +1,87 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// HandleTable allocates handle IDs for open files and directories, each
+// carrying an arbitrary payload supplied by the user (e.g. an open file in a
+// backing store, or the state of a directory listing). Call Add from OpenFile
+// and OpenDir, and Release from ReleaseFileHandle and ReleaseDirHandle.
+//
+// Handle IDs are never reused, so that an op for a released handle can't be
+// mistaken for one on a later open. They are never zero.
+//
+// Safe for concurrent access.
+type HandleTable struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]interface{}
+
+	// GUARDED_BY(mu)
+	nextID fuseops.HandleID
+}
+
+// NewHandleTable creates an empty table.
+func NewHandleTable() *HandleTable {
+	return &HandleTable{
+		handles: make(map[fuseops.HandleID]interface{}),
+		nextID:  1,
+	}
+}
+
+// Add records a new handle with the supplied payload, returning its ID.
+func (t *HandleTable) Add(payload interface{}) fuseops.HandleID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := t.nextID
+	t.nextID++
+	t.handles[id] = payload
+	return id
+}
+
+// Get returns the payload of the given handle, if it is open.
+func (t *HandleTable) Get(id fuseops.HandleID) (interface{}, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	payload, ok := t.handles[id]
+	return payload, ok
+}
+
+// Release removes the given handle from the table, returning its payload so
+// that the caller can clean it up.
+func (t *HandleTable) Release(id fuseops.HandleID) (interface{}, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	payload, ok := t.handles[id]
+	delete(t.handles, id)
+	return payload, ok
+}
+
+// Len returns the number of open handles.
+func (t *HandleTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.handles)
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The ops that change a file's contents or push them to storage through a
+// handle, which ReleaseFileHandle must not overtake.
+func writesToHandle(op interface{}) (h fuseops.HandleID, ok bool) {
+	switch typed := op.(type) {
+	case *fuseops.WriteFileOp:
+		return typed.Handle, true
+
+	case *fuseops.SyncFileOp:
+		return typed.Handle, true
+
+	case *fuseops.FlushFileOp:
+		return typed.Handle, true
+
+	case *fuseops.FallocateOp:
+		return typed.Handle, true
+
+	case *fuseops.CopyFileRangeOp:
+		return typed.DstHandle, true
+	}
+
+	return 0, false
+}
+
+// The writes to each handle whose methods haven't yet returned. Writes are
+// counted when they are read from the kernel, on the goroutine calling
+// ServeOps, so that a release read after them is sure to see them.
+//
+// The zero value is ready to use.
+type handleWrites struct {
+	mu sync.Mutex
+
+	// For each handle with writes outstanding, their number and a channel
+	// closed when it drops to zero.
+	//
+	// GUARDED_BY(mu)
+	pending map[fuseops.HandleID]*pendingWrites
+}
+
+type pendingWrites struct {
+	n    int
+	done chan struct{}
+}
+
+// Record the start of a write to h.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *handleWrites) start(h fuseops.HandleID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.pending == nil {
+		w.pending = make(map[fuseops.HandleID]*pendingWrites)
+	}
+
+	p := w.pending[h]
+	if p == nil {
+		p = &pendingWrites{done: make(chan struct{})}
+		w.pending[h] = p
+	}
+
+	p.n++
+}
+
+// Record that the method for a write to h has returned.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *handleWrites) finish(h fuseops.HandleID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p := w.pending[h]
+	p.n--
+	if p.n == 0 {
+		close(p.done)
+		delete(w.pending, h)
+	}
+}
+
+// Wait for the writes to h started so far to finish.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *handleWrites) wait(h fuseops.HandleID) {
+	w.mu.Lock()
+	p := w.pending[h]
+	w.mu.Unlock()
+
+	if p != nil {
+		<-p.done
+	}
+}
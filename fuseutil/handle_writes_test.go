@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestReleaseWaitsForWrites(t *testing.T) {
+	var w handleWrites
+
+	// Nothing outstanding.
+	w.wait(1)
+
+	w.start(1)
+	w.start(1)
+	w.start(2)
+
+	released := make(chan struct{})
+	go func() {
+		w.wait(1)
+		close(released)
+	}()
+
+	// A write to another handle finishing doesn't count.
+	w.finish(2)
+	w.finish(1)
+
+	select {
+	case <-released:
+		t.Fatalf("Release overtook a running write")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	w.finish(1)
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatalf("Release still waiting after the writes finished")
+	}
+
+	if len(w.pending) != 0 {
+		t.Errorf("Pending: %v", w.pending)
+	}
+}
+
+func TestWritesToHandle(t *testing.T) {
+	testCases := []struct {
+		op interface{}
+		h  fuseops.HandleID
+		ok bool
+	}{
+		{&fuseops.WriteFileOp{Handle: 1}, 1, true},
+		{&fuseops.SyncFileOp{Handle: 2}, 2, true},
+		{&fuseops.FlushFileOp{Handle: 3}, 3, true},
+		{&fuseops.FallocateOp{Handle: 4}, 4, true},
+		{&fuseops.CopyFileRangeOp{SrcHandle: 5, DstHandle: 6}, 6, true},
+		{&fuseops.ReadFileOp{Handle: 7}, 0, false},
+		{&fuseops.ReleaseFileHandleOp{Handle: 8}, 0, false},
+	}
+
+	for _, tc := range testCases {
+		h, ok := writesToHandle(tc.op)
+		if h != tc.h || ok != tc.ok {
+			t.Errorf("%T: got (%v, %v), want (%v, %v)", tc.op, h, ok, tc.h, tc.ok)
+		}
+	}
+}
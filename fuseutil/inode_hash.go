@@ -0,0 +1,140 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// HashInodeID derives an inode ID from the supplied key (e.g. a path or an
+// object name) by hashing it. The result is the same on every run, and is
+// never zero or fuseops.RootInodeID. Distinct keys can collide, though
+// rarely; see InodeHasher for a way to deal with that.
+func HashInodeID(key string) fuseops.InodeID {
+	return hashInodeID(key, 0)
+}
+
+// Hash the key along with a probe number, which is zero for the first
+// attempt.
+func hashInodeID(key string, probe uint64) fuseops.InodeID {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	if probe != 0 {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], probe)
+		h.Write(b[:])
+	}
+
+	id := fuseops.InodeID(h.Sum64())
+
+	// Stay clear of the IDs with special meanings.
+	if id == 0 || id == fuseops.RootInodeID {
+		id += 2
+	}
+
+	return id
+}
+
+// InodeHasher hands out inode IDs to string keys using HashInodeID, for file
+// systems that can't persist a numbering (cf. InodeStore) but want stable IDs
+// across restarts. It remembers which key it gave each ID to, and resolves
+// collisions by rehashing the later key until a free ID is found.
+//
+// A key gets the same ID on every run unless it collides with another key in
+// use at the time, in which case which of the two gets the plain hash depends
+// on the order in which they were first seen. With 64-bit hashes this is
+// vanishingly rare in practice.
+//
+// Safe for concurrent access.
+type InodeHasher struct {
+	mu sync.Mutex
+
+	// The key to which each ID in use is assigned.
+	//
+	// GUARDED_BY(mu)
+	keys map[fuseops.InodeID]string
+
+	// The IDs of keys that collided with another key and so were given an ID
+	// other than their hash.
+	//
+	// GUARDED_BY(mu)
+	collisions map[string]fuseops.InodeID
+}
+
+// NewInodeHasher creates an InodeHasher with no IDs in use.
+func NewInodeHasher() *InodeHasher {
+	return &InodeHasher{
+		keys:       make(map[fuseops.InodeID]string),
+		collisions: make(map[string]fuseops.InodeID),
+	}
+}
+
+// ID returns the inode ID for the supplied key, recording it as in use.
+func (h *InodeHasher) ID(key string) fuseops.InodeID {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if id, ok := h.collisions[key]; ok {
+		return id
+	}
+
+	for probe := uint64(0); ; probe++ {
+		id := hashInodeID(key, probe)
+		existing, ok := h.keys[id]
+		if ok && existing != key {
+			continue
+		}
+
+		h.keys[id] = key
+		if probe != 0 {
+			h.collisions[key] = id
+		}
+
+		return id
+	}
+}
+
+// Key returns the key to which the supplied ID is assigned, if it is in use.
+func (h *InodeHasher) Key(id fuseops.InodeID) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key, ok := h.keys[id]
+	return key, ok
+}
+
+// Forget releases the ID of the supplied key, e.g. once the kernel has
+// forgotten the inode, so that the tables don't grow without bound. A later
+// call to ID for the key may return a different ID if another key has taken
+// its hash in the meantime.
+func (h *InodeHasher) Forget(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id, ok := h.collisions[key]
+	if ok {
+		delete(h.collisions, key)
+	} else {
+		id = hashInodeID(key, 0)
+	}
+
+	if h.keys[id] == key {
+		delete(h.keys, id)
+	}
+}
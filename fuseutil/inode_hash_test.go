@@ -0,0 +1,54 @@
+package fuseutil
+
+import (
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestHashInodeID(t *testing.T) {
+	if HashInodeID("foo") != HashInodeID("foo") {
+		t.Errorf("Expected a stable hash")
+	}
+
+	if HashInodeID("foo") == HashInodeID("bar") {
+		t.Errorf("Unexpected collision")
+	}
+}
+
+func TestInodeHasherCollisions(t *testing.T) {
+	h := NewInodeHasher()
+
+	foo := h.ID("foo")
+	if foo != HashInodeID("foo") {
+		t.Errorf("ID(foo) = %v, want the plain hash", foo)
+	}
+
+	// Simulate another key that hashes to the same ID as "bar" being in use.
+	bar := HashInodeID("bar")
+	h.keys[bar] = "impostor"
+
+	got := h.ID("bar")
+	if got == bar || got == foo || got == 0 || got == fuseops.RootInodeID {
+		t.Fatalf("ID(bar) = %v despite collision", got)
+	}
+
+	if again := h.ID("bar"); again != got {
+		t.Errorf("ID(bar) changed from %v to %v", got, again)
+	}
+
+	if key, ok := h.Key(got); !ok || key != "bar" {
+		t.Errorf("Key(%v) = %q, %v", got, key, ok)
+	}
+
+	h.Forget("bar")
+	if _, ok := h.Key(got); ok {
+		t.Errorf("Expected forgotten ID to be free")
+	}
+
+	// Once the impostor is gone, bar gets its plain hash again.
+	delete(h.keys, bar)
+	if id := h.ID("bar"); id != bar {
+		t.Errorf("ID(bar) = %v, want %v", id, bar)
+	}
+}
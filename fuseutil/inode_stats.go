@@ -0,0 +1,389 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// InodeOpStats holds the number of ops and bytes transferred for one inode.
+type InodeOpStats struct {
+	Inode fuseops.InodeID
+
+	// The number of ops that named the inode, successful or not. Ops that
+	// name an entry in a directory (e.g. LookUpInode, MkDir, Unlink) are
+	// counted against the directory.
+	Ops uint64
+
+	// Bytes returned by ReadFile, ReadDir, ReadDirPlus, GetXattr and ListXattr.
+	BytesRead uint64
+
+	// Bytes supplied to WriteFile and SetXattr, and copied by CopyFileRange
+	// (counted against the destination).
+	BytesWritten uint64
+}
+
+// InodeStatsFileSystem wraps a FileSystem and keeps per-inode op counts and
+// byte volumes, so that it's possible to find out which files are responsible
+// for a mount's load. To keep memory bounded, only a fixed number of inodes
+// are tracked; the least recently used one is dropped to make room for another.
+type InodeStatsFileSystem struct {
+	FileSystem
+	maxInodes int
+
+	mu sync.Mutex
+
+	// Elements are *InodeOpStats, most recently used at the front.
+	//
+	// GUARDED_BY(mu)
+	lru list.List
+
+	// GUARDED_BY(mu)
+	index map[fuseops.InodeID]*list.Element
+}
+
+// NewInodeStatsFileSystem wraps the supplied file system, tracking at most
+// maxInodes inodes at a time.
+func NewInodeStatsFileSystem(
+	wrapped FileSystem,
+	maxInodes int) *InodeStatsFileSystem {
+	if maxInodes <= 0 {
+		maxInodes = 1
+	}
+
+	return &InodeStatsFileSystem{
+		FileSystem: wrapped,
+		maxInodes:  maxInodes,
+		index:      make(map[fuseops.InodeID]*list.Element),
+	}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *InodeStatsFileSystem) record(
+	inode fuseops.InodeID,
+	read int,
+	written int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	e, ok := fs.index[inode]
+	if ok {
+		fs.lru.MoveToFront(e)
+	} else {
+		if fs.lru.Len() >= fs.maxInodes {
+			oldest := fs.lru.Back()
+			fs.lru.Remove(oldest)
+			delete(fs.index, oldest.Value.(*InodeOpStats).Inode)
+		}
+
+		e = fs.lru.PushFront(&InodeOpStats{Inode: inode})
+		fs.index[inode] = e
+	}
+
+	s := e.Value.(*InodeOpStats)
+	s.Ops++
+	s.BytesRead += uint64(read)
+	s.BytesWritten += uint64(written)
+}
+
+// Stats returns the statistics for the supplied inode, if it is being
+// tracked.
+func (fs *InodeStatsFileSystem) Stats(
+	inode fuseops.InodeID) (InodeOpStats, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	e, ok := fs.index[inode]
+	if !ok {
+		return InodeOpStats{}, false
+	}
+
+	return *e.Value.(*InodeOpStats), true
+}
+
+// Hottest returns the statistics for up to n tracked inodes with the most
+// ops, busiest first.
+func (fs *InodeStatsFileSystem) Hottest(n int) []InodeOpStats {
+	fs.mu.Lock()
+	all := make([]InodeOpStats, 0, fs.lru.Len())
+	for e := fs.lru.Front(); e != nil; e = e.Next() {
+		all = append(all, *e.Value.(*InodeOpStats))
+	}
+	fs.mu.Unlock()
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Ops > all[j].Ops
+	})
+
+	if len(all) > n {
+		all = all[:n]
+	}
+
+	return all
+}
+
+// Reset discards all statistics.
+func (fs *InodeStatsFileSystem) Reset() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.lru.Init()
+	fs.index = make(map[fuseops.InodeID]*list.Element)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ops
+////////////////////////////////////////////////////////////////////////
+
+func (fs *InodeStatsFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.record(op.Parent, 0, 0)
+	return fs.FileSystem.LookUpInode(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.record(op.Inode, 0, 0)
+	return fs.FileSystem.GetInodeAttributes(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.record(op.Inode, 0, 0)
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.record(op.Parent, 0, 0)
+	return fs.FileSystem.MkDir(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	fs.record(op.Parent, 0, 0)
+	return fs.FileSystem.MkNode(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.record(op.Parent, 0, 0)
+	return fs.FileSystem.CreateFile(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	fs.record(op.Parent, 0, 0)
+	return fs.FileSystem.CreateLink(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	fs.record(op.Parent, 0, 0)
+	return fs.FileSystem.CreateSymlink(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	fs.record(op.OldParent, 0, 0)
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	fs.record(op.Parent, 0, 0)
+	return fs.FileSystem.RmDir(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	fs.record(op.Parent, 0, 0)
+	return fs.FileSystem.Unlink(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	fs.record(op.Inode, 0, 0)
+	return fs.FileSystem.OpenDir(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	err := fs.FileSystem.ReadDir(ctx, op)
+	if err != nil {
+		fs.record(op.Inode, 0, 0)
+		return err
+	}
+
+	fs.record(op.Inode, op.BytesRead, 0)
+	return nil
+}
+
+func (fs *InodeStatsFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	err := fs.FileSystem.ReadDirPlus(ctx, op)
+	if err != nil {
+		fs.record(op.Inode, 0, 0)
+		return err
+	}
+
+	var n int
+	for i := range op.Entries {
+		n += DirentPlusSize(op.Entries[i].Name)
+	}
+
+	fs.record(op.Inode, n, 0)
+	return nil
+}
+
+func (fs *InodeStatsFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.record(op.Inode, 0, 0)
+	return fs.FileSystem.OpenFile(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	err := fs.FileSystem.ReadFile(ctx, op)
+	if err != nil {
+		fs.record(op.Inode, 0, 0)
+		return err
+	}
+
+	fs.record(op.Inode, op.BytesRead, 0)
+	return nil
+}
+
+func (fs *InodeStatsFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	err := fs.FileSystem.WriteFile(ctx, op)
+	if err != nil {
+		fs.record(op.Inode, 0, 0)
+		return err
+	}
+
+	fs.record(op.Inode, 0, len(op.Data))
+	return nil
+}
+
+func (fs *InodeStatsFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fs.record(op.Inode, 0, 0)
+	return fs.FileSystem.SyncFile(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	fs.record(op.Inode, 0, 0)
+	return fs.FileSystem.FlushFile(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	fs.record(op.Inode, 0, 0)
+	return fs.FileSystem.ReadSymlink(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	fs.record(op.Inode, 0, 0)
+	return fs.FileSystem.RemoveXattr(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	err := fs.FileSystem.GetXattr(ctx, op)
+	if err != nil {
+		fs.record(op.Inode, 0, 0)
+		return err
+	}
+
+	fs.record(op.Inode, op.BytesRead, 0)
+	return nil
+}
+
+func (fs *InodeStatsFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	err := fs.FileSystem.ListXattr(ctx, op)
+	if err != nil {
+		fs.record(op.Inode, 0, 0)
+		return err
+	}
+
+	fs.record(op.Inode, op.BytesRead, 0)
+	return nil
+}
+
+func (fs *InodeStatsFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	err := fs.FileSystem.SetXattr(ctx, op)
+	if err != nil {
+		fs.record(op.Inode, 0, 0)
+		return err
+	}
+
+	fs.record(op.Inode, 0, len(op.Value))
+	return nil
+}
+
+func (fs *InodeStatsFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	fs.record(op.Inode, 0, 0)
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *InodeStatsFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	err := fs.FileSystem.CopyFileRange(ctx, op)
+	fs.record(op.SrcInode, 0, 0)
+	if err != nil {
+		fs.record(op.DstInode, 0, 0)
+		return err
+	}
+
+	fs.record(op.DstInode, 0, int(op.BytesCopied))
+	return nil
+}
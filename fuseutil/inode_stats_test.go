@@ -0,0 +1,71 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type statsTargetFS struct {
+	NotImplementedFileSystem
+}
+
+func (fs *statsTargetFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	op.BytesRead = 10
+	return nil
+}
+
+func (fs *statsTargetFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return nil
+}
+
+func TestInodeStats(t *testing.T) {
+	ctx := context.Background()
+	fs := NewInodeStatsFileSystem(&statsTargetFS{}, 2)
+
+	fs.ReadFile(ctx, &fuseops.ReadFileOp{Inode: 2})
+	fs.ReadFile(ctx, &fuseops.ReadFileOp{Inode: 2})
+	fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 2, Data: []byte("abc")})
+	fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 3, Data: []byte("a")})
+	fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: 1, Name: "foo"})
+
+	// Inode 2 was least recently used, so was evicted to make room for 1.
+	if _, ok := fs.Stats(2); ok {
+		t.Errorf("inode 2 still tracked")
+	}
+
+	fs.ReadFile(ctx, &fuseops.ReadFileOp{Inode: 3})
+
+	want := []InodeOpStats{
+		{Inode: 3, Ops: 2, BytesRead: 10, BytesWritten: 1},
+		{Inode: 1, Ops: 1},
+	}
+
+	if got := fs.Hottest(5); !reflect.DeepEqual(got, want) {
+		t.Errorf("Hottest = %+v, want %+v", got, want)
+	}
+
+	if got := fs.Hottest(1); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("Hottest(1) = %+v, want %+v", got, want[:1])
+	}
+}
@@ -0,0 +1,372 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// InodeStore is a persistent mapping from string keys (e.g. paths or object
+// names in a backing store) to inode IDs and generation numbers, so that inode
+// IDs survive restarts of the file system daemon. This is required for
+// re-exporting a file system over NFS, and is appreciated by tools that cache
+// by inode number.
+//
+// A key keeps its inode ID for as long as the store exists. When a key is
+// removed and later reappears it gets the same ID with an incremented
+// generation number, so that stale NFS handles for the old incarnation are
+// detected. IDs are never handed out to a different key, and
+// fuseops.RootInodeID is never handed out at all.
+//
+// The store is kept in a single file as a log of changes, each synced to disk
+// before the corresponding method returns, and compacted when opened.
+//
+// Safe for concurrent access.
+type InodeStore struct {
+	mu sync.Mutex
+
+	// The log file, open for appending.
+	//
+	// GUARDED_BY(mu)
+	f *os.File
+
+	// GUARDED_BY(mu)
+	entries map[string]*inodeStoreEntry
+
+	// The next ID to hand out.
+	//
+	// GUARDED_BY(mu)
+	nextID fuseops.InodeID
+}
+
+type inodeStoreEntry struct {
+	ID         fuseops.InodeID          `json:"id"`
+	Generation fuseops.GenerationNumber `json:"gen"`
+
+	// False if the key has been removed, in which case the ID is held in
+	// reserve for the key's return.
+	Live bool `json:"live"`
+}
+
+// A record in the log file. A nil entry means the key was deleted outright
+// (because its ID moved to another key). A record with NextID set instead
+// carries the next ID to hand out, which compaction writes so that IDs
+// retired along with their keys are not handed out again.
+type inodeStoreRecord struct {
+	Key    string           `json:"key"`
+	Entry  *inodeStoreEntry `json:"entry,omitempty"`
+	NextID fuseops.InodeID  `json:"next_id,omitempty"`
+}
+
+// OpenInodeStore opens the store kept in the file at the supplied path,
+// creating it if it doesn't exist. The caller must eventually call Close.
+func OpenInodeStore(path string) (*InodeStore, error) {
+	s := &InodeStore{
+		entries: make(map[string]*inodeStoreEntry),
+		nextID:  fuseops.RootInodeID + 1,
+	}
+
+	if err := s.load(path); err != nil {
+		return nil, err
+	}
+
+	if err := s.compact(path); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Replay the log at the supplied path, if any.
+func (s *InodeStore) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var r inodeStoreRecord
+		err := d.Decode(&r)
+		if err == io.EOF {
+			break
+		}
+
+		// Tolerate a record torn by a crash part way through writing it, but
+		// only at the end of the log.
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("Decoding %s: %v", path, err)
+		}
+
+		if r.NextID != 0 {
+			if r.NextID > s.nextID {
+				s.nextID = r.NextID
+			}
+
+			continue
+		}
+
+		if r.Entry == nil {
+			delete(s.entries, r.Key)
+			continue
+		}
+
+		s.entries[r.Key] = r.Entry
+		if r.Entry.ID >= s.nextID {
+			s.nextID = r.Entry.ID + 1
+		}
+	}
+
+	return nil
+}
+
+// Write out the current contents as a fresh log and open it for appending.
+func (s *InodeStore) compact(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	e := json.NewEncoder(w)
+	err = e.Encode(inodeStoreRecord{NextID: s.nextID})
+	for key, entry := range s.entries {
+		if err != nil {
+			break
+		}
+
+		err = e.Encode(inodeStoreRecord{Key: key, Entry: entry})
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// Make the rename itself durable, or a crash could bring back the old log
+	// after records have been appended to the new one.
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	s.f = tmp
+	return nil
+}
+
+// Sync the directory at the supplied path, making changes to its entries
+// durable.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Append records to the log and sync it.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(s.mu)
+func (s *InodeStore) append(records ...inodeStoreRecord) error {
+	var buf []byte
+	for _, r := range records {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		buf = append(append(buf, b...), '\n')
+	}
+
+	if _, err := s.f.Write(buf); err != nil {
+		return err
+	}
+
+	return s.f.Sync()
+}
+
+// LookUp returns the inode ID and generation number for the supplied key,
+// assigning them and recording the key as live if necessary.
+func (s *InodeStore) LookUp(
+	key string) (fuseops.InodeID, fuseops.GenerationNumber, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if ok && entry.Live {
+		return entry.ID, entry.Generation, nil
+	}
+
+	// Bring back a removed key with a new generation, or mint a new ID.
+	var updated inodeStoreEntry
+	if ok {
+		updated = *entry
+		updated.Generation++
+	} else {
+		updated.ID = s.nextID
+	}
+
+	updated.Live = true
+	if err := s.append(inodeStoreRecord{Key: key, Entry: &updated}); err != nil {
+		return 0, 0, err
+	}
+
+	s.entries[key] = &updated
+	if !ok {
+		s.nextID++
+	}
+
+	return updated.ID, updated.Generation, nil
+}
+
+// Key returns the live key to which the supplied ID is assigned, if any. This
+// requires a scan of the store.
+func (s *InodeStore) Key(id fuseops.InodeID) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, entry := range s.entries {
+		if entry.ID == id && entry.Live {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+// Remove records that the supplied key no longer exists. Its ID is kept for
+// the key's return. Removing a key that isn't live does nothing.
+func (s *InodeStore) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || !entry.Live {
+		return nil
+	}
+
+	updated := *entry
+	updated.Live = false
+	if err := s.append(inodeStoreRecord{Key: key, Entry: &updated}); err != nil {
+		return err
+	}
+
+	s.entries[key] = &updated
+	return nil
+}
+
+// Rename moves the ID and generation of the live key oldKey to newKey, so
+// that the inode keeps its ID across a rename. The ID of any inode previously
+// at newKey is retired for good, and oldKey gets a fresh ID if it is looked up
+// again. Returns ENOENT if oldKey isn't live.
+//
+// Keys are taken to be slash-separated paths: those below oldKey (with the
+// prefix oldKey+"/") move along with it, as when renaming a directory, and
+// likewise replace any at the corresponding keys below newKey.
+func (s *InodeStore) Rename(oldKey, newKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[oldKey]
+	if !ok || !entry.Live {
+		return syscall.ENOENT
+	}
+
+	if oldKey == newKey {
+		return nil
+	}
+
+	moved := map[string]*inodeStoreEntry{newKey: entry}
+	removed := []string{oldKey}
+	prefix := oldKey + "/"
+	for key, e := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			moved[newKey+"/"+key[len(prefix):]] = e
+			removed = append(removed, key)
+		}
+	}
+
+	// The replaced inodes' IDs, if any, are dropped along with their entries:
+	// they now belong to nobody and are never handed out again. All records go
+	// in one write, so that a crash can't leave a directory half moved.
+	var records []inodeStoreRecord
+	for _, key := range removed {
+		records = append(records, inodeStoreRecord{Key: key})
+	}
+
+	for key, e := range moved {
+		records = append(records, inodeStoreRecord{Key: key, Entry: e})
+	}
+
+	if err := s.append(records...); err != nil {
+		return err
+	}
+
+	for _, key := range removed {
+		delete(s.entries, key)
+	}
+
+	for key, e := range moved {
+		s.entries[key] = e
+	}
+
+	return nil
+}
+
+// Close closes the log file. The store must not be used afterward.
+func (s *InodeStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
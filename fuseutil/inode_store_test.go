@@ -0,0 +1,193 @@
+package fuseutil
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestInodeStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inodes")
+
+	s, err := OpenInodeStore(path)
+	if err != nil {
+		t.Fatalf("OpenInodeStore: %v", err)
+	}
+
+	foo, fooGen, err := s.LookUp("foo")
+	if err != nil {
+		t.Fatalf("LookUp: %v", err)
+	}
+
+	bar, _, _ := s.LookUp("bar")
+	if foo == fuseops.RootInodeID || foo == bar {
+		t.Errorf("Unexpected IDs: %v, %v", foo, bar)
+	}
+
+	if id, _, _ := s.LookUp("foo"); id != foo {
+		t.Errorf("LookUp(foo) = %v, want %v", id, foo)
+	}
+
+	// Removing and recreating a key keeps the ID and bumps the generation.
+	if err := s.Remove("foo"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	if _, ok := s.Key(foo); ok {
+		t.Errorf("Expected removed key not to be found")
+	}
+
+	if id, gen, _ := s.LookUp("foo"); id != foo || gen != fooGen+1 {
+		t.Errorf("LookUp(foo) = %v, %v, want %v, %v", id, gen, foo, fooGen+1)
+	}
+
+	// Renames move the ID.
+	if err := s.Rename("bar", "baz"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if err := s.Rename("bar", "qux"); err != syscall.ENOENT {
+		t.Errorf("Rename of missing key: %v, want ENOENT", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Everything survives reopening, and new IDs don't collide with old ones.
+	s, err = OpenInodeStore(path)
+	if err != nil {
+		t.Fatalf("OpenInodeStore: %v", err)
+	}
+	defer s.Close()
+
+	if id, gen, _ := s.LookUp("foo"); id != foo || gen != fooGen+1 {
+		t.Errorf("LookUp(foo) after reopen = %v, %v", id, gen)
+	}
+
+	if key, ok := s.Key(bar); !ok || key != "baz" {
+		t.Errorf("Key(%v) = %q, %v, want baz", bar, key, ok)
+	}
+
+	if id, _, _ := s.LookUp("bar"); id == foo || id == bar {
+		t.Errorf("LookUp(bar) reused ID %v", id)
+	}
+}
+
+func TestInodeStoreTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inodes")
+
+	s, err := OpenInodeStore(path)
+	if err != nil {
+		t.Fatalf("OpenInodeStore: %v", err)
+	}
+
+	foo, _, _ := s.LookUp("foo")
+	s.Close()
+
+	// Simulate a crash part way through appending a record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	f.WriteString(`{"key":"bar","entry":{"id":`)
+	f.Close()
+
+	s, err = OpenInodeStore(path)
+	if err != nil {
+		t.Fatalf("OpenInodeStore: %v", err)
+	}
+	defer s.Close()
+
+	if id, _, _ := s.LookUp("foo"); id != foo {
+		t.Errorf("LookUp(foo) = %v, want %v", id, foo)
+	}
+}
+
+func TestInodeStoreRetiredIDsSurviveReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inodes")
+	s, err := OpenInodeStore(path)
+	if err != nil {
+		t.Fatalf("OpenInodeStore: %v", err)
+	}
+
+	a, _, _ := s.LookUp("a")
+	b, _, _ := s.LookUp("b")
+	if err := s.Rename("a", "b"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	// Reopen twice, so that the records mentioning b's old ID are compacted
+	// away.
+	for i := 0; i < 2; i++ {
+		s.Close()
+		if s, err = OpenInodeStore(path); err != nil {
+			t.Fatalf("OpenInodeStore: %v", err)
+		}
+	}
+	defer s.Close()
+
+	c, _, err := s.LookUp("c")
+	if err != nil {
+		t.Fatalf("LookUp: %v", err)
+	}
+
+	if c == a || c == b {
+		t.Errorf("c got ID %d, already used by a (%d) or b (%d)", c, a, b)
+	}
+}
+
+func TestInodeStoreRenameDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inodes")
+	s, err := OpenInodeStore(path)
+	if err != nil {
+		t.Fatalf("OpenInodeStore: %v", err)
+	}
+
+	ids := make(map[string]fuseops.InodeID)
+	for _, key := range []string{"dir", "dir/a", "dir/sub", "dir/sub/b", "dirt", "other"} {
+		if ids[key], _, err = s.LookUp(key); err != nil {
+			t.Fatalf("LookUp(%s): %v", key, err)
+		}
+	}
+
+	if err := s.Rename("dir", "other"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	// Reopen, to check that the log says the same.
+	s.Close()
+	if s, err = OpenInodeStore(path); err != nil {
+		t.Fatalf("OpenInodeStore: %v", err)
+	}
+	defer s.Close()
+
+	// The directory's descendants keep their IDs at their new keys, and a key
+	// that merely shares a prefix stays put.
+	for oldKey, newKey := range map[string]string{
+		"dir":       "other",
+		"dir/a":     "other/a",
+		"dir/sub":   "other/sub",
+		"dir/sub/b": "other/sub/b",
+		"dirt":      "dirt",
+	} {
+		if key, ok := s.Key(ids[oldKey]); !ok || key != newKey {
+			t.Errorf("Key(%v) = %q, %v, want %q", ids[oldKey], key, ok, newKey)
+		}
+	}
+
+	// The old keys get fresh IDs, and the replaced ID is retired.
+	for _, key := range []string{"dir", "dir/a", "dir/sub/b"} {
+		if id, _, _ := s.LookUp(key); id == ids[key] {
+			t.Errorf("LookUp(%s) reused ID %v", key, id)
+		}
+	}
+
+	if _, ok := s.Key(ids["other"]); ok {
+		t.Errorf("Replaced ID %v still assigned", ids["other"])
+	}
+}
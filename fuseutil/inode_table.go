@@ -0,0 +1,196 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// InodeTable allocates inode IDs for file systems that don't have a natural
+// numbering of their own, and tracks the lookup counts the kernel holds on
+// them (see the notes on fuseops.ForgetInodeOp). Each inode carries an
+// arbitrary payload supplied by the user, typically a pointer to the file
+// system's own inode struct.
+//
+//   - Call Add when minting a new inode in reply to an op that returns a
+//     ChildInodeEntry, and LookedUp when returning an existing one. Both also
+//     supply the generation number to put in the entry.
+//
+//   - Call Forget for each ForgetInodeOp and BatchForgetOp entry. Once the
+//     count reaches zero the inode is dropped, the forget function passed to
+//     NewInodeTable (if any) is called with its payload, and its ID becomes
+//     available for reuse under a new generation number.
+//
+// The root inode is present from the start and is never dropped.
+//
+// Safe for concurrent access. The forget function is called with the table's
+// lock held, and so must not call back into the table.
+type InodeTable struct {
+	onForget func(fuseops.InodeID, interface{})
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*inodeTableEntry
+
+	// IDs that have been dropped, available for reuse, along with the
+	// generation number they had.
+	//
+	// GUARDED_BY(mu)
+	free []inodeTableFree
+
+	// The next never-used ID.
+	//
+	// GUARDED_BY(mu)
+	nextID fuseops.InodeID
+}
+
+type inodeTableEntry struct {
+	payload     interface{}
+	generation  fuseops.GenerationNumber
+	lookupCount uint64
+}
+
+type inodeTableFree struct {
+	id         fuseops.InodeID
+	generation fuseops.GenerationNumber
+}
+
+// NewInodeTable creates a table containing just the root inode, with the
+// supplied payload. If onForget is non-nil, it is called for each inode that
+// is dropped, including by Destroy.
+func NewInodeTable(
+	root interface{},
+	onForget func(id fuseops.InodeID, payload interface{})) *InodeTable {
+	return &InodeTable{
+		onForget: onForget,
+		inodes: map[fuseops.InodeID]*inodeTableEntry{
+			fuseops.RootInodeID: {payload: root},
+		},
+		nextID: fuseops.RootInodeID + 1,
+	}
+}
+
+// Add records a new inode with the supplied payload and a lookup count of
+// one, returning its ID and generation number.
+func (t *InodeTable) Add(
+	payload interface{}) (fuseops.InodeID, fuseops.GenerationNumber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := &inodeTableEntry{payload: payload, lookupCount: 1}
+
+	var id fuseops.InodeID
+	if n := len(t.free); n > 0 {
+		id = t.free[n-1].id
+		e.generation = t.free[n-1].generation + 1
+		t.free = t.free[:n-1]
+	} else {
+		id = t.nextID
+		t.nextID++
+	}
+
+	t.inodes[id] = e
+	return id, e.generation
+}
+
+// LookedUp increments the lookup count of the given inode, returning its
+// generation number. It returns false if the inode isn't in the table.
+func (t *InodeTable) LookedUp(
+	id fuseops.InodeID) (fuseops.GenerationNumber, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.inodes[id]
+	if !ok {
+		return 0, false
+	}
+
+	e.lookupCount++
+	return e.generation, true
+}
+
+// Get returns the payload of the given inode, if it is in the table.
+func (t *InodeTable) Get(id fuseops.InodeID) (interface{}, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.inodes[id]
+	if !ok {
+		return nil, false
+	}
+
+	return e.payload, true
+}
+
+// LookupCount returns the current lookup count of the given inode, or zero if
+// it isn't in the table.
+func (t *InodeTable) LookupCount(id fuseops.InodeID) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.inodes[id]; ok {
+		return e.lookupCount
+	}
+
+	return 0
+}
+
+// Forget decrements the lookup count of the given inode by n, as directed by
+// the kernel, dropping the inode and returning true if it reaches zero.
+func (t *InodeTable) Forget(id fuseops.InodeID, n uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.inodes[id]
+	if !ok {
+		return false
+	}
+
+	if n < e.lookupCount {
+		e.lookupCount -= n
+		return false
+	}
+
+	if id == fuseops.RootInodeID {
+		e.lookupCount = 0
+		return false
+	}
+
+	t.dropLocked(id, e)
+	t.free = append(t.free, inodeTableFree{id, e.generation})
+	return true
+}
+
+// Destroy drops every inode, including the root, as when the file system is
+// unmounted (cf. FileSystem.Destroy). The table must not be used afterward.
+func (t *InodeTable) Destroy() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, e := range t.inodes {
+		t.dropLocked(id, e)
+	}
+}
+
+// EXCLUSIVE_LOCKS_REQUIRED(t.mu)
+func (t *InodeTable) dropLocked(id fuseops.InodeID, e *inodeTableEntry) {
+	delete(t.inodes, id)
+	if t.onForget != nil {
+		t.onForget(id, e.payload)
+	}
+}
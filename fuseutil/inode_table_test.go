@@ -0,0 +1,87 @@
+package fuseutil
+
+import (
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestInodeTable(t *testing.T) {
+	forgotten := make(map[fuseops.InodeID]interface{})
+	tab := NewInodeTable("root", func(id fuseops.InodeID, payload interface{}) {
+		forgotten[id] = payload
+	})
+
+	if p, ok := tab.Get(fuseops.RootInodeID); !ok || p != "root" {
+		t.Errorf("Get(root) = %v, %v", p, ok)
+	}
+
+	id, gen := tab.Add("foo")
+	if id == fuseops.RootInodeID || gen != 0 {
+		t.Errorf("Add(foo) = %v, %v", id, gen)
+	}
+
+	if _, ok := tab.LookedUp(id); !ok {
+		t.Fatal("LookedUp failed")
+	}
+
+	// Forgets may be split, as across batch forget entries.
+	if tab.Forget(id, 1) {
+		t.Error("Forgotten too early")
+	}
+
+	if n := tab.LookupCount(id); n != 1 {
+		t.Errorf("LookupCount = %v", n)
+	}
+
+	if !tab.Forget(id, 1) {
+		t.Error("Not forgotten")
+	}
+
+	if _, ok := tab.Get(id); ok || forgotten[id] != "foo" {
+		t.Errorf("Inode not dropped: %v", forgotten)
+	}
+
+	// The ID comes back with a new generation.
+	reused, gen := tab.Add("bar")
+	if reused != id || gen != 1 {
+		t.Errorf("Add(bar) = %v, %v", reused, gen)
+	}
+
+	// The root is never dropped by forgets, only by Destroy.
+	if tab.Forget(fuseops.RootInodeID, 10) {
+		t.Error("Root forgotten")
+	}
+
+	tab.Destroy()
+	if len(forgotten) != 2 || forgotten[fuseops.RootInodeID] != "root" {
+		t.Errorf("After Destroy: %v", forgotten)
+	}
+}
+
+func TestHandleTable(t *testing.T) {
+	tab := NewHandleTable()
+
+	h1 := tab.Add("a")
+	h2 := tab.Add("b")
+	if h1 == 0 || h1 == h2 {
+		t.Errorf("Add = %v, %v", h1, h2)
+	}
+
+	if p, ok := tab.Get(h2); !ok || p != "b" {
+		t.Errorf("Get = %v, %v", p, ok)
+	}
+
+	if p, ok := tab.Release(h1); !ok || p != "a" {
+		t.Errorf("Release = %v, %v", p, ok)
+	}
+
+	if _, ok := tab.Release(h1); ok {
+		t.Error("Released twice")
+	}
+
+	// Released IDs aren't reused.
+	if h3 := tab.Add("c"); h3 == h1 || tab.Len() != 2 {
+		t.Errorf("Add = %v, Len = %v", h3, tab.Len())
+	}
+}
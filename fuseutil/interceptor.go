@@ -0,0 +1,373 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// An Interceptor is called in place of a FileSystem method by a file system
+// returned by NewInterceptingFileSystem, with the method's op (e.g. a
+// *fuseops.ReadFileOp) and a function that carries on to the next interceptor
+// or, for the last one, the wrapped method. It may inspect or modify the op,
+// call next zero or more times, possibly with a different context, and return
+// an error of its choosing.
+//
+// This makes it easy to layer concerns that apply to all ops, such as
+// logging, access control, rate limiting or retries, without a wrapper
+// method for every op type.
+type Interceptor func(
+	ctx context.Context,
+	op interface{},
+	next func(ctx context.Context) error) error
+
+// NewInterceptingFileSystem wraps the supplied file system so that each of
+// its methods other than Destroy is called through the supplied interceptors,
+// the first of which is outermost.
+func NewInterceptingFileSystem(
+	wrapped FileSystem,
+	interceptors ...Interceptor) FileSystem {
+	return &interceptingFS{
+		FileSystem:   wrapped,
+		interceptors: interceptors,
+	}
+}
+
+type interceptingFS struct {
+	FileSystem
+	interceptors []Interceptor
+}
+
+// Run the interceptors from the i'th onward for the supplied op, finishing
+// with call.
+func (fs *interceptingFS) intercept(
+	i int,
+	ctx context.Context,
+	op interface{},
+	call func(ctx context.Context) error) error {
+	if i == len(fs.interceptors) {
+		return call(ctx)
+	}
+
+	return fs.interceptors[i](ctx, op, func(ctx context.Context) error {
+		return fs.intercept(i+1, ctx, op, call)
+	})
+}
+
+func (fs *interceptingFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.StatFS(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.LookUpInode(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.GetInodeAttributes(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.SetInodeAttributes(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.Access(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.ForgetInode(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.BatchForget(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.MkDir(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.MkNode(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.CreateFile(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.CreateLink(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.CreateSymlink(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.Rename(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.RmDir(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.Unlink(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.OpenDir(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.ReadDir(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.ReadDirPlus(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.ReleaseDirHandle(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.OpenFile(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.ReadFile(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.WriteFile(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.SyncFile(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.FlushFile(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.ReleaseFileHandle(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) GetLk(
+	ctx context.Context,
+	op *fuseops.GetLkOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.GetLk(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) SetLk(
+	ctx context.Context,
+	op *fuseops.SetLkOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.SetLk(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) SetLkW(
+	ctx context.Context,
+	op *fuseops.SetLkWOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.SetLkW(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.ReadSymlink(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.RemoveXattr(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.GetXattr(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.ListXattr(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.SetXattr(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.Fallocate(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.CopyFileRange(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) LSeek(
+	ctx context.Context,
+	op *fuseops.LSeekOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.LSeek(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.Ioctl(ctx, op)
+	})
+}
+
+func (fs *interceptingFS) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	return fs.intercept(0, ctx, op, func(ctx context.Context) error {
+		return fs.FileSystem.Poll(ctx, op)
+	})
+}
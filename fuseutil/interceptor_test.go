@@ -0,0 +1,93 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type interceptKey struct{}
+
+// Records the context value seen by LookUpInode.
+type interceptTargetFS struct {
+	NotImplementedFileSystem
+	seen interface{}
+}
+
+func (fs *interceptTargetFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.seen = ctx.Value(interceptKey{})
+	op.Entry.Child = 17
+	return nil
+}
+
+func TestInterceptors(t *testing.T) {
+	var calls []string
+	logging := func(name string) Interceptor {
+		return func(
+			ctx context.Context,
+			op interface{},
+			next func(context.Context) error) error {
+			calls = append(calls, fmt.Sprintf("%s %T", name, op))
+			return next(context.WithValue(ctx, interceptKey{}, name))
+		}
+	}
+
+	deny := func(
+		ctx context.Context,
+		op interface{},
+		next func(context.Context) error) error {
+		if _, ok := op.(*fuseops.UnlinkOp); ok {
+			return syscall.EACCES
+		}
+
+		return next(ctx)
+	}
+
+	wrapped := &interceptTargetFS{}
+	fs := NewInterceptingFileSystem(wrapped, logging("outer"), deny, logging("inner"))
+
+	op := &fuseops.LookUpInodeOp{}
+	if err := fs.LookUpInode(context.Background(), op); err != nil || op.Entry.Child != 17 {
+		t.Fatalf("LookUpInode: %v, %+v", err, op.Entry)
+	}
+
+	want := []string{"outer *fuseops.LookUpInodeOp", "inner *fuseops.LookUpInodeOp"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("Calls: got %q, want %q", calls, want)
+	}
+
+	// The innermost context reaches the file system.
+	if wrapped.seen != "inner" {
+		t.Errorf("Context value: got %v", wrapped.seen)
+	}
+
+	// Interceptors may fail ops without calling on.
+	calls = nil
+	if err := fs.Unlink(context.Background(), &fuseops.UnlinkOp{}); err != syscall.EACCES {
+		t.Errorf("Unlink: got %v, want EACCES", err)
+	}
+
+	if want := []string{"outer *fuseops.UnlinkOp"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("Calls: got %q, want %q", calls, want)
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewIOFSFileSystem returns a read-only file system serving the contents of
+// fsys, e.g. an embed.FS, a *zip.Reader or an fstest.MapFS:
+//
+//	server := fuseutil.NewFileSystemServer(fuseutil.NewIOFSFileSystem(fsys))
+//	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{ReadOnly: true})
+//
+// Inode IDs are derived from paths using an InodeHasher. Files and
+// directories are owned by the user running the process, and those whose
+// fs.FileInfo has no permission bits set (as is common for fstest.MapFS) are
+// given 0444 or 0555 respectively. Since fsys is assumed not to change while
+// mounted, the kernel is allowed to keep file contents cached across opens.
+//
+// Files are read using io.ReaderAt or io.Seeker if they implement them, and
+// otherwise by reading sequentially, reopening the file if the kernel asks
+// for an earlier offset. Symlinks are followed if fsys follows them, as
+// os.DirFS does; they can't be served as such.
+//
+// Ops that would modify the file system fail with ENOSYS, as for
+// NotImplementedFileSystem; mount with MountConfig.ReadOnly to have the kernel
+// refuse them with EROFS instead.
+func NewIOFSFileSystem(fsys iofs.FS) FileSystem {
+	return &ioFS{
+		fsys:       fsys,
+		uid:        uint32(os.Getuid()),
+		gid:        uint32(os.Getgid()),
+		inodes:     NewInodeHasher(),
+		lookups:    make(map[string]uint64),
+		handles:    make(map[fuseops.HandleID]*ioFSHandle),
+		nextHandle: 1,
+	}
+}
+
+type ioFS struct {
+	NotImplementedFileSystem
+
+	fsys     iofs.FS
+	uid, gid uint32
+	inodes   *InodeHasher
+
+	mu sync.Mutex
+
+	// The kernel's lookup count for each path other than the root's.
+	//
+	// GUARDED_BY(mu)
+	lookups map[string]uint64
+
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]*ioFSHandle
+
+	// GUARDED_BY(mu)
+	nextHandle fuseops.HandleID
+}
+
+// An open file or directory.
+type ioFSHandle struct {
+	name string
+
+	// The directory's entries, for directory handles.
+	entries []iofs.DirEntry
+
+	// For file handles: the open file, and our offset within it if it has to
+	// be read sequentially.
+	mu  sync.Mutex
+	f   iofs.File // GUARDED_BY(mu)
+	pos int64     // GUARDED_BY(mu)
+}
+
+// Return the path within fsys of the supplied inode.
+func (fs *ioFS) pathOf(id fuseops.InodeID) (string, error) {
+	if id == fuseops.RootInodeID {
+		return ".", nil
+	}
+
+	name, ok := fs.inodes.Key(id)
+	if !ok {
+		return "", fuse.ENOENT
+	}
+
+	return name, nil
+}
+
+func (fs *ioFS) attributes(name string) (fuseops.InodeAttributes, error) {
+	fi, err := iofs.Stat(fs.fsys, name)
+	if err != nil {
+		return fuseops.InodeAttributes{}, ioFSError(err)
+	}
+
+	attrs := AttributesFromFileInfo(fi)
+	attrs.Uid = fs.uid
+	attrs.Gid = fs.gid
+
+	if attrs.Mode.Perm() == 0 {
+		if attrs.Mode.IsDir() {
+			attrs.Mode |= 0555
+		} else {
+			attrs.Mode |= 0444
+		}
+	}
+
+	if attrs.Mode.IsDir() {
+		attrs.Nlink = 2
+	}
+
+	return attrs, nil
+}
+
+// Translate an error from fsys into one for the kernel.
+func ioFSError(err error) error {
+	switch {
+	case errors.Is(err, iofs.ErrNotExist):
+		return fuse.ENOENT
+
+	case errors.Is(err, iofs.ErrPermission):
+		return syscall.EACCES
+
+	case errors.Is(err, iofs.ErrInvalid):
+		return fuse.EINVAL
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return err
+	}
+
+	return fuse.WrapError(fuse.EIO, err, "fs.FS")
+}
+
+func (fs *ioFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *ioFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := fs.pathOf(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	name := path.Join(parent, op.Name)
+	if !iofs.ValidPath(name) {
+		return fuse.ENOENT
+	}
+
+	attrs, err := fs.attributes(name)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	fs.lookups[name]++
+	fs.mu.Unlock()
+
+	op.Entry.Child = fs.inodes.ID(name)
+	op.Entry.Attributes = attrs
+	return nil
+}
+
+func (fs *ioFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	name, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes, err = fs.attributes(name)
+	return err
+}
+
+func (fs *ioFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	name, err := fs.pathOf(op.Inode)
+	if err != nil || op.Inode == fuseops.RootInodeID {
+		return nil
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.lookups[name] > op.N {
+		fs.lookups[name] -= op.N
+		return nil
+	}
+
+	delete(fs.lookups, name)
+	fs.inodes.Forget(name)
+	return nil
+}
+
+func (fs *ioFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: e.Inode, N: e.N})
+	}
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *ioFS) newHandle(h *ioFSHandle) fuseops.HandleID {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id := fs.nextHandle
+	fs.nextHandle++
+	fs.handles[id] = h
+	return id
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *ioFS) handle(id fuseops.HandleID) (*ioFSHandle, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	h, ok := fs.handles[id]
+	if !ok {
+		return nil, fuse.EINVAL
+	}
+
+	return h, nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *ioFS) releaseHandle(id fuseops.HandleID) *ioFSHandle {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	h := fs.handles[id]
+	delete(fs.handles, id)
+	return h
+}
+
+func (fs *ioFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	name, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	// Snapshot the listing, so that offsets stay meaningful for the life of
+	// the handle.
+	entries, err := iofs.ReadDir(fs.fsys, name)
+	if err != nil {
+		return ioFSError(err)
+	}
+
+	op.Handle = fs.newHandle(&ioFSHandle{name: name, entries: entries})
+	return nil
+}
+
+func (fs *ioFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	h, err := fs.handle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	for i := int(op.Offset); i < len(h.entries); i++ {
+		e := h.entries[i]
+		d := Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  HashInodeID(path.Join(h.name, e.Name())),
+			Name:   e.Name(),
+			Type:   DirentTypeForMode(e.Type()),
+		}
+
+		n := WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *ioFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.releaseHandle(op.Handle)
+	return nil
+}
+
+func (fs *ioFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	name, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.fsys.Open(name)
+	if err != nil {
+		return ioFSError(err)
+	}
+
+	op.Handle = fs.newHandle(&ioFSHandle{name: name, f: f})
+	op.KeepPageCache = true
+	return nil
+}
+
+func (fs *ioFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	h, err := fs.handle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if r, ok := h.f.(io.ReaderAt); ok {
+		op.BytesRead, err = r.ReadAt(op.Dst, op.Offset)
+	} else {
+		err = fs.seekLocked(h, op.Offset)
+		if err == nil {
+			op.BytesRead, err = io.ReadFull(h.f, op.Dst)
+			h.pos += int64(op.BytesRead)
+		}
+	}
+
+	// Short reads are how the kernel learns of EOF.
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	if err != nil {
+		return ioFSError(err)
+	}
+
+	return nil
+}
+
+// Move the handle's file to the supplied offset, for files that don't
+// implement io.ReaderAt.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(h.mu)
+func (fs *ioFS) seekLocked(h *ioFSHandle, off int64) error {
+	if off == h.pos {
+		return nil
+	}
+
+	if s, ok := h.f.(io.Seeker); ok {
+		pos, err := s.Seek(off, io.SeekStart)
+		h.pos = pos
+		return err
+	}
+
+	// Start again from the beginning if we've gone past the offset.
+	if off < h.pos {
+		f, err := fs.fsys.Open(h.name)
+		if err != nil {
+			return err
+		}
+
+		h.f.Close()
+		h.f = f
+		h.pos = 0
+	}
+
+	n, err := io.CopyN(io.Discard, h.f, off-h.pos)
+	h.pos += n
+	return err
+}
+
+func (fs *ioFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	if h := fs.releaseHandle(op.Handle); h != nil && h.f != nil {
+		h.f.Close()
+	}
+
+	return nil
+}
+
+func (fs *ioFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
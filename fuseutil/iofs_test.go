@@ -0,0 +1,148 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// An fs.FS whose files support neither io.ReaderAt nor io.Seeker, like those
+// of a zip.Reader.
+type sequentialFS struct {
+	fs.FS
+}
+
+type sequentialFile struct {
+	f fs.File
+}
+
+func (f sequentialFile) Stat() (fs.FileInfo, error) { return f.f.Stat() }
+func (f sequentialFile) Read(p []byte) (int, error) { return f.f.Read(p) }
+func (f sequentialFile) Close() error               { return f.f.Close() }
+
+func (s sequentialFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return sequentialFile{f}, nil
+}
+
+func (s sequentialFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(s.FS, name)
+}
+
+func TestIOFS(t *testing.T) {
+	ctx := context.Background()
+	fsys := fstest.MapFS{
+		"dir/a":    {Data: []byte("taco")},
+		"dir/b":    {Data: []byte("burrito"), Mode: 0600},
+		"dir/sub/": {Mode: fs.ModeDir},
+	}
+
+	for _, tc := range []struct {
+		name string
+		fsys fs.FS
+	}{
+		{"MapFS", fsys},
+		{"sequential", sequentialFS{fsys}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := NewIOFSFileSystem(tc.fsys)
+
+			// Look up the directory and list it.
+			lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "dir"}
+			if err := fs.LookUpInode(ctx, lookUp); err != nil {
+				t.Fatalf("LookUpInode: %v", err)
+			}
+
+			dir := lookUp.Entry.Child
+			if m := lookUp.Entry.Attributes.Mode; !m.IsDir() || m.Perm() != 0555 {
+				t.Errorf("Directory mode: %v", m)
+			}
+
+			openDir := &fuseops.OpenDirOp{Inode: dir}
+			if err := fs.OpenDir(ctx, openDir); err != nil {
+				t.Fatalf("OpenDir: %v", err)
+			}
+
+			readDir := &fuseops.ReadDirOp{Handle: openDir.Handle, Dst: make([]byte, 4096)}
+			if err := fs.ReadDir(ctx, readDir); err != nil {
+				t.Fatalf("ReadDir: %v", err)
+			}
+
+			names, _ := parseDirents(t, readDir.Dst[:readDir.BytesRead])
+			if want := []string{"a", "b", "sub"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("Names = %q, want %q", names, want)
+			}
+
+			// Look up a file, which keeps its permissions, and read it out of order.
+			lookUp = &fuseops.LookUpInodeOp{Parent: dir, Name: "b"}
+			if err := fs.LookUpInode(ctx, lookUp); err != nil {
+				t.Fatalf("LookUpInode: %v", err)
+			}
+
+			if attrs := lookUp.Entry.Attributes; attrs.Size != 7 || attrs.Mode != 0600 {
+				t.Errorf("File attributes: %+v", attrs)
+			}
+
+			openFile := &fuseops.OpenFileOp{Inode: lookUp.Entry.Child}
+			if err := fs.OpenFile(ctx, openFile); err != nil {
+				t.Fatalf("OpenFile: %v", err)
+			}
+
+			for _, r := range []struct {
+				off  int64
+				size int
+				want string
+			}{{3, 8, "rito"}, {0, 3, "bur"}, {5, 2, "to"}} {
+				read := &fuseops.ReadFileOp{
+					Handle: openFile.Handle,
+					Offset: r.off,
+					Dst:    make([]byte, r.size),
+				}
+
+				if err := fs.ReadFile(ctx, read); err != nil {
+					t.Fatalf("ReadFile(%d): %v", r.off, err)
+				}
+
+				if got := string(read.Dst[:read.BytesRead]); got != r.want {
+					t.Errorf("ReadFile(%d) = %q, want %q", r.off, got, r.want)
+				}
+			}
+
+			fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: openFile.Handle})
+
+			// Missing names and forgotten inodes are reported as such.
+			if err := fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: dir, Name: "c"}); err != fuse.ENOENT {
+				t.Errorf("LookUpInode(c): %v, want ENOENT", err)
+			}
+
+			fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: lookUp.Entry.Child, N: 1})
+			getAttrs := &fuseops.GetInodeAttributesOp{Inode: lookUp.Entry.Child}
+			if err := fs.GetInodeAttributes(ctx, getAttrs); err != fuse.ENOENT {
+				t.Errorf("GetInodeAttributes after forget: %v, want ENOENT", err)
+			}
+		})
+	}
+}
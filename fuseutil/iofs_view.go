@@ -0,0 +1,473 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewIOFS returns a read-only io/fs.FS view of the supplied file system that
+// sends it ops directly, as the kernel would for the corresponding system
+// calls on a mount, but without mounting. This lets application code and
+// tests use the same data in process, e.g. with fs.WalkDir or
+// template.ParseFS, where a kernel mount is unavailable or unnecessary.
+//
+// The result also implements fs.StatFS and fs.ReadDirFS, and the files it
+// opens implement io.ReaderAt and io.Seeker. Every op is sent with the
+// supplied context and a zero OpContext. The lookup counts the file system is
+// told about are balanced with ForgetInodeOps once the view is done with an
+// inode, and handles are released when files are closed. Symlinks are not
+// followed; Stat reports them as such.
+//
+// The file system must support LookUpInode and GetInodeAttributes, and
+// OpenFile/ReadFile and OpenDir/ReadDir for reading files and directories.
+// As with a mount using MountConfig.EnableNoOpenSupport, ENOSYS from OpenFile
+// or OpenDir is taken to mean that no handle is needed.
+func NewIOFS(ctx context.Context, fs FileSystem) iofs.FS {
+	return &ioFSView{
+		ctx: ctx,
+		fs:  fs,
+	}
+}
+
+type ioFSView struct {
+	ctx context.Context
+	fs  FileSystem
+}
+
+var _ iofs.StatFS = &ioFSView{}
+var _ iofs.ReadDirFS = &ioFSView{}
+
+// Translate an error from the file system into one for fs.FS users. Errnos
+// already satisfy errors.Is for fs.ErrNotExist and friends.
+func ioFSViewError(op, name string, err error) error {
+	return &iofs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Look up the inode with the supplied name, returning its attributes and a
+// function the caller must call once done with it to balance the lookup
+// counts.
+func (v *ioFSView) resolve(
+	op string,
+	name string) (
+	entry fuseops.ChildInodeEntry,
+	release func(),
+	err error) {
+	if !iofs.ValidPath(name) {
+		return entry, nil, ioFSViewError(op, name, iofs.ErrInvalid)
+	}
+
+	var looked []fuseops.InodeID
+	release = func() {
+		for i := len(looked) - 1; i >= 0; i-- {
+			v.fs.ForgetInode(v.ctx, &fuseops.ForgetInodeOp{Inode: looked[i], N: 1})
+		}
+	}
+
+	entry.Child = fuseops.RootInodeID
+	getAttrs := &fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	if err = v.fs.GetInodeAttributes(v.ctx, getAttrs); err != nil {
+		return entry, nil, ioFSViewError(op, name, err)
+	}
+
+	entry.Attributes = getAttrs.Attributes
+	if name == "." {
+		return entry, release, nil
+	}
+
+	// Walk down from the root, keeping every inode we pass until release.
+	var parent fuseops.InodeID = fuseops.RootInodeID
+	for i, c := range strings.Split(name, "/") {
+		if i > 0 && !entry.Attributes.Mode.IsDir() {
+			release()
+			return entry, nil, ioFSViewError(op, name, syscall.ENOTDIR)
+		}
+
+		lookUp := &fuseops.LookUpInodeOp{Parent: parent, Name: c}
+		if err = v.fs.LookUpInode(v.ctx, lookUp); err != nil {
+			release()
+			return entry, nil, ioFSViewError(op, name, err)
+		}
+
+		entry = lookUp.Entry
+		parent = entry.Child
+		looked = append(looked, entry.Child)
+	}
+
+	return entry, release, nil
+}
+
+func (v *ioFSView) Stat(name string) (iofs.FileInfo, error) {
+	entry, release, err := v.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	release()
+	return FileInfoFromAttributes(path.Base(name), entry.Attributes), nil
+}
+
+func (v *ioFSView) Open(name string) (iofs.File, error) {
+	entry, release, err := v.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &ioFSViewFile{
+		v:       v,
+		name:    name,
+		inode:   entry.Child,
+		attrs:   entry.Attributes,
+		release: release,
+		handle:  ioFSViewNoHandle,
+	}
+
+	if entry.Attributes.Mode.IsDir() {
+		op := &fuseops.OpenDirOp{Inode: entry.Child}
+		err = v.fs.OpenDir(v.ctx, op)
+		if err == nil {
+			f.handle = op.Handle
+		}
+	} else {
+		op := &fuseops.OpenFileOp{Inode: entry.Child, OpenFlags: syscall.O_RDONLY}
+		err = v.fs.OpenFile(v.ctx, op)
+		if err == nil {
+			f.handle = op.Handle
+		}
+	}
+
+	if err != nil && !errors.Is(err, syscall.ENOSYS) {
+		release()
+		return nil, ioFSViewError("open", name, err)
+	}
+
+	return f, nil
+}
+
+func (v *ioFSView) ReadDir(name string) ([]iofs.DirEntry, error) {
+	f, err := v.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d, ok := f.(iofs.ReadDirFile)
+	if !ok || !f.(*ioFSViewFile).attrs.Mode.IsDir() {
+		return nil, ioFSViewError("readdir", name, syscall.ENOTDIR)
+	}
+
+	entries, err := d.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, err
+}
+
+// A sentinel for files opened without a handle (cf. ENOSYS from OpenFile).
+// The kernel uses zero, but that is a valid handle for most file systems.
+const ioFSViewNoHandle = ^fuseops.HandleID(0)
+
+// A file or directory opened by ioFSView.Open.
+type ioFSViewFile struct {
+	v       *ioFSView
+	name    string
+	inode   fuseops.InodeID
+	attrs   fuseops.InodeAttributes
+	release func()
+	handle  fuseops.HandleID
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	closed bool
+
+	// The read offset, for files.
+	//
+	// GUARDED_BY(mu)
+	off int64
+
+	// The entries not yet returned by ReadDir, and whether we've read them
+	// from the file system yet, for directories.
+	//
+	// GUARDED_BY(mu)
+	entries []iofs.DirEntry
+	listed  bool // GUARDED_BY(mu)
+}
+
+// The handle to put in ops, which is zero if there isn't one.
+func (f *ioFSViewFile) opHandle() fuseops.HandleID {
+	if f.handle == ioFSViewNoHandle {
+		return 0
+	}
+
+	return f.handle
+}
+
+func (f *ioFSViewFile) Stat() (iofs.FileInfo, error) {
+	op := &fuseops.GetInodeAttributesOp{Inode: f.inode}
+	if err := f.v.fs.GetInodeAttributes(f.v.ctx, op); err != nil {
+		return nil, ioFSViewError("stat", f.name, err)
+	}
+
+	return FileInfoFromAttributes(path.Base(f.name), op.Attributes), nil
+}
+
+func (f *ioFSViewFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt(p, f.off)
+	f.off += int64(n)
+
+	// Read, unlike ReadAt, mustn't report EOF before the end.
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *ioFSViewFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.readAt(p, off)
+}
+
+func (f *ioFSViewFile) readAt(p []byte, off int64) (int, error) {
+	if f.attrs.Mode.IsDir() {
+		return 0, ioFSViewError("read", f.name, syscall.EISDIR)
+	}
+
+	// The file system may return less than asked only at EOF.
+	op := &fuseops.ReadFileOp{
+		Inode:  f.inode,
+		Handle: f.opHandle(),
+		Offset: off,
+		Size:   int64(len(p)),
+		Dst:    p,
+	}
+
+	if err := f.v.fs.ReadFile(f.v.ctx, op); err != nil {
+		return 0, ioFSViewError("read", f.name, err)
+	}
+
+	n := op.BytesRead
+	if op.Data != nil {
+		n = 0
+		for _, b := range op.Data {
+			n += copy(p[n:], b)
+		}
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *ioFSViewFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+
+	case io.SeekEnd:
+		fi, err := f.Stat()
+		if err != nil {
+			return f.off, err
+		}
+
+		offset += fi.Size()
+	}
+
+	if offset < 0 {
+		return f.off, ioFSViewError("seek", f.name, iofs.ErrInvalid)
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *ioFSViewFile) ReadDir(n int) ([]iofs.DirEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.attrs.Mode.IsDir() {
+		return nil, ioFSViewError("readdir", f.name, syscall.ENOTDIR)
+	}
+
+	if !f.listed {
+		entries, err := f.listLocked()
+		if err != nil {
+			return nil, ioFSViewError("readdir", f.name, err)
+		}
+
+		f.entries = entries
+		f.listed = true
+	}
+
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+// Read the whole directory from the file system.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(f.mu)
+func (f *ioFSViewFile) listLocked() ([]iofs.DirEntry, error) {
+	var entries []iofs.DirEntry
+	var offset fuseops.DirOffset
+	buf := make([]byte, 64<<10)
+
+	for {
+		op := &fuseops.ReadDirOp{
+			Inode:  f.inode,
+			Handle: f.opHandle(),
+			Offset: offset,
+			Dst:    buf,
+		}
+
+		if err := f.v.fs.ReadDir(f.v.ctx, op); err != nil {
+			return nil, err
+		}
+
+		if op.BytesRead == 0 {
+			return entries, nil
+		}
+
+		dirents, err := ParseDirents(buf[:op.BytesRead])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range dirents {
+			offset = d.Offset
+			if d.Name == "." || d.Name == ".." {
+				continue
+			}
+
+			entries = append(entries, &ioFSViewDirEntry{
+				v:    f.v,
+				path: path.Join(f.name, d.Name),
+				typ:  d.Type,
+			})
+		}
+	}
+}
+
+func (f *ioFSViewFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return ioFSViewError("close", f.name, iofs.ErrClosed)
+	}
+
+	f.closed = true
+	defer f.release()
+
+	if f.handle == ioFSViewNoHandle {
+		return nil
+	}
+
+	var err error
+	if f.attrs.Mode.IsDir() {
+		err = f.v.fs.ReleaseDirHandle(
+			f.v.ctx,
+			&fuseops.ReleaseDirHandleOp{Handle: f.handle})
+	} else {
+		// As close(2) would.
+		flush := &fuseops.FlushFileOp{Inode: f.inode, Handle: f.handle}
+		if err = f.v.fs.FlushFile(f.v.ctx, flush); errors.Is(err, syscall.ENOSYS) {
+			err = nil
+		}
+
+		f.v.fs.ReleaseFileHandle(
+			f.v.ctx,
+			&fuseops.ReleaseFileHandleOp{Handle: f.handle})
+	}
+
+	if err != nil {
+		return ioFSViewError("close", f.name, err)
+	}
+
+	return nil
+}
+
+// An entry returned by ioFSViewFile.ReadDir.
+type ioFSViewDirEntry struct {
+	v    *ioFSView
+	path string
+	typ  DirentType
+}
+
+func (e *ioFSViewDirEntry) Name() string { return path.Base(e.path) }
+func (e *ioFSViewDirEntry) IsDir() bool  { return e.Type().IsDir() }
+
+func (e *ioFSViewDirEntry) Type() iofs.FileMode {
+	switch e.typ {
+	case DT_Directory:
+		return iofs.ModeDir
+	case DT_Link:
+		return iofs.ModeSymlink
+	case DT_FIFO:
+		return iofs.ModeNamedPipe
+	case DT_Socket:
+		return iofs.ModeSocket
+	case DT_Char:
+		return iofs.ModeDevice | iofs.ModeCharDevice
+	case DT_Block:
+		return iofs.ModeDevice
+	case DT_File:
+		return 0
+	}
+
+	// The file system didn't say, so ask.
+	if fi, err := e.Info(); err == nil {
+		return fi.Mode().Type()
+	}
+
+	return iofs.ModeIrregular
+}
+
+func (e *ioFSViewDirEntry) Info() (iofs.FileInfo, error) {
+	return e.v.Stat(e.path)
+}
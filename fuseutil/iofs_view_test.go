@@ -0,0 +1,61 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIOFSView(t *testing.T) {
+	mapFS := fstest.MapFS{
+		"a":         {Data: []byte("taco")},
+		"dir/b":     {Data: []byte("burrito")},
+		"dir/sub/c": {Data: make([]byte, 100<<10)},
+	}
+
+	// Serve the map through a FileSystem and view it as an fs.FS again.
+	wrapped := NewIOFSFileSystem(mapFS)
+	view := NewIOFS(context.Background(), wrapped)
+
+	if err := fstest.TestFS(view, "a", "dir/b", "dir/sub/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := fs.ReadFile(view, "dir/b")
+	if err != nil || string(data) != "burrito" {
+		t.Errorf("ReadFile: %q, %v", data, err)
+	}
+
+	if _, err := fs.Stat(view, "dir/nope"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of missing file: %v", err)
+	}
+
+	if _, err := fs.Stat(view, "a/b"); err == nil {
+		t.Errorf("Expected an error for a path through a file")
+	}
+
+	// Every lookup should have been balanced by a forget.
+	f := wrapped.(*ioFS)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.lookups) != 0 || len(f.handles) != 0 {
+		t.Errorf("Leaked lookups %v and handles %v", f.lookups, f.handles)
+	}
+}
@@ -0,0 +1,525 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func init() {
+	// The ops that a Journal records.
+	gob.Register(&fuseops.SetInodeAttributesOp{})
+	gob.Register(&fuseops.MkDirOp{})
+	gob.Register(&fuseops.MkNodeOp{})
+	gob.Register(&fuseops.CreateFileOp{})
+	gob.Register(&fuseops.CreateLinkOp{})
+	gob.Register(&fuseops.CreateSymlinkOp{})
+	gob.Register(&fuseops.RenameOp{})
+	gob.Register(&fuseops.RmDirOp{})
+	gob.Register(&fuseops.UnlinkOp{})
+	gob.Register(&fuseops.WriteFileOp{})
+	gob.Register(&fuseops.FallocateOp{})
+	gob.Register(&fuseops.CopyFileRangeOp{})
+	gob.Register(&fuseops.SetXattrOp{})
+	gob.Register(&fuseops.RemoveXattrOp{})
+}
+
+// The size of the header preceding each journal record: the length of the
+// record and its CRC-32, both little endian uint32s.
+const journalHeaderSize = 8
+
+// Journal is a log of mutating ops kept in a local file, for file systems
+// that acknowledge changes before they are durable in their backing store
+// (e.g. one that uploads asynchronously). Ops are appended, and synced to
+// disk, once the file system has applied them and before they are
+// acknowledged to the kernel; once the backing store has caught up the
+// journal is reset. After a crash, the ops still in the journal are replayed
+// with ReplayJournal before serving.
+//
+// See NewJournalingFileSystem for doing this automatically.
+//
+// Safe for concurrent access.
+type Journal struct {
+	path string
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	f *os.File
+
+	// The sequence number of the next record.
+	//
+	// GUARDED_BY(mu)
+	nextSeq uint64
+}
+
+type journalRecord struct {
+	Seq uint64
+	Op  interface{}
+}
+
+// OpenJournal opens the journal kept in the file at the supplied path,
+// creating it if it doesn't exist. A record torn by a crash while it was being
+// appended is discarded. The caller must eventually call Close.
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{path: path, f: f}
+
+	// Find the end of the last intact record, and chop off anything after it.
+	var end int64
+	err = j.scan(func(r *journalRecord, off int64) error {
+		j.nextSeq = r.Seq + 1
+		end = off
+		return nil
+	})
+
+	if err == nil {
+		err = f.Truncate(end)
+	}
+
+	if err == nil {
+		_, err = f.Seek(end, io.SeekStart)
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Call fn for each intact record in the file, along with the offset just past
+// it. The caller must hold j.mu unless j hasn't been shared yet.
+func (j *Journal) scan(fn func(r *journalRecord, end int64) error) error {
+	r := bufio.NewReader(io.NewSectionReader(j.f, 0, 1<<62))
+
+	var off int64
+	var header [journalHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			// EOF or a torn header.
+			return nil
+		}
+
+		n := binary.LittleEndian.Uint32(header[0:4])
+		sum := binary.LittleEndian.Uint32(header[4:8])
+
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil
+		}
+
+		if crc32.ChecksumIEEE(payload) != sum {
+			return nil
+		}
+
+		var rec journalRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+			return fmt.Errorf("Decoding journal record: %v", err)
+		}
+
+		off += journalHeaderSize + int64(n)
+		if err := fn(&rec, off); err != nil {
+			return err
+		}
+	}
+}
+
+// Append records the supplied op, which must be a pointer to one of the
+// mutating op types (e.g. *fuseops.WriteFileOp), and syncs the journal to
+// disk. It returns the op's sequence number.
+func (j *Journal) Append(op interface{}) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	seq := j.nextSeq
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(&journalRecord{Seq: seq, Op: op}); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, journalHeaderSize, journalHeaderSize+payload.Len())
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	buf = append(buf, payload.Bytes()...)
+
+	if _, err := j.f.Write(buf); err != nil {
+		return 0, err
+	}
+
+	if err := j.f.Sync(); err != nil {
+		return 0, err
+	}
+
+	j.nextSeq++
+	return seq, nil
+}
+
+// Replay calls fn for each op in the journal, in the order they were
+// appended, stopping at the first error.
+func (j *Journal) Replay(fn func(seq uint64, op interface{}) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.scan(func(r *journalRecord, end int64) error {
+		return fn(r.Seq, r.Op)
+	})
+}
+
+// Reset discards the ops in the journal with sequence numbers up to and
+// including upTo, keeping any appended since. Call it once their effects are
+// durable in the backing store. Sequence numbers are not reused.
+func (j *Journal) Reset(upTo uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// Find where the ops to keep begin.
+	var start, end int64
+	keep := false
+	err := j.scan(func(r *journalRecord, off int64) error {
+		if r.Seq <= upTo {
+			start = off
+		} else {
+			keep = true
+		}
+
+		end = off
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// The common case: nothing has been appended since.
+	if !keep {
+		if err := j.f.Truncate(0); err != nil {
+			return err
+		}
+
+		if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		return j.f.Sync()
+	}
+
+	// Otherwise write the rest to a new file and swap it in, so that a crash
+	// part way through leaves one journal or the other intact.
+	tmp, err := os.OpenFile(j.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, io.NewSectionReader(j.f, start, end-start))
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), j.path)
+	}
+
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	j.f.Close()
+	j.f = tmp
+	return nil
+}
+
+// Close closes the journal's file, leaving its contents in place.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.f.Close()
+}
+
+// ReplayJournal re-applies the ops in the journal to the supplied file
+// system, in order, and then resets the journal. Call it before mounting.
+//
+// The backing store may already reflect some of the ops, so creating what
+// already exists (EEXIST) and removing or renaming what no longer exists
+// (ENOENT, or ENOATTR for xattrs) are taken to mean that the op was applied
+// before the crash, and replay carries on.
+//
+// Ops are replayed with their original inode IDs, so the file system must
+// assign inode IDs that are stable across restarts (cf. InodeStore). Writes
+// and copies are replayed through handles opened for the purpose with
+// OpenFile, and handles created by CreateFile are released again.
+func ReplayJournal(ctx context.Context, j *Journal, fs FileSystem) error {
+	handles := make(map[fuseops.InodeID]fuseops.HandleID)
+	defer func() {
+		for _, h := range handles {
+			fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: h})
+		}
+	}()
+
+	// Open a handle for the inode, or reuse the one opened earlier.
+	handle := func(inode fuseops.InodeID) (fuseops.HandleID, error) {
+		if h, ok := handles[inode]; ok {
+			return h, nil
+		}
+
+		open := &fuseops.OpenFileOp{Inode: inode}
+		if err := fs.OpenFile(ctx, open); err != nil {
+			return 0, err
+		}
+
+		handles[inode] = open.Handle
+		return open.Handle, nil
+	}
+
+	var last uint64
+	replayed := false
+	err := j.Replay(func(seq uint64, op interface{}) error {
+		last = seq
+		replayed = true
+
+		var err error
+		switch typed := op.(type) {
+		case *fuseops.SetInodeAttributesOp:
+			err = fs.SetInodeAttributes(ctx, typed)
+
+		case *fuseops.MkDirOp:
+			err = fs.MkDir(ctx, typed)
+
+		case *fuseops.MkNodeOp:
+			err = fs.MkNode(ctx, typed)
+
+		case *fuseops.CreateFileOp:
+			if err = fs.CreateFile(ctx, typed); err == nil {
+				fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: typed.Handle})
+			}
+
+		case *fuseops.CreateLinkOp:
+			err = fs.CreateLink(ctx, typed)
+
+		case *fuseops.CreateSymlinkOp:
+			err = fs.CreateSymlink(ctx, typed)
+
+		case *fuseops.RenameOp:
+			err = fs.Rename(ctx, typed)
+
+		case *fuseops.RmDirOp:
+			err = fs.RmDir(ctx, typed)
+
+		case *fuseops.UnlinkOp:
+			err = fs.Unlink(ctx, typed)
+
+		case *fuseops.WriteFileOp:
+			if typed.Handle, err = handle(typed.Inode); err == nil {
+				err = fs.WriteFile(ctx, typed)
+			}
+
+		case *fuseops.FallocateOp:
+			err = fs.Fallocate(ctx, typed)
+
+		case *fuseops.CopyFileRangeOp:
+			if typed.SrcHandle, err = handle(typed.SrcInode); err != nil {
+				break
+			}
+
+			if typed.DstHandle, err = handle(typed.DstInode); err == nil {
+				err = fs.CopyFileRange(ctx, typed)
+			}
+
+		case *fuseops.SetXattrOp:
+			err = fs.SetXattr(ctx, typed)
+
+		case *fuseops.RemoveXattrOp:
+			err = fs.RemoveXattr(ctx, typed)
+
+		default:
+			err = fmt.Errorf("unexpected op type %T", op)
+		}
+
+		if err != nil && !alreadyApplied(op, err) {
+			return fmt.Errorf("Replaying journal record %d: %w", seq, err)
+		}
+
+		return nil
+	})
+
+	if err != nil || !replayed {
+		return err
+	}
+
+	return j.Reset(last)
+}
+
+// Whether the supplied error from replaying op shows that its effect was
+// already in the backing store.
+func alreadyApplied(op interface{}, err error) bool {
+	switch op.(type) {
+	case *fuseops.MkDirOp,
+		*fuseops.MkNodeOp,
+		*fuseops.CreateFileOp,
+		*fuseops.CreateLinkOp,
+		*fuseops.CreateSymlinkOp:
+		return errors.Is(err, syscall.EEXIST)
+
+	case *fuseops.RmDirOp, *fuseops.UnlinkOp, *fuseops.RenameOp:
+		return errors.Is(err, syscall.ENOENT)
+
+	case *fuseops.RemoveXattrOp:
+		return errors.Is(err, fuse.ENOATTR)
+	}
+
+	return false
+}
+
+// NewJournalingFileSystem wraps the supplied file system so that each
+// mutating op it applies successfully is appended to the journal before being
+// acknowledged. Ops that fail aren't journaled, so that replaying the journal
+// doesn't repeat them. If appending fails the op fails with EIO, although the
+// wrapped file system has applied it.
+//
+// The wrapped file system is responsible for calling j.Reset when its
+// backing store has caught up, e.g. in SyncFile or after a background upload,
+// with the sequence number of the last op it covers (cf. Journal.Append).
+func NewJournalingFileSystem(wrapped FileSystem, j *Journal) FileSystem {
+	return &journalingFS{
+		FileSystem: wrapped,
+		j:          j,
+	}
+}
+
+type journalingFS struct {
+	FileSystem
+	j *Journal
+}
+
+// Journal op, if the wrapped file system applied it without error, and
+// return the error with which to reply.
+func (fs *journalingFS) record(op interface{}, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if _, err := fs.j.Append(op); err != nil {
+		return fuse.WrapError(syscall.EIO, err, "Journal.Append")
+	}
+
+	return nil
+}
+
+func (fs *journalingFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.record(op, fs.FileSystem.SetInodeAttributes(ctx, op))
+}
+
+func (fs *journalingFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.record(op, fs.FileSystem.MkDir(ctx, op))
+}
+
+func (fs *journalingFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.record(op, fs.FileSystem.MkNode(ctx, op))
+}
+
+func (fs *journalingFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.record(op, fs.FileSystem.CreateFile(ctx, op))
+}
+
+func (fs *journalingFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return fs.record(op, fs.FileSystem.CreateLink(ctx, op))
+}
+
+func (fs *journalingFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.record(op, fs.FileSystem.CreateSymlink(ctx, op))
+}
+
+func (fs *journalingFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.record(op, fs.FileSystem.Rename(ctx, op))
+}
+
+func (fs *journalingFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.record(op, fs.FileSystem.RmDir(ctx, op))
+}
+
+func (fs *journalingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.record(op, fs.FileSystem.Unlink(ctx, op))
+}
+
+func (fs *journalingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.record(op, fs.FileSystem.WriteFile(ctx, op))
+}
+
+func (fs *journalingFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return fs.record(op, fs.FileSystem.Fallocate(ctx, op))
+}
+
+func (fs *journalingFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	return fs.record(op, fs.FileSystem.CopyFileRange(ctx, op))
+}
+
+func (fs *journalingFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.record(op, fs.FileSystem.SetXattr(ctx, op))
+}
+
+func (fs *journalingFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.record(op, fs.FileSystem.RemoveXattr(ctx, op))
+}
@@ -0,0 +1,212 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type replayTargetFS struct {
+	NotImplementedFileSystem
+	ops []string
+}
+
+func (fs *replayTargetFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.ops = append(fs.ops, fmt.Sprintf("mkdir %d/%s", op.Parent, op.Name))
+	return nil
+}
+
+func (fs *replayTargetFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.Handle = 7
+	fs.ops = append(fs.ops, fmt.Sprintf("open %d", op.Inode))
+	return nil
+}
+
+func (fs *replayTargetFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.ops = append(fs.ops, fmt.Sprintf("write %d@%d %d:%s", op.Inode, op.Handle, op.Offset, op.Data))
+	return nil
+}
+
+func (fs *replayTargetFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.ops = append(fs.ops, fmt.Sprintf("release %d", op.Handle))
+	return nil
+}
+
+func (fs *replayTargetFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	fs.ops = append(fs.ops, fmt.Sprintf("unlink %d/%s", op.Parent, op.Name))
+	return fuse.ENOENT
+}
+
+func (fs *replayTargetFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	fs.ops = append(fs.ops, fmt.Sprintf("symlink %d/%s", op.Parent, op.Name))
+	return fuse.EEXIST
+}
+
+func TestJournalReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+
+	fs := NewJournalingFileSystem(&replayTargetFS{}, j)
+	fs.MkDir(ctx, &fuseops.MkDirOp{Parent: 1, Name: "dir"})
+	fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 3, Handle: 99, Offset: 4, Data: []byte("taco")})
+
+	// Ops that fail aren't journaled.
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "nope"}); err == nil {
+		t.Fatalf("Expected Unlink to fail")
+	}
+	j.Close()
+
+	// Simulate a crash part way through appending another record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	f.Write([]byte{0xff, 0, 0, 0, 1, 2})
+	f.Close()
+
+	if j, err = OpenJournal(path); err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	defer j.Close()
+
+	target := &replayTargetFS{}
+	if err := ReplayJournal(ctx, j, target); err != nil {
+		t.Fatalf("ReplayJournal: %v", err)
+	}
+
+	want := []string{
+		"mkdir 1/dir",
+		"open 3",
+		"write 3@7 4:taco",
+		"release 7",
+	}
+
+	if !reflect.DeepEqual(target.ops, want) {
+		t.Errorf("replayed %q, want %q", target.ops, want)
+	}
+
+	// The journal is empty afterward, and sequence numbers carry on.
+	var n int
+	j.Replay(func(uint64, interface{}) error { n++; return nil })
+	if n != 0 {
+		t.Errorf("%d records left after replay", n)
+	}
+
+	if seq, err := j.Append(&fuseops.UnlinkOp{Parent: 1, Name: "x"}); err != nil || seq != 2 {
+		t.Errorf("Append: (%d, %v), want (2, nil)", seq, err)
+	}
+}
+
+func TestJournalReplayAlreadyApplied(t *testing.T) {
+	ctx := context.Background()
+	j, err := OpenJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	defer j.Close()
+
+	// Ops the backing store had already applied before the crash.
+	j.Append(&fuseops.CreateSymlinkOp{Parent: 1, Name: "link"})
+	j.Append(&fuseops.UnlinkOp{Parent: 1, Name: "gone"})
+	j.Append(&fuseops.MkDirOp{Parent: 1, Name: "dir"})
+
+	target := &replayTargetFS{}
+	if err := ReplayJournal(ctx, j, target); err != nil {
+		t.Fatalf("ReplayJournal: %v", err)
+	}
+
+	want := []string{"symlink 1/link", "unlink 1/gone", "mkdir 1/dir"}
+	if !reflect.DeepEqual(target.ops, want) {
+		t.Errorf("replayed %q, want %q", target.ops, want)
+	}
+
+	// Other errors still stop replay, and leave the journal alone.
+	j.Append(&fuseops.RmDirOp{Parent: 1, Name: "dir"})
+	if err := ReplayJournal(ctx, j, target); err == nil {
+		t.Errorf("Expected an error for ENOSYS")
+	}
+
+	var n int
+	j.Replay(func(uint64, interface{}) error { n++; return nil })
+	if n != 1 {
+		t.Errorf("%d records left, want 1", n)
+	}
+}
+
+func TestJournalResetUpTo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := j.Append(&fuseops.UnlinkOp{Parent: 1, Name: name}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	// Only the ops the backing store has caught up with are dropped.
+	if err := j.Reset(1); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+
+	if seq, err := j.Append(&fuseops.UnlinkOp{Parent: 1, Name: "d"}); err != nil || seq != 3 {
+		t.Errorf("Append: (%d, %v), want (3, nil)", seq, err)
+	}
+
+	j.Close()
+
+	// And the rest survive reopening.
+	if j, err = OpenJournal(path); err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	defer j.Close()
+
+	var got []string
+	j.Replay(func(seq uint64, op interface{}) error {
+		got = append(got, fmt.Sprintf("%d:%s", seq, op.(*fuseops.UnlinkOp).Name))
+		return nil
+	})
+
+	if want := []string{"2:c", "3:d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Records: %q, want %q", got, want)
+	}
+}
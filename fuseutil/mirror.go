@@ -0,0 +1,623 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// ErrMirrorQueueFull is passed to MirrorConfig.OnError when a mutation is
+// dropped because the queue is full.
+var ErrMirrorQueueFull = errors.New("mirror queue full")
+
+// Configuration for NewMirroringFileSystem.
+type MirrorConfig struct {
+	// The number of mutations that may be waiting to be applied to the
+	// secondary. Defaults to 1024.
+	QueueLength int
+
+	// If set, a mutation that arrives when the queue is full is dropped, and
+	// reported to OnError with ErrMirrorQueueFull, rather than making the op
+	// wait. The secondary is likely to diverge after this.
+	DropWhenFull bool
+
+	// Called, from the goroutine applying mutations, for each mutation that
+	// couldn't be applied to the secondary. op is the copy of the op made for
+	// the secondary, with whatever IDs had been translated when it failed. May
+	// be nil.
+	OnError func(op interface{}, err error)
+}
+
+// MirroringFileSystem wraps a primary FileSystem, applying each mutation that
+// succeeds on it to a secondary FileSystem in the background, in the order
+// the primary completed them. This gives a simple replication or backup path
+// for data served through a mount. Failures on the secondary don't affect the
+// primary's ops; they are reported to MirrorConfig.OnError.
+//
+// The two file systems needn't agree on inode IDs or handles; the mirror maps
+// between them. It learns the secondary's ID for an inode when the inode is
+// created through the mirror, or when the kernel looks it up in the primary,
+// in which case the same lookup is made in the secondary. The mirror never
+// forgets secondary inodes, so the secondary's lookup counts only grow.
+//
+// Call Close to wait for outstanding mutations after unmounting.
+type MirroringFileSystem struct {
+	FileSystem
+	secondary FileSystem
+	cfg       MirrorConfig
+
+	queue   chan mirrorTask
+	stopped chan struct{}
+
+	// Held for reading while sending to queue, and for writing by Close.
+	mu sync.RWMutex
+
+	// GUARDED_BY(mu)
+	closed bool
+
+	/////////////////////////
+	// Accessed only by the goroutine applying mutations.
+	/////////////////////////
+
+	// Secondary IDs for primary inodes other than the root.
+	inodes map[fuseops.InodeID]fuseops.InodeID
+
+	// Secondary handles for primary file handles.
+	handles map[fuseops.HandleID]fuseops.HandleID
+}
+
+type mirrorTask struct {
+	op    interface{}
+	apply func(ctx context.Context) error
+}
+
+// NewMirroringFileSystem wraps primary, mirroring its mutations to secondary.
+func NewMirroringFileSystem(
+	primary FileSystem,
+	secondary FileSystem,
+	cfg MirrorConfig) *MirroringFileSystem {
+	if cfg.QueueLength <= 0 {
+		cfg.QueueLength = 1024
+	}
+
+	m := &MirroringFileSystem{
+		FileSystem: primary,
+		secondary:  secondary,
+		cfg:        cfg,
+		queue:      make(chan mirrorTask, cfg.QueueLength),
+		stopped:    make(chan struct{}),
+		inodes:     make(map[fuseops.InodeID]fuseops.InodeID),
+		handles:    make(map[fuseops.HandleID]fuseops.HandleID),
+	}
+
+	go m.run()
+	return m
+}
+
+// Close stops accepting mutations and waits for those queued to be applied.
+// Mutations made through the file system afterward are not mirrored.
+func (m *MirroringFileSystem) Close() {
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	m.mu.Unlock()
+
+	<-m.stopped
+}
+
+func (m *MirroringFileSystem) run() {
+	defer close(m.stopped)
+
+	ctx := context.Background()
+	for t := range m.queue {
+		if err := t.apply(ctx); err != nil && m.cfg.OnError != nil {
+			m.cfg.OnError(t.op, err)
+		}
+	}
+}
+
+// Queue a mutation that succeeded on the primary.
+func (m *MirroringFileSystem) enqueue(
+	op interface{},
+	apply func(ctx context.Context) error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return
+	}
+
+	t := mirrorTask{op: op, apply: apply}
+	if !m.cfg.DropWhenFull {
+		m.queue <- t
+		return
+	}
+
+	select {
+	case m.queue <- t:
+	default:
+		if m.cfg.OnError != nil {
+			m.cfg.OnError(op, ErrMirrorQueueFull)
+		}
+	}
+}
+
+// Translate a primary inode ID.
+func (m *MirroringFileSystem) inode(id fuseops.InodeID) (fuseops.InodeID, error) {
+	if id == fuseops.RootInodeID {
+		return id, nil
+	}
+
+	s, ok := m.inodes[id]
+	if !ok {
+		return 0, fmt.Errorf("inode %d not known to the mirror", id)
+	}
+
+	return s, nil
+}
+
+// Translate a primary file handle.
+func (m *MirroringFileSystem) handle(h fuseops.HandleID) (fuseops.HandleID, error) {
+	s, ok := m.handles[h]
+	if !ok {
+		return 0, fmt.Errorf("handle %d not known to the mirror", h)
+	}
+
+	return s, nil
+}
+
+// Look up in the secondary a name that the primary has returned as the
+// supplied child, unless the child is already known.
+func (m *MirroringFileSystem) mirrorLookUp(
+	parent fuseops.InodeID,
+	name string,
+	child fuseops.InodeID,
+	opCtx fuseops.OpContext) {
+	s := fuseops.LookUpInodeOp{Name: name, OpContext: opCtx}
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if _, ok := m.inodes[child]; ok || child == fuseops.RootInodeID {
+			return nil
+		}
+
+		if s.Parent, err = m.inode(parent); err != nil {
+			return err
+		}
+
+		if err = m.secondary.LookUpInode(ctx, &s); err != nil {
+			return err
+		}
+
+		m.inodes[child] = s.Entry.Child
+		return nil
+	})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ops
+////////////////////////////////////////////////////////////////////////
+
+func (m *MirroringFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := m.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	m.mirrorLookUp(op.Parent, op.Name, op.Entry.Child, op.OpContext)
+	return nil
+}
+
+func (m *MirroringFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if err := m.FileSystem.ReadDirPlus(ctx, op); err != nil {
+		return err
+	}
+
+	for _, e := range op.Entries {
+		if e.Name != "." && e.Name != ".." {
+			m.mirrorLookUp(op.Inode, e.Name, e.Entry.Child, op.OpContext)
+		}
+	}
+
+	return nil
+}
+
+func (m *MirroringFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := m.FileSystem.SetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Inode, err = m.inode(s.Inode); err != nil {
+			return err
+		}
+
+		if s.Handle != nil {
+			h, err := m.handle(*s.Handle)
+			if err != nil {
+				return err
+			}
+
+			s.Handle = &h
+		}
+
+		return m.secondary.SetInodeAttributes(ctx, &s)
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if err := m.FileSystem.MkDir(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	child := op.Entry.Child
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Parent, err = m.inode(s.Parent); err != nil {
+			return err
+		}
+
+		if err = m.secondary.MkDir(ctx, &s); err != nil {
+			return err
+		}
+
+		m.inodes[child] = s.Entry.Child
+		return nil
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	if err := m.FileSystem.MkNode(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	child := op.Entry.Child
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Parent, err = m.inode(s.Parent); err != nil {
+			return err
+		}
+
+		if err = m.secondary.MkNode(ctx, &s); err != nil {
+			return err
+		}
+
+		m.inodes[child] = s.Entry.Child
+		return nil
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := m.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	child := op.Entry.Child
+	handle := op.Handle
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Parent, err = m.inode(s.Parent); err != nil {
+			return err
+		}
+
+		if err = m.secondary.CreateFile(ctx, &s); err != nil {
+			return err
+		}
+
+		m.inodes[child] = s.Entry.Child
+		m.handles[handle] = s.Handle
+		return nil
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if err := m.FileSystem.CreateLink(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Parent, err = m.inode(s.Parent); err != nil {
+			return err
+		}
+
+		if s.Target, err = m.inode(s.Target); err != nil {
+			return err
+		}
+
+		return m.secondary.CreateLink(ctx, &s)
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if err := m.FileSystem.CreateSymlink(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	child := op.Entry.Child
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Parent, err = m.inode(s.Parent); err != nil {
+			return err
+		}
+
+		if err = m.secondary.CreateSymlink(ctx, &s); err != nil {
+			return err
+		}
+
+		m.inodes[child] = s.Entry.Child
+		return nil
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	if err := m.FileSystem.Rename(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.OldParent, err = m.inode(s.OldParent); err != nil {
+			return err
+		}
+
+		if s.NewParent, err = m.inode(s.NewParent); err != nil {
+			return err
+		}
+
+		return m.secondary.Rename(ctx, &s)
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if err := m.FileSystem.RmDir(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Parent, err = m.inode(s.Parent); err != nil {
+			return err
+		}
+
+		return m.secondary.RmDir(ctx, &s)
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := m.FileSystem.Unlink(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Parent, err = m.inode(s.Parent); err != nil {
+			return err
+		}
+
+		return m.secondary.Unlink(ctx, &s)
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if err := m.FileSystem.OpenFile(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	handle := op.Handle
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Inode, err = m.inode(s.Inode); err != nil {
+			return err
+		}
+
+		if err = m.secondary.OpenFile(ctx, &s); err != nil {
+			return err
+		}
+
+		m.handles[handle] = s.Handle
+		return nil
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if err := m.FileSystem.WriteFile(ctx, op); err != nil {
+		return err
+	}
+
+	// The kernel reuses the op's buffer once we return, so take a copy.
+	s := *op
+	s.Data = append([]byte(nil), op.Data...)
+	s.Callback = nil
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Inode, err = m.inode(s.Inode); err != nil {
+			return err
+		}
+
+		if s.Handle, err = m.handle(s.Handle); err != nil {
+			return err
+		}
+
+		return m.secondary.WriteFile(ctx, &s)
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	err := m.FileSystem.ReleaseFileHandle(ctx, op)
+
+	// Release the secondary's handle regardless, to avoid leaking it.
+	s := *op
+	handle := op.Handle
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Handle, err = m.handle(s.Handle); err != nil {
+			return err
+		}
+
+		delete(m.handles, handle)
+		return m.secondary.ReleaseFileHandle(ctx, &s)
+	})
+
+	return err
+}
+
+func (m *MirroringFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	if err := m.FileSystem.Fallocate(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Inode, err = m.inode(s.Inode); err != nil {
+			return err
+		}
+
+		if s.Handle, err = m.handle(s.Handle); err != nil {
+			return err
+		}
+
+		return m.secondary.Fallocate(ctx, &s)
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	if err := m.FileSystem.CopyFileRange(ctx, op); err != nil {
+		return err
+	}
+
+	// Copy only what the primary did.
+	s := *op
+	s.Length = op.BytesCopied
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.SrcInode, err = m.inode(s.SrcInode); err != nil {
+			return err
+		}
+
+		if s.SrcHandle, err = m.handle(s.SrcHandle); err != nil {
+			return err
+		}
+
+		if s.DstInode, err = m.inode(s.DstInode); err != nil {
+			return err
+		}
+
+		if s.DstHandle, err = m.handle(s.DstHandle); err != nil {
+			return err
+		}
+
+		return m.secondary.CopyFileRange(ctx, &s)
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	if err := m.FileSystem.SetXattr(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	s.Value = append([]byte(nil), op.Value...)
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Inode, err = m.inode(s.Inode); err != nil {
+			return err
+		}
+
+		return m.secondary.SetXattr(ctx, &s)
+	})
+
+	return nil
+}
+
+func (m *MirroringFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	if err := m.FileSystem.RemoveXattr(ctx, op); err != nil {
+		return err
+	}
+
+	s := *op
+	m.enqueue(&s, func(ctx context.Context) (err error) {
+		if s.Inode, err = m.inode(s.Inode); err != nil {
+			return err
+		}
+
+		return m.secondary.RemoveXattr(ctx, &s)
+	})
+
+	return nil
+}
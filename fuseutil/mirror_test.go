@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A file system that assigns inode IDs and handles from a base, and records
+// the ops it sees.
+type mirrorTargetFS struct {
+	NotImplementedFileSystem
+	base fuseops.InodeID
+	ops  []string
+}
+
+func (fs *mirrorTargetFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	op.Entry.Child = fs.base + 1
+	op.Handle = fuseops.HandleID(fs.base) + 2
+	fs.ops = append(fs.ops, fmt.Sprintf("create %d/%s", op.Parent, op.Name))
+	return nil
+}
+
+func (fs *mirrorTargetFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.ops = append(fs.ops, fmt.Sprintf("write %d %d %s", op.Inode, op.Handle, op.Data))
+	return nil
+}
+
+func (fs *mirrorTargetFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.ops = append(fs.ops, fmt.Sprintf("release %d", op.Handle))
+	return nil
+}
+
+func (fs *mirrorTargetFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	fs.ops = append(fs.ops, fmt.Sprintf("unlink %d/%s", op.Parent, op.Name))
+	return nil
+}
+
+func TestMirroringFileSystem(t *testing.T) {
+	ctx := context.Background()
+	primary := &mirrorTargetFS{base: 10}
+	secondary := &mirrorTargetFS{base: 100}
+
+	var errs []error
+	m := NewMirroringFileSystem(primary, secondary, MirrorConfig{
+		OnError: func(op interface{}, err error) { errs = append(errs, err) },
+	})
+
+	create := &fuseops.CreateFileOp{Parent: 1, Name: "f"}
+	m.CreateFile(ctx, create)
+
+	data := []byte("taco")
+	m.WriteFile(ctx, &fuseops.WriteFileOp{Inode: create.Entry.Child, Handle: create.Handle, Data: data})
+	copy(data, "XXXX")
+
+	m.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: create.Handle})
+	m.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "f"})
+
+	// An inode the mirror has never heard of.
+	m.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 99, Handle: 12})
+	m.Close()
+
+	want := []string{
+		"create 1/f",
+		"write 101 102 taco",
+		"release 102",
+		"unlink 1/f",
+	}
+
+	if !reflect.DeepEqual(secondary.ops, want) {
+		t.Errorf("secondary saw %q, want %q", secondary.ops, want)
+	}
+
+	if len(errs) != 1 {
+		t.Errorf("errors: %v, want one", errs)
+	}
+}
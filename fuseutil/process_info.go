@@ -0,0 +1,138 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+	"time"
+)
+
+// ProcessInfo contains metadata about the process that issued an op, as
+// identified by fuseops.OpContext.Pid.
+//
+// Any field other than Pid may be empty if the information could not be
+// obtained, for example because the process belongs to another user or has
+// already exited.
+type ProcessInfo struct {
+	Pid uint32
+
+	// The absolute path of the executable image of the process.
+	Executable string
+
+	// The command line arguments of the process, including argv[0].
+	Cmdline []string
+
+	// The cgroup of the process (Linux only). For cgroup v1 hierarchies this is
+	// the path within the first hierarchy listed.
+	Cgroup string
+
+	// An opaque value identifying this incarnation of the PID. Two ProcessInfo
+	// values with the same Pid but different StartTime describe different
+	// processes.
+	StartTime uint64
+}
+
+// LookUpProcessInfo resolves the supplied PID to metadata about the process.
+// It returns an error if the process does not exist or the platform is not
+// supported.
+//
+// Beware that PIDs are recycled: by the time this function returns, the
+// process that issued an op may have exited and its PID reused. Callers making
+// security decisions should prefer ProcessInfoCache, which detects reuse.
+func LookUpProcessInfo(pid uint32) (*ProcessInfo, error) {
+	return lookUpProcessInfo(pid)
+}
+
+// ProcessInfoCache caches the results of LookUpProcessInfo for a limited
+// time, since an op-heavy process may otherwise cause the same /proc entries
+// to be read thousands of times a second.
+//
+// Cached entries are revalidated against the process start time, so a
+// recycled PID is never attributed to a previous process. Safe for concurrent
+// use.
+type ProcessInfoCache struct {
+	ttl time.Duration
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	entries map[uint32]processInfoCacheEntry
+}
+
+type processInfoCacheEntry struct {
+	info    *ProcessInfo
+	expires time.Time
+}
+
+// NewProcessInfoCache creates a cache whose entries are considered fresh for
+// the supplied duration.
+func NewProcessInfoCache(ttl time.Duration) *ProcessInfoCache {
+	return &ProcessInfoCache{
+		ttl:     ttl,
+		entries: make(map[uint32]processInfoCacheEntry),
+	}
+}
+
+// LookUp returns metadata for the supplied PID, consulting the cache first.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *ProcessInfoCache) LookUp(pid uint32) (*ProcessInfo, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[pid]
+	c.mu.Unlock()
+
+	// Make sure a fresh entry still describes the same process.
+	if ok && now.Before(e.expires) {
+		if st, err := processStartTime(pid); err == nil && st == e.info.StartTime {
+			return e.info, nil
+		}
+	}
+
+	info, err := lookUpProcessInfo(pid)
+	if err != nil {
+		c.Forget(pid)
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[pid] = processInfoCacheEntry{
+		info:    info,
+		expires: now.Add(c.ttl),
+	}
+
+	// Opportunistically drop stale entries so the map doesn't grow without
+	// bound for short-lived processes.
+	for p, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, p)
+		}
+	}
+
+	return info, nil
+}
+
+// Forget discards any cached information for the supplied PID.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *ProcessInfoCache) Forget(pid uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, pid)
+}
@@ -0,0 +1,89 @@
+package fuseutil
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func procPath(pid uint32, name string) string {
+	return fmt.Sprintf("/proc/%d/%s", pid, name)
+}
+
+// Read the start time of the process from field 22 of /proc/<pid>/stat, which
+// together with the PID uniquely identifies a process.
+func processStartTime(pid uint32) (uint64, error) {
+	b, err := ioutil.ReadFile(procPath(pid, "stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	// The second field is the command name in parentheses, which may itself
+	// contain spaces and parentheses. Skip past the last closing one.
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("Unexpected stat contents for PID %d", pid)
+	}
+
+	// Fields after the command name start at field 3.
+	fields := strings.Fields(string(b[i+1:]))
+	const startTimeIndex = 22 - 3
+	if len(fields) <= startTimeIndex {
+		return 0, fmt.Errorf("Short stat contents for PID %d", pid)
+	}
+
+	return strconv.ParseUint(fields[startTimeIndex], 10, 64)
+}
+
+func lookUpProcessInfo(pid uint32) (*ProcessInfo, error) {
+	startTime, err := processStartTime(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ProcessInfo{
+		Pid:       pid,
+		StartTime: startTime,
+	}
+
+	// The remaining files may be unreadable for processes owned by other users,
+	// or vanish if the process exits while we are looking. Tolerate both.
+	if exe, err := os.Readlink(procPath(pid, "exe")); err == nil {
+		info.Executable = exe
+	}
+
+	if b, err := ioutil.ReadFile(procPath(pid, "cmdline")); err == nil {
+		b = bytes.TrimRight(b, "\x00")
+		if len(b) > 0 {
+			info.Cmdline = strings.Split(string(b), "\x00")
+		}
+	}
+
+	if b, err := ioutil.ReadFile(procPath(pid, "cgroup")); err == nil {
+		info.Cgroup = parseCgroup(string(b))
+	}
+
+	// Make sure we didn't just read the files of a different process that
+	// reused the PID in the meantime.
+	if st, err := processStartTime(pid); err != nil || st != startTime {
+		return nil, fmt.Errorf("PID %d exited during lookup", pid)
+	}
+
+	return info, nil
+}
+
+// Extract the cgroup path from the contents of /proc/<pid>/cgroup. Lines have
+// the form "hierarchy-ID:controller-list:cgroup-path".
+func parseCgroup(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) == 3 {
+			return parts[2]
+		}
+	}
+
+	return ""
+}
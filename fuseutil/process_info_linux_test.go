@@ -0,0 +1,74 @@
+package fuseutil
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLookUpProcessInfo(t *testing.T) {
+	pid := uint32(os.Getpid())
+
+	info, err := LookUpProcessInfo(pid)
+	if err != nil {
+		t.Fatalf("LookUpProcessInfo: %v", err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable: %v", err)
+	}
+
+	if info.Executable != exe {
+		t.Errorf("Executable = %q, want %q", info.Executable, exe)
+	}
+
+	if len(info.Cmdline) == 0 || info.Cmdline[0] != os.Args[0] {
+		t.Errorf("Cmdline = %q, want prefix %q", info.Cmdline, os.Args[0])
+	}
+
+	if info.StartTime == 0 {
+		t.Errorf("StartTime is zero")
+	}
+}
+
+func TestProcessInfoCache(t *testing.T) {
+	c := NewProcessInfoCache(time.Minute)
+	pid := uint32(os.Getpid())
+
+	a, err := c.LookUp(pid)
+	if err != nil {
+		t.Fatalf("LookUp: %v", err)
+	}
+
+	b, err := c.LookUp(pid)
+	if err != nil {
+		t.Fatalf("LookUp: %v", err)
+	}
+
+	if a != b {
+		t.Errorf("Expected second lookup to be served from the cache")
+	}
+
+	c.Forget(pid)
+	if b, _ = c.LookUp(pid); a == b {
+		t.Errorf("Expected lookup after Forget to miss the cache")
+	}
+}
+
+func TestParseCgroup(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want string
+	}{
+		{"0::/user.slice/session-1.scope\n", "/user.slice/session-1.scope"},
+		{"12:cpu,cpuacct:/docker/abc\n11:memory:/docker/abc\n", "/docker/abc"},
+		{"", ""},
+	}
+
+	for _, tc := range testCases {
+		if got := parseCgroup(tc.in); got != tc.want {
+			t.Errorf("parseCgroup(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package fuseutil
+
+import "syscall"
+
+func processStartTime(pid uint32) (uint64, error) {
+	return 0, syscall.ENOSYS
+}
+
+func lookUpProcessInfo(pid uint32) (*ProcessInfo, error) {
+	return nil, syscall.ENOSYS
+}
@@ -0,0 +1,281 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Configuration for NewReadAheadFileSystem.
+type ReadAheadConfig struct {
+	// The number of bytes requested from the wrapped file system by a read
+	// that continues where the previous one on the handle left off, when the
+	// kernel asks for less. Defaults to 1 MiB.
+	Window int
+}
+
+// NewReadAheadFileSystem wraps the supplied file system so that sequential
+// reads through a file handle are served from larger reads of the wrapped
+// file system, of cfg.Window bytes each. This helps with backends that have a
+// high per-request overhead, since the kernel reads at most a few pages at a
+// time when it isn't caching (e.g. for direct IO) and is often conservative
+// when it is.
+//
+// The data read ahead for a handle is kept until a read outside it, and is
+// dropped when the handle is released and on any op that writes to the inode
+// through the mount: WriteFile, SetInodeAttributes, Fallocate and
+// CopyFileRange. Changes made to the backend in other ways are not seen until
+// then.
+//
+// Write coalescing is provided separately, by NewWriteCoalescingFileSystem,
+// and the two combine to give a buffering layer for e.g. object stores:
+//
+//	fs = NewReadAheadFileSystem(NewWriteCoalescingFileSystem(fs, wc), ra)
+//
+// Reads that miss then see buffered writes, since the coalescing layer
+// forwards them first.
+func NewReadAheadFileSystem(
+	wrapped FileSystem,
+	cfg ReadAheadConfig) FileSystem {
+	if cfg.Window <= 0 {
+		cfg.Window = 1 << 20
+	}
+
+	return &readAheadFS{
+		FileSystem: wrapped,
+		cfg:        cfg,
+		handles:    make(map[fuseops.HandleID]*readAheadHandle),
+	}
+}
+
+type readAheadFS struct {
+	FileSystem
+	cfg ReadAheadConfig
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]*readAheadHandle
+}
+
+// The read-ahead state for one file handle.
+type readAheadHandle struct {
+	mu sync.Mutex
+
+	// The inode the handle is open on.
+	inode fuseops.InodeID
+
+	// The data read ahead, which starts at offset start within the file, and
+	// whether it runs to the end of the file. The buffer is never modified once
+	// filled, so slices of it may be handed to the kernel.
+	//
+	// GUARDED_BY(mu)
+	data  []byte
+	start int64
+	eof   bool
+
+	// The offset at which the next read is sequential.
+	//
+	// GUARDED_BY(mu)
+	next int64
+}
+
+// Return the state for the handle, creating it if necessary.
+func (fs *readAheadFS) handle(
+	h fuseops.HandleID,
+	inode fuseops.InodeID) *readAheadHandle {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rh := fs.handles[h]
+	if rh == nil {
+		rh = &readAheadHandle{inode: inode}
+		fs.handles[h] = rh
+	}
+
+	return rh
+}
+
+// Drop the data read ahead for any handle open on the inode.
+func (fs *readAheadFS) invalidate(inode fuseops.InodeID) {
+	fs.mu.Lock()
+	var handles []*readAheadHandle
+	for _, rh := range fs.handles {
+		if rh.inode == inode {
+			handles = append(handles, rh)
+		}
+	}
+	fs.mu.Unlock()
+
+	for _, rh := range handles {
+		rh.mu.Lock()
+		rh.data = nil
+		rh.eof = false
+		rh.mu.Unlock()
+	}
+}
+
+// Serve the read from the data read ahead, if it is covered, returning false
+// otherwise.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(rh.mu)
+func (rh *readAheadHandle) serveLocked(op *fuseops.ReadFileOp) bool {
+	if rh.data == nil || op.Offset < rh.start {
+		return false
+	}
+
+	end := rh.start + int64(len(rh.data))
+	if op.Offset > end || (op.Offset+op.Size > end && !rh.eof) {
+		return false
+	}
+
+	avail := rh.data[op.Offset-rh.start:]
+	if int64(len(avail)) > op.Size {
+		avail = avail[:op.Size]
+	}
+
+	if op.Dst != nil {
+		op.BytesRead = copy(op.Dst, avail)
+	} else {
+		op.Data = [][]byte{avail}
+		op.BytesRead = len(avail)
+	}
+
+	return true
+}
+
+// Read from the wrapped file system into a new buffer of the given size at
+// the op's offset, returning the bytes read.
+func (fs *readAheadFS) fill(
+	ctx context.Context,
+	op *fuseops.ReadFileOp,
+	size int) ([]byte, error) {
+	inner := &fuseops.ReadFileOp{
+		Inode:     op.Inode,
+		Handle:    op.Handle,
+		Offset:    op.Offset,
+		Size:      int64(size),
+		Dst:       make([]byte, size),
+		OpContext: op.OpContext,
+	}
+
+	if err := fs.FileSystem.ReadFile(ctx, inner); err != nil {
+		return nil, err
+	}
+
+	if inner.Callback != nil {
+		defer inner.Callback()
+	}
+
+	// The wrapped file system may have supplied the data in any of the ways
+	// ReadFileOp allows.
+	buf := inner.Dst[:inner.BytesRead]
+	switch {
+	case inner.SpliceFile != nil:
+		n, err := inner.SpliceFile.ReadAt(buf, inner.SpliceOffset)
+		if n < len(buf) {
+			return nil, err
+		}
+
+	case inner.Data != nil:
+		n := 0
+		for _, d := range inner.Data {
+			n += copy(buf[n:], d)
+		}
+	}
+
+	return buf, nil
+}
+
+func (fs *readAheadFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	rh := fs.handle(op.Handle, op.Inode)
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	if rh.serveLocked(op) {
+		rh.next = op.Offset + int64(op.BytesRead)
+		return nil
+	}
+
+	// Only reads continuing where the last left off are worth enlarging.
+	sequential := op.Offset == rh.next
+	rh.next = op.Offset
+	if !sequential || int64(fs.cfg.Window) <= op.Size {
+		rh.data = nil
+		rh.eof = false
+		if err := fs.FileSystem.ReadFile(ctx, op); err != nil {
+			return err
+		}
+
+		rh.next = op.Offset + int64(op.BytesRead)
+		return nil
+	}
+
+	data, err := fs.fill(ctx, op, fs.cfg.Window)
+	if err != nil {
+		return err
+	}
+
+	rh.data = data
+	rh.start = op.Offset
+	rh.eof = len(data) < fs.cfg.Window
+
+	rh.serveLocked(op)
+	rh.next = op.Offset + int64(op.BytesRead)
+	return nil
+}
+
+func (fs *readAheadFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.invalidate(op.Inode)
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *readAheadFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.invalidate(op.Inode)
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *readAheadFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	fs.invalidate(op.Inode)
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *readAheadFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	fs.invalidate(op.DstInode)
+	return fs.FileSystem.CopyFileRange(ctx, op)
+}
+
+func (fs *readAheadFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	delete(fs.handles, op.Handle)
+	fs.mu.Unlock()
+
+	return fs.FileSystem.ReleaseFileHandle(ctx, op)
+}
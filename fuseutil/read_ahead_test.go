@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A file system with a single file, counting the reads it serves.
+type readAheadTargetFS struct {
+	NotImplementedFileSystem
+	contents []byte
+	reads    []int64
+}
+
+func (fs *readAheadTargetFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.reads = append(fs.reads, op.Size)
+	if op.Offset < int64(len(fs.contents)) {
+		op.BytesRead = copy(op.Dst, fs.contents[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *readAheadTargetFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	copy(fs.contents[op.Offset:], op.Data)
+	return nil
+}
+
+func TestReadAhead(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &readAheadTargetFS{contents: bytes.Repeat([]byte("0123456789"), 10)}
+	fs := NewReadAheadFileSystem(wrapped, ReadAheadConfig{Window: 40})
+
+	read := func(offset, size int64) string {
+		op := &fuseops.ReadFileOp{
+			Inode:  2,
+			Handle: 1,
+			Offset: offset,
+			Size:   size,
+			Dst:    make([]byte, size),
+		}
+
+		if err := fs.ReadFile(ctx, op); err != nil {
+			t.Fatalf("ReadFile(%d, %d): %v", offset, size, err)
+		}
+
+		return string(op.Dst[:op.BytesRead])
+	}
+
+	// Sequential reads from the start are served from a window at a time.
+	for off := int64(0); off < 100; off += 10 {
+		if s := read(off, 10); s != "0123456789" {
+			t.Errorf("Read at %d: %q", off, s)
+		}
+	}
+
+	if want := []int64{40, 40, 40}; len(wrapped.reads) != len(want) {
+		t.Errorf("Wrapped reads: got %v, want %v", wrapped.reads, want)
+	}
+
+	// Reading at EOF is served from the last window, which came up short.
+	if s := read(100, 10); s != "" || len(wrapped.reads) != 3 {
+		t.Errorf("Read at EOF: %q, wrapped reads %v", s, wrapped.reads)
+	}
+
+	// A random read passes straight through.
+	wrapped.reads = nil
+	if s := read(55, 3); s != "567" || len(wrapped.reads) != 1 || wrapped.reads[0] != 3 {
+		t.Errorf("Random read: %q, wrapped reads %v", s, wrapped.reads)
+	}
+
+	// Writes drop what was read ahead.
+	read(58, 2)
+	read(60, 10)
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 2, Handle: 1, Offset: 70, Data: []byte("abc")}); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if s := read(70, 5); s != "abc34" {
+		t.Errorf("Read after write: %q", s)
+	}
+}
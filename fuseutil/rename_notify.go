@@ -0,0 +1,88 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// EntryNotifier is the subset of *fuse.Connection's kernel notification
+// methods needed by NotifyRename.
+type EntryNotifier interface {
+	NotifyInvalEntry(parent fuseops.InodeID, name string) error
+	NotifyDelete(parent fuseops.InodeID, child fuseops.InodeID, name string) error
+}
+
+var _ EntryNotifier = &fuse.Connection{}
+
+// NotifyRename brings the kernel's directory entry cache up to date with a
+// rename that happened in the backing store rather than through the mount:
+// child was moved from oldName within oldParent to newName within newParent.
+// If that replaced an existing inode, pass it as replaced; otherwise pass
+// zero.
+//
+// Notifications are sent in this order:
+//
+//  1. The entry for the new name, which may be cached either as the replaced
+//     inode or as a negative entry. If an inode was replaced it is reported
+//     as deleted, so that the kernel drops the dead inode too.
+//
+//  2. The entry for the old name, which is only invalidated: child is still
+//     alive, and reporting it as deleted would mark it dead in the kernel
+//     (or fail with ENOTEMPTY for a directory with cached children).
+//
+// Doing it the other way around opens a window in which child can be found by
+// neither name, so that concurrent lookups fail with ENOENT; in this order it
+// is briefly found by both, which is harmless.
+//
+// ENOENT from the kernel means that it has nothing cached for a parent, and is
+// not treated as an error. The old name is invalidated even if notifying the
+// new one fails, and the first error is returned.
+func NotifyRename(
+	n EntryNotifier,
+	oldParent fuseops.InodeID,
+	oldName string,
+	newParent fuseops.InodeID,
+	newName string,
+	child fuseops.InodeID,
+	replaced fuseops.InodeID) error {
+	var firstErr error
+	record := func(err error) {
+		if err != nil && err != syscall.ENOENT && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if replaced != 0 {
+		err := n.NotifyDelete(newParent, replaced, newName)
+
+		// Fall back to plain invalidation if the kernel is too old to support
+		// deletion notifications, or refuses because it has cached children for
+		// a replaced directory.
+		if err == syscall.ENOSYS || err == syscall.ENOTEMPTY {
+			err = n.NotifyInvalEntry(newParent, newName)
+		}
+
+		record(err)
+	} else {
+		record(n.NotifyInvalEntry(newParent, newName))
+	}
+
+	record(n.NotifyInvalEntry(oldParent, oldName))
+	return firstErr
+}
@@ -0,0 +1,58 @@
+package fuseutil
+
+import (
+	"fmt"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type recordingNotifier struct {
+	calls     []string
+	deleteErr error
+}
+
+func (n *recordingNotifier) NotifyInvalEntry(parent fuseops.InodeID, name string) error {
+	n.calls = append(n.calls, fmt.Sprintf("inval %d %s", parent, name))
+	return syscall.ENOENT
+}
+
+func (n *recordingNotifier) NotifyDelete(parent, child fuseops.InodeID, name string) error {
+	n.calls = append(n.calls, fmt.Sprintf("delete %d %d %s", parent, child, name))
+	return n.deleteErr
+}
+
+func TestNotifyRename(t *testing.T) {
+	testCases := []struct {
+		replaced  fuseops.InodeID
+		deleteErr error
+		want      []string
+	}{
+		{0, nil, []string{"inval 2 bar", "inval 1 foo"}},
+		{9, nil, []string{"delete 2 9 bar", "inval 1 foo"}},
+		{9, syscall.ENOSYS, []string{"delete 2 9 bar", "inval 2 bar", "inval 1 foo"}},
+	}
+
+	for _, tc := range testCases {
+		n := &recordingNotifier{deleteErr: tc.deleteErr}
+		if err := NotifyRename(n, 1, "foo", 2, "bar", 7, tc.replaced); err != nil {
+			t.Errorf("NotifyRename: %v", err)
+		}
+
+		if !reflect.DeepEqual(n.calls, tc.want) {
+			t.Errorf("calls = %q, want %q", n.calls, tc.want)
+		}
+	}
+
+	// Other errors are reported, but don't stop the old name being invalidated.
+	n := &recordingNotifier{deleteErr: syscall.EIO}
+	if err := NotifyRename(n, 1, "foo", 2, "bar", 7, 9); err != syscall.EIO {
+		t.Errorf("NotifyRename error = %v, want EIO", err)
+	}
+
+	if len(n.calls) != 2 {
+		t.Errorf("calls = %q", n.calls)
+	}
+}
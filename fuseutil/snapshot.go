@@ -0,0 +1,204 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// InodeTableSnapshot is the kernel-visible state of an InodeTable: the IDs it
+// has issued, their generation numbers and lookup counts. A daemon taking over
+// a mount from a previous one (see fuse.MountConfig.ResumeState) must carry
+// on with exactly this state, since the kernel still holds references to
+// these IDs and will forget them by the counts it was given. It is plain
+// data, suitable for encoding with encoding/json.
+type InodeTableSnapshot struct {
+	Inodes []InodeSnapshot
+
+	// IDs available for reuse, with the generation number they last had.
+	Free []InodeSnapshot
+
+	NextID fuseops.InodeID
+}
+
+// InodeSnapshot describes one inode in an InodeTableSnapshot. Payload is
+// whatever the caller's encode function made of the inode's payload; it is
+// empty for the free list.
+type InodeSnapshot struct {
+	ID          fuseops.InodeID
+	Generation  fuseops.GenerationNumber
+	LookupCount uint64
+	Payload     []byte
+}
+
+// Snapshot captures the table's state, calling encode for the payload of each
+// inode. Inodes are listed in ID order.
+func (t *InodeTable) Snapshot(
+	encode func(id fuseops.InodeID, payload interface{}) ([]byte, error)) (
+	InodeTableSnapshot, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := InodeTableSnapshot{NextID: t.nextID}
+	for id, e := range t.inodes {
+		payload, err := encode(id, e.payload)
+		if err != nil {
+			return InodeTableSnapshot{}, fmt.Errorf("inode %v: %w", id, err)
+		}
+
+		s.Inodes = append(s.Inodes, InodeSnapshot{
+			ID:          id,
+			Generation:  e.generation,
+			LookupCount: e.lookupCount,
+			Payload:     payload,
+		})
+	}
+
+	sort.Slice(s.Inodes, func(i, j int) bool {
+		return s.Inodes[i].ID < s.Inodes[j].ID
+	})
+
+	for _, f := range t.free {
+		s.Free = append(s.Free, InodeSnapshot{ID: f.id, Generation: f.generation})
+	}
+
+	return s, nil
+}
+
+// RestoreInodeTable creates a table with the state captured by Snapshot,
+// calling decode to rebuild the payload of each inode. onForget is as for
+// NewInodeTable.
+func RestoreInodeTable(
+	s InodeTableSnapshot,
+	decode func(id fuseops.InodeID, data []byte) (interface{}, error),
+	onForget func(id fuseops.InodeID, payload interface{})) (*InodeTable, error) {
+	t := &InodeTable{
+		onForget: onForget,
+		inodes:   make(map[fuseops.InodeID]*inodeTableEntry),
+		nextID:   s.NextID,
+	}
+
+	for _, in := range s.Inodes {
+		if in.ID >= s.NextID {
+			return nil, fmt.Errorf("inode %v: not below NextID %v", in.ID, s.NextID)
+		}
+
+		if _, ok := t.inodes[in.ID]; ok {
+			return nil, fmt.Errorf("inode %v: listed twice", in.ID)
+		}
+
+		payload, err := decode(in.ID, in.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("inode %v: %w", in.ID, err)
+		}
+
+		t.inodes[in.ID] = &inodeTableEntry{
+			payload:     payload,
+			generation:  in.Generation,
+			lookupCount: in.LookupCount,
+		}
+	}
+
+	if _, ok := t.inodes[fuseops.RootInodeID]; !ok {
+		return nil, fmt.Errorf("no root inode")
+	}
+
+	for _, f := range s.Free {
+		if _, ok := t.inodes[f.ID]; ok || f.ID >= s.NextID {
+			return nil, fmt.Errorf("free inode %v: in use or not yet issued", f.ID)
+		}
+
+		t.free = append(t.free, inodeTableFree{f.ID, f.Generation})
+	}
+
+	return t, nil
+}
+
+// HandleTableSnapshot is the state of a HandleTable, for restoring the handles
+// the kernel holds across a change of daemon (cf. InodeTableSnapshot).
+type HandleTableSnapshot struct {
+	Handles []HandleSnapshot
+	NextID  fuseops.HandleID
+}
+
+// HandleSnapshot describes one open handle in a HandleTableSnapshot.
+type HandleSnapshot struct {
+	ID      fuseops.HandleID
+	Payload []byte
+}
+
+// Snapshot captures the table's state, calling encode for the payload of each
+// handle. Handles are listed in ID order.
+func (t *HandleTable) Snapshot(
+	encode func(id fuseops.HandleID, payload interface{}) ([]byte, error)) (
+	HandleTableSnapshot, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := HandleTableSnapshot{NextID: t.nextID}
+	for id, p := range t.handles {
+		payload, err := encode(id, p)
+		if err != nil {
+			return HandleTableSnapshot{}, fmt.Errorf("handle %v: %w", id, err)
+		}
+
+		s.Handles = append(s.Handles, HandleSnapshot{ID: id, Payload: payload})
+	}
+
+	sort.Slice(s.Handles, func(i, j int) bool {
+		return s.Handles[i].ID < s.Handles[j].ID
+	})
+
+	return s, nil
+}
+
+// RestoreHandleTable creates a table with the state captured by Snapshot,
+// calling decode to rebuild the payload of each handle (e.g. by reopening the
+// backing file).
+func RestoreHandleTable(
+	s HandleTableSnapshot,
+	decode func(id fuseops.HandleID, data []byte) (interface{}, error)) (
+	*HandleTable, error) {
+	t := &HandleTable{
+		handles: make(map[fuseops.HandleID]interface{}),
+		nextID:  s.NextID,
+	}
+
+	if t.nextID == 0 {
+		t.nextID = 1
+	}
+
+	for _, h := range s.Handles {
+		if h.ID == 0 || h.ID >= t.nextID {
+			return nil, fmt.Errorf("handle %v: not in [1, NextID)", h.ID)
+		}
+
+		if _, ok := t.handles[h.ID]; ok {
+			return nil, fmt.Errorf("handle %v: listed twice", h.ID)
+		}
+
+		payload, err := decode(h.ID, h.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("handle %v: %w", h.ID, err)
+		}
+
+		t.handles[h.ID] = payload
+	}
+
+	return t, nil
+}
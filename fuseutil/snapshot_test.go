@@ -0,0 +1,101 @@
+package fuseutil
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestInodeTableSnapshot(t *testing.T) {
+	tab := NewInodeTable("root", nil)
+	foo, _ := tab.Add("foo")
+	bar, _ := tab.Add("bar")
+	tab.LookedUp(foo)
+	tab.Forget(bar, 1)
+
+	encode := func(_ fuseops.InodeID, p interface{}) ([]byte, error) {
+		return []byte(p.(string)), nil
+	}
+
+	s, err := tab.Snapshot(encode)
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	// Through JSON, as it would be saved.
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var decoded InodeTableSnapshot
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	restored, err := RestoreInodeTable(
+		decoded,
+		func(_ fuseops.InodeID, data []byte) (interface{}, error) {
+			return string(data), nil
+		},
+		nil)
+	if err != nil {
+		t.Fatalf("RestoreInodeTable: %v", err)
+	}
+
+	if p, ok := restored.Get(foo); !ok || p != "foo" || restored.LookupCount(foo) != 2 {
+		t.Errorf("foo: %v, %v, %v", p, ok, restored.LookupCount(foo))
+	}
+
+	if _, ok := restored.Get(bar); ok {
+		t.Error("bar wasn't forgotten")
+	}
+
+	// The free list carries over, generation and all.
+	if id, gen := restored.Add("baz"); id != bar || gen != 1 {
+		t.Errorf("Add(baz) = %v, %v", id, gen)
+	}
+
+	if id, _ := restored.Add("qux"); id != bar+1 {
+		t.Errorf("Add(qux) = %v", id)
+	}
+
+	// Inconsistent snapshots are rejected.
+	decoded.Inodes = decoded.Inodes[1:]
+	if _, err := RestoreInodeTable(decoded, func(fuseops.InodeID, []byte) (interface{}, error) {
+		return nil, nil
+	}, nil); err == nil {
+		t.Error("Restored without a root")
+	}
+}
+
+func TestHandleTableSnapshot(t *testing.T) {
+	tab := NewHandleTable()
+	a := tab.Add("a")
+	b := tab.Add("b")
+	tab.Release(a)
+
+	s, err := tab.Snapshot(func(_ fuseops.HandleID, p interface{}) ([]byte, error) {
+		return []byte(p.(string)), nil
+	})
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	restored, err := RestoreHandleTable(s, func(_ fuseops.HandleID, data []byte) (interface{}, error) {
+		return string(data), nil
+	})
+	if err != nil {
+		t.Fatalf("RestoreHandleTable: %v", err)
+	}
+
+	if p, ok := restored.Get(b); !ok || p != "b" || restored.Len() != 1 {
+		t.Errorf("Get(b) = %v, %v; Len = %v", p, ok, restored.Len())
+	}
+
+	// IDs still aren't reused.
+	if id := restored.Add("c"); id <= b {
+		t.Errorf("Add(c) = %v", id)
+	}
+}
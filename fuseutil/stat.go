@@ -0,0 +1,57 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package fuseutil
+
+import (
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The attributes in sys, if it is the *syscall.Stat_t that os.FileInfo.Sys
+// returns for files on disk.
+func attributesFromStatSys(sys interface{}) (fuseops.InodeAttributes, bool) {
+	st, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return fuseops.InodeAttributes{}, false
+	}
+
+	return AttributesFromStat(st), true
+}
+
+// AttributesFromStat converts the result of stat(2) to inode attributes,
+// including all times, the device number and the allocated block count. The
+// differences between the field names and types on Linux and OS X are taken
+// care of.
+func AttributesFromStat(st *syscall.Stat_t) fuseops.InodeAttributes {
+	atime, mtime, ctime, crtime := statTimes(st)
+	return fuseops.InodeAttributes{
+		Size:   uint64(st.Size),
+		Nlink:  uint32(st.Nlink),
+		Mode:   fuse.ConvertFileMode(uint32(st.Mode)),
+		Rdev:   uint32(st.Rdev),
+		Blocks: uint64(st.Blocks),
+		Atime:  atime,
+		Mtime:  mtime,
+		Ctime:  ctime,
+		Crtime: crtime,
+		Uid:    st.Uid,
+		Gid:    st.Gid,
+	}
+}
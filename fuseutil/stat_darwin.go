@@ -0,0 +1,14 @@
+package fuseutil
+
+import (
+	"syscall"
+	"time"
+)
+
+func statTimes(st *syscall.Stat_t) (atime, mtime, ctime, crtime time.Time) {
+	atime = time.Unix(st.Atimespec.Unix())
+	mtime = time.Unix(st.Mtimespec.Unix())
+	ctime = time.Unix(st.Ctimespec.Unix())
+	crtime = time.Unix(st.Birthtimespec.Unix())
+	return atime, mtime, ctime, crtime
+}
@@ -0,0 +1,14 @@
+package fuseutil
+
+import (
+	"syscall"
+	"time"
+)
+
+// Linux doesn't report a birth time in struct stat, so crtime is left zero.
+func statTimes(st *syscall.Stat_t) (atime, mtime, ctime, crtime time.Time) {
+	atime = time.Unix(st.Atim.Unix())
+	mtime = time.Unix(st.Mtim.Unix())
+	ctime = time.Unix(st.Ctim.Unix())
+	return atime, mtime, ctime, crtime
+}
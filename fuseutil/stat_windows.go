@@ -0,0 +1,9 @@
+package fuseutil
+
+import "github.com/jacobsa/fuse/fuseops"
+
+// There is no struct stat on Windows: os.FileInfo.Sys returns a
+// *syscall.Win32FileAttributeData, which has nothing that FileInfo doesn't.
+func attributesFromStatSys(sys interface{}) (fuseops.InodeAttributes, bool) {
+	return fuseops.InodeAttributes{}, false
+}
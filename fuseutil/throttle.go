@@ -0,0 +1,214 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// Configuration for NewThrottlingFileSystem. A zero rate means no limit of
+// that kind.
+type ThrottleConfig struct {
+	// The sustained rate, in bytes per second, at which each open file handle
+	// may read and write, and the number of bytes it may transfer in a burst
+	// after being idle. The burst defaults to one second's worth.
+	HandleBytesPerSecond float64
+	HandleBurst          int64
+
+	// Likewise, for all handles used by a single UID (the caller recorded in
+	// the op's context).
+	UIDBytesPerSecond float64
+	UIDBurst          int64
+
+	// The clock used to measure rates. Defaults to the real clock.
+	Clock timeutil.Clock
+}
+
+// NewThrottlingFileSystem wraps the supplied file system so that ReadFile and
+// WriteFile are delayed as necessary to keep to byte rate limits per handle
+// and per UID, using token buckets. This stops a single bulk copy from
+// saturating a backend shared with interactive users. (It limits bytes, not
+// ops; small ops are cheap under it.)
+//
+// Writes are charged before being passed on, and reads once they complete,
+// since only then is the number of bytes known. A single transfer larger than
+// the burst is allowed, and its excess paid for by waiting afterward. If the
+// op's context is cancelled while waiting, e.g. because the kernel interrupted
+// it, the op fails with EINTR.
+func NewThrottlingFileSystem(
+	wrapped FileSystem,
+	cfg ThrottleConfig) FileSystem {
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	if cfg.HandleBurst <= 0 {
+		cfg.HandleBurst = int64(cfg.HandleBytesPerSecond)
+	}
+
+	if cfg.UIDBurst <= 0 {
+		cfg.UIDBurst = int64(cfg.UIDBytesPerSecond)
+	}
+
+	return &throttlingFS{
+		FileSystem: wrapped,
+		cfg:        cfg,
+		handles:    make(map[fuseops.HandleID]*tokenBucket),
+		uids:       make(map[uint32]*tokenBucket),
+	}
+}
+
+type throttlingFS struct {
+	FileSystem
+	cfg ThrottleConfig
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]*tokenBucket
+
+	// GUARDED_BY(mu)
+	uids map[uint32]*tokenBucket
+}
+
+// A token bucket that may go into debt.
+//
+// External synchronization is required.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// Take n tokens, returning how long the caller must wait for the bucket to
+// come out of debt.
+func (b *tokenBucket) take(n int, now time.Time) time.Duration {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+
+		b.last = now
+	}
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Charge n bytes to the handle and UID, returning how long to wait.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *throttlingFS) charge(
+	h fuseops.HandleID,
+	uid uint32,
+	n int) time.Duration {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	now := fs.cfg.Clock.Now()
+
+	var wait time.Duration
+	if fs.cfg.HandleBytesPerSecond > 0 {
+		b := fs.handles[h]
+		if b == nil {
+			b = newTokenBucket(fs.cfg.HandleBytesPerSecond, fs.cfg.HandleBurst, now)
+			fs.handles[h] = b
+		}
+
+		wait = b.take(n, now)
+	}
+
+	if fs.cfg.UIDBytesPerSecond > 0 {
+		b := fs.uids[uid]
+		if b == nil {
+			b = newTokenBucket(fs.cfg.UIDBytesPerSecond, fs.cfg.UIDBurst, now)
+			fs.uids[uid] = b
+		}
+
+		if w := b.take(n, now); w > wait {
+			wait = w
+		}
+	}
+
+	return wait
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
+
+func (fs *throttlingFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if err := fs.FileSystem.ReadFile(ctx, op); err != nil {
+		return err
+	}
+
+	return sleepContext(ctx, fs.charge(op.Handle, op.OpContext.Uid, op.BytesRead))
+}
+
+func (fs *throttlingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	d := fs.charge(op.Handle, op.OpContext.Uid, len(op.Data))
+	if err := sleepContext(ctx, d); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *throttlingFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	delete(fs.handles, op.Handle)
+	fs.mu.Unlock()
+
+	return fs.FileSystem.ReleaseFileHandle(ctx, op)
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+func TestThrottleCharge(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Unix(1000, 0))
+
+	fs := NewThrottlingFileSystem(&NotImplementedFileSystem{}, ThrottleConfig{
+		HandleBytesPerSecond: 1000,
+		UIDBytesPerSecond:    1500,
+		UIDBurst:             3000,
+		Clock:                &clock,
+	}).(*throttlingFS)
+
+	// Within the handle's burst of one second's worth.
+	if d := fs.charge(1, 0, 1000); d != 0 {
+		t.Errorf("first charge: wait %v, want 0", d)
+	}
+
+	// Half a second of debt on the handle.
+	if d := fs.charge(1, 0, 500); d != 500*time.Millisecond {
+		t.Errorf("second charge: wait %v, want 500ms", d)
+	}
+
+	// Other handles have their own buckets, but share the UID's: 1500 of its
+	// 3000 are used, so another 2000 leaves it 500 in debt at 1500/s.
+	if d := fs.charge(2, 0, 1000); d != 0 {
+		t.Errorf("third charge: wait %v, want 0", d)
+	}
+
+	if d := fs.charge(3, 0, 1000); d != time.Second/3 {
+		t.Errorf("fourth charge: wait %v, want 333ms", d)
+	}
+
+	// Refills with time.
+	clock.AdvanceTime(10 * time.Second)
+	if d := fs.charge(1, 0, 1000); d != 0 {
+		t.Errorf("charge after refill: wait %v, want 0", d)
+	}
+}
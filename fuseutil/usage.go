@@ -0,0 +1,454 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Configuration for NewUsageTrackingFileSystem.
+type UsageConfig struct {
+	// The capacity of the file system to report, in bytes and inodes.
+	CapacityBytes  uint64
+	CapacityInodes uint64
+
+	// The usage at the time the wrapper is created, e.g. from a walk of the
+	// backing store at startup.
+	InitialBytes  uint64
+	InitialInodes uint64
+
+	// The block size reported by StatFS, and by which file sizes are rounded
+	// up when counting bytes used. Defaults to 4096.
+	BlockSize uint32
+}
+
+// UsageTrackingFileSystem wraps a FileSystem, keeping a running count of the
+// bytes and inodes in use as ops flow through it, and answers StatFS from that
+// count, so that df is accurate without walking the tree on every statfs(2).
+// The wrapped file system's StatFS is not called.
+//
+// Sizes are learned from the attributes returned by ops like LookUpInode and
+// GetInodeAttributes and from WriteFile and CopyFileRange, creations add
+// inodes, and the last unlink of an inode subtracts it, so the count is only
+// as accurate as those attributes and the initial usage. Changes made to the
+// backing store other than through the file system should be reported with
+// Adjust.
+type UsageTrackingFileSystem struct {
+	FileSystem
+	cfg UsageConfig
+
+	// The names the kernel knows of, used to find the inode an UnlinkOp,
+	// RmDirOp, or RenameOp refers to.
+	entries *EntryMap
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	usedBytes  uint64
+	usedInodes uint64
+
+	// What we know of each inode the kernel knows of.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*usageInode
+}
+
+type usageInode struct {
+	size  uint64
+	nlink uint32
+	dir   bool
+}
+
+// NewUsageTrackingFileSystem wraps the supplied file system.
+func NewUsageTrackingFileSystem(
+	wrapped FileSystem,
+	cfg UsageConfig) *UsageTrackingFileSystem {
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = 4096
+	}
+
+	return &UsageTrackingFileSystem{
+		FileSystem: wrapped,
+		cfg:        cfg,
+		entries:    NewEntryMap(),
+		usedBytes:  cfg.InitialBytes,
+		usedInodes: cfg.InitialInodes,
+		inodes:     make(map[fuseops.InodeID]*usageInode),
+	}
+}
+
+// Usage returns the bytes and inodes currently counted as in use.
+func (fs *UsageTrackingFileSystem) Usage() (bytes, inodes uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.usedBytes, fs.usedInodes
+}
+
+// Adjust changes the usage counts by the supplied amounts, for changes that
+// didn't go through the file system.
+func (fs *UsageTrackingFileSystem) Adjust(bytes, inodes int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.usedBytes = addClamped(fs.usedBytes, bytes)
+	fs.usedInodes = addClamped(fs.usedInodes, inodes)
+}
+
+func addClamped(n uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > n {
+		return 0
+	}
+
+	return n + uint64(delta)
+}
+
+// The bytes counted for a file of the given size.
+func (fs *UsageTrackingFileSystem) rounded(size uint64) uint64 {
+	bs := uint64(fs.cfg.BlockSize)
+	return (size + bs - 1) / bs * bs
+}
+
+// Update the known size of the inode, adjusting the count if it was already
+// known. If created, the inode is new and is added to the count.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *UsageTrackingFileSystem) observe(
+	id fuseops.InodeID,
+	attrs fuseops.InodeAttributes,
+	created bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.inodes[id]
+	switch {
+	case created:
+		in = &usageInode{}
+		fs.inodes[id] = in
+		fs.usedInodes++
+
+	case in == nil:
+		// Already counted in the initial usage.
+		fs.inodes[id] = &usageInode{
+			size:  attrs.Size,
+			nlink: attrs.Nlink,
+			dir:   attrs.Mode.IsDir(),
+		}
+
+		return
+	}
+
+	fs.usedBytes = addClamped(
+		fs.usedBytes,
+		int64(fs.rounded(attrs.Size))-int64(fs.rounded(in.size)))
+
+	in.size = attrs.Size
+	in.nlink = attrs.Nlink
+	in.dir = attrs.Mode.IsDir()
+}
+
+// Record that a name for the inode went away, subtracting the inode from the
+// count if it was its last. Directories have only one name, whatever their
+// link count.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *UsageTrackingFileSystem) unlinked(id fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.inodes[id]
+	if in == nil {
+		return
+	}
+
+	if in.nlink > 0 {
+		in.nlink--
+	}
+
+	if in.dir || in.nlink == 0 {
+		fs.usedBytes = addClamped(fs.usedBytes, -int64(fs.rounded(in.size)))
+		fs.usedInodes = addClamped(fs.usedInodes, -1)
+		in.size = 0
+		in.nlink = 0
+	}
+}
+
+// Record an entry returned to the kernel.
+func (fs *UsageTrackingFileSystem) entry(
+	parent fuseops.InodeID,
+	name string,
+	e *fuseops.ChildInodeEntry,
+	created bool) {
+	fs.entries.LookedUp(parent, name, e.Child)
+	fs.observe(e.Child, e.Attributes, created)
+}
+
+// Drop the state for an inode the kernel no longer knows of.
+func (fs *UsageTrackingFileSystem) forget(id fuseops.InodeID, n uint64) {
+	if !fs.entries.Forget(id, n) {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.inodes, id)
+}
+
+func (fs *UsageTrackingFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	fs.mu.Lock()
+	usedBytes, usedInodes := fs.usedBytes, fs.usedInodes
+	fs.mu.Unlock()
+
+	bs := uint64(fs.cfg.BlockSize)
+	op.BlockSize = fs.cfg.BlockSize
+	op.IoSize = fs.cfg.BlockSize
+	op.Blocks = fs.cfg.CapacityBytes / bs
+	op.Inodes = fs.cfg.CapacityInodes
+
+	if usedBytes < fs.cfg.CapacityBytes {
+		op.BlocksFree = (fs.cfg.CapacityBytes - usedBytes) / bs
+		op.BlocksAvailable = op.BlocksFree
+	}
+
+	if usedInodes < fs.cfg.CapacityInodes {
+		op.InodesFree = fs.cfg.CapacityInodes - usedInodes
+	}
+
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.entry(op.Parent, op.Name, &op.Entry, false)
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if err := fs.FileSystem.ReadDirPlus(ctx, op); err != nil {
+		return err
+	}
+
+	for i := range op.Entries {
+		e := &op.Entries[i]
+		if e.Name != "." && e.Name != ".." {
+			fs.entry(op.Inode, e.Name, &e.Entry, false)
+		}
+	}
+
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if err := fs.FileSystem.GetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.observe(op.Inode, op.Attributes, false)
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := fs.FileSystem.SetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.observe(op.Inode, op.Attributes, false)
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.forget(op.Inode, op.N)
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *UsageTrackingFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.forget(e.Inode, e.N)
+	}
+
+	return fs.FileSystem.BatchForget(ctx, op)
+}
+
+func (fs *UsageTrackingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if err := fs.FileSystem.MkDir(ctx, op); err != nil {
+		return err
+	}
+
+	fs.entry(op.Parent, op.Name, &op.Entry, true)
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	if err := fs.FileSystem.MkNode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.entry(op.Parent, op.Name, &op.Entry, true)
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.entry(op.Parent, op.Name, &op.Entry, true)
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if err := fs.FileSystem.CreateSymlink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.entry(op.Parent, op.Name, &op.Entry, true)
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if err := fs.FileSystem.CreateLink(ctx, op); err != nil {
+		return err
+	}
+
+	// A new name for an existing inode: no new inode, and the size is
+	// unchanged.
+	fs.entry(op.Parent, op.Name, &op.Entry, false)
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	if err := fs.FileSystem.Rename(ctx, op); err != nil {
+		return err
+	}
+
+	// An exchange leaves both inodes linked.
+	if op.Flags&fuseops.RenameExchange != 0 {
+		fs.entries.Exchange(op.OldParent, op.OldName, op.NewParent, op.NewName)
+		return nil
+	}
+
+	_, replaced, _ := fs.entries.Rename(
+		op.OldParent, op.OldName,
+		op.NewParent, op.NewName)
+
+	if replaced != 0 {
+		fs.unlinked(replaced)
+	}
+
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if err := fs.FileSystem.RmDir(ctx, op); err != nil {
+		return err
+	}
+
+	if id, ok := fs.entries.Unlink(op.Parent, op.Name); ok {
+		fs.unlinked(id)
+	}
+
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := fs.FileSystem.Unlink(ctx, op); err != nil {
+		return err
+	}
+
+	if id, ok := fs.entries.Unlink(op.Parent, op.Name); ok {
+		fs.unlinked(id)
+	}
+
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if err := fs.FileSystem.WriteFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.inodes[op.Inode]
+	end := uint64(op.Offset) + uint64(len(op.Data))
+	if in == nil || end <= in.size {
+		return nil
+	}
+
+	fs.usedBytes += fs.rounded(end) - fs.rounded(in.size)
+	in.size = end
+	return nil
+}
+
+func (fs *UsageTrackingFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	if err := fs.FileSystem.CopyFileRange(ctx, op); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.inodes[op.DstInode]
+	end := op.DstOffset + op.BytesCopied
+	if in == nil || end <= in.size {
+		return nil
+	}
+
+	fs.usedBytes += fs.rounded(end) - fs.rounded(in.size)
+	in.size = end
+	return nil
+}
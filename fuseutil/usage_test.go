@@ -0,0 +1,93 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type usageTargetFS struct {
+	NotImplementedFileSystem
+}
+
+func (fs *usageTargetFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	op.Entry.Child = 5
+	op.Entry.Attributes.Nlink = 1
+	return nil
+}
+
+func (fs *usageTargetFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	op.Entry.Child = op.Target
+	op.Entry.Attributes = fuseops.InodeAttributes{Size: 5000, Nlink: 2}
+	return nil
+}
+
+func (fs *usageTargetFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return nil
+}
+
+func (fs *usageTargetFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return nil
+}
+
+func TestUsageTracking(t *testing.T) {
+	ctx := context.Background()
+	fs := NewUsageTrackingFileSystem(&usageTargetFS{}, UsageConfig{
+		CapacityBytes:  1 << 20,
+		CapacityInodes: 100,
+		InitialBytes:   8192,
+		InitialInodes:  3,
+	})
+
+	check := func(wantBytes, wantInodes uint64) {
+		t.Helper()
+		if b, i := fs.Usage(); b != wantBytes || i != wantInodes {
+			t.Errorf("Usage() = (%d, %d), want (%d, %d)", b, i, wantBytes, wantInodes)
+		}
+	}
+
+	fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: 1, Name: "a"})
+	check(8192, 4)
+
+	fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 5, Offset: 1000, Data: make([]byte, 4000)})
+	check(8192+8192, 4)
+
+	fs.CreateLink(ctx, &fuseops.CreateLinkOp{Parent: 1, Name: "b", Target: 5})
+	check(8192+8192, 4)
+
+	// The inode survives until its last name goes.
+	fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "a"})
+	check(8192+8192, 4)
+
+	fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "b"})
+	check(8192, 3)
+
+	op := &fuseops.StatFSOp{}
+	fs.StatFS(ctx, op)
+	if op.Blocks != 256 || op.BlocksFree != 254 || op.Inodes != 100 || op.InodesFree != 97 {
+		t.Errorf("StatFS = %+v", op)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The watchdog for one op being handled under ServerConfig.OpTimeout.
+type opWatch struct {
+	timer *time.Timer
+
+	mu sync.Mutex
+
+	// Set once the op has been replied to, by the method returning or by the
+	// watchdog, and if the latter, the function releasing the op's buffers.
+	//
+	// GUARDED_BY(mu)
+	replied bool
+	release func()
+}
+
+// Start watching an op about to be passed to the file system.
+func (s *fileSystemServer) watch(
+	c *fuse.Connection,
+	ctx context.Context,
+	op interface{}) *opWatch {
+	w := &opWatch{}
+	start := time.Now()
+	w.timer = time.AfterFunc(s.cfg.OpTimeout, func() { s.expire(c, ctx, op, w, start) })
+
+	return w
+}
+
+// Handle an op that has outlived s.cfg.OpTimeout.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (s *fileSystemServer) expire(
+	c *fuse.Connection,
+	ctx context.Context,
+	op interface{},
+	w *opWatch,
+	start time.Time) {
+	running := time.Since(start)
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Errorf(fuse.LogOp, "fuseutil: %v still running after %v", op, running)
+	}
+
+	if s.cfg.OnHang != nil {
+		s.cfg.OnHang(ctx, op, running)
+	}
+
+	if !s.cfg.ReplyOnTimeout {
+		return
+	}
+
+	// Forgets get no reply.
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.replied {
+		return
+	}
+
+	// The method may still be writing into the op's buffers, so keep them
+	// until it returns.
+	w.replied = true
+	w.release = fuse.RetainBuffers(ctx)
+	c.Reply(ctx, syscall.EIO)
+}
+
+// Stop watching an op whose method has returned, reporting whether it remains
+// to be replied to.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *opWatch) finish() bool {
+	w.timer.Stop()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.replied {
+		w.release()
+		return false
+	}
+
+	w.replied = true
+	return true
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestWatchdogReportsStuckOps(t *testing.T) {
+	var buf bytes.Buffer
+	hung := make(chan time.Duration, 1)
+	s := &fileSystemServer{
+		cfg: ServerConfig{
+			OpTimeout: 10 * time.Millisecond,
+			Logger:    fuse.NewLevelLogger(log.New(&buf, "", 0), fuse.LogError),
+			OnHang: func(ctx context.Context, op interface{}, running time.Duration) {
+				hung <- running
+			},
+		},
+	}
+
+	op := &fuseops.GetInodeAttributesOp{Inode: 17}
+	w := s.watch(nil, context.Background(), op)
+
+	if running := <-hung; running < 10*time.Millisecond {
+		t.Errorf("Running for %v", running)
+	}
+
+	if !strings.Contains(buf.String(), "still running") {
+		t.Errorf("Log: %q", buf.String())
+	}
+
+	// Without ReplyOnTimeout, the method's own result is still sent.
+	if !w.finish() {
+		t.Errorf("finish returned false")
+	}
+}
+
+func TestWatchdogIgnoresPromptOps(t *testing.T) {
+	hung := make(chan struct{}, 1)
+	s := &fileSystemServer{
+		cfg: ServerConfig{
+			OpTimeout:      10 * time.Millisecond,
+			ReplyOnTimeout: true,
+			OnHang: func(ctx context.Context, op interface{}, running time.Duration) {
+				hung <- struct{}{}
+			},
+		},
+	}
+
+	w := s.watch(nil, context.Background(), &fuseops.GetInodeAttributesOp{})
+	if !w.finish() {
+		t.Fatalf("finish returned false")
+	}
+
+	select {
+	case <-hung:
+		t.Errorf("OnHang called for a finished op")
+	case <-time.After(30 * time.Millisecond):
+	}
+}
@@ -0,0 +1,673 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// WritableFS is the subset of the path-based virtual file system
+// abstractions popular in Go, such as afero.Fs and billy.Filesystem, that is
+// needed to serve a read-write mount with NewWritableFSFileSystem. Paths are
+// slash-separated and absolute, with "/" the root of the mount.
+//
+// Neither library's types implement it directly, since their methods return
+// their own File types, but a shim is a few lines; see the examples in
+// github.com/jacobsa/fuse/fuseutil/examples, a module of its own so that this
+// one doesn't depend on either library. billy's files lack WriteAt, so its shim
+// builds one from Seek and Write.
+type WritableFS interface {
+	// As for os.OpenFile. The flags never include os.O_APPEND; the kernel
+	// supplies the offset of every write.
+	OpenFile(name string, flag int, perm os.FileMode) (WritableFile, error)
+
+	// As for os.Lstat: a symlink is reported as such, not followed. This is
+	// not what Stat does in afero.Fs and billy.Filesystem, so shims implement
+	// it with their Lstat (afero.Lstater.LstatIfPossible, billy.Symlink.Lstat)
+	// where the file system supports symlinks.
+	Stat(name string) (os.FileInfo, error)
+
+	// Return the entries of the named directory, sorted by name or not.
+	ReadDir(name string) ([]os.FileInfo, error)
+
+	// As for os.Mkdir, os.Remove and os.Rename. Remove is used for both files
+	// and empty directories.
+	Mkdir(name string, perm os.FileMode) error
+	Remove(name string) error
+	Rename(oldname, newname string) error
+}
+
+// WritableFile is a file opened by WritableFS.OpenFile. If it also has a
+// method Sync() error, as *os.File does, that is called for fsync(2).
+type WritableFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Truncate(size int64) error
+}
+
+// Optional WritableFS methods, used for chmod(2), utimes(2), symlink(2) and
+// readlink(2) if present (as they are on afero.Fs and billy.Filesystem, up to
+// naming). Without them those calls fail with ENOSYS.
+type writableFSChmod interface {
+	Chmod(name string, mode os.FileMode) error
+}
+
+type writableFSChtimes interface {
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+type writableFSSymlink interface {
+	Symlink(target, link string) error
+	Readlink(link string) (string, error)
+}
+
+// NewWritableFSFileSystem returns a file system serving the contents of fsys
+// through the mount, read-write. Inode IDs are assigned on lookup and
+// recycled once the kernel forgets them; hard links aren't recognized as
+// such.
+//
+// Ownership is taken from the attributes fsys reports if they are those of
+// the host file system (as with afero.OsFs), and is otherwise the user
+// running the process.
+func NewWritableFSFileSystem(fsys WritableFS) FileSystem {
+	return &writableFS{
+		fsys:       fsys,
+		uid:        uint32(os.Getuid()),
+		gid:        uint32(os.Getgid()),
+		entries:    NewEntryMap(),
+		handles:    make(map[fuseops.HandleID]*writableFSHandle),
+		nextInode:  fuseops.RootInodeID + 1,
+		nextHandle: 1,
+	}
+}
+
+type writableFS struct {
+	NotImplementedFileSystem
+
+	fsys     WritableFS
+	uid, gid uint32
+	entries  *EntryMap
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]*writableFSHandle
+
+	// GUARDED_BY(mu)
+	nextInode fuseops.InodeID
+
+	// GUARDED_BY(mu)
+	nextHandle fuseops.HandleID
+}
+
+// An open file, or an open directory's path and entries.
+type writableFSHandle struct {
+	f WritableFile
+
+	dir     string
+	entries []os.FileInfo
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Return the path of the supplied inode.
+func (fs *writableFS) pathOf(id fuseops.InodeID) (string, error) {
+	p, ok := fs.entries.Path(id)
+	if !ok {
+		return "", fuse.ENOENT
+	}
+
+	return p, nil
+}
+
+func (fs *writableFS) childPath(
+	parent fuseops.InodeID,
+	name string) (string, error) {
+	p, err := fs.pathOf(parent)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(p, name), nil
+}
+
+func (fs *writableFS) attributes(p string) (fuseops.InodeAttributes, error) {
+	fi, err := fs.fsys.Stat(p)
+	if err != nil {
+		return fuseops.InodeAttributes{}, writableFSError(err)
+	}
+
+	attrs := AttributesFromFileInfo(fi)
+	if _, ok := attributesFromStatSys(fi.Sys()); !ok {
+		attrs.Uid = fs.uid
+		attrs.Gid = fs.gid
+	}
+
+	return attrs, nil
+}
+
+// Fill in a ChildInodeEntry for the supplied name, recording the lookup.
+func (fs *writableFS) lookedUp(
+	parent fuseops.InodeID,
+	name string,
+	p string,
+	e *fuseops.ChildInodeEntry) error {
+	attrs, err := fs.attributes(p)
+	if err != nil {
+		return err
+	}
+
+	id, ok := fs.entries.LookUp(parent, name)
+	if !ok {
+		fs.mu.Lock()
+		id = fs.nextInode
+		fs.nextInode++
+		fs.mu.Unlock()
+	}
+
+	fs.entries.LookedUp(parent, name, id)
+	e.Child = id
+	e.Attributes = attrs
+	return nil
+}
+
+// Translate an error from fsys into one for the kernel.
+func writableFSError(err error) error {
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &errno):
+		return errno
+
+	case errors.Is(err, iofs.ErrNotExist):
+		return fuse.ENOENT
+
+	case errors.Is(err, iofs.ErrExist):
+		return fuse.EEXIST
+
+	case errors.Is(err, iofs.ErrPermission):
+		return syscall.EACCES
+
+	case errors.Is(err, iofs.ErrInvalid):
+		return fuse.EINVAL
+	}
+
+	return fuse.WrapError(fuse.EIO, err, "WritableFS")
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *writableFS) newHandle(h *writableFSHandle) fuseops.HandleID {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id := fs.nextHandle
+	fs.nextHandle++
+	fs.handles[id] = h
+	return id
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *writableFS) handle(id fuseops.HandleID) (*writableFSHandle, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	h, ok := fs.handles[id]
+	if !ok {
+		return nil, fuse.EINVAL
+	}
+
+	return h, nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *writableFS) releaseHandle(id fuseops.HandleID) *writableFSHandle {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	h := fs.handles[id]
+	delete(fs.handles, id)
+	return h
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *writableFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *writableFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	return fs.lookedUp(op.Parent, op.Name, p, &op.Entry)
+}
+
+func (fs *writableFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes, err = fs.attributes(p)
+	return err
+}
+
+func (fs *writableFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if op.Size != nil {
+		if err := fs.truncate(p, op.Handle, int64(*op.Size)); err != nil {
+			return err
+		}
+	}
+
+	if op.Mode != nil {
+		c, ok := fs.fsys.(writableFSChmod)
+		if !ok {
+			return fuse.ENOSYS
+		}
+
+		if err := c.Chmod(p, *op.Mode); err != nil {
+			return writableFSError(err)
+		}
+	}
+
+	if op.Atime != nil || op.Mtime != nil {
+		c, ok := fs.fsys.(writableFSChtimes)
+		if !ok {
+			return fuse.ENOSYS
+		}
+
+		// Chtimes sets both, so fill in whichever wasn't supplied.
+		attrs, err := fs.attributes(p)
+		if err != nil {
+			return err
+		}
+
+		atime, mtime := attrs.Atime, attrs.Mtime
+		if op.Atime != nil {
+			atime = *op.Atime
+		}
+		if op.Mtime != nil {
+			mtime = *op.Mtime
+		}
+
+		if err := c.Chtimes(p, atime, mtime); err != nil {
+			return writableFSError(err)
+		}
+	}
+
+	op.Attributes, err = fs.attributes(p)
+	return err
+}
+
+// Truncate the file at p, through the supplied handle if any.
+func (fs *writableFS) truncate(
+	p string,
+	handle *fuseops.HandleID,
+	size int64) error {
+	if handle != nil {
+		if h, err := fs.handle(*handle); err == nil && h.f != nil {
+			if err := h.f.Truncate(size); err != nil {
+				return writableFSError(err)
+			}
+
+			return nil
+		}
+	}
+
+	f, err := fs.fsys.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return writableFSError(err)
+	}
+
+	err = f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return writableFSError(err)
+	}
+
+	return nil
+}
+
+func (fs *writableFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.entries.Forget(op.Inode, op.N)
+	return nil
+}
+
+func (fs *writableFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.entries.Forget(e.Inode, e.N)
+	}
+
+	return nil
+}
+
+func (fs *writableFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.fsys.Mkdir(p, op.Mode.Perm()); err != nil {
+		return writableFSError(err)
+	}
+
+	return fs.lookedUp(op.Parent, op.Name, p, &op.Entry)
+}
+
+func (fs *writableFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.fsys.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, op.Mode.Perm())
+	if err != nil {
+		return writableFSError(err)
+	}
+
+	if err := fs.lookedUp(op.Parent, op.Name, p, &op.Entry); err != nil {
+		f.Close()
+		return err
+	}
+
+	op.Handle = fs.newHandle(&writableFSHandle{f: f})
+	return nil
+}
+
+func (fs *writableFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	s, ok := fs.fsys.(writableFSSymlink)
+	if !ok {
+		return fuse.ENOSYS
+	}
+
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Symlink(op.Target, p); err != nil {
+		return writableFSError(err)
+	}
+
+	return fs.lookedUp(op.Parent, op.Name, p, &op.Entry)
+}
+
+func (fs *writableFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	s, ok := fs.fsys.(writableFSSymlink)
+	if !ok {
+		return fuse.ENOSYS
+	}
+
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Target, err = s.Readlink(p)
+	if err != nil {
+		return writableFSError(err)
+	}
+
+	return nil
+}
+
+func (fs *writableFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	oldPath, err := fs.childPath(op.OldParent, op.OldName)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := fs.childPath(op.NewParent, op.NewName)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.fsys.Rename(oldPath, newPath); err != nil {
+		return writableFSError(err)
+	}
+
+	fs.entries.Rename(op.OldParent, op.OldName, op.NewParent, op.NewName)
+	return nil
+}
+
+func (fs *writableFS) remove(parent fuseops.InodeID, name string) error {
+	p, err := fs.childPath(parent, name)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.fsys.Remove(p); err != nil {
+		return writableFSError(err)
+	}
+
+	fs.entries.Unlink(parent, name)
+	return nil
+}
+
+func (fs *writableFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.remove(op.Parent, op.Name)
+}
+
+func (fs *writableFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.remove(op.Parent, op.Name)
+}
+
+func (fs *writableFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	// Snapshot the listing, so that offsets stay meaningful for the life of
+	// the handle.
+	entries, err := fs.fsys.ReadDir(p)
+	if err != nil {
+		return writableFSError(err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	op.Handle = fs.newHandle(&writableFSHandle{entries: entries, dir: p})
+	return nil
+}
+
+func (fs *writableFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	h, err := fs.handle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	for i := int(op.Offset); i < len(h.entries); i++ {
+		e := h.entries[i]
+
+		// Use the inode's ID if the kernel knows it. Otherwise any non-zero
+		// value will do, since the kernel ignores it.
+		id, ok := fs.entries.LookUp(op.Inode, e.Name())
+		if !ok {
+			id = HashInodeID(path.Join(h.dir, e.Name()))
+		}
+
+		d := Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  id,
+			Name:   e.Name(),
+			Type:   DirentTypeForMode(e.Mode()),
+		}
+
+		n := WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *writableFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.releaseHandle(op.Handle)
+	return nil
+}
+
+func (fs *writableFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.fsys.OpenFile(p, int(op.OpenFlags)&^os.O_APPEND, 0)
+	if err != nil {
+		return writableFSError(err)
+	}
+
+	op.Handle = fs.newHandle(&writableFSHandle{f: f})
+	return nil
+}
+
+func (fs *writableFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	h, err := fs.handle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead, err = h.f.ReadAt(op.Dst, op.Offset)
+
+	// Short reads are how the kernel learns of EOF.
+	if err == io.EOF {
+		err = nil
+	}
+
+	if err != nil {
+		return writableFSError(err)
+	}
+
+	return nil
+}
+
+func (fs *writableFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	h, err := fs.handle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if _, err := h.f.WriteAt(op.Data, op.Offset); err != nil {
+		return writableFSError(err)
+	}
+
+	return nil
+}
+
+func (fs *writableFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	h, err := fs.handle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	s, ok := h.f.(interface{ Sync() error })
+	if !ok {
+		return nil
+	}
+
+	if err := s.Sync(); err != nil {
+		return writableFSError(err)
+	}
+
+	return nil
+}
+
+func (fs *writableFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (fs *writableFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	if h := fs.releaseHandle(op.Handle); h != nil && h.f != nil {
+		h.f.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A WritableFS rooted at a directory on disk, like afero.BasePathFs over
+// afero.OsFs.
+type dirWritableFS struct {
+	root string
+}
+
+func (fs dirWritableFS) path(name string) string {
+	return filepath.Join(fs.root, filepath.FromSlash(name))
+}
+
+func (fs dirWritableFS) OpenFile(name string, flag int, perm os.FileMode) (WritableFile, error) {
+	return os.OpenFile(fs.path(name), flag, perm)
+}
+
+func (fs dirWritableFS) Stat(name string) (os.FileInfo, error) {
+	return os.Lstat(fs.path(name))
+}
+
+func (fs dirWritableFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(fs.path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	var fis []os.FileInfo
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		fis = append(fis, fi)
+	}
+
+	return fis, nil
+}
+
+func (fs dirWritableFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(fs.path(name), perm)
+}
+
+func (fs dirWritableFS) Remove(name string) error {
+	return os.Remove(fs.path(name))
+}
+
+func (fs dirWritableFS) Rename(oldname, newname string) error {
+	return os.Rename(fs.path(oldname), fs.path(newname))
+}
+
+func (fs dirWritableFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(fs.path(name), mode)
+}
+
+func TestWritableFS(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	fs := NewWritableFSFileSystem(dirWritableFS{root})
+
+	// Make a directory and a file within it, and write to the file.
+	mkDir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir", Mode: 0755}
+	if err := fs.MkDir(ctx, mkDir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	dir := mkDir.Entry.Child
+	create := &fuseops.CreateFileOp{Parent: dir, Name: "a", Mode: 0644}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	write := &fuseops.WriteFileOp{Handle: create.Handle, Offset: 2, Data: []byte("taco")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	read := &fuseops.ReadFileOp{Handle: create.Handle, Offset: 1, Dst: make([]byte, 10)}
+	if err := fs.ReadFile(ctx, read); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if got, want := string(read.Dst[:read.BytesRead]), "\x00taco"; got != want {
+		t.Errorf("ReadFile = %q, want %q", got, want)
+	}
+
+	fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: create.Handle})
+
+	// Truncate and chmod it by inode.
+	size := uint64(3)
+	mode := os.FileMode(0600)
+	setattr := &fuseops.SetInodeAttributesOp{Inode: create.Entry.Child, Size: &size, Mode: &mode}
+	if err := fs.SetInodeAttributes(ctx, setattr); err != nil {
+		t.Fatalf("SetInodeAttributes: %v", err)
+	}
+
+	if attrs := setattr.Attributes; attrs.Size != 3 || attrs.Mode != 0600 {
+		t.Errorf("Attributes after setattr: %+v", attrs)
+	}
+
+	// Rename it, after which its inode refers to the new name.
+	rename := &fuseops.RenameOp{OldParent: dir, OldName: "a", NewParent: fuseops.RootInodeID, NewName: "b"}
+	if err := fs.Rename(ctx, rename); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(root, "b"))
+	if err != nil || string(contents) != "\x00\x00t" {
+		t.Errorf("Contents of b: %q, %v", contents, err)
+	}
+
+	getattr := &fuseops.GetInodeAttributesOp{Inode: create.Entry.Child}
+	if err := fs.GetInodeAttributes(ctx, getattr); err != nil || getattr.Attributes.Size != 3 {
+		t.Errorf("GetInodeAttributes after rename: %v, %+v", err, getattr.Attributes)
+	}
+
+	// List the root.
+	openDir := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	if err := fs.OpenDir(ctx, openDir); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	readDir := &fuseops.ReadDirOp{Inode: fuseops.RootInodeID, Handle: openDir.Handle, Dst: make([]byte, 4096)}
+	if err := fs.ReadDir(ctx, readDir); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	names, _ := parseDirents(t, readDir.Dst[:readDir.BytesRead])
+	if want := []string{"b", "dir"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Names = %q, want %q", names, want)
+	}
+
+	// Errors from the backing store become errnos, and unsupported optional
+	// methods ENOSYS.
+	if err := fs.RmDir(ctx, &fuseops.RmDirOp{Parent: fuseops.RootInodeID, Name: "nope"}); err != fuse.ENOENT {
+		t.Errorf("RmDir: %v, want ENOENT", err)
+	}
+
+	symlink := &fuseops.CreateSymlinkOp{Parent: fuseops.RootInodeID, Name: "l", Target: "b"}
+	if err := fs.CreateSymlink(ctx, symlink); err != fuse.ENOSYS {
+		t.Errorf("CreateSymlink: %v, want ENOSYS", err)
+	}
+
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "b"}); err != nil {
+		t.Errorf("Unlink: %v", err)
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Configuration for NewWriteCoalescingFileSystem.
+type WriteCoalescingConfig struct {
+	// Once this many contiguous bytes are buffered for a handle, they are
+	// forwarded. Defaults to 1 MiB.
+	MaxBytes int
+
+	// If non-zero, forwarded writes other than the last ones before a flush
+	// end at multiples of this offset, with the unaligned tail kept buffered.
+	// They start wherever the buffered data does, which is aligned only if the
+	// writes that filled the buffer were. Useful for backends with a natural
+	// block size.
+	Alignment int64
+
+	// Buffered data is forwarded at most this long after it was first written.
+	// Zero means it is only forwarded when MaxBytes is reached or the handle is
+	// flushed.
+	Delay time.Duration
+}
+
+// NewWriteCoalescingFileSystem wraps the supplied file system so that small
+// writes to a file handle are merged, when they are adjacent or overlap, into
+// larger writes before being passed on. This helps with backends that have a
+// high per-request overhead, since the kernel often sends writes much smaller
+// than the user's (e.g. with writeback caching disabled).
+//
+// Buffered data is forwarded before any op that could observe it: FlushFile,
+// SyncFile and ReleaseFileHandle for the handle, and ReadFile,
+// GetInodeAttributes, SetInodeAttributes, Fallocate, CopyFileRange and LSeek
+// for the inode. An error forwarding a write the kernel has already been told
+// succeeded is returned by the next of those ops or WriteFile for the handle.
+func NewWriteCoalescingFileSystem(
+	wrapped FileSystem,
+	cfg WriteCoalescingConfig) FileSystem {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 1 << 20
+	}
+
+	return &writeCoalescingFS{
+		FileSystem: wrapped,
+		cfg:        cfg,
+		handles:    make(map[fuseops.HandleID]*coalescingHandle),
+	}
+}
+
+type writeCoalescingFS struct {
+	FileSystem
+	cfg WriteCoalescingConfig
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]*coalescingHandle
+}
+
+// The buffered state for one file handle.
+type coalescingHandle struct {
+	mu sync.Mutex
+
+	// The write whose Data holds the contiguous buffered bytes, or nil if
+	// nothing is buffered.
+	//
+	// GUARDED_BY(mu)
+	pending *fuseops.WriteFileOp
+
+	// A pending call to flush after cfg.Delay, if any.
+	//
+	// GUARDED_BY(mu)
+	timer *time.Timer
+
+	// An error from forwarding buffered data, not yet returned to the kernel.
+	//
+	// GUARDED_BY(mu)
+	err error
+}
+
+// Return the state for the handle, creating it if necessary.
+func (fs *writeCoalescingFS) handle(h fuseops.HandleID) *coalescingHandle {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ch := fs.handles[h]
+	if ch == nil {
+		ch = &coalescingHandle{}
+		fs.handles[h] = ch
+	}
+
+	return ch
+}
+
+// Forward everything buffered for the handle, clearing and returning any
+// deferred error.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(ch.mu)
+func (fs *writeCoalescingFS) flushLocked(
+	ctx context.Context,
+	ch *coalescingHandle) error {
+	if ch.timer != nil {
+		ch.timer.Stop()
+		ch.timer = nil
+	}
+
+	if ch.pending != nil {
+		op := ch.pending
+		ch.pending = nil
+		if err := fs.FileSystem.WriteFile(ctx, op); err != nil && ch.err == nil {
+			ch.err = err
+		}
+	}
+
+	err := ch.err
+	ch.err = nil
+	return err
+}
+
+// Forward everything buffered for the handle.
+func (fs *writeCoalescingFS) flushHandle(
+	ctx context.Context,
+	h fuseops.HandleID) error {
+	fs.mu.Lock()
+	ch := fs.handles[h]
+	fs.mu.Unlock()
+
+	if ch == nil {
+		return nil
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return fs.flushLocked(ctx, ch)
+}
+
+// Forward everything buffered for any handle open on the inode.
+func (fs *writeCoalescingFS) flushInode(
+	ctx context.Context,
+	inode fuseops.InodeID) error {
+	fs.mu.Lock()
+	var handles []*coalescingHandle
+	for _, ch := range fs.handles {
+		handles = append(handles, ch)
+	}
+	fs.mu.Unlock()
+
+	var firstErr error
+	for _, ch := range handles {
+		ch.mu.Lock()
+		if ch.pending != nil && ch.pending.Inode == inode {
+			if err := fs.flushLocked(ctx, ch); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		ch.mu.Unlock()
+	}
+
+	return firstErr
+}
+
+func (fs *writeCoalescingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	ch := fs.handle(op.Handle)
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.err != nil {
+		err := ch.err
+		ch.err = nil
+		return err
+	}
+
+	start := op.Offset
+	end := op.Offset + int64(len(op.Data))
+
+	// Merge with what's buffered if the write touches it, and otherwise
+	// forward what's buffered to make room.
+	if p := ch.pending; p != nil {
+		pStart := p.Offset
+		pEnd := p.Offset + int64(len(p.Data))
+
+		if start <= pEnd && end >= pStart {
+			newStart, newEnd := pStart, pEnd
+			if start < newStart {
+				newStart = start
+			}
+			if end > newEnd {
+				newEnd = end
+			}
+
+			data := p.Data
+			if newStart < pStart || newEnd > pEnd {
+				data = make([]byte, newEnd-newStart)
+				copy(data[pStart-newStart:], p.Data)
+			}
+
+			copy(data[start-newStart:], op.Data)
+			p.Offset = newStart
+			p.Data = data
+		} else if err := fs.flushLocked(ctx, ch); err != nil {
+			return err
+		}
+	}
+
+	// The kernel reuses the op's buffer once we return, so take a copy.
+	if ch.pending == nil {
+		ch.pending = &fuseops.WriteFileOp{
+			Inode:     op.Inode,
+			Handle:    op.Handle,
+			Offset:    op.Offset,
+			Data:      append([]byte(nil), op.Data...),
+			OpContext: op.OpContext,
+		}
+
+		if fs.cfg.Delay > 0 {
+			ch.timer = time.AfterFunc(fs.cfg.Delay, func() {
+				ch.mu.Lock()
+				defer ch.mu.Unlock()
+
+				// Keep any error for the next op on the handle.
+				ch.err = fs.flushLocked(context.Background(), ch)
+			})
+		}
+	}
+
+	if len(ch.pending.Data) >= fs.cfg.MaxBytes {
+		return fs.forwardAlignedLocked(ctx, ch)
+	}
+
+	return nil
+}
+
+// Forward the buffered data up to the last alignment boundary, keeping the
+// rest buffered.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(ch.mu)
+func (fs *writeCoalescingFS) forwardAlignedLocked(
+	ctx context.Context,
+	ch *coalescingHandle) error {
+	p := ch.pending
+	end := p.Offset + int64(len(p.Data))
+
+	cut := end
+	if a := fs.cfg.Alignment; a > 0 {
+		cut = end - end%a
+	}
+
+	if cut <= p.Offset {
+		return nil
+	}
+
+	if cut == end {
+		return fs.flushLocked(ctx, ch)
+	}
+
+	head := &fuseops.WriteFileOp{
+		Inode:     p.Inode,
+		Handle:    p.Handle,
+		Offset:    p.Offset,
+		Data:      p.Data[:cut-p.Offset],
+		OpContext: p.OpContext,
+	}
+
+	if err := fs.FileSystem.WriteFile(ctx, head); err != nil {
+		return err
+	}
+
+	p.Data = append([]byte(nil), p.Data[cut-p.Offset:]...)
+	p.Offset = cut
+	return nil
+}
+
+func (fs *writeCoalescingFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	if err := fs.flushHandle(ctx, op.Handle); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.FlushFile(ctx, op)
+}
+
+func (fs *writeCoalescingFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	if err := fs.flushHandle(ctx, op.Handle); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SyncFile(ctx, op)
+}
+
+func (fs *writeCoalescingFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	err := fs.flushHandle(ctx, op.Handle)
+
+	fs.mu.Lock()
+	delete(fs.handles, op.Handle)
+	fs.mu.Unlock()
+
+	// The kernel ignores errors from this op, so there is nowhere to report a
+	// deferred write error other than the wrapped file system's reply.
+	if releaseErr := fs.FileSystem.ReleaseFileHandle(ctx, op); releaseErr != nil {
+		return releaseErr
+	}
+
+	return err
+}
+
+func (fs *writeCoalescingFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if err := fs.flushInode(ctx, op.Inode); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.ReadFile(ctx, op)
+}
+
+func (fs *writeCoalescingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if err := fs.flushInode(ctx, op.Inode); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.GetInodeAttributes(ctx, op)
+}
+
+func (fs *writeCoalescingFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := fs.flushInode(ctx, op.Inode); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *writeCoalescingFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	if err := fs.flushInode(ctx, op.Inode); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *writeCoalescingFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	if err := fs.flushInode(ctx, op.SrcInode); err != nil {
+		return err
+	}
+
+	if op.DstInode != op.SrcInode {
+		if err := fs.flushInode(ctx, op.DstInode); err != nil {
+			return err
+		}
+	}
+
+	return fs.FileSystem.CopyFileRange(ctx, op)
+}
+
+func (fs *writeCoalescingFS) LSeek(
+	ctx context.Context,
+	op *fuseops.LSeekOp) error {
+	if err := fs.flushInode(ctx, op.Inode); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.LSeek(ctx, op)
+}
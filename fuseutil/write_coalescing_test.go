@@ -0,0 +1,90 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type recordingWriteFS struct {
+	NotImplementedFileSystem
+	writes []string
+	err    error
+}
+
+func (fs *recordingWriteFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.writes = append(fs.writes, fmt.Sprintf("%d:%s", op.Offset, op.Data))
+	return fs.err
+}
+
+func (fs *recordingWriteFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &recordingWriteFS{}
+	fs := NewWriteCoalescingFileSystem(wrapped, WriteCoalescingConfig{
+		MaxBytes:  8,
+		Alignment: 4,
+	})
+
+	write := func(off int64, data string) {
+		buf := []byte(data)
+		op := &fuseops.WriteFileOp{Inode: 2, Handle: 1, Offset: off, Data: buf}
+		if err := fs.WriteFile(ctx, op); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+
+		// The caller's buffer may be reused.
+		for i := range buf {
+			buf[i] = '!'
+		}
+	}
+
+	write(0, "ab")
+	write(2, "cd")
+	write(1, "X")   // Overlaps.
+	write(10, "zz") // Not contiguous, so forwards the above.
+	write(4, "efghij")
+	write(13, "abcdefgh") // Forwarded up to the alignment boundary.
+
+	if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: 2, Handle: 1}); err != nil {
+		t.Fatalf("FlushFile: %v", err)
+	}
+
+	want := []string{"0:aXcd", "4:efghijzz", "13:abcdefg", "20:h"}
+	if !reflect.DeepEqual(wrapped.writes, want) {
+		t.Errorf("writes = %q, want %q", wrapped.writes, want)
+	}
+
+	// Errors from buffered writes are reported by the next flush.
+	wrapped.err = syscall.ENOSPC
+	write(0, "a")
+	err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: 2, Handle: 1})
+	if err != syscall.ENOSPC {
+		t.Errorf("FlushFile: %v, want ENOSPC", err)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// WriteErrors records failures from writing back data asynchronously, so
+// that they can be reported on the next FlushFile or SyncFile (i.e. close(2)
+// or fsync(2)) as applications expect, rather than being lost.
+//
+// Errors can be recorded against a handle, in which case only that handle
+// sees them, or against an inode, in which case each handle open on the inode
+// when the error was recorded sees it once, similar to the kernel's handling
+// of writeback errors for local file systems (cf. errseq_t). Handles opened
+// afterward don't see it.
+//
+// Call Opened from OpenFile and CreateFile, Released from ReleaseFileHandle,
+// and Take from FlushFile and SyncFile. Safe for concurrent access.
+type WriteErrors struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*inodeWriteError
+
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]*handleWriteError
+}
+
+type inodeWriteError struct {
+	err error
+
+	// Incremented each time an error is recorded.
+	seq uint64
+}
+
+type handleWriteError struct {
+	inode fuseops.InodeID
+	err   error
+
+	// The inode's seq when the handle last saw its error.
+	seen uint64
+}
+
+// NewWriteErrors creates an empty set of errors.
+func NewWriteErrors() *WriteErrors {
+	return &WriteErrors{
+		inodes:  make(map[fuseops.InodeID]*inodeWriteError),
+		handles: make(map[fuseops.HandleID]*handleWriteError),
+	}
+}
+
+// Opened registers a newly opened handle for the inode.
+func (we *WriteErrors) Opened(inode fuseops.InodeID, h fuseops.HandleID) {
+	we.mu.Lock()
+	defer we.mu.Unlock()
+
+	he := &handleWriteError{inode: inode}
+	if ie := we.inodes[inode]; ie != nil {
+		he.seen = ie.seq
+	}
+
+	we.handles[h] = he
+}
+
+// Released forgets the handle, discarding any error not yet taken.
+func (we *WriteErrors) Released(h fuseops.HandleID) {
+	we.mu.Lock()
+	defer we.mu.Unlock()
+
+	delete(we.handles, h)
+}
+
+// Forget discards the state for the inode, e.g. from ForgetInode.
+func (we *WriteErrors) Forget(inode fuseops.InodeID) {
+	we.mu.Lock()
+	defer we.mu.Unlock()
+
+	delete(we.inodes, inode)
+}
+
+// SetHandleError records an error to be reported to the handle only. If an
+// error is already pending for the handle, the earlier one is kept.
+func (we *WriteErrors) SetHandleError(h fuseops.HandleID, err error) {
+	we.mu.Lock()
+	defer we.mu.Unlock()
+
+	if he := we.handles[h]; he != nil && he.err == nil {
+		he.err = err
+	}
+}
+
+// SetInodeError records an error to be reported to each handle currently open
+// on the inode.
+func (we *WriteErrors) SetInodeError(inode fuseops.InodeID, err error) {
+	we.mu.Lock()
+	defer we.mu.Unlock()
+
+	ie := we.inodes[inode]
+	if ie == nil {
+		ie = &inodeWriteError{}
+		we.inodes[inode] = ie
+	}
+
+	ie.err = err
+	ie.seq++
+}
+
+// Take returns the error pending for the handle, if any, and marks it as
+// reported. An error recorded against the handle itself takes precedence over
+// one recorded against its inode.
+func (we *WriteErrors) Take(h fuseops.HandleID) error {
+	we.mu.Lock()
+	defer we.mu.Unlock()
+
+	he := we.handles[h]
+	if he == nil {
+		return nil
+	}
+
+	if err := he.err; err != nil {
+		he.err = nil
+		return err
+	}
+
+	if ie := we.inodes[he.inode]; ie != nil && ie.seq != he.seen {
+		he.seen = ie.seq
+		return ie.err
+	}
+
+	return nil
+}
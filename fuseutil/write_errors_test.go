@@ -0,0 +1,57 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestWriteErrors(t *testing.T) {
+	we := NewWriteErrors()
+	we.Opened(2, 10)
+	we.Opened(2, 11)
+
+	we.SetInodeError(2, syscall.EIO)
+	we.SetHandleError(11, syscall.ENOSPC)
+
+	// Opened after the error, so doesn't see it.
+	we.Opened(2, 12)
+
+	if err := we.Take(10); err != syscall.EIO {
+		t.Errorf("Take(10) = %v, want EIO", err)
+	}
+
+	if err := we.Take(10); err != nil {
+		t.Errorf("second Take(10) = %v, want nil", err)
+	}
+
+	if err := we.Take(11); err != syscall.ENOSPC {
+		t.Errorf("Take(11) = %v, want ENOSPC", err)
+	}
+
+	if err := we.Take(11); err != syscall.EIO {
+		t.Errorf("second Take(11) = %v, want EIO", err)
+	}
+
+	if err := we.Take(12); err != nil {
+		t.Errorf("Take(12) = %v, want nil", err)
+	}
+
+	we.Released(10)
+	if err := we.Take(10); err != nil {
+		t.Errorf("Take after Released = %v, want nil", err)
+	}
+}
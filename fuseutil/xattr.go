@@ -0,0 +1,77 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// WriteXattrValue fills in the reply to the supplied op with the given
+// attribute value, following getxattr(2): a nil op.Dst asks only for the
+// size, and a non-nil one too small for the value is an ERANGE error. Any
+// op.Position is applied first, so file systems that store resource forks
+// whole need not handle it themselves.
+//
+// The result is suitable for returning from FileSystem.GetXattr directly.
+func WriteXattrValue(op *fuseops.GetXattrOp, value []byte) error {
+	if int(op.Position) > len(value) {
+		value = nil
+	} else {
+		value = value[op.Position:]
+	}
+
+	op.BytesRead = len(value)
+	if op.Dst == nil {
+		return nil
+	}
+
+	if len(op.Dst) < len(value) {
+		return syscall.ERANGE
+	}
+
+	copy(op.Dst, value)
+	return nil
+}
+
+// WriteXattrNames fills in the reply to the supplied op with the given
+// attribute names, following listxattr(2) in the same way as WriteXattrValue.
+//
+// The result is suitable for returning from FileSystem.ListXattr directly.
+func WriteXattrNames(op *fuseops.ListXattrOp, names []string) error {
+	var size int
+	for _, name := range names {
+		size += len(name) + 1
+	}
+
+	op.BytesRead = size
+	if op.Dst == nil {
+		return nil
+	}
+
+	if len(op.Dst) < size {
+		return syscall.ERANGE
+	}
+
+	dst := op.Dst
+	for _, name := range names {
+		n := copy(dst, name)
+		dst[n] = 0
+		dst = dst[n+1:]
+	}
+
+	return nil
+}
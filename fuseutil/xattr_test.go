@@ -0,0 +1,55 @@
+package fuseutil
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestWriteXattrValue(t *testing.T) {
+	value := []byte("taco")
+
+	// Asking for the size.
+	op := &fuseops.GetXattrOp{}
+	if err := WriteXattrValue(op, value); err != nil || op.BytesRead != 4 {
+		t.Errorf("Size: got %d, %v", op.BytesRead, err)
+	}
+
+	// Too small.
+	op = &fuseops.GetXattrOp{Dst: make([]byte, 3)}
+	if err := WriteXattrValue(op, value); err != syscall.ERANGE || op.BytesRead != 4 {
+		t.Errorf("Small: got %d, %v", op.BytesRead, err)
+	}
+
+	// Big enough, with an offset.
+	op = &fuseops.GetXattrOp{Dst: make([]byte, 8), Position: 1}
+	if err := WriteXattrValue(op, value); err != nil || string(op.Dst[:op.BytesRead]) != "aco" {
+		t.Errorf("Offset: got %q, %v", op.Dst[:op.BytesRead], err)
+	}
+
+	// An offset past the end.
+	op = &fuseops.GetXattrOp{Dst: make([]byte, 8), Position: 5}
+	if err := WriteXattrValue(op, value); err != nil || op.BytesRead != 0 {
+		t.Errorf("Past end: got %d, %v", op.BytesRead, err)
+	}
+}
+
+func TestWriteXattrNames(t *testing.T) {
+	names := []string{"user.foo", "user.ba"}
+
+	op := &fuseops.ListXattrOp{}
+	if err := WriteXattrNames(op, names); err != nil || op.BytesRead != 17 {
+		t.Errorf("Size: got %d, %v", op.BytesRead, err)
+	}
+
+	op = &fuseops.ListXattrOp{Dst: make([]byte, 16)}
+	if err := WriteXattrNames(op, names); err != syscall.ERANGE || op.BytesRead != 17 {
+		t.Errorf("Small: got %d, %v", op.BytesRead, err)
+	}
+
+	op = &fuseops.ListXattrOp{Dst: make([]byte, 17)}
+	if err := WriteXattrNames(op, names); err != nil || string(op.Dst) != "user.foo\x00user.ba\x00" {
+		t.Errorf("Full: got %q, %v", op.Dst, err)
+	}
+}
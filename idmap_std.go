@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package fuse
+
+import (
+	"os"
+	"syscall"
+)
+
+// ID-mapped mounts are Linux only; MountConfig.validate rejects them first.
+func idmapMount(dir string, userns *os.File) error {
+	return syscall.ENOSYS
+}
@@ -28,13 +28,8 @@ import (
 // this.
 var pageSize int
 
-// We size the buffer to have enough room for a fuse request plus data
-// associated with a write request.
-var bufSize int
-
 func init() {
 	pageSize = syscall.Getpagesize()
-	bufSize = pageSize + MaxWriteSize
 }
 
 // An incoming message from the kernel, including leading fusekernel.InHeader
@@ -46,10 +41,12 @@ type InMessage struct {
 	size      int
 }
 
-// NewInMessage creates a new InMessage with its storage initialized.
-func NewInMessage() *InMessage {
+// NewInMessage creates a new InMessage with its storage initialized, with
+// enough room for a fuse request plus the data associated with a write
+// request of up to maxWrite bytes.
+func NewInMessage(maxWrite int) *InMessage {
 	return &InMessage{
-		storage: make([]byte, bufSize),
+		storage: make([]byte, pageSize+maxWrite),
 	}
 }
 
@@ -114,6 +111,12 @@ func (m *InMessage) Header() *fusekernel.InHeader {
 	return (*fusekernel.InHeader)(unsafe.Pointer(&m.storage[0]))
 }
 
+// Return the whole message read in the most recent call to Init, header
+// included.
+func (m *InMessage) Bytes() []byte {
+	return m.storage[:m.size]
+}
+
 // Return the number of bytes left to consume.
 func (m *InMessage) Len() uintptr {
 	return uintptr(len(m.remaining))
@@ -14,7 +14,7 @@
 
 package buffer
 
-// The maximum fuse write request size that InMessage can acommodate.
+// The default maximum fuse write request size (cf. MountConfig.MaxWrite).
 //
 // Experimentally, OS X appears to cap the size of writes to 1 MiB, regardless
 // of whether a larger size is specified in the mount options.
@@ -106,6 +106,7 @@ const (
 	SetattrAtimeNow  SetattrValid = 1 << 7
 	SetattrMtimeNow  SetattrValid = 1 << 8
 	SetattrLockOwner SetattrValid = 1 << 9 // http://www.mail-archive.com/git-commits-head@vger.kernel.org/msg27852.html
+	SetattrCtime     SetattrValid = 1 << 10
 
 	// OS X only
 	SetattrCrtime   SetattrValid = 1 << 28
@@ -144,6 +145,7 @@ var setattrValidNames = []flagName{
 	{uint32(SetattrAtimeNow), "SetattrAtimeNow"},
 	{uint32(SetattrMtimeNow), "SetattrMtimeNow"},
 	{uint32(SetattrLockOwner), "SetattrLockOwner"},
+	{uint32(SetattrCtime), "SetattrCtime"},
 	{uint32(SetattrCrtime), "SetattrCrtime"},
 	{uint32(SetattrChgtime), "SetattrChgtime"},
 	{uint32(SetattrBkuptime), "SetattrBkuptime"},
@@ -168,7 +170,7 @@ const (
 
 // OpenAccessModeMask is a bitmask that separates the access mode
 // from the other flags in OpenFlags.
-const OpenAccessModeMask OpenFlags = syscall.O_ACCMODE
+const OpenAccessModeMask OpenFlags = OpenReadOnly | OpenWriteOnly | OpenReadWrite
 
 // OpenFlags are the O_FOO flags passed to open/create/etc calls. For
 // example, os.O_WRONLY | os.O_APPEND.
@@ -199,6 +201,11 @@ func (fl OpenFlags) IsReadWrite() bool {
 	return fl&OpenAccessModeMask == OpenReadWrite
 }
 
+// Return true if OpenTruncate is set.
+func (fl OpenFlags) IsTruncate() bool {
+	return fl&OpenTruncate != 0
+}
+
 func accModeName(flags OpenFlags) string {
 	switch flags {
 	case OpenReadOnly:
@@ -227,6 +234,7 @@ const (
 	OpenDirectIO    OpenResponseFlags = 1 << 0 // bypass page cache for this open file
 	OpenKeepCache   OpenResponseFlags = 1 << 1 // don't invalidate the data cache on open
 	OpenNonSeekable OpenResponseFlags = 1 << 2 // mark the file as non-seekable (not supported on OS X)
+	OpenPassthrough OpenResponseFlags = 1 << 7 // serve reads and writes from OpenOut.BackingID (Linux 6.9+)
 
 	OpenPurgeAttr OpenResponseFlags = 1 << 30 // OS X
 	OpenPurgeUBC  OpenResponseFlags = 1 << 31 // OS X
@@ -240,6 +248,7 @@ var openResponseFlagNames = []flagName{
 	{uint32(OpenDirectIO), "OpenDirectIO"},
 	{uint32(OpenKeepCache), "OpenKeepCache"},
 	{uint32(OpenNonSeekable), "OpenNonSeekable"},
+	{uint32(OpenPassthrough), "OpenPassthrough"},
 	{uint32(OpenPurgeAttr), "OpenPurgeAttr"},
 	{uint32(OpenPurgeUBC), "OpenPurgeUBC"},
 }
@@ -248,28 +257,30 @@ var openResponseFlagNames = []flagName{
 type InitFlags uint32
 
 const (
-	InitAsyncRead        InitFlags = 1 << 0
-	InitPosixLocks       InitFlags = 1 << 1
-	InitFileOps          InitFlags = 1 << 2
-	InitAtomicTrunc      InitFlags = 1 << 3
-	InitExportSupport    InitFlags = 1 << 4
-	InitBigWrites        InitFlags = 1 << 5
-	InitDontMask         InitFlags = 1 << 6
-	InitSpliceWrite      InitFlags = 1 << 7
-	InitSpliceMove       InitFlags = 1 << 8
-	InitSpliceRead       InitFlags = 1 << 9
-	InitFlockLocks       InitFlags = 1 << 10
-	InitHasIoctlDir      InitFlags = 1 << 11
-	InitAutoInvalData    InitFlags = 1 << 12
-	InitDoReaddirplus    InitFlags = 1 << 13
-	InitReaddirplusAuto  InitFlags = 1 << 14
-	InitAsyncDIO         InitFlags = 1 << 15
-	InitWritebackCache   InitFlags = 1 << 16
-	InitNoOpenSupport    InitFlags = 1 << 17
-	InitParallelDirOps   InitFlags = 1 << 18
-	InitMaxPages         InitFlags = 1 << 22
-	InitCacheSymlinks    InitFlags = 1 << 23
-	InitNoOpendirSupport InitFlags = 1 << 24
+	InitAsyncRead         InitFlags = 1 << 0
+	InitPosixLocks        InitFlags = 1 << 1
+	InitFileOps           InitFlags = 1 << 2
+	InitAtomicTrunc       InitFlags = 1 << 3
+	InitExportSupport     InitFlags = 1 << 4
+	InitBigWrites         InitFlags = 1 << 5
+	InitDontMask          InitFlags = 1 << 6
+	InitSpliceWrite       InitFlags = 1 << 7
+	InitSpliceMove        InitFlags = 1 << 8
+	InitSpliceRead        InitFlags = 1 << 9
+	InitFlockLocks        InitFlags = 1 << 10
+	InitHasIoctlDir       InitFlags = 1 << 11
+	InitAutoInvalData     InitFlags = 1 << 12
+	InitDoReaddirplus     InitFlags = 1 << 13
+	InitReaddirplusAuto   InitFlags = 1 << 14
+	InitAsyncDIO          InitFlags = 1 << 15
+	InitWritebackCache    InitFlags = 1 << 16
+	InitNoOpenSupport     InitFlags = 1 << 17
+	InitParallelDirOps    InitFlags = 1 << 18
+	InitMaxPages          InitFlags = 1 << 22
+	InitCacheSymlinks     InitFlags = 1 << 23
+	InitNoOpendirSupport  InitFlags = 1 << 24
+	InitExplicitInvalData InitFlags = 1 << 25
+	InitExt               InitFlags = 1 << 30 // Linux only: InitInExt.Flags2 and InitOut.Flags2 are valid
 
 	InitCaseSensitive InitFlags = 1 << 29 // OS X only
 	InitVolRename     InitFlags = 1 << 30 // OS X only
@@ -303,6 +314,8 @@ var initFlagNames = []flagName{
 	{uint32(InitNoOpenSupport), "InitNoOpenSupport"},
 	{uint32(InitCacheSymlinks), "InitCacheSymlinks"},
 	{uint32(InitNoOpendirSupport), "InitNoOpendirSupport"},
+	{uint32(InitExplicitInvalData), "InitExplicitInvalData"},
+	{uint32(InitExt), "InitExt"},
 
 	{uint32(InitCaseSensitive), "InitCaseSensitive"},
 	{uint32(InitVolRename), "InitVolRename"},
@@ -313,6 +326,24 @@ func (fl InitFlags) String() string {
 	return flagString(uint32(fl), initFlagNames)
 }
 
+// The InitFlags2 are the upper 32 bits of the init flags, exchanged when
+// InitExt is set.
+type InitFlags2 uint32
+
+const (
+	InitPassthrough InitFlags2 = 1 << 5
+	InitAllowIdmap  InitFlags2 = 1 << 8
+)
+
+var initFlags2Names = []flagName{
+	{uint32(InitPassthrough), "InitPassthrough"},
+	{uint32(InitAllowIdmap), "InitAllowIdmap"},
+}
+
+func (fl InitFlags2) String() string {
+	return flagString(uint32(fl), initFlags2Names)
+}
+
 func flagString(f uint32, names []flagName) string {
 	var s string
 
@@ -336,7 +367,8 @@ func flagString(f uint32, names []flagName) string {
 type ReleaseFlags uint32
 
 const (
-	ReleaseFlush ReleaseFlags = 1 << 0
+	ReleaseFlush       ReleaseFlags = 1 << 0
+	ReleaseFlockUnlock ReleaseFlags = 1 << 1
 )
 
 func (fl ReleaseFlags) String() string {
@@ -345,50 +377,71 @@ func (fl ReleaseFlags) String() string {
 
 var releaseFlagNames = []flagName{
 	{uint32(ReleaseFlush), "ReleaseFlush"},
+	{uint32(ReleaseFlockUnlock), "ReleaseFlockUnlock"},
+}
+
+// The FsyncFlags are used in the Fsync and Fsyncdir exchanges.
+type FsyncFlags uint32
+
+const (
+	FsyncFdatasync FsyncFlags = 1 << 0
+)
+
+func (fl FsyncFlags) String() string {
+	return flagString(uint32(fl), fsyncFlagNames)
+}
+
+var fsyncFlagNames = []flagName{
+	{uint32(FsyncFdatasync), "FsyncFdatasync"},
 }
 
 // Opcodes
 const (
-	OpLookup      = 1
-	OpForget      = 2 // no reply
-	OpGetattr     = 3
-	OpSetattr     = 4
-	OpReadlink    = 5
-	OpSymlink     = 6
-	OpMknod       = 8
-	OpMkdir       = 9
-	OpUnlink      = 10
-	OpRmdir       = 11
-	OpRename      = 12
-	OpLink        = 13
-	OpOpen        = 14
-	OpRead        = 15
-	OpWrite       = 16
-	OpStatfs      = 17
-	OpRelease     = 18
-	OpFsync       = 20
-	OpSetxattr    = 21
-	OpGetxattr    = 22
-	OpListxattr   = 23
-	OpRemovexattr = 24
-	OpFlush       = 25
-	OpInit        = 26
-	OpOpendir     = 27
-	OpReaddir     = 28
-	OpReleasedir  = 29
-	OpFsyncdir    = 30
-	OpGetlk       = 31
-	OpSetlk       = 32
-	OpSetlkw      = 33
-	OpAccess      = 34
-	OpCreate      = 35
-	OpInterrupt   = 36
-	OpBmap        = 37
-	OpDestroy     = 38
-	OpIoctl       = 39 // Linux?
-	OpPoll        = 40 // Linux?
-	OpBatchForget = 42
-	OpFallocate   = 43
+	OpLookup        = 1
+	OpForget        = 2 // no reply
+	OpGetattr       = 3
+	OpSetattr       = 4
+	OpReadlink      = 5
+	OpSymlink       = 6
+	OpMknod         = 8
+	OpMkdir         = 9
+	OpUnlink        = 10
+	OpRmdir         = 11
+	OpRename        = 12
+	OpLink          = 13
+	OpOpen          = 14
+	OpRead          = 15
+	OpWrite         = 16
+	OpStatfs        = 17
+	OpRelease       = 18
+	OpFsync         = 20
+	OpSetxattr      = 21
+	OpGetxattr      = 22
+	OpListxattr     = 23
+	OpRemovexattr   = 24
+	OpFlush         = 25
+	OpInit          = 26
+	OpOpendir       = 27
+	OpReaddir       = 28
+	OpReleasedir    = 29
+	OpFsyncdir      = 30
+	OpGetlk         = 31
+	OpSetlk         = 32
+	OpSetlkw        = 33
+	OpAccess        = 34
+	OpCreate        = 35
+	OpInterrupt     = 36
+	OpBmap          = 37
+	OpDestroy       = 38
+	OpIoctl         = 39 // Linux?
+	OpPoll          = 40 // Linux?
+	OpNotifyReply   = 41 // no reply
+	OpBatchForget   = 42
+	OpFallocate     = 43
+	OpReaddirplus   = 44
+	OpRename2       = 45
+	OpLseek         = 46
+	OpCopyFileRange = 47
 
 	// OS X
 	OpSetvolname = 61
@@ -496,6 +549,13 @@ type RenameIn struct {
 	// "oldname\x00newname\x00" follows
 }
 
+type Rename2In struct {
+	Newdir  uint64
+	Flags   uint32
+	Padding uint32
+	// "oldname\x00newname\x00" follows
+}
+
 // OS X
 type ExchangeIn struct {
 	Olddir  uint64
@@ -515,10 +575,10 @@ type setattrInCommon struct {
 	LockOwner uint64 // unused on OS X?
 	Atime     uint64
 	Mtime     uint64
-	Unused2   uint64
+	Ctime     uint64 // Linux only
 	AtimeNsec uint32
 	MtimeNsec uint32
-	Unused3   uint32
+	CtimeNsec uint32 // Linux only
 	Mode      uint32
 	Unused4   uint32
 	Uid       uint32
@@ -534,7 +594,7 @@ type OpenIn struct {
 type OpenOut struct {
 	Fh        uint64
 	OpenFlags uint32
-	Padding   uint32
+	BackingID int32
 }
 
 type CreateIn struct {
@@ -557,7 +617,7 @@ type ReleaseIn struct {
 	Fh           uint64
 	Flags        uint32
 	ReleaseFlags uint32
-	LockOwner    uint32
+	LockOwner    uint64
 }
 
 type FlushIn struct {
@@ -692,6 +752,83 @@ type FallocateIn struct {
 	Padding uint32
 }
 
+type LseekIn struct {
+	Fh      uint64
+	Offset  uint64
+	Whence  uint32
+	Padding uint32
+}
+
+type LseekOut struct {
+	Offset uint64
+}
+
+type CopyFileRangeIn struct {
+	FhIn      uint64
+	OffIn     uint64
+	NodeidOut uint64
+	FhOut     uint64
+	OffOut    uint64
+	Len       uint64
+	Flags     uint64
+}
+
+type IoctlIn struct {
+	Fh      uint64
+	Flags   uint32
+	Cmd     uint32
+	Arg     uint64
+	InSize  uint32
+	OutSize uint32
+}
+
+// Flags for IoctlIn.Flags and IoctlOut.Flags.
+const (
+	IoctlCompat       = 1 << 0
+	IoctlUnrestricted = 1 << 1
+	IoctlRetry        = 1 << 2
+	Ioctl32Bit        = 1 << 3
+	IoctlDir          = 1 << 4
+)
+
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+type IoctlOut struct {
+	Result  int32
+	Flags   uint32
+	InIovs  uint32
+	OutIovs uint32
+}
+
+type PollIn struct {
+	Fh     uint64
+	Kh     uint64
+	Flags  uint32
+	Events uint32
+}
+
+func PollInSize(p Protocol) uintptr {
+	switch {
+	case p.LT(Protocol{7, 21}):
+		return unsafe.Offsetof(PollIn{}.Events)
+	default:
+		return unsafe.Sizeof(PollIn{})
+	}
+}
+
+// Flags for PollIn.Flags.
+const (
+	PollScheduleNotify = 1 << 0
+)
+
+type PollOut struct {
+	Revents uint32
+	padding uint32
+}
+
 type LkIn struct {
 	Fh      uint64
 	Owner   uint64
@@ -709,6 +846,11 @@ func LkInSize(p Protocol) uintptr {
 	}
 }
 
+// Flags for LkIn.LkFlags.
+const (
+	LkFlock = 1 << 0
+)
+
 type LkOut struct {
 	Lk fileLock
 }
@@ -727,6 +869,12 @@ type InitIn struct {
 
 const InitInSize = int(unsafe.Sizeof(InitIn{}))
 
+// The remainder of InitIn, sent by kernels speaking protocol 7.36 or later.
+type InitInExt struct {
+	Flags2 uint32
+	Unused [11]uint32
+}
+
 type InitOut struct {
 	Major               uint32
 	Minor               uint32
@@ -738,9 +886,29 @@ type InitOut struct {
 	TimeGran            uint32
 	MaxPages            uint16
 	MapAlignment        uint16
-	Unused              [8]uint32
+	Flags2              uint32
+	MaxStackDepth       uint32
+	Unused              [6]uint32
+}
+
+// Registers an open file with the kernel as the backing file for passthrough
+// opens (FUSE_DEV_IOC_BACKING_OPEN), which returns its backing ID.
+type BackingMap struct {
+	Fd      int32
+	Flags   uint32
+	Padding uint64
 }
 
+// Ioctls on the device, with the asm-generic encoding of _IOW(229, nr, size).
+const (
+	DevIocBackingOpen  = 1<<30 | 16<<16 | 229<<8 | 1
+	DevIocBackingClose = 1<<30 | 4<<16 | 229<<8 | 2
+)
+
+// Attaches a newly opened device to the connection of the device whose fd is
+// passed (FUSE_DEV_IOC_CLONE), encoded as _IOR(229, 0, uint32).
+const DevIocClone = 2<<30 | 4<<16 | 229<<8 | 0
+
 type InterruptIn struct {
 	Unique uint64
 }
@@ -788,16 +956,71 @@ const (
 	NotifyCodePoll       int32 = 1
 	NotifyCodeInvalInode int32 = 2
 	NotifyCodeInvalEntry int32 = 3
+	NotifyCodeStore      int32 = 4
+	NotifyCodeRetrieve   int32 = 5
+	NotifyCodeDelete     int32 = 6
+	NotifyCodeResend     int32 = 7
 )
 
+type NotifyPollWakeupOut struct {
+	Kh uint64
+}
+
+const NotifyPollWakeupOutSize = int(unsafe.Sizeof(NotifyPollWakeupOut{}))
+
 type NotifyInvalInodeOut struct {
 	Ino uint64
 	Off int64
 	Len int64
 }
 
+const NotifyInvalInodeOutSize = int(unsafe.Sizeof(NotifyInvalInodeOut{}))
+
 type NotifyInvalEntryOut struct {
 	Parent  uint64
 	Namelen uint32
 	padding uint32
 }
+
+const NotifyInvalEntryOutSize = int(unsafe.Sizeof(NotifyInvalEntryOut{}))
+
+type NotifyDeleteOut struct {
+	Parent  uint64
+	Child   uint64
+	Namelen uint32
+	padding uint32
+}
+
+const NotifyDeleteOutSize = int(unsafe.Sizeof(NotifyDeleteOut{}))
+
+type NotifyStoreOut struct {
+	Nodeid  uint64
+	Offset  uint64
+	Size    uint32
+	padding uint32
+	// data follows
+}
+
+const NotifyStoreOutSize = int(unsafe.Sizeof(NotifyStoreOut{}))
+
+type NotifyRetrieveOut struct {
+	NotifyUnique uint64
+	Nodeid       uint64
+	Offset       uint64
+	Size         uint32
+	padding      uint32
+}
+
+const NotifyRetrieveOutSize = int(unsafe.Sizeof(NotifyRetrieveOut{}))
+
+// Sent by the kernel as OpNotifyReply in answer to a retrieve notification,
+// whose unique ID it carries in the header. Matches the layout of WriteIn.
+type NotifyRetrieveIn struct {
+	dummy1 uint64
+	Offset uint64
+	Size   uint32
+	dummy2 uint32
+	dummy3 uint64
+	dummy4 uint64
+	// data follows
+}
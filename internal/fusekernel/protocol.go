@@ -73,3 +73,24 @@ func (a Protocol) HasUmask() bool {
 func (a Protocol) HasInvalidate() bool {
 	return a.is712()
 }
+
+func (a Protocol) is718() bool {
+	return a.GE(Protocol{7, 18})
+}
+
+// HasNotifyDelete returns whether the delete notification is supported.
+func (a Protocol) HasNotifyDelete() bool {
+	return a.is718()
+}
+
+// HasNotifyStore returns whether the store and retrieve notifications are
+// supported.
+func (a Protocol) HasNotifyStore() bool {
+	return a.GE(Protocol{7, 15})
+}
+
+// HasRename2 returns whether the kernel may send rename requests with
+// flags.
+func (a Protocol) HasRename2() bool {
+	return a.GE(Protocol{7, 23})
+}
@@ -0,0 +1,321 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package uring submits reads and writes of a single file through an io_uring
+// instance, one at a time.
+package uring
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The parts of the io_uring ABI that we use, cf. <linux/io_uring.h>.
+const (
+	opReadv  = 1
+	opWritev = 2
+
+	enterGetEvents = 1 << 0
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+)
+
+type sqRingOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Flags       uint32
+	Dropped     uint32
+	Array       uint32
+	Resv1       uint32
+	UserAddr    uint64
+}
+
+type cqRingOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Overflow    uint32
+	CQEs        uint32
+	Flags       uint32
+	Resv1       uint32
+	UserAddr    uint64
+}
+
+type params struct {
+	SQEntries    uint32
+	CQEntries    uint32
+	Flags        uint32
+	SQThreadCPU  uint32
+	SQThreadIdle uint32
+	Features     uint32
+	WQFd         uint32
+	Resv         [3]uint32
+	SQOff        sqRingOffsets
+	CQOff        cqRingOffsets
+}
+
+type sqe struct {
+	Opcode      uint8
+	Flags       uint8
+	IOPrio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	RWFlags     uint32
+	UserData    uint64
+	BufIndex    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	Pad         [2]uint64
+}
+
+type cqe struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+// Ring is an io_uring instance bound to one file. It implements io.Reader,
+// and is safe for concurrent use, though each call waits for its own
+// completion before the next is submitted.
+type Ring struct {
+	fd   int
+	file int
+
+	mu sync.Mutex
+
+	// The mapped rings and the pointers into them that we use.
+	//
+	// GUARDED_BY(mu)
+	sqRing, cqRing, sqes []byte
+	sqTail, sqMask       *uint32
+	sqArray              unsafe.Pointer
+	cqHead, cqTail       *uint32
+	cqMask               *uint32
+	cqes                 unsafe.Pointer
+
+	// The vector for the op in flight, kept here so that it lives on the heap
+	// for as long as the kernel may look at it.
+	//
+	// GUARDED_BY(mu)
+	iovecs []syscall.Iovec
+
+	// Set once io_uring_enter has failed, after which we can no longer tell
+	// what the kernel has done with the rings, so all further ops fail.
+	//
+	// GUARDED_BY(mu)
+	broken error
+}
+
+// New sets up a ring for I/O on f. It returns an error wrapping ENOSYS or
+// EPERM if io_uring is unavailable or disabled.
+func New(f *os.File) (*Ring, error) {
+	var p params
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, 4, uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, &os.SyscallError{Syscall: "io_uring_setup", Err: errno}
+	}
+
+	r := &Ring{fd: int(fd), file: int(f.Fd())}
+	if err := r.mmap(&p); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Ring) mmap(p *params) (err error) {
+	r.sqRing, err = unix.Mmap(
+		r.fd,
+		offSQRing,
+		int(p.SQOff.Array+p.SQEntries*4),
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("mmap SQ ring: %w", err)
+	}
+
+	r.cqRing, err = unix.Mmap(
+		r.fd,
+		offCQRing,
+		int(p.CQOff.CQEs+p.CQEntries*uint32(unsafe.Sizeof(cqe{}))),
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("mmap CQ ring: %w", err)
+	}
+
+	r.sqes, err = unix.Mmap(
+		r.fd,
+		offSQEs,
+		int(p.SQEntries*uint32(unsafe.Sizeof(sqe{}))),
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("mmap SQEs: %w", err)
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.SQOff.Tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[p.SQOff.RingMask]))
+	r.sqArray = unsafe.Pointer(&r.sqRing[p.SQOff.Array])
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.CQOff.Head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.CQOff.Tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqRing[p.CQOff.RingMask]))
+	r.cqes = unsafe.Pointer(&r.cqRing[p.CQOff.CQEs])
+
+	return nil
+}
+
+// Read reads from the file into p, at its current position.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *Ring) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.iovecs = r.iovecs[:0]
+	r.iovecs = append(r.iovecs, syscall.Iovec{Base: &p[0]})
+	r.iovecs[0].SetLen(len(p))
+
+	n, err := r.do(opReadv)
+	runtime.KeepAlive(p)
+	return n, err
+}
+
+// Writev writes the concatenation of the supplied buffers to the file, as
+// writev(2) does, skipping empty ones.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *Ring) Writev(bufs [][]byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.iovecs = r.iovecs[:0]
+	for _, b := range bufs {
+		if len(b) == 0 {
+			continue
+		}
+
+		v := syscall.Iovec{Base: &b[0]}
+		v.SetLen(len(b))
+		r.iovecs = append(r.iovecs, v)
+	}
+
+	if len(r.iovecs) == 0 {
+		return 0, nil
+	}
+
+	n, err := r.do(opWritev)
+	runtime.KeepAlive(bufs)
+	return n, err
+}
+
+// Submit an op on r.iovecs and wait for it to complete.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(r.mu)
+func (r *Ring) do(opcode uint8) (int, error) {
+	if r.broken != nil {
+		return 0, r.broken
+	}
+
+	// Fill in the next entry. We only ever have one op in flight, so the
+	// entry and the slot in the array are always free.
+	tail := atomic.LoadUint32(r.sqTail)
+	idx := tail & *r.sqMask
+	e := (*sqe)(unsafe.Pointer(&r.sqes[uintptr(idx)*unsafe.Sizeof(sqe{})]))
+	*e = sqe{
+		Opcode: opcode,
+		Fd:     int32(r.file),
+		Off:    ^uint64(0), // The current file position.
+		Addr:   uint64(uintptr(unsafe.Pointer(&r.iovecs[0]))),
+		Len:    uint32(len(r.iovecs)),
+	}
+
+	*(*uint32)(unsafe.Add(r.sqArray, uintptr(idx)*4)) = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+
+	// Submit it and wait for the completion, which may take several tries if
+	// we are interrupted by signals.
+	toSubmit := uintptr(1)
+	for {
+		head := atomic.LoadUint32(r.cqHead)
+		if head != atomic.LoadUint32(r.cqTail) {
+			c := (*cqe)(unsafe.Add(r.cqes, uintptr(head&*r.cqMask)*unsafe.Sizeof(cqe{})))
+			res := c.Res
+			atomic.StoreUint32(r.cqHead, head+1)
+
+			if res < 0 {
+				return 0, syscall.Errno(-res)
+			}
+
+			return int(res), nil
+		}
+
+		n, _, errno := unix.Syscall6(
+			unix.SYS_IO_URING_ENTER,
+			uintptr(r.fd),
+			toSubmit,
+			1,
+			enterGetEvents,
+			0,
+			0)
+
+		switch {
+		case errno == syscall.EINTR:
+			continue
+
+		case errno != 0:
+			r.broken = &os.SyscallError{Syscall: "io_uring_enter", Err: errno}
+			return 0, r.broken
+		}
+
+		toSubmit -= n
+	}
+}
+
+// Close releases the ring. It must not be called while a Read or Writev is
+// in progress.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *Ring) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, m := range [][]byte{r.sqRing, r.cqRing, r.sqes} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+
+	r.sqRing, r.cqRing, r.sqes = nil, nil, nil
+	return syscall.Close(r.fd)
+}
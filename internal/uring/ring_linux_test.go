@@ -0,0 +1,83 @@
+package uring
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func newRing(t *testing.T, f *os.File) *Ring {
+	r, err := New(f)
+	if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM) {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestReadWritev(t *testing.T) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+
+	reads := newRing(t, pr)
+	writes := newRing(t, pw)
+
+	n, err := writes.Writev([][]byte{[]byte("taco"), nil, []byte("burrito")})
+	if err != nil || n != 11 {
+		t.Fatalf("Writev: %d, %v", n, err)
+	}
+
+	buf := make([]byte, 64)
+	n, err = reads.Read(buf)
+	if err != nil || string(buf[:n]) != "tacoburrito" {
+		t.Fatalf("Read: %q, %v", buf[:n], err)
+	}
+
+	// Errors come back as errnos.
+	pr.Close()
+	if _, err := writes.Writev([][]byte{[]byte("x")}); !errors.Is(err, syscall.EPIPE) {
+		t.Errorf("Writev to closed pipe: %v", err)
+	}
+}
+
+func TestConcurrentOps(t *testing.T) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+
+	reads := newRing(t, pr)
+	writes := newRing(t, pw)
+
+	// A read waiting on one ring doesn't hold up a write on another.
+	done := make(chan string)
+	go func() {
+		buf := make([]byte, 64)
+		n, err := reads.Read(buf)
+		if err != nil {
+			t.Errorf("Read: %v", err)
+		}
+
+		done <- string(buf[:n])
+	}()
+
+	if _, err := writes.Writev([][]byte{[]byte("enchilada")}); err != nil {
+		t.Fatalf("Writev: %v", err)
+	}
+
+	if got := <-done; got != "enchilada" {
+		t.Errorf("Read: %q", got)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package uring
+
+import (
+	"os"
+	"syscall"
+)
+
+// Ring is Linux only; New always fails elsewhere.
+type Ring struct{}
+
+func New(f *os.File) (*Ring, error) {
+	return nil, &os.SyscallError{Syscall: "io_uring_setup", Err: syscall.ENOSYS}
+}
+
+func (r *Ring) Read(p []byte) (int, error) {
+	return 0, syscall.ENOSYS
+}
+
+func (r *Ring) Writev(bufs [][]byte) (int, error) {
+	return 0, syscall.ENOSYS
+}
+
+func (r *Ring) Close() error {
+	return nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// The severity of a log message.
+type LogLevel int32
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogError
+
+	// Not a message level: used with LevelLogger.SetLevel to disable a category
+	// entirely.
+	LogOff
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogError:
+		return "ERROR"
+	case LogOff:
+		return "OFF"
+	}
+
+	return fmt.Sprintf("LogLevel(%d)", int32(l))
+}
+
+// The part of the package a log message comes from, allowing e.g. verbose
+// per-op logging to be enabled without also getting the mount dance.
+type LogCategory int
+
+const (
+	// Mounting and unmounting.
+	LogMount LogCategory = iota
+
+	// Reading ops from and writing replies to the kernel, and failures doing
+	// so.
+	LogDispatch
+
+	// The requests and responses of individual ops, and errors returned by the
+	// file system for them.
+	LogOp
+
+	// Notifications sent to the kernel.
+	LogNotify
+
+	numLogCategories
+)
+
+func (c LogCategory) String() string {
+	switch c {
+	case LogMount:
+		return "mount"
+	case LogDispatch:
+		return "dispatch"
+	case LogOp:
+		return "op"
+	case LogNotify:
+		return "notify"
+	}
+
+	return fmt.Sprintf("LogCategory(%d)", int(c))
+}
+
+// Logger is the interface through which the package logs, set with
+// MountConfig.Logger. Implementations must be safe for concurrent use.
+//
+// Enabled is checked before formatting any message that is expensive to
+// produce, so returning false for a level and category makes logging them
+// nearly free.
+type Logger interface {
+	Enabled(level LogLevel, category LogCategory) bool
+	Debugf(category LogCategory, format string, v ...interface{})
+	Infof(category LogCategory, format string, v ...interface{})
+	Errorf(category LogCategory, format string, v ...interface{})
+}
+
+// LevelLogger is a Logger that writes to a *log.Logger, with a minimum level
+// per category that may be changed at any time, e.g. from a signal handler or
+// a debug endpoint.
+type LevelLogger struct {
+	out    *log.Logger
+	levels [numLogCategories]int32 // Atomic LogLevels
+}
+
+var _ Logger = &LevelLogger{}
+
+// NewLevelLogger creates a logger that writes messages of at least the given
+// level, in all categories, to out.
+func NewLevelLogger(out *log.Logger, level LogLevel) *LevelLogger {
+	l := &LevelLogger{out: out}
+	for c := LogCategory(0); c < numLogCategories; c++ {
+		l.SetLevel(c, level)
+	}
+
+	return l
+}
+
+// SetLevel changes the minimum level of messages logged for the given
+// category. Use LogOff to disable it.
+func (l *LevelLogger) SetLevel(category LogCategory, level LogLevel) {
+	if category >= 0 && category < numLogCategories {
+		atomic.StoreInt32(&l.levels[category], int32(level))
+	}
+}
+
+func (l *LevelLogger) Enabled(level LogLevel, category LogCategory) bool {
+	if category < 0 || category >= numLogCategories {
+		return false
+	}
+
+	min := LogLevel(atomic.LoadInt32(&l.levels[category]))
+	return min != LogOff && level >= min
+}
+
+func (l *LevelLogger) logf(
+	level LogLevel,
+	category LogCategory,
+	format string,
+	v ...interface{}) {
+	if l.Enabled(level, category) {
+		l.out.Printf("%s %s: %s", level, category, fmt.Sprintf(format, v...))
+	}
+}
+
+func (l *LevelLogger) Debugf(category LogCategory, format string, v ...interface{}) {
+	l.logf(LogDebug, category, format, v...)
+}
+
+func (l *LevelLogger) Infof(category LogCategory, format string, v ...interface{}) {
+	l.logf(LogInfo, category, format, v...)
+}
+
+func (l *LevelLogger) Errorf(category LogCategory, format string, v ...interface{}) {
+	l.logf(LogError, category, format, v...)
+}
+
+// The Logger used when MountConfig.Logger is unset, writing debug and info
+// messages to MountConfig.DebugLogger and errors to MountConfig.ErrorLogger,
+// either of which may be nil.
+type legacyLogger struct {
+	debug *log.Logger
+	error *log.Logger
+}
+
+func (l legacyLogger) Enabled(level LogLevel, category LogCategory) bool {
+	if level >= LogError {
+		return l.error != nil
+	}
+
+	return l.debug != nil
+}
+
+func (l legacyLogger) Debugf(category LogCategory, format string, v ...interface{}) {
+	if l.debug != nil {
+		l.debug.Printf(format, v...)
+	}
+}
+
+func (l legacyLogger) Infof(category LogCategory, format string, v ...interface{}) {
+	l.Debugf(category, format, v...)
+}
+
+func (l legacyLogger) Errorf(category LogCategory, format string, v ...interface{}) {
+	if l.error != nil {
+		l.error.Printf(format, v...)
+	}
+}
+
+// Return the logger to use for the config.
+func (c *MountConfig) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+
+	return legacyLogger{debug: c.DebugLogger, error: c.ErrorLogger}
+}
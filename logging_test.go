@@ -0,0 +1,70 @@
+package fuse
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestLevelLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLevelLogger(log.New(&buf, "", 0), LogError)
+
+	l.Debugf(LogOp, "hidden")
+	l.Errorf(LogOp, "shown %d", 1)
+
+	l.SetLevel(LogOp, LogDebug)
+	l.Debugf(LogOp, "shown %d", 2)
+	l.Debugf(LogMount, "hidden")
+
+	l.SetLevel(LogMount, LogOff)
+	l.Errorf(LogMount, "hidden")
+
+	want := "ERROR op: shown 1\nDEBUG op: shown 2\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Output = %q, want %q", got, want)
+	}
+
+	if l.Enabled(LogInfo, LogNotify) || !l.Enabled(LogError, LogNotify) {
+		t.Errorf("Unexpected Enabled results for notify")
+	}
+}
+
+func TestLegacyLogger(t *testing.T) {
+	var debug, errors bytes.Buffer
+	cfg := &MountConfig{ErrorLogger: log.New(&errors, "", 0)}
+
+	l := cfg.logger()
+	if l.Enabled(LogDebug, LogOp) {
+		t.Errorf("Expected debug logging to be disabled")
+	}
+
+	l.Debugf(LogOp, "hidden")
+	l.Errorf(LogOp, "shown")
+	if !strings.Contains(errors.String(), "shown") || debug.Len() != 0 {
+		t.Errorf("Unexpected output: %q, %q", errors.String(), debug.String())
+	}
+}
+
+func TestNoOpenENOSYSNotLogged(t *testing.T) {
+	c := &Connection{
+		cfg:    MountConfig{EnableNoOpenSupport: true},
+		logger: NewLevelLogger(log.New(&bytes.Buffer{}, "", 0), LogError),
+	}
+
+	if c.shouldLogError(&fuseops.OpenFileOp{}, syscall.ENOSYS) {
+		t.Errorf("Expected ENOSYS from OpenFile to be skipped")
+	}
+
+	if !c.shouldLogError(&fuseops.OpenDirOp{}, syscall.ENOSYS) {
+		t.Errorf("Expected ENOSYS from OpenDir to be logged")
+	}
+
+	if !c.shouldLogError(&fuseops.OpenFileOp{}, syscall.EIO) {
+		t.Errorf("Expected EIO from OpenFile to be logged")
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a Tracer that keeps counts of ops by type, errors, latency,
+// bytes read and written, and ops in flight. Set it as MountConfig.Tracer, or
+// call its methods from another Tracer, and read the counts with Snapshot.
+//
+// Metrics is also an http.Handler serving the counts in the Prometheus text
+// exposition format, so that it can be scraped directly:
+//
+//	m := fuse.NewMetrics()
+//	http.Handle("/metrics", m)
+//	cfg := &fuse.MountConfig{Tracer: m}
+type Metrics struct {
+	inFlight     int64  // Atomic
+	bytesRead    uint64 // Atomic
+	bytesWritten uint64 // Atomic
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	ops map[string]*OpStats
+}
+
+var _ Tracer = &Metrics{}
+var _ http.Handler = &Metrics{}
+
+// OpStats holds the counts for one type of op.
+type OpStats struct {
+	// The number of ops replied to, and how many of those were errors.
+	Count  uint64
+	Errors uint64
+
+	// The sum of the latencies of the ops counted.
+	Latency time.Duration
+}
+
+// MetricsSnapshot is a copy of the counts kept by Metrics.
+type MetricsSnapshot struct {
+	// Keyed by op name, as in OpTrace.Op.
+	Ops map[string]OpStats
+
+	// The ops returned by ReadOp but not yet replied to.
+	InFlight int64
+
+	// Bytes read and written by successful ReadFileOps and WriteFileOps.
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// NewMetrics creates a Metrics with all counts zero.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ops: make(map[string]*OpStats),
+	}
+}
+
+// StartOp implements Tracer.
+func (m *Metrics) StartOp(ctx context.Context, t *OpTrace) context.Context {
+	atomic.AddInt64(&m.inFlight, 1)
+	return ctx
+}
+
+// EndOp implements Tracer.
+func (m *Metrics) EndOp(ctx context.Context, t *OpTrace) {
+	atomic.AddInt64(&m.inFlight, -1)
+
+	switch t.Op {
+	case "ReadFile":
+		atomic.AddUint64(&m.bytesRead, uint64(t.Bytes))
+
+	case "WriteFile":
+		atomic.AddUint64(&m.bytesWritten, uint64(t.Bytes))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.ops[t.Op]
+	if s == nil {
+		s = &OpStats{}
+		m.ops[t.Op] = s
+	}
+
+	s.Count++
+	s.Latency += t.Latency
+	if t.Err != nil {
+		s.Errors++
+	}
+}
+
+// Snapshot returns a copy of the current counts.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	snap := MetricsSnapshot{
+		Ops:          make(map[string]OpStats),
+		InFlight:     atomic.LoadInt64(&m.inFlight),
+		BytesRead:    atomic.LoadUint64(&m.bytesRead),
+		BytesWritten: atomic.LoadUint64(&m.bytesWritten),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name, s := range m.ops {
+		snap.Ops[name] = *s
+	}
+
+	return snap
+}
+
+// ServeHTTP writes the current counts in the Prometheus text exposition
+// format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	snap := m.Snapshot()
+
+	var names []string
+	for name := range snap.Ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP fuse_ops_total Ops replied to, by op.")
+	fmt.Fprintln(w, "# TYPE fuse_ops_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "fuse_ops_total{op=%q} %d\n", name, snap.Ops[name].Count)
+	}
+
+	fmt.Fprintln(w, "# HELP fuse_op_errors_total Ops replied to with an error, by op.")
+	fmt.Fprintln(w, "# TYPE fuse_op_errors_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "fuse_op_errors_total{op=%q} %d\n", name, snap.Ops[name].Errors)
+	}
+
+	fmt.Fprintln(w, "# HELP fuse_op_latency_seconds Time from reading an op to replying to it, by op.")
+	fmt.Fprintln(w, "# TYPE fuse_op_latency_seconds summary")
+	for _, name := range names {
+		s := snap.Ops[name]
+		fmt.Fprintf(w, "fuse_op_latency_seconds_sum{op=%q} %g\n", name, s.Latency.Seconds())
+		fmt.Fprintf(w, "fuse_op_latency_seconds_count{op=%q} %d\n", name, s.Count)
+	}
+
+	fmt.Fprintln(w, "# HELP fuse_ops_in_flight Ops read but not yet replied to.")
+	fmt.Fprintln(w, "# TYPE fuse_ops_in_flight gauge")
+	fmt.Fprintf(w, "fuse_ops_in_flight %d\n", snap.InFlight)
+
+	fmt.Fprintln(w, "# HELP fuse_read_bytes_total Bytes returned by reads.")
+	fmt.Fprintln(w, "# TYPE fuse_read_bytes_total counter")
+	fmt.Fprintf(w, "fuse_read_bytes_total %d\n", snap.BytesRead)
+
+	fmt.Fprintln(w, "# HELP fuse_written_bytes_total Bytes accepted by writes.")
+	fmt.Fprintln(w, "# TYPE fuse_written_bytes_total counter")
+	fmt.Fprintf(w, "fuse_written_bytes_total %d\n", snap.BytesWritten)
+}
@@ -0,0 +1,60 @@
+package fuse
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	c := &Connection{cfg: MountConfig{Tracer: m}}
+
+	read := &fuseops.ReadFileOp{Size: 4096, BytesRead: 100}
+	ctx, readTrace := c.startTrace(context.Background(), fusekernel.OpRead, 1, read)
+	writeCtx, writeTrace := c.startTrace(context.Background(), fusekernel.OpWrite, 2, &fuseops.WriteFileOp{Data: make([]byte, 10)})
+
+	if got := m.Snapshot().InFlight; got != 2 {
+		t.Errorf("InFlight: got %d, want 2", got)
+	}
+
+	c.endTrace(ctx, readTrace, read, nil)
+	c.endTrace(writeCtx, writeTrace, &fuseops.WriteFileOp{}, syscall.ENOSPC)
+
+	ctx, readTrace = c.startTrace(context.Background(), fusekernel.OpRead, 3, read)
+	c.endTrace(ctx, readTrace, read, nil)
+
+	snap := m.Snapshot()
+	if snap.InFlight != 0 || snap.BytesRead != 200 || snap.BytesWritten != 0 {
+		t.Errorf("Unexpected snapshot: %+v", snap)
+	}
+
+	if s := snap.Ops["ReadFile"]; s.Count != 2 || s.Errors != 0 {
+		t.Errorf("ReadFile: %+v", s)
+	}
+
+	if s := snap.Ops["WriteFile"]; s.Count != 1 || s.Errors != 1 {
+		t.Errorf("WriteFile: %+v", s)
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		`fuse_ops_total{op="ReadFile"} 2`,
+		`fuse_op_errors_total{op="WriteFile"} 1`,
+		`fuse_op_latency_seconds_count{op="WriteFile"} 1`,
+		`fuse_ops_in_flight 0`,
+		`fuse_read_bytes_total 200`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("Missing %q in:\n%s", want, body)
+		}
+	}
+}
@@ -17,12 +17,8 @@ package fuse
 import (
 	"context"
 	"fmt"
-	"log"
-	"net"
 	"os"
-	"os/exec"
 	"strings"
-	"syscall"
 )
 
 // Server is an interface for any type that knows how to serve ops read from a
@@ -41,12 +37,30 @@ func Mount(
 	dir string,
 	server Server,
 	config *MountConfig) (*MountedFileSystem, error) {
+	if err := config.validate(); err != nil {
+		return nil, newMountError(dir, err)
+	}
+
 	// Sanity check: make sure the mount point exists and is a directory. This
 	// saves us from some confusing errors later on OS X.
-	if err := checkMountPoint(dir); err != nil {
-		return nil, err
+	if config.Device == nil {
+		if err := checkMountPoint(dir); err != nil {
+			if os.IsNotExist(err) {
+				return nil, err
+			}
+
+			return nil, newMountError(dir, err)
+		}
 	}
 
+	if config.ResumeState != nil && !premounted(dir, config) {
+		return nil, newMountError(
+			dir,
+			fmt.Errorf("%w: resuming requires a /dev/fd/N mount point or a Device", ErrInvalidMountOption))
+	}
+
+	logger := config.logger()
+
 	// Initialize the struct.
 	mfs := &MountedFileSystem{
 		dir:                 dir,
@@ -54,17 +68,18 @@ func Mount(
 	}
 
 	// Begin the mounting process, which will continue in the background.
-	if config.DebugLogger != nil {
-		config.DebugLogger.Println("Beginning the mounting kickoff process")
-	}
+	logger.Debugf(LogMount, "Beginning the mounting kickoff process")
 	ready := make(chan error, 1)
-	dev, err := mount(dir, config, ready)
-	if err != nil {
-		return nil, fmt.Errorf("mount: %v", err)
-	}
-	if config.DebugLogger != nil {
-		config.DebugLogger.Println("Completed the mounting kickoff process")
+	dev := config.Device
+	if dev != nil {
+		ready <- nil
+	} else {
+		var err error
+		if dev, err = mount(dir, config, ready); err != nil {
+			return nil, newMountError(dir, fmt.Errorf("mount: %w", err))
+		}
 	}
+	logger.Debugf(LogMount, "Completed the mounting kickoff process")
 
 	// Choose a parent context for ops.
 	cfgCopy := *config
@@ -72,161 +87,105 @@ func Mount(
 		cfgCopy.OpContext = context.Background()
 	}
 
-	if config.DebugLogger != nil {
-		config.DebugLogger.Println("Creating a connection object")
-	}
+	logger.Debugf(LogMount, "Creating a connection object")
 	// Create a Connection object wrapping the device.
 	connection, err := newConnection(
 		cfgCopy,
-		config.DebugLogger,
-		config.ErrorLogger,
+		logger,
 		dev)
 	if err != nil {
-		return nil, fmt.Errorf("newConnection: %v", err)
-	}
-	if config.DebugLogger != nil {
-		config.DebugLogger.Println("Successfully created the connection")
+		return nil, newMountError(dir, fmt.Errorf("newConnection: %w", err))
 	}
+	mfs.conn = connection
+	logger.Debugf(LogMount, "Successfully created the connection")
 
 	// Serve the connection in the background. When done, set the join status.
 	go func() {
+		defer connection.abortOnPanic()
 		server.ServeOps(connection)
 		mfs.joinStatus = connection.close()
 		close(mfs.joinStatusAvailable)
 	}()
 
-	if config.DebugLogger != nil {
-		config.DebugLogger.Println("Waiting for mounting process to complete")
-	}
+	logger.Debugf(LogMount, "Waiting for mounting process to complete")
 
 	// Wait for the mount process to complete.
 	if err := <-ready; err != nil {
-		return nil, fmt.Errorf("mount (background): %v", err)
+		return nil, newMountError(dir, fmt.Errorf("mount (background): %w", err))
 	}
 
-	return mfs, nil
-}
-
-func checkMountPoint(dir string) error {
-	if strings.HasPrefix(dir, "/dev/fd") {
-		return nil
+	// Now that the kernel has agreed to it, swap in an ID-mapped mount if
+	// asked to.
+	if config.IDMapUserNamespace != nil {
+		if err := setUpIDMap(dir, connection); err != nil {
+			unmount(dir)
+			return nil, newMountError(dir, fmt.Errorf("ID mapping: %w", err))
+		}
 	}
 
-	fi, err := os.Stat(dir)
-	switch {
-	case os.IsNotExist(err):
-		return err
+	connection.setMountPoint(dir)
 
-	case err != nil:
-		return fmt.Errorf("Statting mount point: %v", err)
-
-	case !fi.IsDir():
-		return fmt.Errorf("Mount point %s is not a directory", dir)
+	// Take commands for the mount, if asked to.
+	if config.ControlSocket != "" {
+		if err := connection.serveControl(mfs.joinStatusAvailable); err != nil {
+			unmount(dir)
+			return nil, newMountError(dir, fmt.Errorf("control socket: %w", err))
+		}
 	}
 
-	return nil
+	return mfs, nil
 }
 
-func fusermount(binary string, argv []string, additionalEnv []string, wait bool, debugLogger *log.Logger) (*os.File, error) {
-	if debugLogger != nil {
-		debugLogger.Println("Creating a socket pair")
-	}
-	// Create a socket pair.
-	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
-	if err != nil {
-		return nil, fmt.Errorf("Socketpair: %v", err)
-	}
-
-	if debugLogger != nil {
-		debugLogger.Println("Creating files to wrap the sockets")
-	}
-	// Wrap the sockets into os.File objects that we will pass off to fusermount.
-	writeFile := os.NewFile(uintptr(fds[0]), "fusermount-child-writes")
-	defer writeFile.Close()
-
-	readFile := os.NewFile(uintptr(fds[1]), "fusermount-parent-reads")
-	defer readFile.Close()
-
-	if debugLogger != nil {
-		debugLogger.Println("Starting fusermount/os mount")
-	}
-	// Start fusermount/mount_macfuse/mount_osxfuse.
-	cmd := exec.Command(binary, argv...)
-	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
-	cmd.Env = append(cmd.Env, additionalEnv...)
-	cmd.ExtraFiles = []*os.File{writeFile}
-	cmd.Stderr = os.Stderr
-
-	// Run the command.
-	if wait {
-		err = cmd.Run()
-	} else {
-		err = cmd.Start()
-	}
-	if err != nil {
-		return nil, fmt.Errorf("running %v: %v", binary, err)
-	}
-
-	if debugLogger != nil {
-		debugLogger.Println("Wrapping socket pair in a connection")
-	}
-	// Wrap the socket file in a connection.
-	c, err := net.FileConn(readFile)
-	if err != nil {
-		return nil, fmt.Errorf("FileConn: %v", err)
-	}
-	defer c.Close()
-
-	if debugLogger != nil {
-		debugLogger.Println("Checking that we have a unix domain socket")
-	}
-	// We expect to have a Unix domain socket.
-	uc, ok := c.(*net.UnixConn)
-	if !ok {
-		return nil, fmt.Errorf("Expected UnixConn, got %T", c)
-	}
-
-	if debugLogger != nil {
-		debugLogger.Println("Read a message from socket")
-	}
-	// Read a message.
-	buf := make([]byte, 32) // expect 1 byte
-	oob := make([]byte, 32) // expect 24 bytes
-	_, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
-	if err != nil {
-		return nil, fmt.Errorf("ReadMsgUnix: %v", err)
-	}
-
-	// Parse the message.
-	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
+// MountAndServe mounts a file system on the given directory like Mount, then
+// blocks until it is unmounted and all ops have been responded to, as with
+// MountedFileSystem.Join. This suits daemons whose main function owns the
+// file system's resources for exactly as long as it is mounted.
+//
+// If ctx is cancelled first, the file system is unmounted, and MountAndServe
+// waits for serving to finish as usual. If unmounting fails, e.g. with EBUSY
+// because the file system is still in use, the error is returned right away
+// and the file system remains mounted and served until it is unmounted by
+// other means.
+//
+// The result is nil if mounting succeeded and everything went as expected
+// while serving, whether or not ctx was cancelled.
+func MountAndServe(
+	ctx context.Context,
+	dir string,
+	server Server,
+	config *MountConfig) error {
+	mfs, err := Mount(dir, server, config)
 	if err != nil {
-		return nil, fmt.Errorf("ParseSocketControlMessage: %v", err)
+		return err
 	}
 
-	// We expect one message.
-	if len(scms) != 1 {
-		return nil, fmt.Errorf("expected 1 SocketControlMessage; got scms = %#v", scms)
+	select {
+	case <-mfs.joinStatusAvailable:
+	case <-ctx.Done():
+		if err := Unmount(dir); err != nil {
+			return fmt.Errorf("Unmount: %v", err)
+		}
 	}
 
-	scm := scms[0]
+	return mfs.Join(context.Background())
+}
 
-	if debugLogger != nil {
-		debugLogger.Println("Successfully read the socket message.")
-	}
+// Replace the new mount at dir with one applying the ID mapping asked for by
+// MountConfig.IDMapUserNamespace.
+func setUpIDMap(dir string, c *Connection) error {
+	switch {
+	case premounted(dir, &c.cfg):
+		return fmt.Errorf("%w: can't ID-map a mount made by the caller", ErrInvalidMountOption)
 
-	// Pull out the FD returned by fusermount
-	gotFds, err := syscall.ParseUnixRights(&scm)
-	if err != nil {
-		return nil, fmt.Errorf("syscall.ParseUnixRights: %v", err)
+	case !c.Features().IDMap:
+		return fmt.Errorf("%w: the kernel doesn't support ID-mapped fuse mounts", ErrInvalidMountOption)
 	}
 
-	if len(gotFds) != 1 {
-		return nil, fmt.Errorf("wanted 1 fd; got %#v", gotFds)
-	}
+	return idmapMount(dir, c.cfg.IDMapUserNamespace)
+}
 
-	if debugLogger != nil {
-		debugLogger.Println("Converting FD into os.File")
-	}
-	// Turn the FD into an os.File.
-	return os.NewFile(uintptr(gotFds[0]), "/dev/fuse"), nil
+// Whether the mount was made by someone else, who handed us the device (see
+// MountConfig.Device).
+func premounted(dir string, cfg *MountConfig) bool {
+	return cfg.Device != nil || strings.HasPrefix(dir, "/dev/fd/")
 }
@@ -17,9 +17,16 @@ package fuse
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
 )
 
 // Optional configuration accepted by Mount.
@@ -38,6 +45,13 @@ type MountConfig struct {
 	// chtimes, etc. will fail.
 	ReadOnly bool
 
+	// Let users other than the one mounting the file system access it, or just
+	// root as well (the allow_other and allow_root options). At most one may be
+	// set. Unless mounting as root, these require user_allow_other in
+	// /etc/fuse.conf on Linux.
+	AllowOther bool
+	AllowRoot  bool
+
 	// A logger to use for logging errors. All errors are logged, with the
 	// exception of a few blacklisted errors that are expected. If nil, no error
 	// logging is performed.
@@ -47,6 +61,16 @@ type MountConfig struct {
 	// performed.
 	DebugLogger *log.Logger
 
+	// A leveled logger to use instead of ErrorLogger and DebugLogger, which are
+	// ignored if this is set. This allows categories of messages to be enabled
+	// selectively, e.g. per-op tracing without the details of mounting; see
+	// LevelLogger.
+	Logger Logger
+
+	// Optional. Told about the start and end of every op, with its latency
+	// and result; see Tracer.
+	Tracer Tracer
+
 	// Linux only. OS X always behaves as if writeback caching is disabled.
 	//
 	// By default on Linux we allow the kernel to perform writeback caching
@@ -111,6 +135,9 @@ type MountConfig struct {
 	// Setting DisableWritebackCaching disables this behavior. Instead the file
 	// system is called one or more times for each write(2), and the user's
 	// syscall doesn't return until the file system returns.
+	//
+	// Whether writeback caching is in effect for a mount, which also depends on
+	// the kernel, is reported by Features.WritebackCache.
 	DisableWritebackCaching bool
 
 	// OS X only.
@@ -143,17 +170,138 @@ type MountConfig struct {
 	//
 	// Tell the kernel to treat returning -ENOSYS on OpenFile as not needing
 	// OpenFile calls at all (Linux >= 3.16):
+	//
+	// After the first such ENOSYS the kernel sends no further OpenFile or
+	// ReleaseFileHandle ops, and ops on open files carry a zero handle. This
+	// saves two round trips per open for stateless file systems, e.g. ones
+	// serving read-only metadata. Those ENOSYS replies are not logged as
+	// errors. It is ignored by kernels that don't support it, which keep
+	// sending opens and take ENOSYS as a failure.
 	EnableNoOpenSupport bool
 
 	// Linux only.
 	//
 	// Tell the kernel to treat returning -ENOSYS on OpenDir as not needing
 	// OpenDir calls at all (Linux >= 5.1):
+	//
+	// As for EnableNoOpenSupport, but for OpenDir and ReleaseDirHandle.
 	EnableNoOpendirSupport bool
 
+	// Optional. Consulted whenever reading a request from or writing a reply
+	// to the fuse device fails, to decide whether to retry, to treat the
+	// kernel as having hung up, or to report the error to the caller of ReadOp
+	// or Reply. The function is called from whichever goroutine is reading or
+	// replying, and must be safe for concurrent use.
+	//
+	// Returning DeviceErrorDefault, or leaving this nil, gets the default
+	// behavior: reads are retried after EINTR and end with io.EOF after ENODEV
+	// (the file system has been unmounted), and all other errors are
+	// reported. The errors reported are of type *DeviceError, so embedders can
+	// tell a genuine transport failure from an unmount, which is always io.EOF.
+	DeviceErrorPolicy func(*DeviceError) DeviceErrorAction
+
+	// Optional. Consulted for each error returned by the file system that
+	// doesn't carry an errno of its own (a *Error, or a syscall.Errno anywhere
+	// in its chain), so that errors from libraries and backend SDKs are mapped
+	// to the same errnos whichever op returns them. Errors it doesn't map are
+	// replied to as usual: EINTR for cancellation and EIO otherwise, the latter
+	// logged as having no errno so that they can be given one. A zero errno
+	// counts as not mapping the error.
+	// TranslateStandardErrors handles the standard library's errors, and may
+	// be called from a custom translator. Must be safe for concurrent use.
+	ErrorTranslator ErrorTranslator
+
+	// Linux only.
+	//
+	// By default the kernel drops an inode's cached pages only when a new file
+	// handle is opened for it (cf. OpenFileOp.KeepPageCache) or when asked to
+	// by an invalidation notification (cf. Connection.NotifyInvalInode).
+	//
+	// Setting EnableAutoInvalData additionally has the kernel drop them
+	// whenever it sees the inode's mtime or size change in attributes returned
+	// by the file system. This suits simple file systems whose contents may
+	// change behind the kernel's back and which don't send notifications.
+	//
+	// Setting EnableExplicitInvalData instead tells the kernel to drop cached
+	// pages only on an explicit invalidation notification, not even
+	// when the file size shrinks (Linux >= 5.2). This suits file systems that
+	// track changes precisely and notify about every one of them.
+	//
+	// If both are set, EnableAutoInvalData wins. Each is ignored by kernels
+	// that don't support it.
+	EnableAutoInvalData     bool
+	EnableExplicitInvalData bool
+
+	// Linux only.
+	//
+	// Setting EnableReaddirplus has the kernel read directories with
+	// fuseops.ReadDirPlusOp rather than ReadDirOp, so that the attributes of
+	// every entry arrive with the listing instead of in a LookUpInodeOp each.
+	// This helps workloads like `ls -l` and find(1), but is wasted effort for
+	// those that only want names, and the file system must implement
+	// ReadDirPlusOp; ReadDirOp is then never sent.
+	//
+	// Setting EnableReaddirplusAuto instead lets the kernel choose per read:
+	// ReadDirPlusOp for the first read of a directory and after the entries
+	// have been looked up, and ReadDirOp otherwise. The file system must then
+	// implement both, returning the same entries at the same offsets.
+	//
+	// Both are ignored by kernels that don't support READDIRPLUS.
+	EnableReaddirplus     bool
+	EnableReaddirplusAuto bool
+
+	// Linux only.
+	//
+	// Ask the kernel to pass O_TRUNC through to OpenFile (in
+	// OpenFileOp.OpenFlags) rather than truncating with a separate
+	// SetInodeAttributes call after the open. The file system is then
+	// responsible for truncating the file as part of the OpenFile op, which
+	// lets it do so atomically with respect to concurrent writers. Ignored by
+	// kernels that don't support it.
+	EnableAtomicTrunc bool
+
+	// Linux only.
+	//
+	// By default the kernel keeps track of advisory locks itself, so that they
+	// exclude only processes on the same machine. Setting EnablePosixLocks has
+	// it send fcntl(2) locks to the file system instead, as GetLkOp, SetLkOp
+	// and SetLkWOp, and EnableFlockLocks does the same for flock(2) locks, so
+	// that a file system served to several machines can implement locks that
+	// hold across all of them, e.g. with a distributed lock service. Ignored by
+	// kernels that don't support it.
+	EnablePosixLocks bool
+	EnableFlockLocks bool
+
+	// Linux only.
+	//
+	// Pass the flags to renameat2(2), such as RENAME_NOREPLACE and
+	// RENAME_EXCHANGE, through to the file system in RenameOp.Flags. By default
+	// the kernel is told such renames are unsupported, and fails them with
+	// EINVAL without asking the file system. Whether this is in effect is
+	// reported by Features.RenameFlags.
+	EnableRenameFlags bool
+
+	// Linux only.
+	//
+	// Allow the file system to hand the kernel a file on another file system
+	// to serve an open file's reads and writes from directly, without calling
+	// the file system (see fuseops.OpenFileOp.BackingID). This requires Linux
+	// 6.9 or later built with CONFIG_FUSE_PASSTHROUGH, and CAP_SYS_ADMIN to
+	// register backing files.
+	//
+	// The kernel doesn't support passthrough together with writeback caching,
+	// so setting this disables writeback caching when the kernel does support
+	// passthrough. Whether it is in effect is reported by Features.Passthrough.
+	EnablePassthrough bool
+
 	// Disable FUSE default permissions.
 	// This is useful for situations where the backing data store (e.g., S3) doesn't
 	// actually utilise any form of qualifiable UNIX permissions.
+	//
+	// The kernel then no longer checks inode mode bits against the caller, and
+	// instead sends fuseops.AccessOp for access(2) and chdir(2), leaving it to
+	// the file system to enforce its own permission model in that op and the
+	// others.
 	DisableDefaultPermissions bool
 
 	// Use vectored reads.
@@ -163,18 +311,37 @@ type MountConfig struct {
 	// being read from the file as a list of slices in ReadFileOp.Data.
 	UseVectoredRead bool
 
-	// OS X only.
+	// OS X and Windows only.
 	//
-	// The name of the mounted volume, as displayed in the Finder. If empty, a
-	// default name involving the string 'osxfuse' is used.
+	// The name of the mounted volume, as displayed in the Finder or Explorer.
+	// If empty, a default name involving the string 'osxfuse' is used on OS X.
 	VolumeName string
 
+	// OS X only.
+	//
+	// If non-zero, a stable identifier for the file system, reported as the
+	// second word of statfs::f_fsid so that tools can recognize the same file
+	// system across mounts. Must be at most 0xffffff. The Linux kernel always
+	// reports a zero f_fsid for fuse mounts, so there this has no effect.
+	FSID uint32
+
+	// OS X only.
+	//
+	// The FUSE implementation to mount with. The zero value uses FUSE-T if it
+	// is installed and macFUSE otherwise; see DarwinBackend for the others.
+	DarwinBackend DarwinBackend
+
 	// Additional key=value options to pass unadulterated to the underlying mount
 	// command. See `man 8 mount`, the fuse documentation, etc. for
-	// system-specific information.
+	// system-specific information. On Windows they go to WinFsp's FUSE layer.
 	//
 	// For expert use only! May invalidate other guarantees made in the
 	// documentation for this package.
+	//
+	// Options that this package sets itself from the mount's device and the
+	// calling process (fd, rootmode, user_id, group_id) can't be given, and
+	// values can't contain commas; Mount fails with ErrInvalidMountOption
+	// otherwise.
 	Options map[string]string
 
 	// Sets the filesystem type (third field in /etc/mtab). /etc/mtab and
@@ -190,6 +357,224 @@ type MountConfig struct {
 	// kernel
 	// Ref: https://github.com/torvalds/linux/commit/5c672ab3f0ee0f78f7acad183f34db0f8781a200
 	EnableParallelDirOps bool
+
+	// Allow mounting over a directory that isn't empty, hiding its contents for
+	// as long as the file system is mounted. This is commonly used to replace
+	// a populated directory with a fuse view of it.
+	//
+	// Only fuse 2's fusermount refuses to do this by default; on Linux this
+	// passes it the nonempty option, and has no effect when mounting directly
+	// or using fusermount3, both of which always allow it. On OS X non-empty
+	// mount points are always allowed.
+	AllowNonEmptyMountPoint bool
+
+	// Default lengths of time for which the kernel may cache directory entries
+	// and inode attributes, applied to ops that return them
+	// (fuseops.ChildInodeEntry and the AttributesExpiration fields of
+	// GetInodeAttributesOp and SetInodeAttributesOp) when the file system
+	// leaves the expiration time unset. Sub-second durations are honored, and
+	// InfiniteTimeout caches until told otherwise.
+	//
+	// The zero value keeps the historical behavior of not caching at all. With
+	// a default in effect, a file system can still choose a different lifetime
+	// for a particular op, including disabling caching, with
+	// fuseops.ExpireAfter. Entries returned by ReadDirPlusOp are covered too.
+	DefaultEntryTimeout     time.Duration
+	DefaultAttributeTimeout time.Duration
+
+	// If set, called for every op read from the connection before it is handed
+	// to the Server, with the identity of the calling process. If it returns a
+	// non-nil error, the op is replied to with that error (typically a
+	// syscall.Errno such as EACCES or EPERM) and never reaches the Server.
+	//
+	// This provides a cheap enforcement point for per-caller access control
+	// that doesn't require wrapping every FileSystem method. The op must not be
+	// modified. Forget ops are never passed to the policy, since the kernel
+	// expects no reply to them.
+	//
+	// Beware that some ops are sent by the kernel on its own behalf (e.g.
+	// write-back of dirty pages) and carry a zero UID, GID and PID.
+	//
+	// The function is called synchronously from Connection.ReadOp and so
+	// should be fast.
+	CallerPolicy func(op interface{}, caller fuseops.OpContext) error
+
+	// If set, ops sent on behalf of the file system's own process (e.g. because
+	// a FileSystem method called os.Stat on a path within the mount point) fail
+	// immediately with EDEADLK, and are logged as errors (cf. Logger), instead
+	// of reaching the Server.
+	//
+	// Such calls are a common source of hangs: if the op that made the call is
+	// holding a lock that the new op needs, or the kernel is holding an inode
+	// lock on its behalf, the mount deadlocks. Leave this unset if the process
+	// legitimately uses its own mount, as in-process tests do.
+	//
+	// On Linux ops are matched against all threads of the process; elsewhere
+	// only the process ID is compared.
+	DetectSelfDeadlock bool
+
+	// If non-zero, the inode of the file system to expose as the root of the
+	// mount. The kernel always refers to the root as fuseops.RootInodeID; ops
+	// are translated so that the file system sees this ID instead, and vice
+	// versa, which allows one file system to be mounted several times exposing
+	// different subtrees.
+	//
+	// The two IDs are swapped rather than aliased, so if the file system also
+	// has an inode with ID fuseops.RootInodeID, the kernel sees that inode
+	// under this ID. The implicit lookup count described on ForgetInodeOp
+	// applies to this inode rather than to fuseops.RootInodeID.
+	RootInode fuseops.InodeID
+
+	// If non-zero, permission bits to clear from the mode of every file,
+	// directory, and device node created through the file system (i.e. the Mode
+	// field of MkDirOp, MkNodeOp, and CreateFileOp) before the op is delivered,
+	// in addition to the creating process's umask applied by the kernel. Useful
+	// for exporting data with a fixed policy, e.g. 0027 to keep new files
+	// private to their owner and group. Only the permission, setuid, setgid, and
+	// sticky bits are affected.
+	Umask os.FileMode
+
+	// The largest write, in bytes, that the kernel should send in a single
+	// WriteFileOp, which also bounds the size of ReadFileOp. Zero means 1 MiB.
+	//
+	// Each message buffer the connection keeps is this large, plus a page, so
+	// file systems that only ever see small writes can save memory by setting
+	// it lower. On Linux larger values take effect only if the kernel's
+	// per-request page limit allows (/proc/sys/fs/fuse/max_pages_limit, 256
+	// pages unless raised, on Linux >= 6.13); check MountedFileSystem.MaxWrite
+	// for the value in effect.
+	MaxWrite uint32
+
+	// Linux only.
+	//
+	// If set, the user namespace (e.g. an open /proc/PID/ns/user) whose ID
+	// mapping the mount should apply, as for rootless containers: callers'
+	// IDs are mapped through it before reaching the file system, and the IDs
+	// the file system reports are mapped back. Mount replaces its mount with
+	// an ID-mapped one once the connection is initialized, which requires
+	// Linux 6.12 or later (Features.IDMap), CAP_SYS_ADMIN in the mount point's
+	// mount namespace, and default permissions checking (so it can't be
+	// combined with DisableDefaultPermissions). Mounting fails otherwise.
+	IDMapUserNamespace *os.File
+
+	// Linux only.
+	//
+	// If set, the mount point must be /dev/fd/N for a device connected to an
+	// existing mount (or Device must be set), and the connection takes over from the daemon that was
+	// serving it rather than initializing it afresh, as for an upgrade in
+	// place or a restart after a crash. The state is what Connection.State
+	// returned in that daemon; the device must be kept open in between (e.g.
+	// by passing it to the new daemon, or in systemd's file descriptor store)
+	// or the kernel tears down the mount.
+	//
+	// The file system must restore the inode IDs, lookup counts and handles
+	// that it had issued (cf. fuseutil.InodeTable's Snapshot), and the config
+	// must otherwise match the previous one. Requests that the previous daemon
+	// read but didn't answer are sent again on Linux 6.9 and later; before
+	// that, the processes waiting for them stay blocked until interrupted.
+	ResumeState *ConnectionState
+
+	// If set, every message read from the kernel is written to it as is, for
+	// feeding to a file system again later with Replay. Messages carry their
+	// own length, so the recording is simply their concatenation. It includes
+	// file contents and names, so treat it with care. If a write fails,
+	// recording stops and the error is logged; serving carries on.
+	RecordOps io.Writer
+
+	// Linux only.
+	//
+	// If set, the file system is served on this already-open fuse device and
+	// Mount doesn't mount anything, as when a privileged helper does the
+	// mounting for a rootless or sandboxed daemon and passes it the device
+	// (over a unix socket, or as a file descriptor from systemd). The directory
+	// given to Mount is then the mount point the helper used, for reporting and
+	// unmounting; it isn't inspected, since doing so would wait on this very
+	// file system. The connection takes ownership of the file.
+	//
+	// A mount point of the form /dev/fd/N has the same effect for file
+	// descriptor N, for callers that have nothing more meaningful to give.
+	Device *os.File
+
+	// Linux only.
+	//
+	// The number of goroutines reading requests from the kernel. Values above
+	// one clone the device (FUSE_DEV_IOC_CLONE) so that each goroutine reads
+	// from its own queue, which keeps reading requests from becoming the
+	// bottleneck on machines with many cores. Zero means one.
+	//
+	// With more than one reader, ReadOp no longer returns ops in exactly the
+	// order the kernel sent them. If the kernel can't clone the device, as
+	// before Linux 4.2, the connection uses the readers it managed to set up.
+	DeviceReaders int
+
+	// Linux only, and experimental.
+	//
+	// Read requests from the device and write replies to it through io_uring
+	// rather than read(2) and writev(2), falling back to those if io_uring is
+	// unavailable (before Linux 5.1) or disabled. Each read and write is still
+	// submitted on its own, so this is the groundwork for batching submissions
+	// rather than a speedup by itself. Spliced replies and notifications don't
+	// go through the rings. This is unrelated to FUSE-over-io_uring (Linux
+	// 6.14), which replaces reading the device altogether and isn't supported.
+	UseIOURing bool
+
+	// If set, the path of a unix domain socket on which to accept commands
+	// for the mount while it is being served, so that a long-lived mount can
+	// be inspected and adjusted without restarting the daemon. It is created
+	// once mounting completes, accessible to its owner only, and removed when
+	// serving ends. A stale socket left at the path by a daemon that died is
+	// replaced. See SendControlCommand for the protocol and the commands that
+	// are always available.
+	ControlSocket string
+
+	// Further commands for ControlSocket, by name, e.g. a "flush" command that
+	// drops the file system's caches (cf. fuseutil.CachingFileSystem's
+	// InvalidateAll). They can't replace the built-in commands.
+	ControlCommands map[string]ControlCommand
+}
+
+// DarwinBackend selects the FUSE implementation used to mount on OS X. See
+// MountConfig.DarwinBackend.
+type DarwinBackend int
+
+const (
+	// Use FUSE-T if it is installed, and macFUSE otherwise.
+	DarwinBackendAuto DarwinBackend = iota
+
+	// Use the macFUSE kernel extension. Version 4.x is preferred, falling back
+	// to the 3.x and 2.x releases, which were named OSXFUSE. The kernel
+	// extension is loaded if need be; on recent versions of OS X the user must
+	// first have allowed it in the system settings.
+	DarwinBackendMacFUSE
+
+	// Use FUSE-T, which needs no kernel extension: it serves the file system
+	// to the kernel's NFS client from a helper process. The helper is found
+	// at the path in the FUSE_NFSSRV_PATH environment variable, or at
+	// /usr/local/bin/go-nfsv4 if that is unset. Of the OS X options only
+	// VolumeName and ReadOnly are passed on to it.
+	DarwinBackendFuseT
+)
+
+func (b DarwinBackend) String() string {
+	switch b {
+	case DarwinBackendAuto:
+		return "auto"
+	case DarwinBackendMacFUSE:
+		return "macFUSE"
+	case DarwinBackendFuseT:
+		return "FUSE-T"
+	}
+
+	return fmt.Sprintf("DarwinBackend(%d)", int(b))
+}
+
+// The value of MaxWrite in effect, with the default applied.
+func (c *MountConfig) maxWrite() int {
+	if c.MaxWrite == 0 {
+		return buffer.MaxWriteSize
+	}
+
+	return int(c.MaxWrite)
 }
 
 // Create a map containing all of the key=value mount options to be given to
@@ -233,6 +618,15 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 		opts["ro"] = ""
 	}
 
+	// Who else may access the file system?
+	switch {
+	case c.AllowOther:
+		opts["allow_other"] = ""
+
+	case c.AllowRoot:
+		opts["allow_root"] = ""
+	}
+
 	// Handle OS X options.
 	if isDarwin {
 		if !c.EnableVnodeCaching {
@@ -243,6 +637,10 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 			// Cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options#volname
 			opts["volname"] = c.VolumeName
 		}
+
+		if c.FSID != 0 {
+			opts["fsid"] = strconv.FormatUint(uint64(c.FSID), 10)
+		}
 	}
 
 	// OS X: disable the use of "Apple Double" (._foo and .DS_Store) files, which
@@ -262,6 +660,68 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 	return opts
 }
 
+// Options that are computed by mount itself, and can't be overridden.
+var reservedMountOptions = map[string]bool{
+	"fd":       true,
+	"rootmode": true,
+	"user_id":  true,
+	"group_id": true,
+}
+
+// Check the config for options that can't be honored, before trying to
+// mount. The returned error wraps ErrInvalidMountOption.
+func (c *MountConfig) validate() error {
+	if c.AllowOther && c.AllowRoot {
+		return fmt.Errorf("%w: AllowOther and AllowRoot are mutually exclusive", ErrInvalidMountOption)
+	}
+
+	for k, v := range c.Options {
+		switch {
+		case k == "":
+			return fmt.Errorf("%w: empty option name", ErrInvalidMountOption)
+
+		case strings.Contains(k, "="):
+			return fmt.Errorf("%w: option name %q contains '='", ErrInvalidMountOption, k)
+
+		case reservedMountOptions[k]:
+			return fmt.Errorf("%w: option %q is set by the package", ErrInvalidMountOption, k)
+
+		case strings.Contains(v, ","):
+			return fmt.Errorf("%w: value of option %q contains ','", ErrInvalidMountOption, k)
+		}
+	}
+
+	if c.IDMapUserNamespace != nil {
+		switch {
+		case runtime.GOOS != "linux":
+			return fmt.Errorf("%w: ID-mapped mounts are Linux only", ErrInvalidMountOption)
+
+		case c.DisableDefaultPermissions:
+			return fmt.Errorf("%w: ID-mapped mounts require default permissions", ErrInvalidMountOption)
+		}
+	}
+
+	if c.Device != nil && runtime.GOOS != "linux" {
+		return fmt.Errorf("%w: serving an open device is Linux only", ErrInvalidMountOption)
+	}
+
+	if len(c.ControlCommands) > 0 && c.ControlSocket == "" {
+		return fmt.Errorf("%w: ControlCommands without a ControlSocket", ErrInvalidMountOption)
+	}
+
+	for name := range c.ControlCommands {
+		switch {
+		case name == "" || strings.ContainsAny(name, " \t\n"):
+			return fmt.Errorf("%w: malformed control command name %q", ErrInvalidMountOption, name)
+
+		case isBuiltinControlCommand(name):
+			return fmt.Errorf("%w: control command %q is built in", ErrInvalidMountOption, name)
+		}
+	}
+
+	return nil
+}
+
 func escapeOptionsKey(s string) (res string) {
 	res = s
 	res = strings.Replace(res, `\`, `\\`, -1)
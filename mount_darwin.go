@@ -4,84 +4,18 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"syscall"
 
-	"github.com/jacobsa/fuse/internal/buffer"
 	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
 var errNoAvail = errors.New("no available fuse devices")
 var errNotLoaded = errors.New("osxfuse is not loaded")
 
-// errOSXFUSENotFound is returned from Mount when the OSXFUSE installation is
-// not detected. Make sure OSXFUSE is installed.
-var errOSXFUSENotFound = errors.New("cannot locate OSXFUSE")
-
-// osxfuseInstallation describes the paths used by an installed OSXFUSE
-// version.
-type osxfuseInstallation struct {
-	// Prefix for the device file. At mount time, an incrementing number is
-	// suffixed until a free FUSE device is found.
-	DevicePrefix string
-
-	// Path of the load helper, used to load the kernel extension if no device
-	// files are found.
-	Load string
-
-	// Path of the mount helper, used for the actual mount operation.
-	Mount string
-
-	// Environment variable used to pass the path to the executable calling the
-	// mount helper.
-	DaemonVar string
-
-	// Environment variable used to pass the "called by library" flag.
-	LibVar string
-
-	// Open device manually (false) or receive the FD through a UNIX socket,
-	// like with fusermount (true)
-	UseCommFD bool
-}
-
-var (
-	osxfuseInstallations = []osxfuseInstallation{
-		// v4
-		{
-			DevicePrefix: "/dev/macfuse",
-			Load:         "/Library/Filesystems/macfuse.fs/Contents/Resources/load_macfuse",
-			Mount:        "/Library/Filesystems/macfuse.fs/Contents/Resources/mount_macfuse",
-			DaemonVar:    "_FUSE_DAEMON_PATH",
-			LibVar:       "_FUSE_CALL_BY_LIB",
-			UseCommFD:    true,
-		},
-
-		// v3
-		{
-			DevicePrefix: "/dev/osxfuse",
-			Load:         "/Library/Filesystems/osxfuse.fs/Contents/Resources/load_osxfuse",
-			Mount:        "/Library/Filesystems/osxfuse.fs/Contents/Resources/mount_osxfuse",
-			DaemonVar:    "MOUNT_OSXFUSE_DAEMON_PATH",
-			LibVar:       "MOUNT_OSXFUSE_CALL_BY_LIB",
-		},
-
-		// v2
-		{
-			DevicePrefix: "/dev/osxfuse",
-			Load:         "/Library/Filesystems/osxfusefs.fs/Support/load_osxfusefs",
-			Mount:        "/Library/Filesystems/osxfusefs.fs/Support/mount_osxfusefs",
-			DaemonVar:    "MOUNT_FUSEFS_DAEMON_PATH",
-			LibVar:       "MOUNT_FUSEFS_CALL_BY_LIB",
-		},
-	}
-)
-
-const FUSET_SRV_PATH = "/usr/local/bin/go-nfsv4"
-
 func loadOSXFUSE(bin string) error {
 	cmd := exec.Command(bin)
 	cmd.Dir = "/"
@@ -139,7 +73,7 @@ func convertMountArgs(daemonVar string, libVar string,
 		//
 		// OSXFUSE seems to ignore InitResponse.MaxWrite, and uses
 		// this instead.
-		"-o", "iosize=" + strconv.FormatUint(buffer.MaxWriteSize, 10),
+		"-o", "iosize=" + strconv.Itoa(cfg.maxWrite()),
 	}
 
 	return argv, env, nil
@@ -209,7 +143,7 @@ func callMountCommFD(
 	env = append(env, "_FUSE_COMMVERS=2")
 	argv = append(argv, dir)
 
-	return fusermount(bin, argv, env, false, cfg.DebugLogger)
+	return fusermount(bin, argv, env, false, cfg.logger())
 }
 
 // Begin the process of mounting at the given directory, returning a connection
@@ -217,68 +151,46 @@ func callMountCommFD(
 // error is written to the supplied channel. The file system may need to
 // service the connection in order for mounting to complete.
 func mountOsxFuse(
+	loc *osxfuseInstallation,
 	dir string,
 	cfg *MountConfig,
 	ready chan<- error) (dev *os.File, err error) {
-	// Find the version of osxfuse installed on this machine.
-	for _, loc := range osxfuseInstallations {
-		if _, err := os.Stat(loc.Mount); os.IsNotExist(err) {
-			// try the other locations
-			continue
-		}
-
-		if loc.UseCommFD {
-			// Call the mount binary with the device.
-			ready <- nil
-			dev, err = callMountCommFD(loc.Mount, loc.DaemonVar, loc.LibVar, dir, cfg)
-			if err != nil {
-				return nil, fmt.Errorf("callMount: %v", err)
-			}
-			return
+	if loc.UseCommFD {
+		// Call the mount binary with the device.
+		ready <- nil
+		dev, err = callMountCommFD(loc.Mount, loc.DaemonVar, loc.LibVar, dir, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("callMount: %v", err)
 		}
+		return
+	}
 
-		// Open the device.
-		dev, err = openOSXFUSEDev(loc.DevicePrefix)
-
-		// Special case: we may need to explicitly load osxfuse. Load it, then
-		// try again.
-		if err == errNotLoaded {
-			err = loadOSXFUSE(loc.Load)
-			if err != nil {
-				return nil, fmt.Errorf("loadOSXFUSE: %v", err)
-			}
-
-			dev, err = openOSXFUSEDev(loc.DevicePrefix)
-		}
+	// Open the device.
+	dev, err = openOSXFUSEDev(loc.DevicePrefix)
 
-		// Propagate errors.
+	// Special case: we may need to explicitly load osxfuse. Load it, then
+	// try again.
+	if err == errNotLoaded {
+		err = loadOSXFUSE(loc.Load)
 		if err != nil {
-			return nil, fmt.Errorf("openOSXFUSEDev: %v", err)
-		}
-
-		// Call the mount binary with the device.
-		if err := callMount(loc.Mount, loc.DaemonVar, loc.LibVar, dir, cfg, dev, ready); err != nil {
-			dev.Close()
-			return nil, fmt.Errorf("callMount: %v", err)
+			return nil, fmt.Errorf("loadOSXFUSE: %v", err)
 		}
 
-		return dev, nil
+		dev, err = openOSXFUSEDev(loc.DevicePrefix)
 	}
 
-	return nil, errOSXFUSENotFound
-}
-
-func fusetBinary() (string, error) {
-	srv_path := os.Getenv("FUSE_NFSSRV_PATH")
-	if srv_path == "" {
-		srv_path = FUSET_SRV_PATH
+	// Propagate errors.
+	if err != nil {
+		return nil, fmt.Errorf("openOSXFUSEDev: %v", err)
 	}
 
-	if _, err := os.Stat(srv_path); err == nil {
-		return srv_path, nil
+	// Call the mount binary with the device.
+	if err := callMount(loc.Mount, loc.DaemonVar, loc.LibVar, dir, cfg, dev, ready); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("callMount: %v", err)
 	}
 
-	return "", fmt.Errorf("FUSE-T not found")
+	return dev, nil
 }
 
 func unixgramSocketpair() (l, r *os.File, err error) {
@@ -297,11 +209,9 @@ var local, local_mon, remote, remote_mon *os.File
 func startFuseTServer(binary string, argv []string,
 	additionalEnv []string,
 	wait bool,
-	debugLogger *log.Logger,
+	logger Logger,
 	ready chan<- error) (*os.File, error) {
-	if debugLogger != nil {
-		debugLogger.Println("Creating a socket pair")
-	}
+	logger.Debugf(LogMount, "Creating a socket pair")
 
 	var err error
 	local, remote, err = unixgramSocketpair()
@@ -319,13 +229,9 @@ func startFuseTServer(binary string, argv []string,
 	syscall.CloseOnExec(int(local.Fd()))
 	syscall.CloseOnExec(int(local_mon.Fd()))
 
-	if debugLogger != nil {
-		debugLogger.Println("Creating files to wrap the sockets")
-	}
+	logger.Debugf(LogMount, "Creating files to wrap the sockets")
 
-	if debugLogger != nil {
-		debugLogger.Println("Starting fusermount/os mount")
-	}
+	logger.Debugf(LogMount, "Starting fusermount/os mount")
 	// Start fusermount/mount_macfuse/mount_osxfuse.
 	cmd := exec.Command(binary, argv...)
 	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
@@ -346,17 +252,11 @@ func startFuseTServer(binary string, argv []string,
 		return nil, fmt.Errorf("running %v: %v", binary, err)
 	}
 
-	if debugLogger != nil {
-		debugLogger.Println("Wrapping socket pair in a connection")
-	}
+	logger.Debugf(LogMount, "Wrapping socket pair in a connection")
 
-	if debugLogger != nil {
-		debugLogger.Println("Checking that we have a unix domain socket")
-	}
+	logger.Debugf(LogMount, "Checking that we have a unix domain socket")
 
-	if debugLogger != nil {
-		debugLogger.Println("Read a message from socket")
-	}
+	logger.Debugf(LogMount, "Read a message from socket")
 
 	go func() {
 		if _, err = local_mon.Write([]byte("mount")); err != nil {
@@ -373,9 +273,7 @@ func startFuseTServer(binary string, argv []string,
 		close(ready)
 	}()
 
-	if debugLogger != nil {
-		debugLogger.Println("Successfully read the socket message.")
-	}
+	logger.Debugf(LogMount, "Successfully read the socket message.")
 
 	return local, nil
 }
@@ -389,7 +287,7 @@ func mountFuset(
 	fusekernel.IsPlatformFuseT = true
 	env := []string{}
 	argv := []string{
-		fmt.Sprintf("--rwsize=%d", buffer.MaxWriteSize),
+		fmt.Sprintf("--rwsize=%d", cfg.maxWrite()),
 	}
 
 	if cfg.VolumeName != "" {
@@ -403,7 +301,7 @@ func mountFuset(
 	env = append(env, "_FUSE_COMMVERS=2")
 	argv = append(argv, dir)
 
-	return startFuseTServer(bin, argv, env, false, cfg.DebugLogger, ready)
+	return startFuseTServer(bin, argv, env, false, cfg.logger(), ready)
 }
 
 func mount(
@@ -412,8 +310,14 @@ func mount(
 	ready chan<- error) (dev *os.File, err error) {
 
 	fusekernel.IsPlatformFuseT = false
-	if fuset_bin, err := fusetBinary(); err == nil {
-		return mountFuset(fuset_bin, dir, cfg, ready)
+	choice, err := hostDarwinLayout.chooseBackend(cfg.DarwinBackend)
+	if err != nil {
+		return nil, err
+	}
+
+	if choice.fuseT != "" {
+		cfg.logger().Debugf(LogMount, "Found FUSE-T at %s", choice.fuseT)
+		return mountFuset(choice.fuseT, dir, cfg, ready)
 	}
-	return mountOsxFuse(dir, cfg, ready)
+	return mountOsxFuse(choice.osxfuse, dir, cfg, ready)
 }
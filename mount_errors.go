@@ -0,0 +1,167 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Errors classifying why Mount failed. An error returned by Mount is a
+// *MountError, whose Kind is one of these when the cause could be determined,
+// so that callers can test for them with errors.Is rather than by matching
+// strings. For example:
+//
+//	if errors.Is(err, fuse.ErrFusermountNotFound) {
+//		log.Fatal("Please install the fuse3 package.")
+//	}
+//
+// A mount point that doesn't exist is reported as before, with an error
+// satisfying os.IsNotExist.
+var (
+	// Neither fusermount3 nor fusermount could be found in $PATH, and mounting
+	// directly wasn't permitted.
+	ErrFusermountNotFound = errors.New("fusermount not found")
+
+	// The kernel has no fuse support: /dev/fuse doesn't exist, or on OS X no
+	// supported FUSE implementation is installed.
+	ErrNoFuseDevice = errors.New("fuse device not available")
+
+	// The user isn't allowed to mount here, or with these options (e.g.
+	// allow_other without user_allow_other in /etc/fuse.conf).
+	ErrMountPermission = errors.New("mount not permitted")
+
+	// Something is already mounted on the mount point, or it is otherwise in
+	// use.
+	ErrMountPointBusy = errors.New("mount point busy")
+
+	// The mount point isn't a directory.
+	ErrMountPointNotDir = errors.New("mount point not a directory")
+
+	// The kernel's fuse protocol is older than the oldest version this package
+	// supports.
+	ErrKernelTooOld = errors.New("kernel fuse protocol too old")
+
+	// The MountConfig asks for options that can't be used, or can't be used
+	// together or on this system.
+	ErrInvalidMountOption = errors.New("invalid mount option")
+)
+
+// MountError is the type of errors returned by Mount. Its message is that
+// of the underlying error.
+type MountError struct {
+	// The directory on which mounting was attempted.
+	Dir string
+
+	// One of the Err* variables above, or nil if the failure couldn't be
+	// classified.
+	Kind error
+
+	// The underlying error.
+	Err error
+}
+
+func (e *MountError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns both the kind and the underlying error, so that errors.Is
+// and errors.As see through to either.
+func (e *MountError) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+
+	return []error{e.Kind, e.Err}
+}
+
+var mountErrorKinds = []error{
+	ErrFusermountNotFound,
+	ErrNoFuseDevice,
+	ErrMountPermission,
+	ErrMountPointBusy,
+	ErrMountPointNotDir,
+	ErrKernelTooOld,
+	ErrInvalidMountOption,
+}
+
+// Wrap an error from the mounting process in a *MountError, classifying it by
+// any of the kinds above that it already wraps, or else by the errno it
+// wraps.
+func newMountError(dir string, err error) *MountError {
+	return &MountError{
+		Dir:  dir,
+		Kind: mountErrorKind(err),
+		Err:  err,
+	}
+}
+
+func mountErrorKind(err error) error {
+	for _, kind := range mountErrorKinds {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+
+	if errors.Is(err, exec.ErrNotFound) {
+		return ErrFusermountNotFound
+	}
+
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return nil
+	}
+
+	switch errno {
+	case syscall.EACCES, syscall.EPERM:
+		return ErrMountPermission
+
+	case syscall.EBUSY:
+		return ErrMountPointBusy
+
+	case syscall.ENOTDIR:
+		return ErrMountPointNotDir
+
+	case syscall.ENODEV:
+		return ErrNoFuseDevice
+	}
+
+	return nil
+}
+
+// Classify what fusermount wrote to stderr before failing. It reports only
+// strerror text and a few messages of its own, so this is the best we can do.
+func fusermountErrorKind(stderr string) error {
+	switch {
+	case strings.Contains(stderr, "fuse device not found"),
+		strings.Contains(stderr, "No such device"):
+		return ErrNoFuseDevice
+
+	case strings.Contains(stderr, "Device or resource busy"):
+		return ErrMountPointBusy
+
+	case strings.Contains(stderr, "Not a directory"):
+		return ErrMountPointNotDir
+
+	case strings.Contains(stderr, "Permission denied"),
+		strings.Contains(stderr, "Operation not permitted"),
+		strings.Contains(stderr, "only allowed if"):
+		return ErrMountPermission
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMountErrorKind(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want error
+	}{
+		{fmt.Errorf("mount: %w", &exec.Error{Name: "fusermount", Err: exec.ErrNotFound}), ErrFusermountNotFound},
+		{fmt.Errorf("mount: %w", syscall.EBUSY), ErrMountPointBusy},
+		{fmt.Errorf("mount: %w", syscall.EACCES), ErrMountPermission},
+		{fmt.Errorf("Init: %w", fmt.Errorf("%w: 7.1", ErrKernelTooOld)), ErrKernelTooOld},
+		{fmt.Errorf("running fusermount: %w (%w)", errors.New("exit status 1"), ErrNoFuseDevice), ErrNoFuseDevice},
+		{errors.New("something else"), nil},
+	}
+
+	for _, tc := range testCases {
+		err := newMountError("/mnt", tc.err)
+		if err.Kind != tc.want {
+			t.Errorf("Kind for %q = %v, want %v", tc.err, err.Kind, tc.want)
+		}
+
+		if tc.want != nil && !errors.Is(err, tc.want) {
+			t.Errorf("errors.Is(%q, %v) = false", err, tc.want)
+		}
+
+		if !errors.Is(err, tc.err) || err.Error() != tc.err.Error() {
+			t.Errorf("MountError %q doesn't preserve %q", err, tc.err)
+		}
+	}
+}
+
+func TestFusermountErrorKind(t *testing.T) {
+	testCases := []struct {
+		stderr string
+		want   error
+	}{
+		{"fusermount3: fuse device not found, try 'modprobe fuse' first\n", ErrNoFuseDevice},
+		{"fusermount3: mount failed: Device or resource busy\n", ErrMountPointBusy},
+		{"fusermount3: failed to access mountpoint /mnt: Permission denied\n", ErrMountPermission},
+		{"fusermount3: option allow_other only allowed if 'user_allow_other' is set in /etc/fuse.conf\n", ErrMountPermission},
+		{"fusermount3: bad mount point /mnt: Not a directory\n", ErrMountPointNotDir},
+		{"", nil},
+	}
+
+	for _, tc := range testCases {
+		if got := fusermountErrorKind(tc.stderr); got != tc.want {
+			t.Errorf("fusermountErrorKind(%q) = %v, want %v", tc.stderr, got, tc.want)
+		}
+	}
+}
+
+func TestMountPointNotDir(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "foo")
+	if err := os.WriteFile(f, nil, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	_, err := Mount(f, nil, &MountConfig{})
+	if !errors.Is(err, ErrMountPointNotDir) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	var me *MountError
+	if !errors.As(err, &me) || me.Dir != f {
+		t.Errorf("Expected a *MountError for %q, got %#v", f, err)
+	}
+}
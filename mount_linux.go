@@ -23,6 +23,40 @@ func findFusermount() (string, error) {
 	return path, nil
 }
 
+// fuse 2's fusermount refuses to mount over a non-empty directory without the
+// nonempty option, while fusermount3 always allows it and may reject the
+// option. Distributions sometimes install fusermount3 under the old name, so
+// ask the binary for its version rather than going by its name.
+func fusermountNeedsNonempty(path string) bool {
+	out, err := exec.Command(path, "-V").CombinedOutput()
+	if err != nil {
+		return false
+	}
+
+	return parseFusermountMajorVersion(string(out)) == 2
+}
+
+// Parse output like "fusermount version: 2.9.9", returning zero if it can't
+// be parsed.
+func parseFusermountMajorVersion(out string) int {
+	i := strings.LastIndex(out, "version:")
+	if i < 0 {
+		return 0
+	}
+
+	v := strings.TrimSpace(out[i+len("version:"):])
+	if j := strings.IndexByte(v, '.'); j >= 0 {
+		v = v[:j]
+	}
+
+	major, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+
+	return major
+}
+
 func enableFunc(flag uintptr) func(uintptr) uintptr {
 	return func(v uintptr) uintptr {
 		return v | flag
@@ -55,21 +89,36 @@ var mountflagopts = map[string]func(uintptr) uintptr{
 var errFallback = errors.New("sentinel: fallback to fusermount(1)")
 
 func directmount(dir string, cfg *MountConfig) (*os.File, error) {
-	if cfg.DebugLogger != nil {
-		cfg.DebugLogger.Println("Preparing for direct mounting")
-	}
+	cfg.logger().Debugf(LogMount, "Preparing for direct mounting")
 	// We use syscall.Open + os.NewFile instead of os.OpenFile so that the file
 	// is opened in blocking mode. When opened in non-blocking mode, the Go
 	// runtime tries to use poll(2), which does not work with /dev/fuse.
 	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR, 0644)
+	if err == syscall.ENOENT || err == syscall.ENODEV {
+		// fusermount(1) would fail the same way.
+		return nil, fmt.Errorf("%w: opening /dev/fuse: %v", ErrNoFuseDevice, err)
+	}
 	if err != nil {
 		return nil, errFallback
 	}
 	dev := os.NewFile(uintptr(fd), "/dev/fuse")
 
-	if cfg.DebugLogger != nil {
-		cfg.DebugLogger.Println("Successfully opened the /dev/fuse in blocking mode")
+	cfg.logger().Debugf(LogMount, "Successfully opened the /dev/fuse in blocking mode")
+	if err := mountDevice(dev, dir, cfg, unix.Mount); err != nil {
+		return nil, err
 	}
+	cfg.logger().Debugf(LogMount, "Unix mounting completed successfully")
+	return dev, nil
+}
+
+// Mount the already open /dev/fuse device at the given directory using the
+// supplied mount(2) implementation. On failure the device is closed, and
+// errFallback is returned if we are not permitted to mount directly.
+func mountDevice(
+	dev *os.File,
+	dir string,
+	cfg *MountConfig,
+	sysMount func(source, target, fstype string, flags uintptr, data string) error) error {
 	// As per libfuse/fusermount.c:847: https://bit.ly/2SgtWYM#L847
 	data := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d",
 		dev.Fd(), os.Getuid(), os.Getgid())
@@ -92,26 +141,21 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 	delete(opts, "subtype")
 	data += "," + mapToOptionsString(opts)
 
-	if cfg.DebugLogger != nil {
-		cfg.DebugLogger.Println("Starting the unix mounting")
-	}
-	if err := unix.Mount(
+	cfg.logger().Debugf(LogMount, "Starting the unix mounting")
+	if err := sysMount(
 		cfg.FSName, // source
 		dir,        // target
 		fstype,     // fstype
 		mountflag,  // mountflag
 		data,       // data
 	); err != nil {
+		dev.Close()
 		if err == syscall.EPERM {
-			return nil, errFallback
-
+			return errFallback
 		}
-		return nil, err
+		return err
 	}
-	if cfg.DebugLogger != nil {
-		cfg.DebugLogger.Println("Unix mounting completed successfully")
-	}
-	return dev, nil
+	return nil
 }
 
 // Begin the process of mounting at the given directory, returning a connection
@@ -122,34 +166,40 @@ func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
 	// On linux, mounting is never delayed.
 	ready <- nil
 
-	if cfg.DebugLogger != nil {
-		cfg.DebugLogger.Println("Parsing fuse file descriptor")
-	}
+	cfg.logger().Debugf(LogMount, "Parsing fuse file descriptor")
 	// If the mountpoint is /dev/fd/N, assume that the file descriptor N is an
 	// already open FUSE channel. Parse it, cast it to an fd, and don't do any
 	// other part of the mount dance.
-	if fd, err := parseFuseFd(dir); err == nil {
-		dev := os.NewFile(uintptr(fd), "/dev/fuse")
-		return dev, nil
+	if strings.HasPrefix(dir, "/dev/fd/") {
+		fd, err := parseFuseFd(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		return os.NewFile(uintptr(fd), "/dev/fuse"), nil
 	}
 
 	// Try mounting without fusermount(1) first: we might be running as root or
 	// have the CAP_SYS_ADMIN capability.
 	dev, err := directmount(dir, cfg)
 	if err == errFallback {
-		if cfg.DebugLogger != nil {
-			cfg.DebugLogger.Println("Directmount failed. Trying fallback.")
-		}
+		cfg.logger().Debugf(LogMount, "Directmount failed. Trying fallback.")
 		fusermountPath, err := findFusermount()
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf(
+				"not permitted to mount directly, and %w",
+				err)
+		}
+		opts := cfg.toOptionsString()
+		if cfg.AllowNonEmptyMountPoint && fusermountNeedsNonempty(fusermountPath) {
+			opts += ",nonempty"
 		}
 		argv := []string{
-			"-o", cfg.toOptionsString(),
+			"-o", opts,
 			"--",
 			dir,
 		}
-		return fusermount(fusermountPath, argv, []string{}, true, cfg.DebugLogger)
+		return fusermount(fusermountPath, argv, []string{}, true, cfg.logger())
 	}
 	return dev, err
 }
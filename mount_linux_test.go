@@ -1,7 +1,16 @@
 package fuse
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
 func Test_parseFuseFd(t *testing.T) {
@@ -35,3 +44,140 @@ func Test_parseFuseFd(t *testing.T) {
 		}
 	})
 }
+
+func Test_parseFusermountMajorVersion(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want int
+	}{
+		{"fusermount version: 2.9.9\n", 2},
+		{"fusermount3 version: 3.10.3\n", 3},
+		{"garbage", 0},
+	}
+
+	for _, tc := range testCases {
+		if got := parseFusermountMajorVersion(tc.in); got != tc.want {
+			t.Errorf("parseFusermountMajorVersion(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+type blockingServer chan struct{}
+
+func (s blockingServer) ServeOps(*Connection) { <-s }
+
+func TestMountDevice(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	defer kernel.Close()
+
+	type initMsg struct {
+		h  fusekernel.InHeader
+		in fusekernel.InitIn
+	}
+
+	msg := initMsg{
+		h: fusekernel.InHeader{
+			Len:    uint32(unsafe.Sizeof(initMsg{})),
+			Opcode: fusekernel.OpInit,
+			Unique: 1,
+		},
+		in: fusekernel.InitIn{
+			Major:        fusekernel.ProtoVersionMaxMajor,
+			Minor:        fusekernel.ProtoVersionMaxMinor,
+			MaxReadahead: 1 << 17,
+		},
+	}
+
+	if _, err := kernel.Write((*[unsafe.Sizeof(initMsg{})]byte)(unsafe.Pointer(&msg))[:]); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// The mount point isn't looked at: a helper mounted it for us.
+	const dir = "/nonexistent/mnt"
+	server := make(blockingServer)
+	cfg := &MountConfig{Device: os.NewFile(uintptr(fds[1]), "/dev/fuse")}
+	mfs, err := Mount(dir, server, cfg)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	if mfs.Dir() != dir {
+		t.Errorf("Dir = %q", mfs.Dir())
+	}
+
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	if n < int(unsafe.Sizeof(*h)) || h.Unique != 1 || h.Error != 0 {
+		t.Errorf("Unexpected init reply: %+v", *h)
+	}
+
+	close(server)
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+
+	// A malformed /dev/fd path is an error rather than a directory to mount on.
+	if _, err := Mount("/dev/fd/x", server, &MountConfig{}); err == nil {
+		t.Error("Mounted on /dev/fd/x")
+	}
+}
+
+func TestMountDeviceClosesOnFailure(t *testing.T) {
+	testCases := []struct {
+		name     string
+		mountErr error
+		wantErr  error
+	}{
+		{"success", nil, nil},
+		{"not permitted", syscall.EPERM, errFallback},
+		{"other error", syscall.EINVAL, syscall.EINVAL},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, dev, err := os.Pipe()
+			if err != nil {
+				t.Fatalf("Pipe: %v", err)
+			}
+			defer r.Close()
+
+			var gotData string
+			sysMount := func(source, target, fstype string, flags uintptr, data string) error {
+				if target != "/mnt/foo" {
+					t.Errorf("target = %q", target)
+				}
+				gotData = data
+				return tc.mountErr
+			}
+
+			fd := dev.Fd()
+			cfg := &MountConfig{FSName: "test"}
+			err = mountDevice(dev, "/mnt/foo", cfg, sysMount)
+			if err != tc.wantErr {
+				t.Errorf("got %v, want %v", err, tc.wantErr)
+			}
+			if want := fmt.Sprintf("fd=%d,", fd); !strings.HasPrefix(gotData, want) {
+				t.Errorf("data = %q, want prefix %q", gotData, want)
+			}
+
+			// The device must be closed exactly when mounting fails.
+			closeErr := dev.Close()
+			if tc.mountErr == nil && closeErr != nil {
+				t.Errorf("device closed after a successful mount: %v", closeErr)
+			}
+			if tc.mountErr != nil && !errors.Is(closeErr, os.ErrClosed) {
+				t.Errorf("device left open after a failed mount: %v", closeErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func checkMountPoint(dir string) error {
+	if strings.HasPrefix(dir, "/dev/fd") {
+		return nil
+	}
+
+	fi, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		return err
+
+	case err != nil:
+		return fmt.Errorf("Statting mount point: %w", err)
+
+	case !fi.IsDir():
+		return fmt.Errorf("%w: %s", ErrMountPointNotDir, dir)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Whether dir names a drive, as in "X:".
+func isDriveLetter(dir string) bool {
+	return len(dir) == 2 && dir[1] == ':' &&
+		('a' <= dir[0] && dir[0] <= 'z' || 'A' <= dir[0] && dir[0] <= 'Z')
+}
+
+// WinFsp mounts on a drive letter, or on a directory that it creates itself,
+// so unlike elsewhere the mount point must not exist yet. Its parent must.
+func checkMountPoint(dir string) error {
+	if isDriveLetter(dir) {
+		return nil
+	}
+
+	_, err := os.Stat(dir)
+	if err == nil {
+		return fmt.Errorf("%w: %s exists; WinFsp mounts on a drive letter or a directory that doesn't exist yet", ErrMountPointBusy, dir)
+	}
+
+	// Check the parent first, since a parent that's a file can also make dir
+	// fail to stat with something other than "not found".
+	fi, parentErr := os.Stat(filepath.Dir(dir))
+	switch {
+	case os.IsNotExist(parentErr):
+		return parentErr
+
+	case parentErr != nil:
+		return fmt.Errorf("Statting mount point's parent: %w", parentErr)
+
+	case !fi.IsDir():
+		return fmt.Errorf("%w: %s", ErrMountPointNotDir, filepath.Dir(dir))
+
+	case !os.IsNotExist(err):
+		return fmt.Errorf("Statting mount point: %w", err)
+	}
+
+	return nil
+}
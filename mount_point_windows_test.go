@@ -0,0 +1,35 @@
+package fuse
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckMountPoint(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		dir  string
+		want error
+	}{
+		{"X:", nil},
+		{"x:", nil},
+		{filepath.Join(dir, "mnt"), nil},
+		{dir, ErrMountPointBusy},
+		{filepath.Join(file, "mnt"), ErrMountPointNotDir},
+		{filepath.Join(dir, "missing", "mnt"), os.ErrNotExist},
+	}
+
+	for _, c := range cases {
+		err := checkMountPoint(c.dir)
+		if c.want == nil && err != nil || !errors.Is(err, c.want) {
+			t.Errorf("checkMountPoint(%q): got %v, want %v", c.dir, err, c.want)
+		}
+	}
+}
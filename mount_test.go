@@ -2,6 +2,7 @@ package fuse_test
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
@@ -93,3 +94,58 @@ func TestNonexistentMountPoint(t *testing.T) {
 		t.Errorf("Unexpected error: %v", got)
 	}
 }
+
+func TestMountAndServeNonexistentMountPoint(t *testing.T) {
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Attempting to mount into a sub-directory that doesn't exist should fail
+	// without blocking.
+	err = fuse.MountAndServe(
+		context.Background(),
+		path.Join(dir, "foo"),
+		fuseutil.NewFileSystemServer(&minimalFS{}),
+		&fuse.MountConfig{})
+
+	const want = "no such file"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func noopControlCommand([]string) (string, error) { return "", nil }
+
+func TestInvalidMountOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	testCases := []fuse.MountConfig{
+		{AllowOther: true, AllowRoot: true},
+		{Options: map[string]string{"": ""}},
+		{Options: map[string]string{"a=b": ""}},
+		{Options: map[string]string{"rootmode": "40000"}},
+		{Options: map[string]string{"context": "a,b"}},
+		{IDMapUserNamespace: os.Stdin, DisableDefaultPermissions: true},
+		{ResumeState: &fuse.ConnectionState{}},
+		{ControlCommands: map[string]fuse.ControlCommand{"flush": noopControlCommand}},
+		{ControlSocket: "/tmp/control", ControlCommands: map[string]fuse.ControlCommand{"unmount": noopControlCommand}},
+		{ControlSocket: "/tmp/control", ControlCommands: map[string]fuse.ControlCommand{"two words": noopControlCommand}},
+	}
+
+	for _, cfg := range testCases {
+		cfg := cfg
+		_, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(&minimalFS{}), &cfg)
+		if !errors.Is(err, fuse.ErrInvalidMountOption) {
+			t.Errorf("%+v: unexpected error: %v", cfg, err)
+		}
+	}
+}
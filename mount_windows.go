@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// The hosts of the file systems mounted by this process, by mount point, for
+// unmount.
+var (
+	winfspHostsMu sync.Mutex
+	winfspHosts   = make(map[string]*winfspHost) // GUARDED_BY(winfspHostsMu)
+)
+
+// Mount with WinFsp, which calls into this process for each operation
+// rather than handing it a device to read from. A winfspHost turns the calls
+// into requests for the connection, through an in-process device pair.
+func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
+	kernel, dev, err := newDevicePair()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoFuseDevice, err)
+	}
+
+	h := newWinfspHost(kernel, cfg)
+	h.ready = ready
+	go h.serve(dir)
+
+	return dev, nil
+}
+
+// Options for WinFsp's FUSE layer. Files are reported as owned by the user
+// who mounted, as the uid and gid of file systems mean nothing on Windows.
+func winfspOptions(cfg *MountConfig) []string {
+	opts := map[string]string{
+		"uid": "-1",
+		"gid": "-1",
+	}
+
+	if cfg.FSName != "" {
+		opts["FileSystemName"] = cfg.FSName
+	}
+
+	if cfg.VolumeName != "" {
+		opts["volname"] = cfg.VolumeName
+	}
+
+	for k, v := range cfg.Options {
+		opts[k] = v
+	}
+
+	return []string{"-o", mapToOptionsString(opts)}
+}
+
+// Play the kernel's part for the connection at the other end of the device
+// pair: negotiate with it, then mount with WinFsp and serve its calls until
+// it unmounts. Closing the kernel's end at the end makes the connection see
+// EOF.
+func (h *winfspHost) serve(dir string) {
+	defer h.kernel.Close()
+	go h.readReplies()
+
+	if err := h.init(); err != nil {
+		h.signal(fmt.Errorf("INIT: %w", err))
+		return
+	}
+
+	winfspHostsMu.Lock()
+	winfspHosts[dir] = h
+	winfspHostsMu.Unlock()
+
+	defer func() {
+		winfspHostsMu.Lock()
+		delete(winfspHosts, dir)
+		winfspHostsMu.Unlock()
+	}()
+
+	// Init signals success once WinFsp is up, making this a no-op.
+	err := h.mount(dir)
+	if err == nil {
+		err = errors.New("WinFsp unmounted before initializing the file system")
+	}
+
+	h.signal(err)
+}
+
+// Mount with WinFsp, blocking until unmounted.
+func (h *winfspHost) mount(dir string) (err error) {
+	// cgofuse panics if WinFsp isn't installed.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrNoFuseDevice, r)
+		}
+	}()
+
+	if !h.host.Mount(dir, winfspOptions(h.cfg)) {
+		return errors.New("WinFsp failed to mount")
+	}
+
+	return nil
+}
@@ -22,7 +22,8 @@ import (
 // MountedFileSystem represents the status of a mount operation, with a method
 // that waits for unmounting.
 type MountedFileSystem struct {
-	dir string
+	dir  string
+	conn *Connection
 
 	// The result to return from Join. Not valid until the channel is closed.
 	joinStatus          error
@@ -35,6 +36,37 @@ func (mfs *MountedFileSystem) Dir() string {
 	return mfs.dir
 }
 
+// Protocol returns the version of the fuse kernel protocol negotiated with
+// the kernel, as for Connection.Protocol.
+func (mfs *MountedFileSystem) Protocol() (major, minor uint32) {
+	return mfs.conn.Protocol()
+}
+
+// MaxWrite returns the largest amount of data the kernel will send in a single
+// WriteFileOp, as for Connection.MaxWrite.
+func (mfs *MountedFileSystem) MaxWrite() uint32 {
+	return mfs.conn.MaxWrite()
+}
+
+// MaxReadahead returns the maximum number of bytes the kernel will read ahead
+// of the application, as for Connection.MaxReadahead.
+func (mfs *MountedFileSystem) MaxReadahead() uint32 {
+	return mfs.conn.MaxReadahead()
+}
+
+// Features returns the optional behaviors agreed with the kernel, as for
+// Connection.Features.
+func (mfs *MountedFileSystem) Features() Features {
+	return mfs.conn.Features()
+}
+
+// DeviceFd returns the file descriptor of the fuse device through which ops
+// are served, e.g. for logging or for polling it alongside other descriptors.
+// It remains owned by the connection: don't read from, write to or close it.
+func (mfs *MountedFileSystem) DeviceFd() uintptr {
+	return mfs.conn.dev.Fd()
+}
+
 // Join blocks until a mounted file system has been unmounted. It does not
 // return successfully until all ops read from the connection have been
 // responded to (i.e. the file system server has finished processing all
@@ -51,6 +83,16 @@ func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 	}
 }
 
+// Shutdown unmounts the file system gracefully, as for Connection.Shutdown,
+// and then waits for serving to finish, as for Join.
+func (mfs *MountedFileSystem) Shutdown(ctx context.Context) error {
+	if err := mfs.conn.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	return mfs.Join(ctx)
+}
+
 // GetFuseContext implements the equiv. of FUSE-C fuse_get_context() and thus
 // returns the UID / GID / PID associated with all FUSE requests send by the kernel.
 // ctx parameter must be one of the context from the fuseops handlers (e.g.: CreateFile)
@@ -0,0 +1,61 @@
+package fuse
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestMountedFileSystemNegotiatedValues(t *testing.T) {
+	// A kernel older than us, with less readahead than we ask for and no way
+	// of raising its limit of 32 pages per request.
+	in := fusekernel.InitIn{
+		Major:        7,
+		Minor:        28,
+		MaxReadahead: 1 << 16,
+	}
+
+	cfg := MountConfig{MaxWrite: 1 << 20}
+	c, _, _ := initWithKernelIn(t, cfg, in, 0)
+	mfs := &MountedFileSystem{conn: c}
+
+	if major, minor := mfs.Protocol(); major != 7 || minor != 28 {
+		t.Errorf("Protocol: got %d.%d, want 7.28", major, minor)
+	}
+
+	if got, want := mfs.MaxWrite(), uint32(32*os.Getpagesize()); got != want {
+		t.Errorf("MaxWrite: got %d, want %d", got, want)
+	}
+
+	if got, want := mfs.MaxReadahead(), uint32(1<<16); got != want {
+		t.Errorf("MaxReadahead: got %d, want %d", got, want)
+	}
+
+	if got, want := mfs.DeviceFd(), c.dev.Fd(); got != want {
+		t.Errorf("DeviceFd: got %d, want %d", got, want)
+	}
+
+	// A kernel that lets us have what we ask for.
+	in = fusekernel.InitIn{
+		Major:        fusekernel.ProtoVersionMaxMajor,
+		Minor:        fusekernel.ProtoVersionMaxMinor,
+		MaxReadahead: 1 << 24,
+		Flags:        uint32(fusekernel.InitMaxPages),
+	}
+
+	c, _, _ = initWithKernelIn(t, cfg, in, 0)
+	mfs = &MountedFileSystem{conn: c}
+
+	if major, minor := mfs.Protocol(); major != fusekernel.ProtoVersionMaxMajor || minor != fusekernel.ProtoVersionMaxMinor {
+		t.Errorf("Protocol: got %d.%d", major, minor)
+	}
+
+	if got, want := mfs.MaxWrite(), uint32(1<<20); got != want {
+		t.Errorf("MaxWrite: got %d, want %d", got, want)
+	}
+
+	if got, want := mfs.MaxReadahead(), uint32(maxReadahead); got != want {
+		t.Errorf("MaxReadahead: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// NotifyInvalEntry tells the kernel to drop any cached directory entry for
+// the given name within the given parent, whether positive or negative. The
+// next lookup of the name will reach the file system.
+//
+// This is for changes made to the file system other than through the mount,
+// e.g. by another client of a shared backing store. It returns ENOSYS if the
+// kernel doesn't support the notification, and ENOENT if the kernel doesn't
+// know about the parent, in which case there is nothing to invalidate.
+//
+// May be called concurrently with ReadOp and Reply. It must not be called
+// while handling an op for which the kernel may hold the parent's lock (e.g.
+// a lookup within the parent), since the kernel would wait for that op to
+// complete before processing the notification.
+func (c *Connection) NotifyInvalEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	if !c.protocol.HasInvalidate() {
+		return syscall.ENOSYS
+	}
+
+	out := fusekernel.NotifyInvalEntryOut{
+		Parent:  uint64(c.kernelInodeID(parent)),
+		Namelen: uint32(len(name)),
+	}
+
+	return c.notify(
+		fusekernel.NotifyCodeInvalEntry,
+		(*[fusekernel.NotifyInvalEntryOutSize]byte)(unsafe.Pointer(&out))[:],
+		[]byte(name),
+		[]byte{0})
+}
+
+// NotifyInvalInode tells the kernel to drop its cached attributes for the
+// given inode, along with the cached pages in the byte range [offset,
+// offset+length). A length of zero or less means to the end of the file, and
+// a negative offset means to drop only the attributes.
+//
+// Like NotifyInvalEntry, this is for changes made other than through the
+// mount. It returns ENOSYS if the kernel doesn't support the notification,
+// and ENOENT if the kernel doesn't know about the inode (in which case there
+// is nothing cached). See also MountConfig.EnableExplicitInvalData.
+//
+// May be called concurrently with ReadOp and Reply. It must not be called
+// while handling a read or write of the inode, since the kernel may hold
+// locks on the pages being invalidated until that op completes.
+func (c *Connection) NotifyInvalInode(
+	inode fuseops.InodeID,
+	offset int64,
+	length int64) error {
+	return c.notifyInvalInode(c.kernelInodeID(inode), offset, length)
+}
+
+// Like NotifyInvalInode, but in terms of the kernel's inode IDs.
+func (c *Connection) notifyInvalInode(
+	inode fuseops.InodeID,
+	offset int64,
+	length int64) error {
+	if !c.protocol.HasInvalidate() {
+		return syscall.ENOSYS
+	}
+
+	out := fusekernel.NotifyInvalInodeOut{
+		Ino: uint64(inode),
+		Off: offset,
+		Len: length,
+	}
+
+	return c.notify(
+		fusekernel.NotifyCodeInvalInode,
+		(*[fusekernel.NotifyInvalInodeOutSize]byte)(unsafe.Pointer(&out))[:])
+}
+
+// NotifyDelete is like NotifyInvalEntry, but additionally tells the kernel
+// that the entry referred to the given child inode and that the child is
+// gone, so that e.g. inotify watchers see the deletion. If the kernel's entry
+// refers to a different inode, it is left alone.
+//
+// The kernel marks a directory child as dead, failing with ENOTEMPTY if it
+// has cached children, so this is only right for inodes that were actually
+// removed; use NotifyInvalEntry for ones that were merely renamed.
+func (c *Connection) NotifyDelete(
+	parent fuseops.InodeID,
+	child fuseops.InodeID,
+	name string) error {
+	if !c.protocol.HasNotifyDelete() {
+		return syscall.ENOSYS
+	}
+
+	out := fusekernel.NotifyDeleteOut{
+		Parent:  uint64(c.kernelInodeID(parent)),
+		Child:   uint64(c.kernelInodeID(child)),
+		Namelen: uint32(len(name)),
+	}
+
+	return c.notify(
+		fusekernel.NotifyCodeDelete,
+		(*[fusekernel.NotifyDeleteOutSize]byte)(unsafe.Pointer(&out))[:],
+		[]byte(name),
+		[]byte{0})
+}
+
+// NotifyPoll tells the kernel that the readiness of the file polled by the
+// PollOp with the given handle may have changed, so that the kernel polls it
+// again and wakes up the waiting caller if it is now ready. The handle is
+// valid until the notification is sent; later polls carry new ones.
+//
+// May be called concurrently with ReadOp and Reply, including while handling
+// an op.
+func (c *Connection) NotifyPoll(h fuseops.PollHandle) error {
+	out := fusekernel.NotifyPollWakeupOut{
+		Kh: uint64(h),
+	}
+
+	return c.notify(
+		fusekernel.NotifyCodePoll,
+		(*[fusekernel.NotifyPollWakeupOutSize]byte)(unsafe.Pointer(&out))[:])
+}
+
+// NotifyStore copies data into the kernel's page cache for the given inode,
+// starting at the given offset, as if it had been read from the file. The
+// kernel extends its idea of the file's size if the data reaches beyond it.
+//
+// This lets a file system that prefetches data, e.g. from a remote store,
+// warm the cache ahead of reads rather than waiting for the kernel to ask. The
+// data is not written back to the file system. It returns ENOSYS if the
+// kernel doesn't support the notification, and ENOENT if the kernel doesn't
+// know about the inode.
+//
+// May be called concurrently with ReadOp and Reply. As for NotifyInvalInode,
+// it must not be called while handling a read or write of the inode.
+func (c *Connection) NotifyStore(
+	inode fuseops.InodeID,
+	offset uint64,
+	data []byte) error {
+	if !c.protocol.HasNotifyStore() {
+		return syscall.ENOSYS
+	}
+
+	out := fusekernel.NotifyStoreOut{
+		Nodeid: uint64(c.kernelInodeID(inode)),
+		Offset: offset,
+		Size:   uint32(len(data)),
+	}
+
+	return c.notify(
+		fusekernel.NotifyCodeStore,
+		(*[fusekernel.NotifyStoreOutSize]byte)(unsafe.Pointer(&out))[:],
+		data)
+}
+
+// A NotifyRetrieve call awaiting the kernel's reply.
+type retrieveWaiter struct {
+	dst  []byte
+	n    int
+	done chan struct{}
+}
+
+// NotifyRetrieve copies data for the given inode out of the kernel's page
+// cache into dst, starting at the given offset. It returns the number of
+// bytes copied, which stops short at the end of the file, at the first page
+// not in the cache, and at the connection's MaxWrite.
+//
+// This lets a file system see what the kernel holds, e.g. dirty pages when
+// writeback caching is enabled. It returns ENOSYS if the kernel doesn't
+// support the notification, and ENOENT if the kernel doesn't know about the
+// inode.
+//
+// The kernel's reply arrives through ReadOp, so this blocks until another
+// goroutine reads it or ctx is cancelled. It must not be called while
+// handling a read or write of the inode.
+func (c *Connection) NotifyRetrieve(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	offset uint64,
+	dst []byte) (int, error) {
+	if !c.protocol.HasNotifyStore() {
+		return 0, syscall.ENOSYS
+	}
+
+	w := &retrieveWaiter{dst: dst, done: make(chan struct{})}
+
+	c.mu.Lock()
+	if c.retrieves == nil {
+		c.retrieves = make(map[uint64]*retrieveWaiter)
+	}
+
+	c.retrieveID++
+	id := c.retrieveID
+	c.retrieves[id] = w
+	c.mu.Unlock()
+
+	out := fusekernel.NotifyRetrieveOut{
+		NotifyUnique: id,
+		Nodeid:       uint64(c.kernelInodeID(inode)),
+		Offset:       offset,
+		Size:         uint32(len(dst)),
+	}
+
+	err := c.notify(
+		fusekernel.NotifyCodeRetrieve,
+		(*[fusekernel.NotifyRetrieveOutSize]byte)(unsafe.Pointer(&out))[:])
+
+	if err != nil {
+		c.forgetRetrieve(id)
+		return 0, err
+	}
+
+	select {
+	case <-w.done:
+		return w.n, nil
+
+	case <-ctx.Done():
+		// Unless the reply is already being copied into dst, in which case we
+		// must wait for that to finish.
+		if c.forgetRetrieve(id) {
+			return 0, ctx.Err()
+		}
+
+		<-w.done
+		return w.n, nil
+	}
+}
+
+// Remove the waiter for the given retrieve, returning false if it was
+// already gone.
+func (c *Connection) forgetRetrieve(id uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.retrieves[id]
+	delete(c.retrieves, id)
+	return ok
+}
+
+// Hand the kernel's reply to a retrieve notification to the waiting
+// NotifyRetrieve call, if it is still waiting.
+func (c *Connection) handleNotifyReply(op *notifyReplyOp) {
+	c.mu.Lock()
+	w := c.retrieves[op.Unique]
+	delete(c.retrieves, op.Unique)
+	c.mu.Unlock()
+
+	if w == nil {
+		return
+	}
+
+	w.n = copy(w.dst, op.Data)
+	close(w.done)
+}
+
+// Send a notification with the given code and body to the kernel.
+// Notifications are distinguished from replies by a zero unique ID, and carry
+// their code in the error field of the header.
+func (c *Connection) notify(code int32, body ...[]byte) error {
+	outMsg := c.getOutMessage()
+	defer c.putOutMessage(outMsg)
+
+	outMsg.Append(body...)
+	h := outMsg.OutHeader()
+	h.Error = code
+	h.Len = uint32(outMsg.Len())
+
+	// writev is not atomic
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	_, err := writev(c.dev, outMsg.Sglist)
+	return err
+}
@@ -0,0 +1,242 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestNotifyInvalInode(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	c := &Connection{
+		dev:      w,
+		cfg:      MountConfig{RootInode: 7},
+		protocol: fusekernel.Protocol{Major: 7, Minor: 31},
+	}
+
+	// The file system's root is the kernel's inode 1.
+	if err := c.NotifyInvalInode(7, 4096, -1); err != nil {
+		t.Fatalf("NotifyInvalInode: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	const hdrSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+	if want := hdrSize + fusekernel.NotifyInvalInodeOutSize; n != want {
+		t.Fatalf("Read %d bytes, want %d", n, want)
+	}
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	if h.Unique != 0 || h.Error != fusekernel.NotifyCodeInvalInode || int(h.Len) != n {
+		t.Errorf("Unexpected header: %+v", *h)
+	}
+
+	out := (*fusekernel.NotifyInvalInodeOut)(unsafe.Pointer(&buf[hdrSize]))
+	if out.Ino != 1 || out.Off != 4096 || out.Len != -1 {
+		t.Errorf("Unexpected body: %+v", *out)
+	}
+
+	// Kernels older than 7.12 don't support the notification.
+	c.protocol = fusekernel.Protocol{Major: 7, Minor: 11}
+	if err := c.NotifyInvalInode(7, 0, 0); err != syscall.ENOSYS {
+		t.Errorf("NotifyInvalInode: got %v, want ENOSYS", err)
+	}
+}
+
+func TestNotifyPoll(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	c := &Connection{dev: w}
+	if err := c.NotifyPoll(17); err != nil {
+		t.Fatalf("NotifyPoll: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	const hdrSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+	if want := hdrSize + fusekernel.NotifyPollWakeupOutSize; n != want {
+		t.Fatalf("Read %d bytes, want %d", n, want)
+	}
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	if h.Unique != 0 || h.Error != fusekernel.NotifyCodePoll || int(h.Len) != n {
+		t.Errorf("Unexpected header: %+v", *h)
+	}
+
+	out := (*fusekernel.NotifyPollWakeupOut)(unsafe.Pointer(&buf[hdrSize]))
+	if out.Kh != 17 {
+		t.Errorf("Unexpected body: %+v", *out)
+	}
+}
+
+func TestNotifyStore(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	c := &Connection{
+		dev:      w,
+		protocol: fusekernel.Protocol{Major: 7, Minor: 31},
+	}
+
+	if err := c.NotifyStore(2, 8192, []byte("taco")); err != nil {
+		t.Fatalf("NotifyStore: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	const hdrSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+	if want := hdrSize + fusekernel.NotifyStoreOutSize + 4; n != want {
+		t.Fatalf("Read %d bytes, want %d", n, want)
+	}
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	if h.Unique != 0 || h.Error != fusekernel.NotifyCodeStore || int(h.Len) != n {
+		t.Errorf("Unexpected header: %+v", *h)
+	}
+
+	out := (*fusekernel.NotifyStoreOut)(unsafe.Pointer(&buf[hdrSize]))
+	if out.Nodeid != 2 || out.Offset != 8192 || out.Size != 4 {
+		t.Errorf("Unexpected body: %+v", *out)
+	}
+
+	if got := string(buf[hdrSize+fusekernel.NotifyStoreOutSize : n]); got != "taco" {
+		t.Errorf("Unexpected data: %q", got)
+	}
+}
+
+func TestNotifyRetrieve(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	c := &Connection{
+		dev:      w,
+		protocol: fusekernel.Protocol{Major: 7, Minor: 31},
+	}
+
+	// Read the notification, returning the unique ID the kernel should reply
+	// with.
+	readNotification := func() uint64 {
+		buf := make([]byte, 1024)
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		const hdrSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+		if want := hdrSize + fusekernel.NotifyRetrieveOutSize; n != want {
+			t.Fatalf("Read %d bytes, want %d", n, want)
+		}
+
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+		out := (*fusekernel.NotifyRetrieveOut)(unsafe.Pointer(&buf[hdrSize]))
+		if h.Error != fusekernel.NotifyCodeRetrieve || out.Nodeid != 2 || out.Offset != 4096 || out.Size != 8 {
+			t.Errorf("Unexpected notification: %+v, %+v", *h, *out)
+		}
+
+		return out.NotifyUnique
+	}
+
+	// Feed the kernel's reply through the decoder, as ReadOp would.
+	reply := func(unique uint64, data string) {
+		type replyMsg struct {
+			h    fusekernel.InHeader
+			in   fusekernel.NotifyRetrieveIn
+			data [4]byte
+		}
+
+		msg := replyMsg{
+			h: fusekernel.InHeader{
+				Len:    uint32(unsafe.Sizeof(replyMsg{})),
+				Opcode: fusekernel.OpNotifyReply,
+				Unique: unique,
+				Nodeid: 2,
+			},
+			in: fusekernel.NotifyRetrieveIn{Offset: 4096, Size: 4},
+		}
+		copy(msg.data[:], data)
+		b := (*[unsafe.Sizeof(replyMsg{})]byte)(unsafe.Pointer(&msg))[:]
+
+		inMsg := buffer.NewInMessage(4096)
+		if err := inMsg.Init(bytes.NewReader(b)); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		op, err := convertInMessage(&MountConfig{}, inMsg, nil, c.protocol)
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		c.handleNotifyReply(op.(*notifyReplyOp))
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	dst := make([]byte, 8)
+	results := make(chan result, 1)
+	retrieve := func(ctx context.Context) {
+		n, err := c.NotifyRetrieve(ctx, 2, 4096, dst)
+		results <- result{n, err}
+	}
+
+	go retrieve(context.Background())
+	reply(readNotification(), "taco")
+
+	if res := <-results; res.err != nil || res.n != 4 || string(dst[:4]) != "taco" {
+		t.Errorf("NotifyRetrieve: got %d, %v, %q", res.n, res.err, dst)
+	}
+
+	// A cancelled retrieve gives up, and its late reply is dropped.
+	ctx, cancel := context.WithCancel(context.Background())
+	go retrieve(ctx)
+	unique := readNotification()
+	cancel()
+
+	if res := <-results; res.err != context.Canceled {
+		t.Errorf("Cancelled NotifyRetrieve: got %d, %v", res.n, res.err)
+	}
+
+	reply(unique, "nope")
+	if string(dst[:4]) != "taco" {
+		t.Errorf("Late reply was copied: %q", dst)
+	}
+}
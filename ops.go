@@ -31,13 +31,22 @@ type interruptOp struct {
 	FuseID uint64
 }
 
+// The kernel's answer to a retrieve notification, handed to the waiting
+// NotifyRetrieve call.
+type notifyReplyOp struct {
+	Unique uint64
+	Offset uint64
+	Data   []byte
+}
+
 // Required in order to mount on Linux and OS X.
 type initOp struct {
 	// In
 	Kernel fusekernel.Protocol
 
 	// In/out
-	Flags fusekernel.InitFlags
+	Flags  fusekernel.InitFlags
+	Flags2 fusekernel.InitFlags2
 
 	// Out
 	Library       fusekernel.Protocol
@@ -45,4 +54,5 @@ type initOp struct {
 	MaxBackground uint16
 	MaxWrite      uint32
 	MaxPages      uint16
+	MaxStackDepth uint32
 }
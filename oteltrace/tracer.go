@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package oteltrace records a span for each op served by a fuse.Connection
+// with OpenTelemetry. It is a module of its own, so that package fuse doesn't
+// depend on OpenTelemetry.
+//
+// Spans go to whatever exporter the tracer provider is configured with. By
+// default that is the global provider, so a program that installs one with
+// otel.SetTracerProvider only needs to set
+//
+//	cfg := &fuse.MountConfig{Tracer: oteltrace.NewTracer(nil)}
+package oteltrace
+
+import (
+	"context"
+
+	"github.com/jacobsa/fuse"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The name under which spans are created, as the instrumentation scope.
+const scopeName = "github.com/jacobsa/fuse/oteltrace"
+
+// Tracer is a fuse.Tracer that starts a span named after each op, e.g.
+// "LookUpInode", when it is read from the kernel and ends it when the op is
+// replied to. Spans carry these attributes:
+//
+//   - fuse.opcode and fuse.unique: the op's kernel opcode and request ID.
+//   - fuse.inode: the inode the op is about, if any (cf. fuse.OpTrace).
+//   - fuse.pid: the process that caused the op, if known.
+//   - fuse.size and fuse.bytes: the bytes asked for and actually read or
+//     written, for ReadFileOp and WriteFileOp.
+//   - fuse.errno: the errno replied with, for ops that fail, whose spans also
+//     have an error status.
+//
+// The context the file system sees for an op carries its span, so spans the
+// file system starts from it are children of the op's.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+var _ fuse.Tracer = &Tracer{}
+
+// NewTracer creates a tracer that creates spans with the supplied provider, or
+// with the global one (cf. otel.GetTracerProvider) if it is nil.
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	return &Tracer{
+		tracer: tp.Tracer(scopeName),
+	}
+}
+
+// StartOp implements fuse.Tracer.
+func (t *Tracer) StartOp(ctx context.Context, op *fuse.OpTrace) context.Context {
+	attrs := []attribute.KeyValue{
+		attribute.Int64("fuse.opcode", int64(op.Opcode)),
+		attribute.Int64("fuse.unique", int64(op.FuseID)),
+	}
+
+	if op.Inode != 0 {
+		attrs = append(attrs, attribute.Int64("fuse.inode", int64(op.Inode)))
+	}
+
+	if op.Pid != 0 {
+		attrs = append(attrs, attribute.Int64("fuse.pid", int64(op.Pid)))
+	}
+
+	if op.Size != 0 {
+		attrs = append(attrs, attribute.Int64("fuse.size", op.Size))
+	}
+
+	ctx, _ = t.tracer.Start(
+		ctx,
+		op.Op,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(op.Start),
+		trace.WithAttributes(attrs...))
+
+	return ctx
+}
+
+// EndOp implements fuse.Tracer.
+func (t *Tracer) EndOp(ctx context.Context, op *fuse.OpTrace) {
+	span := trace.SpanFromContext(ctx)
+
+	if op.Bytes != 0 {
+		span.SetAttributes(attribute.Int64("fuse.bytes", op.Bytes))
+	}
+
+	if op.Err != nil {
+		span.SetAttributes(attribute.Int64("fuse.errno", int64(op.Errno)))
+		span.RecordError(op.Err)
+		span.SetStatus(codes.Error, op.Err.Error())
+	}
+
+	span.End(trace.WithTimestamp(op.Start.Add(op.Latency)))
+}
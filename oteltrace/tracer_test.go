@@ -0,0 +1,83 @@
+package oteltrace
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	start := time.Date(2015, 3, 26, 0, 0, 0, 0, time.UTC)
+	op := &fuse.OpTrace{
+		Op:     "ReadFile",
+		Opcode: 15,
+		FuseID: 3,
+		Inode:  7,
+		Size:   4096,
+		Pid:    17,
+		Start:  start,
+	}
+
+	ctx := tracer.StartOp(context.Background(), op)
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		t.Fatal("No span in the op's context")
+	}
+
+	op.Latency = time.Millisecond
+	op.Err = syscall.EIO
+	op.Errno = syscall.EIO
+	tracer.EndOp(ctx, op)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Got %d spans", len(spans))
+	}
+
+	span := spans[0]
+	if span.Name() != "ReadFile" || span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("Span %q of kind %v", span.Name(), span.SpanKind())
+	}
+
+	if !span.StartTime().Equal(start) || span.EndTime().Sub(span.StartTime()) != time.Millisecond {
+		t.Errorf("Span from %v to %v", span.StartTime(), span.EndTime())
+	}
+
+	if span.Status().Code != codes.Error {
+		t.Errorf("Status: %+v", span.Status())
+	}
+
+	got := make(map[attribute.Key]int64)
+	for _, kv := range span.Attributes() {
+		got[kv.Key] = kv.Value.AsInt64()
+	}
+
+	want := map[attribute.Key]int64{
+		"fuse.opcode": 15,
+		"fuse.unique": 3,
+		"fuse.inode":  7,
+		"fuse.pid":    17,
+		"fuse.size":   4096,
+		"fuse.errno":  int64(syscall.EIO),
+	}
+
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %d, want %d", k, got[k], v)
+		}
+	}
+
+	if _, ok := got["fuse.bytes"]; ok {
+		t.Error("Unexpected fuse.bytes on a failed op")
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// RegisterBackingFile registers f with the kernel as a backing file for
+// passthrough opens, returning the ID to put in OpenFileOp.BackingID or
+// CreateFileOp.BackingID. f should be open for reading and/or writing as the
+// opens that use it will be; the kernel takes its own reference, so f may be
+// closed as soon as this returns.
+//
+// This fails unless Features.Passthrough is in effect, and requires
+// CAP_SYS_ADMIN. Call UnregisterBackingFile once the ID is no longer needed
+// for new opens.
+func (c *Connection) RegisterBackingFile(f *os.File) (fuseops.BackingID, error) {
+	return c.registerBackingFile(f)
+}
+
+// UnregisterBackingFile releases an ID returned by RegisterBackingFile.
+// Handles already opened with it are unaffected.
+func (c *Connection) UnregisterBackingFile(id fuseops.BackingID) error {
+	return c.unregisterBackingFile(id)
+}
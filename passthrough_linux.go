@@ -0,0 +1,56 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"runtime"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+func (c *Connection) registerBackingFile(f *os.File) (fuseops.BackingID, error) {
+	m := fusekernel.BackingMap{Fd: int32(f.Fd())}
+	id, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		c.dev.Fd(),
+		fusekernel.DevIocBackingOpen,
+		uintptr(unsafe.Pointer(&m)))
+	runtime.KeepAlive(f)
+
+	if errno != 0 {
+		return 0, &os.SyscallError{Syscall: "FUSE_DEV_IOC_BACKING_OPEN", Err: errno}
+	}
+
+	return fuseops.BackingID(id), nil
+}
+
+func (c *Connection) unregisterBackingFile(id fuseops.BackingID) error {
+	raw := uint32(id)
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		c.dev.Fd(),
+		fusekernel.DevIocBackingClose,
+		uintptr(unsafe.Pointer(&raw)))
+
+	if errno != 0 {
+		return &os.SyscallError{Syscall: "FUSE_DEV_IOC_BACKING_CLOSE", Err: errno}
+	}
+
+	return nil
+}
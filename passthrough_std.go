@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package fuse
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Passthrough is Linux only.
+func (c *Connection) registerBackingFile(f *os.File) (fuseops.BackingID, error) {
+	return 0, syscall.ENOSYS
+}
+
+func (c *Connection) unregisterBackingFile(id fuseops.BackingID) error {
+	return syscall.ENOSYS
+}
@@ -0,0 +1,125 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+// Interrupts for requests we don't know about are normally for requests that
+// were replied to as the interrupt was being read, and not just early, so
+// there is no telling when, if ever, a remembered one is used up. Bound their
+// number so that they can't pile up.
+const maxEarlyInterrupts = 1024
+
+// A message read by one of the reader goroutines, or the error that stopped
+// it.
+type readResult struct {
+	m   *buffer.InMessage
+	dev *os.File
+	err error
+}
+
+// Clone the device as asked by c.cfg.DeviceReaders. Failing to clone isn't
+// fatal; we use what we have.
+func (c *Connection) cloneDevices() {
+	for i := 1; i < c.cfg.DeviceReaders; i++ {
+		clone, err := cloneDevice(c.dev)
+		if err != nil {
+			c.logger.Errorf(LogMount, "Cloning the device for reader %d: %v", i, err)
+			break
+		}
+
+		c.clones = append(c.clones, clone)
+	}
+}
+
+// If the device has been cloned, start a goroutine reading from each device,
+// after which readMessage takes messages from all of them.
+func (c *Connection) startReaders() {
+	if len(c.clones) == 0 {
+		return
+	}
+
+	c.incoming = make(chan readResult)
+	c.closing = make(chan struct{})
+
+	go c.readDevice(c.dev)
+	for _, clone := range c.clones {
+		go c.readDevice(clone)
+	}
+}
+
+// Read messages from the supplied device and hand them to readMessage, until
+// reading fails or the connection is closed.
+func (c *Connection) readDevice(dev *os.File) {
+	for {
+		m, err := c.readMessageFrom(dev)
+		select {
+		case c.incoming <- readResult{m, dev, err}:
+		case <-c.closing:
+			if m != nil {
+				c.putInMessage(m)
+			}
+
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Stop the reader goroutines, if any, and close the clones of the device.
+func (c *Connection) stopReaders() {
+	if c.closing == nil {
+		return
+	}
+
+	close(c.closing)
+	for _, clone := range c.clones {
+		clone.Close()
+	}
+}
+
+// Remember an interrupt for a request that hasn't begun.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(c.mu)
+func (c *Connection) recordEarlyInterrupt(fuseID uint64) {
+	if c.earlyInterrupts == nil || len(c.earlyInterrupts) >= maxEarlyInterrupts {
+		c.earlyInterrupts = make(map[uint64]struct{})
+	}
+
+	c.earlyInterrupts[fuseID] = struct{}{}
+}
+
+// Report whether the request has already been interrupted, forgetting the
+// interrupt if so.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) takeEarlyInterrupt(fuseID uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.earlyInterrupts[fuseID]; !ok {
+		return false
+	}
+
+	delete(c.earlyInterrupts, fuseID)
+	return true
+}
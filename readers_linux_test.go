@@ -0,0 +1,239 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestReadersReplyThroughOwnDevice(t *testing.T) {
+	// Two devices, each with its own end standing in for the kernel.
+	var kernels, devs [2]*os.File
+	for i := range devs {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+		if err != nil {
+			t.Fatalf("Socketpair: %v", err)
+		}
+
+		kernels[i] = os.NewFile(uintptr(fds[0]), "kernel")
+		devs[i] = os.NewFile(uintptr(fds[1]), "dev")
+		defer kernels[i].Close()
+		defer devs[i].Close()
+	}
+
+	c := &Connection{
+		cfg:         MountConfig{OpContext: context.Background()},
+		logger:      NewLevelLogger(log.New(&bytes.Buffer{}, "", 0), LogError),
+		dev:         devs[0],
+		protocol:    fusekernel.Protocol{Major: 7, Minor: 31},
+		cancelFuncs: make(map[uint64]context.CancelCauseFunc),
+		clones:      devs[1:],
+		incoming:    make(chan readResult),
+		closing:     make(chan struct{}),
+	}
+	defer c.stopReaders()
+
+	for _, dev := range devs {
+		go c.readDevice(dev)
+	}
+
+	// Send a request through each device, with the device index as its ID.
+	for i, k := range kernels {
+		msg := rawMessage(fusekernel.OpGetattr, wireBytes(fusekernel.GetattrIn{}))
+		(*fusekernel.InHeader)(unsafe.Pointer(&msg[0])).Unique = uint64(i)
+		if _, err := k.Write(msg); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	for range kernels {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		if _, ok := op.(*fuseops.GetInodeAttributesOp); !ok {
+			t.Fatalf("Unexpected op: %#v", op)
+		}
+
+		if err := c.Reply(ctx, nil); err != nil {
+			t.Fatalf("Reply: %v", err)
+		}
+	}
+
+	// Each reply comes back through the device its request arrived on.
+	buf := make([]byte, 4096)
+	for i, k := range kernels {
+		if _, err := k.Read(buf); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		if got := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0])).Unique; got != uint64(i) {
+			t.Errorf("Device %d: reply for request %d", i, got)
+		}
+	}
+}
+
+func TestEarlyInterrupt(t *testing.T) {
+	c := &Connection{
+		cfg:         MountConfig{OpContext: context.Background()},
+		cancelFuncs: make(map[uint64]context.CancelCauseFunc),
+		clones:      []*os.File{nil},
+	}
+
+	// An interrupt read before its request cancels the request when it begins.
+	c.handleInterrupt(5)
+
+	ctx := c.beginOp(fusekernel.OpGetattr, 5)
+	if !errors.Is(context.Cause(ctx), ErrInterrupted) {
+		t.Errorf("Cause: %v", context.Cause(ctx))
+	}
+
+	// But only that request, and only once.
+	c.finishOp(fusekernel.OpGetattr, 5)
+	for _, id := range []uint64{5, 7} {
+		ctx := c.beginOp(fusekernel.OpGetattr, id)
+		if ctx.Err() != nil {
+			t.Errorf("Request %d: %v", id, ctx.Err())
+		}
+
+		c.finishOp(fusekernel.OpGetattr, id)
+	}
+}
+
+func TestIOURingTransport(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+	defer dev.Close()
+
+	c := &Connection{
+		cfg:         MountConfig{OpContext: context.Background(), UseIOURing: true},
+		logger:      NewLevelLogger(log.New(&bytes.Buffer{}, "", 0), LogError),
+		dev:         dev,
+		protocol:    fusekernel.Protocol{Major: 7, Minor: 31},
+		cancelFuncs: make(map[uint64]context.CancelCauseFunc),
+	}
+
+	c.setUpRings()
+	defer c.closeRings()
+	if c.rings == nil {
+		t.Skip("io_uring unavailable")
+	}
+
+	msg := rawMessage(fusekernel.OpGetattr, wireBytes(fusekernel.GetattrIn{}))
+	if _, err := kernel.Write(msg); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	ctx, op, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	op.(*fuseops.GetInodeAttributesOp).Attributes.Size = 17
+	if err := c.Reply(ctx, nil); err != nil {
+		t.Fatalf("Reply: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	if h.Unique != 1 || h.Error != 0 || int(h.Len) != n {
+		t.Errorf("Unexpected header: %+v (read %d)", *h, n)
+	}
+
+	out := (*fusekernel.AttrOut)(unsafe.Pointer(&buf[unsafe.Sizeof(*h)]))
+	if out.Attr.Size != 17 {
+		t.Errorf("Size: %d", out.Attr.Size)
+	}
+
+	// Errors too.
+	if _, err := kernel.Write(msg); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	ctx, _, err = c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	if err := c.Reply(ctx, syscall.ENOENT); err != nil {
+		t.Fatalf("Reply: %v", err)
+	}
+
+	if _, err := kernel.Read(buf); err != nil || h.Error != -int32(syscall.ENOENT) {
+		t.Errorf("Error reply: %+v, %v", *h, err)
+	}
+}
+
+func TestReadOpRejectsMalformed(t *testing.T) {
+	var logs bytes.Buffer
+	c, kernel, _ := initWithKernelSocket(t, MountConfig{}, 0, 0)
+	c.logger = NewLevelLogger(log.New(&logs, "", 0), LogError)
+
+	// A lookup whose name isn't NUL-terminated, a forget too short to hold
+	// its count, and then a well-formed request.
+	msgs := [][]byte{
+		rawMessageID(5, fusekernel.OpLookup, []byte("foo")),
+		rawMessageID(6, fusekernel.OpForget, []byte{1}),
+		rawMessageID(7, fusekernel.OpGetattr, make([]byte, unsafe.Sizeof(fusekernel.GetattrIn{}))),
+	}
+
+	for _, m := range msgs {
+		if _, err := kernel.Write(m); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// The malformed requests are skipped.
+	ctx, op, err := c.ReadOp()
+	if err != nil {
+		t.Fatalf("ReadOp: %v", err)
+	}
+
+	if _, ok := op.(*fuseops.GetInodeAttributesOp); !ok {
+		t.Fatalf("Got %#v", op)
+	}
+
+	c.Reply(ctx, nil)
+
+	// The lookup was failed with EIO, and the forget, which expects no reply,
+	// got none.
+	buf := make([]byte, 4096)
+	for _, want := range []struct {
+		unique uint64
+		errno  int32
+	}{{5, -int32(syscall.EIO)}, {7, 0}} {
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+		if n < int(unsafe.Sizeof(*h)) || h.Unique != want.unique || h.Error != want.errno {
+			t.Errorf("Reply %x, want unique %d with error %d", buf[:n], want.unique, want.errno)
+		}
+	}
+
+	if !bytes.Contains(logs.Bytes(), []byte("Malformed request 5")) {
+		t.Errorf("Logs: %q", logs.String())
+	}
+}
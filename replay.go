@@ -0,0 +1,188 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Write a message read from the kernel to MountConfig.RecordOps.
+func (c *Connection) record(m *buffer.InMessage) {
+	c.recordMu.Lock()
+	defer c.recordMu.Unlock()
+
+	if c.recordErr != nil {
+		return
+	}
+
+	if _, err := c.cfg.RecordOps.Write(m.Bytes()); err != nil {
+		c.recordErr = err
+		c.logger.Errorf(LogDispatch, "Recording ops stopped: %v", err)
+	}
+}
+
+// Replay feeds the messages recorded with MountConfig.RecordOps to the server
+// as if they came from the kernel, for reproducing a problem or benchmarking
+// deterministically without mounting anything. To replay into a
+// fuseutil.FileSystem, pass fuseutil.NewFileSystemServer(fs). Replies are
+// discarded. Linux only.
+//
+// The recording must start at the connection's init request, and config
+// should match the one it was recorded with. Each request is answered before
+// the next is sent, except for requests that go on to be interrupted in the
+// recording, which may only finish once they are. Replay returns once the
+// recording is used up and the server has returned, with the error that
+// MountedFileSystem.Join would give.
+func Replay(r io.Reader, server Server, config *MountConfig) error {
+	msgs, err := readRecording(r)
+	if err != nil {
+		return err
+	}
+
+	kernel, dev, err := newDevicePair()
+	if err != nil {
+		return err
+	}
+
+	defer kernel.Close()
+
+	cfgCopy := *config
+	cfgCopy.RecordOps = nil
+	if cfgCopy.OpContext == nil {
+		cfgCopy.OpContext = context.Background()
+	}
+
+	fed := make(chan error, 1)
+	go func() {
+		fed <- feedRecording(kernel, msgs)
+	}()
+
+	c, err := newConnection(cfgCopy, cfgCopy.logger(), dev)
+	if err != nil {
+		kernel.Close()
+		<-fed
+		return fmt.Errorf("newConnection: %w", err)
+	}
+
+	server.ServeOps(c)
+	joinErr := c.close()
+
+	if err := <-fed; err != nil {
+		return err
+	}
+
+	return joinErr
+}
+
+// Split a recording into its messages.
+func readRecording(r io.Reader) ([][]byte, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading recording: %w", err)
+	}
+
+	const hdrSize = int(unsafe.Sizeof(fusekernel.InHeader{}))
+
+	var msgs [][]byte
+	for len(b) > 0 {
+		if len(b) < hdrSize {
+			return nil, fmt.Errorf("truncated recording: %d bytes left", len(b))
+		}
+
+		n := int((*fusekernel.InHeader)(unsafe.Pointer(&b[0])).Len)
+		if n < hdrSize || n > len(b) {
+			return nil, fmt.Errorf("message %d: bad length %d", len(msgs), n)
+		}
+
+		msgs = append(msgs, b[:n:n])
+		b = b[n:]
+	}
+
+	return msgs, nil
+}
+
+// Play the part of the kernel: send each message through the supplied end of
+// the device, waiting for the reply to each before sending the next (see
+// Replay), then hang up and drain whatever else is written.
+func feedRecording(kernel *os.File, msgs [][]byte) error {
+	const hdrSize = int(unsafe.Sizeof(fusekernel.InHeader{}))
+
+	header := func(b []byte) *fusekernel.InHeader {
+		return (*fusekernel.InHeader)(unsafe.Pointer(&b[0]))
+	}
+
+	// Requests that the recording goes on to interrupt.
+	interrupted := make(map[uint64]bool)
+	for _, m := range msgs {
+		if header(m).Opcode == fusekernel.OpInterrupt &&
+			len(m) >= hdrSize+int(unsafe.Sizeof(fusekernel.InterruptIn{})) {
+			in := (*fusekernel.InterruptIn)(unsafe.Pointer(&m[hdrSize]))
+			interrupted[in.Unique] = true
+		}
+	}
+
+	buf := make([]byte, buffer.MaxReadSize+os.Getpagesize())
+	var feedErr error
+	for i, m := range msgs {
+		if err := writeMessage(kernel, m); err != nil {
+			feedErr = fmt.Errorf("message %d: %w", i, err)
+			break
+		}
+
+		h := header(m)
+		switch h.Opcode {
+		case fusekernel.OpForget,
+			fusekernel.OpBatchForget,
+			fusekernel.OpInterrupt,
+			fusekernel.OpNotifyReply:
+			continue
+		}
+
+		if interrupted[h.Unique] {
+			continue
+		}
+
+		// Wait for the reply, skipping notifications and replies to
+		// interrupted requests.
+		for {
+			n, err := kernel.Read(buf)
+			if err != nil {
+				return fmt.Errorf("awaiting reply to message %d: %w", i, err)
+			}
+
+			if n >= int(unsafe.Sizeof(fusekernel.OutHeader{})) &&
+				(*fusekernel.OutHeader)(unsafe.Pointer(&buf[0])).Unique == h.Unique {
+				break
+			}
+		}
+	}
+
+	// Hang up, so that the connection sees EOF, and drain until it is closed.
+	hangUp(kernel)
+	for {
+		if _, err := kernel.Read(buf); err != nil {
+			break
+		}
+	}
+
+	return feedErr
+}
@@ -0,0 +1,120 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Like rawMessage, with the given unique ID.
+func rawMessageID(unique uint64, opcode uint32, payload ...[]byte) []byte {
+	b := rawMessage(opcode, payload...)
+	(*fusekernel.InHeader)(unsafe.Pointer(&b[0])).Unique = unique
+	return b
+}
+
+// A server that answers every op with success, noting their types.
+type opTypeServer struct {
+	types []string
+}
+
+func (s *opTypeServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		s.types = append(s.types, fmt.Sprintf("%T", op))
+		c.Reply(ctx, nil)
+	}
+}
+
+func TestRecordOps(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+	defer dev.Close()
+
+	var recording bytes.Buffer
+	c := &Connection{
+		cfg:    MountConfig{RecordOps: &recording},
+		logger: NewLevelLogger(log.New(&bytes.Buffer{}, "", 0), LogError),
+		dev:    dev,
+	}
+
+	msgs := [][]byte{
+		rawMessageID(1, fusekernel.OpGetattr, make([]byte, 16)),
+		rawMessageID(2, fusekernel.OpForget, wireBytes(fusekernel.ForgetIn{Nlookup: 1})),
+	}
+
+	var want []byte
+	for _, m := range msgs {
+		if _, err := kernel.Write(m); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		if _, err := c.readMessageFrom(dev); err != nil {
+			t.Fatalf("readMessageFrom: %v", err)
+		}
+
+		want = append(want, m...)
+	}
+
+	if !bytes.Equal(recording.Bytes(), want) {
+		t.Errorf("Recorded %x, want %x", recording.Bytes(), want)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	initIn := wireBytes(fusekernel.InitIn{
+		Major:        fusekernel.ProtoVersionMaxMajor,
+		Minor:        fusekernel.ProtoVersionMaxMinor,
+		MaxReadahead: 1 << 17,
+	})
+
+	var recording []byte
+	for _, m := range [][]byte{
+		rawMessageID(1, fusekernel.OpInit, initIn),
+		rawMessageID(2, fusekernel.OpGetattr, make([]byte, 16)),
+		rawMessageID(3, fusekernel.OpForget, wireBytes(fusekernel.ForgetIn{Nlookup: 1})),
+		rawMessageID(4, fusekernel.OpGetattr, make([]byte, 16)),
+	} {
+		recording = append(recording, m...)
+	}
+
+	server := &opTypeServer{}
+	cfg := &MountConfig{OpContext: context.Background()}
+	if err := Replay(bytes.NewReader(recording), server, cfg); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	// Init is handled by the connection itself.
+	want := []string{
+		"*fuseops.GetInodeAttributesOp",
+		"*fuseops.ForgetInodeOp",
+		"*fuseops.GetInodeAttributesOp",
+	}
+
+	if !reflect.DeepEqual(server.types, want) {
+		t.Errorf("Ops: %v, want %v", server.types, want)
+	}
+
+	// A truncated recording is rejected up front.
+	if err := Replay(bytes.NewReader(recording[:len(recording)-1]), &opTypeServer{}, cfg); err == nil {
+		t.Error("Replayed a truncated recording")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// ConnectionState is what a connection agreed with the kernel when it was
+// initialized. The kernel initializes a connection only once, so a daemon
+// taking over a mount from a previous one needs this to carry on where it
+// left off (see MountConfig.ResumeState). It is plain data, suitable for
+// encoding with encoding/json.
+type ConnectionState struct {
+	ProtocolMajor uint32
+	ProtocolMinor uint32
+	MaxWrite      uint32
+	MaxReadahead  uint32
+	Features      Features
+}
+
+// State returns the state that a daemon taking over the connection needs, for
+// saving alongside the file system's own state (cf. fuseutil.InodeTable's
+// Snapshot) when upgrading in place or to recover from a crash.
+func (c *Connection) State() ConnectionState {
+	return ConnectionState{
+		ProtocolMajor: c.protocol.Major,
+		ProtocolMinor: c.protocol.Minor,
+		MaxWrite:      c.maxWrite,
+		MaxReadahead:  c.maxReadahead,
+		Features:      c.features,
+	}
+}
+
+// Take on the state of a connection initialized by a previous daemon, in place
+// of Init.
+func (c *Connection) resume(s *ConnectionState) error {
+	p := fusekernel.Protocol{Major: s.ProtocolMajor, Minor: s.ProtocolMinor}
+	min := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMinMajor,
+		Minor: fusekernel.ProtoVersionMinMinor,
+	}
+
+	if p.LT(min) {
+		return fmt.Errorf("%w: %v", ErrKernelTooOld, p)
+	}
+
+	// Our buffers must hold the largest write the kernel was told to send.
+	if uint32(c.cfg.maxWrite()) < s.MaxWrite {
+		return fmt.Errorf(
+			"MaxWrite %d is smaller than the connection's %d",
+			c.cfg.maxWrite(),
+			s.MaxWrite)
+	}
+
+	c.protocol = p
+	c.maxWrite = s.MaxWrite
+	c.maxReadahead = s.MaxReadahead
+	c.features = s.Features
+
+	// Have the kernel send again the requests that the previous daemon read
+	// but didn't answer (Linux >= 6.9). Older kernels don't know the
+	// notification; those requests are then never answered.
+	err := c.notify(fusekernel.NotifyCodeResend)
+	if errors.Is(err, syscall.EINVAL) {
+		c.logger.Errorf(LogMount, "Resuming: the kernel can't resend unanswered requests")
+		err = nil
+	}
+
+	return err
+}
@@ -0,0 +1,70 @@
+package fuse
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestResume(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	old := &Connection{
+		protocol:     fusekernel.Protocol{Major: 7, Minor: 31},
+		maxWrite:     128 << 10,
+		maxReadahead: 1 << 20,
+		features:     Features{AsyncReads: true, Readdirplus: true},
+	}
+
+	// Through JSON, as it would be saved.
+	b, err := json.Marshal(old.State())
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var s ConnectionState
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	c := &Connection{dev: w}
+	if err := c.resume(&s); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+
+	if c.State() != old.State() {
+		t.Errorf("State = %+v, want %+v", c.State(), old.State())
+	}
+
+	// The kernel is asked to resend unanswered requests.
+	buf := make([]byte, 1024)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	if h.Unique != 0 || h.Error != fusekernel.NotifyCodeResend || int(h.Len) != n || n != int(unsafe.Sizeof(*h)) {
+		t.Errorf("Unexpected notification: %+v", *h)
+	}
+
+	// Our buffers must be big enough for the writes the kernel may send.
+	c = &Connection{dev: w, cfg: MountConfig{MaxWrite: 64 << 10}}
+	if err := c.resume(&s); err == nil {
+		t.Error("Resumed with too small a MaxWrite")
+	}
+
+	s.ProtocolMinor = 11
+	if err := (&Connection{dev: w}).resume(&s); !errors.Is(err, ErrKernelTooOld) {
+		t.Errorf("resume: got %v, want ErrKernelTooOld", err)
+	}
+}
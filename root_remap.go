@@ -0,0 +1,114 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"reflect"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Support for MountConfig.RootInode. The translation between the kernel's
+// inode IDs and the file system's swaps fuseops.RootInodeID with the
+// configured root and leaves all other IDs alone. A swap is its own inverse, so
+// the same function translates in both directions, and no ID of the file
+// system's is lost: its own inode 1, if it has one, is shown to the kernel
+// under the configured root's ID.
+
+var inodeIDType = reflect.TypeOf(fuseops.InodeID(0))
+
+func swapRoot(id, root fuseops.InodeID) fuseops.InodeID {
+	switch id {
+	case fuseops.RootInodeID:
+		return root
+	case root:
+		return fuseops.RootInodeID
+	}
+
+	return id
+}
+
+// Translate a single inode ID of the file system's to the kernel's, e.g. for
+// use in a notification.
+func (c *Connection) kernelInodeID(id fuseops.InodeID) fuseops.InodeID {
+	root := c.cfg.RootInode
+	if root == 0 {
+		return id
+	}
+
+	return swapRoot(id, root)
+}
+
+// Translate every inode ID found in the supplied op, including those in
+// nested entries such as ChildInodeEntry.Child and BatchForgetOp.Entries, and
+// those written into a ReadDirOp's destination buffer. Does nothing if no
+// root is configured.
+func (c *Connection) remapInodes(op interface{}) {
+	root := c.cfg.RootInode
+	if root == 0 || root == fuseops.RootInodeID {
+		return
+	}
+
+	v := reflect.ValueOf(op)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+
+	remapValue(v.Elem(), root)
+
+	if o, ok := op.(*fuseops.ReadDirOp); ok && o.BytesRead <= len(o.Dst) {
+		remapDirents(o.Dst[:o.BytesRead], root)
+	}
+}
+
+func remapValue(v reflect.Value, root fuseops.InodeID) {
+	switch {
+	case v.Type() == inodeIDType:
+		if v.CanSet() {
+			v.SetUint(uint64(swapRoot(fuseops.InodeID(v.Uint()), root)))
+		}
+
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			remapValue(v.Field(i), root)
+		}
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		for i := 0; i < v.Len(); i++ {
+			remapValue(v.Index(i), root)
+		}
+	}
+}
+
+// Translate the inode IDs in a buffer of entries written by
+// fuseutil.WriteDirent. Stops at the first malformed entry.
+func remapDirents(buf []byte, root fuseops.InodeID) {
+	const direntAlignment = 8
+
+	for len(buf) >= fusekernel.DirentSize {
+		de := (*fusekernel.Dirent)(unsafe.Pointer(&buf[0]))
+		de.Ino = uint64(swapRoot(fuseops.InodeID(de.Ino), root))
+
+		size := fusekernel.DirentSize + int(de.Namelen)
+		size = (size + direntAlignment - 1) &^ (direntAlignment - 1)
+		if size > len(buf) {
+			return
+		}
+
+		buf = buf[size:]
+	}
+}
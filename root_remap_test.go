@@ -0,0 +1,69 @@
+package fuse
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func Test_remapInodes(t *testing.T) {
+	c := &Connection{cfg: MountConfig{RootInode: 7}}
+
+	lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo"}
+	c.remapInodes(lookUp)
+	if lookUp.Parent != 7 {
+		t.Errorf("Parent = %v, want 7", lookUp.Parent)
+	}
+
+	// The file system's own inode 1 shows up under the root's old ID.
+	lookUp.Entry.Child = fuseops.RootInodeID
+	c.remapInodes(lookUp)
+	if lookUp.Parent != fuseops.RootInodeID || lookUp.Entry.Child != 7 {
+		t.Errorf("Parent, Child = %v, %v, want 1, 7", lookUp.Parent, lookUp.Entry.Child)
+	}
+
+	forget := &fuseops.BatchForgetOp{
+		Entries: []fuseops.BatchForgetEntry{{Inode: 7, N: 1}, {Inode: 9, N: 1}},
+	}
+	c.remapInodes(forget)
+	if forget.Entries[0].Inode != 1 || forget.Entries[1].Inode != 9 {
+		t.Errorf("Entries = %v", forget.Entries)
+	}
+}
+
+func Test_remapInodesReadDirPlus(t *testing.T) {
+	c := &Connection{cfg: MountConfig{RootInode: 7}}
+
+	op := &fuseops.ReadDirPlusOp{
+		Inode: fuseops.RootInodeID,
+		Entries: []fuseops.DirentPlus{
+			{Name: ".", Entry: fuseops.ChildInodeEntry{Child: 7}},
+			{Name: "foo", Entry: fuseops.ChildInodeEntry{Child: 9}},
+		},
+	}
+
+	c.remapInodes(op)
+	if op.Inode != 7 || op.Entries[0].Entry.Child != 1 || op.Entries[1].Entry.Child != 9 {
+		t.Errorf("Inode, Entries = %v, %+v", op.Inode, op.Entries)
+	}
+}
+
+func Test_remapDirents(t *testing.T) {
+	var buf [2 * (fusekernel.DirentSize + 8)]byte
+	for i, ino := range []uint64{7, 9} {
+		de := (*fusekernel.Dirent)(unsafe.Pointer(&buf[i*(fusekernel.DirentSize+8)]))
+		de.Ino = ino
+		de.Namelen = 3
+	}
+
+	remapDirents(buf[:], 7)
+
+	for i, want := range []uint64{1, 9} {
+		de := (*fusekernel.Dirent)(unsafe.Pointer(&buf[i*(fusekernel.DirentSize+8)]))
+		if de.Ino != want {
+			t.Errorf("entry %d: Ino = %d, want %d", i, de.Ino, want)
+		}
+	}
+}
@@ -1,3 +1,6 @@
+//go:build !windows
+// +build !windows
+
 package dynamicfs_test
 
 import (
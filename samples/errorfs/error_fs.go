@@ -19,7 +19,6 @@ import (
 	"fmt"
 	"os"
 	"reflect"
-	"sync"
 	"syscall"
 
 	"github.com/jacobsa/fuse/fuseops"
@@ -50,55 +49,30 @@ type FS interface {
 }
 
 func New() (FS, error) {
-	return &errorFS{
-		errors: make(map[reflect.Type]syscall.Errno),
-	}, nil
+	return &faultyFS{fuseutil.NewFaultInjectingFileSystem(&errorFS{})}, nil
 }
 
-type errorFS struct {
-	fuseutil.NotImplementedFileSystem
-
-	mu sync.Mutex
-
-	// GUARDED_BY(mu)
-	errors map[reflect.Type]syscall.Errno
+// Implements SetError in terms of the faults of a
+// fuseutil.FaultInjectingFileSystem.
+type faultyFS struct {
+	*fuseutil.FaultInjectingFileSystem
 }
 
-// LOCKS_EXCLUDED(fs.mu)
-func (fs *errorFS) SetError(t reflect.Type, err syscall.Errno) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	fs.errors[t] = err
+func (fs *faultyFS) SetError(t reflect.Type, err syscall.Errno) {
+	fs.SetFault(reflect.Zero(t).Interface(), fuseutil.Fault{Err: err})
 }
 
-// LOCKS_EXCLUDED(fs.mu)
-func (fs *errorFS) transformError(op interface{}, err *error) bool {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	cannedErr, ok := fs.errors[reflect.TypeOf(op)]
-	if ok {
-		*err = cannedErr
-		return true
-	}
-
-	return false
+type errorFS struct {
+	fuseutil.NotImplementedFileSystem
 }
 
 ////////////////////////////////////////////////////////////////////////
 // File system methods
 ////////////////////////////////////////////////////////////////////////
 
-// LOCKS_EXCLUDED(fs.mu)
 func (fs *errorFS) GetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.GetInodeAttributesOp) error {
-	var err error
-	if fs.transformError(op, &err) {
-		return err
-	}
-
 	// Figure out which inode the request is for.
 	switch {
 	case op.Inode == fuseops.RootInodeID:
@@ -122,15 +96,9 @@ func (fs *errorFS) StatFS(
 	return nil
 }
 
-// LOCKS_EXCLUDED(fs.mu)
 func (fs *errorFS) LookUpInode(
 	ctx context.Context,
 	op *fuseops.LookUpInodeOp) error {
-	var err error
-	if fs.transformError(op, &err) {
-		return err
-	}
-
 	// Is this a known inode?
 	if !(op.Parent == fuseops.RootInodeID && op.Name == "foo") {
 		return syscall.ENOENT
@@ -142,15 +110,9 @@ func (fs *errorFS) LookUpInode(
 	return nil
 }
 
-// LOCKS_EXCLUDED(fs.mu)
 func (fs *errorFS) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) error {
-	var err error
-	if fs.transformError(op, &err) {
-		return err
-	}
-
 	if op.Inode != fooInodeID {
 		return fmt.Errorf("Unsupported inode ID: %d", op.Inode)
 	}
@@ -158,15 +120,9 @@ func (fs *errorFS) OpenFile(
 	return nil
 }
 
-// LOCKS_EXCLUDED(fs.mu)
 func (fs *errorFS) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) error {
-	var err error
-	if fs.transformError(op, &err) {
-		return err
-	}
-
 	if op.Inode != fooInodeID || op.Offset != 0 {
 		return fmt.Errorf("Unexpected request: %#v", op)
 	}
@@ -176,15 +132,9 @@ func (fs *errorFS) ReadFile(
 	return nil
 }
 
-// LOCKS_EXCLUDED(fs.mu)
 func (fs *errorFS) OpenDir(
 	ctx context.Context,
 	op *fuseops.OpenDirOp) error {
-	var err error
-	if fs.transformError(op, &err) {
-		return err
-	}
-
 	if op.Inode != fuseops.RootInodeID {
 		return fmt.Errorf("Unsupported inode ID: %d", op.Inode)
 	}
@@ -192,15 +142,9 @@ func (fs *errorFS) OpenDir(
 	return nil
 }
 
-// LOCKS_EXCLUDED(fs.mu)
 func (fs *errorFS) ReadDir(
 	ctx context.Context,
 	op *fuseops.ReadDirOp) error {
-	var err error
-	if fs.transformError(op, &err) {
-		return err
-	}
-
 	if op.Inode != fuseops.RootInodeID || op.Offset != 0 {
 		return fmt.Errorf("Unexpected request: %#v", op)
 	}
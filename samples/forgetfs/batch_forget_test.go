@@ -0,0 +1,83 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forgetfs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestBatchForget(t *testing.T) {
+	ctx := context.Background()
+	fs := NewFileSystem().impl
+
+	// Create two files, and look up foo a couple of times.
+	var ids []fuseops.InodeID
+	for _, name := range []string{"a", "b"} {
+		op := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: name}
+		if err := fs.CreateFile(ctx, op); err != nil {
+			t.Fatalf("CreateFile: %v", err)
+		}
+		ids = append(ids, op.Entry.Child)
+	}
+
+	for i := 0; i < 2; i++ {
+		op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo"}
+		if err := fs.LookUpInode(ctx, op); err != nil {
+			t.Fatalf("LookUpInode: %v", err)
+		}
+	}
+
+	// Forget everything in one batch, with foo split across two entries.
+	err := fs.BatchForget(ctx, &fuseops.BatchForgetOp{
+		Entries: []fuseops.BatchForgetEntry{
+			{Inode: ids[0], N: 1},
+			{Inode: cannedID_Foo, N: 1},
+			{Inode: ids[1], N: 1},
+			{Inode: cannedID_Foo, N: 1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("BatchForget: %v", err)
+	}
+
+	for _, id := range ids {
+		if in := fs.inodes[id]; !in.Forgotten() {
+			t.Errorf("Inode %v has lookup count %v", id, in.lookupCount)
+		}
+	}
+
+	// Only the count held by the file system itself should remain.
+	if n := fs.inodes[cannedID_Foo].lookupCount; n != 1 {
+		t.Errorf("foo: got lookup count %v, want 1", n)
+	}
+
+	// Forgetting more than was looked up should panic, whether or not it is
+	// split across entries.
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for an overly large decrement")
+		}
+	}()
+
+	fs.BatchForget(ctx, &fuseops.BatchForgetOp{
+		Entries: []fuseops.BatchForgetEntry{
+			{Inode: cannedID_Bar, N: 1},
+			{Inode: cannedID_Bar, N: 1},
+		},
+	})
+}
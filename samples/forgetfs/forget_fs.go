@@ -290,6 +290,22 @@ func (fs *fsImpl) ForgetInode(
 	return nil
 }
 
+func (fs *fsImpl) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Decrement the count for each entry in turn. An inode may appear more than
+	// once in the batch.
+	for _, e := range op.Entries {
+		in := fs.findInodeByID(e.Inode)
+		in.DecrementLookupCount(e.N)
+	}
+
+	return nil
+}
+
 func (fs *fsImpl) MkDir(
 	ctx context.Context,
 	op *fuseops.MkDirOp) error {
@@ -0,0 +1,711 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+// Package loopbackfs implements a read-write file system that mirrors a
+// directory on the host, forwarding each op to the corresponding system call.
+// It is the usual baseline for running file system test suites such as
+// xfstests against this package, and a starting point for file systems that
+// layer behaviour over a local directory.
+package loopbackfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"golang.org/x/sys/unix"
+)
+
+// NewLoopbackFileSystem returns a file system serving the contents of the
+// directory at root, read-write.
+//
+// Inodes are identified by their device and inode numbers on the host, so
+// hard links are recognized as such. Ops are forwarded by path, so changes
+// made to the directory other than through the mount are seen, but renames
+// made that way can leave inodes the kernel already knows about unreachable
+// until it looks them up again.
+func NewLoopbackFileSystem(root string) (fuseutil.FileSystem, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return nil, &os.PathError{Op: "loopback", Path: root, Err: syscall.ENOTDIR}
+	}
+
+	fs := &loopbackFS{
+		root:      root,
+		entries:   fuseutil.NewEntryMap(),
+		handles:   fuseutil.NewHandleTable(),
+		ids:       make(map[hostInode]fuseops.InodeID),
+		keys:      make(map[fuseops.InodeID]hostInode),
+		nextInode: fuseops.RootInodeID + 1,
+	}
+
+	return fs, nil
+}
+
+// The identity of a file on the host.
+type hostInode struct {
+	dev uint64
+	ino uint64
+}
+
+type loopbackFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	root    string
+	entries *fuseutil.EntryMap
+	handles *fuseutil.HandleTable
+
+	// Held while assigning IDs and forgetting inodes, so that an ID isn't
+	// dropped between being found in ids and having its lookup recorded.
+	mu sync.Mutex
+
+	// The ID assigned to each host inode the kernel knows about, and the
+	// reverse.
+	//
+	// INVARIANT: For each k, v in ids, keys[v] == k
+	// INVARIANT: len(ids) == len(keys)
+	//
+	// GUARDED_BY(mu)
+	ids  map[hostInode]fuseops.InodeID
+	keys map[fuseops.InodeID]hostInode
+
+	// GUARDED_BY(mu)
+	nextInode fuseops.InodeID
+}
+
+// An open directory: its host path, and its entries as of when it was
+// opened.
+type dirHandle struct {
+	path    string
+	entries []os.DirEntry
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Translate an error from the os package into one for the kernel.
+func convertError(err error) error {
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return nil
+
+	case errors.As(err, &errno):
+		return errno
+	}
+
+	return fuse.WrapError(fuse.EIO, err, "loopback")
+}
+
+// Return the host path of the supplied inode.
+func (fs *loopbackFS) pathOf(id fuseops.InodeID) (string, error) {
+	p, ok := fs.entries.Path(id)
+	if !ok {
+		return "", fuse.ENOENT
+	}
+
+	return filepath.Join(fs.root, filepath.FromSlash(p)), nil
+}
+
+func (fs *loopbackFS) childPath(
+	parent fuseops.InodeID,
+	name string) (string, error) {
+	p, err := fs.pathOf(parent)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(p, name), nil
+}
+
+func lstat(p string) (*syscall.Stat_t, error) {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return fi.Sys().(*syscall.Stat_t), nil
+}
+
+func attributes(p string) (fuseops.InodeAttributes, error) {
+	st, err := lstat(p)
+	if err != nil {
+		return fuseops.InodeAttributes{}, err
+	}
+
+	return fuseutil.AttributesFromStat(st), nil
+}
+
+// Fill in a ChildInodeEntry for the file at p, which has the supplied name
+// within parent, recording the lookup.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *loopbackFS) lookedUp(
+	parent fuseops.InodeID,
+	name string,
+	p string,
+	e *fuseops.ChildInodeEntry) error {
+	st, err := lstat(p)
+	if err != nil {
+		return err
+	}
+
+	key := hostInode{uint64(st.Dev), uint64(st.Ino)}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id, ok := fs.ids[key]
+	if !ok {
+		id = fs.nextInode
+		fs.nextInode++
+		fs.ids[key] = id
+		fs.keys[id] = key
+	}
+
+	fs.entries.LookedUp(parent, name, id)
+	e.Child = id
+	e.Attributes = fuseutil.AttributesFromStat(st)
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *loopbackFS) forget(id fuseops.InodeID, n uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.entries.Forget(id, n) {
+		delete(fs.ids, fs.keys[id])
+		delete(fs.keys, id)
+	}
+}
+
+func (fs *loopbackFS) file(id fuseops.HandleID) (*os.File, error) {
+	h, _ := fs.handles.Get(id)
+	f, ok := h.(*os.File)
+	if !ok {
+		return nil, fuse.EINVAL
+	}
+
+	return f, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *loopbackFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return convertError(statFS(fs.root, op))
+}
+
+func (fs *loopbackFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	return fs.lookedUp(op.Parent, op.Name, p, &op.Entry)
+}
+
+func (fs *loopbackFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes, err = attributes(p)
+	return err
+}
+
+func (fs *loopbackFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if op.Size != nil {
+		var f *os.File
+		if op.Handle != nil {
+			f, _ = fs.file(*op.Handle)
+		}
+
+		if f != nil {
+			err = f.Truncate(int64(*op.Size))
+		} else {
+			err = os.Truncate(p, int64(*op.Size))
+		}
+
+		if err != nil {
+			return convertError(err)
+		}
+	}
+
+	if op.Mode != nil {
+		if err := os.Chmod(p, *op.Mode); err != nil {
+			return convertError(err)
+		}
+	}
+
+	if op.Uid != nil || op.Gid != nil {
+		uid, gid := -1, -1
+		if op.Uid != nil {
+			uid = int(*op.Uid)
+		}
+		if op.Gid != nil {
+			gid = int(*op.Gid)
+		}
+
+		if err := os.Lchown(p, uid, gid); err != nil {
+			return convertError(err)
+		}
+	}
+
+	if op.Atime != nil || op.Mtime != nil {
+		// Fill in whichever time wasn't supplied.
+		attrs, err := attributes(p)
+		if err != nil {
+			return err
+		}
+
+		atime, mtime := attrs.Atime, attrs.Mtime
+		if op.Atime != nil {
+			atime = *op.Atime
+		}
+		if op.Mtime != nil {
+			mtime = *op.Mtime
+		}
+
+		ts := []unix.Timespec{
+			unix.NsecToTimespec(atime.UnixNano()),
+			unix.NsecToTimespec(mtime.UnixNano()),
+		}
+
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return convertError(err)
+		}
+	}
+
+	op.Attributes, err = attributes(p)
+	return err
+}
+
+func (fs *loopbackFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.forget(op.Inode, op.N)
+	return nil
+}
+
+func (fs *loopbackFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.forget(e.Inode, e.N)
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(p, op.Mode.Perm()); err != nil {
+		return convertError(err)
+	}
+
+	return fs.lookedUp(op.Parent, op.Name, p, &op.Entry)
+}
+
+func (fs *loopbackFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Mknod(p, fuse.ConvertGoMode(op.Mode), int(op.Rdev)); err != nil {
+		return convertError(err)
+	}
+
+	return fs.lookedUp(op.Parent, op.Name, p, &op.Entry)
+}
+
+func (fs *loopbackFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	// The kernel supplies the offset of every write, even in append mode.
+	flags := int(op.OpenFlags)&^os.O_APPEND | os.O_CREATE | os.O_EXCL
+	f, err := os.OpenFile(p, flags, op.Mode.Perm())
+	if err != nil {
+		return convertError(err)
+	}
+
+	if err := fs.lookedUp(op.Parent, op.Name, p, &op.Entry); err != nil {
+		f.Close()
+		return err
+	}
+
+	op.Handle = fs.handles.Add(f)
+	return nil
+}
+
+func (fs *loopbackFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Symlink(op.Target, p); err != nil {
+		return convertError(err)
+	}
+
+	return fs.lookedUp(op.Parent, op.Name, p, &op.Entry)
+}
+
+func (fs *loopbackFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	target, err := fs.pathOf(op.Target)
+	if err != nil {
+		return err
+	}
+
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Link(target, p); err != nil {
+		return convertError(err)
+	}
+
+	return fs.lookedUp(op.Parent, op.Name, p, &op.Entry)
+}
+
+func (fs *loopbackFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Target, err = os.Readlink(p)
+	return convertError(err)
+}
+
+func (fs *loopbackFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	oldPath, err := fs.childPath(op.OldParent, op.OldName)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := fs.childPath(op.NewParent, op.NewName)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return convertError(err)
+	}
+
+	fs.entries.Rename(op.OldParent, op.OldName, op.NewParent, op.NewName)
+	return nil
+}
+
+func (fs *loopbackFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Rmdir(p); err != nil {
+		return convertError(err)
+	}
+
+	fs.entries.Unlink(op.Parent, op.Name)
+	return nil
+}
+
+func (fs *loopbackFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Unlink(p); err != nil {
+		return convertError(err)
+	}
+
+	fs.entries.Unlink(op.Parent, op.Name)
+	return nil
+}
+
+func (fs *loopbackFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	// Snapshot the listing, so that offsets stay meaningful for the life of
+	// the handle.
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return convertError(err)
+	}
+
+	op.Handle = fs.handles.Add(&dirHandle{path: p, entries: entries})
+	return nil
+}
+
+func (fs *loopbackFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	h, _ := fs.handles.Get(op.Handle)
+	d, ok := h.(*dirHandle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	for i := int(op.Offset); i < len(d.entries); i++ {
+		e := d.entries[i]
+
+		// Use the inode's ID if the kernel knows it. Otherwise any non-zero
+		// value will do, since the kernel ignores it.
+		id, ok := fs.entries.LookUp(op.Inode, e.Name())
+		if !ok {
+			id = fuseutil.HashInodeID(filepath.Join(d.path, e.Name()))
+		}
+
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  id,
+			Name:   e.Name(),
+			Type:   fuseutil.DirentTypeForMode(e.Type()),
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.handles.Release(op.Handle)
+	return nil
+}
+
+func (fs *loopbackFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, int(op.OpenFlags)&^os.O_APPEND, 0)
+	if err != nil {
+		return convertError(err)
+	}
+
+	op.Handle = fs.handles.Add(f)
+	return nil
+}
+
+func (fs *loopbackFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead, err = f.ReadAt(op.Dst, op.Offset)
+
+	// Short reads are how the kernel learns of EOF.
+	if err == io.EOF {
+		err = nil
+	}
+
+	return convertError(err)
+}
+
+func (fs *loopbackFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(op.Data, op.Offset)
+	return convertError(err)
+}
+
+func (fs *loopbackFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	return convertError(f.Sync())
+}
+
+func (fs *loopbackFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (fs *loopbackFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	if h, ok := fs.handles.Release(op.Handle); ok {
+		h.(*os.File).Close()
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	return convertError(fallocate(f, op.Mode, int64(op.Offset), int64(op.Length)))
+}
+
+func (fs *loopbackFS) LSeek(
+	ctx context.Context,
+	op *fuseops.LSeekOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	// Only the file system's own offset changes, and ReadAt and WriteAt don't
+	// use it.
+	op.ResultOffset, err = f.Seek(op.Offset, int(op.Whence))
+	return convertError(err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Extended attributes
+////////////////////////////////////////////////////////////////////////
+
+func (fs *loopbackFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead, err = unix.Lgetxattr(p, op.Name, op.Dst)
+	return convertError(err)
+}
+
+func (fs *loopbackFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead, err = unix.Llistxattr(p, op.Dst)
+	return convertError(err)
+}
+
+func (fs *loopbackFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	return convertError(unix.Lsetxattr(p, op.Name, op.Value, int(op.Flags)))
+}
+
+func (fs *loopbackFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	return convertError(unix.Lremovexattr(p, op.Name))
+}
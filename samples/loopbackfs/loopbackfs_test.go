@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package loopbackfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestLoopback(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	fs, err := NewLoopbackFileSystem(root)
+	if err != nil {
+		t.Fatalf("NewLoopbackFileSystem: %v", err)
+	}
+
+	mkdir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir", Mode: 0755}
+	if err := fs.MkDir(ctx, mkdir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	create := &fuseops.CreateFileOp{
+		Parent:    mkdir.Entry.Child,
+		Name:      "foo",
+		Mode:      0644,
+		OpenFlags: syscall.O_RDWR,
+	}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	write := &fuseops.WriteFileOp{Inode: create.Entry.Child, Handle: create.Handle, Data: []byte("taco")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if b, _ := os.ReadFile(filepath.Join(root, "dir", "foo")); string(b) != "taco" {
+		t.Errorf("Host contents: %q", b)
+	}
+
+	// A hard link is the same inode.
+	link := &fuseops.CreateLinkOp{Parent: fuseops.RootInodeID, Name: "link", Target: create.Entry.Child}
+	if err := fs.CreateLink(ctx, link); err != nil {
+		t.Fatalf("CreateLink: %v", err)
+	}
+
+	if link.Entry.Child != create.Entry.Child || link.Entry.Attributes.Nlink != 2 {
+		t.Errorf("Unexpected link entry: %+v", link.Entry)
+	}
+
+	// Renaming the directory keeps the file reachable once the link is gone.
+	unlink := &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "link"}
+	if err := fs.Unlink(ctx, unlink); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	rename := &fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "dir",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "renamed",
+	}
+	if err := fs.Rename(ctx, rename); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	getAttr := &fuseops.GetInodeAttributesOp{Inode: create.Entry.Child}
+	if err := fs.GetInodeAttributes(ctx, getAttr); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if getAttr.Attributes.Size != 4 || getAttr.Attributes.Nlink != 1 {
+		t.Errorf("Unexpected attributes: %+v", getAttr.Attributes)
+	}
+
+	// Errors from the host are passed through.
+	lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "dir"}
+	if err := fs.LookUpInode(ctx, lookUp); err != fuse.ENOENT {
+		t.Errorf("LookUpInode: got %v, want ENOENT", err)
+	}
+
+	// Symlinks aren't followed.
+	symlink := &fuseops.CreateSymlinkOp{Parent: fuseops.RootInodeID, Name: "sym", Target: "renamed/foo"}
+	if err := fs.CreateSymlink(ctx, symlink); err != nil {
+		t.Fatalf("CreateSymlink: %v", err)
+	}
+
+	readlink := &fuseops.ReadSymlinkOp{Inode: symlink.Entry.Child}
+	if err := fs.ReadSymlink(ctx, readlink); err != nil || readlink.Target != "renamed/foo" {
+		t.Errorf("ReadSymlink: %q, %v", readlink.Target, err)
+	}
+
+	if symlink.Entry.Attributes.Mode&os.ModeSymlink == 0 {
+		t.Errorf("Unexpected symlink mode: %v", symlink.Entry.Attributes.Mode)
+	}
+
+	release := &fuseops.ReleaseFileHandleOp{Handle: create.Handle}
+	if err := fs.ReleaseFileHandle(ctx, release); err != nil {
+		t.Fatalf("ReleaseFileHandle: %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package memfs
+
+import "golang.org/x/sys/unix"
+
+func major(dev uint64) uint32 {
+	return unix.Major(dev)
+}
+
+func minor(dev uint64) uint32 {
+	return unix.Minor(dev)
+}
+
+func mkdev(major, minor uint32) uint64 {
+	return unix.Mkdev(major, minor)
+}
@@ -0,0 +1,19 @@
+package memfs
+
+// Device numbers in the Linux encoding, which the WinFsp layer speaks (cf.
+// unix.Mkdev for linux).
+
+func major(dev uint64) uint32 {
+	return uint32((dev & 0x00000000000fff00) >> 8)
+}
+
+func minor(dev uint64) uint32 {
+	return uint32(dev&0x00000000000000ff) | uint32((dev&0x00000000fff00000)>>12)
+}
+
+func mkdev(major, minor uint32) uint64 {
+	dev := (uint64(major) & 0x00000fff) << 8
+	dev |= (uint64(minor) & 0x000000ff) << 0
+	dev |= (uint64(minor) & 0xffffff00) << 12
+	return dev
+}
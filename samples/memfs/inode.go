@@ -19,9 +19,9 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"syscall"
 	"time"
 
-	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 )
@@ -389,14 +389,35 @@ func (in *inode) SetAttributes(
 }
 
 func (in *inode) Fallocate(mode uint32, offset uint64, length uint64) error {
-	if mode != 0 {
-		return fuse.ENOSYS
+	keepSize := mode&fuseops.FallocateKeepSize != 0
+	zero := mode&(fuseops.FallocatePunchHole|fuseops.FallocateZeroRange) != 0
+	if mode&^(fuseops.FallocateKeepSize|fuseops.FallocatePunchHole|fuseops.FallocateZeroRange) != 0 {
+		return syscall.EOPNOTSUPP
 	}
-	newSize := int(offset + length)
-	if newSize > len(in.contents) {
-		padding := make([]byte, newSize-len(in.contents))
+
+	end := offset + length
+
+	// We have no notion of allocated but unused space, so if the file isn't to
+	// grow there is nothing to do beyond zeroing.
+	if zero {
+		zeroEnd := end
+		if zeroEnd > uint64(len(in.contents)) {
+			zeroEnd = uint64(len(in.contents))
+		}
+
+		if offset < zeroEnd {
+			b := in.contents[offset:zeroEnd]
+			for i := range b {
+				b[i] = 0
+			}
+		}
+	}
+
+	if !keepSize && end > uint64(len(in.contents)) {
+		padding := make([]byte, end-uint64(len(in.contents)))
 		in.contents = append(in.contents, padding...)
-		in.attrs.Size = offset + length
+		in.attrs.Size = end
 	}
+
 	return nil
 }
@@ -26,8 +26,8 @@ import (
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
 	"github.com/jacobsa/syncutil"
-	"golang.org/x/sys/unix"
 )
 
 const (
@@ -88,6 +88,15 @@ func NewMemFSWithCallbacks(
 	gid uint32,
 	readFileCallback func(),
 	writeFileCallback func()) fuse.Server {
+	return fuseutil.NewFileSystemServer(
+		newMemFS(uid, gid, readFileCallback, writeFileCallback))
+}
+
+func newMemFS(
+	uid uint32,
+	gid uint32,
+	readFileCallback func(),
+	writeFileCallback func()) *memFS {
 	// Set up the basic struct.
 	fs := &memFS{
 		inodes:            make([]*inode, fuseops.RootInodeID+1),
@@ -109,7 +118,7 @@ func NewMemFSWithCallbacks(
 	// Set up invariant checking.
 	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
 
-	return fuseutil.NewFileSystemServer(fs)
+	return fs
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -337,7 +346,7 @@ func (fs *memFS) MkNode(
 	defer fs.mu.Unlock()
 
 	var err error
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode, op.Rdev)
 	return err
 }
 
@@ -345,7 +354,8 @@ func (fs *memFS) MkNode(
 func (fs *memFS) createFile(
 	parentID fuseops.InodeID,
 	name string,
-	mode os.FileMode) (fuseops.ChildInodeEntry, error) {
+	mode os.FileMode,
+	rdev uint32) (fuseops.ChildInodeEntry, error) {
 	// Grab the parent, which we will update shortly.
 	parent := fs.getInodeOrDie(parentID)
 
@@ -361,6 +371,7 @@ func (fs *memFS) createFile(
 	childAttrs := fuseops.InodeAttributes{
 		Nlink:  1,
 		Mode:   mode,
+		Rdev:   rdev,
 		Atime:  now,
 		Mtime:  now,
 		Ctime:  now,
@@ -373,7 +384,7 @@ func (fs *memFS) createFile(
 	childID, child := fs.allocateInode(childAttrs, name)
 
 	// Add an entry in the parent.
-	parent.AddChild(childID, name, fuseutil.DT_File)
+	parent.AddChild(childID, name, fuseutil.DirentTypeForMode(mode))
 
 	// Fill in the response entry.
 	var entry fuseops.ChildInodeEntry
@@ -394,7 +405,7 @@ func (fs *memFS) CreateFile(
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode, 0)
 	return err
 }
 
@@ -493,6 +504,10 @@ func (fs *memFS) Rename(
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	if op.Flags&^(fuseops.RenameNoReplace|fuseops.RenameExchange) != 0 {
+		return fuse.EINVAL
+	}
+
 	// Ask the old parent for the child's inode ID and type.
 	oldParent := fs.getInodeOrDie(op.OldParent)
 	childID, childType, ok := oldParent.LookUpChild(op.OldName)
@@ -501,10 +516,28 @@ func (fs *memFS) Rename(
 		return fuse.ENOENT
 	}
 
+	newParent := fs.getInodeOrDie(op.NewParent)
+	existingID, existingType, ok := newParent.LookUpChild(op.NewName)
+
+	// An exchange swaps the two names, which must both exist.
+	if op.Flags&fuseops.RenameExchange != 0 {
+		if !ok {
+			return fuse.ENOENT
+		}
+
+		oldParent.RemoveChild(op.OldName)
+		newParent.RemoveChild(op.NewName)
+		oldParent.AddChild(existingID, op.OldName, existingType)
+		newParent.AddChild(childID, op.NewName, childType)
+		return nil
+	}
+
+	if ok && op.Flags&fuseops.RenameNoReplace != 0 {
+		return fuse.EEXIST
+	}
+
 	// If the new name exists already in the new parent, make sure it's not a
 	// non-empty directory, then delete it.
-	newParent := fs.getInodeOrDie(op.NewParent)
-	existingID, _, ok := newParent.LookUpChild(op.NewName)
 	if ok {
 		existing := fs.getInodeOrDie(existingID)
 
@@ -635,12 +668,18 @@ func (fs *memFS) OpenFile(
 		panic("Found non-file.")
 	}
 
+	// With atomic O_TRUNC the kernel leaves truncation to us.
+	if op.OpenFlags.IsTruncate() {
+		var size uint64
+		inode.SetAttributes(&size, nil, nil)
+	}
+
 	if inode.name == CheckFileOpenFlagsFileName {
 		// For testing purpose only.
 		// Set attribute (name=fileOpenFlagsXattr, value=OpenFlags) to test whether
 		// we set OpenFlags correctly. The value is checked in test with getXattr.
 		value := make([]byte, 4)
-		binary.LittleEndian.PutUint32(value, uint32(op.OpenFlags)&syscall.O_ACCMODE)
+		binary.LittleEndian.PutUint32(value, uint32(op.OpenFlags&fusekernel.OpenAccessModeMask))
 		err := fs.setXattrHelper(inode, &fuseops.SetXattrOp{
 			Name:  FileOpenFlagsXattrName,
 			Value: value,
@@ -720,18 +759,12 @@ func (fs *memFS) GetXattr(ctx context.Context,
 	defer fs.mu.Unlock()
 
 	inode := fs.getInodeOrDie(op.Inode)
-	if value, ok := inode.xattrs[op.Name]; ok {
-		op.BytesRead = len(value)
-		if len(op.Dst) >= len(value) {
-			copy(op.Dst, value)
-		} else if len(op.Dst) != 0 {
-			return syscall.ERANGE
-		}
-	} else {
+	value, ok := inode.xattrs[op.Name]
+	if !ok {
 		return fuse.ENOATTR
 	}
 
-	return nil
+	return fuseutil.WriteXattrValue(op, value)
 }
 
 func (fs *memFS) ListXattr(ctx context.Context,
@@ -741,20 +774,12 @@ func (fs *memFS) ListXattr(ctx context.Context,
 
 	inode := fs.getInodeOrDie(op.Inode)
 
-	dst := op.Dst[:]
+	names := make([]string, 0, len(inode.xattrs))
 	for key := range inode.xattrs {
-		keyLen := len(key) + 1
-
-		if len(dst) >= keyLen {
-			copy(dst, key)
-			dst = dst[keyLen:]
-		} else if len(op.Dst) != 0 {
-			return syscall.ERANGE
-		}
-		op.BytesRead += keyLen
+		names = append(names, key)
 	}
 
-	return nil
+	return fuseutil.WriteXattrNames(op, names)
 }
 
 func (fs *memFS) RemoveXattr(ctx context.Context,
@@ -785,11 +810,11 @@ func (fs *memFS) setXattrHelper(inode *inode, op *fuseops.SetXattrOp) error {
 	_, ok := inode.xattrs[op.Name]
 
 	switch op.Flags {
-	case unix.XATTR_CREATE:
+	case xattrCreate:
 		if ok {
 			return fuse.EEXIST
 		}
-	case unix.XATTR_REPLACE:
+	case xattrReplace:
 		if !ok {
 			return fuse.ENOATTR
 		}
@@ -806,6 +831,5 @@ func (fs *memFS) Fallocate(ctx context.Context,
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	inode := fs.getInodeOrDie(op.Inode)
-	inode.Fallocate(op.Mode, op.Offset, op.Length)
-	return nil
+	return inode.Fallocate(op.Mode, op.Offset, op.Length)
 }
@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/sys/unix"
+)
+
+func (t *MknodTest) Fallocate_PunchHole() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	err = ioutil.WriteFile(fileName, []byte("tacoburrito"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Punch a hole extending past the end of the file.
+	err = unix.Fallocate(
+		int(f.Fd()),
+		unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+		4,
+		100)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectEq("taco\x00\x00\x00\x00\x00\x00\x00", string(contents))
+}
+
+func (t *MknodTest) Fallocate_KeepSize() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	err = unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, 100)
+	AssertEq(nil, err)
+
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(4, fi.Size())
+}
+
+func (t *MknodTest) Fallocate_UnsupportedMode() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	err = unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_COLLAPSE_RANGE, 0, 4096)
+	ExpectEq(unix.EOPNOTSUPP, err)
+
+	// Ordinary allocation still works afterward.
+	err = unix.Fallocate(int(f.Fd()), 0, 0, 8)
+	AssertEq(nil, err)
+}
+
+func (t *MemFSTest) Rename_NoReplace() {
+	var err error
+	oldPath := path.Join(t.Dir, "foo")
+	newPath := path.Join(t.Dir, "bar")
+
+	err = ioutil.WriteFile(oldPath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(newPath, []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	err = unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_NOREPLACE)
+	ExpectEq(unix.EEXIST, err)
+
+	// Both files are untouched.
+	contents, err := ioutil.ReadFile(newPath)
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	// A fresh name is fine.
+	err = unix.Renameat2(
+		unix.AT_FDCWD, oldPath,
+		unix.AT_FDCWD, path.Join(t.Dir, "baz"),
+		unix.RENAME_NOREPLACE)
+	AssertEq(nil, err)
+}
+
+func (t *MemFSTest) Rename_Exchange() {
+	var err error
+	oldPath := path.Join(t.Dir, "foo")
+	newPath := path.Join(t.Dir, "bar")
+
+	err = ioutil.WriteFile(oldPath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Mkdir(newPath, 0700)
+	AssertEq(nil, err)
+
+	err = unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_EXCHANGE)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(oldPath)
+	AssertEq(nil, err)
+	ExpectTrue(fi.IsDir())
+
+	contents, err := ioutil.ReadFile(newPath)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
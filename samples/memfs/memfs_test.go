@@ -12,6 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build !windows
+// +build !windows
+
 package memfs_test
 
 import (
@@ -110,6 +113,7 @@ type memFSTest struct {
 func (t *memFSTest) SetUp(ti *TestInfo) {
 	// Disable writeback caching so that pid is always available in OpContext
 	t.MountConfig.DisableWritebackCaching = true
+	t.MountConfig.EnableRenameFlags = true
 
 	t.Server = memfs.NewMemFS(currentUid(), currentGid())
 	t.SampleTest.SetUp(ti)
@@ -1940,6 +1944,29 @@ func (t *MknodTest) File() {
 	ExpectEq("", string(contents))
 }
 
+func (t *MknodTest) FIFO() {
+	// mknod(2) only works for root on OS X.
+	if runtime.GOOS == "darwin" {
+		return
+	}
+
+	var err error
+	p := path.Join(t.Dir, "foo")
+
+	err = syscall.Mknod(p, syscall.S_IFIFO|0600, 0)
+	AssertEq(nil, err)
+
+	fi, err := os.Lstat(p)
+	AssertEq(nil, err)
+	ExpectEq(os.ModeNamedPipe|0600, fi.Mode())
+
+	// The directory listing has the right type too.
+	entries, err := os.ReadDir(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq(os.ModeNamedPipe, entries[0].Type())
+}
+
 func (t *MknodTest) Directory() {
 	// mknod(2) only works for root on OS X.
 	if runtime.GOOS == "darwin" {
@@ -12,6 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build !windows
+// +build !windows
+
 // Tests for the behavior of os.File objects on plain old posix file systems,
 // for use in verifying the intended behavior of memfs.
 
@@ -448,3 +451,12 @@ func (t *PosixTest) SymlinkInParallel() {
 func (t *PosixTest) HardlinkInParallel() {
 	fusetesting.RunHardlinkInParallelTest(t.ctx, t.dir)
 }
+
+func (t *PosixTest) Conformance() {
+	// Let the sticky directory check act as another user.
+	AssertEq(nil, os.Chmod(t.dir, 0755))
+
+	for _, r := range fusetesting.CheckConformance(t.dir, fusetesting.ConformanceChecks) {
+		ExpectTrue(r.Passed() || r.Skipped(), "%v", r)
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The prefix of PAX records holding extended attributes, as used by GNU tar
+// and others.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// Tree gives access to the contents of a memfs file system for checkpointing
+// them to, and restoring them from, tar streams. This is handy for preloading
+// test fixtures and saving scratch mounts.
+type Tree struct {
+	fs *memFS
+}
+
+// NewMemFSWithTree is like NewMemFS, but also returns a Tree for the file
+// system.
+func NewMemFSWithTree(
+	uid uint32,
+	gid uint32) (fuse.Server, *Tree) {
+	fs := newMemFS(uid, gid, nil, nil)
+	return fuseutil.NewFileSystemServer(fs), &Tree{fs: fs}
+}
+
+// WriteTar writes the file system's contents to w as a tar stream, with
+// directories preceding their contents. Hard links are written as tar links
+// to the first name encountered, and extended attributes as PAX records.
+// Sockets can't be represented in tar, and cause an error.
+func (t *Tree) WriteTar(w io.Writer) error {
+	fs := t.fs
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	tw := tar.NewWriter(w)
+	seen := make(map[fuseops.InodeID]string)
+	if err := t.writeDir(tw, fuseops.RootInodeID, "", seen); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// LOCKS_REQUIRED(t.fs.mu)
+func (t *Tree) writeDir(
+	tw *tar.Writer,
+	dirID fuseops.InodeID,
+	dirPath string,
+	seen map[fuseops.InodeID]string) error {
+	dir := t.fs.getInodeOrDie(dirID)
+	for _, e := range dir.entries {
+		if e.Type == fuseutil.DT_Unknown {
+			continue
+		}
+
+		child := t.fs.getInodeOrDie(e.Inode)
+		name := path.Join(dirPath, e.Name)
+
+		hdr := &tar.Header{
+			Name:       name,
+			Mode:       int64(child.attrs.Mode.Perm()),
+			Uid:        int(child.attrs.Uid),
+			Gid:        int(child.attrs.Gid),
+			ModTime:    child.attrs.Mtime,
+			AccessTime: child.attrs.Atime,
+			ChangeTime: child.attrs.Ctime,
+			Format:     tar.FormatPAX,
+		}
+
+		for k, v := range child.xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+
+			hdr.PAXRecords[paxXattrPrefix+k] = string(v)
+		}
+
+		var contents []byte
+		switch {
+		case child.isDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+
+		case child.isSymlink():
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = child.target
+
+		case child.attrs.Mode&os.ModeNamedPipe != 0:
+			hdr.Typeflag = tar.TypeFifo
+
+		case child.attrs.Mode&os.ModeDevice != 0:
+			hdr.Typeflag = tar.TypeBlock
+			if child.attrs.Mode&os.ModeCharDevice != 0 {
+				hdr.Typeflag = tar.TypeChar
+			}
+
+			hdr.Devmajor = int64(major(uint64(child.attrs.Rdev)))
+			hdr.Devminor = int64(minor(uint64(child.attrs.Rdev)))
+
+		case child.attrs.Mode&os.ModeSocket != 0:
+			return fmt.Errorf("%s: sockets can't be written to tar", name)
+
+		case seen[e.Inode] != "":
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = seen[e.Inode]
+
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(child.contents))
+			contents = child.contents
+			seen[e.Inode] = name
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("WriteHeader(%q): %w", name, err)
+		}
+
+		if _, err := tw.Write(contents); err != nil {
+			return fmt.Errorf("Write(%q): %w", name, err)
+		}
+
+		if child.isDir() {
+			if err := t.writeDir(tw, e.Inode, name, seen); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadTar adds the contents of the tar stream to the file system. Each
+// entry's parent directory must already exist, either in the file system or
+// earlier in the stream, and its name must not. Regular files, directories,
+// symlinks, hard links, named pipes and device nodes are supported. Ownership
+// is not restored; new inodes are owned by the file system's UID and GID as
+// usual.
+//
+// This should be done before the file system is mounted, since the kernel is
+// not told about the new entries.
+func (t *Tree) ReadTar(r io.Reader) error {
+	fs := t.fs
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Adding children updates directories' mtimes, so restore them at the end.
+	dirMtimes := make(map[*inode]time.Time)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if name == "." {
+			continue
+		}
+
+		parentID, err := t.lookUpDir(path.Dir(name))
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+
+		parent := fs.getInodeOrDie(parentID)
+		base := path.Base(name)
+		if _, _, exists := parent.LookUpChild(base); exists {
+			return fmt.Errorf("%s: %w", hdr.Name, fuse.EEXIST)
+		}
+
+		// Hard links just add another entry for an existing inode.
+		if hdr.Typeflag == tar.TypeLink {
+			targetID, err := t.lookUp(path.Clean(strings.TrimPrefix(hdr.Linkname, "/")))
+			if err != nil {
+				return fmt.Errorf("%s: link target: %w", hdr.Name, err)
+			}
+
+			target := fs.getInodeOrDie(targetID)
+			if !target.isFile() {
+				return fmt.Errorf("%s: link target is not a file", hdr.Name)
+			}
+
+			target.attrs.Nlink++
+			parent.AddChild(targetID, base, fuseutil.DT_File)
+			continue
+		}
+
+		attrs := fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.FileMode(hdr.Mode).Perm(),
+			Uid:   fs.uid,
+			Gid:   fs.gid,
+		}
+
+		var dt fuseutil.DirentType
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			attrs.Mode |= os.ModeDir
+			dt = fuseutil.DT_Directory
+
+		case tar.TypeSymlink:
+			attrs.Mode |= os.ModeSymlink
+			dt = fuseutil.DT_Link
+
+		case tar.TypeReg:
+			dt = fuseutil.DT_File
+
+		case tar.TypeFifo:
+			attrs.Mode |= os.ModeNamedPipe
+			dt = fuseutil.DT_FIFO
+
+		case tar.TypeChar:
+			attrs.Mode |= os.ModeDevice | os.ModeCharDevice
+			attrs.Rdev = uint32(mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+			dt = fuseutil.DT_Char
+
+		case tar.TypeBlock:
+			attrs.Mode |= os.ModeDevice
+			attrs.Rdev = uint32(mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+			dt = fuseutil.DT_Block
+
+		default:
+			return fmt.Errorf("%s: unsupported tar entry type %q", hdr.Name, hdr.Typeflag)
+		}
+
+		childID, child := fs.allocateInode(attrs, base)
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			child.target = hdr.Linkname
+
+		case tar.TypeReg:
+			if child.contents, err = io.ReadAll(tr); err != nil {
+				return fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+
+			child.attrs.Size = uint64(len(child.contents))
+		}
+
+		for k, v := range hdr.PAXRecords {
+			if strings.HasPrefix(k, paxXattrPrefix) {
+				child.xattrs[strings.TrimPrefix(k, paxXattrPrefix)] = []byte(v)
+			}
+		}
+
+		child.attrs.Mtime = hdr.ModTime
+		child.attrs.Atime = hdr.AccessTime
+		child.attrs.Ctime = hdr.ChangeTime
+		if child.isDir() {
+			dirMtimes[child] = hdr.ModTime
+		}
+
+		parent.AddChild(childID, base, dt)
+	}
+
+	for dir, mtime := range dirMtimes {
+		dir.attrs.Mtime = mtime
+	}
+
+	return nil
+}
+
+// Find the inode with the supplied slash-separated path relative to the root.
+//
+// LOCKS_REQUIRED(t.fs.mu)
+func (t *Tree) lookUp(p string) (fuseops.InodeID, error) {
+	id := fuseops.InodeID(fuseops.RootInodeID)
+	if p == "." {
+		return id, nil
+	}
+
+	for _, name := range strings.Split(p, "/") {
+		in := t.fs.getInodeOrDie(id)
+		if !in.isDir() {
+			return 0, fuse.ENOTDIR
+		}
+
+		child, _, ok := in.LookUpChild(name)
+		if !ok {
+			return 0, fuse.ENOENT
+		}
+
+		id = child
+	}
+
+	return id, nil
+}
+
+// Like lookUp, but require the inode to be a directory.
+//
+// LOCKS_REQUIRED(t.fs.mu)
+func (t *Tree) lookUpDir(p string) (fuseops.InodeID, error) {
+	id, err := t.lookUp(p)
+	if err != nil {
+		return 0, err
+	}
+
+	if !t.fs.getInodeOrDie(id).isDir() {
+		return 0, fuse.ENOTDIR
+	}
+
+	return id, nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+func TestTarRoundTrip(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var in bytes.Buffer
+	tw := tar.NewWriter(&in)
+	entries := []struct {
+		hdr      tar.Header
+		contents string
+	}{
+		{tar.Header{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0755}, ""},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "dir/file", Mode: 0640, Size: 4,
+			PAXRecords: map[string]string{"SCHILY.xattr.user.foo": "bar"}}, "taco"},
+		{tar.Header{Typeflag: tar.TypeLink, Name: "link", Linkname: "dir/file"}, ""},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "sym", Linkname: "dir/file", Mode: 0777}, ""},
+	}
+
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.ModTime = mtime
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("WriteHeader: %v", err)
+		}
+
+		io.WriteString(tw, e.contents)
+	}
+	tw.Close()
+
+	_, tree := memfs.NewMemFSWithTree(0, 0)
+	if err := tree.ReadTar(&in); err != nil {
+		t.Fatalf("ReadTar: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := tree.WriteTar(&out); err != nil {
+		t.Fatalf("WriteTar: %v", err)
+	}
+
+	var got []string
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+
+		contents, _ := io.ReadAll(tr)
+		got = append(got, fmt.Sprintf(
+			"%c %s %o %q -> %q %v %q",
+			hdr.Typeflag, hdr.Name, hdr.Mode, contents, hdr.Linkname,
+			hdr.ModTime.Equal(mtime), hdr.PAXRecords["SCHILY.xattr.user.foo"]))
+	}
+
+	want := []string{
+		`5 dir/ 755 "" -> "" true ""`,
+		`0 dir/file 640 "taco" -> "" true "bar"`,
+		`1 link 640 "" -> "dir/file" true "bar"`,
+		`2 sym 777 "" -> "dir/file" true ""`,
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+
+	// Names that already exist are rejected.
+	in.Reset()
+	tw = tar.NewWriter(&in)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0755})
+	tw.Close()
+	if err := tree.ReadTar(&in); err == nil {
+		t.Errorf("ReadTar of existing name succeeded")
+	}
+}
+
+func TestTarSpecialFiles(t *testing.T) {
+	var in bytes.Buffer
+	tw := tar.NewWriter(&in)
+	for _, hdr := range []tar.Header{
+		{Typeflag: tar.TypeFifo, Name: "fifo", Mode: 0600},
+		{Typeflag: tar.TypeChar, Name: "null", Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Typeflag: tar.TypeBlock, Name: "sda1", Mode: 0660, Devmajor: 8, Devminor: 1},
+	} {
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("WriteHeader: %v", err)
+		}
+	}
+	tw.Close()
+
+	_, tree := memfs.NewMemFSWithTree(0, 0)
+	if err := tree.ReadTar(&in); err != nil {
+		t.Fatalf("ReadTar: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := tree.WriteTar(&out); err != nil {
+		t.Fatalf("WriteTar: %v", err)
+	}
+
+	var got []string
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+
+		got = append(got, fmt.Sprintf(
+			"%c %s %o %d,%d", hdr.Typeflag, hdr.Name, hdr.Mode, hdr.Devmajor, hdr.Devminor))
+	}
+
+	want := []string{
+		`6 fifo 600 0,0`,
+		`3 null 666 1,3`,
+		`4 sda1 660 8,1`,
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package memfs
+
+import "golang.org/x/sys/unix"
+
+// The flags of setxattr(2), as the kernel passes them in SetXattrOp.
+const (
+	xattrCreate  = unix.XATTR_CREATE
+	xattrReplace = unix.XATTR_REPLACE
+)
@@ -0,0 +1,7 @@
+package memfs
+
+// WinFsp passes the flags of setxattr(2) with their Linux values.
+const (
+	xattrCreate  = 1
+	xattrReplace = 2
+)
@@ -21,6 +21,7 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/samples/hellofs"
@@ -56,13 +57,11 @@ func main() {
 		cfg.DebugLogger = log.New(os.Stderr, "fuse: ", 0)
 	}
 
-	mfs, err := fuse.Mount(*fMountPoint, server, cfg)
-	if err != nil {
-		log.Fatalf("Mount: %v", err)
-	}
+	// Serve until unmounted, or until interrupted.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	// Wait for it to be unmounted.
-	if err = mfs.Join(context.Background()); err != nil {
-		log.Fatalf("Join: %v", err)
+	if err := fuse.MountAndServe(ctx, *fMountPoint, server, cfg); err != nil {
+		log.Fatalf("MountAndServe: %v", err)
 	}
 }
@@ -39,13 +39,14 @@ func (t *StatFSTest) Syscall_ZeroValues() {
 	var stat syscall.Statfs_t
 
 	// Call without configuring a canned response, meaning the OS will see the
-	// zero value for each field. The assertions below act as documentation for
-	// the OS's behavior in this case.
+	// zero value for each field, except for the block sizes, which default to
+	// 4096 (cf. StatFSOp). The assertions below act as documentation for the
+	// OS's behavior in this case.
 	err = syscall.Statfs(t.Dir, &stat)
 	AssertEq(nil, err)
 
-	ExpectEq(0, stat.Bsize)
-	ExpectEq(0, stat.Frsize)
+	ExpectEq(4096, stat.Bsize)
+	ExpectEq(4096, stat.Frsize)
 	ExpectEq(0, stat.Blocks)
 	ExpectEq(0, stat.Bfree)
 	ExpectEq(0, stat.Bavail)
@@ -118,7 +119,14 @@ func (t *StatFSTest) BlockSizes() {
 		err = syscall.Statfs(t.Dir, &stat)
 		AssertEq(nil, err)
 
-		ExpectEq(bs, stat.Frsize, "%s", desc)
+		// A zero block size gets the default, and the IO size follows it.
+		want := bs
+		if want == 0 {
+			want = 4096
+		}
+
+		ExpectEq(want, stat.Frsize, "%s", desc)
+		ExpectEq(want, stat.Bsize, "%s", desc)
 	}
 }
 
@@ -155,6 +163,13 @@ func (t *StatFSTest) IoSizes() {
 		err = syscall.Statfs(t.Dir, &stat)
 		AssertEq(nil, err)
 
-		ExpectEq(bs, stat.Bsize, "%s", desc)
+		// A zero IO size gets the default, and the block size follows it.
+		want := bs
+		if want == 0 {
+			want = 4096
+		}
+
+		ExpectEq(want, stat.Bsize, "%s", desc)
+		ExpectEq(want, stat.Frsize, "%s", desc)
 	}
 }
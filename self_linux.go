@@ -0,0 +1,18 @@
+package fuse
+
+import (
+	"fmt"
+	"os"
+)
+
+// Return true if the supplied PID, as found in a fuse request header, belongs
+// to the current process. The kernel reports the ID of the calling thread,
+// so check whether it's one of ours.
+func isOwnProcess(pid uint32) bool {
+	if int(pid) == os.Getpid() {
+		return true
+	}
+
+	_, err := os.Stat(fmt.Sprintf("/proc/self/task/%d", pid))
+	return err == nil
+}
@@ -0,0 +1,24 @@
+package fuse
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func Test_isOwnProcess(t *testing.T) {
+	if !isOwnProcess(uint32(os.Getpid())) {
+		t.Errorf("expected own PID to match")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if !isOwnProcess(uint32(syscall.Gettid())) {
+		t.Errorf("expected own thread ID to match")
+	}
+
+	if isOwnProcess(uint32(os.Getppid())) {
+		t.Errorf("expected parent PID not to match")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package fuse
+
+import "os"
+
+// Return true if the supplied PID, as found in a fuse request header, belongs
+// to the current process.
+func isOwnProcess(pid uint32) bool {
+	return int(pid) == os.Getpid()
+}
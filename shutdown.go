@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The error with which ops that arrive during a shutdown are rejected.
+var errShuttingDown = NewError(syscall.ENOTCONN, "fuse: shutting down")
+
+// Shutdown unmounts the file system gracefully. It stops delivering new ops
+// from ReadOp, replying to them with ENOTCONN instead (except for forgets, and
+// for the flushes and releases of files being closed), waits for the ops
+// already delivered to be replied to, and then unmounts. If ctx is done
+// before the ops drain, or the unmount fails (e.g. with EBUSY because files
+// are still open), it falls back to Abort, so that the mount point doesn't
+// linger with nobody serving it.
+//
+// The result is nil if the file system was unmounted without aborting. The
+// server's ServeOps sees EOF from ReadOp either way, as with any unmount.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	dir := c.mountPoint
+	c.mu.Unlock()
+
+	if dir == "" {
+		return errors.New("Shutdown: connection is not mounted")
+	}
+
+	var err error
+	select {
+	case <-c.beginShutdown():
+		if err = unmount(dir); err == nil {
+			return nil
+		}
+
+		err = fmt.Errorf("unmount: %w", err)
+
+	case <-ctx.Done():
+		err = fmt.Errorf("waiting for in-flight ops: %w", ctx.Err())
+	}
+
+	if abortErr := c.Abort(); abortErr != nil {
+		return fmt.Errorf("Shutdown: %v; %v", err, abortErr)
+	}
+
+	return fmt.Errorf("Shutdown: aborted after %w", err)
+}
+
+// Stop delivering new ops, returning a channel that is closed once every op
+// already delivered has been replied to.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) beginShutdown() <-chan struct{} {
+	atomic.StoreInt32(&c.shuttingDown, 1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	drained := make(chan struct{})
+	if c.inFlight == 0 {
+		close(drained)
+		return drained
+	}
+
+	c.drainWaiters = append(c.drainWaiters, drained)
+	return drained
+}
+
+// Record that an op is about to be delivered.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) opStarted() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inFlight++
+}
+
+// Record that an op has been replied to, waking up any shutdown waiting for
+// the last one.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Connection) opFinished() {
+	c.inFlight--
+	if c.inFlight == 0 {
+		for _, ch := range c.drainWaiters {
+			close(ch)
+		}
+
+		c.drainWaiters = nil
+	}
+}
+
+// If a shutdown has begun, return the error with which to reject a newly
+// arrived op.
+func (c *Connection) checkShutdown(op interface{}) error {
+	if atomic.LoadInt32(&c.shuttingDown) == 0 {
+		return nil
+	}
+
+	// As for checkCallerPolicy, leave alone the ops that can't be failed. Let
+	// flushes and releases through too: they come from processes closing
+	// files, whose close(2) shouldn't fail, and file systems may only write
+	// back their data once they see them.
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp, *fuseops.DestroyOp, *initOp:
+		return nil
+
+	case *fuseops.FlushFileOp, *fuseops.ReleaseFileHandleOp, *fuseops.ReleaseDirHandleOp:
+		return nil
+	}
+
+	return errShuttingDown
+}
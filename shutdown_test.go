@@ -0,0 +1,69 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestShutdownDrainsOps(t *testing.T) {
+	c := &Connection{
+		cfg:         MountConfig{OpContext: context.Background()},
+		cancelFuncs: make(map[uint64]context.CancelCauseFunc),
+		logger:      NewLevelLogger(log.New(&bytes.Buffer{}, "", 0), LogError),
+	}
+
+	if err := c.checkShutdown(&fuseops.LookUpInodeOp{}); err != nil {
+		t.Fatalf("Rejected before shutdown: %v", err)
+	}
+
+	c.beginOp(fusekernel.OpLookup, 1)
+	c.beginOp(fusekernel.OpForget, 2)
+
+	drained := c.beginShutdown()
+
+	// New ops are turned away, except those that can't be failed.
+	if err := c.checkShutdown(&fuseops.LookUpInodeOp{}); errnoForError(err) != syscall.ENOTCONN {
+		t.Errorf("LookUpInode: got %v", err)
+	}
+
+	for _, op := range []interface{}{
+		&fuseops.BatchForgetOp{},
+		&fuseops.FlushFileOp{},
+		&fuseops.ReleaseFileHandleOp{},
+		&fuseops.ReleaseDirHandleOp{},
+	} {
+		if err := c.checkShutdown(op); err != nil {
+			t.Errorf("%T: got %v", op, err)
+		}
+	}
+
+	if c.shouldLogError(&fuseops.LookUpInodeOp{}, errShuttingDown) {
+		t.Errorf("Expected shutdown rejections not to be logged")
+	}
+
+	c.finishOp(fusekernel.OpLookup, 1)
+	select {
+	case <-drained:
+		t.Fatalf("Drained with an op in flight")
+	default:
+	}
+
+	c.finishOp(fusekernel.OpForget, 2)
+	<-drained
+
+	// Once drained, later shutdowns needn't wait.
+	<-c.beginShutdown()
+}
+
+func TestShutdownNotMounted(t *testing.T) {
+	c := &Connection{}
+	if err := c.Shutdown(context.Background()); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
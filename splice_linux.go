@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// Send the reply to a read straight from o.SpliceFile to the device by way of
+// a pipe: the header is written to the pipe, the data spliced in after it,
+// and the whole message then spliced to the device at once, since the kernel
+// requires each reply to arrive in a single write. Nothing has reached the
+// device if an error is returned.
+func (c *Connection) spliceReply(
+	dev *os.File,
+	outMsg *buffer.OutMessage,
+	o *fuseops.ReadFileOp) error {
+	total := buffer.OutMessageHeaderSize + o.BytesRead
+
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+		return err
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+
+	// The whole message must fit in the pipe, or filling it would block. A pipe
+	// holds a whole number of pages, one for the header and one for each page
+	// of the file the data touches, which may be one more than its length
+	// suggests if it doesn't start on a page boundary.
+	pageSize := os.Getpagesize()
+	want := (2 + (o.BytesRead+pageSize-1)/pageSize) * pageSize
+	size, err := unix.FcntlInt(uintptr(p[1]), unix.F_SETPIPE_SZ, want)
+	if err != nil {
+		return fmt.Errorf("F_SETPIPE_SZ: %w", err)
+	}
+
+	if size < want {
+		return fmt.Errorf("Pipe holds only %d bytes", size)
+	}
+
+	h := *outMsg.OutHeader()
+	h.Len = uint32(total)
+	hdr := (*[unsafe.Sizeof(fusekernel.OutHeader{})]byte)(unsafe.Pointer(&h))[:]
+	if _, err := unix.Write(p[1], hdr); err != nil {
+		return err
+	}
+
+	off := o.SpliceOffset
+	for n := 0; n < o.BytesRead; {
+		m, err := unix.Splice(
+			int(o.SpliceFile.Fd()), &off,
+			p[1], nil,
+			o.BytesRead-n,
+			unix.SPLICE_F_MOVE)
+
+		if err != nil {
+			return fmt.Errorf("splice from file: %w", err)
+		}
+
+		if m == 0 {
+			return io.ErrUnexpectedEOF
+		}
+
+		n += int(m)
+	}
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	n, err := unix.Splice(p[0], nil, int(dev.Fd()), nil, total, unix.SPLICE_F_MOVE)
+	if err != nil {
+		return fmt.Errorf("splice to device: %w", err)
+	}
+
+	if int(n) != total {
+		return fmt.Errorf("Spliced %d bytes; expected %d", n, total)
+	}
+
+	return nil
+}
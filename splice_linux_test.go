@@ -0,0 +1,88 @@
+package fuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestSplicedReadReply(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	name := path.Join(t.TempDir(), "foo")
+	if err := ioutil.WriteFile(name, []byte("tacoburrito"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	c := &Connection{
+		dev:    w,
+		logger: NewLevelLogger(log.New(&bytes.Buffer{}, "", 0), LogError),
+	}
+
+	const hdrSize = buffer.OutMessageHeaderSize
+	reply := func(o *fuseops.ReadFileOp) (*fusekernel.OutHeader, string) {
+		var m buffer.OutMessage
+		m.Reset()
+		c.kernelResponse(&m, 17, o, nil)
+		if err := c.writeSplicedReply(c.dev, &m, o); err != nil {
+			t.Fatalf("writeSplicedReply: %v", err)
+		}
+
+		buf := make([]byte, 1024)
+		n, err := r.Read(buf)
+		if err != nil || n < hdrSize {
+			t.Fatalf("Read: %d, %v", n, err)
+		}
+
+		h := *(*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+		if int(h.Len) != n || h.Unique != 17 {
+			t.Errorf("Unexpected header for %d bytes: %+v", n, h)
+		}
+
+		return &h, string(buf[hdrSize:n])
+	}
+
+	// Spliced.
+	h, data := reply(&fuseops.ReadFileOp{SpliceFile: f, SpliceOffset: 4, BytesRead: 7})
+	if h.Error != 0 || data != "burrito" {
+		t.Errorf("Got error %d, data %q", h.Error, data)
+	}
+
+	// Without falling back to copying.
+	var m buffer.OutMessage
+	m.Reset()
+	if err := c.spliceReply(c.dev, &m, &fuseops.ReadFileOp{SpliceFile: f, BytesRead: 4}); err != nil {
+		t.Fatalf("spliceReply: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	if n, err := r.Read(buf); err != nil || string(buf[hdrSize:n]) != "taco" {
+		t.Errorf("Read: %q, %v", buf[:n], err)
+	}
+
+	// Past the end of the file: splicing comes up short, and so does copying.
+	h, data = reply(&fuseops.ReadFileOp{SpliceFile: f, SpliceOffset: 4, BytesRead: 8})
+	if h.Error != -int32(syscall.EIO) || data != "" {
+		t.Errorf("Got error %d, data %q", h.Error, data)
+	}
+}
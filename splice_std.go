@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package fuse
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+// There is no splice(2) elsewhere; callers fall back to copying.
+func (c *Connection) spliceReply(
+	dev *os.File,
+	outMsg *buffer.OutMessage,
+	o *fuseops.ReadFileOp) error {
+	return syscall.ENOSYS
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"math"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// InfiniteTimeout may be used for MountConfig.DefaultEntryTimeout and
+// MountConfig.DefaultAttributeTimeout to let the kernel cache entries or
+// attributes until it is told otherwise (e.g. by a notification) or evicts
+// them under memory pressure.
+const InfiniteTimeout = time.Duration(math.MaxInt64)
+
+// Far enough in the future to be infinite for the kernel's purposes, without
+// overflowing when computing durations from it.
+var infiniteExpiration = time.Unix(1<<40, 0)
+
+// Return the expiration time for a default timeout, or the zero time if there
+// is no default.
+func defaultExpiration(now time.Time, d time.Duration) time.Time {
+	switch {
+	case d <= 0:
+		return time.Time{}
+	case d == InfiniteTimeout:
+		return infiniteExpiration
+	}
+
+	return now.Add(d)
+}
+
+// Fill in the expiration times the user left unset in a successful op from the
+// configured defaults.
+func (c *Connection) applyDefaultTimeouts(op interface{}) {
+	entryTimeout := c.cfg.DefaultEntryTimeout
+	attrTimeout := c.cfg.DefaultAttributeTimeout
+	if entryTimeout <= 0 && attrTimeout <= 0 {
+		return
+	}
+
+	now := time.Now()
+	fill := func(t *time.Time, d time.Duration) {
+		if t.IsZero() {
+			*t = defaultExpiration(now, d)
+		}
+	}
+
+	fillEntry := func(e *fuseops.ChildInodeEntry) {
+		fill(&e.EntryExpiration, entryTimeout)
+		fill(&e.AttributesExpiration, attrTimeout)
+	}
+
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		fillEntry(&o.Entry)
+	case *fuseops.MkDirOp:
+		fillEntry(&o.Entry)
+	case *fuseops.MkNodeOp:
+		fillEntry(&o.Entry)
+	case *fuseops.CreateFileOp:
+		fillEntry(&o.Entry)
+	case *fuseops.CreateSymlinkOp:
+		fillEntry(&o.Entry)
+	case *fuseops.CreateLinkOp:
+		fillEntry(&o.Entry)
+	case *fuseops.GetInodeAttributesOp:
+		fill(&o.AttributesExpiration, attrTimeout)
+	case *fuseops.SetInodeAttributesOp:
+		fill(&o.AttributesExpiration, attrTimeout)
+	case *fuseops.ReadDirPlusOp:
+		for i := range o.Entries {
+			fillEntry(&o.Entries[i].Entry)
+		}
+	}
+}
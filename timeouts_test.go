@@ -0,0 +1,54 @@
+package fuse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func Test_applyDefaultTimeouts(t *testing.T) {
+	c := &Connection{cfg: MountConfig{
+		DefaultEntryTimeout:     InfiniteTimeout,
+		DefaultAttributeTimeout: 100 * time.Millisecond,
+	}}
+
+	past := time.Unix(1, 0)
+	op := &fuseops.LookUpInodeOp{}
+	op.Entry.AttributesExpiration = past
+
+	before := time.Now()
+	c.applyDefaultTimeouts(op)
+
+	secs, _ := convertExpirationTime(op.Entry.EntryExpiration)
+	if secs < 1<<30 {
+		t.Errorf("EntryExpiration = %v, want effectively infinite", op.Entry.EntryExpiration)
+	}
+
+	// Explicit values are left alone.
+	if !op.Entry.AttributesExpiration.Equal(past) {
+		t.Errorf("AttributesExpiration = %v, want %v", op.Entry.AttributesExpiration, past)
+	}
+
+	getAttr := &fuseops.GetInodeAttributesOp{}
+	c.applyDefaultTimeouts(getAttr)
+	if d := getAttr.AttributesExpiration.Sub(before); d < 100*time.Millisecond || d > time.Second {
+		t.Errorf("AttributesExpiration is %v from now", d)
+	}
+
+	// An explicit zero lifetime overrides the default.
+	getAttr = &fuseops.GetInodeAttributesOp{AttributesExpiration: fuseops.ExpireAfter(0)}
+	c.applyDefaultTimeouts(getAttr)
+	if secs, nsecs := convertExpirationTime(getAttr.AttributesExpiration); secs != 0 || nsecs != 0 {
+		t.Errorf("ExpireAfter(0) converted to %d.%09ds", secs, nsecs)
+	}
+
+	// Defaults reach the entries of ReadDirPlusOp.
+	readDir := &fuseops.ReadDirPlusOp{Entries: make([]fuseops.DirentPlus, 2)}
+	c.applyDefaultTimeouts(readDir)
+	for i, e := range readDir.Entries {
+		if d := e.Entry.AttributesExpiration.Sub(before); d < 100*time.Millisecond || d > time.Second {
+			t.Errorf("Entry %d: AttributesExpiration is %v from now", i, d)
+		}
+	}
+}
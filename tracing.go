@@ -0,0 +1,190 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Tracer receives the start and end of every op the connection returns from
+// ReadOp, set with MountConfig.Tracer. It is the place to hang per-op latency
+// metrics or distributed tracing spans; package
+// github.com/jacobsa/fuse/oteltrace, a separate module, provides one that
+// records an OpenTelemetry span per op. The connection's debug logging of ops
+// (LogOp at LogDebug) is done by a Tracer of its own, alongside this one.
+//
+// Implementations must be safe for concurrent use.
+type Tracer interface {
+	// Called when an op has been read from the kernel, before it is returned
+	// by ReadOp. The returned context, which must be derived from ctx, is the
+	// one ReadOp returns.
+	StartOp(ctx context.Context, t *OpTrace) context.Context
+
+	// Called when the op is replied to, with the context returned by StartOp
+	// and the same OpTrace, its result fields now filled in. The reply has
+	// not yet been written to the kernel.
+	EndOp(ctx context.Context, t *OpTrace)
+}
+
+// OpTrace describes an op for a Tracer.
+type OpTrace struct {
+	// The name of the op, e.g. "LookUpInode" for a *fuseops.LookUpInodeOp, and
+	// its kernel opcode and request ID.
+	Op     string
+	Opcode uint32
+	FuseID uint64
+
+	// The inode the op is about (its parent, for ops like LookUpInodeOp that
+	// name a child), or zero if it has none.
+	Inode fuseops.InodeID
+
+	// The number of bytes the kernel asked to read or write, for ReadFileOp
+	// and WriteFileOp, and zero otherwise.
+	Size int64
+
+	// The process that caused the op, where known.
+	Pid uint32
+
+	// When the op was read from the kernel.
+	Start time.Time
+
+	// Filled in before EndOp: how long the op took to be replied to, the error
+	// it was replied to with, and the errno that the kernel is sent for that
+	// error (zero on success).
+	Latency time.Duration
+	Err     error
+	Errno   syscall.Errno
+
+	// Also filled in before EndOp: the number of bytes actually read or
+	// written by a successful ReadFileOp or WriteFileOp.
+	Bytes int64
+
+	// The op itself, and whether it is being logged by debugTracer.
+	op    interface{}
+	debug bool
+}
+
+// debugTracer is the Tracer through which a connection logs each op and its
+// reply, when debug logging of ops is enabled.
+type debugTracer struct {
+	c *Connection
+}
+
+func (d debugTracer) StartOp(ctx context.Context, t *OpTrace) context.Context {
+	d.c.debugLog(t.FuseID, 1, "<- %s", describeRequest(t.op))
+	return ctx
+}
+
+func (d debugTracer) EndOp(ctx context.Context, t *OpTrace) {
+	if t.Err == nil {
+		d.c.debugLog(t.FuseID, 1, "-> OK (%s)", describeResponse(t.op))
+	} else {
+		d.c.debugLog(t.FuseID, 1, "-> Error: %q", t.Err.Error())
+	}
+}
+
+// Tell the tracer, if any, about an op that is about to be returned by ReadOp.
+func (c *Connection) startTrace(
+	ctx context.Context,
+	opCode uint32,
+	fuseID uint64,
+	op interface{}) (context.Context, *OpTrace) {
+	debug := c.logger != nil && c.logger.Enabled(LogDebug, LogOp)
+	if c.cfg.Tracer == nil && !debug {
+		return ctx, nil
+	}
+
+	t := &OpTrace{
+		Op:     opName(op),
+		Opcode: opCode,
+		FuseID: fuseID,
+		Start:  time.Now(),
+		op:     op,
+		debug:  debug,
+	}
+
+	v := reflect.ValueOf(op).Elem()
+	for _, name := range []string{"Inode", "Parent"} {
+		if f := v.FieldByName(name); f.IsValid() {
+			if id, ok := f.Interface().(fuseops.InodeID); ok {
+				t.Inode = id
+				break
+			}
+		}
+	}
+
+	if f := v.FieldByName("OpContext"); f.IsValid() {
+		if meta, ok := f.Interface().(fuseops.OpContext); ok {
+			t.Pid = meta.Pid
+		}
+	}
+
+	switch typed := op.(type) {
+	case *fuseops.ReadFileOp:
+		t.Size = typed.Size
+
+	case *fuseops.WriteFileOp:
+		t.Size = int64(len(typed.Data))
+	}
+
+	if debug {
+		ctx = debugTracer{c}.StartOp(ctx, t)
+	}
+
+	if c.cfg.Tracer != nil {
+		ctx = c.cfg.Tracer.StartOp(ctx, t)
+	}
+
+	return ctx, t
+}
+
+// Tell the tracer about the reply to an op whose trace was started by
+// startTrace.
+func (c *Connection) endTrace(
+	ctx context.Context,
+	t *OpTrace,
+	op interface{},
+	opErr error) {
+	if t == nil {
+		return
+	}
+
+	t.Latency = time.Since(t.Start)
+	t.Err = opErr
+	if opErr != nil {
+		t.Errno = c.errnoForError(opErr)
+	} else {
+		switch typed := op.(type) {
+		case *fuseops.ReadFileOp:
+			t.Bytes = int64(typed.BytesRead)
+
+		case *fuseops.WriteFileOp:
+			t.Bytes = int64(len(typed.Data))
+		}
+	}
+
+	if t.debug {
+		debugTracer{c}.EndOp(ctx, t)
+	}
+
+	if c.cfg.Tracer != nil {
+		c.cfg.Tracer.EndOp(ctx, t)
+	}
+}
@@ -0,0 +1,116 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+type traceKey struct{}
+
+type recordingTracer struct {
+	started []*OpTrace
+	ended   []*OpTrace
+}
+
+func (r *recordingTracer) StartOp(ctx context.Context, t *OpTrace) context.Context {
+	r.started = append(r.started, t)
+	return context.WithValue(ctx, traceKey{}, t.FuseID)
+}
+
+func (r *recordingTracer) EndOp(ctx context.Context, t *OpTrace) {
+	if ctx.Value(traceKey{}) != t.FuseID {
+		panic("EndOp called without the context from StartOp")
+	}
+
+	r.ended = append(r.ended, t)
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	c := &Connection{cfg: MountConfig{Tracer: tracer}}
+
+	op := &fuseops.ReadFileOp{
+		Inode:     7,
+		Size:      4096,
+		OpContext: fuseops.OpContext{Pid: 17},
+	}
+
+	ctx, trace := c.startTrace(context.Background(), fusekernel.OpRead, 3, op)
+	want := OpTrace{
+		Op:     "ReadFile",
+		Opcode: fusekernel.OpRead,
+		FuseID: 3,
+		Inode:  7,
+		Size:   4096,
+		Pid:    17,
+		Start:  trace.Start,
+		op:     op,
+	}
+
+	if *trace != want {
+		t.Errorf("Started: got %+v, want %+v", *trace, want)
+	}
+
+	c.endTrace(ctx, trace, op, syscall.ENOENT)
+	if len(tracer.ended) != 1 || trace.Errno != syscall.ENOENT || trace.Latency <= 0 {
+		t.Errorf("Ended: %+v", *trace)
+	}
+
+	// Ops about a child report the parent.
+	_, trace = c.startTrace(context.Background(), fusekernel.OpLookup, 4, &fuseops.LookUpInodeOp{Parent: 9})
+	if trace.Inode != 9 || trace.Op != "LookUpInode" {
+		t.Errorf("LookUpInode: %+v", *trace)
+	}
+
+	// Without a tracer there is nothing to do.
+	c = &Connection{}
+	if _, trace := c.startTrace(context.Background(), fusekernel.OpRead, 5, op); trace != nil {
+		t.Errorf("Unexpected trace: %+v", *trace)
+	}
+}
+
+func TestDebugTracer(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLevelLogger(log.New(&buf, "", 0), LogDebug)
+	tracer := &recordingTracer{}
+	c := &Connection{cfg: MountConfig{Tracer: tracer}, logger: logger}
+
+	// Debug logging goes alongside the configured tracer.
+	op := &fuseops.LookUpInodeOp{Parent: 1, Name: "foo"}
+	ctx, trace := c.startTrace(context.Background(), fusekernel.OpLookup, 6, op)
+	c.endTrace(ctx, trace, op, syscall.ENOENT)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 ||
+		!strings.Contains(lines[0], "Op 0x00000006") ||
+		!strings.Contains(lines[0], "<- LookUpInode") ||
+		!strings.Contains(lines[1], "-> Error") {
+		t.Errorf("Unexpected debug log: %q", buf.String())
+	}
+
+	if len(tracer.started) != 1 || len(tracer.ended) != 1 {
+		t.Errorf("Tracer saw %d starts and %d ends", len(tracer.started), len(tracer.ended))
+	}
+
+	// With debug logging enabled, ops are traced even without a tracer.
+	buf.Reset()
+	c = &Connection{logger: logger}
+	ctx, trace = c.startTrace(context.Background(), fusekernel.OpLookup, 7, op)
+	c.endTrace(ctx, trace, op, nil)
+	if n := strings.Count(buf.String(), "\n"); n != 2 {
+		t.Errorf("Got %d debug lines: %q", n, buf.String())
+	}
+
+	// And not at all when it's off.
+	logger.SetLevel(LogOp, LogError)
+	if _, trace := c.startTrace(context.Background(), fusekernel.OpLookup, 8, op); trace != nil {
+		t.Errorf("Unexpected trace: %+v", *trace)
+	}
+}
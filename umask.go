@@ -0,0 +1,44 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The mode bits that MountConfig.Umask may clear.
+const umaskableBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Clear the bits in c.cfg.Umask from the mode of the inode the op creates, if
+// any.
+func (c *Connection) applyUmask(op interface{}) {
+	mask := c.cfg.Umask & umaskableBits
+	if mask == 0 {
+		return
+	}
+
+	switch o := op.(type) {
+	case *fuseops.MkDirOp:
+		o.Mode &^= mask
+
+	case *fuseops.MkNodeOp:
+		o.Mode &^= mask
+
+	case *fuseops.CreateFileOp:
+		o.Mode &^= mask
+	}
+}
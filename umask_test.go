@@ -0,0 +1,24 @@
+package fuse
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func Test_applyUmask(t *testing.T) {
+	c := &Connection{cfg: MountConfig{Umask: 0027 | os.ModeSetuid}}
+
+	mkdir := &fuseops.MkDirOp{Mode: os.ModeDir | 0777}
+	c.applyUmask(mkdir)
+	if want := os.ModeDir | 0750; mkdir.Mode != want {
+		t.Errorf("MkDirOp.Mode = %v, want %v", mkdir.Mode, want)
+	}
+
+	create := &fuseops.CreateFileOp{Mode: os.ModeSetuid | 0666}
+	c.applyUmask(create)
+	if want := os.FileMode(0640); create.Mode != want {
+		t.Errorf("CreateFileOp.Mode = %v, want %v", create.Mode, want)
+	}
+}
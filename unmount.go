@@ -14,8 +14,71 @@
 
 package fuse
 
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+)
+
 // Unmount attempts to unmount the file system whose mount point is the
 // supplied directory.
 func Unmount(dir string) error {
 	return unmount(dir)
 }
+
+// UnmountConfig controls how UnmountWithConfig deals with a busy mount point,
+// i.e. one that some process still has open files or its working directory
+// in.
+type UnmountConfig struct {
+	// The number of times to retry an unmount that fails with EBUSY, and how
+	// long to wait before the first retry, doubling for each retry after that.
+	// The delay defaults to 100ms.
+	Retries    int
+	RetryDelay time.Duration
+
+	// If the mount point is still busy after the retries, detach the file
+	// system lazily: on Linux (MNT_DETACH, or fusermount -z) it disappears at
+	// once and is cleaned up when it is no longer in use, meanwhile continuing
+	// to be served for those still using it. On OS X this is a forced unmount
+	// (MNT_FORCE), after which those still using it get errors.
+	Lazy bool
+}
+
+// UnmountWithConfig is like Unmount, but retries and falls back to a lazy
+// unmount as configured when the mount point is busy. It gives up waiting
+// between retries, returning ctx.Err(), if ctx is done first.
+func UnmountWithConfig(ctx context.Context, dir string, cfg UnmountConfig) error {
+	return unmountWithRetries(ctx, dir, cfg, unmountLazily)
+}
+
+func unmountWithRetries(
+	ctx context.Context,
+	dir string,
+	cfg UnmountConfig,
+	try func(dir string, lazy bool) error) error {
+	delay := cfg.RetryDelay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+
+	err := try(dir, false)
+	for i := 0; i < cfg.Retries && errors.Is(err, syscall.EBUSY); i++ {
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+
+		delay *= 2
+		err = try(dir, false)
+	}
+
+	if cfg.Lazy && errors.Is(err, syscall.EBUSY) {
+		err = try(dir, true)
+	}
+
+	return err
+}
@@ -3,19 +3,50 @@ package fuse
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func unmount(dir string) error {
+	return unmountLazily(dir, false)
+}
+
+// Unmount, detaching the file system lazily if asked to.
+func unmountLazily(dir string, lazy bool) error {
+	flags := 0
+	args := []string{"-u"}
+	if lazy {
+		flags = unix.MNT_DETACH
+		args = append(args, "-z")
+	}
+
+	// Try unmounting without fusermount(1) first, as when mounting: we might be
+	// running as root or have the CAP_SYS_ADMIN capability, and fusermount may
+	// not be installed at all (e.g. in a container).
+	fallback, err := directUnmountResult(dir, unix.Unmount(dir, flags))
+	if !fallback {
+		return err
+	}
+
 	fusermount, err := findFusermount()
 	if err != nil {
 		return err
 	}
-	cmd := exec.Command(fusermount, "-u", dir)
+	cmd := exec.Command(fusermount, append(args, dir)...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		if len(output) > 0 {
 			output = bytes.TrimRight(output, "\n")
+
+			// Let callers recognize a busy mount point, as when unmounting
+			// directly.
+			if bytes.Contains(bytes.ToLower(output), []byte("resource busy")) {
+				return fmt.Errorf("%v: %s: %w", err, output, syscall.EBUSY)
+			}
+
 			return fmt.Errorf("%v: %s", err, output)
 		}
 
@@ -23,3 +54,17 @@ func unmount(dir string) error {
 	}
 	return nil
 }
+
+// Interpret the result of unmount(2): we fall back to fusermount(1) only if
+// we are not permitted to unmount directly. Any other error, such as EBUSY or
+// EINVAL for a directory that is not a mount point, is returned as is.
+func directUnmountResult(dir string, err error) (fallback bool, _ error) {
+	switch err {
+	case nil:
+		return false, nil
+	case syscall.EPERM:
+		return true, nil
+	default:
+		return false, &os.PathError{Op: "unmount", Path: dir, Err: err}
+	}
+}
@@ -0,0 +1,49 @@
+package fuse
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestDirectUnmountResult(t *testing.T) {
+	testCases := []struct {
+		name         string
+		err          error
+		wantFallback bool
+		wantErr      error
+	}{
+		{"success", nil, false, nil},
+		{"not permitted", syscall.EPERM, true, nil},
+		{"busy", syscall.EBUSY, false, syscall.EBUSY},
+		{"not mounted", syscall.EINVAL, false, syscall.EINVAL},
+		{"no such directory", syscall.ENOENT, false, syscall.ENOENT},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fallback, err := directUnmountResult("/mnt/foo", tc.err)
+			if fallback != tc.wantFallback {
+				t.Errorf("fallback = %v, want %v", fallback, tc.wantFallback)
+			}
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var pathErr *os.PathError
+			if !errors.As(err, &pathErr) {
+				t.Fatalf("got %#v, want an *os.PathError", err)
+			}
+			if pathErr.Op != "unmount" || pathErr.Path != "/mnt/foo" {
+				t.Errorf("unexpected op or path: %v", pathErr)
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("got %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
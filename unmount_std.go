@@ -1,15 +1,27 @@
-//go:build !linux
-// +build !linux
+//go:build !linux && !windows
+// +build !linux,!windows
 
 package fuse
 
 import (
 	"os"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func unmount(dir string) error {
-	if err := syscall.Unmount(dir, 0); err != nil {
+	return unmountLazily(dir, false)
+}
+
+// There is no lazy unmount outside Linux; force it instead.
+func unmountLazily(dir string, lazy bool) error {
+	flags := 0
+	if lazy {
+		flags = unix.MNT_FORCE
+	}
+
+	if err := syscall.Unmount(dir, flags); err != nil {
 		return &os.PathError{Op: "unmount", Path: dir, Err: err}
 	}
 
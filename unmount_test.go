@@ -0,0 +1,79 @@
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_unmountWithRetries(t *testing.T) {
+	busy := &os.PathError{Op: "unmount", Path: "/mnt", Err: syscall.EBUSY}
+
+	type call struct {
+		dir  string
+		lazy bool
+	}
+
+	testCases := []struct {
+		cfg       UnmountConfig
+		busyTries int
+		wantCalls int
+		wantLazy  bool
+		wantErr   bool
+	}{
+		// Not busy.
+		{UnmountConfig{Retries: 3}, 0, 1, false, false},
+
+		// Busy for a while, and retried until it isn't.
+		{UnmountConfig{Retries: 3}, 2, 3, false, false},
+
+		// Busy for too long.
+		{UnmountConfig{Retries: 1}, 5, 2, false, true},
+
+		// Busy for too long, then detached.
+		{UnmountConfig{Retries: 1, Lazy: true}, 2, 3, true, false},
+
+		// No retries, straight to detaching.
+		{UnmountConfig{Lazy: true}, 1, 2, true, false},
+	}
+
+	for i, tc := range testCases {
+		tc.cfg.RetryDelay = time.Microsecond
+
+		var calls []call
+		try := func(dir string, lazy bool) error {
+			calls = append(calls, call{dir, lazy})
+			if len(calls) <= tc.busyTries {
+				return busy
+			}
+
+			return nil
+		}
+
+		err := unmountWithRetries(context.Background(), "/mnt", tc.cfg, try)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Case %d: got error %v", i, err)
+		}
+
+		if len(calls) != tc.wantCalls || calls[len(calls)-1].lazy != tc.wantLazy {
+			t.Errorf("Case %d: got calls %+v", i, calls)
+		}
+	}
+}
+
+func Test_unmountWithRetriesCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	try := func(dir string, lazy bool) error {
+		return fmt.Errorf("fusermount: %w", syscall.EBUSY)
+	}
+
+	cfg := UnmountConfig{Retries: 10, RetryDelay: time.Hour, Lazy: true}
+	if err := unmountWithRetries(ctx, "/mnt", cfg, try); err != context.Canceled {
+		t.Errorf("Got %v, want context.Canceled", err)
+	}
+}
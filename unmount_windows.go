@@ -0,0 +1,25 @@
+package fuse
+
+import (
+	"os"
+	"syscall"
+)
+
+func unmount(dir string) error {
+	return unmountLazily(dir, false)
+}
+
+// WinFsp doesn't wait for a file system to be idle before unmounting it, so
+// there is nothing lazier to fall back to. Only file systems mounted by this
+// process can be unmounted.
+func unmountLazily(dir string, lazy bool) error {
+	winfspHostsMu.Lock()
+	h := winfspHosts[dir]
+	winfspHostsMu.Unlock()
+
+	if h == nil || !h.host.Unmount() {
+		return &os.PathError{Op: "unmount", Path: dir, Err: syscall.EINVAL}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/uring"
+)
+
+// The io_uring instances for one device: one for reads and one for replies,
+// so that a read waiting for the next request doesn't hold up replies.
+type deviceRings struct {
+	reads  *uring.Ring
+	writes *uring.Ring
+}
+
+// Write the supplied reply to the device.
+func (r *deviceRings) write(outMsg *buffer.OutMessage) error {
+	sglist := outMsg.Sglist
+	if sglist == nil {
+		sglist = [][]byte{outMsg.OutHeaderBytes()}
+	}
+
+	n, err := r.writes.Writev(sglist)
+	if err != nil {
+		return err
+	}
+
+	if want := outMsg.Len(); n != want {
+		return fmt.Errorf("Wrote %d bytes; expected %d", n, want)
+	}
+
+	return nil
+}
+
+// Set up rings for each device, as asked by c.cfg.UseIOURing. If io_uring is
+// unavailable, the devices are read and written directly instead.
+func (c *Connection) setUpRings() {
+	rings := make(map[*os.File]*deviceRings)
+	for _, dev := range append([]*os.File{c.dev}, c.clones...) {
+		r, err := newDeviceRings(dev)
+		if err != nil {
+			c.logger.Errorf(LogMount, "Setting up io_uring: %v; using plain reads and writes", err)
+			closeRings(rings)
+			return
+		}
+
+		rings[dev] = r
+	}
+
+	c.rings = rings
+}
+
+func newDeviceRings(dev *os.File) (*deviceRings, error) {
+	reads, err := uring.New(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	writes, err := uring.New(dev)
+	if err != nil {
+		reads.Close()
+		return nil, err
+	}
+
+	return &deviceRings{reads: reads, writes: writes}, nil
+}
+
+// Release the rings, once nothing is reading or writing the devices any more.
+func (c *Connection) closeRings() {
+	closeRings(c.rings)
+}
+
+func closeRings(rings map[*os.File]*deviceRings) {
+	for _, r := range rings {
+		r.reads.Close()
+		r.writes.Close()
+	}
+}
@@ -0,0 +1,1321 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/winfsp/cgofuse/fuse"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// There is no fuse kernel module on Windows. Instead a winfspHost plays its
+// part: it mounts with WinFsp's FUSE layer (through cgofuse), and turns each
+// of the path-based calls that WinFsp makes into requests in the Linux
+// protocol, written to the kernel's end of a device pair (see newDevicePair).
+// The connection at the other end serves them as it would requests from
+// /dev/fuse, so that file systems are none the wiser.
+//
+// Like the kernel, the host looks up paths a component at a time, keeping
+// the entries until they expire, and sends forgets for the lookups of those
+// it drops.
+type winfspHost struct {
+	fuse.FileSystemBase
+
+	cfg    *MountConfig
+	kernel *os.File
+	host   *fuse.FileSystemHost
+
+	// The caller of the WinFsp call being served, to put in request headers.
+	// fuse.Getcontext, except in tests.
+	context func() (uid uint32, gid uint32, pid int)
+
+	// The largest write and read the connection accepts, as negotiated by
+	// init.
+	maxWrite int
+	maxRead  int
+
+	// Closed when replies can no longer be read.
+	done chan struct{}
+
+	unique atomic.Uint64
+
+	readyOnce sync.Once
+	ready     chan<- error
+
+	mu sync.Mutex
+
+	// Waiters for replies, by request.
+	//
+	// GUARDED_BY(mu)
+	pending map[uint64]chan []byte
+
+	// Entries looked up, by path.
+	//
+	// GUARDED_BY(mu)
+	nodes map[string]*winfspNode
+
+	// Open files and directories, by the handles given to WinFsp.
+	//
+	// GUARDED_BY(mu)
+	handles    map[uint64]winfspHandle
+	nextHandle uint64
+}
+
+type winfspNode struct {
+	inode   uint64
+	lookups uint64
+	expiry  time.Time
+}
+
+type winfspHandle struct {
+	inode  uint64
+	handle uint64
+}
+
+// The handle that WinFsp passes for calls on paths rather than open files.
+const winfspNoHandle = ^uint64(0)
+
+func newWinfspHost(kernel *os.File, cfg *MountConfig) *winfspHost {
+	h := &winfspHost{
+		cfg:     cfg,
+		kernel:  kernel,
+		context: fuse.Getcontext,
+		done:    make(chan struct{}),
+		pending: make(map[uint64]chan []byte),
+		nodes:   make(map[string]*winfspNode),
+		handles: make(map[uint64]winfspHandle),
+	}
+
+	h.host = fuse.NewFileSystemHost(h)
+	return h
+}
+
+////////////////////////////////////////////////////////////////////////
+// Requests and replies
+////////////////////////////////////////////////////////////////////////
+
+// The bytes of the supplied request struct, to send as they are.
+func structBytes(p unsafe.Pointer, size uintptr) []byte {
+	return unsafe.Slice((*byte)(p), size)
+}
+
+// A name, as requests carry it.
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// The leading struct of a reply, or nil if it is too short to hold one.
+func replyStruct(b []byte, size uintptr) unsafe.Pointer {
+	if uintptr(len(b)) < size {
+		return nil
+	}
+
+	return unsafe.Pointer(&b[0])
+}
+
+// Read replies from the connection for as long as it is there, handing each
+// to the request that awaits it. Notifications are dropped: WinFsp has no
+// caches for them to invalidate.
+func (h *winfspHost) readReplies() {
+	const hdrSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+
+	buf := make([]byte, buffer.MaxReadSize+buffer.OutMessageHeaderSize)
+	for {
+		n, err := h.kernel.Read(buf)
+		if err != nil {
+			close(h.done)
+			return
+		}
+
+		if n < hdrSize {
+			continue
+		}
+
+		unique := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0])).Unique
+		if unique == 0 {
+			continue
+		}
+
+		h.mu.Lock()
+		c := h.pending[unique]
+		delete(h.pending, unique)
+		h.mu.Unlock()
+
+		if c != nil {
+			c <- append([]byte(nil), buf[:n]...)
+		}
+	}
+}
+
+// Write a request to the connection, filling in its length.
+func (h *winfspHost) send(hdr fusekernel.InHeader, in ...[]byte) error {
+	n := fusekernel.InHeaderSize
+	for _, b := range in {
+		n += len(b)
+	}
+
+	hdr.Len = uint32(n)
+	msg := make([]byte, 0, n)
+	msg = append(msg, structBytes(unsafe.Pointer(&hdr), unsafe.Sizeof(hdr))...)
+	for _, b := range in {
+		msg = append(msg, b...)
+	}
+
+	return writeMessage(h.kernel, msg)
+}
+
+// Send a request and wait for its reply. Return what follows the reply's
+// header, or the errno in it.
+func (h *winfspHost) roundTrip(hdr fusekernel.InHeader, in ...[]byte) ([]byte, error) {
+	hdr.Unique = h.unique.Add(1)
+	c := make(chan []byte, 1)
+
+	h.mu.Lock()
+	h.pending[hdr.Unique] = c
+	h.mu.Unlock()
+
+	if err := h.send(hdr, in...); err != nil {
+		h.mu.Lock()
+		delete(h.pending, hdr.Unique)
+		h.mu.Unlock()
+
+		return nil, err
+	}
+
+	select {
+	case b := <-c:
+		out := (*fusekernel.OutHeader)(unsafe.Pointer(&b[0]))
+		if out.Error != 0 {
+			return nil, syscall.Errno(-out.Error)
+		}
+
+		return b[unsafe.Sizeof(*out):], nil
+
+	case <-h.done:
+		return nil, syscall.ENOTCONN
+	}
+}
+
+// Send a request on behalf of the caller of the WinFsp call being served.
+// Return what follows the reply's header, or the negated WinFsp error code
+// for the error.
+func (h *winfspHost) call(opcode uint32, inode uint64, in ...[]byte) ([]byte, int) {
+	uid, gid, pid := h.context()
+	b, err := h.roundTrip(
+		fusekernel.InHeader{
+			Opcode: opcode,
+			Nodeid: inode,
+			Uid:    uid,
+			Gid:    gid,
+			Pid:    uint32(pid),
+		},
+		in...)
+
+	return b, winfspErrc(err)
+}
+
+// Negotiate with the connection, as the kernel does before anything else.
+func (h *winfspHost) init() error {
+	in := fusekernel.InitIn{
+		Major:        fusekernel.ProtoVersionMaxMajor,
+		Minor:        fusekernel.ProtoVersionMaxMinor,
+		MaxReadahead: 128 << 10,
+		Flags:        uint32(fusekernel.InitBigWrites | fusekernel.InitMaxPages),
+	}
+
+	b, err := h.roundTrip(
+		fusekernel.InHeader{Opcode: fusekernel.OpInit},
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+	if err != nil {
+		return err
+	}
+
+	// Older protocol versions reply with less, but MaxWrite is in all of them.
+	const minSize = unsafe.Offsetof(fusekernel.InitOut{}.MaxWrite) + 4
+	if uintptr(len(b)) < minSize {
+		return errors.New("short reply to INIT")
+	}
+
+	var out fusekernel.InitOut
+	copy(structBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)), b)
+
+	h.maxWrite = int(out.MaxWrite)
+	if h.maxWrite <= 0 || h.maxWrite > buffer.MaxWriteSize {
+		h.maxWrite = buffer.MaxWriteSize
+	}
+
+	// Like the kernel, read no more than max_pages at a time, or than the
+	// default of 32 pages when the connection doesn't say.
+	pages := 32
+	const pagesSize = unsafe.Offsetof(fusekernel.InitOut{}.MaxPages) + 2
+	if out.Flags&uint32(fusekernel.InitMaxPages) != 0 &&
+		uintptr(len(b)) >= pagesSize &&
+		out.MaxPages > 0 {
+		pages = int(out.MaxPages)
+	}
+
+	h.maxRead = pages * os.Getpagesize()
+	if h.maxRead > buffer.MaxReadSize {
+		h.maxRead = buffer.MaxReadSize
+	}
+
+	return nil
+}
+
+// Tell the connection that the kernel is done with the supplied lookups.
+func (h *winfspHost) forget(n *winfspNode) {
+	in := fusekernel.ForgetIn{Nlookup: n.lookups}
+	h.send(
+		fusekernel.InHeader{
+			Opcode: fusekernel.OpForget,
+			Unique: h.unique.Add(1),
+			Nodeid: n.inode,
+		},
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+}
+
+// Report the outcome of mounting to Mount, once.
+func (h *winfspHost) signal(err error) {
+	h.readyOnce.Do(func() {
+		h.ready <- err
+	})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Errors
+////////////////////////////////////////////////////////////////////////
+
+// The WinFsp error codes for the errnos that the connection replies with,
+// which are those of package syscall.
+var winfspErrnos = map[syscall.Errno]int{
+	syscall.EPERM:        fuse.EPERM,
+	syscall.ENOENT:       fuse.ENOENT,
+	syscall.EINTR:        fuse.EINTR,
+	syscall.EIO:          fuse.EIO,
+	syscall.ENXIO:        fuse.ENXIO,
+	syscall.E2BIG:        fuse.E2BIG,
+	syscall.EBADF:        fuse.EBADF,
+	syscall.EAGAIN:       fuse.EAGAIN,
+	syscall.ENOMEM:       fuse.ENOMEM,
+	syscall.EACCES:       fuse.EACCES,
+	syscall.EFAULT:       fuse.EFAULT,
+	syscall.EBUSY:        fuse.EBUSY,
+	syscall.EEXIST:       fuse.EEXIST,
+	syscall.EXDEV:        fuse.EXDEV,
+	syscall.ENODEV:       fuse.ENODEV,
+	syscall.ENOTDIR:      fuse.ENOTDIR,
+	syscall.EISDIR:       fuse.EISDIR,
+	syscall.EINVAL:       fuse.EINVAL,
+	syscall.ENFILE:       fuse.ENFILE,
+	syscall.EMFILE:       fuse.EMFILE,
+	syscall.ENOTTY:       fuse.ENOTTY,
+	syscall.EFBIG:        fuse.EFBIG,
+	syscall.ENOSPC:       fuse.ENOSPC,
+	syscall.ESPIPE:       fuse.ESPIPE,
+	syscall.EROFS:        fuse.EROFS,
+	syscall.EMLINK:       fuse.EMLINK,
+	syscall.EPIPE:        fuse.EPIPE,
+	syscall.ERANGE:       fuse.ERANGE,
+	syscall.EDEADLK:      fuse.EDEADLK,
+	syscall.ENAMETOOLONG: fuse.ENAMETOOLONG,
+	syscall.ENOLCK:       fuse.ENOLCK,
+	syscall.ENOSYS:       fuse.ENOSYS,
+	syscall.ENOTEMPTY:    fuse.ENOTEMPTY,
+	syscall.ELOOP:        fuse.ELOOP,
+	syscall.ENODATA:      fuse.ENODATA,
+	syscall.EOVERFLOW:    fuse.EOVERFLOW,
+	syscall.EPROTO:       fuse.EPROTO,
+	syscall.ENOTSUP:      fuse.ENOTSUP,
+	syscall.ENOTCONN:     fuse.ENOTCONN,
+	syscall.ETIMEDOUT:    fuse.ETIMEDOUT,
+	syscall.ECANCELED:    fuse.ECANCELED,
+}
+
+// The negated WinFsp error code for an error from roundTrip, or zero for
+// none.
+func winfspErrc(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if errc, ok := winfspErrnos[errno]; ok {
+			return -errc
+		}
+	}
+
+	return -fuse.EIO
+}
+
+////////////////////////////////////////////////////////////////////////
+// Paths and handles
+////////////////////////////////////////////////////////////////////////
+
+// Split a path into its parent's path and its final component.
+func splitPath(path string) (dir, name string) {
+	i := strings.LastIndexByte(path, '/')
+	dir, name = path[:i], path[i+1:]
+	if dir == "" {
+		dir = "/"
+	}
+
+	return dir, name
+}
+
+// Whether path is under dir, or is dir itself.
+func underPath(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// The inode for the supplied path, looking up any component whose entry
+// isn't cached or has expired.
+func (h *winfspHost) inode(path string) (uint64, int) {
+	if path == "/" || path == "" {
+		return uint64(fuseops.RootInodeID), 0
+	}
+
+	h.mu.Lock()
+	n := h.nodes[path]
+	if n != nil && time.Now().Before(n.expiry) {
+		inode := n.inode
+		h.mu.Unlock()
+		return inode, 0
+	}
+	h.mu.Unlock()
+
+	dir, name := splitPath(path)
+	parent, errc := h.inode(dir)
+	if errc != 0 {
+		return 0, errc
+	}
+
+	b, errc := h.call(fusekernel.OpLookup, parent, cstring(name))
+	if errc == -fuse.ENOENT {
+		h.drop(path)
+	}
+
+	if errc != 0 {
+		return 0, errc
+	}
+
+	return h.entry(path, b)
+}
+
+// Note the entry in a reply to a request that creates or looks up path,
+// which counts as a lookup of its inode.
+func (h *winfspHost) entry(path string, b []byte) (uint64, int) {
+	e := (*fusekernel.EntryOut)(replyStruct(b, unsafe.Sizeof(fusekernel.EntryOut{})))
+	if e == nil {
+		return 0, -fuse.EIO
+	}
+
+	// A negative entry, cached by the kernel. There's no lookup to forget.
+	if e.Nodeid == 0 {
+		h.drop(path)
+		return 0, -fuse.ENOENT
+	}
+
+	valid := time.Duration(e.EntryValid)*time.Second + time.Duration(e.EntryValidNsec)
+
+	h.mu.Lock()
+	n := h.nodes[path]
+	var stale *winfspNode
+	if n != nil && n.inode != e.Nodeid {
+		stale, n = n, nil
+	}
+
+	if n == nil {
+		n = &winfspNode{inode: e.Nodeid}
+		h.nodes[path] = n
+	}
+
+	n.lookups++
+	n.expiry = time.Now().Add(valid)
+	h.mu.Unlock()
+
+	if stale != nil {
+		h.forget(stale)
+	}
+
+	return e.Nodeid, 0
+}
+
+// Forget the entries for path and anything under it.
+func (h *winfspHost) drop(path string) {
+	h.mu.Lock()
+	var stale []*winfspNode
+	for p, n := range h.nodes {
+		if underPath(p, path) {
+			stale = append(stale, n)
+			delete(h.nodes, p)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, n := range stale {
+		h.forget(n)
+	}
+}
+
+// Move the entries for oldpath and anything under it to newpath, forgetting
+// those that they replace.
+func (h *winfspHost) move(oldpath, newpath string) {
+	h.drop(newpath)
+
+	h.mu.Lock()
+	moved := make(map[string]*winfspNode)
+	for p, n := range h.nodes {
+		if underPath(p, oldpath) {
+			moved[newpath+p[len(oldpath):]] = n
+			delete(h.nodes, p)
+		}
+	}
+
+	for p, n := range moved {
+		h.nodes[p] = n
+	}
+	h.mu.Unlock()
+}
+
+// Give WinFsp a handle for a file or directory opened by the file system.
+// The file system's own handles needn't be unique, as they are only ever
+// used along with the inode.
+func (h *winfspHost) newHandle(inode, handle uint64) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextHandle++
+	h.handles[h.nextHandle] = winfspHandle{inode, handle}
+	return h.nextHandle
+}
+
+func (h *winfspHost) closeHandle(fh uint64) (winfspHandle, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hd, ok := h.handles[fh]
+	delete(h.handles, fh)
+	return hd, ok
+}
+
+// The inode and file system handle that a call is for: those of the open
+// file if WinFsp passes one, else the path's.
+func (h *winfspHost) target(path string, fh uint64) (winfspHandle, bool, int) {
+	if fh != winfspNoHandle {
+		h.mu.Lock()
+		hd, ok := h.handles[fh]
+		h.mu.Unlock()
+
+		if ok {
+			return hd, true, 0
+		}
+	}
+
+	inode, errc := h.inode(path)
+	return winfspHandle{inode: inode}, false, errc
+}
+
+////////////////////////////////////////////////////////////////////////
+// Conversions
+////////////////////////////////////////////////////////////////////////
+
+// Translate WinFsp's open flags into those of package syscall, which the
+// connection expects.
+func winfspOpenFlags(flags int) uint32 {
+	out := uint32(flags & fuse.O_ACCMODE)
+	for _, f := range []struct {
+		winfsp  int
+		syscall uint32
+	}{
+		{fuse.O_APPEND, syscall.O_APPEND},
+		{fuse.O_CREAT, syscall.O_CREAT},
+		{fuse.O_EXCL, syscall.O_EXCL},
+		{fuse.O_TRUNC, syscall.O_TRUNC},
+	} {
+		if flags&f.winfsp != 0 {
+			out |= f.syscall
+		}
+	}
+
+	return out
+}
+
+func winfspStat(stat *fuse.Stat_t, a *fusekernel.Attr) {
+	*stat = fuse.Stat_t{
+		Ino:     a.Ino,
+		Mode:    a.Mode,
+		Nlink:   a.Nlink,
+		Uid:     a.Uid,
+		Gid:     a.Gid,
+		Rdev:    uint64(a.Rdev),
+		Size:    int64(a.Size),
+		Atim:    fuse.Timespec{Sec: int64(a.Atime), Nsec: int64(a.AtimeNsec)},
+		Mtim:    fuse.Timespec{Sec: int64(a.Mtime), Nsec: int64(a.MtimeNsec)},
+		Ctim:    fuse.Timespec{Sec: int64(a.Ctime), Nsec: int64(a.CtimeNsec)},
+		Blksize: int64(a.Blksize),
+		Blocks:  int64(a.Blocks),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// fuse.FileSystemInterface
+////////////////////////////////////////////////////////////////////////
+
+func (h *winfspHost) Init() {
+	h.signal(nil)
+}
+
+func (h *winfspHost) Destroy() {
+	h.roundTrip(fusekernel.InHeader{Opcode: fusekernel.OpDestroy})
+}
+
+func (h *winfspHost) Statfs(path string, stat *fuse.Statfs_t) int {
+	b, errc := h.call(fusekernel.OpStatfs, uint64(fuseops.RootInodeID))
+	if errc != 0 {
+		return errc
+	}
+
+	out := (*fusekernel.StatfsOut)(replyStruct(b, unsafe.Sizeof(fusekernel.StatfsOut{})))
+	if out == nil {
+		return -fuse.EIO
+	}
+
+	*stat = fuse.Statfs_t{
+		Bsize:   uint64(out.St.Bsize),
+		Frsize:  uint64(out.St.Frsize),
+		Blocks:  out.St.Blocks,
+		Bfree:   out.St.Bfree,
+		Bavail:  out.St.Bavail,
+		Files:   out.St.Files,
+		Ffree:   out.St.Ffree,
+		Favail:  out.St.Ffree,
+		Namemax: uint64(out.St.Namelen),
+	}
+
+	return 0
+}
+
+// Send a request that creates an entry named by the last component of path,
+// and note the entry in the reply.
+func (h *winfspHost) create(opcode uint32, path string, in ...[]byte) ([]byte, int) {
+	if h.cfg.ReadOnly {
+		return nil, -fuse.EROFS
+	}
+
+	dir, _ := splitPath(path)
+	parent, errc := h.inode(dir)
+	if errc != 0 {
+		return nil, errc
+	}
+
+	b, errc := h.call(opcode, parent, in...)
+	if errc != 0 {
+		return nil, errc
+	}
+
+	if _, errc := h.entry(path, b); errc != 0 {
+		return nil, errc
+	}
+
+	return b, 0
+}
+
+func (h *winfspHost) Mknod(path string, mode uint32, dev uint64) int {
+	_, name := splitPath(path)
+	in := fusekernel.MknodIn{Mode: mode, Rdev: uint32(dev)}
+	_, errc := h.create(
+		fusekernel.OpMknod,
+		path,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+		cstring(name))
+
+	return errc
+}
+
+func (h *winfspHost) Mkdir(path string, mode uint32) int {
+	_, name := splitPath(path)
+	in := fusekernel.MkdirIn{Mode: mode}
+	_, errc := h.create(
+		fusekernel.OpMkdir,
+		path,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+		cstring(name))
+
+	return errc
+}
+
+func (h *winfspHost) Symlink(target string, newpath string) int {
+	_, name := splitPath(newpath)
+	_, errc := h.create(
+		fusekernel.OpSymlink,
+		newpath,
+		cstring(name),
+		cstring(target))
+
+	return errc
+}
+
+func (h *winfspHost) Link(oldpath string, newpath string) int {
+	if h.cfg.ReadOnly {
+		return -fuse.EROFS
+	}
+
+	inode, errc := h.inode(oldpath)
+	if errc != 0 {
+		return errc
+	}
+
+	_, name := splitPath(newpath)
+	in := fusekernel.LinkIn{Oldnodeid: inode}
+	_, errc = h.create(
+		fusekernel.OpLink,
+		newpath,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+		cstring(name))
+
+	return errc
+}
+
+// Remove the entry for path with UNLINK or RMDIR.
+func (h *winfspHost) remove(opcode uint32, path string) int {
+	if h.cfg.ReadOnly {
+		return -fuse.EROFS
+	}
+
+	dir, name := splitPath(path)
+	parent, errc := h.inode(dir)
+	if errc != 0 {
+		return errc
+	}
+
+	if _, errc := h.call(opcode, parent, cstring(name)); errc != 0 {
+		return errc
+	}
+
+	h.drop(path)
+	return 0
+}
+
+func (h *winfspHost) Unlink(path string) int {
+	return h.remove(fusekernel.OpUnlink, path)
+}
+
+func (h *winfspHost) Rmdir(path string) int {
+	return h.remove(fusekernel.OpRmdir, path)
+}
+
+func (h *winfspHost) Rename(oldpath string, newpath string) int {
+	if h.cfg.ReadOnly {
+		return -fuse.EROFS
+	}
+
+	olddir, oldname := splitPath(oldpath)
+	newdir, newname := splitPath(newpath)
+
+	oldparent, errc := h.inode(olddir)
+	if errc != 0 {
+		return errc
+	}
+
+	newparent, errc := h.inode(newdir)
+	if errc != 0 {
+		return errc
+	}
+
+	in := fusekernel.RenameIn{Newdir: newparent}
+	_, errc = h.call(
+		fusekernel.OpRename,
+		oldparent,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+		cstring(oldname),
+		cstring(newname))
+	if errc != 0 {
+		return errc
+	}
+
+	h.move(oldpath, newpath)
+	return 0
+}
+
+func (h *winfspHost) Readlink(path string) (int, string) {
+	inode, errc := h.inode(path)
+	if errc != 0 {
+		return errc, ""
+	}
+
+	b, errc := h.call(fusekernel.OpReadlink, inode)
+	if errc != 0 {
+		return errc, ""
+	}
+
+	return 0, string(b)
+}
+
+// Change the attributes selected by in.Valid.
+func (h *winfspHost) setattr(path string, fh uint64, in *fusekernel.SetattrIn) int {
+	if h.cfg.ReadOnly {
+		return -fuse.EROFS
+	}
+
+	hd, open, errc := h.target(path, fh)
+	if errc != 0 {
+		return errc
+	}
+
+	if open {
+		in.Valid |= uint32(fusekernel.SetattrHandle)
+		in.Fh = hd.handle
+	}
+
+	_, errc = h.call(
+		fusekernel.OpSetattr,
+		hd.inode,
+		structBytes(unsafe.Pointer(in), unsafe.Sizeof(*in)))
+
+	return errc
+}
+
+func (h *winfspHost) Chmod(path string, mode uint32) int {
+	var in fusekernel.SetattrIn
+	in.Valid = uint32(fusekernel.SetattrMode)
+	in.Mode = mode
+	return h.setattr(path, winfspNoHandle, &in)
+}
+
+func (h *winfspHost) Chown(path string, uid uint32, gid uint32) int {
+	var in fusekernel.SetattrIn
+	if uid != ^uint32(0) {
+		in.Valid |= uint32(fusekernel.SetattrUid)
+		in.Uid = uid
+	}
+
+	if gid != ^uint32(0) {
+		in.Valid |= uint32(fusekernel.SetattrGid)
+		in.Gid = gid
+	}
+
+	return h.setattr(path, winfspNoHandle, &in)
+}
+
+func (h *winfspHost) Utimens(path string, tmsp []fuse.Timespec) int {
+	var in fusekernel.SetattrIn
+	if len(tmsp) < 2 {
+		in.Valid = uint32(fusekernel.SetattrAtimeNow | fusekernel.SetattrMtimeNow)
+		return h.setattr(path, winfspNoHandle, &in)
+	}
+
+	switch tmsp[0].Nsec {
+	case fuse.UTIME_OMIT:
+	case fuse.UTIME_NOW:
+		in.Valid |= uint32(fusekernel.SetattrAtime | fusekernel.SetattrAtimeNow)
+	default:
+		in.Valid |= uint32(fusekernel.SetattrAtime)
+		in.Atime = uint64(tmsp[0].Sec)
+		in.AtimeNsec = uint32(tmsp[0].Nsec)
+	}
+
+	switch tmsp[1].Nsec {
+	case fuse.UTIME_OMIT:
+	case fuse.UTIME_NOW:
+		in.Valid |= uint32(fusekernel.SetattrMtime | fusekernel.SetattrMtimeNow)
+	default:
+		in.Valid |= uint32(fusekernel.SetattrMtime)
+		in.Mtime = uint64(tmsp[1].Sec)
+		in.MtimeNsec = uint32(tmsp[1].Nsec)
+	}
+
+	return h.setattr(path, winfspNoHandle, &in)
+}
+
+func (h *winfspHost) Truncate(path string, size int64, fh uint64) int {
+	var in fusekernel.SetattrIn
+	in.Valid = uint32(fusekernel.SetattrSize)
+	in.Size = uint64(size)
+	return h.setattr(path, fh, &in)
+}
+
+func (h *winfspHost) Access(path string, mask uint32) int {
+	inode, errc := h.inode(path)
+	if errc != 0 {
+		return errc
+	}
+
+	in := fusekernel.AccessIn{Mask: mask}
+	_, errc = h.call(
+		fusekernel.OpAccess,
+		inode,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+	// As for the kernel, a file system that doesn't check access allows it.
+	if errc == -fuse.ENOSYS {
+		return 0
+	}
+
+	return errc
+}
+
+func (h *winfspHost) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
+	hd, open, errc := h.target(path, fh)
+	if errc != 0 {
+		return errc
+	}
+
+	var in fusekernel.GetattrIn
+	if open {
+		in.GetattrFlags = uint32(fusekernel.GetattrFh)
+		in.Fh = hd.handle
+	}
+
+	b, errc := h.call(
+		fusekernel.OpGetattr,
+		hd.inode,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+	if errc != 0 {
+		return errc
+	}
+
+	out := (*fusekernel.AttrOut)(replyStruct(b, unsafe.Sizeof(fusekernel.AttrOut{})))
+	if out == nil {
+		return -fuse.EIO
+	}
+
+	winfspStat(stat, &out.Attr)
+	return 0
+}
+
+// Whether flags open a file for anything other than reading.
+func winfspWrites(flags int) bool {
+	return flags&fuse.O_ACCMODE != fuse.O_RDONLY || flags&fuse.O_TRUNC != 0
+}
+
+func (h *winfspHost) Create(path string, flags int, mode uint32) (int, uint64) {
+	_, name := splitPath(path)
+	in := fusekernel.CreateIn{
+		Flags: winfspOpenFlags(flags),
+		Mode:  mode,
+	}
+
+	b, errc := h.create(
+		fusekernel.OpCreate,
+		path,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+		cstring(name))
+	if errc != 0 {
+		return errc, winfspNoHandle
+	}
+
+	e := (*fusekernel.EntryOut)(unsafe.Pointer(&b[0]))
+	out := (*fusekernel.OpenOut)(replyStruct(
+		b[unsafe.Sizeof(*e):],
+		unsafe.Sizeof(fusekernel.OpenOut{})))
+	if out == nil {
+		return -fuse.EIO, winfspNoHandle
+	}
+
+	return 0, h.newHandle(e.Nodeid, out.Fh)
+}
+
+// Open a file or directory with OPEN or OPENDIR.
+func (h *winfspHost) open(opcode uint32, path string, flags int) (int, uint64) {
+	if h.cfg.ReadOnly && winfspWrites(flags) {
+		return -fuse.EROFS, winfspNoHandle
+	}
+
+	inode, errc := h.inode(path)
+	if errc != 0 {
+		return errc, winfspNoHandle
+	}
+
+	in := fusekernel.OpenIn{Flags: winfspOpenFlags(flags)}
+	b, errc := h.call(
+		opcode,
+		inode,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+	// As for the kernel, with EnableNoOpenSupport or EnableNoOpendirSupport
+	// the file system doesn't want to be told about opens.
+	if errc == -fuse.ENOSYS {
+		return 0, h.newHandle(inode, 0)
+	}
+
+	if errc != 0 {
+		return errc, winfspNoHandle
+	}
+
+	out := (*fusekernel.OpenOut)(replyStruct(b, unsafe.Sizeof(fusekernel.OpenOut{})))
+	if out == nil {
+		return -fuse.EIO, winfspNoHandle
+	}
+
+	return 0, h.newHandle(inode, out.Fh)
+}
+
+func (h *winfspHost) Open(path string, flags int) (int, uint64) {
+	return h.open(fusekernel.OpOpen, path, flags)
+}
+
+func (h *winfspHost) Opendir(path string) (int, uint64) {
+	return h.open(fusekernel.OpOpendir, path, fuse.O_RDONLY)
+}
+
+func (h *winfspHost) Read(path string, buff []byte, ofst int64, fh uint64) int {
+	hd, _, errc := h.target(path, fh)
+	if errc != 0 {
+		return errc
+	}
+
+	var n int
+	for n < len(buff) {
+		size := len(buff) - n
+		if size > h.maxRead {
+			size = h.maxRead
+		}
+
+		in := fusekernel.ReadIn{
+			Fh:     hd.handle,
+			Offset: uint64(ofst) + uint64(n),
+			Size:   uint32(size),
+		}
+
+		b, errc := h.call(
+			fusekernel.OpRead,
+			hd.inode,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+		if errc != 0 {
+			if n > 0 {
+				break
+			}
+
+			return errc
+		}
+
+		n += copy(buff[n:], b)
+		if len(b) < size {
+			break
+		}
+	}
+
+	return n
+}
+
+func (h *winfspHost) Write(path string, buff []byte, ofst int64, fh uint64) int {
+	if h.cfg.ReadOnly {
+		return -fuse.EROFS
+	}
+
+	hd, _, errc := h.target(path, fh)
+	if errc != 0 {
+		return errc
+	}
+
+	var n int
+	for n < len(buff) {
+		chunk := buff[n:]
+		if len(chunk) > h.maxWrite {
+			chunk = chunk[:h.maxWrite]
+		}
+
+		in := fusekernel.WriteIn{
+			Fh:     hd.handle,
+			Offset: uint64(ofst) + uint64(n),
+			Size:   uint32(len(chunk)),
+		}
+
+		b, errc := h.call(
+			fusekernel.OpWrite,
+			hd.inode,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+			chunk)
+		if errc != 0 {
+			if n > 0 {
+				break
+			}
+
+			return errc
+		}
+
+		out := (*fusekernel.WriteOut)(replyStruct(b, unsafe.Sizeof(fusekernel.WriteOut{})))
+		if out == nil {
+			return -fuse.EIO
+		}
+
+		n += int(out.Size)
+		if int(out.Size) < len(chunk) {
+			break
+		}
+	}
+
+	return n
+}
+
+func (h *winfspHost) Flush(path string, fh uint64) int {
+	hd, _, errc := h.target(path, fh)
+	if errc != 0 {
+		return errc
+	}
+
+	in := fusekernel.FlushIn{Fh: hd.handle}
+	_, errc = h.call(
+		fusekernel.OpFlush,
+		hd.inode,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+	if errc == -fuse.ENOSYS {
+		return 0
+	}
+
+	return errc
+}
+
+// Flush a file or directory with FSYNC or FSYNCDIR.
+func (h *winfspHost) fsync(opcode uint32, path string, datasync bool, fh uint64) int {
+	hd, _, errc := h.target(path, fh)
+	if errc != 0 {
+		return errc
+	}
+
+	in := fusekernel.FsyncIn{Fh: hd.handle}
+	if datasync {
+		in.FsyncFlags = 1
+	}
+
+	_, errc = h.call(
+		opcode,
+		hd.inode,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+	if errc == -fuse.ENOSYS {
+		return 0
+	}
+
+	return errc
+}
+
+func (h *winfspHost) Fsync(path string, datasync bool, fh uint64) int {
+	return h.fsync(fusekernel.OpFsync, path, datasync, fh)
+}
+
+func (h *winfspHost) Fsyncdir(path string, datasync bool, fh uint64) int {
+	return h.fsync(fusekernel.OpFsyncdir, path, datasync, fh)
+}
+
+// Close a file or directory with RELEASE or RELEASEDIR.
+func (h *winfspHost) release(opcode uint32, fh uint64) int {
+	hd, ok := h.closeHandle(fh)
+	if !ok {
+		return -fuse.EBADF
+	}
+
+	in := fusekernel.ReleaseIn{Fh: hd.handle}
+	_, errc := h.call(
+		opcode,
+		hd.inode,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+	return errc
+}
+
+func (h *winfspHost) Release(path string, fh uint64) int {
+	return h.release(fusekernel.OpRelease, fh)
+}
+
+func (h *winfspHost) Releasedir(path string, fh uint64) int {
+	return h.release(fusekernel.OpReleasedir, fh)
+}
+
+// How much to ask for at a time when reading a directory.
+const winfspReaddirSize = 64 << 10
+
+// Read the whole directory in one go, as WinFsp allows by passing a zero
+// offset to fill.
+func (h *winfspHost) Readdir(
+	path string,
+	fill func(name string, stat *fuse.Stat_t, ofst int64) bool,
+	ofst int64,
+	fh uint64) int {
+	hd, _, errc := h.target(path, fh)
+	if errc != 0 {
+		return errc
+	}
+
+	var offset uint64
+	for {
+		in := fusekernel.ReadIn{
+			Fh:     hd.handle,
+			Offset: offset,
+			Size:   winfspReaddirSize,
+		}
+
+		b, errc := h.call(
+			fusekernel.OpReaddir,
+			hd.inode,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+		if errc != 0 {
+			return errc
+		}
+
+		if len(b) == 0 {
+			return 0
+		}
+
+		for len(b) >= fusekernel.DirentSize {
+			d := (*fusekernel.Dirent)(unsafe.Pointer(&b[0]))
+			end := fusekernel.DirentSize + int(d.Namelen)
+			if end > len(b) {
+				return -fuse.EIO
+			}
+
+			if !fill(string(b[fusekernel.DirentSize:end]), nil, 0) {
+				return 0
+			}
+
+			offset = d.Off
+
+			// Entries are padded to a multiple of eight bytes.
+			end = (end + 7) &^ 7
+			if end > len(b) {
+				end = len(b)
+			}
+
+			b = b[end:]
+		}
+	}
+}
+
+func (h *winfspHost) Setxattr(path string, name string, value []byte, flags int) int {
+	if h.cfg.ReadOnly {
+		return -fuse.EROFS
+	}
+
+	inode, errc := h.inode(path)
+	if errc != 0 {
+		return errc
+	}
+
+	var in fusekernel.SetxattrIn
+	in.Size = uint32(len(value))
+	in.Flags = uint32(flags)
+	_, errc = h.call(
+		fusekernel.OpSetxattr,
+		inode,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+		cstring(name),
+		value)
+
+	return errc
+}
+
+// Send GETXATTR or LISTXATTR, first to learn the size of the value, then to
+// read it. The request struct is the same for both.
+func (h *winfspHost) xattr(opcode uint32, inode uint64, name []byte) ([]byte, int) {
+	var size uint32
+	for {
+		var in fusekernel.GetxattrIn
+		in.Size = size
+
+		b, errc := h.call(
+			opcode,
+			inode,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)),
+			name)
+
+		switch {
+		// The value grew since its size was asked for.
+		case errc == -fuse.ERANGE && size > 0:
+			size = 0
+			continue
+
+		case errc != 0:
+			return nil, errc
+
+		case size > 0:
+			return b, 0
+		}
+
+		out := (*fusekernel.GetxattrOut)(replyStruct(b, unsafe.Sizeof(fusekernel.GetxattrOut{})))
+		switch {
+		case out == nil:
+			return nil, -fuse.EIO
+
+		case out.Size == 0:
+			return nil, 0
+
+		case out.Size > buffer.MaxReadSize:
+			return nil, -fuse.E2BIG
+		}
+
+		size = out.Size
+	}
+}
+
+func (h *winfspHost) Getxattr(path string, name string) (int, []byte) {
+	inode, errc := h.inode(path)
+	if errc != 0 {
+		return errc, nil
+	}
+
+	b, errc := h.xattr(fusekernel.OpGetxattr, inode, cstring(name))
+	return errc, b
+}
+
+func (h *winfspHost) Listxattr(path string, fill func(name string) bool) int {
+	inode, errc := h.inode(path)
+	if errc != 0 {
+		return errc
+	}
+
+	b, errc := h.xattr(fusekernel.OpListxattr, inode, nil)
+	if errc != 0 {
+		return errc
+	}
+
+	for _, name := range strings.Split(string(b), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		if !fill(name) {
+			return -fuse.ERANGE
+		}
+	}
+
+	return 0
+}
+
+func (h *winfspHost) Removexattr(path string, name string) int {
+	if h.cfg.ReadOnly {
+		return -fuse.EROFS
+	}
+
+	inode, errc := h.inode(path)
+	if errc != 0 {
+		return errc
+	}
+
+	_, errc = h.call(fusekernel.OpRemovexattr, inode, cstring(name))
+	return errc
+}
@@ -0,0 +1,467 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/winfsp/cgofuse/fuse"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A small in-memory tree, served straight from ops, for exercising the
+// WinFsp host against a real connection without WinFsp.
+type winfspTestFS struct {
+	mu       sync.Mutex
+	nodes    map[fuseops.InodeID]*winfspTestNode
+	next     fuseops.InodeID
+	lookups  map[fuseops.InodeID]uint64
+	forgets  map[fuseops.InodeID]uint64
+	maxWrite int
+	maxRead  int
+}
+
+type winfspTestNode struct {
+	children map[string]fuseops.InodeID // nil for files
+	data     []byte
+}
+
+func newWinfspTestFS() *winfspTestFS {
+	return &winfspTestFS{
+		nodes: map[fuseops.InodeID]*winfspTestNode{
+			fuseops.RootInodeID: {children: make(map[string]fuseops.InodeID)},
+		},
+		next:    fuseops.RootInodeID + 1,
+		lookups: make(map[fuseops.InodeID]uint64),
+		forgets: make(map[fuseops.InodeID]uint64),
+	}
+}
+
+// Files are opened with a handle derived from the inode, so that ops on the
+// wrong handle can be caught.
+func winfspTestHandle(id fuseops.InodeID) fuseops.HandleID {
+	return fuseops.HandleID(id + 100)
+}
+
+func (fs *winfspTestFS) attributes(id fuseops.InodeID) fuseops.InodeAttributes {
+	n := fs.nodes[id]
+	if n.children != nil {
+		return fuseops.InodeAttributes{Nlink: 1, Mode: os.ModeDir | 0755}
+	}
+
+	return fuseops.InodeAttributes{Nlink: 1, Mode: 0644, Size: uint64(len(n.data))}
+}
+
+func (fs *winfspTestFS) entry(id fuseops.InodeID, e *fuseops.ChildInodeEntry) {
+	fs.lookups[id]++
+	e.Child = id
+	e.Attributes = fs.attributes(id)
+}
+
+func (fs *winfspTestFS) create(
+	parent fuseops.InodeID,
+	name string,
+	dir bool,
+	e *fuseops.ChildInodeEntry) error {
+	p := fs.nodes[parent]
+	if _, ok := p.children[name]; ok {
+		return EEXIST
+	}
+
+	n := &winfspTestNode{}
+	if dir {
+		n.children = make(map[string]fuseops.InodeID)
+	}
+
+	id := fs.next
+	fs.next++
+	fs.nodes[id] = n
+	p.children[name] = id
+	fs.entry(id, e)
+	return nil
+}
+
+func (fs *winfspTestFS) serve(op interface{}) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch op := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		id, ok := fs.nodes[op.Parent].children[op.Name]
+		if !ok {
+			return ENOENT
+		}
+
+		fs.entry(id, &op.Entry)
+
+	case *fuseops.ForgetInodeOp:
+		fs.forgets[op.Inode] += op.N
+
+	case *fuseops.GetInodeAttributesOp:
+		op.Attributes = fs.attributes(op.Inode)
+
+	case *fuseops.SetInodeAttributesOp:
+		n := fs.nodes[op.Inode]
+		if op.Handle != nil && *op.Handle != winfspTestHandle(op.Inode) {
+			return EBADF
+		}
+
+		if op.Size != nil {
+			data := make([]byte, *op.Size)
+			copy(data, n.data)
+			n.data = data
+		}
+
+		op.Attributes = fs.attributes(op.Inode)
+
+	case *fuseops.MkDirOp:
+		return fs.create(op.Parent, op.Name, true, &op.Entry)
+
+	case *fuseops.CreateFileOp:
+		op.Handle = winfspTestHandle(fs.next)
+		return fs.create(op.Parent, op.Name, false, &op.Entry)
+
+	case *fuseops.OpenFileOp:
+		op.Handle = winfspTestHandle(op.Inode)
+
+	case *fuseops.WriteFileOp:
+		n := fs.nodes[op.Inode]
+		if op.Handle != winfspTestHandle(op.Inode) {
+			return EBADF
+		}
+
+		if len(op.Data) > fs.maxWrite {
+			fs.maxWrite = len(op.Data)
+		}
+
+		if end := int(op.Offset) + len(op.Data); end > len(n.data) {
+			n.data = append(n.data, make([]byte, end-len(n.data))...)
+		}
+
+		copy(n.data[op.Offset:], op.Data)
+
+	case *fuseops.ReadFileOp:
+		n := fs.nodes[op.Inode]
+		if op.Handle != winfspTestHandle(op.Inode) {
+			return EBADF
+		}
+
+		if len(op.Dst) > fs.maxRead {
+			fs.maxRead = len(op.Dst)
+		}
+
+		if op.Offset < int64(len(n.data)) {
+			op.BytesRead = copy(op.Dst, n.data[op.Offset:])
+		}
+
+	case *fuseops.OpenDirOp:
+
+	case *fuseops.ReadDirOp:
+		var names []string
+		for name := range fs.nodes[op.Inode].children {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+		for i := int(op.Offset); i < len(names); i++ {
+			n := writeWinfspTestDirent(
+				op.Dst[op.BytesRead:],
+				uint64(fs.nodes[op.Inode].children[names[i]]),
+				uint64(i+1),
+				names[i])
+			if n == 0 {
+				break
+			}
+
+			op.BytesRead += n
+		}
+
+	case *fuseops.UnlinkOp:
+		delete(fs.nodes[op.Parent].children, op.Name)
+
+	case *fuseops.RenameOp:
+		id, ok := fs.nodes[op.OldParent].children[op.OldName]
+		if !ok {
+			return ENOENT
+		}
+
+		delete(fs.nodes[op.OldParent].children, op.OldName)
+		fs.nodes[op.NewParent].children[op.NewName] = id
+
+	case *fuseops.StatFSOp:
+		op.BlockSize = 4096
+		op.Blocks = 42
+
+	case *fuseops.FlushFileOp,
+		*fuseops.ReleaseFileHandleOp,
+		*fuseops.ReleaseDirHandleOp:
+
+	default:
+		return ENOSYS
+	}
+
+	return nil
+}
+
+func (fs *winfspTestFS) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		c.Reply(ctx, fs.serve(op))
+	}
+}
+
+// Write a struct fuse_dirent, returning zero if it doesn't fit.
+func writeWinfspTestDirent(buf []byte, ino, off uint64, name string) int {
+	n := (fusekernel.DirentSize + len(name) + 7) &^ 7
+	if n > len(buf) {
+		return 0
+	}
+
+	d := (*fusekernel.Dirent)(unsafe.Pointer(&buf[0]))
+	d.Ino = ino
+	d.Off = off
+	d.Namelen = uint32(len(name))
+	copy(buf[fusekernel.DirentSize:n], name)
+	return n
+}
+
+// Serve fs through a connection at the other end of a device pair from a
+// winfspHost, which is returned initialized but not mounted.
+func newTestWinfspHost(t *testing.T, cfg MountConfig, fs Server) *winfspHost {
+	kernel, dev, err := newDevicePair()
+	if err != nil {
+		t.Fatalf("newDevicePair: %v", err)
+	}
+
+	h := newWinfspHost(kernel, &cfg)
+	h.context = func() (uint32, uint32, int) { return 0, 0, 0 }
+	go h.readReplies()
+
+	initErr := make(chan error, 1)
+	go func() {
+		initErr <- h.init()
+	}()
+
+	cfg.OpContext = context.Background()
+	c, err := newConnection(cfg, NewLevelLogger(log.New(io.Discard, "", 0), LogError), dev)
+	if err != nil {
+		kernel.Close()
+		t.Fatalf("newConnection: %v", err)
+	}
+
+	if err := <-initErr; err != nil {
+		kernel.Close()
+		t.Fatalf("init: %v", err)
+	}
+
+	served := make(chan struct{})
+	go func() {
+		fs.ServeOps(c)
+		c.close()
+		close(served)
+	}()
+
+	t.Cleanup(func() {
+		hangUp(kernel)
+		<-served
+		kernel.Close()
+	})
+
+	return h
+}
+
+func TestWinfspHost(t *testing.T) {
+	fs := newWinfspTestFS()
+	h := newTestWinfspHost(t, MountConfig{MaxWrite: 4096}, fs)
+
+	if errc := h.Mkdir("/dir", 0755); errc != 0 {
+		t.Fatalf("Mkdir: %d", errc)
+	}
+
+	if errc := h.Mkdir("/dir", 0755); errc != -fuse.EEXIST {
+		t.Errorf("Mkdir again: got %d, want %d", errc, -fuse.EEXIST)
+	}
+
+	errc, fh := h.Create("/dir/f", fuse.O_RDWR, 0644)
+	if errc != 0 {
+		t.Fatalf("Create: %d", errc)
+	}
+
+	// More than MaxWrite, so that the write and read are split.
+	data := bytes.Repeat([]byte("abcdefgh"), 2048)
+	if n := h.Write("/dir/f", data, 0, fh); n != len(data) {
+		t.Errorf("Write: got %d, want %d", n, len(data))
+	}
+
+	buf := make([]byte, len(data)+100)
+	if n := h.Read("/dir/f", buf, 0, fh); n != len(data) || !bytes.Equal(buf[:n], data) {
+		t.Errorf("Read: got %d bytes, want %d", n, len(data))
+	}
+
+	// Neither should be larger than the connection's buffers allow.
+	fs.mu.Lock()
+	if fs.maxWrite > 4096 || fs.maxRead > h.maxRead {
+		t.Errorf("Largest write %d, read %d; want at most 4096, %d", fs.maxWrite, fs.maxRead, h.maxRead)
+	}
+	fs.mu.Unlock()
+
+	if errc := h.Truncate("/dir/f", 5, fh); errc != 0 {
+		t.Errorf("Truncate: %d", errc)
+	}
+
+	var st fuse.Stat_t
+	if errc := h.Getattr("/dir/f", &st, fh); errc != 0 {
+		t.Fatalf("Getattr: %d", errc)
+	}
+
+	if st.Size != 5 || st.Mode&fuse.S_IFMT != fuse.S_IFREG {
+		t.Errorf("Getattr: size %d, mode %o", st.Size, st.Mode)
+	}
+
+	if errc := h.Release("/dir/f", fh); errc != 0 {
+		t.Errorf("Release: %d", errc)
+	}
+
+	errc, dh := h.Opendir("/dir")
+	if errc != 0 {
+		t.Fatalf("Opendir: %d", errc)
+	}
+
+	var names []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		names = append(names, name)
+		return true
+	}
+
+	if errc := h.Readdir("/dir", fill, 0, dh); errc != 0 {
+		t.Errorf("Readdir: %d", errc)
+	}
+
+	if strings.Join(names, ",") != "f" {
+		t.Errorf("Readdir: got %q", names)
+	}
+
+	h.Releasedir("/dir", dh)
+
+	if errc := h.Rename("/dir/f", "/dir/g"); errc != 0 {
+		t.Fatalf("Rename: %d", errc)
+	}
+
+	if errc := h.Getattr("/dir/f", &st, winfspNoHandle); errc != -fuse.ENOENT {
+		t.Errorf("Getattr old path: got %d, want %d", errc, -fuse.ENOENT)
+	}
+
+	if errc := h.Getattr("/dir/g", &st, winfspNoHandle); errc != 0 {
+		t.Errorf("Getattr new path: %d", errc)
+	}
+
+	if errc := h.Unlink("/dir/g"); errc != 0 {
+		t.Errorf("Unlink: %d", errc)
+	}
+
+	// Forgets have no reply; a request after them is served after them.
+	var sfs fuse.Statfs_t
+	if errc := h.Statfs("/", &sfs); errc != 0 || sfs.Blocks != 42 {
+		t.Errorf("Statfs: %d, %d blocks", errc, sfs.Blocks)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id := fuseops.InodeID(fuseops.RootInodeID + 2)
+	if fs.lookups[id] == 0 || fs.forgets[id] != fs.lookups[id] {
+		t.Errorf("Unlinked file: %d lookups, %d forgotten", fs.lookups[id], fs.forgets[id])
+	}
+}
+
+func TestWinfspHostReadOnly(t *testing.T) {
+	h := newTestWinfspHost(t, MountConfig{ReadOnly: true}, newWinfspTestFS())
+
+	if errc := h.Mkdir("/dir", 0755); errc != -fuse.EROFS {
+		t.Errorf("Mkdir: got %d, want %d", errc, -fuse.EROFS)
+	}
+
+	if errc, _ := h.Open("/", fuse.O_RDWR); errc != -fuse.EROFS {
+		t.Errorf("Open for writing: got %d, want %d", errc, -fuse.EROFS)
+	}
+
+	errc, fh := h.Opendir("/")
+	if errc != 0 {
+		t.Errorf("Opendir: %d", errc)
+	}
+
+	h.Releasedir("/", fh)
+}
+
+func TestWinfspErrc(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{syscall.ENOENT, -fuse.ENOENT},
+		{syscall.ENOTDIR, -fuse.ENOTDIR},
+		{syscall.ENOTEMPTY, -fuse.ENOTEMPTY},
+		{syscall.ENODATA, -fuse.ENODATA},
+		{syscall.ENOTCONN, -fuse.ENOTCONN},
+		{syscall.Errno(12345), -fuse.EIO},
+		{errors.New("taco"), -fuse.EIO},
+	}
+
+	for _, c := range cases {
+		if got := winfspErrc(c.err); got != c.want {
+			t.Errorf("winfspErrc(%v): got %d, want %d", c.err, got, c.want)
+		}
+	}
+}
+
+func TestWinfspOpenFlags(t *testing.T) {
+	cases := []struct {
+		flags int
+		want  uint32
+	}{
+		{fuse.O_RDONLY, syscall.O_RDONLY},
+		{fuse.O_WRONLY | fuse.O_APPEND, syscall.O_WRONLY | syscall.O_APPEND},
+		{fuse.O_RDWR | fuse.O_CREAT | fuse.O_EXCL, syscall.O_RDWR | syscall.O_CREAT | syscall.O_EXCL},
+		{fuse.O_WRONLY | fuse.O_TRUNC, syscall.O_WRONLY | syscall.O_TRUNC},
+	}
+
+	for _, c := range cases {
+		if got := winfspOpenFlags(c.flags); got != c.want {
+			t.Errorf("winfspOpenFlags(%#x): got %#x, want %#x", c.flags, got, c.want)
+		}
+	}
+}
+
+func TestWinfspOptions(t *testing.T) {
+	opts := winfspOptions(&MountConfig{
+		VolumeName: "vol",
+		Options:    map[string]string{"ThreadCount": "4"},
+	})
+
+	if len(opts) != 2 || opts[0] != "-o" {
+		t.Fatalf("winfspOptions: %q", opts)
+	}
+
+	got := strings.Split(opts[1], ",")
+	sort.Strings(got)
+	want := []string{"ThreadCount=4", "gid=-1", "uid=-1", "volname=vol"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("winfspOptions: got %q, want %q", got, want)
+	}
+}
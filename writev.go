@@ -1,11 +1,31 @@
+//go:build !windows
+// +build !windows
+
 package fuse
 
 import (
+	"fmt"
+	"os"
 	"syscall"
 	"unsafe"
 )
 
-func writev(fd int, packet [][]byte) (n int, err error) {
+// Write the supplied message to the kernel through the given device.
+func writeMessage(dev *os.File, msg []byte) error {
+	// Avoid the retry loop in os.File.Write.
+	n, err := syscall.Write(int(dev.Fd()), msg)
+	if err != nil {
+		return err
+	}
+
+	if n != len(msg) {
+		return fmt.Errorf("Wrote %d bytes; expected %d", n, len(msg))
+	}
+
+	return nil
+}
+
+func writev(dev *os.File, packet [][]byte) (n int, err error) {
 	iovecs := make([]syscall.Iovec, 0, len(packet))
 	for _, v := range packet {
 		if len(v) == 0 {
@@ -19,7 +39,7 @@ func writev(fd int, packet [][]byte) (n int, err error) {
 	}
 	n1, _, e1 := syscall.Syscall(
 		syscall.SYS_WRITEV,
-		uintptr(fd), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)),
+		dev.Fd(), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)),
 	)
 	n = int(n1)
 	if e1 != 0 {
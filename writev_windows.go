@@ -0,0 +1,40 @@
+package fuse
+
+import (
+	"fmt"
+	"os"
+)
+
+// Write the supplied message to the WinFsp layer through the given device,
+// the connection's end of a message-mode pipe (see newDevicePair).
+//
+// Unlike on unix this goes through os.File rather than the raw handle:
+// calling Fd on an overlapped file takes it out of the runtime's poller.
+func writeMessage(dev *os.File, msg []byte) error {
+	n, err := dev.Write(msg)
+	if err != nil {
+		return err
+	}
+
+	if n != len(msg) {
+		return fmt.Errorf("Wrote %d bytes; expected %d", n, len(msg))
+	}
+
+	return nil
+}
+
+// There is no writev(2), and each write to the pipe is a message of its own,
+// so gather the packet into a single write.
+func writev(dev *os.File, packet [][]byte) (n int, err error) {
+	var size int
+	for _, v := range packet {
+		size += len(v)
+	}
+
+	buf := make([]byte, 0, size)
+	for _, v := range packet {
+		buf = append(buf, v...)
+	}
+
+	return dev.Write(buf)
+}